@@ -3,22 +3,38 @@ package cmd
 import (
 	"context"
 	"database/sql"
+	"encoding/json"
+	"flag"
 	"fmt"
 	"log"
 	"os"
+	"path/filepath"
+	"strconv"
 	"strings"
+	"time"
 
 	"deduplicator/db"
 	"deduplicator/files"
 	"deduplicator/lock"
 	"deduplicator/mq"
+	"deduplicator/notify"
 )
 
 // App represents the main application
 type App struct {
-	version string
-	rabbit  *mq.RabbitMQ
-	db      *sql.DB
+	version  string
+	commit   string // build commit, when known
+	rabbit   *mq.RabbitMQ
+	db       *sql.DB
+	readOnly bool
+	// autoRegister adds a hosts row for this machine when a command that
+	// resolves the local host finds none.
+	autoRegister bool
+	// notifier reports long or failed runs; nil when none is configured.
+	notifier *notify.Notifier
+	// statementTimeout bounds every statement of the command being run;
+	// zero means unlimited.
+	statementTimeout time.Duration
 }
 
 // NewApp creates a new App instance
@@ -28,15 +44,33 @@ func NewApp(version string) *App {
 	}
 }
 
+// SetCommit records the commit the binary was built from, carried in the
+// version updates it publishes and compared against forced ones it receives.
+func (a *App) SetCommit(commit string) {
+	a.commit = commit
+}
+
 // HandleCommand processes and executes a command
 func (a *App) HandleCommand(ctx context.Context, args []string) error {
+	args, global, err := parseGlobalFlags(args)
+	if err != nil {
+		return err
+	}
+	a.readOnly = a.readOnly || global.readOnly
+	a.autoRegister = a.autoRegister || global.autoRegister
+	a.notifier = notify.FromEnv(global.notifyMinDuration)
+	a.statementTimeout = statementTimeoutFor(args[1:])
+	if global.dbTimeout >= 0 {
+		a.statementTimeout = global.dbTimeout
+	}
+
 	if len(args) < 2 {
 		PrintUsage(a.version)
 		return fmt.Errorf("no command provided")
 	}
 
 	// Check for help command
-	if args[1] == "help" {
+	if args[1] == "help" || args[1] == "--help" || args[1] == "-h" {
 		if len(args) == 2 {
 			PrintUsage(a.version)
 			return nil
@@ -92,7 +126,7 @@ func (a *App) HandleCommand(ctx context.Context, args []string) error {
 	if args[1] == "listen" || args[1] == "queue" {
 		if os.Getenv("RABBITMQ_HOST") != "" {
 			var err error
-			a.rabbit, err = mq.NewRabbitMQ(a.version)
+			a.rabbit, err = mq.NewRabbitMQ(a.version, a.commit)
 			if err != nil {
 				log.Printf("Warning: Failed to connect to RabbitMQ: %v", err)
 			} else {
@@ -118,6 +152,10 @@ func (a *App) HandleCommand(ctx context.Context, args []string) error {
 
 	// Handle commands that don't need database access
 	switch args[1] {
+	case "files":
+		if len(args) > 2 && args[2] == "import-status" {
+			return HandleImportStatus(args[3:])
+		}
 	case "listen":
 		<-ctx.Done() // Just wait for shutdown since we're already listening
 		return nil
@@ -128,19 +166,31 @@ func (a *App) HandleCommand(ctx context.Context, args []string) error {
 
 		switch args[2] {
 		case "version":
+			queueCmd := flag.NewFlagSet("queue version", flag.ExitOnError)
+			version := queueCmd.String("version", a.version, "Version to publish")
+			forceUpdate := queueCmd.Bool("force-update", false, "Also stop listeners running the same version from another commit")
+			if err := queueCmd.Parse(args[3:]); err != nil {
+				return fmt.Errorf("error parsing command flags: %v", err)
+			}
 			if a.rabbit == nil {
 				return fmt.Errorf("RabbitMQ connection not available")
 			}
-			return HandleQueueVersion(ctx, a.rabbit, a.version, a.version)
+			return HandleQueueVersion(ctx, a.rabbit, *version, a.version, a.commit, *forceUpdate)
 		default:
 			return fmt.Errorf("unknown queue subcommand: %s", args[2])
 		}
 	}
 
+	if a.readOnly {
+		if err := refuseInReadOnly(args[1:]); err != nil {
+			return err
+		}
+	}
+
 	// Acquire flow-specific lock before proceeding
 	var lockFile *lock.Lock
 	switch args[1] {
-	case "migrate", "createdb", "update", "hash":
+	case "migrate", "createdb", "update", "hash", "maintain":
 		lockFile = lock.MustAcquire(args[1])
 		defer lockFile.Release()
 	case "files":
@@ -148,6 +198,10 @@ func (a *App) HandleCommand(ctx context.Context, args []string) error {
 			lockFile = lock.MustAcquire("prune")
 			defer lockFile.Release()
 		}
+		if len(args) > 2 && args[2] == "rehash-all" {
+			lockFile = lock.MustAcquire("rehash-all")
+			defer lockFile.Release()
+		}
 	}
 
 	// Connect to database
@@ -156,6 +210,12 @@ func (a *App) HandleCommand(ctx context.Context, args []string) error {
 	}
 	defer a.db.Close()
 
+	if a.autoRegister && resolvesLocalHost(args[1:]) {
+		if err := autoRegisterLocalHost(a.db); err != nil {
+			return err
+		}
+	}
+
 	// Execute command
 	switch args[1] {
 	case "migrate":
@@ -165,13 +225,13 @@ func (a *App) HandleCommand(ctx context.Context, args []string) error {
 		return db.CreateDatabase(a.db, false) // TODO: Add force flag support
 	case "update":
 		// Parse update command flags
-		flags := CreateFlagSets(a.version)
-		updateCmd := flags["update"]
+		updateCmd := flag.NewFlagSet("update", flag.ExitOnError)
+		register := updateCmd.Bool("register", false, "Register this machine as a host if no host matches its hostname")
 		if err := updateCmd.Parse(args[2:]); err != nil {
 			return fmt.Errorf("error parsing update command flags: %v", err)
 		}
 
-		return files.ProcessStdin(ctx, a.db)
+		return files.ProcessStdin(ctx, a.db, files.UpdateOptions{Register: *register})
 	case "problematic":
 		hostname, err := os.Hostname()
 		if err != nil {
@@ -189,7 +249,7 @@ func (a *App) HandleCommand(ctx context.Context, args []string) error {
 		`, hostname).Scan(&hostName)
 		if err != nil {
 			if err == sql.ErrNoRows {
-				return fmt.Errorf("no host found for hostname %s, please add it using 'deduplicator manage add'", hostname)
+				return files.UnknownHostError(hostname)
 			}
 			return err
 		}
@@ -198,14 +258,55 @@ func (a *App) HandleCommand(ctx context.Context, args []string) error {
 	case "manage":
 		return HandleManage(a.db, args[2:])
 	case "files":
+		if len(args) > 2 && notifiesOnFinish(args[2]) {
+			return a.runNotified("files "+args[2], func(stats *files.RunStats) error {
+				return handleFiles(ctx, a.db, args[2:], stats)
+			})
+		}
 		return HandleFiles(ctx, a.db, args[2:])
 	case "server":
 		return HandleServer(ctx, a.db, args[2:])
+	case "doctor":
+		return HandleDoctor(ctx, a.db, args[2:])
+	case "maintain":
+		return HandleMaintain(ctx, a.db, args[2:])
 	default:
 		return fmt.Errorf("unknown command: %s", args[1])
 	}
 }
 
+// notifiesOnFinish reports whether a files subcommand is a long run whose
+// outcome is sent to the configured notifier.
+func notifiesOnFinish(subcommand string) bool {
+	switch subcommand {
+	case "hash", "rehash-all", "verify", "find", "prune", "import", "mirror", "mirror-group", "group-replicate":
+		return true
+	}
+	return false
+}
+
+// runNotified runs fn and, if it failed or ran for longer than the notify
+// threshold, sends its summary to the notifier. Notification failures are
+// only logged and never change the outcome of the run.
+func (a *App) runNotified(command string, fn func(stats *files.RunStats) error) error {
+	if a.notifier == nil {
+		return fn(nil)
+	}
+
+	stats := &files.RunStats{}
+	started := time.Now()
+	err := fn(stats)
+
+	result := notify.NewResult(command, a.version, started, stats.Counters(), err)
+	if a.notifier.ShouldNotify(result) {
+		// The run's own context may already be cancelled; notify regardless.
+		if nerr := a.notifier.Notify(context.Background(), result); nerr != nil {
+			log.Printf("Warning: failed to send notification for %s: %v", command, nerr)
+		}
+	}
+	return err
+}
+
 // connectDB establishes a connection to the database
 func (a *App) connectDB() error {
 	dbHost := os.Getenv("DB_HOST")
@@ -231,6 +332,304 @@ func (a *App) connectDB() error {
 	dbPassword := os.Getenv("DB_PASSWORD")
 
 	var err error
-	a.db, err = db.Connect(dbHost, dbPort, dbUser, dbPassword, dbName)
+	if a.readOnly {
+		a.db, err = db.ConnectReadOnly(dbHost, dbPort, dbUser, dbPassword, dbName, a.statementTimeout)
+		return err
+	}
+	a.db, err = db.Connect(dbHost, dbPort, dbUser, dbPassword, dbName, a.statementTimeout)
 	return err
 }
+
+// interactiveStatementTimeout is how long a single statement of an
+// interactive listing may run before it fails instead of waiting on an
+// overloaded database.
+const interactiveStatementTimeout = 30 * time.Second
+
+// commandStatementTimeouts maps a command ("files list-dupes", "manage") to
+// its statement timeout. Commands not listed are batch flows such as hash,
+// find and prune, which run without a limit.
+var commandStatementTimeouts = map[string]time.Duration{
+	"files list-dupes":    interactiveStatementTimeout,
+	"files stats":         interactiveStatementTimeout,
+	"files unhashed":      interactiveStatementTimeout,
+	"files dupe-report":   interactiveStatementTimeout,
+	"files export-hashes": interactiveStatementTimeout,
+	"manage":              interactiveStatementTimeout,
+	"problematic":         interactiveStatementTimeout,
+	"doctor":              interactiveStatementTimeout,
+}
+
+// batchModeFlags lists, per command of commandStatementTimeouts, the flags
+// that turn it into a batch flow: doctor --fix runs table-wide UPDATEs, and
+// list-dupes keeps its duplicate query open while it moves, deletes or waits
+// on a prompt, which Postgres counts against the statement timeout.
+var batchModeFlags = map[string][]string{
+	"files list-dupes": {"dest", "delete", "interactive"},
+	"doctor":           {"fix"},
+}
+
+// statementTimeoutFor returns the default statement timeout of a command.
+// args starts at the command name.
+func statementTimeoutFor(args []string) time.Duration {
+	if len(args) == 0 {
+		return 0
+	}
+	command, flagArgs := args[0], args[1:]
+	if len(args) > 1 {
+		if _, ok := commandStatementTimeouts[args[0]+" "+args[1]]; ok {
+			command, flagArgs = args[0]+" "+args[1], args[2:]
+		}
+	}
+	for _, name := range batchModeFlags[command] {
+		if flagGiven(flagArgs, name) {
+			return 0
+		}
+	}
+	return commandStatementTimeouts[command]
+}
+
+// flagGiven reports whether args set the flag name, as -name, --name or
+// --name=value; a boolean turned off with =false does not count.
+func flagGiven(args []string, name string) bool {
+	for _, arg := range args {
+		if arg == "--" {
+			return false
+		}
+		arg = strings.TrimPrefix(strings.TrimPrefix(arg, "-"), "-")
+		if arg == name {
+			return true
+		}
+		if value, ok := strings.CutPrefix(arg, name+"="); ok {
+			if on, err := strconv.ParseBool(value); value != "" && (err != nil || on) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// globalOptions are the flags accepted before the command name.
+type globalOptions struct {
+	readOnly     bool // --read-only / DEDUPE_READ_ONLY
+	autoRegister bool // --auto-register / AUTO_REGISTER
+	// notifyMinDuration is how long a successful run must take before it is
+	// notified (--notify-min-duration / NOTIFY_MIN_DURATION).
+	notifyMinDuration time.Duration
+	// dbTimeout overrides the per-command statement timeout (--db-timeout /
+	// DB_TIMEOUT); 0 means unlimited and -1 keeps the command's default.
+	dbTimeout time.Duration
+}
+
+// parseGlobalFlags strips global flags given before the command name. Each
+// flag can also be enabled through its environment variable.
+func parseGlobalFlags(args []string) ([]string, globalOptions, error) {
+	opts := globalOptions{notifyMinDuration: notify.DefaultMinDuration, dbTimeout: -1}
+	durations := map[string]*time.Duration{
+		"notify-min-duration": &opts.notifyMinDuration,
+		"db-timeout":          &opts.dbTimeout,
+	}
+	for name, env := range map[string]string{"notify-min-duration": "NOTIFY_MIN_DURATION", "db-timeout": "DB_TIMEOUT"} {
+		if v := os.Getenv(env); v != "" {
+			d, err := files.ParseDuration(v)
+			if err != nil {
+				return nil, opts, fmt.Errorf("invalid %s value %q: %v", env, v, err)
+			}
+			*durations[name] = d
+		}
+	}
+	flags := map[string]*bool{
+		"read-only":     &opts.readOnly,
+		"auto-register": &opts.autoRegister,
+	}
+	for name, env := range map[string]string{"read-only": "DEDUPE_READ_ONLY", "auto-register": "AUTO_REGISTER"} {
+		if v := os.Getenv(env); v != "" {
+			parsed, err := strconv.ParseBool(v)
+			if err != nil {
+				return nil, opts, fmt.Errorf("invalid %s value %q: %v", env, v, err)
+			}
+			*flags[name] = parsed
+		}
+	}
+
+	rest := args
+	if len(rest) > 0 {
+		rest = rest[1:]
+	}
+	for len(rest) > 0 && strings.HasPrefix(rest[0], "--") {
+		name, value, hasValue := strings.Cut(strings.TrimPrefix(rest[0], "--"), "=")
+		if duration, ok := durations[name]; ok {
+			if !hasValue {
+				if len(rest) < 2 {
+					return nil, opts, fmt.Errorf("--%s requires a value", name)
+				}
+				value = rest[1]
+				rest = rest[1:]
+			}
+			d, err := files.ParseDuration(value)
+			if err != nil {
+				return nil, opts, fmt.Errorf("invalid --%s value %q: %v", name, value, err)
+			}
+			*duration = d
+			rest = rest[1:]
+			continue
+		}
+		target, ok := flags[name]
+		if !ok {
+			break
+		}
+		*target = true
+		if hasValue {
+			parsed, err := strconv.ParseBool(value)
+			if err != nil {
+				return nil, opts, fmt.Errorf("invalid --%s value %q: %v", name, value, err)
+			}
+			*target = parsed
+		}
+		rest = rest[1:]
+	}
+	if len(args) == 0 {
+		return args, opts, nil
+	}
+	return append([]string{args[0]}, rest...), opts, nil
+}
+
+// readOnlySafeCommands lists what can still be run against the catalog in
+// read-only mode.
+const readOnlySafeCommands = "files list-dupes (without --run), files verify (without --reset-mismatched), files stats, files unhashed, files dupe-report, files unique (without --copy-to), files export-hashes, doctor (without --fix), problematic, manage server-list, manage path-list, manage group-list, manage group-show"
+
+// refuseInReadOnly rejects commands whose purpose is to write, before any
+// lock is taken or connection opened. args starts at the command name.
+func refuseInReadOnly(args []string) error {
+	command := args[0]
+	switch command {
+	case "update", "migrate", "createdb", "maintain":
+	case "doctor":
+		if !hasFixFlag(args[1:]) {
+			return nil
+		}
+		command = "doctor --fix"
+	case "files":
+		if len(args) < 2 {
+			return nil
+		}
+		command = "files " + args[1]
+		switch args[1] {
+		case "import", "import-hashes", "find", "hash", "hash-upgrade", "rehash-all", "prune", "undelete", "vacuum", "analyze", "move-dupes", "undo-moves", "mirror", "mirror-group", "group-replicate", "dedupe-group", "group-dedupe":
+		case "list-dupes":
+			if !hasRunFlag(args[2:]) {
+				return nil
+			}
+			command = "files list-dupes --run"
+		case "unique":
+			if !hasCopyToFlag(args[2:]) {
+				return nil
+			}
+			command = "files unique --copy-to"
+		case "verify":
+			if !hasResetMismatchedFlag(args[2:]) {
+				return nil
+			}
+			command = "files verify --reset-mismatched"
+		default:
+			return nil
+		}
+	default:
+		return nil
+	}
+	return fmt.Errorf("%s writes to the database and cannot run in read-only mode; read-only-safe alternatives: %s", command, readOnlySafeCommands)
+}
+
+func hasFixFlag(args []string) bool {
+	for _, arg := range args {
+		switch arg {
+		case "--fix", "-fix", "--fix=true", "-fix=true", "--fix=1", "-fix=1":
+			return true
+		}
+	}
+	return false
+}
+
+func hasRunFlag(args []string) bool {
+	for _, arg := range args {
+		switch arg {
+		case "--run", "-run", "--run=true", "-run=true", "--run=1", "-run=1":
+			return true
+		}
+	}
+	return false
+}
+
+func hasResetMismatchedFlag(args []string) bool {
+	for _, arg := range args {
+		switch arg {
+		case "--reset-mismatched", "-reset-mismatched", "--reset-mismatched=true", "-reset-mismatched=true", "--reset-mismatched=1", "-reset-mismatched=1":
+			return true
+		}
+	}
+	return false
+}
+
+func hasCopyToFlag(args []string) bool {
+	for _, arg := range args {
+		if arg == "--copy-to" || arg == "-copy-to" || strings.HasPrefix(arg, "--copy-to=") || strings.HasPrefix(arg, "-copy-to=") {
+			return true
+		}
+	}
+	return false
+}
+
+// resolvesLocalHost reports whether the command looks up the hosts row of the
+// machine it runs on. args starts at the command name.
+func resolvesLocalHost(args []string) bool {
+	switch args[0] {
+	case "update", "maintain":
+		return true
+	case "files":
+		if len(args) < 2 {
+			return false
+		}
+		switch args[1] {
+		case "prune":
+			return true
+		case "find", "hash", "rehash-all":
+			for _, arg := range args[2:] {
+				if arg == "--server" || arg == "-server" || strings.HasPrefix(arg, "--server=") || strings.HasPrefix(arg, "-server=") {
+					return false
+				}
+			}
+			return true
+		}
+	}
+	return false
+}
+
+// autoRegisterLocalHost registers this machine under its lowercased hostname
+// if no host matches it yet, seeding friendly paths from AUTO_REGISTER_PATHS
+// (a JSON object, set from the [paths] section of config.ini).
+func autoRegisterLocalHost(database *sql.DB) error {
+	hostname, err := os.Hostname()
+	if err != nil {
+		return fmt.Errorf("error getting hostname: %v", err)
+	}
+
+	var paths map[string]string
+	if raw := os.Getenv("AUTO_REGISTER_PATHS"); raw != "" {
+		if err := json.Unmarshal([]byte(raw), &paths); err != nil {
+			return fmt.Errorf("invalid AUTO_REGISTER_PATHS: %v", err)
+		}
+		for friendly, abs := range paths {
+			if !filepath.IsAbs(abs) {
+				return fmt.Errorf("invalid AUTO_REGISTER_PATHS: path %q for %q is not absolute", abs, friendly)
+			}
+		}
+	}
+
+	registered, err := db.RegisterHostIfMissing(database, hostname, paths)
+	if err != nil {
+		return fmt.Errorf("error auto-registering host: %v", err)
+	}
+	if registered {
+		log.Printf("Auto-registered host %s with %d friendly path(s)", strings.ToLower(hostname), len(paths))
+	}
+	return nil
+}
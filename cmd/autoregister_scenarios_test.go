@@ -0,0 +1,84 @@
+package cmd
+
+import (
+	"encoding/json"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+func TestAutoRegisterLocalHostSeedsPathsAndIsIdempotent(t *testing.T) {
+	hostname, err := os.Hostname()
+	if err != nil {
+		t.Skipf("hostname unavailable: %v", err)
+	}
+	hostname = strings.ToLower(hostname)
+	t.Setenv("AUTO_REGISTER_PATHS", `{"photos":"/data/photos"}`)
+
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("sqlmock: %v", err)
+	}
+	defer db.Close()
+
+	mock.ExpectQuery("SELECT EXISTS").
+		WithArgs(hostname).
+		WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(false))
+	mock.ExpectExec("INSERT INTO hosts").
+		WithArgs(hostname, json.RawMessage(`{"paths":{"photos":"/data/photos"}}`)).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectQuery("SELECT EXISTS").
+		WithArgs(hostname).
+		WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(true))
+
+	for run := 0; run < 2; run++ {
+		if err := autoRegisterLocalHost(db); err != nil {
+			t.Fatalf("run %d: %v", run+1, err)
+		}
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatalf("unmet expectations: %v", err)
+	}
+}
+
+func TestAutoRegisterRejectsRelativeSeedPaths(t *testing.T) {
+	t.Setenv("AUTO_REGISTER_PATHS", `{"photos":"data/photos"}`)
+	if err := autoRegisterLocalHost(nil); err == nil || !strings.Contains(err.Error(), "not absolute") {
+		t.Fatalf("expected relative path to be rejected, got %v", err)
+	}
+}
+
+func TestAutoRegisterOnlyForLocalHostCommands(t *testing.T) {
+	cases := map[string]bool{
+		"update":                         true,
+		"files hash":                     true,
+		"files hash --server Backup1":    false,
+		"files prune":                    true,
+		"maintain":                       true,
+		"files find":                     true,
+		"files find --path photos":       true,
+		"files find --server Backup1":    false,
+		"files find --server=Backup1":    false,
+		"files list-dupes":               false,
+		"manage server-list":             false,
+		"files import --server Backup1 ": false,
+	}
+	for command, want := range cases {
+		if got := resolvesLocalHost(strings.Fields(command)); got != want {
+			t.Errorf("resolvesLocalHost(%q) = %v, want %v", command, got, want)
+		}
+	}
+
+	t.Setenv("AUTO_REGISTER", "1")
+	t.Setenv("DEDUPE_READ_ONLY", "")
+	_, global, err := parseGlobalFlags([]string{"deduplicator", "files", "hash"})
+	if err != nil || !global.autoRegister {
+		t.Fatalf("expected AUTO_REGISTER=1 to enable auto-registration, got %+v (%v)", global, err)
+	}
+	t.Setenv("AUTO_REGISTER", "")
+	if _, global, _ := parseGlobalFlags([]string{"deduplicator", "--auto-register", "files", "hash"}); !global.autoRegister {
+		t.Fatal("expected --auto-register to enable auto-registration")
+	}
+}
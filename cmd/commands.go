@@ -56,6 +56,7 @@ Server Subcommands:
   server-list                                 - List all registered servers
   server-add "Friendly server name" --hostname <hostname> [--ip <ip>]   - Add a new server
   server-edit "Current friendly name" [--new-friendly-name <new name>] [--hostname <hostname>] [--ip <ip>] - Edit an existing server
+  server-set-ssh <server name> [--user <user>] [--port <port>] [--identity-file <path>] [--option <opt>]... [--clear] - Set how ssh and rsync reach a server
   server-delete "Friendly server name"         - Remove a server
 
 Path Subcommands:
@@ -69,8 +70,9 @@ Path Group Subcommands:
   group-list                                  - List all path groups
   group-show <group name>                     - Show detailed information about a path group
   group-delete <group name>                   - Delete a path group
-  group-add-path <group name> <host name> <friendly path> [--priority N] - Add a path to a group
-  group-remove-path <host name> <friendly path> - Remove a path from its group
+  group-add-path <group name> <host name> <friendly path> [--priority N] - Add a path to a group (also group-member-add)
+  group-member-edit <host name> <friendly path> [--priority N] [--protected[=true|false]] [--read-only[=true|false]] - Change a group member's priority, protection or read-only flag
+  group-remove-path [<group name>] <host name> <friendly path> - Remove a path from its group (also group-member-remove)
 
 Arguments:
   <server name>         - Friendly name for the server
@@ -84,6 +86,7 @@ Arguments:
 			"deduplicator manage server-list",
 			"deduplicator manage server-add \"Backup1\" --hostname backup1.example.com --ip 192.168.1.10",
 			"deduplicator manage server-edit \"Backup1\" --hostname backup1.local --ip 192.168.1.11",
+			"deduplicator manage server-set-ssh \"Backup1\" --user backup --port 2222 --identity-file ~/.ssh/backup_ed25519",
 			"deduplicator manage server-delete \"Backup1\"",
 			"deduplicator manage path-list \"Backup1\"",
 			"deduplicator manage path-add \"Backup1\" \"HomeDir\" \"/home/user\"",
@@ -94,6 +97,7 @@ Arguments:
 			"deduplicator manage group-show photos",
 			"deduplicator manage group-add-path photos brain photos --priority 10",
 			"deduplicator manage group-add-path photos pinky photos --priority 50",
+			"deduplicator manage group-member-edit nas photos --protected",
 			"deduplicator manage group-remove-path brain photos",
 			"deduplicator manage group-delete photos",
 		},
@@ -123,21 +127,53 @@ Options:
 	{
 		Name:        "manage server-edit",
 		Description: "Edit an existing server's details (friendly name, hostname, IP).",
-		Usage:       "manage server-edit \"Current friendly name\" [--new-friendly-name <new name>] [--hostname <hostname>] [--ip <ip>]",
+		Usage:       "manage server-edit \"Current friendly name\" [--new-friendly-name <new name>] [--hostname <hostname>] [--ip <ip>] [--hash-command <cmd>] [--xattr-whitelist <names>]",
 		Help: "Edit the details of an existing server registered in the database.\n\n" +
 			"You must specify the server's current friendly name to identify it.\n\n" +
 			"Options:\n" +
 			"  --new-friendly-name <new name>  Set a new friendly name for the server.\n" +
 			"  --hostname <hostname>           Set a new hostname for the server.\n" +
-			"  --ip <ip>                       Set a new IP address for the server.\n\n" +
+			"  --ip <ip>                       Set a new IP address for the server.\n" +
+			"  --hash-command <cmd>            Checksum command used over ssh to verify files on this\n" +
+			"                                  server (default: sha256sum; e.g. \"shasum -a 256\").\n" +
+			"                                  Pass an empty string to restore the default.\n" +
+			"  --xattr-whitelist <names>       Comma-separated xattr names captured by find/import\n" +
+			"                                  --capture-xattrs and merged by --merge-xattrs\n" +
+			"                                  (e.g. \"user.rating,user.xdg.tags\"). Empty clears it.\n\n" +
 			"If an option is not provided, the corresponding value for the server will remain unchanged.",
 		Examples: []string{
 			"deduplicator manage server-edit \"Old Server Name\" --new-friendly-name \"New Server Name\"",
 			"deduplicator manage server-edit \"My Server\" --hostname \"new.server.hostname.com\"",
 			"deduplicator manage server-edit \"My Server\" --ip \"192.168.1.100\"",
+			"deduplicator manage server-edit \"Mac Mini\" --hash-command \"shasum -a 256\"",
+			"deduplicator manage server-edit \"Brain\" --xattr-whitelist \"user.rating,user.xdg.tags\"",
 			"deduplicator manage server-edit \"Server Alpha\" --new-friendly-name \"Server Beta\" --hostname \"beta.local\" --ip \"10.0.0.5\"",
 		},
 	},
+	{
+		Name:        "manage server-set-ssh",
+		Description: "Set how ssh and rsync reach a server",
+		Usage:       "manage server-set-ssh \"Friendly server name\" [--user <user>] [--port <port>] [--identity-file <path>] [--option <ssh option>]... [--clear]",
+		Help: "Store the ssh settings of a server, for hosts that ~/.ssh/config does not cover.\n\n" +
+			"files import, files mirror, files mirror-group, group dedupe, files hash\n" +
+			"--remote and --dest host:/path moves then run ssh -p PORT -i KEY -l USER -o OPTION ...\n" +
+			"for the server, and rsync -e \"ssh ...\" with the same options. A server\n" +
+			"without settings is reached with plain ssh, as before.\n\n" +
+			"Options:\n" +
+			"  --user <user>            Login user (ssh -l).\n" +
+			"  --port <port>            Port (ssh -p). 0 removes it.\n" +
+			"  --identity-file <path>   Private key (ssh -i), read on the machine running deduplicator.\n" +
+			"  --option <ssh option>    Extra ssh -o option such as \"StrictHostKeyChecking=accept-new\".\n" +
+			"                           Repeat it for several; the given list replaces the stored one.\n" +
+			"  --clear                  Remove the stored settings first.\n\n" +
+			"Settings that are not given keep their value. An empty value removes the user or\n" +
+			"identity file. They are stored as \"ssh\" in the host settings JSON.",
+		Examples: []string{
+			"deduplicator manage server-set-ssh \"NAS\" --user backup --port 2222 --identity-file /home/me/.ssh/nas_ed25519",
+			"deduplicator manage server-set-ssh \"NAS\" --option \"StrictHostKeyChecking=accept-new\" --option \"ConnectTimeout=10\"",
+			"deduplicator manage server-set-ssh \"NAS\" --clear",
+		},
+	},
 	{
 		Name:        "manage server-delete",
 		Description: "Remove a server",
@@ -230,6 +266,9 @@ Options:
 		Usage:       "manage group-add-path <group name> <host name> <friendly path> [--priority N]",
 		Help: `Add a host's friendly path to a group.
 
+The friendly path must already be configured on the host (manage path-add).
+Also available as manage group-member-add.
+
 Priority:
   - Lower numbers = higher priority to keep files (default: 100)`,
 		Examples: []string{
@@ -237,26 +276,58 @@ Priority:
 			"deduplicator manage group-add-path photos pinky photos --priority 50",
 		},
 	},
+	{
+		Name:        "manage group-member-edit",
+		Description: "Change a group member's priority, protection or read-only flag",
+		Usage:       "manage group-member-edit <host name> <friendly path> [--priority N] [--protected[=true|false]] [--read-only[=true|false]]",
+		Help: `Change the priority, protection or read-only flag of a path already in a group.
+
+Protection:
+  - Copies on a protected member are never removed by files dedupe-group,
+    whatever their priority. A group kept above max_copies because of them
+    is reported as "over-replicated but protected".
+
+Read-only:
+  - For archive mounts that must never be modified. Copies on a read-only
+    member are never removed, as for a protected one, and files mirror-group
+    and group-replicate never copy files onto it; its copies still count and
+    serve as sources. A duplicate whose only removable copies are read-only
+    is skipped with a note and counted in the dedupe-group summary.`,
+		Examples: []string{
+			"deduplicator manage group-member-edit nas photos --protected",
+			"deduplicator manage group-member-edit nas photos --protected=false --priority 90",
+			"deduplicator manage group-member-edit archive photos --read-only",
+		},
+	},
 	{
 		Name:        "manage group-remove-path",
 		Description: "Remove a path from its group",
-		Usage:       "manage group-remove-path <host name> <friendly path>",
-		Help:        `Remove a host path from whatever group it belongs to.`,
+		Usage:       "manage group-remove-path [<group name>] <host name> <friendly path>",
+		Help: `Remove a host path from whatever group it belongs to. When a group name is
+given, the path is only removed if it is a member of that group.
+Also available as manage group-member-remove.`,
 		Examples: []string{
 			"deduplicator manage group-remove-path brain photos",
+			"deduplicator manage group-member-remove photos brain photos",
 		},
 	},
 	{
 		Name:        "update",
 		Description: "Process file paths from stdin and update the database",
-		Usage:       "update < file_list.txt",
+		Usage:       "update [--register] < file_list.txt",
 		Help: `Update the database with file paths from standard input.
 
 Each line from stdin should contain a single file path. The paths will be
-associated with the current host and stored in the database for deduplication.`,
+associated with the current host and stored in the database for deduplication.
+
+Options:
+  --register  If no host matches this machine's hostname, register it first
+              with the lowercased hostname as both name and hostname (like
+              the global --auto-register, but for this command only)`,
 		Examples: []string{
 			"find /data -type f | deduplicator update",
 			"cat file_list.txt | deduplicator update",
+			"find /data -type f | deduplicator update --register",
 		},
 	},
 	{
@@ -268,9 +339,16 @@ associated with the current host and stored in the database for deduplication.`,
 Options:
   --force              Rehash selected files even if they already have a hash
   --renew              Recalculate hashes older than 1 week
-  --retry-problematic  Retry files that previously timed out
+  --retry-problematic  Retry files that previously failed to hash; a file that
+                       timed out before gets a longer stall timeout (1m, doubled
+                       for every earlier timeout, up to 16m)
+  --max-attempts N     Timeouts after which a file is marked permanent and only
+                       retried by --force (default 5, 0 = never)
   --full-hash          Hash full contents for all eligible files
   --large-first        Process larger files before smaller files
+  --order ORDER        Order to hash files in: id (default, oldest rows first),
+                       size-desc (same as --large-first) or newest (most recently
+                       added rows first)
   --count N            Process only N files (0 = unlimited)
 
 Note: This command is deprecated. Please use 'files hash' instead.
@@ -328,29 +406,52 @@ Options:
 	{
 		Name:        "queue version",
 		Description: "Publish a version update message to notify running instances",
-		Usage:       "queue version [--version VERSION]",
-		Help:        `Publish a version update message to notify running instances.`,
+		Usage:       "queue version [--version VERSION] [--force-update]",
+		Help: `Publish a version update message to notify running instances.
+
+Listeners shut down when the published version is newer than theirs. When this
+binary publishes its own version, the message also carries its build commit.
+
+Options:
+  --version VERSION  Version to publish (default: this binary's version)
+  --force-update     Also stop listeners on the same version built from another
+                     commit, to roll out rebuilds while testing`,
 		Examples: []string{
 			"deduplicator queue version",
 			"deduplicator queue version --version 1.2.0",
+			"deduplicator queue version --force-update",
 		},
 	},
 	{
 		Name:        "files",
 		Description: "Manage file operations (find, hashing, duplicate detection, pruning)",
-		Usage:       "files [find|list-dupes|move-dupes|hash|hash-upgrade|prune|import|mirror|mirror-group|dedupe-group] [options]",
+		Usage:       "files [find|list-dupes|move-dupes|undo-moves|hash|hash-upgrade|rehash-all|verify|stats|unhashed|dupe-report|unique|export-hashes|import-hashes|prune|undelete|vacuum|analyze|import|import-status|mirror|mirror-group|group-replicate|dedupe-group] [options]",
 		Help: `Manage file operations including finding, hashing, and duplicate detection.
 
 Subcommands:
   find        - Search for files based on criteria
   list-dupes  - List duplicate files
   move-dupes  - Move duplicate files to a destination
+  undo-moves  - Move the copies recorded in a move manifest back
   hash        - Calculate and store file hashes
 	  hash-upgrade - Temporarily upgrade stored hashes to full-file hashes
+  rehash-all  - Throttled, resumable rehash of every file on a host
+  verify      - Re-check stored hashes against the files on disk
+  stats       - List the slowest-hashing files and throughput per friendly path
+  unhashed    - Report the never-hashed backlog by friendly path or age
+  dupe-report - Report the space wasted by duplicates per directory
+  unique      - Report (and optionally copy) content no other host holds
+  export-hashes - Export a hash -> canonical path mapping for backup tooling
+  import-hashes - Mark files whose hashes an external backup already holds
   prune       - Remove entries for files that no longer exist
+  undelete    - Restore rows soft-deleted by prune, dedupe or move
+  vacuum      - Permanently purge rows soft-deleted long ago
+  analyze     - Refresh table statistics and show index usage
   import      - Import files from another location
+  import-status - Show the progress of an import started with --status-file
   mirror      - Mirror a friendly path (implementation-specific)
   mirror-group - Mirror missing hashes across every path in a path group
+  group-replicate - Copy hashes held by fewer members than a group's min_copies
   dedupe-group - Balance/limit duplicates across a path group
 
 Use 'files <subcommand> --help' for more information on a specific subcommand.`,
@@ -362,51 +463,142 @@ Use 'files <subcommand> --help' for more information on a specific subcommand.`,
 			"deduplicator files move-dupes --target /backup/dupes --dry-run",
 			"deduplicator files hash --force",
 			"deduplicator files hash-upgrade",
+			"deduplicator files rehash-all --rate 200/s --daily-window 01:00-06:00",
+			"deduplicator files verify --sample 5",
+			"deduplicator files stats --slowest 50",
+			"deduplicator files unhashed --by age",
+			"deduplicator files dupe-report --depth 2",
+			"deduplicator files unique --server Backup1",
 			"deduplicator files prune",
+			"deduplicator files analyze",
 			"deduplicator files import --source /path/to/files --server myhost --path Photos",
 			"deduplicator files mirror Photos",
 			"deduplicator files mirror-group photos",
+			"deduplicator files group-replicate photos --dry-run",
 			"deduplicator files dedupe-group photos --dry-run",
 		},
 	},
 	{
 		Name:        "files find",
 		Description: "Search for files based on criteria",
-		Usage:       "files find [--server HOSTNAME] [--path PATH_NAME]",
+		Usage:       "files find [--server HOSTNAME] [--path PATH_NAME] [--follow-symlinks] [--max-depth N] [--index-symlink-targets] [--capture-xattrs] [--register] [--report-new FILE] [--max-path-len N]",
 		Help: `Search for files in the database based on specified criteria.
 
 Options:
-  --server HOSTNAME  Host to find files for (defaults to current host)
-  --path PATH_NAME   Friendly path name to search within (optional)`,
+  --server HOSTNAME        Host to find files for (defaults to current host)
+  --path PATH_NAME         Friendly path name to search within (optional)
+  --follow-symlinks        Descend into symlinked directories; directories already
+                           visited are skipped so symlink cycles are safe
+  --max-depth N            Maximum directory depth when following symlinks (default: 64)
+  --index-symlink-targets  Index file symlinks under the link path using the
+                           target's content (skipped by default)
+  --capture-xattrs         Store the server's whitelisted xattrs of each file
+                           (see manage server-edit --xattr-whitelist)
+  --register               Without --server, register this machine as a host
+                           if none matches its hostname
+  --report-new FILE        Append "<friendly>/<relative path>" of every file
+                           indexed for the first time to FILE, one per line,
+                           as each batch of 1000 commits (- writes to stdout
+                           and moves progress and the summary to stderr)
+  --max-path-len N         Skip files whose absolute path is longer than N
+                           bytes (default: 3800); the summary counts them and
+                           lists the longest`,
 		Examples: []string{
 			"deduplicator files find",
 			"deduplicator files find --server myhost",
 			"deduplicator files find --server myhost --path 'My Documents'",
+			"deduplicator files find --path media --follow-symlinks --index-symlink-targets",
+			"deduplicator files find --path media --report-new /var/spool/transcode/new.txt",
 		},
 	},
 	{
 		Name:        "files hash",
-		Description: "Calculate and store file hashes for the current host",
-		Usage:       "files hash [--force] [--renew] [--retry-problematic] [--full-hash] [--large-first] [--path PATH]",
-		Help: `Calculate and store file hashes for deduplication (host is inferred from OS hostname).
+		Description: "Calculate and store file hashes for a host",
+		Usage:       "files hash [--server NAME] [--force] [--renew] [--retry-problematic] [--max-attempts N] [--full-hash] [--large-first] [--order ORDER] [--path PATH] [--only-path NAME] [--min-size SIZE] [--max-size SIZE] [--count N] [--no-resume] [--audit-sample N] [--algo ALGO] [--prescreen] [--no-file-progress] [--remote]",
+		Help: `Calculate and store file hashes for deduplication.
 
 Options:
+  --server NAME        Host to hash, by friendly name or hostname (defaults to the
+                       host matching the OS hostname)
+  --remote             Hash the files of a --server that is not this machine on it
+                       over ssh with its hash command
   --force              Rehash selected files even if they already have a hash
   --renew              Recalculate hashes older than 1 week
-  --retry-problematic  Retry files that previously timed out
+  --retry-problematic  Retry files that previously failed to hash
   --full-hash          Hash full contents for all eligible files
   --large-first        Process larger files before smaller files
   --path PATH          Friendly path or absolute root folder to process first (repeatable)
+  --only-path NAME     Only hash files under this friendly path; the other root
+                       folders of the host are left alone
+  --min-size SIZE      Only hash files at least this large (e.g. 500K, 1.5G)
+  --max-size SIZE      Only hash files at most this large; the summary reports
+                       how many files the size limits left out
+  --count N            Stop after hashing N files and print how many remain
+                       (0 = unlimited; failed and unchanged files do not count)
+  --resume             Continue after the checkpoint of an interrupted run with the
+                       same options (default)
+  --no-resume          Ignore that checkpoint and start from the beginning
+  --audit-sample N     Re-hash N random files hashed this run at the end (default 5,
+                       0 disables)
+  --algo ALGO          Hash algorithm: sha256 (default) or blake3
+  --prescreen          Quick-hash candidates first, then fully hash only files whose
+                       size and quick hash collide with another file
+  --no-file-progress   Only show the overall progress bar, not one bar per file
+                       (the default when stdout is not a terminal)
 
 By default, only files whose size appears more than once on the host are hashed.
-Use --full-hash --force to rehash every file for the current host.`,
+Use --full-hash --force to rehash every file for the host.
+
+With --remote, each file of another host is hashed on that host by running its
+hash command (manage server-edit --hash-command, sha256sum by default) over ssh,
+so only the checksum crosses the network. The command must print a SHA-256 hash.
+As nothing is printed until a file is done, a file may take one stall timeout
+per started GiB. If ssh cannot reach the host, the run stops instead of recording
+every file as failed.
+
+Without --force, a file that already has a hash is only hashed again when its
+size or modification time differs from what files find recorded; the others are
+counted as unchanged in the summary. This keeps --renew runs short. When files
+find sees a new size or modification time it drops the file's hash, so an edit
+is hashed again even if find ran first.
+
+Progress is saved in hash_checkpoints after every batch of 100 files, per host
+and set of options. A run that is interrupted or stopped by --count picks up
+after the last saved file next time; a run that finishes clears its checkpoint.
+
+The audit sample is drawn from every file hashed during the run. Its result is
+printed and added to the run summary sent to the notifier; a file that hashes
+differently on the second read fails the run, as it points at failing hardware
+or a hashing bug.
+
+Each hash is stored with the algorithm that produced it, and files only count as
+duplicates of files hashed with the same algorithm. With --force, rows hashed
+with another algorithm are re-hashed too, so --force --algo blake3 moves a host
+over to BLAKE3. BLAKE3 is much faster than SHA-256 on large files.
+
+With --prescreen, each candidate first gets a quick hash of its size and its
+first and last 64KB, stored in files.quick_hash. Only files whose size and
+quick hash match another file are then hashed in full, which saves most of the
+reading on collections where same-size files usually differ. A file without a
+quick hash, such as one hashed before, counts as a possible match.`,
 		Examples: []string{
 			"deduplicator files hash",
+			"deduplicator files hash --server Backup1",
 			"deduplicator files hash --force",
 			"deduplicator files hash --full-hash --force",
 			"deduplicator files hash --large-first",
+			"deduplicator files hash --order newest",
 			"deduplicator files hash --path Photos --path Videos",
+			"deduplicator files hash --server Backup1 --only-path photos",
+			"deduplicator files hash --server Backup1 --remote",
+			"deduplicator files hash --renew --max-size 50G",
 			"deduplicator files hash --retry-problematic",
+			"deduplicator files hash --audit-sample 20",
+			"deduplicator files hash --count 500",
+			"deduplicator files hash --full-hash --no-resume",
+			"deduplicator files hash --force --algo blake3",
+			"deduplicator files hash --full-hash --prescreen",
+			"deduplicator files hash --no-file-progress >> /var/log/deduplicator-hash.log",
 		},
 	},
 	{
@@ -417,21 +609,278 @@ Use --full-hash --force to rehash every file for the current host.`,
 stored hashes.
 
 This temporary maintenance command compares the newly calculated full hash with
-the stored hash and updates rows whose stored hash differs. It skips NULL hashes,
-TIMEOUT_ERROR, and HASH_ERROR rows.`,
+the stored hash and updates rows whose stored hash differs. It skips files
+without a stored hash.`,
 		Examples: []string{
 			"deduplicator files hash-upgrade",
 		},
 	},
+	{
+		Name:        "files rehash-all",
+		Description: "Throttled, resumable rehash of every file on a host",
+		Usage:       "files rehash-all [--server HOST] [--algo sha256|blake3] [--rate N/s] [--daily-window HH:MM-HH:MM] [--restart]",
+		Help: `Recompute the hash of every live file of a host, for hash algorithm
+migrations or after finding corrupted hashes. Files are taken oldest
+last_hashed_at first (never-hashed files first of all).
+
+Progress is saved after every batch, so a stopped run picks up where it
+left off when started again. Files that fail to hash keep their stored hash
+and are recorded as problematic. A summary is printed for each day.
+
+Options:
+  --server HOST                Host whose files to rehash (defaults to current host)
+  --algo NAME                  Hash algorithm to recompute with: sha256 (default)
+                               or blake3
+  --rate N/s                   Rehash at most N files per second (also N/m, N/h;
+                               default: 0 = unlimited)
+  --daily-window HH:MM-HH:MM   Only rehash between these local times, sleeping
+                               outside them; may span midnight (22:00-04:00)
+  --restart                    Discard the saved checkpoint and start over`,
+		Examples: []string{
+			"deduplicator files rehash-all --rate 200/s --daily-window 01:00-06:00",
+			"deduplicator files rehash-all --server Backup1 --rate 50/s",
+			"deduplicator files rehash-all --restart",
+		},
+	},
+	{
+		Name:        "files verify",
+		Description: "Re-check stored hashes against the files on disk",
+		Usage:       "files verify [--server HOST] [--all | --sample PCT] [--min-size SIZE] [--fail-fast] [--reset-mismatched]",
+		Help: `Re-hash a random sample of the hashed files of a host, or all of them, and
+report the files whose content no longer matches the stored hash. Each file is
+hashed with the algorithm recorded for its row.
+
+Mismatched, missing and unreadable files are listed as they are found, and a
+summary of verified, matched, mismatched, missing and unreadable files is
+printed at the end. The command exits with status 1 when any file mismatches.
+
+Options:
+  --server HOST        Host to verify (defaults to current host)
+  --all                Verify every hashed file
+  --sample PCT         Percentage of hashed files to verify (default: 10)
+  --min-size SIZE      Only verify files at least this large (e.g. 100M)
+  --fail-fast          Stop at the first mismatch
+  --reset-mismatched   Clear the stored hash of mismatched files so the next
+                       files hash run repairs them`,
+		Examples: []string{
+			"deduplicator files verify",
+			"deduplicator files verify --all --min-size 1G",
+			"deduplicator files verify --sample 1 --fail-fast",
+			"deduplicator files verify --all --reset-mismatched",
+		},
+	},
 	{
 		Name:        "files prune",
 		Description: "Remove entries for files that no longer exist",
-		Usage:       "files prune",
+		Usage:       "files prune [--batch-size N] [--keep-symlink-targets]",
 		Help: `Remove database entries for files that no longer exist on disk.
 
-This command helps keep the database in sync with the actual filesystem.`,
+This command helps keep the database in sync with the actual filesystem.
+
+Rows without a root_folder, written before friendly paths, are resolved against
+the host's deprecated root_path and each configured path before anything is
+removed. Those that resolve to an existing file are kept and counted separately;
+re-index their paths with files find so the next prune drops them as duplicates.
+
+Options:
+  --batch-size N          Number of deletions per transaction commit (default: 250)
+  --keep-symlink-targets  Keep entries for symlinks to regular files, as indexed by
+                          files find --index-symlink-targets`,
 		Examples: []string{
 			"deduplicator files prune",
+			"deduplicator files prune --keep-symlink-targets",
+		},
+	},
+	{
+		Name:        "files stats",
+		Description: "Report how long files took to hash",
+		Usage:       "files stats [--server NAME] [--slowest N]",
+		Help: `Report the hash durations recorded in files.hash_duration_ms by files hash,
+rehash-all and process.
+
+The N files that took longest to hash are listed with their size and MB/s,
+followed by the combined throughput of each friendly path, slowest first. A
+friendly path much slower than the others usually sits on a failing disk.
+Files hashed before durations were recorded are left out until they are
+hashed again.
+
+Options:
+  --server string   Host to report on (defaults to the current host)
+  --slowest int     Number of slowest files to list (default: 20)`,
+		Examples: []string{
+			"deduplicator files stats",
+			"deduplicator files stats --server Backup1 --slowest 50",
+		},
+	},
+	{
+		Name:        "files unhashed",
+		Description: "Report files that have never been hashed",
+		Usage:       "files unhashed [--server NAME] [--by path|age] [--output text|json]",
+		Help: `Report the hashing backlog of a host: files whose hash is NULL and that have
+no recorded hashing error in file_errors.
+
+Files are counted per friendly path (--by path, the default) or by how long
+ago the row was created (--by age: <1d, 1-7d, 7-30d, >30d). The ten largest
+unhashed files are listed after the buckets. A large >30d bucket usually means
+hashing is stuck or never runs for that host.
+
+Options:
+  --server string   Host to report on (defaults to the current host)
+  --by string       Bucket by "path" or "age" (default: path)
+  --output string   Output format: text or json (default: text)`,
+		Examples: []string{
+			"deduplicator files unhashed",
+			"deduplicator files unhashed --server Backup1 --by age",
+			"deduplicator files unhashed --output json",
+		},
+	},
+	{
+		Name:        "files dupe-report",
+		Description: "Report the space wasted by duplicates per directory",
+		Usage:       "files dupe-report [--depth N] [--min-size SIZE] [--csv FILE]",
+		Help: `Add up the space held by duplicate copies per directory, to find where the
+waste lives (say, 1.2TB under photos/2019/phone-backups).
+
+Only the copies deduplication would remove are counted: every copy of a group
+but the first by host and path, the one move-dupes keeps by default. Each is
+counted under its directory, relative to its root folder and cut to --depth
+levels, shown under its friendly path. The table lists the directories that
+waste the most first, and ends with the totals.
+
+The report only reads the catalog, so it can run while hashing is still in
+progress: files not hashed yet cannot be matched, and their number is noted
+under the table.
+
+Options:
+  --depth N         Directory levels below each root folder to group by
+                    (default: 2; 0 groups by root folder)
+  --min-size SIZE   Minimum file size to consider (e.g. 1M, 1.5G, 500K)
+  --csv FILE        Also write host,directory,copies,wasted_bytes rows to FILE
+                    (- writes them to stdout instead of the table)`,
+		Examples: []string{
+			"deduplicator files dupe-report",
+			"deduplicator files dupe-report --depth 3 --min-size 10M",
+			"deduplicator files dupe-report --csv waste.csv",
+		},
+	},
+	{
+		Name:        "files unique",
+		Description: "Report content that exists only on one host",
+		Usage:       "files unique [--server NAME] [--against HOST,...|--all] [--min-size SIZE] [--output text|json] [--list] [--copy-to HOST [--dry-run]]",
+		Help: `Report the hashed files of a host whose content (hash and size) is held by
+none of the comparison hosts: the hosts named with --against, or every other
+host (--all, the default). Run it before decommissioning a disk or host to see
+what would be lost.
+
+Results are counted per friendly path with their total size. --list also
+prints each file as it is read; with --output json the files are included in
+the report.
+
+--copy-to copies the unique files to another host under the same friendly
+path, using the transfers of files mirror. Files outside every friendly path,
+or under a friendly path the destination does not have, are skipped and
+counted. The destination's paths are locked for the copy (see --lock-timeout).
+
+Options:
+  --server string        Host to report on (defaults to the current host)
+  --against string       Comma-separated hosts to compare with
+  --all                  Compare with every other host (default)
+  --min-size string      Minimum file size to consider (e.g., "1M", "1.5G")
+  --output string        Output format: text or json (default: text)
+  --list                 Also list each unique file
+  --copy-to string       Copy the unique files to this host
+  --dry-run              With --copy-to, show what would be copied
+  --lock-timeout duration  How long --copy-to waits for mirror or dedupe runs on the destination (default 30s, 0 = indefinitely)`,
+		Examples: []string{
+			"deduplicator files unique --server Backup1",
+			"deduplicator files unique --server Backup1 --against Backup2,nas --min-size 10M",
+			"deduplicator files unique --server Backup1 --list --output json",
+			"deduplicator files unique --server Backup1 --copy-to nas --dry-run",
+		},
+	},
+	{
+		Name:        "files export-hashes",
+		Description: "Export a hash to canonical path mapping for backup tooling",
+		Usage:       "files export-hashes [--server NAME] [--path FRIENDLY] [--format csv|binary] [--changed-since TIMESTAMP]",
+		Help: `Write one record per distinct hash stored for a host to stdout, mapping the
+hash to a single canonical path (the lexicographically smallest full path that
+holds it). Only hashed rows are exported, and records are streamed as they are
+read from the database.
+
+The csv format has a "hash,path" header. The binary format is the magic
+"DDHASH1\n" followed by records of uvarint-length-prefixed hash and path.
+
+Options:
+  --server string         Host to export (defaults to the current host)
+  --path string           Only export files under this friendly path
+  --format string         csv (default) or binary
+  --changed-since string  Only export files hashed at or after this time
+                          (RFC3339 or YYYY-MM-DD), for incremental exports`,
+		Examples: []string{
+			"deduplicator files export-hashes > hashes.csv",
+			"deduplicator files export-hashes --server Backup1 --path photos --format binary > photos.ddh",
+			"deduplicator files export-hashes --changed-since 2024-05-01",
+		},
+	},
+	{
+		Name:        "files import-hashes",
+		Description: "Mark files whose content an external backup already holds",
+		Usage:       "files import-hashes [--file PATH] [--format csv|binary]",
+		Help: `Read a hash export (in the export-hashes format) and set known_external on every
+files row, on any host, whose hash appears in it. Use files list-dupes
+--show-external to see which duplicate groups are already covered by backups.
+
+Options:
+  --file string     Export to read (default: - for stdin)
+  --format string   csv (default) or binary`,
+		Examples: []string{
+			"deduplicator files import-hashes --file backup-known.csv",
+			"deduplicator files import-hashes --format binary < known.ddh",
+		},
+	},
+	{
+		Name:        "files undelete",
+		Description: "Restore recently soft-deleted file rows",
+		Usage:       "files undelete [--server NAME] [--since DURATION] [--path FRIENDLY]",
+		Help: `Prune, dedupe and move mark rows deleted (deleted_at) instead of removing
+them. Undelete clears the mark on rows of a host deleted within --since. Only
+the catalog rows are restored; files removed from disk stay removed. Rows whose
+path has been indexed again since are skipped.
+
+Options:
+  --server string   Host to restore rows for (defaults to current host)
+  --since duration  Restore rows deleted within this window (default: 24h)
+  --path string     Only restore rows under this friendly path`,
+		Examples: []string{
+			"deduplicator files undelete",
+			"deduplicator files undelete --since 2h --path photos",
+		},
+	},
+	{
+		Name:        "files vacuum",
+		Description: "Permanently purge long soft-deleted file rows",
+		Usage:       "files vacuum [--older-than DURATION] [--batch-size N]",
+		Help: `Hard-delete rows on every host that were soft-deleted longer ago than
+--older-than, in batches. Purged rows can no longer be undeleted.
+
+Options:
+  --older-than duration  Purge rows deleted longer ago than this (default: 30d)
+  --batch-size int       Rows removed per statement (default: 1000)`,
+		Examples: []string{
+			"deduplicator files vacuum --older-than 30d",
+		},
+	},
+	{
+		Name:        "files analyze",
+		Description: "Refresh files table statistics and show index usage",
+		Usage:       "files analyze",
+		Help: `Run ANALYZE on the files table and print per-index usage counters from
+pg_stat_user_indexes.
+
+Use this after large imports or migrations to refresh planner statistics and to
+confirm that duplicate detection and hashing queries are using the indexes.`,
+		Examples: []string{
+			"deduplicator files analyze",
 		},
 	},
 	{
@@ -441,7 +890,14 @@ This command helps keep the database in sync with the actual filesystem.`,
 		Help: `Import files from a source directory to a target host.
 
 The command transfers files using rsync and adds them to the database.
-Files that already exist on the target host (based on hash) will be skipped.
+Files whose content already exists on the target host (based on hash) are
+skipped, or moved to --duplicate; see below for a target path that is taken.
+The hashes on the host are loaded once when the run starts, and the rows of
+transferred files are inserted --batch-size at a time, each batch in one
+transaction; a batch that fails is retried one row at a time, so only the
+rows that cannot be inserted count as errors. Files transferred since the
+last batch are recorded when the run ends, however it ends; should the
+process be killed, files find indexes them.
 
 Options:
   --source DIR        Source directory to import files from (required)
@@ -451,40 +907,315 @@ Options:
   --remove-source     Remove source files after successful import
   --dry-run          Show what would be imported without making changes
   --count N          Limit the number of files to process (0 = no limit, default: 0)
-  --age MINUTES      Only import files older than this many minutes`,
+  --age DURATION     Only import files older than this (bare numbers are minutes; also 2h, 7d, 1w)
+  --older-than DURATION  Same as --age, as a duration (2h, 7d, 1w)
+  --newer-than DURATION  Only import files modified less than this long ago
+  --route SUBDIR=FRIENDLY  Import a top-level source subdirectory to its own friendly path (repeatable)
+  --routes-file FILE Read SUBDIR=FRIENDLY routes from FILE, one per line (# starts a comment)
+  --strict-routes    Skip files outside routed subdirectories; --path becomes optional
+  --capture-xattrs   Store the target server's whitelisted xattrs (see manage
+                     server-edit --xattr-whitelist) of each source file
+  --status-file FILE Keep live progress (counters, current file, pid) in FILE,
+                     rewritten every 5s; creating FILE.cancel stops the run
+                     at the next file, like Ctrl-C
+  --transfer-retries N  Attempts per rsync or ssh mkdir (default: 3, 1 = no
+                     retries); see below
+  --max-path-len N   Skip files whose source, target or --duplicate path is
+                     longer than N bytes (default: 3800); the summary counts
+                     them and lists the longest
+  --min-free SIZE|N% Keep this much free space on each destination, as a size
+                     (50G) or a percentage of its filesystem (5%)
+  --free-check-every N  Transferred files between free space checks (default: 20)
+  --exclude GLOB     Skip files and directories matching GLOB, see below (repeatable)
+  --include GLOB     Only import files matching GLOB, see below (repeatable)
+  --workers N        Hash and transfer N files at once (default: 1), see below
+  --verify           Re-hash each transferred copy at the destination, see below
+  --on-conflict MODE What to do when a different file already sits at the
+                     target path: skip (default), overwrite or rename
+  --batch-size N     Transferred files recorded per transaction (default: 100)
+  --bwlimit RATE     Limit each rsync's bandwidth, as rsync --bwlimit takes it
+                     (500 is KiB/s; also 1.5m, 2M)
+  --rsync-opt OPTION Pass OPTION to every rsync, including the fallback of
+                     --duplicate moves across filesystems (repeatable); give
+                     options with a value as one, e.g. --rsync-opt=--timeout=60
+  --summary-json FILE  Write the counters and failed files as JSON when the
+                     run ends, see below; - writes them to stdout
+
+--age (or --older-than) and --newer-than compare each file's modification
+time with the start of the walk, so together they import a window such as
+--older-than 1h --newer-than 30d. Files outside the window are skipped and
+counted as too new or too old; they do not count toward --count, which
+limits the files that pass every filter.
+
+With --summary-json, dry runs and real runs write one JSON document once the
+walk ends: the result (finished, stopped by --min-free, cancelled or failed),
+files processed, the totals and, with routes, each route's counters (files and
+bytes transferred, skipped as already on the host, path conflicts, moved to
+--duplicate, too new or too old, removed from the source, verified, errors),
+and an errors list with the path and message of each file that failed. With
+--summary-json -, stdout carries the document alone and everything else the
+run prints goes to stderr.
+
+With routes, SOURCE/camera/2024/a.jpg routed as camera=Photos lands in
+Photos/2024/a.jpg. Files in other subdirectories go to --path (keeping their
+subdirectory) unless --strict-routes is given. The summary breaks the counters
+down per route.
+
+--exclude and --include match paths relative to --source, as --exclude does
+for files list-dupes: a GLOB without a slash matches any file or directory
+name, so .DS_Store or '*.swp' skip those files anywhere, and a GLOB with a
+slash matches the whole relative path, with ** for any number of directories.
+An excluded directory is not walked at all. With --include, only files
+matching one of its GLOBs are imported; --exclude still wins over it. The
+summary counts the files and directories skipped either way.
+
+When a file already sits at the target path, both are hashed. The same
+content makes the source a duplicate, skipped or moved to --duplicate like a
+file whose hash is already in the catalog for the host. Other content is a
+path conflict: --on-conflict skip leaves both files alone, overwrite replaces
+the target, and rename imports the source next to it as NAME-1.EXT (or the
+first free -N). The summary counts duplicates and path conflicts apart. A
+--dry-run only hashes the files whose target path is taken.
+
+On a remote server, each destination is listed once with ssh find before
+the walk, and the target paths are looked up in that listing instead of
+with one ssh test -e per file. A destination that cannot be listed falls
+back to the per-file checks, with a warning.
+
+With --workers, the walk hands each file to the next free worker, which
+checks, hashes and transfers it, so a LAN import of many small files
+keeps N rsyncs busy. Output lines of different files may interleave; the
+counters and summary are the same as with one worker. Two files of the same
+content are never both imported: the second is skipped (or moved to
+--duplicate) as if it were already on the host. Ctrl-C, or the status file's
+cancel file, starts no new transfer and waits for the ones in flight.
+
+With --verify, each copy is hashed again where it landed (locally, or with
+the server's hash command over ssh) before its row is inserted. A copy that
+does not match the source's SHA-256 is deleted, the source is kept and the
+file counts as an error. --remove-source then removes each source only once
+its copy is verified, instead of through rsync --remove-source-files.
+
+A --dry-run shows the rsync command line of each planned transfer, and checks
+the planned files again after the walk (all of them, or
+the 1000 most recently modified) and lists those that changed or vanished
+meanwhile as still being written, with an --age value that would skip them.
+It also estimates the bytes it would transfer to each destination and warns
+when they do not fit in the free space above --min-free.
+
+With --min-free, the destination's free space is checked (Statfs locally, ssh
+df -P remotely) before the run and every --free-check-every files. When the
+next file would take it under the floor, the run stops after the file in
+flight, prints its summary and fails with "stopped: destination below headroom".
+
+Transfers that fail with a transient exit code (rsync 10, 12 or 30, or 255
+when ssh cannot reach the host) are retried with exponential backoff (2s,
+4s, ... up to 30s, plus jitter). Other failures, such as a missing source
+(rsync 23), are reported at once.`,
 		Examples: []string{
 			"deduplicator files import --source /path/to/files --server myhost --path Photos",
+			"deduplicator files import --source /staging --server myhost --path Inbox --route camera=Photos --route docs=Documents",
+			"deduplicator files import --source /staging --server myhost --routes-file routes.txt --strict-routes",
 			"deduplicator files import --source /path/to/files --server myhost --path Photos --remove-source",
 			"deduplicator files import --source /path/to/files --server myhost --path Photos --dry-run",
+			"deduplicator files import --source /path/to/files --server myhost --path Photos --older-than 1h --newer-than 30d --count 500",
+			"deduplicator files import --source /path/to/files --server myhost --path Photos --min-free 5%",
+			"deduplicator files import --source /path/to/files --server myhost --path Photos --status-file /tmp/import.json",
+			"deduplicator files import --source /path/to/files --server myhost --path Photos --summary-json - | jq .totals",
+			"deduplicator files import --source /staging --server myhost --path Photos --exclude .DS_Store --exclude '**/cache' --include '*.jpg'",
+			"deduplicator files import --source /camera-roll --server myhost --path Photos --workers 8",
+			"deduplicator files import --source /camera-roll --server myhost --path Photos --on-conflict rename",
+			"deduplicator files import --source /path/to/files --server myhost --path Photos --verify --remove-source",
+			"deduplicator files import --source /path/to/files --server myhost --path Photos --bwlimit 500 --rsync-opt=--partial --dry-run",
+		},
+	},
+	{
+		Name:        "files import-status",
+		Description: "Show the progress of an import started with --status-file",
+		Usage:       "files import-status --file FILE",
+		Help: `Show the status file kept by files import --status-file: state, pid,
+start time, current file and counters. A running import whose file has not
+been updated for a minute is flagged as stale.
+
+The file is plain JSON, so jq works too. To stop the import gracefully from
+another terminal, create FILE.cancel.`,
+		Examples: []string{
+			"deduplicator files import-status --file /tmp/import.json",
+			"jq .counters /tmp/import.json",
+			"touch /tmp/import.json.cancel",
 		},
 	},
 	{
 		Name:        "files list-dupes",
-		Description: "List duplicates (or move them if --dest is provided)",
-		Usage:       "files list-dupes [--count N] [--min-size SIZE] [--dest DIR] [--run] [--strip-prefix PREFIX] [--ignore-dest=true|false]",
+		Description: "List duplicates (or move them with --dest, or delete surplus copies with --delete)",
+		Usage:       "files list-dupes [--count N] [--min-size SIZE] [--ignore-empty] [--sort size|count|path|savings] [--show-external] [--context N] [--summary] [--format text|brief|json] [--print0-paths] [--csv FILE] [--exclude GLOB]... [--path NAME] [--dest DIR] [--run] [--strip-prefix PREFIX] [--ignore-dest=true|false] [--recover forward|back] [--merge-xattrs] [--symlink] [--keep POLICY] [--min-copies N] [--interactive] [--verify] [--min-age D] [--max-bytes SIZE] [--lock-timeout D] [--delete [--i-understand-data-loss] [--delete-report FILE]]",
 		Help: `List duplicate files across all hosts.
 
 If --dest is provided, the legacy current-host mover is used (dry-run by default;
 use --run to actually move). For cross-host duplicate archiving, use files move-dupes.
+This host is found by its hostname, and each copy under the root folder recorded
+for it by files find.
 
 Options:
   --count N             Limit number of duplicate groups shown (0 = unlimited)
-  --min-size SIZE       Minimum file size (e.g. 1M, 1.5G, 500K)
-  --dest DIR            Directory to move duplicates to (optional)
+  --min-size SIZE       Minimum file size (e.g. 1M, 1.5G, 500K; default: min_size in
+                        the [dedupe] section of config.ini, or DEDUPE_MIN_SIZE)
+  --ignore-empty        Leave out empty files even without --min-size
+  --sort ORDER          Order of the listed groups: size (largest total first,
+                        default), count (most copies first), path (alphabetically
+                        by first file) or savings (most space freed first); with
+                        --count, picks which groups are shown (listings only)
+  --show-external       Mark groups already held by an external backup (see files import-hashes)
+  --context N           Under each copy, show up to N other indexed files from its
+                        directory and how many there are, to tell which copy is the
+                        stray (listing only; looked up once per directory)
+  --format FORMAT       text (default), brief: one line per group, or json: the
+                        --summary report as JSON, see below
+  --summary             Only report totals, see below; with --format brief, end
+                        the groups with a "total" line instead
+  --print0-paths        Print only the copies on this host that the dedupe flow
+                        would move (all but the keeper), NUL-terminated for
+                        xargs -0; nothing is moved
+  --csv FILE            Write one row per duplicate file to FILE (- for stdout)
+                        for review in a spreadsheet, see below
+  --exclude GLOB        Leave out files matching GLOB, see below (repeatable)
+  --path NAME           Only consider this host's files under friendly path NAME;
+                        duplicates elsewhere, on this host or others, are ignored
+  --dest DIR            Directory to move duplicates to (optional); host:/path
+                        moves them to another machine, see files move-dupes
   --run                 Actually move files (default is dry-run)
   --strip-prefix PREFIX Remove this prefix from paths when moving
-  --ignore-dest         Ignore files already in destination dir (default: true)`,
+  --ignore-dest         Ignore files already in destination dir (default: true)
+  --recover MODE        Finish (forward) or undo (back) a group left half moved
+                        by an interrupted run; without it such a run refuses to start
+  --merge-xattrs        Before moving a copy, copy its whitelisted xattrs that the
+                        kept file lacks onto the kept file
+  --symlink             Leave a relative symlink to the kept file where each
+                        moved copy was, so its path keeps resolving (with --dest)
+  --keep POLICY         Which copy of a group to keep with --dest or --delete,
+                        see below (default most-populated)
+  --min-copies N        With --dest or --delete, keep N copies of each group and
+                        move or delete only the rest (default 1); groups of N
+                        or fewer copies are reported as already compliant
+  --interactive         With --dest, ask before moving each group, see below
+  --verify              With --dest or --delete, re-hash each copy right before
+                        moving or deleting it and skip those that changed, see below
+  --min-age D           With --dest or --delete, skip copies modified less than D
+                        ago, e.g. 10m or 1d; they keep their rows for the next run
+  --max-bytes SIZE      With --dest, start no new group once the moved copies add
+                        up to SIZE (e.g. 200G); the summary tells what remains
+  --lock-timeout D      With --run, how long to wait for a mirror or dedupe run on
+                        this host's paths before giving up (default 30s, 0 = wait)
+  --delete              Delete surplus copies on this host instead of moving them
+                        (not with --dest; dry-run by default). A group is skipped
+                        unless each kept copy exists with the expected size
+  --i-understand-data-loss
+                        Required with --delete --run
+  --delete-report FILE  With --delete, record each deletion and the kept copies
+                        (default ~/.cache/deduplicator/deletions/<time>.tsv)
+
+--format brief prints, with no colours, headers or summary:
+
+  <hash>\t<size>\t<copies>\t<savings>\t<path1>|<path2>|...
+
+Sizes are in bytes and paths absolute (copies may be on different hosts). In
+a path, a backslash, pipe, tab or newline is written as \\, \|, \t or \n.
+
+--summary prints no groups, only their number, the redundant files (every
+copy but one of each group), the wasted bytes and the 10 root folders (as
+host:root_folder) and 10 extensions wasting the most. Each copy of a group of
+N copies is charged (N-1)/N of its size, so each breakdown adds up to the
+total. Groups are aggregated as they are read, so it stays fast and small on
+hosts with tens of thousands of groups. --format json prints the same report
+as JSON.
+
+--csv writes a header and then one row per copy, groups largest first:
+
+  hash,size,hostname,root_folder,path,group_savings
+
+size and group_savings (the bytes freed by keeping one copy) are in bytes.
+Rows are written as groups are read, and --count and --min-size apply.
+
+How many copies of a group stay is set by --min-copies N; --keep only
+chooses which ones, and takes a policy, not a count (--keep 2 is rejected
+with a pointer to --min-copies 2). Potential savings count only the copies
+beyond N, dry runs print a Keeping: line per kept copy, and with --delete all
+N are checked.
+
+--keep picks the copy that stays (with --min-copies, the first N):
+
+  most-populated    the copy whose directory holds the most files
+  oldest, newest    the copy with the oldest or newest mod_time recorded by
+                    files find; copies without one lose
+  shortest-path     the copy with the shortest full path
+  path-prefix=DIR   a copy under DIR
+
+Ties go to the copy listed last. Dry runs print the policy next to the kept
+copy.
+
+--exclude leaves matching files out of every listing and move or delete, so
+they are never kept or moved; a group left with one file is dropped. A GLOB
+without a slash, like '*.pkg' or Thumbs.db, matches any file or directory
+name in the path, so node_modules excludes everything under one. A GLOB with
+a slash matches the path under its friendly path root, or the absolute path
+if it starts with /; ** matches any number of directories. With --exclude,
+--count counts the groups left after exclusion.
+
+--interactive shows each group's kept copy and the copies to move on the
+terminal, even when the output is piped, and asks:
+
+  [k]eep this one / [s]kip group / [a]ll remaining / [q]uit
+
+k moves the group's other copies, s leaves the group alone, a moves this and
+every remaining group without asking, and q leaves the rest alone. ctrl-C at
+the prompt stops the run. The summary ends with the approved and skipped
+counts.
+
+--verify re-hashes each copy with the algorithm recorded for it just before
+it is moved or deleted. A copy whose content no longer matches the catalog,
+or that cannot be read, is left in place with a warning and the run goes on;
+the summary counts the verified and skipped copies. With --delete, each kept
+copy is checked too, and a group whose kept copy fails is left alone. Dry
+runs only check kept copies.
+
+Hard links take their space once: paths on one host sharing the device and
+inode recorded by files find count as a single copy, so a group of links to
+one file is no duplicate. A copy found on disk to be a hard link of the kept
+copy is skipped, as moving it would only rename the inode. Rows indexed
+without an inode count as before.
+
+Size rules: --min-size and --ignore-empty keep tiny files, such as empty lock
+files that all share one hash, out of the groups. When either applies, the
+summary tells how many duplicate groups they filtered out.`,
 		Examples: []string{
 			"deduplicator files list-dupes --count 10",
+			"deduplicator files list-dupes --sort count --count 20",
+			"deduplicator files list-dupes --summary",
+			"deduplicator files list-dupes --path photos --format json",
+			"deduplicator files list-dupes --format brief | cut -f5 | tr '|' '\\n'",
+			"deduplicator files list-dupes --print0-paths | xargs -0 ls -l",
+			"deduplicator files list-dupes --min-size 100M --csv dupes.csv",
 			"deduplicator files list-dupes --min-size 1G",
+			"deduplicator files list-dupes --ignore-empty --dest /backup/dupes",
+			"deduplicator files list-dupes --context 5",
+			"deduplicator files list-dupes --path photos --dest /backup/dupes",
+			"deduplicator files list-dupes --exclude '*.pkg' --exclude Thumbs.db --exclude node_modules",
 			"deduplicator files list-dupes --dest /backup/dupes",
 			"deduplicator files list-dupes --dest /backup/dupes --run",
+			"deduplicator files list-dupes --dest /backup/dupes --run --interactive | tee dedupe.log",
+			"deduplicator files list-dupes --dest /backup/dupes --keep path-prefix=/data/library",
+			"deduplicator files list-dupes --dest /backup/dupes --min-copies 2 --keep most-populated",
+			"deduplicator files list-dupes --dest /backup/dupes --run --verify",
+			"deduplicator files list-dupes --delete --min-copies 2 --verify",
+			"deduplicator files list-dupes --dest /backup/dupes --run --min-age 1d",
+			"deduplicator files list-dupes --dest /backup/dupes --run --max-bytes 200G",
+			"deduplicator files list-dupes --delete --run --i-understand-data-loss",
 		},
 	},
 	{
 		Name:        "files move-dupes",
 		Description: "Move duplicate files to a specified target directory",
-		Usage:       "files move-dupes --target TARGET_DIR [--dry-run] [--count N] [--min-size SIZE]",
+		Usage:       "files move-dupes --target TARGET_DIR|HOST:/PATH [--dry-run] [--count N] [--min-size SIZE] [--ignore-empty] [--recover forward|back] [--merge-xattrs] [--symlink] [--keep POLICY] [--exclude GLOB]... [--verify] [--min-age D] [--max-bytes SIZE] [--lock-timeout D]",
 		Help: `Move duplicate files to a specified target directory.
 
 This command identifies duplicate files across all hosts. It only moves files
@@ -495,10 +1226,50 @@ Options:
   --target string   Target directory where duplicate files will be moved (required)
   --dry-run         Show what would be moved without making any changes (default: false)
   --count N         Limit number of duplicate groups processed (0 = unlimited)
-  --min-size SIZE   Minimum file size (e.g. 1M, 1.5G, 500K)
+  --min-size SIZE   Minimum file size (e.g. 1M, 1.5G, 500K; default: [dedupe] min_size)
+  --ignore-empty    Leave out empty files even without --min-size
+  --recover MODE    Finish (forward) or undo (back) a group left half moved by an
+                    interrupted run
+  --merge-xattrs    Before moving a copy, copy its whitelisted xattrs that the
+                    kept file lacks onto the kept file (local keepers only)
+  --symlink         Leave a relative symlink to the kept file where each moved
+                    copy was (local keepers only), see below
+  --keep POLICY     Which copy of a group to keep: most-populated, oldest, newest,
+                    shortest-path or path-prefix=DIR, as for files list-dupes
+                    (default: the first copy by host and path). most-populated
+                    only counts directories on this host
+  --exclude GLOB    Leave out files matching GLOB, as for files list-dupes; they
+                    are never kept or moved (repeatable)
+  --verify          Re-hash each copy right before moving it; a copy that no
+                    longer matches the catalog is left in place with a warning
+  --min-age D       Skip copies modified less than D ago (e.g. 10m, 1d), such as
+                    files still being uploaded; the next run reconsiders them
+  --max-bytes SIZE  Start no new group once the moved copies add up to SIZE
+                    (e.g. 200G); the group reaching it is finished
+  --lock-timeout D  How long to wait for a mirror or dedupe run on this host's
+                    paths before giving up (default 30s, 0 = wait indefinitely)
   --help            Show help for move-dupes command
 
-Note: The original directory structure is preserved under the per-host target folder.`,
+Note: The original directory structure is preserved under the per-host target folder.
+Each group's planned moves are journaled in TARGET_DIR/.deduplicator-journal.json
+while it is processed. If a run dies mid-group, the next run reports the journal
+and refuses to continue until it is given --recover forward or --recover back.
+Every copy moved is also appended to TARGET_DIR/.deduplicator-moves.jsonl, run
+after run, with its original path, hash, size and host; files undo-moves reads
+it to move the copies back.
+
+A TARGET_DIR of host:/path moves the copies to another machine with rsync over
+ssh, skipping targets that already exist there. If the host is registered and
+the path is under one of its friendly paths, the rows are rewritten to point at
+the moved copies; otherwise they are deleted and the copies are untracked. The
+journal is then kept under ~/.cache/deduplicator/journals/.
+
+With --symlink, each moved copy is replaced by a relative symlink to the kept
+file, for libraries indexed by other software that must keep finding it. A
+group whose kept file is on another host or missing is left alone, so no link
+crosses hosts or dangles. The row of a linked copy is soft-deleted like any
+moved copy, so prune, which only checks live rows, leaves it and the link
+alone; --recover back removes the link before moving the copy back.`,
 		Examples: []string{
 			"# Show what would be moved (dry run)",
 			"deduplicator files move-dupes --target /backup/dupes --dry-run",
@@ -506,13 +1277,60 @@ Note: The original directory structure is preserved under the per-host target fo
 			"# Actually move duplicate files",
 			"deduplicator files move-dupes --target /backup/dupes",
 			"deduplicator files move-dupes --target /backup/dupes --min-size 10G",
+			"deduplicator files move-dupes --target /backup/dupes --verify",
+			"deduplicator files move-dupes --target /backup/dupes --min-age 1h",
+			"deduplicator files move-dupes --target /backup/dupes --max-bytes 200G --dry-run",
+			"deduplicator files move-dupes --target /backup/dupes --symlink --dry-run",
+			"deduplicator files move-dupes --target /backup/dupes --keep oldest --dry-run",
+			"deduplicator files move-dupes --target /backup/dupes --exclude '**/node_modules/**' --exclude '*.pkg'",
+			"deduplicator files move-dupes --target nas:/srv/archive/dupes",
+		},
+	},
+	{
+		Name:        "files undo-moves",
+		Description: "Move the copies recorded in a move manifest back",
+		Usage:       "files undo-moves --manifest FILE [--dry-run] [--lock-timeout D]",
+		Help: `Move back the copies that files move-dupes or list-dupes --dest moved, as
+recorded in the .deduplicator-moves.jsonl manifest of their target directory
+(kept under ~/.cache/deduplicator/journals/ for a host:/path target). Run it
+on the machine the copies were moved from.
+
+Every run that moves copies appends one JSON line per copy to the manifest,
+with its original and new path, hash, size, host and time, and its summary
+names the file. An entry with row_kept set is a move whose row could not be
+updated.
+
+The latest moves are undone first. Each copy goes back to its original path
+and its row is restored: the soft-deleted row is brought back, or inserted
+again if files vacuum purged it, and a row rewritten to a remote target points
+at the original path again. A symlink left by --symlink is removed first. The
+row of a row_kept entry still lists the original path and is left alone.
+
+A copy whose original path is occupied again is left where it is and reported
+as a conflict. Copies already back are skipped, so an interrupted undo can be
+run again.
+
+Options:
+  --manifest FILE   Move manifest to undo (required)
+  --dry-run         Show what would be moved back without making changes
+  --lock-timeout D  How long to wait for a mirror or dedupe run on this host's
+                    paths before giving up (default 30s, 0 = wait indefinitely)`,
+		Examples: []string{
+			"deduplicator files undo-moves --manifest /backup/dupes/.deduplicator-moves.jsonl --dry-run",
+			"deduplicator files undo-moves --manifest /backup/dupes/.deduplicator-moves.jsonl",
 		},
 	},
 	{
 		Name:        "files mirror",
 		Description: "Mirror a friendly path (implementation-specific)",
-		Usage:       "files mirror <friendly path>",
-		Help:        `Mirror a friendly path. This is an advanced command and may depend on your deployment setup.`,
+		Usage:       "files mirror <friendly path> [--lock-timeout D] [--transfer-retries N]",
+		Help: `Mirror a friendly path. This is an advanced command and may depend on your deployment setup.
+
+Options:
+  --lock-timeout D  How long to wait for another mirror or dedupe run on the path,
+                    on any host, before giving up (default 30s, 0 = wait indefinitely)
+  --transfer-retries N  Attempts per rsync or ssh mkdir while it fails transiently,
+                    like files import (default 3, 1 = no retries)`,
 		Examples: []string{
 			"deduplicator files mirror Photos",
 		},
@@ -520,45 +1338,177 @@ Note: The original directory structure is preserved under the per-host target fo
 	{
 		Name:        "files mirror-group",
 		Description: "Mirror missing hashes across every path in a path group",
-		Usage:       "files mirror-group <group name> [--dry-run]",
+		Usage:       "files mirror-group <group name> [--dry-run] [--replicate] [--lock-timeout D]",
 		Help: `Mirror a path group by hash.
 
 The desired copy count is inferred from the number of paths in the group.
-For each hash, one copy is kept or created on every group member path. When
+For each hash, one copy is kept or created on every group member path, except
+read-only members (manage group-member-edit --read-only), which are never
+written to. When
 existing copies use different relative paths, new copies use the relative path
 that already has the most copies for that hash, with the most populated group
 member used as the tie breaker.
 
 Options:
-  --dry-run  Show missing copies without transferring files`,
+  --dry-run         Show missing copies, with their sizes, without transferring files
+  --replicate       Only copy hashes held by fewer members than the group's
+                    min_copies, as files group-replicate does
+  --lock-timeout D  How long to wait for another mirror or dedupe run on a member
+                    path before giving up (default 30s, 0 = wait indefinitely)`,
 		Examples: []string{
 			"deduplicator files mirror-group family --dry-run",
 			"deduplicator files mirror-group family",
 		},
 	},
+	{
+		Name:        "files group-replicate",
+		Description: "Copy hashes held by fewer members than a group's min_copies",
+		Usage:       "files group-replicate <group name> [--dry-run] [--lock-timeout D]",
+		Help: `Bring every hash in a path group up to the group's min_copies (see manage
+group-add --min-copies). files dedupe-group only removes surplus copies; this
+creates the missing ones, so the two together keep a group between its limits.
+
+A hash held by fewer members than min_copies is copied, with rsync (over ssh
+for remote members), onto as many other members as it is short of. Targets are
+the members with the lowest priority number first, then the most free space,
+and never read-only members (manage group-member-edit --read-only);
+the free space of each member is checked once and a member is never planned
+beyond it. New copies use the relative path chosen as for mirror-group, and
+their rows are recorded under the target's hostname and root folder. A hash
+no member can take is listed with the conflicts.
+
+Options:
+  --dry-run         List the planned copies with their sizes without transferring files
+  --lock-timeout D  How long to wait for another mirror or dedupe run on a member
+                    path before giving up (default 30s, 0 = wait indefinitely)`,
+		Examples: []string{
+			"deduplicator files group-replicate family --dry-run",
+			"deduplicator files group-replicate family",
+		},
+	},
 	{
 		Name:        "files dedupe-group",
 		Description: "Balance/limit duplicates across a path group",
-		Usage:       "files dedupe-group <group name> [--balance-mode MODE] [--respect-limits] [--dry-run|--run] [--min-size BYTES] [--count N]",
-		Help: `Deduplicate files across all hosts/paths in a path group.
+		Usage:       "files dedupe-group <group name>|--group NAME [--balance-mode MODE] [--respect-limits] [--dry-run|--run] [--no-verify] [--keep POLICY] [--min-size SIZE] [--count N] [--lock-timeout D] [--report FILE] [--workers N]",
+		Help: `Deduplicate files across all hosts/paths in a path group. Also available
+as files group-dedupe.
 
 Options:
+  --group NAME           The path group, instead of the first argument
   --balance-mode <mode>  Balance mode: priority (default), equal, capacity
+                         (--balance is an alias)
   --respect-limits       Honor min/max copy limits from group settings
   --dry-run              Show what would be done without making changes (default)
   --run                  Actually perform the deduplication
-  --min-size <bytes>     Only process files larger than this size
-  --count <n>            Limit the number of duplicate groups to process`,
+  --no-verify            Remove copies on the strength of their stored hashes,
+                         without the checks below (--verify is still accepted)
+  --keep POLICY          Rank copies of equal priority: most-populated, oldest,
+                         newest, shortest-path or path-prefix=DIR, as for files
+                         list-dupes (default: by host name). most-populated
+                         only counts directories on this host
+  --min-size SIZE        Only process files at least this size (e.g. 500M, 1.5G)
+  --count <n>            Limit the number of duplicate groups to process
+  --lock-timeout D       With --run, how long to wait for another mirror or dedupe
+                         run on a member path (default 30s, 0 = wait indefinitely)
+  --report FILE          Write the plan as JSON for review: every duplicate hash
+                         with the copies kept and removed (host, friendly path,
+                         path, priority) and totals. With --run, each removed
+                         copy also gets its outcome: removed, failed or skipped
+  --workers N            Process N duplicate groups at once (default 1), for runs
+                         over many groups with slow remote deletions. The output
+                         of each group is printed whole once it is done, so
+                         groups may finish out of order; the report keeps the
+                         listing order. ctrl-C starts no new group and removes
+                         nothing more, then prints the summary
+
+Copies on other hosts are deleted with rm over ssh; a copy that cannot be
+removed keeps its row and is counted in the summary.
+
+Before a --run removes anything, it re-hashes the kept copies and each copy to
+remove with the algorithm recorded for its row, locally or over ssh with the
+host's hash command (SHA-256 only, so a remote BLAKE3 copy cannot be
+confirmed). A group is left alone unless every kept copy still matches its
+row, and any other copy that cannot be confirmed is skipped. A copy that no
+longer matches has its hash cleared so the next files hash re-hashes it. The
+summary counts the verified and skipped copies and the cleared hashes. Dry
+runs verify nothing.
+
+Copies on members marked with manage group-member-edit --protected are never
+removed; groups they keep above max_copies are reported as over-replicated
+but protected and counted in the summary. Copies on --read-only members are
+never removed either; a group whose only removable copies are read-only is
+skipped with a note and counted in the summary.`,
 		Examples: []string{
 			"deduplicator files dedupe-group photos --dry-run",
 			"deduplicator files dedupe-group photos --respect-limits --run",
+			"deduplicator files dedupe-group photos --run --no-verify",
+			"deduplicator files dedupe-group photos --keep newest --dry-run",
+			"deduplicator files group-dedupe --group photos --balance equal --dry-run",
+			"deduplicator files dedupe-group photos --report plan.json",
+			"deduplicator files dedupe-group photos --run --workers 8",
+		},
+	},
+	{
+		Name:        "doctor",
+		Description: "Check the catalog for inconsistent rows",
+		Usage:       "doctor [--fix]",
+		Help: `Run health checks against the catalog and report what they find.
+
+Checks:
+  malformed hashes  Rows whose hash is not exactly 64 hex characters, such as
+                    values truncated by an old column resize. Duplicate
+                    listings already ignore them; --fix clears the hash so the
+                    next files hash run recomputes it.
+  mixed-case hostnames
+                    Hosts and files rows whose hostname is not lowercase, which
+                    per-host commands never match. --fix lowercases them and
+                    soft-deletes rows already indexed under the lowercase
+                    hostname; hosts that differ only by case are left for you
+                    to rename with manage server-edit.
+  legacy import paths
+                    Rows files import recorded with the full path of the file
+                    and no root folder, which files find indexes a second time.
+                    --fix rewrites them to the root folder and relative path
+                    find uses, or soft-deletes them when find already indexed
+                    the file; rows outside every path mapping are left alone.
+
+Options:
+  --fix             Repair the problems found where a check knows how`,
+		Examples: []string{
+			"deduplicator doctor",
+			"deduplicator doctor --fix",
+		},
+	},
+	{
+		Name:        "maintain",
+		Description: "Run the routine catalog maintenance in one go",
+		Usage:       "maintain [--full]",
+		Help: `Run the routine catalog maintenance, in order, under one flow lock:
+
+  prune    files prune with its default options
+  doctor   the doctor checks (with --fix under --full)
+  vacuum   count the rows soft-deleted more than 30 days ago (purged under
+           --full, like files vacuum --older-than 30d)
+  analyze  files analyze
+
+A failing phase is reported and the next one still runs. The run ends with a
+report of each phase's outcome, duration and counters, and fails if any phase
+failed.
+
+Options:
+  --full            Also repair doctor findings and purge vacuumable rows`,
+		Examples: []string{
+			"deduplicator maintain",
+			"deduplicator maintain --full",
 		},
 	},
 	{
 		Name:        "problematic",
 		Description: "List problematic files for the current host",
 		Usage:       "problematic",
-		Help:        `List files that are marked problematic (e.g., timeouts) for the current host.`,
+		Help: `List files on the current host that failed to hash (timeouts, permission
+errors, ...), with the error kind, number of attempts, time of the last attempt
+and its error message.`,
 		Examples: []string{
 			"deduplicator problematic",
 		},
@@ -34,7 +34,7 @@ func SetupDatabase() *sql.DB {
 	dbPassword := os.Getenv("DB_PASSWORD")
 
 	// Connect to database
-	database, err := db.Connect(dbHost, dbPort, dbUser, dbPassword, dbName)
+	database, err := db.Connect(dbHost, dbPort, dbUser, dbPassword, dbName, 0)
 	if err != nil {
 		log.Fatal(err)
 	}
@@ -0,0 +1,118 @@
+package cmd
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"deduplicator/db"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+func expectServerList(mock sqlmock.Sqlmock) {
+	mock.ExpectQuery("SELECT id, name, hostname, ip, root_path, settings, created_at\\s+FROM hosts ORDER BY name").
+		WillReturnRows(sqlmock.NewRows([]string{"id", "name", "hostname", "ip", "root_path", "settings", "created_at"}).
+			AddRow(1, "Backup1", "backup1.local", "10.0.0.5", "/data", []byte(`{}`), time.Now()))
+}
+
+func TestListingCommandSetsStatementTimeout(t *testing.T) {
+	timeout := statementTimeoutFor([]string{"manage", "server-list"})
+	if timeout != 30*time.Second {
+		t.Fatalf("expected a 30s default for listings, got %v", timeout)
+	}
+	if got := statementTimeoutFor([]string{"files", "list-dupes", "--count", "5"}); got != 30*time.Second {
+		t.Fatalf("expected a 30s default for files list-dupes, got %v", got)
+	}
+
+	mockDB, mock, err := sqlmock.NewWithDSN("timeout_manage_list")
+	if err != nil {
+		t.Fatalf("sqlmock: %v", err)
+	}
+	defer mockDB.Close()
+	conn := db.Open(mockDB.Driver(), "timeout_manage_list", timeout)
+	defer conn.Close()
+
+	mock.ExpectExec(`SET statement_timeout = 30000`).WillReturnResult(sqlmock.NewResult(0, 0))
+	expectServerList(mock)
+	captureStdout(t, func() {
+		if err := HandleManage(conn, []string{"server-list"}); err != nil {
+			t.Fatalf("server-list: %v", err)
+		}
+	})
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatalf("unmet expectations: %v", err)
+	}
+}
+
+func TestBatchCommandOmitsStatementTimeout(t *testing.T) {
+	for _, args := range [][]string{{"files", "hash"}, {"files", "prune"}, {"files", "find", "--server", "Backup1"}} {
+		if got := statementTimeoutFor(args); got != 0 {
+			t.Fatalf("%v: expected no statement timeout, got %v", args, got)
+		}
+	}
+
+	mockDB, mock, err := sqlmock.NewWithDSN("timeout_hash")
+	if err != nil {
+		t.Fatalf("sqlmock: %v", err)
+	}
+	defer mockDB.Close()
+	conn := db.Open(mockDB.Driver(), "timeout_hash", statementTimeoutFor([]string{"files", "hash"}))
+	defer conn.Close()
+
+	// Only the listing is expected; a SET would fail it as unexpected.
+	expectServerList(mock)
+	captureStdout(t, func() {
+		if err := HandleManage(conn, []string{"server-list"}); err != nil {
+			t.Fatalf("server-list: %v", err)
+		}
+	})
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatalf("unmet expectations: %v", err)
+	}
+}
+
+func TestDBTimeoutFlagOverridesCommandDefault(t *testing.T) {
+	t.Setenv("DB_TIMEOUT", "")
+	args, global, err := parseGlobalFlags([]string{"deduplicator", "--db-timeout", "5m", "files", "hash"})
+	if err != nil {
+		t.Fatalf("parseGlobalFlags: %v", err)
+	}
+	if global.dbTimeout != 5*time.Minute || strings.Join(args, " ") != "deduplicator files hash" {
+		t.Fatalf("unexpected result: %v %+v", args, global)
+	}
+	if _, global, _ := parseGlobalFlags([]string{"deduplicator", "--db-timeout=0", "files", "list-dupes"}); global.dbTimeout != 0 {
+		t.Fatalf("expected --db-timeout=0 to disable the limit, got %v", global.dbTimeout)
+	}
+	if _, global, _ := parseGlobalFlags([]string{"deduplicator", "files", "list-dupes"}); global.dbTimeout != -1 {
+		t.Fatalf("expected the command default without --db-timeout, got %v", global.dbTimeout)
+	}
+
+	t.Setenv("DB_TIMEOUT", "10s")
+	if _, global, _ := parseGlobalFlags([]string{"deduplicator", "files", "hash"}); global.dbTimeout != 10*time.Second {
+		t.Fatalf("expected DB_TIMEOUT to set the override, got %v", global.dbTimeout)
+	}
+}
+
+func TestBatchModesOfListingCommandsOmitStatementTimeout(t *testing.T) {
+	for _, args := range [][]string{
+		{"doctor", "--fix"},
+		{"files", "list-dupes", "--dest", "/backup/dupes", "--run"},
+		{"files", "list-dupes", "--dest=/backup/dupes"},
+		{"files", "list-dupes", "--delete", "--run", "--i-understand-data-loss"},
+		{"files", "list-dupes", "-interactive", "--dest", "/backup/dupes"},
+	} {
+		if got := statementTimeoutFor(args); got != 0 {
+			t.Errorf("%v: expected no statement timeout, got %v", args, got)
+		}
+	}
+	for _, args := range [][]string{
+		{"doctor"},
+		{"doctor", "--fix=false"},
+		{"files", "list-dupes", "--delete=false", "--count", "5"},
+	} {
+		if got := statementTimeoutFor(args); got != 30*time.Second {
+			t.Errorf("%v: expected the 30s listing default, got %v", args, got)
+		}
+	}
+}
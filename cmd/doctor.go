@@ -0,0 +1,23 @@
+package cmd
+
+import (
+	"context"
+	"database/sql"
+	"flag"
+	"fmt"
+
+	"deduplicator/files"
+)
+
+// HandleDoctor runs the catalog health checks
+func HandleDoctor(ctx context.Context, database *sql.DB, args []string) error {
+	doctorCmd := flag.NewFlagSet("doctor", flag.ExitOnError)
+	fix := doctorCmd.Bool("fix", false, "Repair the problems found where possible")
+	if err := doctorCmd.Parse(args); err != nil {
+		return fmt.Errorf("error parsing doctor flags: %v", err)
+	}
+	if doctorCmd.NArg() != 0 {
+		return fmt.Errorf("doctor does not accept positional arguments")
+	}
+	return files.RunDoctor(ctx, database, files.DoctorOptions{Fix: *fix})
+}
@@ -1,13 +1,18 @@
 package cmd
 
 import (
+	"bufio"
 	"context"
 	"database/sql"
 	"flag"
 	"fmt"
+	"io"
 	"os"
+	"strconv"
 	"strings"
+	"time"
 
+	"deduplicator/db"
 	"deduplicator/files"
 )
 
@@ -26,8 +31,113 @@ func (f *repeatedStringFlag) Set(value string) error {
 	return nil
 }
 
+// duplicateMinSize returns the --min-size flag of list-dupes and move-dupes,
+// defaulting to DEDUPE_MIN_SIZE ([dedupe] min_size in config.ini).
+func duplicateMinSize() (files.SizeFlag, error) {
+	var minSize files.SizeFlag
+	if v := os.Getenv("DEDUPE_MIN_SIZE"); v != "" {
+		if err := minSize.Set(v); err != nil {
+			return minSize, fmt.Errorf("invalid DEDUPE_MIN_SIZE value %q: %v", v, err)
+		}
+	}
+	return minSize, nil
+}
+
+// serverOrCurrentHost returns name, or when it is empty the friendly name of
+// the host row matching the OS hostname.
+func serverOrCurrentHost(ctx context.Context, database *sql.DB, name string) (string, error) {
+	if name != "" {
+		return name, nil
+	}
+	osHostname, err := os.Hostname()
+	if err != nil {
+		return "", fmt.Errorf("error getting current OS hostname: %v", err)
+	}
+	err = database.QueryRowContext(ctx, `SELECT name FROM hosts WHERE LOWER(hostname) = LOWER($1)`, strings.ToLower(osHostname)).Scan(&name)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return "", fmt.Errorf("no host found in database for OS hostname '%s'. Please add it using 'manage server-add' or specify --server.", osHostname)
+		}
+		return "", fmt.Errorf("error querying host from database for OS hostname '%s': %v", osHostname, err)
+	}
+	return name, nil
+}
+
+// parseTimestamp accepts RFC3339 timestamps as well as plain dates and
+// "YYYY-MM-DD HH:MM:SS" in local time.
+func parseTimestamp(value string) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t, nil
+	}
+	for _, layout := range []string{"2006-01-02 15:04:05", "2006-01-02T15:04:05", "2006-01-02"} {
+		if t, err := time.ParseInLocation(layout, value, time.Local); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("%q is not a timestamp (use RFC3339 or YYYY-MM-DD)", value)
+}
+
+// importAgeWindow returns the minimum and maximum file age of files import
+// from --age, --older-than (its duration-style spelling) and --newer-than;
+// zero means no limit.
+func importAgeWindow(age, olderThan, newerThan time.Duration) (minAge, maxAge time.Duration, err error) {
+	minAge = age
+	if olderThan > 0 {
+		if age > 0 && age != olderThan {
+			return 0, 0, fmt.Errorf("--age and --older-than set the same limit; give only one")
+		}
+		minAge = olderThan
+	}
+	if newerThan > 0 && newerThan <= minAge {
+		return 0, 0, fmt.Errorf("invalid value for --newer-than: must be longer than --older-than, or no file can match")
+	}
+	return minAge, newerThan, nil
+}
+
+// importRoutes merges --route rules with those of --routes-file, where blank
+// lines and lines starting with # are ignored.
+func importRoutes(rules []string, routesFile string) (map[string]string, error) {
+	if routesFile != "" {
+		f, err := os.Open(routesFile)
+		if err != nil {
+			return nil, fmt.Errorf("error opening routes file: %v", err)
+		}
+		defer f.Close()
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			line := strings.TrimSpace(scanner.Text())
+			if line == "" || strings.HasPrefix(line, "#") {
+				continue
+			}
+			rules = append(rules, line)
+		}
+		if err := scanner.Err(); err != nil {
+			return nil, fmt.Errorf("error reading routes file: %v", err)
+		}
+	}
+
+	routes := make(map[string]string, len(rules))
+	for _, rule := range rules {
+		subdir, friendly, err := files.ParseImportRoute(rule)
+		if err != nil {
+			return nil, err
+		}
+		if existing, ok := routes[subdir]; ok && existing != friendly {
+			return nil, fmt.Errorf("conflicting routes for %s: %s and %s", subdir, existing, friendly)
+		}
+		routes[subdir] = friendly
+	}
+	return routes, nil
+}
+
 // HandleFiles handles file-related commands
 func HandleFiles(ctx context.Context, database *sql.DB, args []string) error {
+	return handleFiles(ctx, database, args, nil)
+}
+
+// handleFiles runs a files subcommand; long-running subcommands record their
+// final counters in stats.
+func handleFiles(ctx context.Context, database *sql.DB, args []string, stats *files.RunStats) error {
 	var err error
 	if len(args) == 0 || args[0] == "help" || args[0] == "--help" {
 		cmd := FindCommand("files")
@@ -35,7 +145,7 @@ func HandleFiles(ctx context.Context, database *sql.DB, args []string) error {
 			ShowCommandHelp(*cmd)
 			return nil
 		}
-		return fmt.Errorf("files command requires a subcommand: find, list-dupes, move-dupes, hash, hash-upgrade, prune, import, mirror, mirror-group, or dedupe-group")
+		return fmt.Errorf("files command requires a subcommand: find, list-dupes, move-dupes, undo-moves, hash, hash-upgrade, rehash-all, verify, stats, unhashed, dupe-report, unique, export-hashes, import-hashes, prune, undelete, vacuum, analyze, import, import-status, mirror, mirror-group, group-replicate, or dedupe-group")
 	}
 
 	switch args[0] {
@@ -48,12 +158,79 @@ func HandleFiles(ctx context.Context, database *sql.DB, args []string) error {
 		importDryRun := importCmd.Bool("dry-run", false, "Show what would be imported without making changes")
 		importCount := importCmd.Int("count", 0, "Limit the number of files to process (0 = no limit)")
 		duplicateDir := importCmd.String("duplicate", "", "Move duplicate files to this directory instead of skipping them")
-		importAge := importCmd.Int("age", 0, "Only import files older than this many minutes")
+		importAge := files.DurationFlag{DefaultUnit: time.Minute}
+		importCmd.Var(&importAge, "age", "Only import files older than this (minutes, or a duration like 2h, 7d)")
+		var olderThan, newerThan files.DurationFlag
+		importCmd.Var(&olderThan, "older-than", "Only import files last modified longer ago than this duration (e.g. 2h, 7d); same as --age")
+		importCmd.Var(&newerThan, "newer-than", "Only import files last modified less than this duration ago (e.g. 30d)")
+		var routeRules repeatedStringFlag
+		importCmd.Var(&routeRules, "route", "Route a top-level source subdirectory to a friendly path, as SUBDIR=FRIENDLY (repeatable)")
+		routesFile := importCmd.String("routes-file", "", "File with one SUBDIR=FRIENDLY route per line")
+		strictRoutes := importCmd.Bool("strict-routes", false, "Skip files outside routed subdirectories instead of importing them to --path")
+		importCaptureXattrs := importCmd.Bool("capture-xattrs", false, "Store the target server's whitelisted xattrs of each source file")
+		statusFile := importCmd.String("status-file", "", "Keep live progress in this JSON file; creating FILE.cancel stops the run at the next file")
+		transferRetries := importCmd.Int("transfer-retries", files.DefaultTransferRetries, "Attempts per rsync or ssh mkdir while it fails transiently (1 = no retries)")
+		importMaxPathLen := importCmd.Int("max-path-len", files.DefaultMaxPathLen, "Skip files whose source, target or duplicate path is longer than this many bytes")
+		minFreeFlag := importCmd.String("min-free", "", "Stop before a destination's free space drops under this size (e.g. 50G) or percentage (e.g. 5%)")
+		freeCheckEvery := importCmd.Int("free-check-every", files.DefaultFreeCheckEvery, "Check the destination's free space every N transferred files")
+		var importExcludeFlags, importIncludeFlags repeatedStringFlag
+		importCmd.Var(&importExcludeFlags, "exclude", "Skip files and directories whose path under --source matches this glob, e.g. '.DS_Store' or '**/cache' (repeatable)")
+		importCmd.Var(&importIncludeFlags, "include", "Only import files whose path under --source matches this glob, e.g. '*.jpg' (repeatable)")
+		importWorkers := importCmd.Int("workers", 1, "Hash and transfer this many files at once")
+		importVerify := importCmd.Bool("verify", false, "Re-hash each transferred copy at the destination before recording it or removing its source")
+		onConflictFlag := importCmd.String("on-conflict", "skip", "What to do when a different file already sits at the target path: skip, overwrite or rename")
+		importBatchSize := importCmd.Int("batch-size", files.DefaultImportBatchSize, "Record this many transferred files per database transaction")
+		bwLimit := importCmd.String("bwlimit", "", "Limit each rsync's bandwidth to this rate, as rsync --bwlimit takes it (e.g. 500 for KiB/s, or 1.5m)")
+		summaryJSON := importCmd.String("summary-json", "", "Write the run's counters and failed files as JSON to this file when it ends; - writes them to stdout and the rest of the output to stderr")
+		var rsyncOptFlags repeatedStringFlag
+		importCmd.Var(&rsyncOptFlags, "rsync-opt", "Pass this option to every rsync, e.g. --rsync-opt=--partial or --rsync-opt=--timeout=60 (repeatable)")
 		err = importCmd.Parse(args[1:])
 		if err != nil {
 			return fmt.Errorf("error parsing command flags: %v", err)
 		}
-		if *sourcePath == "" || *serverName == "" || *friendlyPath == "" {
+		importExclude, err := files.ParsePathExcludes(importExcludeFlags)
+		if err != nil {
+			return err
+		}
+		importInclude, err := files.ParsePathIncludes(importIncludeFlags)
+		if err != nil {
+			return err
+		}
+		minAge, maxAge, err := importAgeWindow(importAge.Duration, olderThan.Duration, newerThan.Duration)
+		if err != nil {
+			return err
+		}
+		if *importWorkers < 1 {
+			return fmt.Errorf("invalid value for --workers: must be at least 1")
+		}
+		onConflict, err := files.ParseImportConflict(*onConflictFlag)
+		if err != nil {
+			return err
+		}
+		if *importBatchSize < 1 {
+			return fmt.Errorf("invalid value for --batch-size: must be at least 1")
+		}
+		if err := files.CheckImportRsyncOptions(*bwLimit, rsyncOptFlags); err != nil {
+			return err
+		}
+		minFree, err := files.ParseFreeSpaceFloor(*minFreeFlag)
+		if err != nil {
+			return fmt.Errorf("invalid value for --min-free: %v", err)
+		}
+		if *freeCheckEvery < 1 {
+			return fmt.Errorf("invalid value for --free-check-every: must be at least 1")
+		}
+		routes, err := importRoutes(routeRules, *routesFile)
+		if err != nil {
+			return err
+		}
+		if *importMaxPathLen < 1 {
+			return fmt.Errorf("invalid value for --max-path-len: must be at least 1")
+		}
+		if *strictRoutes && len(routes) == 0 {
+			return fmt.Errorf("--strict-routes requires at least one --route or a --routes-file")
+		}
+		if *sourcePath == "" || *serverName == "" || (*friendlyPath == "" && !*strictRoutes) {
 			fmt.Println("Import files from a source directory into the database")
 			fmt.Println("")
 			fmt.Println("Usage: files import --source DIR --server NAME --path FRIENDLY [options]")
@@ -68,38 +245,103 @@ func HandleFiles(ctx context.Context, database *sql.DB, args []string) error {
 			fmt.Println("  --remove-source      Remove source files after successful import")
 			fmt.Println("  --dry-run            Show what would be imported without making changes")
 			fmt.Println("  --count int          Limit the number of files to process (0 = no limit, default: 0)")
-			fmt.Println("  --age int            Only import files older than this many minutes")
+			fmt.Println("  --age duration       Only import files older than this (minutes, or e.g. 2h, 7d)")
+			fmt.Println("  --older-than duration  Same as --age, e.g. 2h or 7d")
+			fmt.Println("  --newer-than duration  Only import files modified less than this long ago, e.g. 30d")
+			fmt.Println("  --route SUBDIR=FRIENDLY  Import a top-level source subdirectory to its own friendly path (repeatable)")
+			fmt.Println("  --routes-file string Read SUBDIR=FRIENDLY routes from a file, one per line")
+			fmt.Println("  --strict-routes      Skip unrouted files instead of importing them to --path (--path is then optional)")
+			fmt.Println("  --capture-xattrs     Store the target server's whitelisted xattrs of each source file")
+			fmt.Println("  --status-file string Keep live progress in this JSON file; creating FILE.cancel stops the run")
+			fmt.Println("  --transfer-retries int  Attempts per rsync or ssh mkdir on transient failures (default: 3, 1 = no retries)")
+			fmt.Println("  --max-path-len int   Skip files whose source, target or duplicate path is longer (bytes, default: 3800)")
+			fmt.Println("  --min-free size|N%   Stop before a destination's free space drops under this (e.g. 50G or 5%)")
+			fmt.Println("  --free-check-every int  Transferred files between free space checks (default: 20)")
+			fmt.Println("  --exclude GLOB       Skip files and directories under --source matching GLOB (repeatable)")
+			fmt.Println("  --include GLOB       Only import files under --source matching GLOB (repeatable)")
+			fmt.Println("  --workers int        Hash and transfer this many files at once (default: 1)")
+			fmt.Println("  --verify             Re-hash each copy at the destination before recording it or removing the source")
+			fmt.Println("  --on-conflict string skip, overwrite or rename a file whose target path holds other content (default: skip)")
+			fmt.Println("  --batch-size int     Transferred files recorded per database transaction (default: 100)")
+			fmt.Println("  --bwlimit RATE       Limit each rsync's bandwidth, as rsync --bwlimit (e.g. 500 for KiB/s, or 1.5m)")
+			fmt.Println("  --rsync-opt OPTION   Pass OPTION to every rsync, e.g. --rsync-opt=--partial (repeatable)")
+			fmt.Println("  --summary-json FILE  Write the counters and failed files as JSON when the run ends (- for stdout)")
 			return fmt.Errorf("--source, --server, and --path are required")
 		}
+		status, err := files.NewStatusWriter(*statusFile, "files import")
+		if err != nil {
+			return err
+		}
 		err = files.ImportFiles(ctx, database, files.ImportOptions{
-			SourcePath:   *sourcePath,
-			HostName:     *serverName,
-			FriendlyPath: *friendlyPath,
-			RemoveSource: *importRemoveSource,
-			DryRun:       *importDryRun,
-			Count:        *importCount,
-			DuplicateDir: *duplicateDir,
-			Age:          *importAge,
+			SourcePath:      *sourcePath,
+			HostName:        *serverName,
+			FriendlyPath:    *friendlyPath,
+			RemoveSource:    *importRemoveSource,
+			DryRun:          *importDryRun,
+			Count:           *importCount,
+			DuplicateDir:    *duplicateDir,
+			Age:             minAge,
+			MaxAge:          maxAge,
+			Stats:           stats,
+			Routes:          routes,
+			StrictRoutes:    *strictRoutes,
+			CaptureXattrs:   *importCaptureXattrs,
+			Status:          status,
+			TransferRetries: *transferRetries,
+			MaxPathLen:      *importMaxPathLen,
+			MinFree:         minFree,
+			FreeCheckEvery:  *freeCheckEvery,
+			Exclude:         importExclude,
+			Include:         importInclude,
+			Workers:         *importWorkers,
+			Verify:          *importVerify,
+			OnConflict:      onConflict,
+			BatchSize:       *importBatchSize,
+			BwLimit:         *bwLimit,
+			RsyncOptions:    rsyncOptFlags,
+			SummaryJSON:     *summaryJSON,
 		})
 		if err != nil {
-			fmt.Printf("Import error: %v\n", err)
+			if *summaryJSON == "-" {
+				fmt.Fprintf(os.Stderr, "Import error: %v\n", err)
+			} else {
+				fmt.Printf("Import error: %v\n", err)
+			}
 		}
 		return err
 
 	case "prune":
 		pruneCmd := flag.NewFlagSet(args[0], flag.ExitOnError)
 		pruneBatchSize := pruneCmd.Int("batch-size", 0, "Number of deletions per transaction commit (default: 250)")
+		pruneKeepSymlinks := pruneCmd.Bool("keep-symlink-targets", false, "Keep entries for symlinks to regular files (indexed with find --index-symlink-targets)")
 		err = pruneCmd.Parse(args[1:])
 		if err != nil {
 			return fmt.Errorf("error parsing prune flags: %v", err)
 		}
-		pruneOpts := files.PruneOptions{BatchSize: *pruneBatchSize}
+		pruneOpts := files.PruneOptions{BatchSize: *pruneBatchSize, KeepSymlinkTargets: *pruneKeepSymlinks, Stats: stats}
 		err = files.PruneNonExistentFiles(ctx, database, pruneOpts)
 		if err != nil {
 			fmt.Printf("Prune error: %v\n", err)
 		}
 		return err
 
+	case "analyze":
+		for _, arg := range args[1:] {
+			if arg == "--help" || arg == "help" {
+				cmd := FindCommand("files analyze")
+				if cmd != nil {
+					ShowCommandHelp(*cmd)
+					return nil
+				}
+				break
+			}
+		}
+		err = files.AnalyzeFiles(ctx, database)
+		if err != nil {
+			fmt.Printf("Analyze error: %v\n", err)
+		}
+		return err
+
 	case "find":
 		// Check for help flag
 		for _, arg := range args[1:] {
@@ -117,6 +359,13 @@ func HandleFiles(ctx context.Context, database *sql.DB, args []string) error {
 		findCmd := flag.NewFlagSet("find", flag.ExitOnError)
 		serverFlag := findCmd.String("server", "", "Host to find files for (defaults to current host)")
 		pathNameFlag := findCmd.String("path", "", "Friendly path name to search within (optional)")
+		followSymlinksFlag := findCmd.Bool("follow-symlinks", false, "Follow symlinked directories, skipping cycles")
+		indexTargetsFlag := findCmd.Bool("index-symlink-targets", false, "Index file symlinks under the link path using the target's content")
+		maxDepthFlag := findCmd.Int("max-depth", files.DefaultMaxWalkDepth, "Maximum directory depth when following symlinks")
+		captureXattrsFlag := findCmd.Bool("capture-xattrs", false, "Store the server's whitelisted xattrs of each file")
+		registerFlag := findCmd.Bool("register", false, "Without --server, register this machine as a host if no host matches its hostname")
+		reportNewFlag := findCmd.String("report-new", "", "Append the friendly path of each newly indexed file to FILE (- for stdout)")
+		maxPathLenFlag := findCmd.Int("max-path-len", files.DefaultMaxPathLen, "Skip files whose absolute path is longer than this many bytes")
 
 		err = findCmd.Parse(args[1:])
 		if err != nil {
@@ -133,23 +382,47 @@ func HandleFiles(ctx context.Context, database *sql.DB, args []string) error {
 				return fmt.Errorf("error getting current OS hostname: %v", err)
 			}
 			// Find the friendly server name from the database based on the OS hostname
-			err = database.QueryRowContext(ctx, `SELECT name FROM hosts WHERE LOWER(hostname) = LOWER($1)`, strings.ToLower(osHostname)).Scan(&serverToUse)
+			serverToUse, err = files.LocalHostName(database, strings.ToLower(osHostname), *registerFlag)
 			if err != nil {
-				if err == sql.ErrNoRows {
-					return fmt.Errorf("no host found in database for OS hostname '%s'. Please add it using 'manage server-add' or specify --server.", osHostname)
-				}
-				return fmt.Errorf("error querying host from database for OS hostname '%s': %v", osHostname, err)
+				return fmt.Errorf("%v (or specify --server)", err)
 			}
 		}
 
+		if *maxDepthFlag < 1 {
+			return fmt.Errorf("invalid value for --max-depth: must be at least 1")
+		}
+		if *maxPathLenFlag < 1 {
+			return fmt.Errorf("invalid value for --max-path-len: must be at least 1")
+		}
+
 		findOpts := files.FindOptions{
-			Server: serverToUse,
+			Server:              serverToUse,
+			FollowSymlinks:      *followSymlinksFlag,
+			IndexSymlinkTargets: *indexTargetsFlag,
+			MaxDepth:            *maxDepthFlag,
+			CaptureXattrs:       *captureXattrsFlag,
+			Register:            *registerFlag,
+			Stats:               stats,
+			MaxPathLen:          *maxPathLenFlag,
 		}
 
 		if *pathNameFlag != "" {
 			findOpts.Path = *pathNameFlag
 		}
 
+		switch *reportNewFlag {
+		case "":
+		case "-":
+			findOpts.ReportNew = os.Stdout
+		default:
+			report, err := os.OpenFile(*reportNewFlag, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+			if err != nil {
+				return fmt.Errorf("error opening --report-new file: %v", err)
+			}
+			defer report.Close()
+			findOpts.ReportNew = report
+		}
+
 		// Call the actual find function from the files package
 		err = files.FindFiles(ctx, database, findOpts)
 		if err != nil {
@@ -157,6 +430,304 @@ func HandleFiles(ctx context.Context, database *sql.DB, args []string) error {
 		}
 		return nil
 
+	case "stats":
+		for _, arg := range args[1:] {
+			if arg == "--help" || arg == "help" {
+				cmd := FindCommand("files stats")
+				if cmd != nil {
+					ShowCommandHelp(*cmd)
+					return nil
+				}
+				break
+			}
+		}
+
+		statsCmd := flag.NewFlagSet("stats", flag.ExitOnError)
+		serverFlag := statsCmd.String("server", "", "Host to report on (defaults to current host)")
+		slowest := statsCmd.Int("slowest", files.DefaultHashStatsSlowest, "Number of slowest-hashing files to list")
+		err = statsCmd.Parse(args[1:])
+		if err != nil {
+			return fmt.Errorf("error parsing stats command flags: %v", err)
+		}
+
+		serverToUse, err := serverOrCurrentHost(ctx, database, *serverFlag)
+		if err != nil {
+			return err
+		}
+
+		return files.ListHashStats(ctx, database, files.HashStatsOptions{
+			Server:  serverToUse,
+			Slowest: *slowest,
+		})
+
+	case "unhashed":
+		for _, arg := range args[1:] {
+			if arg == "--help" || arg == "help" {
+				cmd := FindCommand("files unhashed")
+				if cmd != nil {
+					ShowCommandHelp(*cmd)
+					return nil
+				}
+				break
+			}
+		}
+
+		unhashedCmd := flag.NewFlagSet("unhashed", flag.ExitOnError)
+		serverFlag := unhashedCmd.String("server", "", "Host to report on (defaults to current host)")
+		byFlag := unhashedCmd.String("by", "path", "Bucket unhashed files by friendly path or by age (path|age)")
+		outputFlag := unhashedCmd.String("output", "text", "Output format (text|json)")
+		err = unhashedCmd.Parse(args[1:])
+		if err != nil {
+			return fmt.Errorf("error parsing unhashed command flags: %v", err)
+		}
+
+		serverToUse, err := serverOrCurrentHost(ctx, database, *serverFlag)
+		if err != nil {
+			return err
+		}
+
+		return files.ListUnhashed(ctx, database, files.UnhashedOptions{
+			Server: serverToUse,
+			By:     *byFlag,
+			Output: *outputFlag,
+		})
+
+	case "dupe-report":
+		for _, arg := range args[1:] {
+			if arg == "--help" || arg == "help" {
+				cmd := FindCommand("files dupe-report")
+				if cmd != nil {
+					ShowCommandHelp(*cmd)
+					return nil
+				}
+				break
+			}
+		}
+
+		reportCmd := flag.NewFlagSet("dupe-report", flag.ExitOnError)
+		depth := reportCmd.Int("depth", 2, "Directory levels below each root folder to group the wasted space by")
+		var minSize files.SizeFlag
+		reportCmd.Var(&minSize, "min-size", "Minimum file size to consider (e.g., \"1M\", \"1.5G\", \"500K\")")
+		csvFile := reportCmd.String("csv", "", "Also write the table to FILE as CSV (- for stdout instead of the table)")
+		err = reportCmd.Parse(args[1:])
+		if err != nil {
+			return fmt.Errorf("error parsing dupe-report command flags: %v", err)
+		}
+
+		return files.PrintDupeReport(ctx, database, files.DupeReportOptions{
+			Depth:   *depth,
+			MinSize: minSize.Bytes,
+			CSV:     *csvFile,
+		})
+
+	case "unique":
+		for _, arg := range args[1:] {
+			if arg == "--help" || arg == "help" {
+				cmd := FindCommand("files unique")
+				if cmd != nil {
+					ShowCommandHelp(*cmd)
+					return nil
+				}
+				break
+			}
+		}
+
+		uniqueCmd := flag.NewFlagSet("unique", flag.ExitOnError)
+		serverFlag := uniqueCmd.String("server", "", "Host to report on (defaults to current host)")
+		againstFlag := uniqueCmd.String("against", "", "Comma-separated hosts to compare with")
+		allFlag := uniqueCmd.Bool("all", false, "Compare with every other host (the default without --against)")
+		var minSize files.SizeFlag
+		uniqueCmd.Var(&minSize, "min-size", "Minimum file size to consider (e.g., \"1M\", \"1.5G\", \"500K\")")
+		outputFlag := uniqueCmd.String("output", "text", "Output format (text|json)")
+		listFlag := uniqueCmd.Bool("list", false, "Also list each unique file")
+		copyTo := uniqueCmd.String("copy-to", "", "Copy the unique files to this host, under the same friendly paths")
+		dryRun := uniqueCmd.Bool("dry-run", false, "With --copy-to, show what would be copied without transferring files")
+		lockTimeout := uniqueCmd.Duration("lock-timeout", db.DefaultPathLockTimeout, "How long --copy-to waits for mirror or dedupe runs on the destination's paths (0 = indefinitely)")
+		err = uniqueCmd.Parse(args[1:])
+		if err != nil {
+			return fmt.Errorf("error parsing unique command flags: %v", err)
+		}
+
+		var against []string
+		for _, name := range strings.Split(*againstFlag, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				against = append(against, name)
+			}
+		}
+		if *allFlag && len(against) > 0 {
+			return fmt.Errorf("--all and --against cannot be combined")
+		}
+
+		serverToUse, err := serverOrCurrentHost(ctx, database, *serverFlag)
+		if err != nil {
+			return err
+		}
+
+		if *copyTo != "" && !*dryRun {
+			paths, err := hostPathLocks(database, *copyTo)
+			if err != nil {
+				return err
+			}
+			release, err := lockPaths(ctx, database, "files unique --copy-to "+*copyTo, *lockTimeout, paths)
+			if err != nil {
+				return err
+			}
+			defer release()
+		}
+
+		return files.ListUnique(ctx, database, files.UniqueOptions{
+			Server:  serverToUse,
+			Against: against,
+			MinSize: minSize.Bytes,
+			Output:  *outputFlag,
+			List:    *listFlag,
+			CopyTo:  *copyTo,
+			DryRun:  *dryRun,
+		})
+
+	case "export-hashes":
+		for _, arg := range args[1:] {
+			if arg == "--help" || arg == "help" {
+				cmd := FindCommand("files export-hashes")
+				if cmd != nil {
+					ShowCommandHelp(*cmd)
+					return nil
+				}
+				break
+			}
+		}
+
+		exportCmd := flag.NewFlagSet("export-hashes", flag.ExitOnError)
+		serverFlag := exportCmd.String("server", "", "Host to export hashes for (defaults to current host)")
+		pathFlag := exportCmd.String("path", "", "Friendly path to restrict the export to (optional)")
+		formatFlag := exportCmd.String("format", "csv", "Output format (csv|binary)")
+		changedSinceFlag := exportCmd.String("changed-since", "", "Only export files hashed at or after this time (RFC3339 or YYYY-MM-DD)")
+		err = exportCmd.Parse(args[1:])
+		if err != nil {
+			return fmt.Errorf("error parsing export-hashes command flags: %v", err)
+		}
+
+		exportOpts := files.ExportHashesOptions{Path: *pathFlag, Format: *formatFlag}
+		if *changedSinceFlag != "" {
+			exportOpts.ChangedSince, err = parseTimestamp(*changedSinceFlag)
+			if err != nil {
+				return fmt.Errorf("invalid value for --changed-since: %v", err)
+			}
+		}
+		exportOpts.Server, err = serverOrCurrentHost(ctx, database, *serverFlag)
+		if err != nil {
+			return err
+		}
+
+		out := bufio.NewWriter(os.Stdout)
+		if _, err := files.ExportHashes(ctx, database, exportOpts, out); err != nil {
+			return err
+		}
+		return out.Flush()
+
+	case "import-hashes":
+		for _, arg := range args[1:] {
+			if arg == "--help" || arg == "help" {
+				cmd := FindCommand("files import-hashes")
+				if cmd != nil {
+					ShowCommandHelp(*cmd)
+					return nil
+				}
+				break
+			}
+		}
+
+		importHashesCmd := flag.NewFlagSet("import-hashes", flag.ExitOnError)
+		fileFlag := importHashesCmd.String("file", "-", "Export file to read (- for stdin)")
+		formatFlag := importHashesCmd.String("format", "csv", "Input format (csv|binary)")
+		err = importHashesCmd.Parse(args[1:])
+		if err != nil {
+			return fmt.Errorf("error parsing import-hashes command flags: %v", err)
+		}
+
+		in := io.Reader(os.Stdin)
+		if *fileFlag != "-" {
+			f, err := os.Open(*fileFlag)
+			if err != nil {
+				return fmt.Errorf("error opening %s: %v", *fileFlag, err)
+			}
+			defer f.Close()
+			in = f
+		}
+		return files.ImportHashes(ctx, database, files.ImportHashesOptions{Format: *formatFlag}, in)
+
+	case "undelete":
+		for _, arg := range args[1:] {
+			if arg == "--help" || arg == "help" {
+				cmd := FindCommand("files undelete")
+				if cmd != nil {
+					ShowCommandHelp(*cmd)
+					return nil
+				}
+				break
+			}
+		}
+
+		undeleteCmd := flag.NewFlagSet("undelete", flag.ExitOnError)
+		serverFlag := undeleteCmd.String("server", "", "Host to restore rows for (defaults to current host)")
+		pathFlag := undeleteCmd.String("path", "", "Friendly path to restrict the restore to (optional)")
+		since := files.DurationFlag{Duration: 24 * time.Hour}
+		undeleteCmd.Var(&since, "since", "Restore rows deleted within this window (e.g. 2h, 7d; default: 24h)")
+		err = undeleteCmd.Parse(args[1:])
+		if err != nil {
+			return fmt.Errorf("error parsing undelete command flags: %v", err)
+		}
+
+		serverToUse, err := serverOrCurrentHost(ctx, database, *serverFlag)
+		if err != nil {
+			return err
+		}
+		restored, skipped, err := files.UndeleteFiles(ctx, database, files.UndeleteOptions{
+			Server: serverToUse,
+			Path:   *pathFlag,
+			Since:  since.Duration,
+		})
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Restored %d files", restored)
+		if skipped > 0 {
+			fmt.Printf(" (%d skipped: path indexed again or deleted more than once)", skipped)
+		}
+		fmt.Println()
+		return nil
+
+	case "vacuum":
+		for _, arg := range args[1:] {
+			if arg == "--help" || arg == "help" {
+				cmd := FindCommand("files vacuum")
+				if cmd != nil {
+					ShowCommandHelp(*cmd)
+					return nil
+				}
+				break
+			}
+		}
+
+		vacuumCmd := flag.NewFlagSet("vacuum", flag.ExitOnError)
+		olderThan := files.DurationFlag{Duration: 30 * 24 * time.Hour}
+		vacuumCmd.Var(&olderThan, "older-than", "Purge rows soft-deleted longer ago than this (e.g. 30d; default: 30d)")
+		batchSize := vacuumCmd.Int("batch-size", 0, "Rows removed per statement (default: 1000)")
+		err = vacuumCmd.Parse(args[1:])
+		if err != nil {
+			return fmt.Errorf("error parsing vacuum command flags: %v", err)
+		}
+
+		removed, err := files.VacuumFiles(ctx, database, files.VacuumOptions{
+			OlderThan: olderThan.Duration,
+			BatchSize: *batchSize,
+		})
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Purged %d soft-deleted rows\n", removed)
+		return nil
+
 	case "hash":
 		// Check for help flag
 		for _, arg := range args[1:] {
@@ -172,54 +743,105 @@ func HandleFiles(ctx context.Context, database *sql.DB, args []string) error {
 
 		// Parse hash command flags
 		hashCmd := flag.NewFlagSet("hash", flag.ExitOnError)
+		serverFlag := hashCmd.String("server", "", "Host to hash files for, by name or hostname (defaults to current host)")
 		force := hashCmd.Bool("force", false, "Rehash selected files even if they already have a hash")
 		renew := hashCmd.Bool("renew", false, "Recalculate hashes older than 1 week")
 		retryProblematic := hashCmd.Bool("retry-problematic", false, "Retry files that previously timed out")
+		maxAttempts := hashCmd.Int("max-attempts", files.DefaultHashMaxAttempts, "Timeouts after which a file is given up as permanent and only retried by --force (0 = never)")
 		fullHash := hashCmd.Bool("full-hash", false, "Hash full contents for all eligible files")
-		largeFirst := hashCmd.Bool("large-first", false, "Process larger files before smaller files")
+		largeFirst := hashCmd.Bool("large-first", false, "Process larger files before smaller files (same as --order size-desc)")
+		order := hashCmd.String("order", "id", "Order to hash files in: id, size-desc (largest first) or newest (most recently added first)")
 		var priorityPaths repeatedStringFlag
 		hashCmd.Var(&priorityPaths, "path", "Friendly path or absolute root folder to process first (can be repeated)")
-		_ = hashCmd.Int("count", 0, "Process only N files (0 = unlimited)")
+		onlyPath := hashCmd.String("only-path", "", "Only hash files under this friendly path")
+		var minSize, maxSize files.SizeFlag
+		hashCmd.Var(&minSize, "min-size", "Only hash files at least this large (e.g., \"1M\", \"1.5G\", \"500K\")")
+		hashCmd.Var(&maxSize, "max-size", "Only hash files at most this large (e.g., \"1M\", \"1.5G\", \"500K\")")
+		algo := hashCmd.String("algo", files.HashAlgoSHA256, "Hash algorithm to hash with: sha256 or blake3 (with --force, also re-hashes rows hashed with another one)")
+		prescreen := hashCmd.Bool("prescreen", false, "Quick-hash candidates first and fully hash only files whose size and quick hash collide")
+		auditSample := hashCmd.Int("audit-sample", files.DefaultHashAuditSample, "Re-hash N files hashed this run at the end and fail on any mismatch (0 disables)")
+		count := hashCmd.Int("count", 0, "Stop after hashing N files (0 = unlimited)")
+		resume := hashCmd.Bool("resume", true, "Continue after the checkpoint of an interrupted run with the same options")
+		noResume := hashCmd.Bool("no-resume", false, "Ignore the checkpoint of an interrupted run and start from the beginning")
+		remote := hashCmd.Bool("remote", false, "Hash the files of another host on it over ssh with its hash command")
+		noFileProgress := hashCmd.Bool("no-file-progress", false, "Only show the overall progress bar, not one per file (default when stdout is not a terminal)")
 
 		if err := hashCmd.Parse(args[1:]); err != nil {
 			fmt.Printf("Error: failed to parse hash command flags: %v\n", err)
 			return err
 		}
-		// Get hostname for current machine
-		hostname, err := os.Hostname()
-		if err != nil {
-			fmt.Printf("Error: failed to get hostname: %v\n", err)
+		if *auditSample < 0 {
+			return fmt.Errorf("--audit-sample must not be negative")
+		}
+		if *count < 0 {
+			return fmt.Errorf("--count must not be negative")
+		}
+		newestFirst := false
+		switch *order {
+		case "id":
+		case "size-desc":
+			*largeFirst = true
+		case "newest":
+			if *largeFirst {
+				return fmt.Errorf("--large-first cannot be combined with --order newest")
+			}
+			newestFirst = true
+		default:
+			return fmt.Errorf("invalid value for --order: %q (use id, size-desc or newest)", *order)
+		}
+		if *maxAttempts < 0 {
+			return fmt.Errorf("--max-attempts must not be negative")
+		}
+		if *noFileProgress {
+			files.SetFileProgress(false)
+		}
+		if maxSize.Bytes > 0 && maxSize.Bytes < minSize.Bytes {
+			return fmt.Errorf("--max-size must not be smaller than --min-size")
+		}
+		if _, err := files.ParseHashAlgo(*algo); err != nil {
 			return err
 		}
-
-		// Convert hostname to lowercase for consistency
-		hostname = strings.ToLower(hostname)
-
-		// Find host in database by hostname (case-insensitive)
-		var hostName string
-		err = database.QueryRow(`
-			SELECT name
-			FROM hosts
-			WHERE LOWER(hostname) = LOWER($1)
-		`, hostname).Scan(&hostName)
-		if err != nil {
-			if err == sql.ErrNoRows {
-				fmt.Printf("Error: no host found for hostname '%s'. Please add it using 'deduplicator manage add'.\n", hostname)
+		// Default to the current machine when --server is not given
+		server := *serverFlag
+		if server == "" {
+			osHostname, err := os.Hostname()
+			if err != nil {
+				fmt.Printf("Error: failed to get hostname: %v\n", err)
 				return err
 			}
-			fmt.Printf("Error: failed to find host in database: %v\n", err)
+			server = osHostname
+		}
+		host, err := db.ResolveHost(database, server)
+		if err != nil {
+			if *serverFlag == "" {
+				err = files.UnknownHostError(strings.ToLower(server))
+			}
+			fmt.Printf("Error: %v\n", err)
 			return err
 		}
 
-		fmt.Printf("Hashing files for host: %s\n", hostName)
+		fmt.Printf("Hashing files for host: %s (rows of hostname %s)\n", host.Name, strings.ToLower(host.Hostname))
 		err = files.HashFiles(ctx, database, files.HashOptions{
-			Server:           hostName,
+			Host:             host,
 			Refresh:          *force,
 			Renew:            *renew,
 			RetryProblematic: *retryProblematic,
+			MaxAttempts:      *maxAttempts,
 			FullHash:         *fullHash,
 			LargeFirst:       *largeFirst,
+			NewestFirst:      newestFirst,
 			Paths:            []string(priorityPaths),
+			OnlyPath:         *onlyPath,
+			MinSize:          minSize.Bytes,
+			MaxSize:          maxSize.Bytes,
+			AuditSample:      *auditSample,
+			Algo:             *algo,
+			Prescreen:        *prescreen,
+			Remote:           *remote,
+			Count:            *count,
+			Checkpoint:       true,
+			Resume:           *resume && !*noResume,
+			Stats:            stats,
 		})
 		if err != nil {
 			if strings.Contains(err.Error(), "no files need hashing") || strings.Contains(err.Error(), "No files need hashing") {
@@ -268,7 +890,8 @@ func HandleFiles(ctx context.Context, database *sql.DB, args []string) error {
 			`, hostname).Scan(&hostName)
 		if err != nil {
 			if err == sql.ErrNoRows {
-				fmt.Printf("Error: no host found for hostname '%s'. Please add it using 'deduplicator manage add'.\n", hostname)
+				err = files.UnknownHostError(hostname)
+				fmt.Printf("Error: %v\n", err)
 				return err
 			}
 			fmt.Printf("Error: failed to find host in database: %v\n", err)
@@ -280,6 +903,92 @@ func HandleFiles(ctx context.Context, database *sql.DB, args []string) error {
 			Server: hostName,
 		})
 
+	case "rehash-all":
+		for _, arg := range args[1:] {
+			if arg == "--help" || arg == "help" {
+				cmd := FindCommand("files rehash-all")
+				if cmd != nil {
+					ShowCommandHelp(*cmd)
+					return nil
+				}
+				break
+			}
+		}
+
+		rehashCmd := flag.NewFlagSet("rehash-all", flag.ExitOnError)
+		serverName := rehashCmd.String("server", "", "Host whose files to rehash (defaults to current host)")
+		algo := rehashCmd.String("algo", files.HashAlgoSHA256, "Hash algorithm to recompute with: sha256 or blake3")
+		rate := rehashCmd.String("rate", "0", "Maximum files per second, minute or hour (e.g. 200/s; 0 = unlimited)")
+		window := rehashCmd.String("daily-window", "", "Only rehash between these local times (e.g. 01:00-06:00)")
+		restart := rehashCmd.Bool("restart", false, "Discard the saved checkpoint and start over")
+		if err := rehashCmd.Parse(args[1:]); err != nil {
+			return fmt.Errorf("error parsing rehash-all flags: %v", err)
+		}
+		if rehashCmd.NArg() != 0 {
+			return fmt.Errorf("rehash-all does not accept arguments")
+		}
+		perSecond, err := files.ParseRate(*rate)
+		if err != nil {
+			return err
+		}
+		server, err := serverOrCurrentHost(ctx, database, *serverName)
+		if err != nil {
+			return err
+		}
+
+		return files.RehashAll(ctx, database, files.RehashAllOptions{
+			Server:  server,
+			Algo:    *algo,
+			Rate:    perSecond,
+			Window:  *window,
+			Restart: *restart,
+			Stats:   stats,
+		})
+
+	case "verify":
+		for _, arg := range args[1:] {
+			if arg == "--help" || arg == "help" {
+				cmd := FindCommand("files verify")
+				if cmd != nil {
+					ShowCommandHelp(*cmd)
+					return nil
+				}
+				break
+			}
+		}
+
+		verifyCmd := flag.NewFlagSet("verify", flag.ExitOnError)
+		serverName := verifyCmd.String("server", "", "Host to verify (defaults to current host)")
+		all := verifyCmd.Bool("all", false, "Verify every hashed file")
+		sample := verifyCmd.Float64("sample", files.DefaultVerifySample, "Percentage of hashed files to verify")
+		var minSize files.SizeFlag
+		verifyCmd.Var(&minSize, "min-size", "Only verify files at least this large (e.g., \"1M\", \"1.5G\", \"500K\")")
+		failFast := verifyCmd.Bool("fail-fast", false, "Stop at the first mismatch")
+		resetMismatched := verifyCmd.Bool("reset-mismatched", false, "Clear the stored hash of mismatched files so files hash repairs them")
+		if err := verifyCmd.Parse(args[1:]); err != nil {
+			return fmt.Errorf("error parsing verify flags: %v", err)
+		}
+		if verifyCmd.NArg() != 0 {
+			return fmt.Errorf("verify does not accept arguments")
+		}
+		if !*all && (*sample <= 0 || *sample > 100) {
+			return fmt.Errorf("--sample must be greater than 0 and at most 100")
+		}
+		server, err := serverOrCurrentHost(ctx, database, *serverName)
+		if err != nil {
+			return err
+		}
+
+		return files.VerifyFiles(ctx, database, files.VerifyOptions{
+			Server:          server,
+			All:             *all,
+			SamplePercent:   *sample,
+			MinSize:         minSize.Bytes,
+			FailFast:        *failFast,
+			ResetMismatched: *resetMismatched,
+			Stats:           stats,
+		})
+
 	case "list-dupes":
 		// Check for help flag
 		for _, arg := range args[1:] {
@@ -296,32 +1005,123 @@ func HandleFiles(ctx context.Context, database *sql.DB, args []string) error {
 		// Parse command flags
 		cmd := flag.NewFlagSet(args[0], flag.ExitOnError)
 		count := cmd.Int("count", 0, "Limit the number of duplicate groups to show (0 = no limit)")
-		minSize := cmd.String("min-size", "", "Minimum file size to consider (e.g., \"1M\", \"1.5G\", \"500K\")")
-		destDir := cmd.String("dest", "", "Directory to move duplicates to (if specified)")
+		minSize, err := duplicateMinSize()
+		if err != nil {
+			return err
+		}
+		cmd.Var(&minSize, "min-size", "Minimum file size to consider (e.g., \"1M\", \"1.5G\", \"500K\"; default: DEDUPE_MIN_SIZE)")
+		ignoreEmpty := cmd.Bool("ignore-empty", false, "Leave out empty files even without --min-size")
+		sortFlag := cmd.String("sort", "size", "Order of the listed groups (size|count|path|savings)")
+		destDir := cmd.String("dest", "", "Directory to move duplicates to, or host:/path on another machine (if specified)")
 		run := cmd.Bool("run", false, "Actually move files (default is dry-run)")
+		showExternal := cmd.Bool("show-external", false, "Mark groups whose content is already held by an external backup (see import-hashes)")
+		contextNames := cmd.Int("context", 0, "Show up to N other files from each copy's directory (0 = off)")
+		format := cmd.String("format", "text", "Output format (text|brief|json); brief prints one tab-separated line per group, json the --summary report")
+		summary := cmd.Bool("summary", false, "Report totals instead of the groups; with --format brief, end with a totals line")
+		print0Paths := cmd.Bool("print0-paths", false, "Print only the paths the dedupe flow would move from this host, NUL-terminated")
+		csvFile := cmd.String("csv", "", "Write one row per duplicate file to FILE as CSV (- for stdout)")
 		stripPrefix := cmd.String("strip-prefix", "", "Remove this prefix from paths when moving files")
 		ignoreDestDir := cmd.Bool("ignore-dest", true, "Ignore files that are already in the destination directory")
+		recoverMode := cmd.String("recover", "", "Resolve a group left half done by an interrupted run (forward|back)")
+		mergeXattrs := cmd.Bool("merge-xattrs", false, "Copy whitelisted xattrs missing on the kept file from each moved copy")
+		symlink := cmd.Bool("symlink", false, "Leave a relative symlink to the kept file where each moved copy was")
+		interactive := cmd.Bool("interactive", false, "Ask on the terminal before moving each group (with --dest)")
+		var excludeFlags repeatedStringFlag
+		cmd.Var(&excludeFlags, "exclude", "Leave out files whose path matches this glob, e.g. '*.pkg' or '**/node_modules/**' (repeatable)")
+		friendlyPath := cmd.String("path", "", "Only consider this host's files under this friendly path")
+		keepFlag := cmd.String("keep", "", "Which copy to keep with --dest or --delete: most-populated (default), oldest, newest, shortest-path or path-prefix=DIR")
+		lockTimeout := cmd.Duration("lock-timeout", db.DefaultPathLockTimeout, "How long --run waits for mirror or dedupe runs on this host's paths (0 = indefinitely)")
+		deleteDupes := cmd.Bool("delete", false, "Delete surplus copies instead of moving them (needs --i-understand-data-loss with --run)")
+		acknowledged := cmd.Bool("i-understand-data-loss", false, "Confirm that --delete --run permanently deletes files")
+		minCopies := cmd.Int("min-copies", 1, "With --dest or --delete, how many copies of each group to keep")
+		verify := cmd.Bool("verify", false, "With --dest or --delete, re-hash each copy right before moving or deleting it and skip those that changed")
+		var minAge files.DurationFlag
+		cmd.Var(&minAge, "min-age", "With --dest or --delete, skip copies modified within this window, e.g. 10m or 1d (default: 0, no minimum)")
+		var maxBytes files.SizeFlag
+		cmd.Var(&maxBytes, "max-bytes", "With --dest, start no new group once the moved copies add up to this size, e.g. 200G (default: 0, no limit)")
+		deleteReport := cmd.String("delete-report", "", "With --delete, file recording every deletion (default: ~/.cache/deduplicator/deletions/<time>.tsv)")
 
 		err = cmd.Parse(args[1:])
 		if err != nil {
 			return fmt.Errorf("error parsing command flags: %v", err)
 		}
 
-		var parsedMinSize int64
-		if *minSize != "" {
-			var err error
-			parsedMinSize, err = files.ParseSize(*minSize)
-			if err != nil {
-				fmt.Printf("Error parsing min-size: %v\n", err)
-				os.Exit(1)
+		// If dest directory is specified, use DedupFiles, otherwise use FindDuplicates
+		if *destDir != "" && *deleteDupes {
+			return fmt.Errorf("--delete and --dest cannot be used together")
+		}
+		if *symlink && *destDir == "" {
+			return fmt.Errorf("--symlink only applies to moves with --dest")
+		}
+		if *interactive && *destDir == "" {
+			return fmt.Errorf("--interactive only applies to moves with --dest")
+		}
+		if maxBytes.Bytes > 0 && *destDir == "" {
+			return fmt.Errorf("--max-bytes only applies to moves with --dest")
+		}
+		exclude, err := files.ParsePathExcludes(excludeFlags)
+		if err != nil {
+			return err
+		}
+		if _, err := strconv.Atoi(*keepFlag); err == nil {
+			return fmt.Errorf("--keep takes a keep policy; use --min-copies %s to keep %s copies of each group", *keepFlag, *keepFlag)
+		}
+		keep, err := files.ParseKeepPolicy(*keepFlag)
+		if err != nil {
+			return err
+		}
+		if keep.Name != "" && *destDir == "" && !*deleteDupes {
+			return fmt.Errorf("--keep only applies to --dest or --delete")
+		}
+		sortBy, err := files.ParseDuplicateSort(*sortFlag)
+		if err != nil {
+			return err
+		}
+		if (*destDir != "" || *deleteDupes) && (*format != "text" || *summary || *print0Paths || *csvFile != "" || sortBy != files.SortBySize) {
+			return fmt.Errorf("--format, --summary, --sort, --print0-paths and --csv only apply to listings, not to --dest or --delete")
+		}
+		if *csvFile != "" && (*format != "text" || *print0Paths || *showExternal || *contextNames > 0) {
+			return fmt.Errorf("--csv cannot be combined with --format, --print0-paths, --show-external or --context")
+		}
+		minCopiesSet := false
+		cmd.Visit(func(f *flag.Flag) {
+			if f.Name == "min-copies" {
+				minCopiesSet = true
 			}
+		})
+		if minCopiesSet && *destDir == "" && !*deleteDupes {
+			return fmt.Errorf("--min-copies only applies to --dest or --delete")
 		}
-
-		// If dest directory is specified, use DedupFiles, otherwise use FindDuplicates
-		if *destDir != "" {
+		if !*deleteDupes && (*deleteReport != "" || *acknowledged) {
+			return fmt.Errorf("--delete-report and --i-understand-data-loss only apply to --delete")
+		}
+		if (*verify || minAge.Duration > 0) && *destDir == "" && !*deleteDupes {
+			return fmt.Errorf("--verify and --min-age only apply to --dest or --delete")
+		}
+		if *minCopies < 1 {
+			return fmt.Errorf("--min-copies must be at least 1")
+		}
+		if *deleteDupes && *run && !*acknowledged {
+			return fmt.Errorf("--delete --run permanently deletes files; add --i-understand-data-loss to confirm")
+		}
+		if *destDir != "" || *deleteDupes {
 			// Warn if --run is not specified
 			if !*run {
-				fmt.Println("Note: Running in dry-run mode. Use --run to actually move files.")
+				if *deleteDupes {
+					fmt.Println("Note: Running in dry-run mode. Use --run --i-understand-data-loss to actually delete files.")
+				} else {
+					fmt.Println("Note: Running in dry-run mode. Use --run to actually move files.")
+				}
+			} else {
+				paths, err := localPathLocks(database)
+				if err != nil {
+					return err
+				}
+				release, err := lockPaths(ctx, database, "files list-dupes --run", *lockTimeout, paths)
+				if err != nil {
+					return err
+				}
+				defer release()
 			}
 
 			return files.DedupFiles(ctx, database, files.DedupeOptions{
@@ -330,12 +1130,37 @@ func HandleFiles(ctx context.Context, database *sql.DB, args []string) error {
 				StripPrefix:   *stripPrefix,
 				Count:         *count,
 				IgnoreDestDir: *ignoreDestDir,
-				MinSize:       parsedMinSize,
+				MinSize:       minSize.Bytes,
+				IgnoreEmpty:   *ignoreEmpty,
+				Recover:       *recoverMode,
+				MergeXattrs:   *mergeXattrs,
+				Symlink:       *symlink,
+				Exclude:       exclude,
+				Path:          *friendlyPath,
+				Keep:          keep,
+				Interactive:   *interactive,
+				Stats:         stats,
+				Delete:        *deleteDupes,
+				MinCopies:     *minCopies,
+				Verify:        *verify,
+				MinAge:        minAge.Duration,
+				MaxBytes:      maxBytes.Bytes,
+				DeleteReport:  *deleteReport,
 			})
 		} else {
 			return files.FindDuplicates(ctx, database, files.DuplicateListOptions{
-				Count:   *count,
-				MinSize: parsedMinSize,
+				Count:        *count,
+				MinSize:      minSize.Bytes,
+				IgnoreEmpty:  *ignoreEmpty,
+				Sort:         sortBy,
+				ShowExternal: *showExternal,
+				Context:      *contextNames,
+				Format:       *format,
+				Summary:      *summary,
+				Print0Paths:  *print0Paths,
+				CSV:          *csvFile,
+				Exclude:      exclude,
+				Path:         *friendlyPath,
 			})
 		}
 
@@ -354,10 +1179,27 @@ func HandleFiles(ctx context.Context, database *sql.DB, args []string) error {
 
 		// Parse command flags
 		moveDupesCmd := flag.NewFlagSet(args[0], flag.ExitOnError)
-		target := moveDupesCmd.String("target", "", "Target directory to move duplicates to (required)")
+		target := moveDupesCmd.String("target", "", "Target directory to move duplicates to, or host:/path on another machine (required)")
 		dryRun := moveDupesCmd.Bool("dry-run", false, "Show what would be moved without making changes")
 		count := moveDupesCmd.Int("count", 0, "Limit the number of duplicate sets to process (0 = no limit)")
-		minSize := moveDupesCmd.String("min-size", "", "Minimum file size to consider (e.g., \"1M\", \"1.5G\", \"500K\")")
+		minSize, err := duplicateMinSize()
+		if err != nil {
+			return err
+		}
+		moveDupesCmd.Var(&minSize, "min-size", "Minimum file size to consider (e.g., \"1M\", \"1.5G\", \"500K\"; default: DEDUPE_MIN_SIZE)")
+		ignoreEmpty := moveDupesCmd.Bool("ignore-empty", false, "Leave out empty files even without --min-size")
+		recoverMode := moveDupesCmd.String("recover", "", "Resolve a group left half done by an interrupted run (forward|back)")
+		mergeXattrs := moveDupesCmd.Bool("merge-xattrs", false, "Copy whitelisted xattrs missing on a local kept file from each moved copy")
+		symlink := moveDupesCmd.Bool("symlink", false, "Leave a relative symlink to the kept file where each moved copy was (kept file must be on this host)")
+		var excludeFlags repeatedStringFlag
+		moveDupesCmd.Var(&excludeFlags, "exclude", "Leave out files whose path matches this glob, e.g. '*.pkg' or '**/node_modules/**' (repeatable)")
+		keepFlag := moveDupesCmd.String("keep", "", "Which copy to keep: most-populated, oldest, newest, shortest-path or path-prefix=DIR (default: first by host and path)")
+		verify := moveDupesCmd.Bool("verify", false, "Re-hash each copy right before moving it and skip those that changed")
+		var minAge files.DurationFlag
+		moveDupesCmd.Var(&minAge, "min-age", "Skip copies modified within this window, e.g. 10m or 1d (default: 0, no minimum)")
+		var maxBytes files.SizeFlag
+		moveDupesCmd.Var(&maxBytes, "max-bytes", "Start no new group once the moved copies add up to this size, e.g. 200G (default: 0, no limit)")
+		lockTimeout := moveDupesCmd.Duration("lock-timeout", db.DefaultPathLockTimeout, "How long to wait for mirror or dedupe runs on this host's paths (0 = indefinitely)")
 
 		err = moveDupesCmd.Parse(args[1:])
 		if err != nil {
@@ -367,30 +1209,94 @@ func HandleFiles(ctx context.Context, database *sql.DB, args []string) error {
 		if *target == "" {
 			return fmt.Errorf("--target is required for move-dupes command")
 		}
-
-		var parsedMinSize int64
-		if *minSize != "" {
-			parsedMinSize, err = files.ParseSize(*minSize)
-			if err != nil {
-				return fmt.Errorf("error parsing min-size: %v", err)
-			}
+		keep, err := files.ParseKeepPolicy(*keepFlag)
+		if err != nil {
+			return err
+		}
+		exclude, err := files.ParsePathExcludes(excludeFlags)
+		if err != nil {
+			return err
 		}
 
 		// Create move options
 		moveOpts := files.MoveOptions{
-			TargetDir: *target,
-			DryRun:    *dryRun,
-			Count:     *count,
+			TargetDir:   *target,
+			DryRun:      *dryRun,
+			Count:       *count,
+			Recover:     *recoverMode,
+			MergeXattrs: *mergeXattrs,
+			Symlink:     *symlink,
+			Keep:        keep,
+			Verify:      *verify,
+			MinAge:      minAge.Duration,
+			MaxBytes:    maxBytes.Bytes,
+			Stats:       stats,
+		}
+
+		if !*dryRun {
+			paths, err := localPathLocks(database)
+			if err != nil {
+				return err
+			}
+			release, err := lockPaths(ctx, database, "files move-dupes", *lockTimeout, paths)
+			if err != nil {
+				return err
+			}
+			defer release()
 		}
 
 		// Call MoveDuplicates with the appropriate options
 		dupOpts := files.DuplicateListOptions{
-			Count:   *count,
-			MinSize: parsedMinSize,
+			Count:       *count,
+			MinSize:     minSize.Bytes,
+			IgnoreEmpty: *ignoreEmpty,
+			Exclude:     exclude,
 		}
 
 		return files.MoveDuplicates(ctx, database, dupOpts, moveOpts)
 
+	case "undo-moves":
+		for _, arg := range args[1:] {
+			if arg == "--help" || arg == "help" {
+				cmd := FindCommand("files undo-moves")
+				if cmd != nil {
+					ShowCommandHelp(*cmd)
+					return nil
+				}
+				break
+			}
+		}
+
+		undoCmd := flag.NewFlagSet("undo-moves", flag.ExitOnError)
+		manifest := undoCmd.String("manifest", "", "Move manifest written by move-dupes or list-dupes --dest (required)")
+		dryRun := undoCmd.Bool("dry-run", false, "Show what would be moved back without making changes")
+		lockTimeout := undoCmd.Duration("lock-timeout", db.DefaultPathLockTimeout, "How long to wait for mirror or dedupe runs on this host's paths (0 = indefinitely)")
+		err = undoCmd.Parse(args[1:])
+		if err != nil {
+			return fmt.Errorf("error parsing undo-moves command flags: %v", err)
+		}
+		if *manifest == "" {
+			return fmt.Errorf("--manifest is required for undo-moves command")
+		}
+
+		if !*dryRun {
+			paths, err := localPathLocks(database)
+			if err != nil {
+				return err
+			}
+			release, err := lockPaths(ctx, database, "files undo-moves", *lockTimeout, paths)
+			if err != nil {
+				return err
+			}
+			defer release()
+		}
+
+		return files.UndoMoves(ctx, database, files.UndoMovesOptions{
+			Manifest: *manifest,
+			DryRun:   *dryRun,
+			Stats:    stats,
+		})
+
 	case "mirror":
 		// Check for help flag
 		for _, arg := range args[1:] {
@@ -409,13 +1315,29 @@ func HandleFiles(ctx context.Context, database *sql.DB, args []string) error {
 		}
 		var friendlyPath string
 		friendlyPath = args[1]
-		return files.MirrorFriendlyPath(ctx, database, friendlyPath)
+		mirrorCmd := flag.NewFlagSet(args[0], flag.ExitOnError)
+		lockTimeout := mirrorCmd.Duration("lock-timeout", db.DefaultPathLockTimeout, "How long to wait for other mirror or dedupe runs on the path (0 = indefinitely)")
+		transferRetries := mirrorCmd.Int("transfer-retries", files.DefaultTransferRetries, "Attempts per rsync or ssh mkdir while it fails transiently (1 = no retries)")
+		if err := mirrorCmd.Parse(args[2:]); err != nil {
+			return fmt.Errorf("error parsing mirror flags: %v", err)
+		}
+
+		paths, err := friendlyPathLocks(database, friendlyPath)
+		if err != nil {
+			return err
+		}
+		release, err := lockPaths(ctx, database, "files mirror "+friendlyPath, *lockTimeout, paths)
+		if err != nil {
+			return err
+		}
+		defer release()
+		return files.MirrorFriendlyPath(ctx, database, friendlyPath, *transferRetries)
 
-	case "mirror-group":
+	case "mirror-group", "group-replicate":
 		// Check for help flag
 		for _, arg := range args[1:] {
 			if arg == "--help" || arg == "help" {
-				cmd := FindCommand("files mirror-group")
+				cmd := FindCommand("files " + args[0])
 				if cmd != nil {
 					ShowCommandHelp(*cmd)
 					return nil
@@ -425,50 +1347,84 @@ func HandleFiles(ctx context.Context, database *sql.DB, args []string) error {
 		}
 
 		if len(args) < 2 {
-			return fmt.Errorf("mirror-group requires a group name argument")
+			return fmt.Errorf("%s requires a group name argument", args[0])
 		}
 
 		mirrorGroupCmd := flag.NewFlagSet(args[0], flag.ExitOnError)
 		dryRun := mirrorGroupCmd.Bool("dry-run", false, "Show what would be mirrored without transferring files")
+		replicate := mirrorGroupCmd.Bool("replicate", args[0] == "group-replicate", "Only copy hashes held by fewer members than the group's min_copies")
+		lockTimeout := mirrorGroupCmd.Duration("lock-timeout", db.DefaultPathLockTimeout, "How long to wait for other mirror or dedupe runs on the member paths (0 = indefinitely)")
 		if err := mirrorGroupCmd.Parse(args[2:]); err != nil {
-			return fmt.Errorf("error parsing mirror-group flags: %v", err)
+			return fmt.Errorf("error parsing %s flags: %v", args[0], err)
+		}
+
+		if !*dryRun {
+			paths, err := groupPathLocks(database, args[1])
+			if err != nil {
+				return err
+			}
+			release, err := lockPaths(ctx, database, "files "+args[0]+" "+args[1], *lockTimeout, paths)
+			if err != nil {
+				return err
+			}
+			defer release()
 		}
 
 		return files.MirrorGroup(ctx, database, files.GroupMirrorOptions{
 			GroupName: args[1],
 			DryRun:    *dryRun,
+			Replicate: *replicate,
+			Stats:     stats,
 		})
 
-	case "dedupe-group":
+	case "dedupe-group", "group-dedupe":
 		// Check for help flag
 		for _, arg := range args[1:] {
 			if arg == "--help" || arg == "help" {
-				fmt.Println("Usage: deduplicator files dedupe-group <group name> [options]")
+				fmt.Println("Usage: deduplicator files dedupe-group <group name>|--group <name> [options]")
 				fmt.Println("\nOptions:")
-				fmt.Println("  --balance-mode <mode>  Balance mode: priority (default), equal, capacity")
+				fmt.Println("  --group <name>         The path group, instead of the first argument")
+				fmt.Println("  --balance-mode <mode>  Balance mode: priority (default), equal, capacity (alias --balance)")
 				fmt.Println("  --respect-limits       Honor min/max copy limits from group settings")
 				fmt.Println("  --dry-run              Show what would be done without making changes")
-				fmt.Println("  --min-size <bytes>     Only process files larger than this size")
+				fmt.Println("  --min-size <size>      Only process files at least this size (e.g. 500M, 1.5G)")
 				fmt.Println("  --count <n>            Limit the number of duplicate groups to process")
 				fmt.Println("  --run                  Actually perform the deduplication (opposite of dry-run)")
+				fmt.Println("  --no-verify            With --run, remove copies without first re-hashing the kept and removed copies (over ssh for remote hosts)")
+				fmt.Println("  --keep <policy>        Rank copies of equal priority: most-populated, oldest, newest, shortest-path, path-prefix=DIR")
+				fmt.Println("  --lock-timeout <d>     How long --run waits for other mirror or dedupe runs on the member paths (default 30s, 0 = indefinitely)")
+				fmt.Println("  --report <file>        Write the plan, and with --run the outcome of each removal, to a JSON file")
+				fmt.Println("  --workers <n>          Process this many duplicate groups at once (default 1)")
 				return nil
 			}
 		}
 
-		if len(args) < 2 {
-			return fmt.Errorf("dedupe-group requires a group name argument")
+		// The group is the first argument or --group NAME
+		groupName := ""
+		first := 1
+		if len(args) > 1 && !strings.HasPrefix(args[1], "-") {
+			groupName = args[1]
+			first = 2
 		}
-
-		groupName := args[1]
 		balanceMode := "priority"
 		respectLimits := false
 		dryRun := true
-		minSize := int64(0)
+		var minSize files.SizeFlag
 		count := 0
+		verify := true
+		var keep files.KeepPolicy
+		lockTimeout := db.DefaultPathLockTimeout
+		report := ""
+		workers := 1
 
-		for i := 2; i < len(args); i++ {
+		for i := first; i < len(args); i++ {
 			switch args[i] {
-			case "--balance-mode":
+			case "--group":
+				if i+1 < len(args) {
+					groupName = args[i+1]
+					i++
+				}
+			case "--balance-mode", "--balance":
 				if i+1 < len(args) {
 					balanceMode = args[i+1]
 					i++
@@ -479,9 +1435,24 @@ func HandleFiles(ctx context.Context, database *sql.DB, args []string) error {
 				dryRun = true
 			case "--run":
 				dryRun = false
+			case "--verify":
+				verify = true
+			case "--no-verify":
+				verify = false
+			case "--keep":
+				if i+1 < len(args) {
+					policy, err := files.ParseKeepPolicy(args[i+1])
+					if err != nil {
+						return err
+					}
+					keep = policy
+					i++
+				}
 			case "--min-size":
 				if i+1 < len(args) {
-					fmt.Sscanf(args[i+1], "%d", &minSize)
+					if err := minSize.Set(args[i+1]); err != nil {
+						return fmt.Errorf("invalid value for --min-size: %v", err)
+					}
 					i++
 				}
 			case "--count":
@@ -489,16 +1460,57 @@ func HandleFiles(ctx context.Context, database *sql.DB, args []string) error {
 					fmt.Sscanf(args[i+1], "%d", &count)
 					i++
 				}
+			case "--lock-timeout":
+				if i+1 < len(args) {
+					d, err := files.ParseDuration(args[i+1])
+					if err != nil {
+						return fmt.Errorf("invalid value for --lock-timeout: %v", err)
+					}
+					lockTimeout = d
+					i++
+				}
+			case "--report":
+				if i+1 < len(args) {
+					report = args[i+1]
+					i++
+				}
+			case "--workers":
+				if i+1 < len(args) {
+					if _, err := fmt.Sscanf(args[i+1], "%d", &workers); err != nil || workers < 1 {
+						return fmt.Errorf("invalid value for --workers: %q (want a number of at least 1)", args[i+1])
+					}
+					i++
+				}
+			}
+		}
+
+		if groupName == "" {
+			return fmt.Errorf("dedupe-group requires a group name argument or --group NAME")
+		}
+
+		if !dryRun {
+			paths, err := groupPathLocks(database, groupName)
+			if err != nil {
+				return err
+			}
+			release, err := lockPaths(ctx, database, "files dedupe-group "+groupName, lockTimeout, paths)
+			if err != nil {
+				return err
 			}
+			defer release()
 		}
 
 		opts := files.GroupDedupeOptions{
-			GroupName:     groupName,
-			BalanceMode:   balanceMode,
-			RespectLimits: respectLimits,
-			DryRun:        dryRun,
-			MinSize:       minSize,
-			Count:         count,
+			GroupName:          groupName,
+			BalanceMode:        balanceMode,
+			RespectLimits:      respectLimits,
+			DryRun:             dryRun,
+			MinSize:            minSize.Bytes,
+			Count:              count,
+			VerifyBeforeAction: verify,
+			Keep:               keep,
+			Report:             report,
+			Workers:            workers,
 		}
 
 		return files.DeduplicateByGroup(ctx, database, opts)
@@ -507,3 +1519,33 @@ func HandleFiles(ctx context.Context, database *sql.DB, args []string) error {
 		return fmt.Errorf("unknown files subcommand: %s", args[0])
 	}
 }
+
+// HandleImportStatus prints the status file kept by files import
+// --status-file. It needs no database connection.
+func HandleImportStatus(args []string) error {
+	for _, arg := range args {
+		if arg == "--help" || arg == "help" {
+			cmd := FindCommand("files import-status")
+			if cmd != nil {
+				ShowCommandHelp(*cmd)
+				return nil
+			}
+		}
+	}
+
+	statusCmd := flag.NewFlagSet("import-status", flag.ExitOnError)
+	statusFile := statusCmd.String("file", "", "Status file written by files import --status-file (required)")
+	if err := statusCmd.Parse(args); err != nil {
+		return fmt.Errorf("error parsing command flags: %v", err)
+	}
+	if *statusFile == "" {
+		return fmt.Errorf("--file is required")
+	}
+
+	status, err := files.ReadRunStatus(*statusFile)
+	if err != nil {
+		return err
+	}
+	files.PrintRunStatus(status, time.Now())
+	return nil
+}
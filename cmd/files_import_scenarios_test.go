@@ -0,0 +1,51 @@
+package cmd
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+func TestImportAgeWindowCombinesAgeFlags(t *testing.T) {
+	for _, tc := range []struct {
+		age, olderThan, newerThan time.Duration
+		minAge, maxAge            time.Duration
+	}{
+		{age: 10 * time.Minute, minAge: 10 * time.Minute},
+		{olderThan: 2 * time.Hour, minAge: 2 * time.Hour},
+		{age: time.Hour, olderThan: time.Hour, minAge: time.Hour},
+		{newerThan: 48 * time.Hour, maxAge: 48 * time.Hour},
+		{olderThan: time.Hour, newerThan: 720 * time.Hour, minAge: time.Hour, maxAge: 720 * time.Hour},
+	} {
+		minAge, maxAge, err := importAgeWindow(tc.age, tc.olderThan, tc.newerThan)
+		if err != nil || minAge != tc.minAge || maxAge != tc.maxAge {
+			t.Errorf("importAgeWindow(%s, %s, %s) = %s, %s, %v; want %s, %s",
+				tc.age, tc.olderThan, tc.newerThan, minAge, maxAge, err, tc.minAge, tc.maxAge)
+		}
+	}
+}
+
+func TestImportRejectsConflictingAgeFlags(t *testing.T) {
+	db, _, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("sqlmock: %v", err)
+	}
+	defer db.Close()
+
+	for _, tc := range []struct {
+		args []string
+		want string
+	}{
+		{[]string{"--age", "10", "--older-than", "2h"}, "give only one"},
+		{[]string{"--older-than", "7d", "--newer-than", "1d"}, "--newer-than"},
+		{[]string{"--age", "60", "--newer-than", "1h"}, "--newer-than"},
+	} {
+		args := append([]string{"import", "--source", "/tmp/in", "--server", "Backup1", "--path", "photos"}, tc.args...)
+		if err := HandleFiles(context.Background(), db, args); err == nil || !strings.Contains(err.Error(), tc.want) {
+			t.Errorf("expected %q to be rejected mentioning %q, got %v", tc.args, tc.want, err)
+		}
+	}
+}
@@ -2,7 +2,10 @@ package cmd
 
 import (
 	"context"
+	"database/sql"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/DATA-DOG/go-sqlmock"
 )
@@ -19,6 +22,73 @@ func TestMoveDupesTargetRequired(t *testing.T) {
 	}
 }
 
+func TestUndoMovesManifestRequired(t *testing.T) {
+	db, _, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("sqlmock: %v", err)
+	}
+	defer db.Close()
+
+	if err := HandleFiles(context.Background(), db, []string{"undo-moves"}); err == nil {
+		t.Fatalf("expected error when --manifest is missing")
+	}
+}
+
+func TestListDupesMinCopiesNeedsDestOrDelete(t *testing.T) {
+	db, _, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("sqlmock: %v", err)
+	}
+	defer db.Close()
+	for _, tc := range []struct {
+		args []string
+		want string
+	}{
+		{[]string{"list-dupes", "--min-copies", "2"}, "--min-copies only applies"},
+		{[]string{"list-dupes", "--min-copies", "1"}, "--min-copies only applies"},
+		{[]string{"list-dupes", "--dest", "/tmp/dupes", "--min-copies", "0"}, "--min-copies must be at least 1"},
+		{[]string{"list-dupes", "--dest", "/tmp/dupes", "--keep", "2"}, "use --min-copies 2"},
+	} {
+		if err := HandleFiles(context.Background(), db, tc.args); err == nil || !strings.Contains(err.Error(), tc.want) {
+			t.Errorf("expected %q to fail with %q, got %v", tc.args, tc.want, err)
+		}
+	}
+}
+
+func TestDuplicateMinSizeDefaultsToConfig(t *testing.T) {
+	t.Setenv("DEDUPE_MIN_SIZE", "4K")
+	minSize, err := duplicateMinSize()
+	if err != nil || minSize.Bytes != 4096 {
+		t.Fatalf("duplicateMinSize = %d, %v; want 4096", minSize.Bytes, err)
+	}
+	if err := minSize.Set("0"); err != nil || minSize.Bytes != 0 {
+		t.Fatalf("--min-size 0 should turn the default off, got %d, %v", minSize.Bytes, err)
+	}
+
+	t.Setenv("DEDUPE_MIN_SIZE", "4KB5")
+	if _, err := duplicateMinSize(); err == nil || !strings.Contains(err.Error(), "DEDUPE_MIN_SIZE") {
+		t.Fatalf("expected an invalid DEDUPE_MIN_SIZE error, got %v", err)
+	}
+}
+
+func TestListDupesSortOnlyAppliesToListings(t *testing.T) {
+	db, _, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("sqlmock: %v", err)
+	}
+	defer db.Close()
+
+	for _, args := range [][]string{
+		{"list-dupes", "--sort", "largest"},
+		{"list-dupes", "--sort", "count", "--dest", "/backup/dupes"},
+		{"list-dupes", "--sort", "savings", "--delete"},
+	} {
+		if err := HandleFiles(context.Background(), db, args); err == nil || !strings.Contains(err.Error(), "--sort") {
+			t.Errorf("expected %q to be rejected, got %v", args, err)
+		}
+	}
+}
+
 func TestMirrorGroupRequiresGroupName(t *testing.T) {
 	db, _, err := sqlmock.New()
 	if err != nil {
@@ -42,3 +112,70 @@ func TestHashUpgradeRejectsArguments(t *testing.T) {
 		t.Fatalf("expected error when hash-upgrade receives an argument")
 	}
 }
+
+func TestDedupeGroupReportsFriendlySizeError(t *testing.T) {
+	db, _, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("sqlmock: %v", err)
+	}
+	defer db.Close()
+
+	err = HandleFiles(context.Background(), db, []string{"dedupe-group", "photos", "--min-size", "1GB5"})
+	if err == nil {
+		t.Fatalf("expected error for malformed --min-size")
+	}
+	if !strings.Contains(err.Error(), `invalid size "1GB5"`) || !strings.Contains(err.Error(), "500M, 1.5G") {
+		t.Fatalf("expected friendly size error, got %v", err)
+	}
+}
+
+func TestGroupDedupeTakesTheGroupAsAFlag(t *testing.T) {
+	db, _, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("sqlmock: %v", err)
+	}
+	defer db.Close()
+
+	// group-dedupe is dedupe-group, with the group given by --group
+	err = HandleFiles(context.Background(), db, []string{"group-dedupe", "--group", "photos", "--balance", "equal", "--min-size", "1GB5"})
+	if err == nil || !strings.Contains(err.Error(), `invalid size "1GB5"`) {
+		t.Fatalf("expected the --min-size error, got %v", err)
+	}
+	err = HandleFiles(context.Background(), db, []string{"group-dedupe", "--dry-run"})
+	if err == nil || !strings.Contains(err.Error(), "requires a group name") {
+		t.Fatalf("expected a missing group error, got %v", err)
+	}
+}
+
+func TestHashServerFlagOverridesLocalHost(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("sqlmock: %v", err)
+	}
+	defer db.Close()
+
+	// --server is looked up once, by hostname and then by friendly name, and
+	// HashFiles counts the resolved host's rows without a second lookup.
+	mock.ExpectQuery(`FROM hosts WHERE LOWER\(hostname\) = LOWER\(\$1\)`).
+		WithArgs("Backup1").
+		WillReturnError(sql.ErrNoRows)
+	mock.ExpectQuery(`FROM hosts WHERE name = \$1`).
+		WithArgs("Backup1").
+		WillReturnRows(sqlmock.NewRows([]string{"id", "name", "hostname", "ip", "root_path", "settings", "created_at"}).
+			AddRow(1, "Backup1", "backup1.local", "", "", []byte(`{}`), time.Now()))
+	mock.ExpectQuery(`SELECT COUNT\(\*\) FROM files`).
+		WithArgs("backup1.local").
+		WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(0))
+
+	out := captureStdout(t, func() {
+		if err := HandleFiles(context.Background(), db, []string{"hash", "--server", "Backup1"}); err != nil {
+			t.Fatalf("files hash --server: %v", err)
+		}
+	})
+	if !strings.Contains(out, "Hashing files for host: Backup1 (rows of hostname backup1.local)") {
+		t.Fatalf("expected the resolved host in the output, got %q", out)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatalf("unmet expectations: %v", err)
+	}
+}
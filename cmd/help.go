@@ -6,7 +6,7 @@ import "fmt"
 func PrintUsage(version string) {
 	fmt.Printf("Deduplicator %s - A tool for finding and managing duplicate files\n\n", version)
 	fmt.Println("Usage:")
-	fmt.Println("Usage: deduplicator <command> [options]")
+	fmt.Println("Usage: deduplicator [--read-only] [--auto-register] [--notify-min-duration D] [--db-timeout D] <command> [options]")
 	fmt.Println("Available Commands:")
 
 	// Find the longest command name for padding
@@ -27,12 +27,19 @@ func PrintUsage(version string) {
 		fmt.Printf("  deduplicator %s\n", cmd.Usage)
 	}
 
+	fmt.Println("\nGlobal Options:")
+	fmt.Println("  --read-only      Refuse every database write; write-oriented commands will not start")
+	fmt.Println("  --auto-register  Register this machine as a host when update/find/hash/prune cannot find it")
+	fmt.Println("  --notify-min-duration D  Notify successful hash/find/prune/import/mirror runs longer than D (default: 10m)")
+	fmt.Println("  --db-timeout D   Statement timeout for this command; 0 for none (default: 30s for listings, none for batch runs)")
+
 	fmt.Println("\nEnvironment Variables:")
 	fmt.Println("  DB_HOST          PostgreSQL host (default: localhost)")
 	fmt.Println("  DB_PORT          PostgreSQL port (default: 5432)")
 	fmt.Println("  DB_USER          PostgreSQL user (default: postgres)")
 	fmt.Println("  DB_PASSWORD      PostgreSQL password")
 	fmt.Println("  DB_NAME          PostgreSQL database name (default: deduplicator)")
+	fmt.Println("  DB_TIMEOUT       Default for --db-timeout")
 	fmt.Println("  DB_URL           Optional database URL (overrides individual DB_* values when used by your scripts)")
 	fmt.Println("  RABBITMQ_HOST    RabbitMQ host (optional)")
 	fmt.Println("  RABBITMQ_PORT    RabbitMQ port (default: 5672)")
@@ -42,6 +49,13 @@ func PrintUsage(version string) {
 	fmt.Println("  RABBITMQ_QUEUE   RabbitMQ queue name (default: dedup_backup)")
 	fmt.Println("  DEDUPLICATOR_LOCK_DIR    Override lock directory for flow locks")
 	fmt.Println("  LOCAL_MIGRATE_LOCK_DIR   Override lock directory for local migration lock")
+	fmt.Println("  DEDUPE_READ_ONLY Set to 1/true to enable --read-only")
+	fmt.Println("  AUTO_REGISTER    Set to 1/true to enable --auto-register")
+	fmt.Println("  AUTO_REGISTER_PATHS JSON friendly paths seeded on auto-registration ([paths] in config.ini)")
+	fmt.Println("  NOTIFY_WEBHOOK_URL  POST a JSON summary of long or failed runs to this URL")
+	fmt.Println("  NOTIFY_COMMAND   Shell command run with the JSON summary of long or failed runs on stdin")
+	fmt.Println("  NOTIFY_MIN_DURATION Default for --notify-min-duration ([notify] in config.ini)")
+	fmt.Println("  DEDUPE_MIN_SIZE  Default for list-dupes and move-dupes --min-size ([dedupe] min_size in config.ini)")
 	fmt.Println("  LOG_FILE         Log file path (default: /var/log/dedupe/dedupe.log)")
 	fmt.Println("  ERROR_LOG_FILE   Error log file path (default: /var/log/dedupe/error.log)")
 }
@@ -0,0 +1,133 @@
+package cmd
+
+import (
+	"context"
+	"database/sql"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"deduplicator/files"
+)
+
+// maintainVacuumAge is how long rows stay soft-deleted before maintain
+// counts them as vacuumable, the files vacuum default.
+const maintainVacuumAge = 30 * 24 * time.Hour
+
+// maintenancePhase is one step of deduplicator maintain. run records what
+// it did in stats for the consolidated report.
+type maintenancePhase struct {
+	name string
+	run  func(ctx context.Context, stats *files.RunStats) error
+}
+
+// maintenanceResult is the outcome of one phase.
+type maintenanceResult struct {
+	name     string
+	duration time.Duration
+	counters map[string]int64
+	err      error
+}
+
+// maintenancePhases are the steps of maintain, in order: prune rows of
+// missing files, run the doctor checks, report rows old enough to vacuum,
+// then refresh planner statistics. Without full, the doctor and vacuum
+// phases only report.
+func maintenancePhases(database *sql.DB, full bool) []maintenancePhase {
+	return []maintenancePhase{
+		{name: "prune", run: func(ctx context.Context, stats *files.RunStats) error {
+			return files.PruneNonExistentFiles(ctx, database, files.PruneOptions{Stats: stats})
+		}},
+		{name: "doctor", run: func(ctx context.Context, stats *files.RunStats) error {
+			return files.RunDoctor(ctx, database, files.DoctorOptions{Fix: full})
+		}},
+		{name: "vacuum", run: func(ctx context.Context, stats *files.RunStats) error {
+			eligible, err := files.CountVacuumable(ctx, database, maintainVacuumAge)
+			if err != nil {
+				return err
+			}
+			stats.Set("eligible", eligible)
+			if !full || eligible == 0 {
+				return nil
+			}
+			removed, err := files.VacuumFiles(ctx, database, files.VacuumOptions{OlderThan: maintainVacuumAge})
+			stats.Set("purged", removed)
+			return err
+		}},
+		{name: "analyze", run: func(ctx context.Context, stats *files.RunStats) error {
+			return files.AnalyzeFiles(ctx, database)
+		}},
+	}
+}
+
+// runMaintenance runs every phase in order. A failing phase is recorded
+// and the next one still runs.
+func runMaintenance(ctx context.Context, phases []maintenancePhase, now func() time.Time) []maintenanceResult {
+	results := make([]maintenanceResult, 0, len(phases))
+	for _, phase := range phases {
+		fmt.Printf("\n== %s ==\n", phase.name)
+		stats := &files.RunStats{}
+		started := now()
+		err := phase.run(ctx, stats)
+		results = append(results, maintenanceResult{
+			name:     phase.name,
+			duration: now().Sub(started),
+			counters: stats.Counters(),
+			err:      err,
+		})
+	}
+	return results
+}
+
+// printMaintenanceReport writes one line per phase with its outcome,
+// duration and counters, and returns an error naming the failed phases.
+func printMaintenanceReport(w io.Writer, results []maintenanceResult) error {
+	var failed []string
+	var total time.Duration
+	fmt.Fprintln(w, "\nMaintenance report:")
+	for _, r := range results {
+		total += r.duration
+		status := "ok"
+		if r.err != nil {
+			status = "FAILED"
+			failed = append(failed, r.name)
+		}
+		fmt.Fprintf(w, "  %-8s %-6s %10s", r.name, status, r.duration.Round(time.Millisecond))
+		names := make([]string, 0, len(r.counters))
+		for name := range r.counters {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			fmt.Fprintf(w, "  %s=%d", name, r.counters[name])
+		}
+		fmt.Fprintln(w)
+		if r.err != nil {
+			fmt.Fprintf(w, "           %v\n", r.err)
+		}
+	}
+	fmt.Fprintf(w, "  %-8s %-6s %10s\n", "total", "", total.Round(time.Millisecond))
+
+	if len(failed) > 0 {
+		return fmt.Errorf("maintenance failed in %d of %d phases: %s", len(failed), len(results), strings.Join(failed, ", "))
+	}
+	return nil
+}
+
+// HandleMaintain runs the routine catalog maintenance in one go.
+func HandleMaintain(ctx context.Context, database *sql.DB, args []string) error {
+	maintainCmd := flag.NewFlagSet("maintain", flag.ExitOnError)
+	full := maintainCmd.Bool("full", false, "Also repair doctor findings and purge vacuumable rows")
+	if err := maintainCmd.Parse(args); err != nil {
+		return fmt.Errorf("error parsing maintain flags: %v", err)
+	}
+	if maintainCmd.NArg() != 0 {
+		return fmt.Errorf("maintain does not accept positional arguments")
+	}
+	results := runMaintenance(ctx, maintenancePhases(database, *full), time.Now)
+	return printMaintenanceReport(os.Stdout, results)
+}
@@ -0,0 +1,89 @@
+package cmd
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"deduplicator/files"
+)
+
+// fakeClock advances by a second every time it is read.
+func fakeClock() func() time.Time {
+	now := time.Date(2026, 1, 2, 3, 0, 0, 0, time.UTC)
+	return func() time.Time {
+		now = now.Add(time.Second)
+		return now
+	}
+}
+
+func TestRunMaintenanceRunsEveryPhaseInOrderDespiteFailures(t *testing.T) {
+	var ran []string
+	phase := func(name string, err error, counters map[string]int64) maintenancePhase {
+		return maintenancePhase{name: name, run: func(ctx context.Context, stats *files.RunStats) error {
+			ran = append(ran, name)
+			for counter, value := range counters {
+				stats.Set(counter, value)
+			}
+			return err
+		}}
+	}
+	phases := []maintenancePhase{
+		phase("prune", errors.New("host not found: brain"), nil),
+		phase("doctor", nil, nil),
+		phase("vacuum", nil, map[string]int64{"eligible": 120}),
+		phase("analyze", errors.New("error analyzing files table: timeout"), nil),
+	}
+
+	var results []maintenanceResult
+	captureStdout(t, func() {
+		results = runMaintenance(context.Background(), phases, fakeClock())
+	})
+	if strings.Join(ran, ",") != "prune,doctor,vacuum,analyze" {
+		t.Fatalf("phases ran as %v", ran)
+	}
+
+	var report bytes.Buffer
+	err := printMaintenanceReport(&report, results)
+	if err == nil || err.Error() != "maintenance failed in 2 of 4 phases: prune, analyze" {
+		t.Fatalf("expected the failed phases in the error, got %v", err)
+	}
+	for _, want := range []string{
+		"  prune    FAILED         1s\n           host not found: brain\n",
+		"  doctor   ok             1s\n",
+		"  vacuum   ok             1s  eligible=120\n",
+		"  analyze  FAILED         1s\n           error analyzing files table: timeout\n",
+		"  total                   4s\n",
+	} {
+		if !strings.Contains(report.String(), want) {
+			t.Errorf("report does not contain %q:\n%s", want, report.String())
+		}
+	}
+}
+
+func TestMaintenanceReportSucceedsWhenEveryPhaseDoes(t *testing.T) {
+	results := []maintenanceResult{
+		{name: "prune", duration: 2 * time.Second, counters: map[string]int64{"pruned": 4, "checked": 10}},
+		{name: "analyze", duration: 500 * time.Millisecond},
+	}
+	var report bytes.Buffer
+	if err := printMaintenanceReport(&report, results); err != nil {
+		t.Fatalf("printMaintenanceReport: %v", err)
+	}
+	if !strings.Contains(report.String(), "  prune    ok             2s  checked=10  pruned=4\n") {
+		t.Fatalf("expected sorted counters:\n%s", report.String())
+	}
+}
+
+func TestMaintenancePhasesOrder(t *testing.T) {
+	var names []string
+	for _, phase := range maintenancePhases(nil, false) {
+		names = append(names, phase.name)
+	}
+	if strings.Join(names, ",") != "prune,doctor,vacuum,analyze" {
+		t.Fatalf("unexpected phases %v", names)
+	}
+}
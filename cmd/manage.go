@@ -3,6 +3,7 @@ package cmd
 import (
 	"database/sql"
 	"fmt"
+	"strconv"
 	"strings"
 
 	"deduplicator/db"
@@ -93,7 +94,7 @@ func HandleManage(dbConn *sql.DB, args []string) error {
 				return nil
 			}
 			// Fallback if specific command not found (should not happen)
-			fmt.Println("Usage: deduplicator manage server-edit \"Current friendly name\" [--new-friendly-name <new name>] [--hostname <hostname>] [--ip <ip>]")
+			fmt.Println("Usage: deduplicator manage server-edit \"Current friendly name\" [--new-friendly-name <new name>] [--hostname <hostname>] [--ip <ip>] [--hash-command <cmd>] [--xattr-whitelist <names>]")
 			return nil
 		}
 		if len(args) >= 3 && (args[2] == "--help" || args[2] == "help") { // Handles 'manage server-edit <name> --help'
@@ -103,7 +104,7 @@ func HandleManage(dbConn *sql.DB, args []string) error {
 				return nil
 			}
 			// Fallback
-			fmt.Println("Usage: deduplicator manage server-edit \"Current friendly name\" [--new-friendly-name <new name>] [--hostname <hostname>] [--ip <ip>]")
+			fmt.Println("Usage: deduplicator manage server-edit \"Current friendly name\" [--new-friendly-name <new name>] [--hostname <hostname>] [--ip <ip>] [--hash-command <cmd>] [--xattr-whitelist <names>]")
 			return nil
 		}
 
@@ -114,7 +115,7 @@ func HandleManage(dbConn *sql.DB, args []string) error {
 			if cmd != nil {
 				ShowCommandHelp(*cmd)
 			} else {
-				fmt.Println("Usage: deduplicator manage server-edit \"Current friendly name\" [--new-friendly-name <new name>] [--hostname <hostname>] [--ip <ip>]")
+				fmt.Println("Usage: deduplicator manage server-edit \"Current friendly name\" [--new-friendly-name <new name>] [--hostname <hostname>] [--ip <ip>] [--hash-command <cmd>] [--xattr-whitelist <names>]")
 			}
 			return nil
 		}
@@ -122,6 +123,10 @@ func HandleManage(dbConn *sql.DB, args []string) error {
 		newFriendlyName := ""
 		hostname := ""
 		ip := ""
+		hashCommand := ""
+		hashCommandSet := false
+		xattrWhitelist := ""
+		xattrWhitelistSet := false
 		for i := 2; i < len(args); i++ {
 			if args[i] == "--new-friendly-name" && i+1 < len(args) {
 				newFriendlyName = args[i+1]
@@ -132,6 +137,14 @@ func HandleManage(dbConn *sql.DB, args []string) error {
 			} else if args[i] == "--ip" && i+1 < len(args) {
 				ip = args[i+1]
 				i++
+			} else if args[i] == "--hash-command" && i+1 < len(args) {
+				hashCommand = args[i+1]
+				hashCommandSet = true
+				i++
+			} else if args[i] == "--xattr-whitelist" && i+1 < len(args) {
+				xattrWhitelist = args[i+1]
+				xattrWhitelistSet = true
+				i++
 			}
 		}
 		host, err := db.GetHost(dbConn, currentName)
@@ -155,12 +168,102 @@ func HandleManage(dbConn *sql.DB, args []string) error {
 			finalIP = ip
 		}
 
+		if hashCommandSet {
+			if err := host.SetHashCommand(hashCommand); err != nil {
+				return fmt.Errorf("error updating hash command: %v", err)
+			}
+		}
+
+		if xattrWhitelistSet {
+			if err := host.SetXattrWhitelist(strings.Split(xattrWhitelist, ",")); err != nil {
+				return fmt.Errorf("error updating xattr whitelist: %v", err)
+			}
+		}
+
 		if err := db.UpdateHost(dbConn, currentName, finalFriendlyName, finalHostname, finalIP, host.RootPath, host.Settings); err != nil {
 			return fmt.Errorf("error updating server: %v", err)
 		}
 		fmt.Printf("Server '%s' (now '%s') updated successfully\n", currentName, finalFriendlyName)
 		return nil
 
+	case "server-set-ssh":
+		if len(args) < 2 || args[1] == "--help" || args[1] == "help" {
+			if cmd := FindCommand("manage server-set-ssh"); cmd != nil {
+				ShowCommandHelp(*cmd)
+				return nil
+			}
+			fmt.Println("Usage: deduplicator manage server-set-ssh \"Friendly server name\" [--user <user>] [--port <port>] [--identity-file <path>] [--option <ssh option>]... [--clear]")
+			return nil
+		}
+		serverName := args[1]
+		host, err := db.GetHost(dbConn, serverName)
+		if err != nil {
+			return fmt.Errorf("error fetching server '%s': %v", serverName, err)
+		}
+		settings, err := host.GetSSHSettings()
+		if err != nil {
+			return fmt.Errorf("error decoding ssh settings: %v", err)
+		}
+		var options []string
+		optionsSet := false
+		for i := 2; i < len(args); i++ {
+			if args[i] == "--clear" {
+				settings = db.SSHSettings{}
+				continue
+			}
+			if i+1 >= len(args) {
+				return fmt.Errorf("missing value for %s", args[i])
+			}
+			switch args[i] {
+			case "--user":
+				settings.User = args[i+1]
+			case "--port":
+				port, err := strconv.Atoi(args[i+1])
+				if err != nil || port < 0 {
+					return fmt.Errorf("invalid value for --port: %q", args[i+1])
+				}
+				settings.Port = port
+			case "--identity-file":
+				settings.IdentityFile = args[i+1]
+			case "--option":
+				options = append(options, args[i+1])
+				optionsSet = true
+			default:
+				return fmt.Errorf("unknown option for server-set-ssh: %s", args[i])
+			}
+			i++
+		}
+		if optionsSet {
+			settings.Options = options
+		}
+		if err := host.SetSSHSettings(settings); err != nil {
+			return fmt.Errorf("error updating ssh settings: %v", err)
+		}
+		if err := db.UpdateHost(dbConn, host.Name, host.Name, host.Hostname, host.IP, host.RootPath, host.Settings); err != nil {
+			return fmt.Errorf("error updating server: %v", err)
+		}
+		if settings, err = host.GetSSHSettings(); err != nil {
+			return fmt.Errorf("error decoding ssh settings: %v", err)
+		}
+		if settings.IsZero() {
+			fmt.Printf("Server '%s' has no ssh settings; ssh uses its own configuration\n", host.Name)
+			return nil
+		}
+		fmt.Printf("SSH settings of server '%s' updated:\n", host.Name)
+		if settings.User != "" {
+			fmt.Printf("  user:          %s\n", settings.User)
+		}
+		if settings.Port != 0 {
+			fmt.Printf("  port:          %d\n", settings.Port)
+		}
+		if settings.IdentityFile != "" {
+			fmt.Printf("  identity file: %s\n", settings.IdentityFile)
+		}
+		for _, option := range settings.Options {
+			fmt.Printf("  option:        %s\n", option)
+		}
+		return nil
+
 	case "server-delete":
 		if len(args) != 2 {
 			fmt.Println("Usage: deduplicator manage server-delete \"Friendly server name\"")
@@ -253,7 +356,7 @@ func HandleManage(dbConn *sql.DB, args []string) error {
 			UPDATE hosts
 			SET name = $2, hostname = $3, ip = $4, root_path = $5, settings = $6
 			WHERE name = $1
-		`, host.Name, host.Name, strings.ToLower(host.Hostname), host.IP, host.RootPath, host.Settings)
+		`, host.Name, host.Name, db.NormalizeHostname(host.Hostname), host.IP, host.RootPath, host.Settings)
 		if err != nil {
 			return fmt.Errorf("error updating paths: %v", err)
 		}
@@ -267,9 +370,9 @@ func HandleManage(dbConn *sql.DB, args []string) error {
 
 		deleteResult, err := tx.Exec(`
 			DELETE FROM files
-			WHERE LOWER(hostname) = LOWER($1)
+			WHERE hostname = $1
 			AND root_folder = $2
-		`, host.Hostname, removedRoot)
+		`, db.NormalizeHostname(host.Hostname), removedRoot)
 		if err != nil {
 			return fmt.Errorf("error deleting file rows for path '%s': %v", friendly, err)
 		}
@@ -373,9 +476,9 @@ func HandleManage(dbConn *sql.DB, args []string) error {
 		fmt.Printf("Path group '%s' deleted successfully\n", groupName)
 		return nil
 
-	case "group-add-path":
+	case "group-add-path", "group-member-add":
 		if len(args) < 4 {
-			fmt.Println("Usage: deduplicator manage group-add-path <group name> <host name> <friendly path> [--priority N]")
+			fmt.Printf("Usage: deduplicator manage %s <group name> <host name> <friendly path> [--priority N]\n", args[0])
 			return nil
 		}
 		groupName, hostName, friendlyPath := args[1], args[2], args[3]
@@ -394,12 +497,71 @@ func HandleManage(dbConn *sql.DB, args []string) error {
 		fmt.Printf("Path '%s:%s' added to group '%s' with priority %d\n", hostName, friendlyPath, groupName, priority)
 		return nil
 
-	case "group-remove-path":
-		if len(args) != 3 {
-			fmt.Println("Usage: deduplicator manage group-remove-path <host name> <friendly path>")
+	case "group-member-edit":
+		if len(args) < 4 {
+			fmt.Println("Usage: deduplicator manage group-member-edit <host name> <friendly path> [--priority N] [--protected[=true|false]] [--read-only[=true|false]]")
 			return nil
 		}
 		hostName, friendlyPath := args[1], args[2]
+		var priority *int
+		var protected, readOnly *bool
+
+		for i := 3; i < len(args); i++ {
+			switch {
+			case args[i] == "--priority" && i+1 < len(args):
+				var p int
+				if _, err := fmt.Sscanf(args[i+1], "%d", &p); err != nil {
+					return fmt.Errorf("invalid --priority %q", args[i+1])
+				}
+				priority = &p
+				i++
+			case args[i] == "--protected":
+				value := true
+				protected = &value
+			case strings.HasPrefix(args[i], "--protected="):
+				value, err := strconv.ParseBool(strings.TrimPrefix(args[i], "--protected="))
+				if err != nil {
+					return fmt.Errorf("invalid %s: want true or false", args[i])
+				}
+				protected = &value
+			case args[i] == "--read-only":
+				value := true
+				readOnly = &value
+			case strings.HasPrefix(args[i], "--read-only="):
+				value, err := strconv.ParseBool(strings.TrimPrefix(args[i], "--read-only="))
+				if err != nil {
+					return fmt.Errorf("invalid %s: want true or false", args[i])
+				}
+				readOnly = &value
+			}
+		}
+		if priority == nil && protected == nil && readOnly == nil {
+			return fmt.Errorf("group-member-edit requires --priority, --protected or --read-only")
+		}
+
+		if err := db.UpdateGroupMember(dbConn, hostName, friendlyPath, priority, protected, readOnly); err != nil {
+			return fmt.Errorf("error updating group member: %v", err)
+		}
+		fmt.Printf("Group member '%s:%s' updated\n", hostName, friendlyPath)
+		return nil
+
+	case "group-remove-path", "group-member-remove":
+		// A path belongs to at most one group, so the group name is optional;
+		// when given, the path must be a member of that group.
+		if len(args) != 3 && len(args) != 4 {
+			fmt.Printf("Usage: deduplicator manage %s [<group name>] <host name> <friendly path>\n", args[0])
+			return nil
+		}
+		hostName, friendlyPath := args[len(args)-2], args[len(args)-1]
+		if len(args) == 4 {
+			group, err := db.GetGroupForPath(dbConn, hostName, friendlyPath)
+			if err != nil {
+				return fmt.Errorf("error looking up group of path: %v", err)
+			}
+			if group.Name != args[1] {
+				return fmt.Errorf("path %s:%s belongs to group '%s', not '%s'", hostName, friendlyPath, group.Name, args[1])
+			}
+		}
 		if err := db.RemovePathFromGroup(dbConn, hostName, friendlyPath); err != nil {
 			return fmt.Errorf("error removing path from group: %v", err)
 		}
@@ -438,10 +600,17 @@ func HandleManage(dbConn *sql.DB, args []string) error {
 			return nil
 		}
 
-		fmt.Printf("%-20s %-20s %-10s\n", "HOST", "FRIENDLY PATH", "PRIORITY")
-		fmt.Println(strings.Repeat("-", 60))
+		fmt.Printf("%-20s %-20s %-10s %-10s %s\n", "HOST", "FRIENDLY PATH", "PRIORITY", "PROTECTED", "READ-ONLY")
+		fmt.Println(strings.Repeat("-", 72))
 		for _, member := range members {
-			fmt.Printf("%-20s %-20s %-10d\n", member.HostName, member.FriendlyPath, member.Priority)
+			protected, readOnly := "", ""
+			if member.Protected {
+				protected = "yes"
+			}
+			if member.ReadOnly {
+				readOnly = "yes"
+			}
+			fmt.Printf("%-20s %-20s %-10d %-10s %s\n", member.HostName, member.FriendlyPath, member.Priority, protected, readOnly)
 		}
 		return nil
 
@@ -85,6 +85,43 @@ func TestManageServerEditPreservesUnspecifiedFields(t *testing.T) {
 	}
 }
 
+func TestManageServerSetSSHKeepsOtherSettings(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("sqlmock: %v", err)
+	}
+	defer db.Close()
+
+	mock.ExpectQuery("SELECT id, name, hostname, ip, root_path, settings, created_at FROM hosts WHERE name = \\$1").
+		WithArgs("NAS").
+		WillReturnRows(sqlmock.NewRows([]string{"id", "name", "hostname", "ip", "root_path", "settings", "created_at"}).
+			AddRow(1, "NAS", "nas.lan", "", "", []byte(`{"paths":{"photos":"/srv/photos"},"ssh":{"user":"old","port":22}}`), time.Now()))
+	mock.ExpectExec("UPDATE hosts SET name = \\$2, hostname = \\$3, ip = \\$4, root_path = \\$5, settings = \\$6 WHERE name = \\$1").
+		WithArgs("NAS", "NAS", "nas.lan", "", "", []byte(`{"paths":{"photos":"/srv/photos"},"ssh":{"user":"backup","port":22,"identity_file":"/keys/nas","options":["BatchMode=yes"]}}`)).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+
+	out := captureStdout(t, func() {
+		err = HandleManage(db, []string{"server-set-ssh", "NAS", "--user", "backup", "--identity-file", "/keys/nas", "--option", "BatchMode=yes"})
+	})
+	if err != nil {
+		t.Fatalf("HandleManage server-set-ssh error: %v", err)
+	}
+	if !strings.Contains(out, "user:          backup") || !strings.Contains(out, "port:          22") {
+		t.Fatalf("expected the resulting settings, got:\n%s", out)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatalf("unmet expectations: %v", err)
+	}
+
+	mock.ExpectQuery("SELECT id, name, hostname, ip, root_path, settings, created_at FROM hosts WHERE name = \\$1").
+		WithArgs("NAS").
+		WillReturnRows(sqlmock.NewRows([]string{"id", "name", "hostname", "ip", "root_path", "settings", "created_at"}).
+			AddRow(1, "NAS", "nas.lan", "", "", []byte(`{}`), time.Now()))
+	if err := HandleManage(db, []string{"server-set-ssh", "NAS", "--port", "ssh"}); err == nil || !strings.Contains(err.Error(), "invalid value for --port") {
+		t.Fatalf("expected an invalid port to be rejected, got %v", err)
+	}
+}
+
 func TestManageServerListEmptyShowsGuidance(t *testing.T) {
 	db, mock, err := sqlmock.New()
 	if err != nil {
@@ -223,3 +260,52 @@ func TestManagePathDeleteRemovesFileRowsForDeletedRoot(t *testing.T) {
 		t.Fatalf("expected deleted file row count, got: %s", output)
 	}
 }
+
+func TestManageGroupMemberRemoveChecksTheGroup(t *testing.T) {
+	groupRows := func() *sqlmock.Rows {
+		return sqlmock.NewRows([]string{"id", "name", "description", "min_copies", "max_copies", "created_at"}).
+			AddRow(1, "photos", "", 2, 3, time.Now())
+	}
+
+	t.Run("path in another group is refused", func(t *testing.T) {
+		db, mock, err := sqlmock.New()
+		if err != nil {
+			t.Fatalf("sqlmock: %v", err)
+		}
+		defer db.Close()
+
+		mock.ExpectQuery("FROM path_groups pg").WithArgs("brain", "photos").WillReturnRows(groupRows())
+
+		err = HandleManage(db, []string{"group-member-remove", "music", "brain", "photos"})
+		if err == nil || !strings.Contains(err.Error(), "belongs to group 'photos', not 'music'") {
+			t.Fatalf("expected wrong group error, got %v", err)
+		}
+		if err := mock.ExpectationsWereMet(); err != nil {
+			t.Fatalf("unmet expectations: %v", err)
+		}
+	})
+
+	t.Run("member of the named group is removed", func(t *testing.T) {
+		db, mock, err := sqlmock.New()
+		if err != nil {
+			t.Fatalf("sqlmock: %v", err)
+		}
+		defer db.Close()
+
+		mock.ExpectQuery("FROM path_groups pg").WithArgs("brain", "photos").WillReturnRows(groupRows())
+		mock.ExpectExec("DELETE FROM path_group_members").WithArgs("brain", "photos").
+			WillReturnResult(sqlmock.NewResult(0, 1))
+
+		output := captureStdout(t, func() {
+			if err := HandleManage(db, []string{"group-member-remove", "photos", "brain", "photos"}); err != nil {
+				t.Fatalf("HandleManage group-member-remove error: %v", err)
+			}
+		})
+		if err := mock.ExpectationsWereMet(); err != nil {
+			t.Fatalf("unmet expectations: %v", err)
+		}
+		if !strings.Contains(output, "removed from its group") {
+			t.Fatalf("expected removal message, got: %s", output)
+		}
+	})
+}
@@ -0,0 +1,74 @@
+package cmd
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"deduplicator/files"
+	"deduplicator/notify"
+)
+
+func TestParseGlobalFlagsNotifyMinDuration(t *testing.T) {
+	t.Setenv("NOTIFY_MIN_DURATION", "")
+	args, global, err := parseGlobalFlags([]string{"deduplicator", "--notify-min-duration", "2h", "files", "hash"})
+	if err != nil {
+		t.Fatalf("parseGlobalFlags: %v", err)
+	}
+	if global.notifyMinDuration != 2*time.Hour || len(args) != 3 || args[1] != "files" {
+		t.Fatalf("unexpected result: %v %+v", args, global)
+	}
+
+	t.Setenv("NOTIFY_MIN_DURATION", "1d")
+	if _, global, _ := parseGlobalFlags([]string{"deduplicator", "files", "hash"}); global.notifyMinDuration != 24*time.Hour {
+		t.Fatalf("expected NOTIFY_MIN_DURATION to set the threshold, got %v", global.notifyMinDuration)
+	}
+	if _, _, err := parseGlobalFlags([]string{"deduplicator", "--notify-min-duration=soon", "files"}); err == nil {
+		t.Fatal("expected an invalid duration to be rejected")
+	}
+}
+
+func TestRunNotifiedSendsFailuresWithCounters(t *testing.T) {
+	out := filepath.Join(t.TempDir(), "summary.json")
+	a := &App{version: "test", notifier: &notify.Notifier{Command: "cat > " + out, MinDuration: time.Hour}}
+
+	runErr := errors.New("boom")
+	err := a.runNotified("files hash", func(stats *files.RunStats) error {
+		stats.Set("processed", 3)
+		return runErr
+	})
+	if err != runErr {
+		t.Fatalf("expected the run's own error, got %v", err)
+	}
+
+	data, err := os.ReadFile(out)
+	if err != nil {
+		t.Fatalf("expected a notification: %v", err)
+	}
+	var got notify.Result
+	if err := json.Unmarshal(data, &got); err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	if got.Command != "files hash" || got.Success || got.Error != "boom" || got.Counters["processed"] != 3 {
+		t.Fatalf("unexpected summary: %+v", got)
+	}
+}
+
+func TestRunNotifiedSkipsShortSuccessAndIgnoresNotifierErrors(t *testing.T) {
+	out := filepath.Join(t.TempDir(), "summary.json")
+	a := &App{notifier: &notify.Notifier{Command: "cat > " + out, MinDuration: time.Hour}}
+	if err := a.runNotified("files find", func(*files.RunStats) error { return nil }); err != nil {
+		t.Fatalf("runNotified: %v", err)
+	}
+	if _, err := os.Stat(out); !os.IsNotExist(err) {
+		t.Fatalf("expected no notification for a short successful run, stat err: %v", err)
+	}
+
+	a.notifier = &notify.Notifier{Command: "exit 1", MinDuration: 0}
+	if err := a.runNotified("files find", func(*files.RunStats) error { return nil }); err != nil {
+		t.Fatalf("a failed notification must not fail the run: %v", err)
+	}
+}
@@ -0,0 +1,104 @@
+package cmd
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"deduplicator/db"
+)
+
+// lockPaths takes the path locks of a destructive run and returns the
+// function that releases them. Listings and dry runs never call it.
+func lockPaths(ctx context.Context, database *sql.DB, command string, timeout time.Duration, paths []db.LockedPath) (func(), error) {
+	if len(paths) == 0 {
+		return func() {}, nil
+	}
+	lock, err := db.AcquirePathLocks(ctx, database, paths, db.PathLockOptions{Command: command, Timeout: timeout})
+	if err != nil {
+		return nil, err
+	}
+	return func() {
+		if err := lock.Release(); err != nil {
+			fmt.Fprintf(os.Stderr, "Warning: %v\n", err)
+		}
+	}, nil
+}
+
+// friendlyPathLocks lists friendlyPath on every host that has it, the paths
+// files mirror copies between.
+func friendlyPathLocks(database *sql.DB, friendlyPath string) ([]db.LockedPath, error) {
+	hosts, err := db.ListHosts(database)
+	if err != nil {
+		return nil, fmt.Errorf("error listing hosts: %v", err)
+	}
+	var paths []db.LockedPath
+	for i := range hosts {
+		hostPaths, err := hosts[i].GetPaths()
+		if err != nil {
+			continue // mirror skips hosts with bad settings too
+		}
+		if _, ok := hostPaths[friendlyPath]; ok {
+			paths = append(paths, db.LockedPath{HostName: hosts[i].Name, FriendlyPath: friendlyPath})
+		}
+	}
+	return paths, nil
+}
+
+// groupPathLocks lists the member paths of a path group.
+func groupPathLocks(database *sql.DB, groupName string) ([]db.LockedPath, error) {
+	members, err := db.ListGroupMembers(database, groupName)
+	if err != nil {
+		return nil, fmt.Errorf("error listing group members: %v", err)
+	}
+	paths := make([]db.LockedPath, 0, len(members))
+	for _, m := range members {
+		paths = append(paths, db.LockedPath{HostName: m.HostName, FriendlyPath: m.FriendlyPath})
+	}
+	return paths, nil
+}
+
+// localPathLocks lists every friendly path of this host, which the local
+// dedupe flows move files out of.
+func localPathLocks(database *sql.DB) ([]db.LockedPath, error) {
+	hostname, err := os.Hostname()
+	if err != nil {
+		return nil, fmt.Errorf("error getting hostname: %v", err)
+	}
+	host, err := db.GetHostByHostname(database, strings.ToLower(hostname))
+	if err != nil {
+		return nil, fmt.Errorf("error fetching host: %v", err)
+	}
+	return friendlyPathsOf(host)
+}
+
+// hostPathLocks lists every friendly path of the named host, which files
+// unique --copy-to writes into.
+func hostPathLocks(database *sql.DB, name string) ([]db.LockedPath, error) {
+	host, err := db.GetHost(database, name)
+	if err != nil {
+		return nil, fmt.Errorf("server not found: %s", name)
+	}
+	return friendlyPathsOf(host)
+}
+
+func friendlyPathsOf(host *db.Host) ([]db.LockedPath, error) {
+	hostPaths, err := host.GetPaths()
+	if err != nil {
+		return nil, fmt.Errorf("error getting paths for host %s: %v", host.Name, err)
+	}
+	names := make([]string, 0, len(hostPaths))
+	for name := range hostPaths {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	paths := make([]db.LockedPath, 0, len(names))
+	for _, name := range names {
+		paths = append(paths, db.LockedPath{HostName: host.Name, FriendlyPath: name})
+	}
+	return paths, nil
+}
@@ -8,16 +8,19 @@ import (
 	"deduplicator/mq"
 )
 
-// HandleQueueVersion handles the queue version command
-func HandleQueueVersion(ctx context.Context, rabbit *mq.RabbitMQ, version string, currentVersion string) error {
+// HandleQueueVersion handles the queue version command. The commit of this
+// build is only sent along with its own version; force asks listeners on the
+// same version from another commit to shut down.
+func HandleQueueVersion(ctx context.Context, rabbit *mq.RabbitMQ, version string, currentVersion string, commit string, force bool) error {
 	if version == currentVersion {
 		log.Printf("Publishing current version: %s", currentVersion)
 	} else {
 		log.Printf("Warning: Publishing version %s which differs from current version %s",
 			version, currentVersion)
+		commit = ""
 	}
 
-	if err := rabbit.PublishVersionUpdate(ctx, version); err != nil {
+	if err := rabbit.PublishVersionUpdate(ctx, version, commit, force); err != nil {
 		return fmt.Errorf("failed to publish version update: %v", err)
 	}
 
@@ -0,0 +1,109 @@
+package cmd
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"deduplicator/db"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+func TestReadOnlyModeRefusesWriteCommands(t *testing.T) {
+	t.Setenv("DEDUPE_READ_ONLY", "")
+
+	writes := [][]string{
+		{"update"},
+		{"files", "import", "--source", "/tmp/in", "--server", "Backup1", "--path", "photos"},
+		{"files", "hash"},
+		{"files", "rehash-all"},
+		{"files", "verify", "--all", "--reset-mismatched"},
+		{"files", "prune"},
+		{"files", "move-dupes", "--target", "/tmp/dupes"},
+		{"files", "undo-moves", "--manifest", "/tmp/dupes/.deduplicator-moves.jsonl"},
+		{"files", "list-dupes", "--dest", "/tmp/dupes", "--run"},
+		{"files", "mirror", "photos"},
+		{"doctor", "--fix"},
+		{"maintain"},
+	}
+	for _, command := range writes {
+		app := NewApp("test")
+		err := app.HandleCommand(context.Background(), append([]string{"deduplicator", "--read-only"}, command...))
+		if err == nil {
+			t.Fatalf("%v: expected refusal in read-only mode", command)
+		}
+		if !strings.Contains(err.Error(), "read-only mode") || !strings.Contains(err.Error(), "files unhashed") {
+			t.Fatalf("%v: refusal should explain and list alternatives, got: %v", command, err)
+		}
+	}
+}
+
+func TestReadOnlyModeFromEnvironment(t *testing.T) {
+	t.Setenv("DEDUPE_READ_ONLY", "true")
+
+	err := NewApp("test").HandleCommand(context.Background(), []string{"deduplicator", "files", "hash"})
+	if err == nil || !strings.Contains(err.Error(), "files hash writes to the database") {
+		t.Fatalf("expected refusal from DEDUPE_READ_ONLY, got %v", err)
+	}
+
+	t.Setenv("DEDUPE_READ_ONLY", "maybe")
+	if err := NewApp("test").HandleCommand(context.Background(), []string{"deduplicator", "files", "hash"}); err == nil || !strings.Contains(err.Error(), "DEDUPE_READ_ONLY") {
+		t.Fatalf("expected invalid DEDUPE_READ_ONLY error, got %v", err)
+	}
+}
+
+func TestParseGlobalFlagsOnlyConsumesLeadingFlags(t *testing.T) {
+	t.Setenv("DEDUPE_READ_ONLY", "")
+	t.Setenv("AUTO_REGISTER", "")
+
+	args, global, err := parseGlobalFlags([]string{"deduplicator", "--read-only", "files", "list-dupes", "--read-only"})
+	if err != nil || !global.readOnly {
+		t.Fatalf("expected read-only, got %+v (%v)", global, err)
+	}
+	if strings.Join(args, " ") != "deduplicator files list-dupes --read-only" {
+		t.Fatalf("unexpected remaining args: %v", args)
+	}
+
+	if _, global, _ := parseGlobalFlags([]string{"deduplicator", "--read-only=false", "files"}); global.readOnly {
+		t.Fatal("--read-only=false should disable read-only mode")
+	}
+	if err := refuseInReadOnly([]string{"files", "list-dupes", "--count", "5"}); err != nil {
+		t.Fatalf("list-dupes without --run should be allowed: %v", err)
+	}
+	if err := refuseInReadOnly([]string{"files", "verify", "--all"}); err != nil {
+		t.Fatalf("verify without --reset-mismatched should be allowed: %v", err)
+	}
+}
+
+func TestReadOnlyListingsWorkThroughGuard(t *testing.T) {
+	mockDB, mock, err := sqlmock.NewWithDSN("readonly_manage_list")
+	if err != nil {
+		t.Fatalf("sqlmock: %v", err)
+	}
+	defer mockDB.Close()
+	ro := db.OpenReadOnly(mockDB.Driver(), "readonly_manage_list")
+	defer ro.Close()
+
+	mock.ExpectQuery("SELECT id, name, hostname, ip, root_path, settings, created_at\\s+FROM hosts ORDER BY name").
+		WillReturnRows(sqlmock.NewRows([]string{"id", "name", "hostname", "ip", "root_path", "settings", "created_at"}).
+			AddRow(1, "Backup1", "backup1.local", "10.0.0.5", "/data", []byte(`{}`), time.Now()))
+
+	out := captureStdout(t, func() {
+		if err := HandleManage(ro, []string{"server-list"}); err != nil {
+			t.Fatalf("server-list through read-only guard: %v", err)
+		}
+	})
+	if !strings.Contains(out, "Backup1") {
+		t.Fatalf("expected Backup1 in listing, got:\n%s", out)
+	}
+
+	err = HandleManage(ro, []string{"server-add", "Backup2", "--hostname", "backup2.local"})
+	if err == nil || !strings.Contains(err.Error(), "read-only") {
+		t.Fatalf("expected server-add to be refused by the guard, got %v", err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatalf("unmet expectations: %v", err)
+	}
+}
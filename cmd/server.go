@@ -15,6 +15,7 @@ import (
 	"time"
 
 	dedupdb "deduplicator/db"
+	"deduplicator/files"
 )
 
 const (
@@ -44,6 +45,10 @@ type fileSearchResult struct {
 	Size         *int64     `json:"size,omitempty"`
 	Hash         string     `json:"hash,omitempty"`
 	LastHashedAt *time.Time `json:"lastHashedAt,omitempty"`
+	// AddedBy and AddedHostUser record the command and OS user that first
+	// indexed the row; both are empty for rows indexed before they existed.
+	AddedBy       string `json:"addedBy,omitempty"`
+	AddedHostUser string `json:"addedHostUser,omitempty"`
 }
 
 type deleteFileResponse struct {
@@ -163,10 +168,10 @@ func newDeduplicatorHTTPServerWithOptions(opts deduplicatorHTTPServerOptions) *d
 	}
 	return &deduplicatorHTTPServer{
 		db:                   opts.db,
-		hostname:             strings.ToLower(opts.hostname),
+		hostname:             dedupdb.NormalizeHostname(opts.hostname),
 		allHosts:             opts.allHosts,
 		uiDir:                opts.uiDir,
-		localHostname:        strings.ToLower(opts.localHostname),
+		localHostname:        dedupdb.NormalizeHostname(opts.localHostname),
 		deleteEnabled:        opts.deleteEnabled,
 		deleteDisabledReason: opts.deleteDisabledReason,
 	}
@@ -302,9 +307,11 @@ func (s *deduplicatorHTTPServer) searchFiles(ctx context.Context, query string,
 		return s.searchFilesAcrossHosts(ctx, pattern, limit)
 	}
 	rows, err := s.db.QueryContext(ctx, `
-		SELECT id, path, COALESCE(root_folder, ''), hostname, size, COALESCE(hash, ''), last_hashed_at
+		SELECT id, path, COALESCE(root_folder, ''), hostname, size, COALESCE(hash, ''), last_hashed_at,
+		       COALESCE(added_by, ''), COALESCE(added_host_user, '')
 		FROM files
-		WHERE LOWER(hostname) = LOWER($1)
+		WHERE hostname = $1
+		  AND `+files.NotDeleted+`
 		  AND (
 			LOWER(path) LIKE $2
 			OR LOWER(COALESCE(root_folder, '') || '/' || path) LIKE $2
@@ -330,10 +337,12 @@ func (s *deduplicatorHTTPServer) searchFiles(ctx context.Context, query string,
 
 func (s *deduplicatorHTTPServer) searchFilesAcrossHosts(ctx context.Context, pattern string, limit int) ([]fileSearchResult, error) {
 	rows, err := s.db.QueryContext(ctx, `
-		SELECT id, path, COALESCE(root_folder, ''), hostname, size, COALESCE(hash, ''), last_hashed_at
+		SELECT id, path, COALESCE(root_folder, ''), hostname, size, COALESCE(hash, ''), last_hashed_at,
+		       COALESCE(added_by, ''), COALESCE(added_host_user, '')
 		FROM files
-		WHERE LOWER(path) LIKE $1
-		   OR LOWER(COALESCE(root_folder, '') || '/' || path) LIKE $1
+		WHERE (LOWER(path) LIKE $1
+		   OR LOWER(COALESCE(root_folder, '') || '/' || path) LIKE $1)
+		  AND `+files.NotDeleted+`
 		ORDER BY hostname ASC, id DESC
 		LIMIT $2
 	`, pattern, limit)
@@ -361,7 +370,7 @@ func (s *deduplicatorHTTPServer) deleteIndexedFile(ctx context.Context, id int)
 	err := s.db.QueryRowContext(ctx, `
 		SELECT id, path, COALESCE(root_folder, ''), hostname, size, COALESCE(hash, ''), last_hashed_at
 		FROM files
-		WHERE id = $1 AND LOWER(hostname) = LOWER($2)
+		WHERE id = $1 AND hostname = $2 AND `+files.NotDeleted+`
 	`, id, s.hostname).Scan(&row.ID, &row.Path, &row.RootFolder, &row.Hostname, &size, &hash, &lastHashedAt)
 	if err != nil {
 		return deleteFileResponse{}, err
@@ -395,7 +404,7 @@ func (s *deduplicatorHTTPServer) deleteIndexedFile(ctx context.Context, id int)
 		response.RemovedFile = true
 	}
 
-	result, err := s.db.ExecContext(ctx, `DELETE FROM files WHERE id = $1 AND LOWER(hostname) = LOWER($2)`, id, s.hostname)
+	result, err := s.db.ExecContext(ctx, `UPDATE files SET deleted_at = NOW() WHERE id = $1 AND hostname = $2 AND deleted_at IS NULL`, id, s.hostname)
 	if err != nil {
 		return deleteFileResponse{}, err
 	}
@@ -414,7 +423,7 @@ func scanFileSearchResult(scanner interface {
 	var size sql.NullInt64
 	var hash string
 	var lastHashedAt sql.NullTime
-	if err := scanner.Scan(&result.ID, &result.Path, &result.RootFolder, &result.Hostname, &size, &hash, &lastHashedAt); err != nil {
+	if err := scanner.Scan(&result.ID, &result.Path, &result.RootFolder, &result.Hostname, &size, &hash, &lastHashedAt, &result.AddedBy, &result.AddedHostUser); err != nil {
 		return fileSearchResult{}, err
 	}
 	if size.Valid {
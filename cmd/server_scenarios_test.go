@@ -170,10 +170,10 @@ func TestServerSearchAllHostsWhenLocalHostIsNotIndexed(t *testing.T) {
 	defer database.Close()
 
 	root := t.TempDir()
-	mock.ExpectQuery(`(?s)SELECT id, path, COALESCE\(root_folder, ''\), hostname, size, COALESCE\(hash, ''\), last_hashed_at\s+FROM files\s+WHERE LOWER\(path\) LIKE \$1\s+OR LOWER\(COALESCE\(root_folder, ''\) \|\| '/' \|\| path\) LIKE \$1\s+ORDER BY hostname ASC, id DESC\s+LIMIT \$2`).
+	mock.ExpectQuery(`(?s)SELECT id, path, COALESCE\(root_folder, ''\), hostname, size, COALESCE\(hash, ''\), last_hashed_at,\s+COALESCE\(added_by, ''\), COALESCE\(added_host_user, ''\)\s+FROM files\s+WHERE \(LOWER\(path\) LIKE \$1\s+OR LOWER\(COALESCE\(root_folder, ''\) \|\| '/' \|\| path\) LIKE \$1\)\s+AND deleted_at IS NULL\s+ORDER BY hostname ASC, id DESC\s+LIMIT \$2`).
 		WithArgs("%future%", 100).
-		WillReturnRows(sqlmock.NewRows([]string{"id", "path", "root_folder", "hostname", "size", "hash", "last_hashed_at"}).
-			AddRow(8, "movies/Future.mkv", root, "brain.local", int64(99), "hash", nil))
+		WillReturnRows(sqlmock.NewRows([]string{"id", "path", "root_folder", "hostname", "size", "hash", "last_hashed_at", "added_by", "added_host_user"}).
+			AddRow(8, "movies/Future.mkv", root, "brain.local", int64(99), "hash", nil, "", ""))
 
 	server := newDeduplicatorHTTPServerWithOptions(deduplicatorHTTPServerOptions{
 		db:            database,
@@ -210,10 +210,10 @@ func TestServerSearchReturnsPartialPathMatchesForLocalHost(t *testing.T) {
 
 	root := t.TempDir()
 	hashedAt := time.Now().UTC()
-	mock.ExpectQuery(`(?s)SELECT id, path, COALESCE\(root_folder, ''\), hostname, size, COALESCE\(hash, ''\), last_hashed_at\s+FROM files\s+WHERE LOWER\(hostname\) = LOWER\(\$1\).*LOWER\(path\) LIKE \$2.*LIMIT \$3`).
+	mock.ExpectQuery(`(?s)SELECT id, path, COALESCE\(root_folder, ''\), hostname, size, COALESCE\(hash, ''\), last_hashed_at,\s+COALESCE\(added_by, ''\), COALESCE\(added_host_user, ''\)\s+FROM files\s+WHERE hostname = \$1.*LOWER\(path\) LIKE \$2.*LIMIT \$3`).
 		WithArgs("brain.local", "%future%", 25).
-		WillReturnRows(sqlmock.NewRows([]string{"id", "path", "root_folder", "hostname", "size", "hash", "last_hashed_at"}).
-			AddRow(7, "movies/Back to the Future.mkv", root, "brain.local", int64(42), "abc123", hashedAt))
+		WillReturnRows(sqlmock.NewRows([]string{"id", "path", "root_folder", "hostname", "size", "hash", "last_hashed_at", "added_by", "added_host_user"}).
+			AddRow(7, "movies/Back to the Future.mkv", root, "brain.local", int64(42), "abc123", hashedAt, "find", "media"))
 
 	server := newDeduplicatorHTTPServer(database, "brain.local", "")
 	request := httptest.NewRequest(http.MethodGet, "/api/search?q=Future&limit=25", nil)
@@ -234,6 +234,52 @@ func TestServerSearchReturnsPartialPathMatchesForLocalHost(t *testing.T) {
 	if results[0].ID != 7 || results[0].FullPath != filepath.Join(root, "movies/Back to the Future.mkv") {
 		t.Fatalf("unexpected result: %#v", results[0])
 	}
+	if results[0].AddedBy != "find" || results[0].AddedHostUser != "media" {
+		t.Fatalf("expected the row origin in the result, got %#v", results[0])
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatalf("unmet expectations: %v", err)
+	}
+}
+
+func TestServerSearchResolvesMixedCaseServerToLowercaseRows(t *testing.T) {
+	database, mock, err := sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherRegexp))
+	if err != nil {
+		t.Fatalf("sqlmock: %v", err)
+	}
+	defer database.Close()
+
+	// A legacy hosts row keeps its mixed-case hostname; files rows are
+	// written lowercase, and the search compares them without LOWER().
+	mock.ExpectQuery(`(?s)SELECT id, name, hostname, COALESCE\(ip, ''\), root_path, settings, created_at\s+FROM hosts`).
+		WithArgs("BRAIN").
+		WillReturnRows(sqlmock.NewRows([]string{"id", "name", "hostname", "ip", "root_path", "settings", "created_at"}).
+			AddRow(1, "Brain", "Brain.Local", "", "", []byte(`{}`), time.Now()))
+	mock.ExpectQuery(`(?s)FROM files\s+WHERE hostname = \$1\s+AND deleted_at IS NULL`).
+		WithArgs("brain.local", "%future%", 25).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "path", "root_folder", "hostname", "size", "hash", "last_hashed_at", "added_by", "added_host_user"}).
+			AddRow(7, "movies/Future.mkv", "/data", "brain.local", int64(42), "abc123", time.Now(), "find", ""))
+
+	scope, err := resolveServerHostScope(database, "BRAIN", "book16.local")
+	if err != nil {
+		t.Fatalf("resolveServerHostScope: %v", err)
+	}
+	server := newDeduplicatorHTTPServer(database, scope.Hostname, "")
+	request := httptest.NewRequest(http.MethodGet, "/api/search?q=Future&limit=25", nil)
+	response := httptest.NewRecorder()
+
+	server.routes().ServeHTTP(response, request)
+
+	if response.Code != http.StatusOK {
+		t.Fatalf("status = %d, body = %s", response.Code, response.Body.String())
+	}
+	var results []fileSearchResult
+	if err := json.Unmarshal(response.Body.Bytes(), &results); err != nil {
+		t.Fatalf("decode response: %v", err)
+	}
+	if len(results) != 1 || results[0].ID != 7 {
+		t.Fatalf("unexpected results: %#v", results)
+	}
 	if err := mock.ExpectationsWereMet(); err != nil {
 		t.Fatalf("unmet expectations: %v", err)
 	}
@@ -280,11 +326,11 @@ func TestServerDeleteRemovesFileThenDBRow(t *testing.T) {
 		t.Fatalf("write file: %v", err)
 	}
 
-	mock.ExpectQuery(`(?s)SELECT id, path, COALESCE\(root_folder, ''\), hostname, size, COALESCE\(hash, ''\), last_hashed_at\s+FROM files\s+WHERE id = \$1 AND LOWER\(hostname\) = LOWER\(\$2\)`).
+	mock.ExpectQuery(`(?s)SELECT id, path, COALESCE\(root_folder, ''\), hostname, size, COALESCE\(hash, ''\), last_hashed_at\s+FROM files\s+WHERE id = \$1 AND hostname = \$2`).
 		WithArgs(9, "brain.local").
 		WillReturnRows(sqlmock.NewRows([]string{"id", "path", "root_folder", "hostname", "size", "hash", "last_hashed_at"}).
 			AddRow(9, relPath, root, "brain.local", int64(9), "hash", nil))
-	mock.ExpectExec(`DELETE FROM files WHERE id = \$1 AND LOWER\(hostname\) = LOWER\(\$2\)`).
+	mock.ExpectExec(`UPDATE files SET deleted_at = NOW\(\) WHERE id = \$1 AND hostname = \$2`).
 		WithArgs(9, "brain.local").
 		WillReturnResult(sqlmock.NewResult(0, 1))
 
@@ -321,11 +367,11 @@ func TestServerDeleteMissingFileStillRemovesDBRow(t *testing.T) {
 
 	root := t.TempDir()
 	relPath := "movies/missing.mkv"
-	mock.ExpectQuery(`(?s)SELECT id, path, COALESCE\(root_folder, ''\), hostname, size, COALESCE\(hash, ''\), last_hashed_at\s+FROM files\s+WHERE id = \$1 AND LOWER\(hostname\) = LOWER\(\$2\)`).
+	mock.ExpectQuery(`(?s)SELECT id, path, COALESCE\(root_folder, ''\), hostname, size, COALESCE\(hash, ''\), last_hashed_at\s+FROM files\s+WHERE id = \$1 AND hostname = \$2`).
 		WithArgs(10, "brain.local").
 		WillReturnRows(sqlmock.NewRows([]string{"id", "path", "root_folder", "hostname", "size", "hash", "last_hashed_at"}).
 			AddRow(10, relPath, root, "brain.local", nil, "", nil))
-	mock.ExpectExec(`DELETE FROM files WHERE id = \$1 AND LOWER\(hostname\) = LOWER\(\$2\)`).
+	mock.ExpectExec(`UPDATE files SET deleted_at = NOW\(\) WHERE id = \$1 AND hostname = \$2`).
 		WithArgs(10, "brain.local").
 		WillReturnResult(sqlmock.NewResult(0, 1))
 
@@ -367,7 +413,7 @@ func TestServerDeleteRejectsUnsafeIndexedPathsBeforeDBDelete(t *testing.T) {
 			}
 			defer database.Close()
 
-			mock.ExpectQuery(`(?s)SELECT id, path, COALESCE\(root_folder, ''\), hostname, size, COALESCE\(hash, ''\), last_hashed_at\s+FROM files\s+WHERE id = \$1 AND LOWER\(hostname\) = LOWER\(\$2\)`).
+			mock.ExpectQuery(`(?s)SELECT id, path, COALESCE\(root_folder, ''\), hostname, size, COALESCE\(hash, ''\), last_hashed_at\s+FROM files\s+WHERE id = \$1 AND hostname = \$2`).
 				WithArgs(11, "brain.local").
 				WillReturnRows(sqlmock.NewRows([]string{"id", "path", "root_folder", "hostname", "size", "hash", "last_hashed_at"}).
 					AddRow(11, tc.path, tc.rootFolder, "brain.local", nil, "", nil))
@@ -399,7 +445,7 @@ func TestServerDeleteRejectsNonRegularFilesBeforeDBDelete(t *testing.T) {
 	if err := os.Mkdir(filepath.Join(root, "directory"), 0o755); err != nil {
 		t.Fatalf("mkdir: %v", err)
 	}
-	mock.ExpectQuery(`(?s)SELECT id, path, COALESCE\(root_folder, ''\), hostname, size, COALESCE\(hash, ''\), last_hashed_at\s+FROM files\s+WHERE id = \$1 AND LOWER\(hostname\) = LOWER\(\$2\)`).
+	mock.ExpectQuery(`(?s)SELECT id, path, COALESCE\(root_folder, ''\), hostname, size, COALESCE\(hash, ''\), last_hashed_at\s+FROM files\s+WHERE id = \$1 AND hostname = \$2`).
 		WithArgs(12, "brain.local").
 		WillReturnRows(sqlmock.NewRows([]string{"id", "path", "root_folder", "hostname", "size", "hash", "last_hashed_at"}).
 			AddRow(12, "directory", root, "brain.local", nil, "", nil))
@@ -440,7 +486,7 @@ func TestServerDeleteMissingRowReturnsNotFound(t *testing.T) {
 	}
 	defer database.Close()
 
-	mock.ExpectQuery(`(?s)SELECT id, path, COALESCE\(root_folder, ''\), hostname, size, COALESCE\(hash, ''\), last_hashed_at\s+FROM files\s+WHERE id = \$1 AND LOWER\(hostname\) = LOWER\(\$2\)`).
+	mock.ExpectQuery(`(?s)SELECT id, path, COALESCE\(root_folder, ''\), hostname, size, COALESCE\(hash, ''\), last_hashed_at\s+FROM files\s+WHERE id = \$1 AND hostname = \$2`).
 		WithArgs(404, "brain.local").
 		WillReturnError(sql.ErrNoRows)
 
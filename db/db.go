@@ -8,7 +8,7 @@ import (
 
 	"encoding/json"
 
-	_ "github.com/lib/pq"
+	"github.com/lib/pq"
 )
 
 type Host struct {
@@ -40,6 +40,8 @@ type PathGroupMember struct {
 	HostName     string
 	FriendlyPath string
 	Priority     int
+	Protected    bool // copies here are never removed by group dedupe
+	ReadOnly     bool // never modified: copies are never removed, nor new ones written here
 }
 
 // GetPaths returns the paths from the host's settings JSON
@@ -60,12 +62,146 @@ func (h *Host) GetPaths() (map[string]string, error) {
 
 // SetPaths sets the paths in the host's settings JSON
 func (h *Host) SetPaths(paths map[string]string) error {
-	hp := HostPaths{Paths: paths}
-	settings, err := json.Marshal(hp)
+	return h.setSetting("paths", paths)
+}
+
+// DefaultHashCommand is the remote checksum command used when a host does not
+// configure one.
+const DefaultHashCommand = "sha256sum"
+
+// GetHashCommand returns the checksum command used to hash files on this host
+// over ssh. Hosts without GNU coreutils can set e.g. "shasum -a 256".
+func (h *Host) GetHashCommand() (string, error) {
+	if len(h.Settings) == 0 {
+		return DefaultHashCommand, nil
+	}
+	var s struct {
+		HashCommand string `json:"hash_command"`
+	}
+	if err := json.Unmarshal(h.Settings, &s); err != nil {
+		return "", err
+	}
+	if strings.TrimSpace(s.HashCommand) == "" {
+		return DefaultHashCommand, nil
+	}
+	return s.HashCommand, nil
+}
+
+// SetHashCommand sets the checksum command in the host's settings JSON. An
+// empty command restores the default.
+func (h *Host) SetHashCommand(command string) error {
+	command = strings.TrimSpace(command)
+	if command == "" {
+		return h.setSetting("hash_command", nil)
+	}
+	return h.setSetting("hash_command", command)
+}
+
+// GetXattrWhitelist returns the extended attribute names (such as
+// "user.xdg.tags") captured and merged for files on this host.
+func (h *Host) GetXattrWhitelist() ([]string, error) {
+	if len(h.Settings) == 0 {
+		return nil, nil
+	}
+	var s struct {
+		XattrWhitelist []string `json:"xattr_whitelist"`
+	}
+	if err := json.Unmarshal(h.Settings, &s); err != nil {
+		return nil, err
+	}
+	return s.XattrWhitelist, nil
+}
+
+// SetXattrWhitelist sets the xattr whitelist in the host's settings JSON. An
+// empty list removes it.
+func (h *Host) SetXattrWhitelist(names []string) error {
+	var cleaned []string
+	for _, name := range names {
+		if name = strings.TrimSpace(name); name != "" {
+			cleaned = append(cleaned, name)
+		}
+	}
+	if len(cleaned) == 0 {
+		return h.setSetting("xattr_whitelist", nil)
+	}
+	return h.setSetting("xattr_whitelist", cleaned)
+}
+
+// SSHSettings is how ssh and rsync reach a host when ~/.ssh/config does not
+// say. The zero value leaves everything to ssh.
+type SSHSettings struct {
+	User         string   `json:"user,omitempty"`
+	Port         int      `json:"port,omitempty"`
+	IdentityFile string   `json:"identity_file,omitempty"`
+	Options      []string `json:"options,omitempty"` // passed as -o, e.g. "StrictHostKeyChecking=accept-new"
+}
+
+// IsZero reports whether s sets nothing.
+func (s SSHSettings) IsZero() bool {
+	return s.User == "" && s.Port == 0 && s.IdentityFile == "" && len(s.Options) == 0
+}
+
+// GetSSHSettings returns the ssh settings of this host.
+func (h *Host) GetSSHSettings() (SSHSettings, error) {
+	if len(h.Settings) == 0 {
+		return SSHSettings{}, nil
+	}
+	var s struct {
+		SSH SSHSettings `json:"ssh"`
+	}
+	if err := json.Unmarshal(h.Settings, &s); err != nil {
+		return SSHSettings{}, err
+	}
+	return s.SSH, nil
+}
+
+// SetSSHSettings sets the ssh settings in the host's settings JSON. Zero
+// settings remove them.
+func (h *Host) SetSSHSettings(s SSHSettings) error {
+	s.User = strings.TrimSpace(s.User)
+	s.IdentityFile = strings.TrimSpace(s.IdentityFile)
+	var options []string
+	for _, option := range s.Options {
+		if option = strings.TrimSpace(option); option != "" {
+			options = append(options, option)
+		}
+	}
+	s.Options = options
+	if s.Port < 0 || s.Port > 65535 {
+		return fmt.Errorf("invalid ssh port %d", s.Port)
+	}
+	if s.IsZero() {
+		return h.setSetting("ssh", nil)
+	}
+	return h.setSetting("ssh", s)
+}
+
+// setSetting updates a single top-level key in the settings JSON, keeping the
+// others intact. A nil value removes the key.
+func (h *Host) setSetting(key string, value interface{}) error {
+	settings := map[string]json.RawMessage{}
+	if len(h.Settings) > 0 {
+		if err := json.Unmarshal(h.Settings, &settings); err != nil {
+			return err
+		}
+	}
+	if settings == nil {
+		settings = map[string]json.RawMessage{}
+	}
+	if value == nil {
+		delete(settings, key)
+	} else {
+		raw, err := json.Marshal(value)
+		if err != nil {
+			return err
+		}
+		settings[key] = raw
+	}
+	encoded, err := json.Marshal(settings)
 	if err != nil {
 		return err
 	}
-	h.Settings = settings
+	h.Settings = encoded
 	return nil
 }
 
@@ -115,24 +251,95 @@ func CreateDatabase(db *sql.DB, force bool) error {
 	return nil
 }
 
+// NormalizeHostname returns the canonical form of a hostname as stored in
+// hosts.hostname and files.hostname: trimmed and lowercased. Every write
+// goes through it, so lookups can compare hostnames with plain equality.
+func NormalizeHostname(hostname string) string {
+	return strings.ToLower(strings.TrimSpace(hostname))
+}
+
+// ValidateHostname normalizes hostname and rejects values that cannot name
+// a host: empty ones, and ones containing whitespace or a colon, which would
+// break the host:path arguments given to ssh and rsync.
+func ValidateHostname(hostname string) (string, error) {
+	hostname = NormalizeHostname(hostname)
+	if hostname == "" {
+		return "", fmt.Errorf("hostname cannot be empty")
+	}
+	if strings.ContainsAny(hostname, " \t\r\n:") {
+		return "", fmt.Errorf("invalid hostname %q: it cannot contain whitespace or ':'", hostname)
+	}
+	return hostname, nil
+}
+
 // AddHost adds a new host to the database
 func AddHost(db *sql.DB, name, hostname, ip, rootPath string, settings json.RawMessage) error {
+	hostname, err := ValidateHostname(hostname)
+	if err != nil {
+		return err
+	}
 	settings = ensureSettings(settings)
-	_, err := db.Exec(`
+	_, err = db.Exec(`
 		INSERT INTO hosts (name, hostname, ip, root_path, settings)
 		VALUES ($1, $2, $3, $4, $5)
-	`, name, strings.ToLower(hostname), ip, rootPath, settings)
+	`, name, hostname, ip, rootPath, settings)
 	return err
 } // Note: for backward compatibility, rootPath can be provided as ""
 
+// RegisterHostIfMissing adds a hosts row for hostname unless one already
+// exists, using the lowercased hostname as both name and hostname. paths, if
+// any, become the host's friendly paths. It reports whether a row was added.
+func RegisterHostIfMissing(db *sql.DB, hostname string, paths map[string]string) (bool, error) {
+	hostname = NormalizeHostname(hostname)
+	if hostname == "" {
+		return false, fmt.Errorf("cannot register a host with an empty hostname")
+	}
+
+	var exists bool
+	err := db.QueryRow(`
+		SELECT EXISTS (SELECT 1 FROM hosts WHERE LOWER(hostname) = LOWER($1))
+	`, hostname).Scan(&exists)
+	if err != nil {
+		return false, fmt.Errorf("error looking up host %s: %v", hostname, err)
+	}
+	if exists {
+		return false, nil
+	}
+
+	host := &Host{}
+	if len(paths) > 0 {
+		if err := host.SetPaths(paths); err != nil {
+			return false, fmt.Errorf("error encoding paths: %v", err)
+		}
+	}
+	// ON CONFLICT keeps two agents starting at once from failing each other.
+	result, err := db.Exec(`
+		INSERT INTO hosts (name, hostname, ip, root_path, settings)
+		VALUES ($1, $1, '', '', $2)
+		ON CONFLICT DO NOTHING
+	`, hostname, ensureSettings(host.Settings))
+	if err != nil {
+		return false, fmt.Errorf("error registering host %s: %v", hostname, err)
+	}
+	added, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return added > 0, nil
+}
+
 // UpdateHost updates an existing host in the database
 func UpdateHost(db *sql.DB, oldName, newName, hostname, ip, rootPath string, settings json.RawMessage) error {
+	hostname, err := ValidateHostname(hostname)
+	if err != nil {
+		return err
+	}
 	settings = ensureSettings(settings)
 	result, err := db.Exec(`
 		UPDATE hosts
 		SET name = $2, hostname = $3, ip = $4, root_path = $5, settings = $6
 		WHERE name = $1
-	`, oldName, newName, strings.ToLower(hostname), ip, rootPath, settings)
+	`, oldName, newName, hostname, ip, rootPath, settings)
 	if err != nil {
 		return err
 	}
@@ -198,6 +405,20 @@ func GetHost(db *sql.DB, name string) (*Host, error) {
 	return host, err
 }
 
+// ResolveHost finds the host a --server value refers to: by hostname
+// (case-insensitive) first, then by friendly name.
+func ResolveHost(db *sql.DB, server string) (*Host, error) {
+	host, err := GetHostByHostname(db, server)
+	if err == nil {
+		return host, nil
+	}
+	host, err = GetHost(db, server)
+	if err != nil {
+		return nil, fmt.Errorf("server not found: %s", server)
+	}
+	return host, nil
+}
+
 // ListHosts returns all hosts in the database
 func ListHosts(db *sql.DB) ([]Host, error) {
 	rows, err := db.Query(`
@@ -221,13 +442,18 @@ func ListHosts(db *sql.DB) ([]Host, error) {
 	return hosts, rows.Err()
 }
 
-func Connect(host, port, user, password, dbname string) (*sql.DB, error) {
+// Connect opens the catalog database. A positive statementTimeout bounds
+// every statement run on the handle (see Open).
+func Connect(host, port, user, password, dbname string, statementTimeout time.Duration) (*sql.DB, error) {
 	connStr := fmt.Sprintf("host=%s port=%s user=%s dbname=%s sslmode=disable",
 		host, port, user, dbname)
 	if password != "" {
 		connStr += fmt.Sprintf(" password=%s", password)
 	}
 
+	if statementTimeout > 0 {
+		return Open(&pq.Driver{}, connStr, statementTimeout), nil
+	}
 	return sql.Open("postgres", connStr)
 }
 
@@ -356,10 +582,32 @@ func RemovePathFromGroup(db *sql.DB, hostName, friendlyPath string) error {
 	return nil
 }
 
+// UpdateGroupMember changes the priority, protection and/or read-only flag of
+// a group member; nil leaves a setting unchanged.
+func UpdateGroupMember(db *sql.DB, hostName, friendlyPath string, priority *int, protected, readOnly *bool) error {
+	result, err := db.Exec(`
+		UPDATE path_group_members
+		SET priority = COALESCE($3, priority), protected = COALESCE($4, protected), read_only = COALESCE($5, read_only)
+		WHERE host_name = $1 AND friendly_path = $2
+	`, hostName, friendlyPath, priority, protected, readOnly)
+	if err != nil {
+		return err
+	}
+
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rows == 0 {
+		return fmt.Errorf("path not found in any group: %s:%s", hostName, friendlyPath)
+	}
+	return nil
+}
+
 // ListGroupMembers returns all members of a path group
 func ListGroupMembers(db *sql.DB, groupName string) ([]PathGroupMember, error) {
 	rows, err := db.Query(`
-		SELECT pgm.id, pgm.group_id, pgm.host_name, pgm.friendly_path, pgm.priority
+		SELECT pgm.id, pgm.group_id, pgm.host_name, pgm.friendly_path, pgm.priority, pgm.protected, pgm.read_only
 		FROM path_group_members pgm
 		JOIN path_groups pg ON pgm.group_id = pg.id
 		WHERE pg.name = $1
@@ -373,7 +621,7 @@ func ListGroupMembers(db *sql.DB, groupName string) ([]PathGroupMember, error) {
 	var members []PathGroupMember
 	for rows.Next() {
 		var member PathGroupMember
-		err := rows.Scan(&member.ID, &member.GroupID, &member.HostName, &member.FriendlyPath, &member.Priority)
+		err := rows.Scan(&member.ID, &member.GroupID, &member.HostName, &member.FriendlyPath, &member.Priority, &member.Protected, &member.ReadOnly)
 		if err != nil {
 			return nil, err
 		}
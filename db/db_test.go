@@ -0,0 +1,206 @@
+package db
+
+import (
+	"database/sql"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+func TestHostSettingsKeepUnrelatedKeys(t *testing.T) {
+	h := &Host{Settings: json.RawMessage(`{"paths":{"photos":"/data/photos"}}`)}
+
+	cmd, err := h.GetHashCommand()
+	if err != nil || cmd != DefaultHashCommand {
+		t.Fatalf("expected default hash command, got %q (%v)", cmd, err)
+	}
+
+	if err := h.SetHashCommand("shasum -a 256"); err != nil {
+		t.Fatalf("SetHashCommand: %v", err)
+	}
+	if err := h.SetPaths(map[string]string{"videos": "/data/videos"}); err != nil {
+		t.Fatalf("SetPaths: %v", err)
+	}
+
+	cmd, err = h.GetHashCommand()
+	if err != nil || cmd != "shasum -a 256" {
+		t.Fatalf("hash command lost after SetPaths: %q (%v)", cmd, err)
+	}
+	paths, err := h.GetPaths()
+	if err != nil || len(paths) != 1 || paths["videos"] != "/data/videos" {
+		t.Fatalf("unexpected paths: %v (%v)", paths, err)
+	}
+
+	if err := h.SetHashCommand(""); err != nil {
+		t.Fatalf("SetHashCommand reset: %v", err)
+	}
+	if got := string(h.Settings); got != `{"paths":{"videos":"/data/videos"}}` {
+		t.Fatalf("unexpected settings after reset: %s", got)
+	}
+}
+
+func TestHostXattrWhitelist(t *testing.T) {
+	h := &Host{Settings: json.RawMessage(`{"paths":{"photos":"/data/photos"}}`)}
+	if names, err := h.GetXattrWhitelist(); err != nil || names != nil {
+		t.Fatalf("expected no whitelist, got %v (%v)", names, err)
+	}
+	if err := h.SetXattrWhitelist([]string{"user.rating", " ", "user.xdg.tags"}); err != nil {
+		t.Fatalf("SetXattrWhitelist: %v", err)
+	}
+	names, err := h.GetXattrWhitelist()
+	if err != nil || len(names) != 2 || names[0] != "user.rating" || names[1] != "user.xdg.tags" {
+		t.Fatalf("unexpected whitelist %v (%v)", names, err)
+	}
+	if err := h.SetXattrWhitelist(nil); err != nil {
+		t.Fatalf("SetXattrWhitelist reset: %v", err)
+	}
+	if got := string(h.Settings); got != `{"paths":{"photos":"/data/photos"}}` {
+		t.Fatalf("unexpected settings after reset: %s", got)
+	}
+}
+
+func TestHostSSHSettings(t *testing.T) {
+	h := &Host{Settings: json.RawMessage(`{"paths":{"photos":"/data/photos"}}`)}
+	if s, err := h.GetSSHSettings(); err != nil || !s.IsZero() {
+		t.Fatalf("expected no ssh settings, got %+v (%v)", s, err)
+	}
+	if err := h.SetSSHSettings(SSHSettings{User: " backup ", Port: 2222, IdentityFile: "/keys/nas", Options: []string{"BatchMode=yes", " "}}); err != nil {
+		t.Fatalf("SetSSHSettings: %v", err)
+	}
+	s, err := h.GetSSHSettings()
+	if err != nil || s.User != "backup" || s.Port != 2222 || s.IdentityFile != "/keys/nas" || len(s.Options) != 1 || s.Options[0] != "BatchMode=yes" {
+		t.Fatalf("unexpected ssh settings %+v (%v)", s, err)
+	}
+	if err := h.SetSSHSettings(SSHSettings{Port: 70000}); err == nil {
+		t.Fatal("expected an out of range port to be rejected")
+	}
+	if err := h.SetSSHSettings(SSHSettings{}); err != nil {
+		t.Fatalf("SetSSHSettings reset: %v", err)
+	}
+	if got := string(h.Settings); got != `{"paths":{"photos":"/data/photos"}}` {
+		t.Fatalf("unexpected settings after reset: %s", got)
+	}
+}
+
+func TestRegisterHostIfMissingInsertsOnce(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("sqlmock: %v", err)
+	}
+	defer db.Close()
+
+	mock.ExpectQuery(`SELECT EXISTS \(SELECT 1 FROM hosts WHERE LOWER\(hostname\) = LOWER\(\$1\)\)`).
+		WithArgs("agent07").
+		WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(false))
+	mock.ExpectExec(`INSERT INTO hosts \(name, hostname, ip, root_path, settings\)\s+VALUES \(\$1, \$1, '', '', \$2\)\s+ON CONFLICT DO NOTHING`).
+		WithArgs("agent07", json.RawMessage(`{"paths":{"photos":"/data/photos"}}`)).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+
+	added, err := RegisterHostIfMissing(db, "Agent07", map[string]string{"photos": "/data/photos"})
+	if err != nil || !added {
+		t.Fatalf("expected host to be registered, got %v (%v)", added, err)
+	}
+
+	// A second run finds the row and leaves it alone.
+	mock.ExpectQuery(`SELECT EXISTS`).
+		WithArgs("agent07").
+		WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(true))
+
+	added, err = RegisterHostIfMissing(db, "agent07", map[string]string{"photos": "/data/photos"})
+	if err != nil || added {
+		t.Fatalf("expected no registration on second run, got %v (%v)", added, err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatalf("unmet expectations: %v", err)
+	}
+}
+
+func TestAddHostStoresNormalizedHostname(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("sqlmock: %v", err)
+	}
+	defer db.Close()
+
+	mock.ExpectExec(`INSERT INTO hosts \(name, hostname, ip, root_path, settings\)`).
+		WithArgs("Brain", "brain.local", "", "", sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	if err := AddHost(db, "Brain", "  Brain.LOCAL ", "", "", nil); err != nil {
+		t.Fatalf("AddHost: %v", err)
+	}
+
+	for _, bad := range []string{"", "   ", "brain local", "brain:/data"} {
+		if err := AddHost(db, "Brain", bad, "", "", nil); err == nil {
+			t.Errorf("expected hostname %q to be rejected", bad)
+		}
+		if err := UpdateHost(db, "Brain", "Brain", bad, "", "", nil); err == nil {
+			t.Errorf("expected UpdateHost to reject hostname %q", bad)
+		}
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatalf("unmet expectations: %v", err)
+	}
+}
+
+func TestResolveHostTriesHostnameThenName(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("sqlmock: %v", err)
+	}
+	defer db.Close()
+
+	hostByHostname := `SELECT id, name, hostname, ip, root_path, settings, created_at\s+FROM hosts WHERE LOWER\(hostname\) = LOWER\(\$1\)`
+	hostByName := `SELECT id, name, hostname, ip, root_path, settings, created_at\s+FROM hosts WHERE name = \$1`
+	mock.ExpectQuery(hostByHostname).
+		WithArgs("Backup1").
+		WillReturnError(sql.ErrNoRows)
+	mock.ExpectQuery(hostByName).
+		WithArgs("Backup1").
+		WillReturnRows(sqlmock.NewRows([]string{"id", "name", "hostname", "ip", "root_path", "settings", "created_at"}).
+			AddRow(1, "Backup1", "backup1.local", "", "", []byte(`{}`), time.Now()))
+	host, err := ResolveHost(db, "Backup1")
+	if err != nil || host.Hostname != "backup1.local" {
+		t.Fatalf("ResolveHost(Backup1) = %+v, %v", host, err)
+	}
+
+	mock.ExpectQuery(hostByHostname).
+		WithArgs("missing").
+		WillReturnError(sql.ErrNoRows)
+	mock.ExpectQuery(hostByName).
+		WithArgs("missing").
+		WillReturnError(sql.ErrNoRows)
+	if _, err := ResolveHost(db, "missing"); err == nil || err.Error() != "server not found: missing" {
+		t.Fatalf("expected server not found, got %v", err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatalf("unmet expectations: %v", err)
+	}
+}
+
+func TestUpdateGroupMemberLeavesUnsetFieldsAlone(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("sqlmock: %v", err)
+	}
+	defer db.Close()
+
+	protected := true
+	mock.ExpectExec(`UPDATE path_group_members\s+SET priority = COALESCE\(\$3, priority\), protected = COALESCE\(\$4, protected\), read_only = COALESCE\(\$5, read_only\)\s+WHERE host_name = \$1 AND friendly_path = \$2`).
+		WithArgs("NAS", "photos", nil, true, nil).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	if err := UpdateGroupMember(db, "NAS", "photos", nil, &protected, nil); err != nil {
+		t.Fatalf("UpdateGroupMember: %v", err)
+	}
+
+	mock.ExpectExec(`UPDATE path_group_members`).
+		WithArgs("NAS", "videos", nil, true, nil).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	if err := UpdateGroupMember(db, "NAS", "videos", nil, &protected, nil); err == nil {
+		t.Fatalf("expected an error for a path outside any group")
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatalf("unmet expectations: %v", err)
+	}
+}
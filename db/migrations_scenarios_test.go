@@ -24,8 +24,8 @@ func TestMigrateDatabaseAppliesPendingFiles(t *testing.T) {
 
 	mock.ExpectExec(`CREATE TABLE IF NOT EXISTS migrations`).WillReturnResult(sqlmock.NewResult(0, 1))
 
-	// Five .up.sql files exist in migrations/ (including 000005_add_path_groups.up.sql)
-	for i := 0; i < 5; i++ {
+	// Twenty-one .up.sql files exist in migrations/ (including 000021_add_group_member_read_only.up.sql)
+	for i := 0; i < 21; i++ {
 		mock.ExpectQuery(`SELECT EXISTS`).WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(false))
 		mock.ExpectBegin()
 		mock.ExpectExec(`(?s).*`).WillReturnResult(sqlmock.NewResult(0, 1))
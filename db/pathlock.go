@@ -0,0 +1,179 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// DefaultPathLockTimeout is how long a destructive run waits for the paths it
+// touches before giving up.
+const DefaultPathLockTimeout = 30 * time.Second
+
+// LockedPath names a friendly path on one host, the unit destructive runs
+// lock so that mirror and dedupe never work on the same files at once.
+type LockedPath struct {
+	HostName     string
+	FriendlyPath string
+}
+
+func (p LockedPath) String() string {
+	return p.FriendlyPath + " on " + p.HostName
+}
+
+// key is the advisory lock key of the path.
+func (p LockedPath) key() int64 {
+	h := fnv.New64a()
+	h.Write([]byte(p.HostName))
+	h.Write([]byte{0})
+	h.Write([]byte(p.FriendlyPath))
+	return int64(h.Sum64())
+}
+
+// PathLockOptions controls AcquirePathLocks.
+type PathLockOptions struct {
+	Command string        // Recorded in path_locks for runs that wait on this one
+	Timeout time.Duration // Give up waiting after this long (0 = wait indefinitely)
+}
+
+// PathLock holds advisory locks on a set of paths until Release. The locks
+// are transaction-scoped, so they also go away if the process dies.
+type PathLock struct {
+	db     *sql.DB
+	tx     *sql.Tx
+	keys   []int64
+	holder string
+}
+
+// PathLockHolder is the path_locks entry of the run holding a lock, as far as
+// it is known: the entry is written after the lock is taken and may be stale.
+type PathLockHolder struct {
+	Command    string
+	Holder     string
+	PID        int
+	AcquiredAt time.Time
+}
+
+// PathLockedError is returned when a path stayed locked for the whole
+// timeout. Holder is nil when no run registered itself for the path.
+type PathLockedError struct {
+	Path    LockedPath
+	Timeout time.Duration
+	Holder  *PathLockHolder
+}
+
+func (e *PathLockedError) Error() string {
+	msg := fmt.Sprintf("%s is locked by another run (gave up after %s)", e.Path, e.Timeout)
+	if e.Holder != nil {
+		msg += fmt.Sprintf(": likely '%s' on %s (pid %d) since %s",
+			e.Holder.Command, e.Holder.Holder, e.Holder.PID, e.Holder.AcquiredAt.Format("2006-01-02 15:04:05"))
+	}
+	return msg
+}
+
+// AcquirePathLock locks one friendly path of a host; see AcquirePathLocks.
+func AcquirePathLock(ctx context.Context, db *sql.DB, hostName, friendlyPath string, opts PathLockOptions) (*PathLock, error) {
+	return AcquirePathLocks(ctx, db, []LockedPath{{HostName: hostName, FriendlyPath: friendlyPath}}, opts)
+}
+
+// AcquirePathLocks takes a pg_advisory_xact_lock for each path in one
+// transaction, in key order so two runs cannot deadlock, then records the run
+// in path_locks. If a lock is still held by another run after opts.Timeout, it
+// returns a *PathLockedError naming that run.
+func AcquirePathLocks(ctx context.Context, db *sql.DB, paths []LockedPath, opts PathLockOptions) (*PathLock, error) {
+	byKey := make(map[int64]LockedPath, len(paths))
+	for _, p := range paths {
+		byKey[p.key()] = p
+	}
+	keys := make([]int64, 0, len(byKey))
+	for key := range byKey {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i] < keys[j] })
+
+	// The transaction outlives ctx: on ctrl-C database/sql would roll it back
+	// under the run, and Release would then fail on a lock already gone.
+	tx, err := db.BeginTx(context.WithoutCancel(ctx), nil)
+	if err != nil {
+		return nil, fmt.Errorf("error starting path lock transaction: %v", err)
+	}
+	if opts.Timeout > 0 {
+		if _, err := tx.ExecContext(ctx, "SELECT set_config('lock_timeout', $1, true)", fmt.Sprintf("%dms", opts.Timeout.Milliseconds())); err != nil {
+			_ = tx.Rollback()
+			return nil, fmt.Errorf("error setting lock timeout: %v", err)
+		}
+	}
+	for _, key := range keys {
+		if _, err := tx.ExecContext(ctx, "SELECT pg_advisory_xact_lock($1)", key); err != nil {
+			_ = tx.Rollback()
+			if isLockTimeout(err) {
+				return nil, &PathLockedError{Path: byKey[key], Timeout: opts.Timeout, Holder: lookupPathLockHolder(ctx, db, key)}
+			}
+			return nil, fmt.Errorf("error locking %s: %v", byKey[key], err)
+		}
+	}
+
+	holder, _ := os.Hostname()
+	lock := &PathLock{db: db, tx: tx, keys: keys, holder: strings.ToLower(holder)}
+	for _, key := range keys {
+		p := byKey[key]
+		// The registry only serves error messages; failing to write it must
+		// not stop a run that holds its locks.
+		if _, err := db.ExecContext(ctx, `
+			INSERT INTO path_locks (lock_key, host_name, friendly_path, command, holder, pid, acquired_at)
+			VALUES ($1, $2, $3, $4, $5, $6, NOW())
+			ON CONFLICT (lock_key) DO UPDATE SET
+				host_name = EXCLUDED.host_name,
+				friendly_path = EXCLUDED.friendly_path,
+				command = EXCLUDED.command,
+				holder = EXCLUDED.holder,
+				pid = EXCLUDED.pid,
+				acquired_at = EXCLUDED.acquired_at
+		`, key, p.HostName, p.FriendlyPath, opts.Command, lock.holder, os.Getpid()); err != nil {
+			fmt.Fprintf(os.Stderr, "Warning: error registering lock on %s: %v\n", p, err)
+		}
+	}
+	return lock, nil
+}
+
+// Release drops this run's path_locks entries and ends the transaction,
+// which releases the advisory locks. It is safe to call on a nil lock.
+func (l *PathLock) Release() error {
+	if l == nil {
+		return nil
+	}
+	if _, err := l.db.Exec(`DELETE FROM path_locks WHERE lock_key = ANY($1) AND holder = $2 AND pid = $3`,
+		pq.Array(l.keys), l.holder, os.Getpid()); err != nil {
+		fmt.Fprintf(os.Stderr, "Warning: error clearing path lock registry: %v\n", err)
+	}
+	if err := l.tx.Commit(); err != nil {
+		return fmt.Errorf("error releasing path locks: %v", err)
+	}
+	return nil
+}
+
+// isLockTimeout reports whether err is Postgres giving up on a lock wait
+// (lock_not_available, raised when lock_timeout expires).
+func isLockTimeout(err error) bool {
+	var pqErr *pq.Error
+	return errors.As(err, &pqErr) && pqErr.Code == "55P03"
+}
+
+// lookupPathLockHolder returns the registered holder of key, or nil.
+func lookupPathLockHolder(ctx context.Context, db *sql.DB, key int64) *PathLockHolder {
+	var h PathLockHolder
+	err := db.QueryRowContext(ctx, `SELECT command, holder, pid, acquired_at FROM path_locks WHERE lock_key = $1`, key).
+		Scan(&h.Command, &h.Holder, &h.PID, &h.AcquiredAt)
+	if err != nil {
+		return nil
+	}
+	return &h
+}
@@ -0,0 +1,147 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"os"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/lib/pq"
+)
+
+func TestAcquirePathLocksTakesAdvisoryLocksInKeyOrder(t *testing.T) {
+	database, mock, err := sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherRegexp))
+	if err != nil {
+		t.Fatalf("sqlmock: %v", err)
+	}
+	defer database.Close()
+
+	photosA := LockedPath{HostName: "Brain", FriendlyPath: "photos"}
+	photosB := LockedPath{HostName: "Pinky", FriendlyPath: "photos"}
+	keys := []int64{photosA.key(), photosB.key()}
+	sort.Slice(keys, func(i, j int) bool { return keys[i] < keys[j] })
+	if photosA.key() == photosB.key() {
+		t.Fatalf("different paths share lock key %d", photosA.key())
+	}
+
+	mock.ExpectBegin()
+	mock.ExpectExec(`SELECT set_config\('lock_timeout', \$1, true\)`).WithArgs("1500ms").WillReturnResult(sqlmock.NewResult(0, 0))
+	for _, key := range keys {
+		mock.ExpectExec(`SELECT pg_advisory_xact_lock\(\$1\)`).WithArgs(key).WillReturnResult(sqlmock.NewResult(0, 0))
+	}
+	for _, key := range keys {
+		mock.ExpectExec(`INSERT INTO path_locks`).
+			WithArgs(key, sqlmock.AnyArg(), "photos", "files mirror photos", sqlmock.AnyArg(), os.Getpid()).
+			WillReturnResult(sqlmock.NewResult(0, 1))
+	}
+
+	// A path listed twice is locked once.
+	lock, err := AcquirePathLocks(context.Background(), database, []LockedPath{photosB, photosA, photosB},
+		PathLockOptions{Command: "files mirror photos", Timeout: 1500 * time.Millisecond})
+	if err != nil {
+		t.Fatalf("AcquirePathLocks: %v", err)
+	}
+
+	mock.ExpectExec(`DELETE FROM path_locks WHERE lock_key = ANY\(\$1\)`).WillReturnResult(sqlmock.NewResult(0, 2))
+	mock.ExpectCommit()
+	if err := lock.Release(); err != nil {
+		t.Fatalf("Release: %v", err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatalf("unmet expectations: %v", err)
+	}
+}
+
+func TestAcquirePathLockTimeoutNamesLikelyHolder(t *testing.T) {
+	database, mock, err := sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherRegexp))
+	if err != nil {
+		t.Fatalf("sqlmock: %v", err)
+	}
+	defer database.Close()
+
+	path := LockedPath{HostName: "Brain", FriendlyPath: "photos"}
+	since := time.Date(2024, 5, 1, 10, 0, 0, 0, time.UTC)
+
+	mock.ExpectBegin()
+	mock.ExpectExec(`SELECT set_config`).WithArgs("30000ms").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec(`SELECT pg_advisory_xact_lock\(\$1\)`).WithArgs(path.key()).
+		WillReturnError(&pq.Error{Code: "55P03", Message: "canceling statement due to lock timeout"})
+	mock.ExpectRollback()
+	mock.ExpectQuery(`SELECT command, holder, pid, acquired_at FROM path_locks WHERE lock_key = \$1`).WithArgs(path.key()).
+		WillReturnRows(sqlmock.NewRows([]string{"command", "holder", "pid", "acquired_at"}).
+			AddRow("files dedupe-group family", "pinky", 4242, since))
+
+	_, err = AcquirePathLock(context.Background(), database, "Brain", "photos", PathLockOptions{Command: "files mirror photos", Timeout: DefaultPathLockTimeout})
+	var locked *PathLockedError
+	if !errors.As(err, &locked) {
+		t.Fatalf("expected *PathLockedError, got %v", err)
+	}
+	if locked.Holder == nil || locked.Holder.PID != 4242 {
+		t.Fatalf("holder = %+v", locked.Holder)
+	}
+	for _, want := range []string{"photos on Brain is locked", "after 30s", "'files dedupe-group family' on pinky (pid 4242)", "2024-05-01 10:00:00"} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("error %q does not mention %q", err, want)
+		}
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatalf("unmet expectations: %v", err)
+	}
+}
+
+func TestAcquirePathLockWithoutTimeoutWaitsAndReportsOtherErrors(t *testing.T) {
+	database, mock, err := sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherRegexp))
+	if err != nil {
+		t.Fatalf("sqlmock: %v", err)
+	}
+	defer database.Close()
+
+	// No set_config: lock_timeout stays at its default, which waits forever.
+	mock.ExpectBegin()
+	mock.ExpectExec(`SELECT pg_advisory_xact_lock\(\$1\)`).WillReturnError(errors.New("connection reset"))
+	mock.ExpectRollback()
+
+	_, err = AcquirePathLock(context.Background(), database, "Brain", "photos", PathLockOptions{})
+	var locked *PathLockedError
+	if err == nil || errors.As(err, &locked) || !strings.Contains(err.Error(), "error locking photos on Brain") {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatalf("unmet expectations: %v", err)
+	}
+}
+
+func TestPathLockReleasesAfterRunIsCancelled(t *testing.T) {
+	database, mock, err := sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherRegexp))
+	if err != nil {
+		t.Fatalf("sqlmock: %v", err)
+	}
+	defer database.Close()
+
+	path := LockedPath{HostName: "Brain", FriendlyPath: "photos"}
+	mock.ExpectBegin()
+	mock.ExpectExec(`SELECT pg_advisory_xact_lock\(\$1\)`).WithArgs(path.key()).WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec(`INSERT INTO path_locks`).WillReturnResult(sqlmock.NewResult(0, 1))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	lock, err := AcquirePathLock(ctx, database, path.HostName, path.FriendlyPath, PathLockOptions{Command: "files mirror photos"})
+	if err != nil {
+		t.Fatalf("AcquirePathLock: %v", err)
+	}
+	// ctrl-C: the run's context ends while it still holds the lock
+	cancel()
+	time.Sleep(10 * time.Millisecond)
+
+	mock.ExpectExec(`DELETE FROM path_locks WHERE lock_key = ANY\(\$1\)`).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+	if err := lock.Release(); err != nil {
+		t.Fatalf("Release after cancel: %v", err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatalf("unmet expectations: %v", err)
+	}
+}
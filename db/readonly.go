@@ -0,0 +1,179 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// ErrReadOnly is returned for any statement refused by a read-only connection.
+var ErrReadOnly = errors.New("database opened in read-only mode (--read-only / DEDUPE_READ_ONLY)")
+
+var (
+	readOnlyLeadingKeywords = map[string]bool{"SELECT": true, "WITH": true, "SHOW": true, "VALUES": true, "TABLE": true}
+	// writeKeywordRe catches data-modifying CTEs, SELECT ... INTO and row locks.
+	writeKeywordRe = regexp.MustCompile(`(?i)\b(INSERT|UPDATE|DELETE|MERGE|TRUNCATE|INTO|COPY|CREATE|DROP|ALTER|GRANT|LOCK)\b`)
+)
+
+// IsReadOnlyQuery reports whether query only reads data. The check is
+// deliberately conservative: anything that is not a plain SELECT/WITH/SHOW/
+// VALUES/TABLE statement, or that mentions a data-modifying keyword, is
+// treated as a write.
+func IsReadOnlyQuery(query string) bool {
+	q := stripLeadingSQLComments(query)
+	q = strings.TrimLeft(q, "( \t\r\n")
+	end := strings.IndexFunc(q, func(r rune) bool {
+		return !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z')
+	})
+	if end < 0 {
+		end = len(q)
+	}
+	if !readOnlyLeadingKeywords[strings.ToUpper(q[:end])] {
+		return false
+	}
+	return !writeKeywordRe.MatchString(q)
+}
+
+func stripLeadingSQLComments(query string) string {
+	q := strings.TrimSpace(query)
+	for {
+		switch {
+		case strings.HasPrefix(q, "--"):
+			nl := strings.IndexByte(q, '\n')
+			if nl < 0 {
+				return ""
+			}
+			q = strings.TrimSpace(q[nl+1:])
+		case strings.HasPrefix(q, "/*"):
+			end := strings.Index(q, "*/")
+			if end < 0 {
+				return ""
+			}
+			q = strings.TrimSpace(q[end+2:])
+		default:
+			return q
+		}
+	}
+}
+
+func readOnlyError(query string) error {
+	stmt := strings.Join(strings.Fields(stripLeadingSQLComments(query)), " ")
+	if len(stmt) > 60 {
+		stmt = stmt[:60] + "..."
+	}
+	return fmt.Errorf("%w: refusing to run %q", ErrReadOnly, stmt)
+}
+
+// ConnectReadOnly is like Connect but returns a handle that refuses writes.
+// The session is also opened with default_transaction_read_only so the server
+// rejects anything the client-side check lets through.
+func ConnectReadOnly(host, port, user, password, dbname string, statementTimeout time.Duration) (*sql.DB, error) {
+	connStr := fmt.Sprintf("host=%s port=%s user=%s dbname=%s sslmode=disable default_transaction_read_only=on",
+		host, port, user, dbname)
+	if password != "" {
+		connStr += fmt.Sprintf(" password=%s", password)
+	}
+
+	return sql.OpenDB(readOnlyConnector{base: sessionConnector{driver: &pq.Driver{}, dsn: connStr, statementTimeout: statementTimeout}}), nil
+}
+
+// OpenReadOnly opens dsn with drv behind a guard that lets queries through
+// but fails Exec, Begin and the preparation of any statement that writes.
+func OpenReadOnly(drv driver.Driver, dsn string) *sql.DB {
+	return sql.OpenDB(readOnlyConnector{base: sessionConnector{driver: drv, dsn: dsn}})
+}
+
+// readOnlyConnector guards the connections of base; session settings such as
+// the statement timeout are applied before the guard is in place.
+type readOnlyConnector struct {
+	base sessionConnector
+}
+
+func (c readOnlyConnector) Connect(ctx context.Context) (driver.Conn, error) {
+	conn, err := c.base.Connect(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return &readOnlyConn{Conn: conn}, nil
+}
+
+func (c readOnlyConnector) Driver() driver.Driver {
+	return c.base.Driver()
+}
+
+// readOnlyConn wraps a driver connection. Only the optional interfaces that
+// are safe for reads are forwarded; everything else falls back to Prepare,
+// which is guarded as well.
+type readOnlyConn struct {
+	driver.Conn
+}
+
+func (c *readOnlyConn) Prepare(query string) (driver.Stmt, error) {
+	return c.PrepareContext(context.Background(), query)
+}
+
+func (c *readOnlyConn) PrepareContext(ctx context.Context, query string) (driver.Stmt, error) {
+	if !IsReadOnlyQuery(query) {
+		return nil, readOnlyError(query)
+	}
+	if p, ok := c.Conn.(driver.ConnPrepareContext); ok {
+		return p.PrepareContext(ctx, query)
+	}
+	return c.Conn.Prepare(query)
+}
+
+func (c *readOnlyConn) Begin() (driver.Tx, error) {
+	return nil, fmt.Errorf("%w: transactions are not allowed", ErrReadOnly)
+}
+
+func (c *readOnlyConn) BeginTx(ctx context.Context, opts driver.TxOptions) (driver.Tx, error) {
+	return c.Begin()
+}
+
+func (c *readOnlyConn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	if !IsReadOnlyQuery(query) {
+		return nil, readOnlyError(query)
+	}
+	if q, ok := c.Conn.(driver.QueryerContext); ok {
+		return q.QueryContext(ctx, query, args)
+	}
+	return nil, driver.ErrSkip
+}
+
+func (c *readOnlyConn) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	if !IsReadOnlyQuery(query) {
+		return nil, readOnlyError(query)
+	}
+	if e, ok := c.Conn.(driver.ExecerContext); ok {
+		return e.ExecContext(ctx, query, args)
+	}
+	return nil, driver.ErrSkip
+}
+
+func (c *readOnlyConn) CheckNamedValue(nv *driver.NamedValue) error {
+	if checker, ok := c.Conn.(driver.NamedValueChecker); ok {
+		return checker.CheckNamedValue(nv)
+	}
+	return driver.ErrSkip
+}
+
+func (c *readOnlyConn) Ping(ctx context.Context) error {
+	if p, ok := c.Conn.(driver.Pinger); ok {
+		return p.Ping(ctx)
+	}
+	return nil
+}
+
+func (c *readOnlyConn) ResetSession(ctx context.Context) error {
+	if r, ok := c.Conn.(driver.SessionResetter); ok {
+		return r.ResetSession(ctx)
+	}
+	return nil
+}
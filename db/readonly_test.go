@@ -0,0 +1,70 @@
+package db
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+func TestIsReadOnlyQuery(t *testing.T) {
+	cases := map[string]bool{
+		"SELECT id FROM files WHERE hostname = $1":                                  true,
+		"\n\t\tselect name from hosts":                                              true,
+		"-- count\nSELECT COUNT(*) FROM files":                                      true,
+		"WITH sizes AS (SELECT size FROM files) SELECT * FROM sizes":                true,
+		"SELECT updated_at, deleted_flag FROM files":                                true,
+		"SHOW server_version":                                                       true,
+		"INSERT INTO files (path) VALUES ($1)":                                      false,
+		"UPDATE files SET hash = $1":                                                false,
+		"/* batch */ DELETE FROM files WHERE id = ANY($1)":                          false,
+		"WITH cleared AS (DELETE FROM file_errors WHERE file_id = $2) UPDATE files": false,
+		"SELECT * INTO files_copy FROM files":                                       false,
+		"SELECT id FROM files FOR UPDATE":                                           false,
+		"SET default_transaction_read_only = off":                                   false,
+		"ANALYZE files": false,
+		"":              false,
+	}
+	for query, want := range cases {
+		if got := IsReadOnlyQuery(query); got != want {
+			t.Errorf("IsReadOnlyQuery(%q) = %v, want %v", query, got, want)
+		}
+	}
+}
+
+func TestOpenReadOnlyAllowsQueriesAndRefusesWrites(t *testing.T) {
+	mockDB, mock, err := sqlmock.NewWithDSN("readonly_guard")
+	if err != nil {
+		t.Fatalf("sqlmock: %v", err)
+	}
+	defer mockDB.Close()
+
+	ro := OpenReadOnly(mockDB.Driver(), "readonly_guard")
+	defer ro.Close()
+
+	mock.ExpectQuery("SELECT name FROM hosts").
+		WithArgs("backup1.local").
+		WillReturnRows(sqlmock.NewRows([]string{"name"}).AddRow("Backup1"))
+
+	var name string
+	if err := ro.QueryRow("SELECT name FROM hosts WHERE hostname = $1", "backup1.local").Scan(&name); err != nil || name != "Backup1" {
+		t.Fatalf("expected read through the guard, got %q (%v)", name, err)
+	}
+
+	if _, err := ro.Exec("DELETE FROM files WHERE id = $1", 1); !errors.Is(err, ErrReadOnly) {
+		t.Fatalf("expected ErrReadOnly from Exec, got %v", err)
+	}
+	if err := ro.QueryRow("INSERT INTO hosts (name) VALUES ($1) RETURNING id", "x").Scan(new(int)); !errors.Is(err, ErrReadOnly) {
+		t.Fatalf("expected ErrReadOnly from INSERT ... RETURNING, got %v", err)
+	}
+	if _, err := ro.Prepare("UPDATE files SET hash = $1 WHERE id = $2"); !errors.Is(err, ErrReadOnly) {
+		t.Fatalf("expected ErrReadOnly from Prepare, got %v", err)
+	}
+	if _, err := ro.Begin(); !errors.Is(err, ErrReadOnly) {
+		t.Fatalf("expected ErrReadOnly from Begin, got %v", err)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatalf("unmet expectations: %v", err)
+	}
+}
@@ -0,0 +1,61 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"fmt"
+	"time"
+)
+
+// statementTimeoutSQL is run on every new connection of a handle opened with
+// a statement timeout.
+func statementTimeoutSQL(timeout time.Duration) string {
+	return fmt.Sprintf("SET statement_timeout = %d", timeout.Milliseconds())
+}
+
+// Open opens dsn with drv. With a positive statementTimeout, every pooled
+// connection runs SET statement_timeout as it is opened, so plain queries and
+// the transactions of the files package are bounded alike. Zero leaves the
+// server default (usually unlimited).
+func Open(drv driver.Driver, dsn string, statementTimeout time.Duration) *sql.DB {
+	return sql.OpenDB(sessionConnector{driver: drv, dsn: dsn, statementTimeout: statementTimeout})
+}
+
+// sessionConnector opens driver connections and applies per-session settings.
+type sessionConnector struct {
+	driver           driver.Driver
+	dsn              string
+	statementTimeout time.Duration
+}
+
+func (c sessionConnector) Connect(ctx context.Context) (driver.Conn, error) {
+	conn, err := c.driver.Open(c.dsn)
+	if err != nil {
+		return nil, err
+	}
+	if c.statementTimeout <= 0 {
+		return conn, nil
+	}
+
+	query := statementTimeoutSQL(c.statementTimeout)
+	var execErr error
+	if e, ok := conn.(driver.ExecerContext); ok {
+		_, execErr = e.ExecContext(ctx, query, nil)
+	} else {
+		var stmt driver.Stmt
+		if stmt, execErr = conn.Prepare(query); execErr == nil {
+			_, execErr = stmt.Exec(nil)
+			stmt.Close()
+		}
+	}
+	if execErr != nil {
+		conn.Close()
+		return nil, fmt.Errorf("error setting statement_timeout: %v", execErr)
+	}
+	return conn, nil
+}
+
+func (c sessionConnector) Driver() driver.Driver {
+	return c.driver
+}
@@ -0,0 +1,52 @@
+package db
+
+import (
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+func TestOpenSetsStatementTimeoutOnEachConnection(t *testing.T) {
+	mockDB, mock, err := sqlmock.NewWithDSN("statement_timeout")
+	if err != nil {
+		t.Fatalf("sqlmock: %v", err)
+	}
+	defer mockDB.Close()
+
+	conn := Open(mockDB.Driver(), "statement_timeout", 30*time.Second)
+	defer conn.Close()
+
+	mock.ExpectExec(`SET statement_timeout = 30000`).WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectQuery("SELECT 1").WillReturnRows(sqlmock.NewRows([]string{"n"}).AddRow(1))
+
+	var n int
+	if err := conn.QueryRow("SELECT 1").Scan(&n); err != nil {
+		t.Fatalf("query: %v", err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatalf("unmet expectations: %v", err)
+	}
+}
+
+func TestOpenWithoutTimeoutIssuesNoSet(t *testing.T) {
+	mockDB, mock, err := sqlmock.NewWithDSN("no_statement_timeout")
+	if err != nil {
+		t.Fatalf("sqlmock: %v", err)
+	}
+	defer mockDB.Close()
+
+	conn := Open(mockDB.Driver(), "no_statement_timeout", 0)
+	defer conn.Close()
+
+	// Any SET would be an unexpected call and fail the query.
+	mock.ExpectQuery("SELECT 1").WillReturnRows(sqlmock.NewRows([]string{"n"}).AddRow(1))
+
+	var n int
+	if err := conn.QueryRow("SELECT 1").Scan(&n); err != nil {
+		t.Fatalf("query: %v", err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatalf("unmet expectations: %v", err)
+	}
+}
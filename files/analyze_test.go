@@ -0,0 +1,29 @@
+package files
+
+import (
+	"context"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+func TestAnalyzeFilesRunsAnalyzeAndReadsIndexUsage(t *testing.T) {
+	db, mock, err := sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherRegexp))
+	if err != nil {
+		t.Fatalf("sqlmock: %v", err)
+	}
+	defer db.Close()
+
+	mock.ExpectExec(`ANALYZE files`).WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectQuery(`(?s)SELECT indexrelname, idx_scan, idx_tup_read, idx_tup_fetch.*FROM pg_stat_user_indexes\s+WHERE relname = 'files'`).
+		WillReturnRows(sqlmock.NewRows([]string{"indexrelname", "idx_scan", "idx_tup_read", "idx_tup_fetch", "size"}).
+			AddRow("idx_files_hostname_hash", int64(12), int64(340), int64(300), "8192 bytes").
+			AddRow("idx_files_hash", int64(0), int64(0), int64(0), "8192 bytes"))
+
+	if err := AnalyzeFiles(context.Background(), db); err != nil {
+		t.Fatalf("AnalyzeFiles error: %v", err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatalf("unmet expectations: %v", err)
+	}
+}
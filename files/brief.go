@@ -0,0 +1,101 @@
+package files
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// briefEscaper escapes the characters that separate fields and paths in the
+// brief format: a backslash, pipe, tab or newline in a path is written as
+// \\, \|, \t or \n.
+var briefEscaper = strings.NewReplacer(`\`, `\\`, `|`, `\|`, "\t", `\t`, "\n", `\n`)
+
+// fullPath returns the absolute path of the i-th file of the group: its
+// root_folder joined with its path, or the path itself for legacy rows.
+func (g DuplicateGroup) fullPath(i int) string {
+	root := g.rootFolder(i)
+	if root == "" || filepath.IsAbs(g.Files[i]) {
+		return g.Files[i]
+	}
+	return filepath.Join(root, g.Files[i])
+}
+
+// RenderBriefGroups writes one line per group for scripts:
+//
+//	<hash>\t<size>\t<copies>\t<savings>\t<path1>|<path2>|...
+//
+// Sizes are plain byte counts and paths are absolute, escaped with
+// briefEscaper. There are no colours, headers or summary.
+func RenderBriefGroups(w io.Writer, groups []DuplicateGroup) error {
+	for _, group := range groups {
+		paths := make([]string, len(group.Files))
+		for i := range group.Files {
+			paths[i] = briefEscaper.Replace(group.fullPath(i))
+		}
+		savings := group.Size * int64(len(group.Files)-1)
+		if _, err := fmt.Fprintf(w, "%s\t%d\t%d\t%d\t%s\n",
+			group.Hash, group.Size, len(group.Files), savings, strings.Join(paths, "|")); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// RenderBriefSummary writes the totals of groups on one line, for
+// --format brief --summary.
+func RenderBriefSummary(w io.Writer, groups []DuplicateGroup) error {
+	var copies int
+	var savings int64
+	for _, group := range groups {
+		copies += len(group.Files)
+		savings += group.Size * int64(len(group.Files)-1)
+	}
+	_, err := fmt.Fprintf(w, "total\t%d groups\t%d copies\t%d bytes\n", len(groups), copies, savings)
+	return err
+}
+
+// RenderPrint0Paths writes the full path of every copy of groups except the
+// keeper picked by the dedupe flow, each followed by a NUL byte, for xargs -0.
+// Copies that no longer exist are left out.
+func RenderPrint0Paths(w io.Writer, groups []DuplicateGroup) error {
+	for _, group := range groups {
+		if len(group.Files) < 2 {
+			continue
+		}
+		copies := rankDedupeCopies(group, group.fullPath, KeepPolicy{}, nil)
+		for _, c := range copies[:len(copies)-1] {
+			if _, err := os.Stat(c.fullPath); err != nil {
+				log.Printf("Warning: Source file does not exist: %s", c.fullPath)
+				continue
+			}
+			if _, err := io.WriteString(w, c.fullPath+"\x00"); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// printDuplicatePaths is list-dupes --print0-paths: the copies the dedupe
+// flow would move from this host, without moving them.
+func printDuplicatePaths(ctx context.Context, db *sql.DB, opts DuplicateListOptions) error {
+	hostname, err := os.Hostname()
+	if err != nil {
+		return fmt.Errorf("error getting hostname: %v", err)
+	}
+	_, rootFolder, err := resolveDuplicateScope(db, opts.Path)
+	if err != nil {
+		return err
+	}
+	groups, err := FindDuplicateGroups(ctx, db, strings.ToLower(hostname), rootFolder, opts.sizeRules(), opts.Sort, opts.Count, opts.Exclude)
+	if err != nil {
+		return err
+	}
+	return RenderPrint0Paths(os.Stdout, groups)
+}
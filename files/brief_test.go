@@ -0,0 +1,93 @@
+package files
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+var briefGroups = []DuplicateGroup{
+	{
+		Hash:        "aaaa",
+		Size:        1000,
+		Files:       []string{"2021/img.jpg", "backup/img.jpg", "/legacy/img.jpg"},
+		Hosts:       []string{"brain", "brain", "pinky"},
+		RootFolders: []string{"/data/photos", "/data/photos", ""},
+	},
+	{
+		Hash:        "bbbb",
+		Size:        20,
+		Files:       []string{"a|b.txt", `tab	and\slash.txt`},
+		Hosts:       []string{"brain", "brain"},
+		RootFolders: []string{"/data/docs", "/data/docs"},
+	},
+}
+
+func TestRenderBriefGroupsGolden(t *testing.T) {
+	var out bytes.Buffer
+	if err := RenderBriefGroups(&out, briefGroups); err != nil {
+		t.Fatalf("RenderBriefGroups: %v", err)
+	}
+	const golden = "aaaa\t1000\t3\t2000\t/data/photos/2021/img.jpg|/data/photos/backup/img.jpg|/legacy/img.jpg\n" +
+		"bbbb\t20\t2\t20\t/data/docs/a\\|b.txt|/data/docs/tab\\tand\\\\slash.txt\n"
+	if out.String() != golden {
+		t.Fatalf("brief output mismatch\n got: %q\nwant: %q", out.String(), golden)
+	}
+
+	// Each line splits into exactly five fields, and an escaped pipe does
+	// not split a path.
+	for _, line := range strings.Split(strings.TrimSuffix(out.String(), "\n"), "\n") {
+		if fields := strings.Split(line, "\t"); len(fields) != 5 {
+			t.Fatalf("line %q has %d fields", line, len(fields))
+		}
+	}
+}
+
+func TestRenderBriefSummary(t *testing.T) {
+	var out bytes.Buffer
+	if err := RenderBriefSummary(&out, briefGroups); err != nil {
+		t.Fatalf("RenderBriefSummary: %v", err)
+	}
+	if out.String() != "total\t2 groups\t5 copies\t2020 bytes\n" {
+		t.Fatalf("unexpected summary %q", out.String())
+	}
+}
+
+func TestRenderPrint0PathsSkipsKeeper(t *testing.T) {
+	root := t.TempDir()
+	write := func(rel string) {
+		path := filepath.Join(root, rel)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatalf("mkdir: %v", err)
+		}
+		if err := os.WriteFile(path, []byte(rel), 0644); err != nil {
+			t.Fatalf("write: %v", err)
+		}
+	}
+	// The album holds three files, so its copy is the keeper; the stray
+	// copies sit alone in Downloads and in a directory with a pipe.
+	write("album/x.jpg")
+	write("album/y.jpg")
+	write("album/z.jpg")
+	write("Downloads/x.jpg")
+	write("odd|dir/x.jpg")
+
+	groups := []DuplicateGroup{{
+		Hash:        "cccc",
+		Size:        5,
+		Files:       []string{"Downloads/x.jpg", "album/x.jpg", "odd|dir/x.jpg", "gone/x.jpg"},
+		Hosts:       []string{"brain", "brain", "brain", "brain"},
+		RootFolders: []string{root, root, root, root},
+	}}
+
+	var out bytes.Buffer
+	if err := RenderPrint0Paths(&out, groups); err != nil {
+		t.Fatalf("RenderPrint0Paths: %v", err)
+	}
+	golden := filepath.Join(root, "Downloads/x.jpg") + "\x00" + filepath.Join(root, "odd|dir/x.jpg") + "\x00"
+	if out.String() != golden {
+		t.Fatalf("print0 output mismatch\n got: %q\nwant: %q", out.String(), golden)
+	}
+}
@@ -0,0 +1,70 @@
+package files
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+)
+
+// copyVerification re-hashes the copies --verify checks right before they are
+// moved or deleted, and counts the outcome for the summary.
+type copyVerification struct {
+	verified int64 // copies that still match the catalog
+	failed   int64 // copies skipped: different content, or not hashable
+}
+
+// check reports whether the copy at fullPath, the row (path, host), still
+// hashes to hash with the algorithm recorded for the row. A copy that does not
+// is logged and counted, never returned as an error, so one stale row cannot
+// abort the run.
+func (v *copyVerification) check(db *sql.DB, path, host, fullPath, hash string) bool {
+	err := verifyRowHash(db, path, host, fullPath, hash)
+	if err != nil {
+		log.Printf("Warning: Skipping %s: it %v", fullPath, err)
+		fmt.Printf("  Skipped: %s %v\n", fullPath, err)
+		v.failed++
+		return false
+	}
+	v.verified++
+	return true
+}
+
+// print adds the counts to the summary of a run that verified copies.
+func (v *copyVerification) print() {
+	fmt.Printf("Verified %d copies before acting on them", v.verified)
+	if v.failed > 0 {
+		fmt.Printf("; skipped %d that no longer match the catalog", v.failed)
+	}
+	fmt.Println()
+}
+
+// record adds the counts to the run summary.
+func (v *copyVerification) record(stats *RunStats) {
+	stats.Set("verified", v.verified)
+	stats.Set("verify_failed", v.failed)
+}
+
+// verifyRowHash re-hashes the file at fullPath with the algorithm recorded for
+// the row (path, host) and returns an error unless it hashes to hash. Errors
+// read as a statement about the file, to follow its path.
+func verifyRowHash(db *sql.DB, path, host, fullPath, hash string) error {
+	var recorded string
+	if err := db.QueryRow(`
+		SELECT hash_algo FROM files
+		WHERE path = $1 AND hostname = $2 AND deleted_at IS NULL
+	`, path, host).Scan(&recorded); err != nil {
+		return fmt.Errorf("has no hash algorithm on record: %v", err)
+	}
+	algo, err := ParseHashAlgo(recorded)
+	if err != nil {
+		return fmt.Errorf("has an unusable hash algorithm: %v", err)
+	}
+	sum, err := fileHasher(algo)(fullPath)
+	if err != nil {
+		return fmt.Errorf("cannot be hashed: %v", err)
+	}
+	if sum != hash {
+		return fmt.Errorf("hashes to %s, expected %s", sum, hash)
+	}
+	return nil
+}
@@ -0,0 +1,130 @@
+package files
+
+import (
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+func TestDedupFilesVerifySkipsCopiesEditedSinceHashing(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("sqlmock: %v", err)
+	}
+	defer db.Close()
+
+	root := t.TempDir()
+	dest := filepath.Join(root, "dest")
+	// keep/ holds more files, so its copies are kept. move/a.txt was edited
+	// after it was hashed, keeping its size.
+	writeFiles(t, root, "one", "keep/a.txt", "keep/other.txt")
+	writeFiles(t, root, "on3", "move/a.txt")
+	writeFiles(t, root, "two", "keep/b.txt", "move/b.txt")
+	one := fmt.Sprintf("%x", sha256.Sum256([]byte("one")))
+	two := fmt.Sprintf("%x", sha256.Sum256([]byte("two")))
+
+	expectDedupeQueries(mock, root, sqlmock.NewRows([]string{"hash", "path", "hostname", "size", "root_folder"}).
+		AddRow(one, "move/a.txt", "host-a", int64(3), "").
+		AddRow(one, "keep/a.txt", "host-a", int64(3), "").
+		AddRow(two, "move/b.txt", "host-a", int64(3), "").
+		AddRow(two, "keep/b.txt", "host-a", int64(3), ""))
+	mock.ExpectQuery("SELECT hash_algo FROM files").
+		WithArgs("move/a.txt", "host-a").
+		WillReturnRows(sqlmock.NewRows([]string{"hash_algo"}).AddRow(HashAlgoSHA256))
+	mock.ExpectQuery("SELECT hash_algo FROM files").
+		WithArgs("move/b.txt", "host-a").
+		WillReturnRows(sqlmock.NewRows([]string{"hash_algo"}).AddRow(HashAlgoSHA256))
+	mock.ExpectExec("UPDATE files SET deleted_at = NOW\\(\\)").
+		WithArgs("move/b.txt", "host-a").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+
+	stats := &RunStats{}
+	out := captureStdout(t, func() {
+		err = DedupFiles(context.Background(), db, DedupeOptions{
+			DestDir: dest,
+			Verify:  true,
+			Stats:   stats,
+		})
+	})
+	if err != nil {
+		t.Fatalf("DedupFiles: %v", err)
+	}
+
+	assertExists(t, filepath.Join(root, "move/a.txt"), true)
+	assertExists(t, filepath.Join(dest, "move/a.txt"), false)
+	assertExists(t, filepath.Join(root, "move/b.txt"), false)
+	assertExists(t, filepath.Join(dest, "move/b.txt"), true)
+	for _, want := range []string{
+		"Skipped: " + filepath.Join(root, "move/a.txt") + " hashes to",
+		"Verified 1 copies before acting on them; skipped 1 that no longer match the catalog",
+	} {
+		if !strings.Contains(out, want) {
+			t.Fatalf("output does not contain %q:\n%s", want, out)
+		}
+	}
+	if counters := stats.Counters(); counters["verified"] != 1 || counters["verify_failed"] != 1 {
+		t.Fatalf("unexpected counters %v", counters)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatalf("unmet expectations: %v", err)
+	}
+}
+
+func TestDedupFilesDeleteVerifyKeepsCopiesThatCannotBeChecked(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("sqlmock: %v", err)
+	}
+	defer db.Close()
+
+	root := t.TempDir()
+	writeFiles(t, root, "filler", "album/cover.jpg")
+	writeFiles(t, root, "same", "album/img.jpg", "downloads/img.jpg", "inbox/img.jpg")
+	hash := fmt.Sprintf("%x", sha256.Sum256([]byte("same")))
+
+	expectDedupeQueries(mock, root, sqlmock.NewRows([]string{"hash", "path", "hostname", "size", "root_folder"}).
+		AddRow(hash, "downloads/img.jpg", "host-a", int64(4), "").
+		AddRow(hash, "inbox/img.jpg", "host-a", int64(4), "").
+		AddRow(hash, "album/img.jpg", "host-a", int64(4), ""))
+	mock.ExpectQuery("SELECT hash_algo FROM files").
+		WithArgs("album/img.jpg", "host-a").
+		WillReturnRows(sqlmock.NewRows([]string{"hash_algo"}).AddRow(HashAlgoSHA256))
+	// The row of the downloads copy has gone since the listing
+	mock.ExpectQuery("SELECT hash_algo FROM files").
+		WithArgs("downloads/img.jpg", "host-a").
+		WillReturnRows(sqlmock.NewRows([]string{"hash_algo"}))
+	mock.ExpectQuery("SELECT hash_algo FROM files").
+		WithArgs("inbox/img.jpg", "host-a").
+		WillReturnRows(sqlmock.NewRows([]string{"hash_algo"}).AddRow(HashAlgoSHA256))
+	mock.ExpectExec("UPDATE files SET deleted_at = NOW\\(\\)").
+		WithArgs("inbox/img.jpg", "host-a").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+
+	out := captureStdout(t, func() {
+		err = DedupFiles(context.Background(), db, DedupeOptions{
+			Delete:       true,
+			Verify:       true,
+			DeleteReport: filepath.Join(t.TempDir(), "deletions.tsv"),
+		})
+	})
+	if err != nil {
+		t.Fatalf("DedupFiles: %v", err)
+	}
+
+	assertExists(t, filepath.Join(root, "album/img.jpg"), true)
+	assertExists(t, filepath.Join(root, "downloads/img.jpg"), true)
+	assertExists(t, filepath.Join(root, "inbox/img.jpg"), false)
+	for _, want := range []string{"has no hash algorithm on record", "skipped 1 that no longer match the catalog"} {
+		if !strings.Contains(out, want) {
+			t.Fatalf("output does not contain %q:\n%s", want, out)
+		}
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatalf("unmet expectations: %v", err)
+	}
+}
@@ -6,29 +6,53 @@ import (
 	"fmt"
 	"log"
 	"os"
-	"os/exec"
 	"path/filepath"
-	"sort"
 	"strings"
+	"time"
 )
 
-// DedupFiles deduplicates files by moving them to a destination directory
+// DedupFiles deduplicates files by moving them to a destination directory,
+// or with opts.Delete by deleting all but the kept copies
 func DedupFiles(ctx context.Context, db *sql.DB, opts DedupeOptions) error {
 	// Check if the destination directory is valid
-	if opts.DestDir == "" {
+	if opts.Delete {
+		if opts.DestDir != "" {
+			return fmt.Errorf("duplicates are either deleted or moved to a destination, not both")
+		}
+		if opts.Symlink {
+			return fmt.Errorf("--symlink replaces moved copies with links and cannot be used with --delete")
+		}
+		if opts.Interactive {
+			return fmt.Errorf("--interactive only asks before moves, not with --delete")
+		}
+	} else if opts.DestDir == "" {
 		return fmt.Errorf("destination directory cannot be empty")
 	}
 
-	// Check if the parent directory exists
-	parentDir := filepath.Dir(opts.DestDir)
-	if _, err := os.Stat(parentDir); os.IsNotExist(err) {
-		return fmt.Errorf("parent directory %s does not exist, please create it first", parentDir)
+	// The host row is found by hostname: its friendly name need not match
+	host, err := localHostRow(db)
+	if err != nil {
+		return err
+	}
+	// With --path, only the files under that friendly path are considered
+	var rootFolder string
+	if opts.Path != "" {
+		if rootFolder, err = friendlyRootFolder(host, opts.Path); err != nil {
+			return err
+		}
+	}
+
+	// Rows that cannot be updated after their file moved are counted
+	var rowErrors rowErrorCount
+	rows := dedupeJournalRows(db, &rowErrors)
+	if !opts.Delete && !opts.DryRun {
+		defer rowErrors.record(opts.Stats)
 	}
 
-	// Ensure destination directory exists
-	if !opts.DryRun {
-		if err := os.MkdirAll(opts.DestDir, 0755); err != nil {
-			return fmt.Errorf("error creating destination directory: %v", err)
+	var dest moveDestination
+	if !opts.Delete {
+		if dest, err = prepareDedupeDestination(db, opts, rows); err != nil {
+			return err
 		}
 	}
 
@@ -41,36 +65,91 @@ func DedupFiles(ctx context.Context, db *sql.DB, opts DedupeOptions) error {
 	// Convert hostname to lowercase for consistency
 	hostname = strings.ToLower(hostname)
 
-	// Find duplicate groups
-	groups, err := FindDuplicateGroups(ctx, db, hostname, opts.MinSize, opts.Count)
+	// Count the groups the size rules leave out, for the summary
+	sizeFiltered, err := countSizeFilteredGroups(ctx, db, hostname, rootFolder, opts.sizeRules())
 	if err != nil {
 		return err
 	}
+	if sizeFiltered > 0 {
+		opts.Stats.Set("size_filtered", sizeFiltered)
+	}
 
-	// Get root path for current host
-	var rootPath string
-	err = db.QueryRow(`
-		SELECT root_path 
-		FROM hosts 
-		WHERE LOWER(name) = LOWER($1)
-	`, hostname).Scan(&rootPath)
+	// Stream duplicate groups: each one is deduplicated as soon as its
+	// rows have been read, so the first is acted on without waiting for
+	// the whole result.
+	groups, err := openDuplicateGroups(ctx, db, hostname, rootFolder, opts.sizeRules(), SortBySize, opts.Count, opts.Exclude)
 	if err != nil {
-		return fmt.Errorf("error getting root path: %v", err)
+		return err
 	}
+	defer groups.Close()
+
+	// Files are found under their own root_folder; the deprecated root_path
+	// of the host only serves rows without one that store a relative path
+	legacyRoot := host.RootPath
 
 	// Process duplicate groups
 	var totalGroups, totalFiles int
 	var totalSavings int64
 
-	if len(groups) == 0 {
+	if !groups.Next() {
+		if err := groups.Err(); err != nil {
+			return err
+		}
 		fmt.Println("No duplicates found")
+		printSizeFiltered(sizeFiltered)
 		return nil
 	}
 
-	fmt.Printf("Found %d groups of duplicate files:\n\n", len(groups))
-	for _, group := range groups {
+	var xattrWhitelist []string
+	if opts.MergeXattrs && !opts.DryRun {
+		xattrWhitelist = xattrWhitelistFor(db, hostname)
+	}
+
+	var report *deletionReport
+	var tally deletionTally
+	if opts.Delete && !opts.DryRun {
+		if opts.DeleteReport == "" {
+			if opts.DeleteReport, err = DefaultDeleteReportPath(time.Now()); err != nil {
+				return err
+			}
+		}
+		if report, err = openDeletionReport(opts.DeleteReport); err != nil {
+			return err
+		}
+		defer report.Close()
+		fmt.Printf("Recording deletions in %s\n", report.path)
+	}
+
+	// With --verify each copy is re-hashed right before it is moved or deleted
+	var verification copyVerification
+	if opts.Verify && !opts.DryRun {
+		defer verification.record(opts.Stats)
+	}
+
+	var approver *groupApprover
+	if opts.Interactive {
+		var closeTerminal func()
+		if approver, closeTerminal, err = newGroupApprover(opts.terminal); err != nil {
+			return err
+		}
+		defer closeTerminal()
+		defer approver.record(opts.Stats)
+	}
+
+	var compliant int
+	var movedFiles, failedMoves int64
+	budget := byteCap{}
+	if !opts.Delete {
+		budget.max = opts.MaxBytes
+	}
+	names := NewPathNameCache(db)
+	dest.announce()
+	fmt.Print("Duplicate groups, largest first:\n\n")
+	for more := true; more; more = groups.Next() {
+		group := groups.Group()
+
 		// Skip if any file is in destination directory
-		if opts.IgnoreDestDir {
+		if opts.IgnoreDestDir && !opts.Delete && dest.Remote == "" {
 			inDest := false
 			for _, path := range group.Files {
 				if strings.HasPrefix(path, opts.DestDir) {
@@ -83,110 +162,230 @@ func DedupFiles(ctx context.Context, db *sql.DB, opts DedupeOptions) error {
 			}
 		}
 
+		// With MinCopies, a group already down to that many copies is left alone
+		if len(group.Files) <= opts.keptCopies() {
+			fmt.Printf("\033[33mHash: %s\033[0m\nAlready compliant: %d copies, keeping %d\n\n", group.Hash, len(group.Files), opts.keptCopies())
+			compliant++
+			continue
+		}
+
+		// Past --max-bytes, the rest of the groups are only counted
+		savings := group.Size * int64(max(len(group.Files)-opts.keptCopies(), 0))
+		if budget.full() {
+			budget.leave(savings)
+			continue
+		}
+
 		// Print duplicate group with colors
 		fmt.Printf("\033[33mHash: %s\033[0m\n", group.Hash)
 		fmt.Printf("Size: %s bytes\n", formatBytes(group.Size))
 		fmt.Printf("Duplicates: %d files\n", len(group.Files))
 		fmt.Println("Files:")
 		for i := range group.Files {
-			fmt.Printf("\033[90m  %s (%s)\033[0m\n",
-				group.Files[i],
-				group.Hosts[i])
+			fmt.Printf("\033[90m  %s\033[0m\n", group.label(i, names))
 		}
-		savings := group.Size * int64(len(group.Files)-1)
 		fmt.Printf("Potential savings: %s bytes\n", formatBytes(savings))
-		totalSavings += savings
 		fmt.Println()
 
-		// Process the group for deduplication if not in dry run mode
-		if !opts.DryRun {
-			if err := deduplicateGroup(group, rootPath, opts, db); err != nil {
-				return fmt.Errorf("error deduplicating group with hash %s: %v", group.Hash, err)
+		// Process the group for deduplication; a dry run only plans it
+		var moved, failed int64
+		if opts.Delete {
+			err = deleteGroupSurplus(ctx, group, legacyRoot, opts, db, names, report, &tally, &verification)
+		} else {
+			approver.startGroup()
+			moved, failed, err = deduplicateGroup(ctx, group, legacyRoot, opts, dest, db, rows, names, xattrWhitelist, approver, &verification)
+			budget.moved += group.Size * moved
+			movedFiles += moved
+			failedMoves += failed
+		}
+		if err != nil {
+			return fmt.Errorf("error deduplicating group with hash %s: %v", group.Hash, err)
+		}
+		if approver != nil && approver.last != decisionKeep {
+			if approver.quit {
+				break
 			}
+			continue
 		}
 
+		// Copies that failed to move saved nothing
+		totalSavings += savings - group.Size*failed
 		totalGroups++
 		totalFiles += len(group.Files)
 	}
+	if err := groups.Err(); err != nil {
+		return err
+	}
+
+	fmt.Printf("\nProcessed %d groups of duplicate files (%d files)\n", totalGroups, totalFiles)
+	if compliant > 0 {
+		fmt.Printf("%d groups already compliant (%d copies or fewer)\n", compliant, opts.keptCopies())
+	}
+	printSizeFiltered(sizeFiltered)
+	if opts.Verify && !opts.DryRun {
+		verification.print()
+	}
+	budget.print(opts.DryRun)
+	if failedMoves > 0 {
+		fmt.Printf("Failed to move %d files; they were left in place with their rows\n", failedMoves)
+		opts.Stats.Set("move_errors", failedMoves)
+	}
+	rowErrors.print()
+	if approver != nil {
+		fmt.Printf("Approved %d groups, skipped %d\n", approver.approved, approver.skipped)
+		if approver.quit {
+			fmt.Println("Quit at the prompt; the remaining groups were left alone")
+		}
+	}
+
+	if opts.Delete {
+		verb := "Deleted"
+		if opts.DryRun {
+			verb = "Would delete"
+		}
+		fmt.Printf("\n%s %d files, freeing %s bytes\n", verb, tally.deleted, formatBytes(tally.freed))
+		if tally.refused > 0 {
+			fmt.Printf("Refused %d groups whose kept copies failed the check\n", tally.refused)
+		}
+		if opts.DryRun {
+			fmt.Println("Dry run mode - no files were deleted. Use --run with --i-understand-data-loss to delete them.")
+		} else {
+			fmt.Printf("Deletion report: %s\n", report.path)
+		}
+		return nil
+	}
 
 	if opts.DryRun {
 		fmt.Printf("\nTotal potential space savings: %s bytes\n", formatBytes(totalSavings))
 		fmt.Println("Dry run mode - no files were moved. Use --run to actually move files.")
 	} else {
 		fmt.Printf("\nTotal space saved: %s bytes\n", formatBytes(totalSavings))
+		if movedFiles > 0 {
+			printMoveManifest(dest.JournalDir)
+		}
 	}
 
 	return nil
 }
 
-// deduplicateGroup handles the deduplication of a single group of duplicate files
-func deduplicateGroup(group DuplicateGroup, rootPath string, opts DedupeOptions, db *sql.DB) error {
-	if len(group.Files) < 2 {
-		return nil // Nothing to deduplicate
+// prepareDedupeDestination resolves the destination of a moving run,
+// creates it and resolves a group left half done by an interrupted run.
+func prepareDedupeDestination(db *sql.DB, opts DedupeOptions, rows groupJournalRows) (moveDestination, error) {
+	dest, err := newMoveDestination(db, opts.DestDir)
+	if err != nil {
+		return moveDestination{}, err
 	}
 
-	// Create a slice to store files with their parent directory counts
-	type fileInfo struct {
-		path           string
-		host           string
-		parentDirCount int
+	if dest.Remote == "" {
+		// Check if the parent directory exists
+		parentDir := filepath.Dir(opts.DestDir)
+		if _, err := os.Stat(parentDir); os.IsNotExist(err) {
+			return moveDestination{}, fmt.Errorf("parent directory %s does not exist, please create it first", parentDir)
+		}
 	}
-	files := make([]fileInfo, len(group.Files))
 
-	// Count files in parent directories
-	for i, path := range group.Files {
-		// Construct full path by joining root path and relative path
-		fullPath := filepath.Join(rootPath, path)
-		parentDir := filepath.Dir(fullPath)
-		entries, err := os.ReadDir(parentDir)
-		if err != nil {
-			// If directory doesn't exist, assign count of 0
-			log.Printf("Warning: Could not read directory %s: %v", parentDir, err)
-			files[i] = fileInfo{
-				path:           path,
-				host:           group.Hosts[i],
-				parentDirCount: 0,
-			}
-			continue
+	// Ensure destination (or, for a remote one, journal) directory exists
+	if !opts.DryRun {
+		if err := os.MkdirAll(dest.JournalDir, 0755); err != nil {
+			return moveDestination{}, fmt.Errorf("error creating destination directory: %v", err)
 		}
+	}
 
-		// Count only files (not directories)
-		fileCount := 0
-		for _, entry := range entries {
-			if !entry.IsDir() {
-				fileCount++
-			}
-		}
+	// Resolve a group left half done by an interrupted run first
+	if err := recoverGroupJournal(dest.JournalDir, opts.Recover, opts.DryRun, rows); err != nil {
+		return moveDestination{}, err
+	}
 
-		files[i] = fileInfo{
-			path:           path,
-			host:           group.Hosts[i],
-			parentDirCount: fileCount,
-		}
+	return dest, nil
+}
+
+// deduplicateGroup handles the deduplication of a single group of duplicate
+// files. The copies ranked first by the keep policy, opts.keptCopies() of them,
+// are kept. Whitelisted xattrs only present on a moved copy are first merged
+// onto the top keeper. In a dry run it only prints the planned moves. With approver,
+// the group is only moved once approved at the prompt. With opts.Verify, a
+// copy whose content no longer matches the catalog is left in place. It
+// returns how many copies it moved, or in a dry run would move, and how many
+// failed to move and were left in place.
+func deduplicateGroup(ctx context.Context, group DuplicateGroup, legacyRoot string, opts DedupeOptions, dest moveDestination, db *sql.DB, rows groupJournalRows, names *PathNameCache, xattrWhitelist []string, approver *groupApprover, verification *copyVerification) (moved, failed int64, err error) {
+	kept := opts.keptCopies()
+	if len(group.Files) <= kept {
+		return 0, 0, nil // Nothing to deduplicate
 	}
 
-	// Sort files by parent directory count (ascending)
-	// This puts files from least populated directories first
-	sort.Slice(files, func(i, j int) bool {
-		return files[i].parentDirCount < files[j].parentDirCount
-	})
+	keep, modTimes, err := dedupeKeepPolicy(ctx, db, group, opts.Keep)
+	if err != nil {
+		return 0, 0, err
+	}
+	files := rankDedupeCopies(group, func(i int) string {
+		return group.localPath(i, legacyRoot)
+	}, keep, modTimes)
 
-	// Keep the last file (from most populated directory) and move the rest
+	// Keep the last files (picked by the keep policy) and move the rest
+	keepers, movable := files[len(files)-kept:], files[:len(files)-kept]
 	fmt.Printf("\nHash: %s (size: %s)\n", group.Hash, formatBytes(group.Size))
-	fmt.Printf("Keeping: %s (%s) [parent dir has %d files]\n",
-		files[len(files)-1].path,
-		files[len(files)-1].host,
-		files[len(files)-1].parentDirCount)
+	for _, k := range keepers {
+		fmt.Printf("Keeping: %s [parent dir has %d files] (keep policy: %s)\n",
+			k.label(names), k.parentDirCount, keep)
+	}
 
-	// Move all files except the last one (which is from the most populated directory)
-	for i := 0; i < len(files)-1; i++ {
-		sourcePath := filepath.Join(rootPath, files[i].path)
+	// With --symlink the moved copies are replaced by links to the keeper,
+	// so a missing keeper would leave them dangling
+	keeperPath := files[len(files)-1].fullPath
+	if opts.Symlink {
+		if _, err := os.Stat(keeperPath); err != nil {
+			log.Printf("Warning: Not moving the copies of %s: kept copy %s is missing and --symlink never leaves a dangling link", group.Hash, keeperPath)
+			return 0, 0, nil
+		}
+	}
 
-		// Skip if source file doesn't exist
-		if _, err := os.Stat(sourcePath); os.IsNotExist(err) {
+	if approver != nil {
+		kept := make([]string, 0, len(keepers))
+		for _, k := range keepers {
+			kept = append(kept, k.label(names))
+		}
+		moved := make([]string, 0, len(movable))
+		for _, f := range movable {
+			moved = append(moved, f.label(names))
+		}
+		decision, err := approver.decide(ctx, group.Hash, kept, moved)
+		if err != nil {
+			return 0, 0, err
+		}
+		if decision == decisionSkip {
+			fmt.Println("Skipped at the prompt")
+		}
+		if decision != decisionKeep {
+			return 0, 0, nil
+		}
+	}
+
+	// Plan the moves of all files except the keepers, then carry them out
+	// through the journal.
+	var actions []journalAction
+	for i := range movable {
+		sourcePath := files[i].fullPath
+
+		// Skip if source file doesn't exist, or may still be written to
+		info, err := os.Stat(sourcePath)
+		if os.IsNotExist(err) {
 			log.Printf("Warning: Source file does not exist: %s", sourcePath)
 			continue
 		}
+		if err == nil {
+			if err := checkMinAge(info, opts.MinAge); err != nil {
+				log.Printf("Warning: Skipping %s: %v", sourcePath, err)
+				continue
+			}
+			// Moving a hard link of a kept copy only renames the inode
+			if sameFileAsKept(info, keepers) {
+				log.Printf("Warning: Skipping %s: it is the same file as a kept copy", sourcePath)
+				continue
+			}
+		}
+		if opts.Verify && !opts.DryRun && !verification.check(db, files[i].path, files[i].host, sourcePath, group.Hash) {
+			continue
+		}
 
 		// Create target path, applying strip prefix if specified
 		targetPath := files[i].path
@@ -195,46 +394,203 @@ func deduplicateGroup(group DuplicateGroup, rootPath string, opts DedupeOptions,
 			// Remove leading slash if present
 			targetPath = strings.TrimPrefix(targetPath, "/")
 		}
-		targetPath = filepath.Join(opts.DestDir, targetPath)
-		targetDir := filepath.Dir(targetPath)
+		targetPath = filepath.Join(dest.Dir, targetPath)
 
-		fmt.Printf("Moving: %s (%s) [parent dir has %d files]\n  -> %s\n",
-			sourcePath, files[i].host, files[i].parentDirCount, targetPath)
+		// A remote target is checked over ssh first; rsync would overwrite it
+		if exists, err := dest.targetExists(ctx, targetPath); err != nil || exists {
+			if err == nil {
+				err = fmt.Errorf("target already exists")
+			}
+			log.Printf("Warning: Skipping %s: %s: %v", sourcePath, dest.label(targetPath), err)
+			continue
+		}
+
+		verb := "Moving"
+		if opts.DryRun {
+			verb = "Would move"
+		}
+		fmt.Printf("%s: %s [parent dir has %d files]\n  %s -> %s\n",
+			verb, files[i].label(names), files[i].parentDirCount, sourcePath, dest.label(targetPath))
+		action := journalAction{
+			Path:       files[i].path,
+			Host:       files[i].host,
+			RootFolder: files[i].rootFolder,
+			Source:     sourcePath,
+			Target:     targetPath,
+		}
+		if opts.Symlink {
+			action.Link = keeperPath
+			printSymlinkPlan(sourcePath, keeperPath, opts.DryRun)
+		}
+		actions = append(actions, dest.track(action))
+	}
+	if len(actions) == 0 || opts.DryRun {
+		return int64(len(actions)), 0, nil
+	}
 
-		// Create target directory
-		if err := os.MkdirAll(targetDir, 0755); err != nil {
-			return fmt.Errorf("error creating directory %s: %v", targetDir, err)
+	for _, a := range actions {
+		if merged := mergeXattrs(keeperPath, a.Source, xattrWhitelist); len(merged) > 0 {
+			fmt.Printf("  Merged xattrs %s from %s onto the keeper\n", strings.Join(merged, ", "), a.Source)
 		}
+	}
+
+	// A copy that fails to move stays in place with its row, and the
+	// others go on
+	journal := newGroupJournal(dest.JournalDir, group.Hash, group.Size, actions)
+	journal.skipFailedMoves = true
+	if err := journal.save(); err != nil {
+		return 0, 0, err
+	}
+	err = journal.forward(rows)
+	return int64(len(actions)) - journal.failed(), journal.failed(), err
+}
+
+// printSymlinkPlan prints the symlink --symlink leaves at source once it is
+// moved.
+func printSymlinkPlan(source, keeper string, dryRun bool) {
+	verb := "Symlinking"
+	if dryRun {
+		verb = "Would symlink"
+	}
+	link := keeper
+	if rel, err := filepath.Rel(filepath.Dir(source), keeper); err == nil {
+		link = rel
+	}
+	fmt.Printf("  %s %s -> %s\n", verb, source, link)
+}
+
+// dedupeCopy is one file of a duplicate group with the number of files in
+// its parent directory.
+type dedupeCopy struct {
+	path           string
+	host           string
+	rootFolder     string
+	fullPath       string
+	parentDirCount int
+}
+
+// label returns how the copy is shown in the plan.
+func (c dedupeCopy) label(names *PathNameCache) string {
+	return names.Label(c.host, "", c.fullPath)
+}
 
-		// Move the file using rsync to handle cross-filesystem moves
-		// First try with os.Rename for efficiency (same filesystem)
-		err := os.Rename(sourcePath, targetPath)
+// localPath returns where the i-th file of the group is on this host: under
+// its root_folder, or for a legacy row without one, as stored when absolute
+// and under legacyRoot, the host's deprecated root_path, otherwise.
+func (g DuplicateGroup) localPath(i int, legacyRoot string) string {
+	if g.rootFolder(i) == "" && !filepath.IsAbs(g.Files[i]) {
+		return filepath.Join(legacyRoot, g.Files[i])
+	}
+	return g.fullPath(i)
+}
+
+// rankDedupeCopies orders the files of group from the one keep gives up first
+// to the keeper, which comes last. The zero policy is most-populated: the
+// keeper is the copy in the most populated directory, where it most likely
+// belongs. Ties keep the order of the group. fullPath gives the location of
+// the i-th file and modTimes, for oldest and newest, the recorded mod_time of
+// each by keepModTimeKey.
+func rankDedupeCopies(group DuplicateGroup, fullPath func(i int) string, keep KeepPolicy, modTimes map[string]time.Time) []dedupeCopy {
+	files := make([]dedupeCopy, len(group.Files))
+
+	// Count files in parent directories
+	for i, path := range group.Files {
+		files[i] = dedupeCopy{path: path, host: group.Hosts[i], rootFolder: group.rootFolder(i), fullPath: fullPath(i)}
+		parentDir := filepath.Dir(files[i].fullPath)
+		entries, err := os.ReadDir(parentDir)
 		if err != nil {
-			// If rename fails due to cross-device link, use rsync
-			if strings.Contains(err.Error(), "invalid cross-device link") {
-				// Use rsync to copy the file
-				cmd := exec.Command("rsync", "-a", "--remove-source-files", sourcePath, targetPath)
-				output, err := cmd.CombinedOutput()
-				if err != nil {
-					return fmt.Errorf("error moving file %s with rsync: %v\nOutput: %s", sourcePath, err, output)
-				}
-			} else {
-				// If it's another error, return it
-				return fmt.Errorf("error moving file %s: %v", sourcePath, err)
+			// If directory doesn't exist, assign count of 0
+			log.Printf("Warning: Could not read directory %s: %v", parentDir, err)
+			continue
+		}
+
+		// Count only files (not directories)
+		for _, entry := range entries {
+			if !entry.IsDir() {
+				files[i].parentDirCount++
 			}
 		}
+	}
 
-		// Delete the file from the database
-		_, err = db.Exec(`
-			DELETE FROM files
-			WHERE path = $1 AND host_id = (
-				SELECT id FROM hosts WHERE LOWER(hostname) = LOWER($2)
-			)
-		`, files[i].path, files[i].host)
-		if err != nil {
-			log.Printf("Warning: Failed to delete file %s from database: %v", files[i].path, err)
+	if keep.Name == "" {
+		keep.Name = KeepMostPopulated
+	}
+	candidates := make([]keepCandidate, len(files))
+	for i, f := range files {
+		candidates[i] = keepCandidate{
+			fullPath:       f.fullPath,
+			modTime:        modTimes[keepModTimeKey(f.host, f.rootFolder, f.path)],
+			parentDirCount: f.parentDirCount,
 		}
 	}
+	ranked := make([]dedupeCopy, len(files))
+	for i, idx := range keep.rank(candidates) {
+		ranked[i] = files[idx]
+	}
+	return ranked
+}
 
-	return nil
+// dedupeKeepPolicy returns the policy DedupFiles ranks copies with, and the
+// mod_time of the copies of group when it compares them.
+func dedupeKeepPolicy(ctx context.Context, db *sql.DB, group DuplicateGroup, keep KeepPolicy) (KeepPolicy, map[string]time.Time, error) {
+	if keep.Name == "" {
+		return KeepPolicy{Name: KeepMostPopulated}, nil, nil
+	}
+	if !keep.needsModTimes() {
+		return keep, nil, nil
+	}
+	modTimes, err := loadKeepModTimes(ctx, db, group.Hash, group.Size)
+	return keep, modTimes, err
+}
+
+// dedupeJournalRows soft-deletes and restores the rows of files moved by
+// DedupFiles, or rewrites them when the copy went to a tracked remote
+// destination. A failed delete does not undo the move: it is logged and
+// counted in rowErrors.
+func dedupeJournalRows(db *sql.DB, rowErrors *rowErrorCount) groupJournalRows {
+	return groupJournalRows{
+		markDeleted: func(a journalAction) (bool, error) {
+			if a.NewHost != "" {
+				_, err := db.Exec(`
+					UPDATE files SET hostname = $3, root_folder = $4, path = $5
+					WHERE deleted_at IS NULL AND path = $1 AND hostname = $2
+				`, a.Path, a.Host, a.NewHost, a.NewRoot, a.NewPath)
+				if err == nil {
+					return true, nil
+				}
+				log.Printf("Warning: Failed to point %s at %s:%s, deleting it instead: %v", a.Path, a.Remote, a.Target, err)
+			}
+			_, err := db.Exec(`
+				UPDATE files SET deleted_at = NOW()
+				WHERE deleted_at IS NULL AND path = $1 AND hostname = $2
+			`, a.Path, a.Host)
+			if err != nil {
+				log.Printf("Warning: Failed to delete file %s from database: %v", a.Path, err)
+				rowErrors.add()
+				return false, nil
+			}
+			return true, nil
+		},
+		restore: func(a journalAction) error {
+			if a.NewHost != "" {
+				if restored, err := restoreRewrittenRow(db, a); err != nil || restored {
+					return err
+				}
+			}
+			_, err := db.Exec(`
+				UPDATE files SET deleted_at = NULL
+				WHERE id = (
+					SELECT id FROM files
+					WHERE path = $1 AND hostname = $2 AND deleted_at IS NOT NULL
+					ORDER BY deleted_at DESC, id DESC
+					LIMIT 1
+				)
+				AND NOT EXISTS (
+					SELECT 1 FROM files
+					WHERE path = $1 AND hostname = $2 AND `+NotDeleted+`
+				)
+			`, a.Path, a.Host)
+			return err
+		},
+	}
 }
@@ -0,0 +1,200 @@
+package files
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// keptCopies is how many copies of each group the dedupe flow keeps: one,
+// or MinCopies.
+func (o DedupeOptions) keptCopies() int {
+	if o.MinCopies > 1 {
+		return o.MinCopies
+	}
+	return 1
+}
+
+// DefaultDeleteReportPath is where a list-dupes --delete run started at now
+// records its deletions unless told otherwise.
+func DefaultDeleteReportPath(now time.Time) (string, error) {
+	cacheDir, err := os.UserCacheDir()
+	if err != nil {
+		return "", fmt.Errorf("error finding a directory for the deletion report: %v", err)
+	}
+	return filepath.Join(cacheDir, "deduplicator", "deletions", now.Format("20060102-150405")+".tsv"), nil
+}
+
+// deletionReport records every copy a --delete run removes, one line each:
+//
+//	<time>\t<hash>\t<size>\t<deleted path>\t<kept path1>|<kept path2>|...
+//
+// Paths are escaped with briefEscaper. Each line is written as soon as the
+// copy is gone, so the report is complete even if the run is interrupted.
+type deletionReport struct {
+	path string
+	file *os.File
+}
+
+func openDeletionReport(path string) (*deletionReport, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, fmt.Errorf("error creating deletion report directory: %v", err)
+	}
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("error opening deletion report: %v", err)
+	}
+	return &deletionReport{path: path, file: file}, nil
+}
+
+func (r *deletionReport) record(group DuplicateGroup, deleted string, kept []dedupeCopy) error {
+	paths := make([]string, len(kept))
+	for i, k := range kept {
+		paths[i] = briefEscaper.Replace(k.fullPath)
+	}
+	_, err := fmt.Fprintf(r.file, "%s\t%s\t%d\t%s\t%s\n", time.Now().UTC().Format(time.RFC3339),
+		group.Hash, group.Size, briefEscaper.Replace(deleted), strings.Join(paths, "|"))
+	if err != nil {
+		return fmt.Errorf("error writing deletion report: %v", err)
+	}
+	return nil
+}
+
+func (r *deletionReport) Close() error {
+	return r.file.Close()
+}
+
+// deletionTally counts what a --delete run did or, in a dry run, would do.
+type deletionTally struct {
+	deleted int
+	freed   int64
+	refused int
+}
+
+// verifyKeepers checks that every copy to be kept is on disk as a regular
+// file of the group's size and, with verify, that it still hashes to the
+// group's hash with the algorithm recorded for its row.
+func verifyKeepers(db *sql.DB, group DuplicateGroup, keepers []dedupeCopy, verify bool) error {
+	for _, k := range keepers {
+		info, err := os.Stat(k.fullPath)
+		if err != nil {
+			return fmt.Errorf("kept copy %s cannot be checked: %v", k.fullPath, err)
+		}
+		if !info.Mode().IsRegular() {
+			return fmt.Errorf("kept copy %s is not a regular file", k.fullPath)
+		}
+		if info.Size() != group.Size {
+			return fmt.Errorf("kept copy %s is %d bytes, expected %d", k.fullPath, info.Size(), group.Size)
+		}
+		if !verify {
+			continue
+		}
+		if err := verifyRowHash(db, k.path, k.host, k.fullPath, group.Hash); err != nil {
+			return fmt.Errorf("kept copy %s %v", k.fullPath, err)
+		}
+	}
+	return nil
+}
+
+// sameFile reports whether info is the file at path under another name, such
+// as a hard link. Catalog rows may predate the inode columns, so this is
+// checked on disk.
+func sameFile(info os.FileInfo, path string) bool {
+	other, err := os.Stat(path)
+	return err == nil && os.SameFile(info, other)
+}
+
+// sameFileAsKept reports whether info is one of keepers under another name.
+func sameFileAsKept(info os.FileInfo, keepers []dedupeCopy) bool {
+	for _, k := range keepers {
+		if sameFile(info, k.fullPath) {
+			return true
+		}
+	}
+	return false
+}
+
+// deleteGroupSurplus deletes all but the kept copies of a group and
+// soft-deletes their rows. The copies are ranked as for a move; the last
+// keptCopies are kept. Nothing in the group is deleted unless every kept
+// copy passes verifyKeepers, and with opts.Verify a copy is only deleted if
+// it still matches the catalog. In a dry run it only prints the plan.
+func deleteGroupSurplus(ctx context.Context, group DuplicateGroup, legacyRoot string, opts DedupeOptions, db *sql.DB, names *PathNameCache, report *deletionReport, tally *deletionTally, verification *copyVerification) error {
+	keep := opts.keptCopies()
+	if len(group.Files) <= keep {
+		return nil // Nothing beyond the copies to keep
+	}
+
+	policy, modTimes, err := dedupeKeepPolicy(ctx, db, group, opts.Keep)
+	if err != nil {
+		return err
+	}
+	files := rankDedupeCopies(group, func(i int) string {
+		return group.localPath(i, legacyRoot)
+	}, policy, modTimes)
+	keepers := files[len(files)-keep:]
+
+	fmt.Printf("\nHash: %s (size: %s)\n", group.Hash, formatBytes(group.Size))
+	for _, k := range keepers {
+		fmt.Printf("Keeping: %s [parent dir has %d files] (keep policy: %s)\n", k.label(names), k.parentDirCount, policy)
+	}
+	if err := verifyKeepers(db, group, keepers, opts.Verify); err != nil {
+		fmt.Printf("Refusing to delete any copy of this group: %v\n", err)
+		tally.refused++
+		return nil
+	}
+
+	for _, c := range files[:len(files)-keep] {
+		info, err := os.Stat(c.fullPath)
+		if os.IsNotExist(err) {
+			log.Printf("Warning: Source file does not exist: %s", c.fullPath)
+			continue
+		}
+		if err == nil {
+			err = checkMinAge(info, opts.MinAge)
+		}
+		if err != nil {
+			log.Printf("Warning: Skipping %s: %v", c.fullPath, err)
+			continue
+		}
+		// A second name for a kept file, such as a hard link, frees nothing
+		// and must not count as a surviving copy.
+		if sameFileAsKept(info, keepers) {
+			log.Printf("Warning: Skipping %s: it is the same file as a kept copy", c.fullPath)
+			continue
+		}
+
+		if opts.DryRun {
+			fmt.Printf("Would delete: %s [parent dir has %d files]\n  %s\n", c.label(names), c.parentDirCount, c.fullPath)
+			tally.deleted++
+			tally.freed += group.Size
+			continue
+		}
+
+		if opts.Verify && !verification.check(db, c.path, c.host, c.fullPath, group.Hash) {
+			continue
+		}
+		fmt.Printf("Deleting: %s [parent dir has %d files]\n  %s\n", c.label(names), c.parentDirCount, c.fullPath)
+		if err := os.Remove(c.fullPath); err != nil {
+			return fmt.Errorf("error deleting %s: %v", c.fullPath, err)
+		}
+		tally.deleted++
+		tally.freed += group.Size
+		if err := report.record(group, c.fullPath, keepers); err != nil {
+			return err
+		}
+		// Soft-delete the row; files vacuum removes it for good
+		if _, err := db.Exec(`
+			UPDATE files SET deleted_at = NOW()
+			WHERE path = $1 AND hostname = $2 AND deleted_at IS NULL
+		`, c.path, c.host); err != nil {
+			return fmt.Errorf("error removing the row of deleted file %s: %v", c.fullPath, err)
+		}
+	}
+	return nil
+}
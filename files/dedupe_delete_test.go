@@ -0,0 +1,149 @@
+package files
+
+import (
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+// writeFiles creates each path under root with content.
+func writeFiles(t *testing.T, root, content string, paths ...string) {
+	t.Helper()
+	for _, path := range paths {
+		full := filepath.Join(root, path)
+		if err := os.MkdirAll(filepath.Dir(full), 0755); err != nil {
+			t.Fatalf("mkdir: %v", err)
+		}
+		if err := os.WriteFile(full, []byte(content), 0644); err != nil {
+			t.Fatalf("write %s: %v", path, err)
+		}
+	}
+}
+
+// expectDedupeQueries expects the lookups of a DedupFiles run on this host
+// whose duplicate query returns rows.
+func expectDedupeQueries(mock sqlmock.Sqlmock, root string, rows *sqlmock.Rows) {
+	hostname, _ := os.Hostname()
+	lower := strings.ToLower(hostname)
+	expectLocalHost(mock, root, "")
+	mock.ExpectQuery("SELECT hostname FROM hosts WHERE LOWER\\(hostname\\) = LOWER\\(\\$1\\)").
+		WithArgs(lower).
+		WillReturnRows(sqlmock.NewRows([]string{"hostname"}).AddRow("host-a"))
+	mock.ExpectQuery("WITH duplicates AS").WillReturnRows(rows)
+	expectPathNameHosts(mock)
+}
+
+func TestDedupFilesDeleteRefusesGroupWhoseKeeperIsMissing(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("sqlmock: %v", err)
+	}
+	defer db.Close()
+
+	root := t.TempDir()
+	// In both groups the album copy is the keeper: its directory holds more
+	// files. The first group's album copy is gone from disk.
+	writeFiles(t, root, "filler", "album/cover.jpg", "album/back.jpg")
+	writeFiles(t, root, "lost", "downloads/lost.jpg")
+	writeFiles(t, root, "kept", "downloads/kept.jpg", "album/kept.jpg")
+
+	expectDedupeQueries(mock, root, sqlmock.NewRows([]string{"hash", "path", "hostname", "size", "root_folder"}).
+		AddRow("hash-lost", "downloads/lost.jpg", "host-a", int64(4), "").
+		AddRow("hash-lost", "album/lost.jpg", "host-a", int64(4), "").
+		AddRow("hash-kept", "downloads/kept.jpg", "host-a", int64(4), "").
+		AddRow("hash-kept", "album/kept.jpg", "host-a", int64(4), ""))
+	mock.ExpectExec("UPDATE files SET deleted_at = NOW\\(\\)").
+		WithArgs("downloads/kept.jpg", "host-a").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+
+	reportPath := filepath.Join(t.TempDir(), "deletions.tsv")
+	out := captureStdout(t, func() {
+		err = DedupFiles(context.Background(), db, DedupeOptions{
+			Delete:        true,
+			IgnoreDestDir: true,
+			DeleteReport:  reportPath,
+		})
+	})
+	if err != nil {
+		t.Fatalf("DedupFiles: %v", err)
+	}
+
+	if _, err := os.Stat(filepath.Join(root, "downloads/lost.jpg")); err != nil {
+		t.Fatalf("the only remaining copy of a refused group was deleted: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(root, "downloads/kept.jpg")); !os.IsNotExist(err) {
+		t.Fatalf("expected the surplus copy to be deleted, stat err: %v", err)
+	}
+	for _, want := range []string{
+		"Refusing to delete any copy of this group: kept copy " + filepath.Join(root, "album/lost.jpg") + " cannot be checked",
+		"Deleted 1 files, freeing 4 bytes",
+		"Refused 1 groups whose kept copies failed the check",
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("output does not contain %q:\n%s", want, out)
+		}
+	}
+
+	report, err := os.ReadFile(reportPath)
+	if err != nil {
+		t.Fatalf("read report: %v", err)
+	}
+	fields := strings.Split(strings.TrimSuffix(string(report), "\n"), "\t")
+	if len(fields) != 5 || fields[1] != "hash-kept" || fields[3] != filepath.Join(root, "downloads/kept.jpg") || fields[4] != filepath.Join(root, "album/kept.jpg") {
+		t.Fatalf("unexpected deletion report %q", report)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatalf("unmet expectations: %v", err)
+	}
+}
+
+func TestDedupFilesDeleteVerifiesEveryKeptCopy(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("sqlmock: %v", err)
+	}
+	defer db.Close()
+
+	root := t.TempDir()
+	writeFiles(t, root, "filler", "album/cover.jpg", "album/back.jpg", "backup/cover.jpg")
+	writeFiles(t, root, "same", "downloads/img.jpg", "album/img.jpg")
+	// The second kept copy has the right size but rotted content.
+	writeFiles(t, root, "sam3", "backup/img.jpg")
+	hash := fmt.Sprintf("%x", sha256.Sum256([]byte("same")))
+
+	expectDedupeQueries(mock, root, sqlmock.NewRows([]string{"hash", "path", "hostname", "size", "root_folder"}).
+		AddRow(hash, "downloads/img.jpg", "host-a", int64(4), "").
+		AddRow(hash, "backup/img.jpg", "host-a", int64(4), "").
+		AddRow(hash, "album/img.jpg", "host-a", int64(4), ""))
+	mock.ExpectQuery("SELECT hash_algo FROM files").
+		WithArgs("backup/img.jpg", "host-a").
+		WillReturnRows(sqlmock.NewRows([]string{"hash_algo"}).AddRow(HashAlgoSHA256))
+
+	out := captureStdout(t, func() {
+		err = DedupFiles(context.Background(), db, DedupeOptions{
+			Delete:       true,
+			MinCopies:    2,
+			Verify:       true,
+			DeleteReport: filepath.Join(t.TempDir(), "deletions.tsv"),
+		})
+	})
+	if err != nil {
+		t.Fatalf("DedupFiles: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(root, "downloads/img.jpg")); err != nil {
+		t.Fatalf("expected nothing deleted when a kept copy fails verification: %v", err)
+	}
+	if !strings.Contains(out, "kept copy "+filepath.Join(root, "backup/img.jpg")+" hashes to") ||
+		!strings.Contains(out, "Potential savings: 4 bytes") {
+		t.Fatalf("expected the hash mismatch and the savings of one deletion:\n%s", out)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatalf("unmet expectations: %v", err)
+	}
+}
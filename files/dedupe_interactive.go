@@ -0,0 +1,137 @@
+package files
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// groupDecision is the answer to the prompt of an interactive run for one
+// duplicate group.
+type groupDecision int
+
+const (
+	decisionKeep groupDecision = iota // move the others, keeping the shown copy
+	decisionSkip                      // leave the group alone
+	decisionQuit                      // leave this and every remaining group alone
+)
+
+// groupApprover asks before each group of list-dupes --dest --interactive is
+// moved. It talks to the terminal rather than stdin and stdout, so the prompt
+// still works when the output is piped, and tallies the decisions.
+type groupApprover struct {
+	in  *bufio.Reader
+	out io.Writer
+	all bool // "a" was answered: approve every remaining group
+
+	approved, skipped int64
+	quit              bool
+	last              groupDecision // for the current group; decisionKeep until asked
+}
+
+// newGroupApprover returns an approver talking to terminal, or to the
+// controlling terminal when it is nil, and a function that closes it.
+func newGroupApprover(terminal io.ReadWriter) (*groupApprover, func(), error) {
+	if terminal != nil {
+		return &groupApprover{in: bufio.NewReader(terminal), out: terminal}, func() {}, nil
+	}
+	tty, err := os.OpenFile("/dev/tty", os.O_RDWR, 0)
+	if err != nil {
+		return nil, nil, fmt.Errorf("--interactive needs a terminal: %v", err)
+	}
+	return &groupApprover{in: bufio.NewReader(tty), out: tty}, func() { tty.Close() }, nil
+}
+
+// startGroup forgets the decision about the previous group, so a group that
+// needs no prompt is processed as usual.
+func (a *groupApprover) startGroup() {
+	if a != nil {
+		a.last = decisionKeep
+	}
+}
+
+// decide shows the keepers and the copies that would be moved, and asks what
+// to do with the group. Unknown answers repeat the question; the end of the
+// input counts as quit. A cancelled ctx (ctrl-C) stops it waiting.
+func (a *groupApprover) decide(ctx context.Context, hash string, keepers, moved []string) (groupDecision, error) {
+	if a.all {
+		a.approved++
+		a.last = decisionKeep
+		return decisionKeep, nil
+	}
+
+	fmt.Fprintf(a.out, "\nGroup %s\n", hash)
+	for _, path := range keepers {
+		fmt.Fprintf(a.out, "  keep  %s\n", path)
+	}
+	for _, path := range moved {
+		fmt.Fprintf(a.out, "  move  %s\n", path)
+	}
+	for {
+		fmt.Fprint(a.out, "[k]eep this one / [s]kip group / [a]ll remaining / [q]uit: ")
+		answer, err := a.readLine(ctx)
+		if err == io.EOF {
+			answer = "q"
+		} else if err != nil {
+			return decisionQuit, err
+		}
+
+		switch strings.ToLower(strings.TrimSpace(answer)) {
+		case "k", "keep":
+			a.approved++
+			a.last = decisionKeep
+		case "a", "all":
+			a.all = true
+			a.approved++
+			a.last = decisionKeep
+		case "s", "skip":
+			a.skipped++
+			a.last = decisionSkip
+		case "q", "quit":
+			a.quit = true
+			a.last = decisionQuit
+		default:
+			continue
+		}
+		return a.last, nil
+	}
+}
+
+// readLine reads an answer, giving up when ctx is cancelled. The read itself
+// cannot be interrupted, so it is left behind; the run ends right after.
+func (a *groupApprover) readLine(ctx context.Context) (string, error) {
+	type result struct {
+		line string
+		err  error
+	}
+	lines := make(chan result, 1)
+	go func() {
+		line, err := a.in.ReadString('\n')
+		if err == io.EOF && line != "" {
+			err = nil
+		}
+		lines <- result{line, err}
+	}()
+	select {
+	case <-ctx.Done():
+		fmt.Fprintln(a.out)
+		return "", fmt.Errorf("operation cancelled at the prompt")
+	case r := <-lines:
+		return r.line, r.err
+	}
+}
+
+// record adds the decisions to the run summary.
+func (a *groupApprover) record(stats *RunStats) {
+	if a == nil {
+		return
+	}
+	stats.Set("approved", a.approved)
+	stats.Set("skipped", a.skipped)
+	if a.quit {
+		stats.Set("quit", 1)
+	}
+}
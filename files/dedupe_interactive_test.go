@@ -0,0 +1,184 @@
+package files
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+// expectInteractiveRun expects DedupFiles over three local groups under root:
+// g1 and g3 in directories of their own, g2 kept in keep/ beside another file.
+func expectInteractiveRun(t *testing.T, mock sqlmock.Sqlmock, root string) {
+	t.Helper()
+	writeFiles(t, root, "one", "g1/a/x.txt", "g1/b/x.txt")
+	writeFiles(t, root, "two", "keep/dup.txt", "keep/other.txt", "move/dup.txt")
+	writeFiles(t, root, "three", "g3/c/y.txt", "g3/d/y.txt")
+	hostname, _ := os.Hostname()
+	lower := strings.ToLower(hostname)
+
+	expectLocalHost(mock, root, "")
+	mock.ExpectQuery("SELECT hostname FROM hosts WHERE LOWER\\(hostname\\) = LOWER\\(\\$1\\)").
+		WithArgs(lower).
+		WillReturnRows(sqlmock.NewRows([]string{"hostname"}).AddRow("host-a"))
+	mock.ExpectQuery("WITH duplicates AS").
+		WillReturnRows(sqlmock.NewRows([]string{"hash", "path", "hostname", "size", "root_folder"}).
+			AddRow("g1", "g1/a/x.txt", "host-a", int64(3), "").
+			AddRow("g1", "g1/b/x.txt", "host-a", int64(3), "").
+			AddRow("g2", "move/dup.txt", "host-a", int64(3), "").
+			AddRow("g2", "keep/dup.txt", "host-a", int64(3), "").
+			AddRow("g3", "g3/c/y.txt", "host-a", int64(5), "").
+			AddRow("g3", "g3/d/y.txt", "host-a", int64(5), ""))
+	expectPathNameHosts(mock)
+}
+
+// fakeTerminal stands in for /dev/tty: answers are read from the Reader and
+// the prompts written to the Writer.
+type fakeTerminal struct {
+	io.Reader
+	io.Writer
+}
+
+func TestDedupFilesInteractiveMovesOnlyApprovedGroups(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("sqlmock: %v", err)
+	}
+	defer db.Close()
+
+	root := t.TempDir()
+	dest := filepath.Join(root, "dest")
+	expectInteractiveRun(t, mock, root)
+	mock.ExpectExec("UPDATE files SET deleted_at = NOW\\(\\)").
+		WithArgs("move/dup.txt", "host-a").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+
+	// An unknown answer is asked again; q leaves g3 alone
+	var terminal bytes.Buffer
+	stats := &RunStats{}
+	out := captureStdout(t, func() {
+		err = DedupFiles(context.Background(), db, DedupeOptions{
+			DestDir:     dest,
+			Interactive: true,
+			Stats:       stats,
+			terminal:    fakeTerminal{strings.NewReader("y\ns\nk\nq\n"), &terminal},
+		})
+	})
+	if err != nil {
+		t.Fatalf("DedupFiles: %v", err)
+	}
+
+	assertExists(t, filepath.Join(root, "g1/a/x.txt"), true)
+	assertExists(t, filepath.Join(root, "g1/b/x.txt"), true)
+	assertExists(t, filepath.Join(root, "move/dup.txt"), false)
+	assertExists(t, filepath.Join(dest, "move/dup.txt"), true)
+	assertExists(t, filepath.Join(root, "g3/c/y.txt"), true)
+	assertExists(t, filepath.Join(root, "g3/d/y.txt"), true)
+
+	prompt := "[k]eep this one / [s]kip group / [a]ll remaining / [q]uit: "
+	if got := strings.Count(terminal.String(), prompt); got != 4 {
+		t.Fatalf("expected 4 prompts on the terminal, got %d:\n%s", got, terminal.String())
+	}
+	for _, want := range []string{"Group g2\n  keep  ", "keep/dup.txt", "  move  ", "move/dup.txt"} {
+		if !strings.Contains(terminal.String(), want) {
+			t.Fatalf("terminal does not show %q:\n%s", want, terminal.String())
+		}
+	}
+	for _, want := range []string{"Skipped at the prompt", "Processed 1 groups of duplicate files (2 files)", "Approved 1 groups, skipped 1", "Quit at the prompt"} {
+		if !strings.Contains(out, want) {
+			t.Fatalf("output does not contain %q:\n%s", want, out)
+		}
+	}
+	if strings.Contains(out, prompt) {
+		t.Fatalf("the prompt should only go to the terminal:\n%s", out)
+	}
+	if counters := stats.Counters(); counters["approved"] != 1 || counters["skipped"] != 1 || counters["quit"] != 1 {
+		t.Fatalf("unexpected counters %v", counters)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatalf("unmet expectations: %v", err)
+	}
+}
+
+func TestDedupFilesInteractiveAllApprovesRemainingGroups(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("sqlmock: %v", err)
+	}
+	defer db.Close()
+
+	root := t.TempDir()
+	expectInteractiveRun(t, mock, root)
+
+	var terminal bytes.Buffer
+	stats := &RunStats{}
+	out := captureStdout(t, func() {
+		err = DedupFiles(context.Background(), db, DedupeOptions{
+			DryRun:      true,
+			DestDir:     filepath.Join(root, "dest"),
+			Interactive: true,
+			Stats:       stats,
+			terminal:    fakeTerminal{strings.NewReader("s\na\n"), &terminal},
+		})
+	})
+	if err != nil {
+		t.Fatalf("DedupFiles: %v", err)
+	}
+	if got := strings.Count(terminal.String(), "[q]uit: "); got != 2 {
+		t.Fatalf("expected no prompt after a, got %d:\n%s", got, terminal.String())
+	}
+	if !strings.Contains(out, "/move/dup.txt on host-a [parent dir has 1 files]") || !strings.Contains(out, "/g3/c/y.txt on host-a [parent dir has 1 files]") {
+		t.Fatalf("expected g2 and g3 to be planned:\n%s", out)
+	}
+	if counters := stats.Counters(); counters["approved"] != 2 || counters["skipped"] != 1 {
+		t.Fatalf("unexpected counters %v", counters)
+	}
+}
+
+// cancelOnPrompt cancels the run once the prompt has been written, as ctrl-C
+// does while it waits for an answer.
+type cancelOnPrompt struct {
+	bytes.Buffer
+	cancel context.CancelFunc
+}
+
+func (w *cancelOnPrompt) Write(p []byte) (int, error) {
+	if strings.Contains(string(p), "[q]uit: ") {
+		w.cancel()
+	}
+	return w.Buffer.Write(p)
+}
+
+func TestDedupFilesInteractiveStopsOnCancelAtPrompt(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("sqlmock: %v", err)
+	}
+	defer db.Close()
+
+	root := t.TempDir()
+	expectInteractiveRun(t, mock, root)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	answers, unanswered := io.Pipe()
+	defer unanswered.Close()
+
+	captureStdout(t, func() {
+		err = DedupFiles(ctx, db, DedupeOptions{
+			DestDir:     filepath.Join(root, "dest"),
+			Interactive: true,
+			terminal:    fakeTerminal{answers, &cancelOnPrompt{cancel: cancel}},
+		})
+	})
+	if err == nil || !strings.Contains(err.Error(), "operation cancelled at the prompt") {
+		t.Fatalf("expected the run to stop at the prompt, got %v", err)
+	}
+	assertExists(t, filepath.Join(root, "g1/a/x.txt"), true)
+	assertExists(t, filepath.Join(root, "g1/b/x.txt"), true)
+}
@@ -0,0 +1,363 @@
+package files
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+)
+
+// doctorSampleLimit caps how many offending rows a check prints.
+const doctorSampleLimit = 10
+
+// doctorCheck is one catalog health check. run prints what it finds, repairs
+// it when fix is set, and returns the number of offending rows.
+type doctorCheck struct {
+	name string
+	run  func(ctx context.Context, db *sql.DB, fix bool) (int64, error)
+}
+
+var doctorChecks = []doctorCheck{
+	{name: "malformed hashes", run: checkMalformedHashes},
+	{name: "mixed-case hostnames", run: checkMixedCaseHostnames},
+	{name: "legacy import paths", run: checkLegacyImportPaths},
+	{name: "row origins", run: reportRowOrigins},
+}
+
+// RunDoctor runs every catalog health check and reports the findings.
+func RunDoctor(ctx context.Context, db *sql.DB, opts DoctorOptions) error {
+	var problems int64
+	for _, check := range doctorChecks {
+		found, err := check.run(ctx, db, opts.Fix)
+		if err != nil {
+			return fmt.Errorf("error running doctor check %q: %v", check.name, err)
+		}
+		problems += found
+	}
+
+	if problems == 0 {
+		fmt.Println("\nNo problems found.")
+	} else if !opts.Fix {
+		fmt.Println("\nRerun with --fix to repair the problems above.")
+	}
+	return nil
+}
+
+// checkMalformedHashes reports rows whose hash is not 64 lowercase hex
+// digits, such as the 32-character values left by an old column resize.
+// Duplicate queries already ignore them; --fix clears the hash so the next
+// files hash run recomputes it.
+func checkMalformedHashes(ctx context.Context, db *sql.DB, fix bool) (int64, error) {
+	where := `
+		WHERE hash IS NOT NULL
+		AND NOT (` + WellFormedHash + `)
+		AND ` + NotDeleted
+
+	var count int64
+	if err := db.QueryRowContext(ctx, `SELECT COUNT(*) FROM files`+where).Scan(&count); err != nil {
+		return 0, fmt.Errorf("error counting malformed hashes: %v", err)
+	}
+	if count == 0 {
+		fmt.Println("[ok]   malformed hashes: every hash is 64 hex characters")
+		return 0, nil
+	}
+
+	fmt.Printf("[fail] malformed hashes: %d rows have a hash that is not 64 hex characters\n", count)
+	rows, err := db.QueryContext(ctx, `
+		SELECT id, hostname, path, LENGTH(hash)
+		FROM files`+where+`
+		ORDER BY id
+		LIMIT $1
+	`, doctorSampleLimit)
+	if err != nil {
+		return 0, fmt.Errorf("error listing malformed hashes: %v", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var id, length int64
+		var hostname, path string
+		if err := rows.Scan(&id, &hostname, &path, &length); err != nil {
+			return 0, fmt.Errorf("error scanning row: %v", err)
+		}
+		fmt.Printf("       id %d  %s:%s (%d characters)\n", id, hostname, path, length)
+	}
+	if err := rows.Err(); err != nil {
+		return 0, fmt.Errorf("error iterating rows: %v", err)
+	}
+	if count > doctorSampleLimit {
+		fmt.Printf("       ... and %d more\n", count-doctorSampleLimit)
+	}
+
+	if !fix {
+		return count, nil
+	}
+	result, err := db.ExecContext(ctx, `UPDATE files SET hash = NULL, last_hashed_at = NULL`+where)
+	if err != nil {
+		return 0, fmt.Errorf("error clearing malformed hashes: %v", err)
+	}
+	cleared, _ := result.RowsAffected()
+	fmt.Printf("       cleared %d malformed hashes; run files hash to recompute them\n", cleared)
+	return count, nil
+}
+
+// hostnameCaseConflict matches a hostname, aliased as m.hostname, shared
+// after lowercasing by two hosts rows. Folding would merge those hosts, so
+// their rows are left alone until one host is renamed.
+const hostnameCaseConflict = `(SELECT COUNT(*) FROM hosts o WHERE LOWER(o.hostname) = LOWER(m.hostname)) > 1`
+
+// checkMixedCaseHostnames reports hosts rows and live files rows whose
+// hostname is not lowercase, such as rows written before every write site
+// normalized it. Per-host queries compare hostnames with plain equality, so
+// commands never see those rows. --fix folds them the way migration 000016
+// does: a mixed-case row whose path is already indexed under the lowercase
+// hostname is soft-deleted, the rest are lowercased.
+func checkMixedCaseHostnames(ctx context.Context, db *sql.DB, fix bool) (int64, error) {
+	var hosts, rows int64
+	err := db.QueryRowContext(ctx, `
+		SELECT
+			(SELECT COUNT(*) FROM hosts WHERE hostname <> LOWER(hostname)),
+			(SELECT COUNT(*) FROM files WHERE hostname <> LOWER(hostname) AND `+NotDeleted+`)
+	`).Scan(&hosts, &rows)
+	if err != nil {
+		return 0, fmt.Errorf("error counting mixed-case hostnames: %v", err)
+	}
+	if hosts+rows == 0 {
+		fmt.Println("[ok]   mixed-case hostnames: every hostname is lowercase")
+		return 0, nil
+	}
+
+	fmt.Printf("[fail] mixed-case hostnames: %d hosts and %d files rows have a hostname that is not lowercase\n", hosts, rows)
+	sample, err := db.QueryContext(ctx, `
+		SELECT m.hostname, COUNT(f.id), `+hostnameCaseConflict+`
+		FROM (
+			SELECT hostname FROM hosts WHERE hostname <> LOWER(hostname)
+			UNION
+			SELECT hostname FROM files WHERE hostname <> LOWER(hostname) AND `+NotDeleted+`
+		) m
+		LEFT JOIN files f ON f.hostname = m.hostname AND f.deleted_at IS NULL
+		GROUP BY m.hostname
+		ORDER BY m.hostname
+		LIMIT $1
+	`, doctorSampleLimit)
+	if err != nil {
+		return 0, fmt.Errorf("error listing mixed-case hostnames: %v", err)
+	}
+	defer sample.Close()
+	var conflicts int
+	for sample.Next() {
+		var hostname string
+		var count int64
+		var conflict bool
+		if err := sample.Scan(&hostname, &count, &conflict); err != nil {
+			return 0, fmt.Errorf("error scanning row: %v", err)
+		}
+		line := fmt.Sprintf("       %s  %d files rows", hostname, count)
+		if conflict {
+			conflicts++
+			line += " (another host differs only by case; rename one with manage server-edit)"
+		}
+		fmt.Println(line)
+	}
+	if err := sample.Err(); err != nil {
+		return 0, fmt.Errorf("error iterating rows: %v", err)
+	}
+
+	if !fix {
+		return hosts + rows, nil
+	}
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, fmt.Errorf("error starting transaction: %v", err)
+	}
+	defer tx.Rollback()
+	collided, err := tx.ExecContext(ctx, `
+		UPDATE files m SET deleted_at = NOW()
+		WHERE m.deleted_at IS NULL
+		AND m.hostname <> LOWER(m.hostname)
+		AND EXISTS (
+			SELECT 1 FROM files b
+			WHERE b.path = m.path
+			AND LOWER(b.hostname) = LOWER(m.hostname)
+			AND b.id <> m.id
+			AND b.deleted_at IS NULL
+			AND (b.hostname = LOWER(b.hostname) OR b.id < m.id)
+		)
+		AND NOT `+hostnameCaseConflict)
+	if err != nil {
+		return 0, fmt.Errorf("error soft-deleting colliding rows: %v", err)
+	}
+	folded, err := tx.ExecContext(ctx, `
+		UPDATE files m SET hostname = LOWER(m.hostname)
+		WHERE m.hostname <> LOWER(m.hostname)
+		AND NOT `+hostnameCaseConflict)
+	if err != nil {
+		return 0, fmt.Errorf("error lowercasing files hostnames: %v", err)
+	}
+	foldedHosts, err := tx.ExecContext(ctx, `
+		UPDATE hosts m SET hostname = LOWER(m.hostname)
+		WHERE m.hostname <> LOWER(m.hostname)
+		AND NOT `+hostnameCaseConflict)
+	if err != nil {
+		return 0, fmt.Errorf("error lowercasing hosts hostnames: %v", err)
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, fmt.Errorf("error committing hostname fix: %v", err)
+	}
+	deleted, _ := collided.RowsAffected()
+	filesFolded, _ := folded.RowsAffected()
+	hostsFolded, _ := foldedHosts.RowsAffected()
+	fmt.Printf("       lowercased %d hosts and %d files rows; soft-deleted %d rows already indexed under the lowercase hostname\n", hostsFolded, filesFolded, deleted)
+	if conflicts > 0 {
+		fmt.Printf("       %d hostnames were left alone because two hosts differ only by case\n", conflicts)
+	}
+	return hosts + rows, nil
+}
+
+// legacyImportWhere matches the live rows files import recorded before it
+// stored paths the way files find does: the full path and no root folder.
+const legacyImportWhere = `
+		WHERE added_by = '` + OriginImport + `'
+		AND root_folder IS NULL
+		AND path LIKE '/%'
+		AND ` + NotDeleted
+
+// checkLegacyImportPaths reports rows files import recorded with the full
+// path of the file. files find indexes the same file by its path relative to
+// the root folder of its path mapping, so the next find of the destination
+// adds a second row for it instead of updating the imported one. --fix
+// rewrites each row to the root folder and relative path find uses; a row
+// find has already indexed is soft-deleted and hands its hash to find's row
+// when that one has none. Rows outside every path mapping are left alone.
+func checkLegacyImportPaths(ctx context.Context, db *sql.DB, fix bool) (int64, error) {
+	var count int64
+	if err := db.QueryRowContext(ctx, `SELECT COUNT(*) FROM files`+legacyImportWhere).Scan(&count); err != nil {
+		return 0, fmt.Errorf("error counting legacy import paths: %v", err)
+	}
+	if count == 0 {
+		fmt.Println("[ok]   legacy import paths: every imported row is relative to its root folder")
+		return 0, nil
+	}
+
+	fmt.Printf("[fail] legacy import paths: %d imported rows store the full path instead of a root folder and a relative path\n", count)
+	type legacyRow struct {
+		id             int64
+		hostname, path string
+		root, rel      string // Where files find indexes the file
+	}
+	rows, err := db.QueryContext(ctx, `SELECT id, hostname, path FROM files`+legacyImportWhere+`
+		ORDER BY id
+	`)
+	if err != nil {
+		return 0, fmt.Errorf("error listing legacy import paths: %v", err)
+	}
+	defer rows.Close()
+	var legacy []legacyRow
+	for rows.Next() {
+		var r legacyRow
+		if err := rows.Scan(&r.id, &r.hostname, &r.path); err != nil {
+			return 0, fmt.Errorf("error scanning row: %v", err)
+		}
+		if len(legacy) < doctorSampleLimit {
+			fmt.Printf("       id %d  %s:%s\n", r.id, r.hostname, r.path)
+		}
+		legacy = append(legacy, r)
+	}
+	if err := rows.Err(); err != nil {
+		return 0, fmt.Errorf("error iterating rows: %v", err)
+	}
+	if count > doctorSampleLimit {
+		fmt.Printf("       ... and %d more\n", count-doctorSampleLimit)
+	}
+
+	if !fix {
+		return count, nil
+	}
+	names := NewPathNameCache(db)
+	var mapped []legacyRow
+	var moved, merged, unmapped int64
+	for _, r := range legacy {
+		var ok bool
+		if r.root, r.rel, ok = names.ForHostname(r.hostname).split(r.path); !ok {
+			unmapped++
+			continue
+		}
+		mapped = append(mapped, r)
+	}
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, fmt.Errorf("error starting transaction: %v", err)
+	}
+	defer tx.Rollback()
+	for _, r := range mapped {
+		result, err := tx.ExecContext(ctx, `
+			UPDATE files b SET
+				hash = COALESCE(b.hash, m.hash),
+				hash_algo = CASE WHEN b.hash IS NULL THEN m.hash_algo ELSE b.hash_algo END,
+				last_hashed_at = CASE WHEN b.hash IS NULL THEN m.last_hashed_at ELSE b.last_hashed_at END
+			FROM files m
+			WHERE m.id = $1 AND b.path = $2 AND b.hostname = m.hostname
+			AND b.id <> m.id AND b.deleted_at IS NULL
+		`, r.id, r.rel)
+		if err != nil {
+			return 0, fmt.Errorf("error merging row %d: %v", r.id, err)
+		}
+		if n, _ := result.RowsAffected(); n > 0 {
+			if _, err := tx.ExecContext(ctx, `UPDATE files SET deleted_at = NOW() WHERE id = $1`, r.id); err != nil {
+				return 0, fmt.Errorf("error soft-deleting row %d: %v", r.id, err)
+			}
+			merged++
+			continue
+		}
+		if _, err := tx.ExecContext(ctx, `UPDATE files SET root_folder = $1, path = $2 WHERE id = $3`, r.root, r.rel, r.id); err != nil {
+			return 0, fmt.Errorf("error rewriting row %d: %v", r.id, err)
+		}
+		moved++
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, fmt.Errorf("error committing import path fix: %v", err)
+	}
+	fmt.Printf("       rewrote %d rows under their root folder; soft-deleted %d rows files find had already indexed\n", moved, merged)
+	if unmapped > 0 {
+		fmt.Printf("       %d rows were left alone because no path mapping of their host holds them\n", unmapped)
+	}
+	return count, nil
+}
+
+// reportRowOrigins prints how many live rows each command inserted, from
+// files.added_by. Rows indexed before the column existed count as unknown.
+// It is informational and never reports a problem.
+func reportRowOrigins(ctx context.Context, db *sql.DB, fix bool) (int64, error) {
+	rows, err := db.QueryContext(ctx, `
+		SELECT COALESCE(added_by, ''), COUNT(*)
+		FROM files
+		WHERE `+NotDeleted+`
+		GROUP BY 1
+		ORDER BY 2 DESC, 1
+	`)
+	if err != nil {
+		return 0, fmt.Errorf("error counting rows per origin: %v", err)
+	}
+	defer rows.Close()
+
+	var parts []string
+	for rows.Next() {
+		var origin string
+		var count int64
+		if err := rows.Scan(&origin, &count); err != nil {
+			return 0, fmt.Errorf("error scanning row: %v", err)
+		}
+		if origin == "" {
+			origin = "(unknown)"
+		}
+		parts = append(parts, fmt.Sprintf("%s %d", origin, count))
+	}
+	if err := rows.Err(); err != nil {
+		return 0, fmt.Errorf("error iterating rows: %v", err)
+	}
+	if len(parts) == 0 {
+		fmt.Println("[info] row origins: no rows")
+	} else {
+		fmt.Printf("[info] row origins: %s\n", strings.Join(parts, ", "))
+	}
+	return 0, nil
+}
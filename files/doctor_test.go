@@ -0,0 +1,286 @@
+package files
+
+import (
+	"context"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+const malformedHashWhere = `WHERE hash IS NOT NULL\s+AND NOT \(hash ~ '\^\[0-9a-f\]\{64\}\$'\)\s+AND deleted_at IS NULL`
+
+func expectMalformedHashRows(mock sqlmock.Sqlmock) {
+	mock.ExpectQuery(`SELECT COUNT\(\*\) FROM files\s+` + malformedHashWhere).
+		WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(int64(1)))
+	mock.ExpectQuery(`SELECT id, hostname, path, LENGTH\(hash\)\s+FROM files\s+` + malformedHashWhere + `\s+ORDER BY id\s+LIMIT \$1`).
+		WithArgs(doctorSampleLimit).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "hostname", "path", "length"}).
+			AddRow(int64(42), "host-a", "legacy/movie.mkv", int64(32)))
+}
+
+func expectMixedCaseHostnames(mock sqlmock.Sqlmock, hosts, rows int64) {
+	mock.ExpectQuery(`(?s)SELECT\s+\(SELECT COUNT\(\*\) FROM hosts WHERE hostname <> LOWER\(hostname\)\),\s+\(SELECT COUNT\(\*\) FROM files WHERE hostname <> LOWER\(hostname\) AND deleted_at IS NULL\)`).
+		WillReturnRows(sqlmock.NewRows([]string{"hosts", "files"}).AddRow(hosts, rows))
+}
+
+const legacyImportPathWhere = `WHERE added_by = 'import'\s+AND root_folder IS NULL\s+AND path LIKE '/%'\s+AND deleted_at IS NULL`
+
+func expectLegacyImportPaths(mock sqlmock.Sqlmock, count int64) {
+	mock.ExpectQuery(`SELECT COUNT\(\*\) FROM files\s+` + legacyImportPathWhere).
+		WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(count))
+}
+
+func expectRowOrigins(mock sqlmock.Sqlmock, origins ...any) {
+	rows := sqlmock.NewRows([]string{"added_by", "count"})
+	for i := 0; i+1 < len(origins); i += 2 {
+		rows.AddRow(origins[i], origins[i+1])
+	}
+	mock.ExpectQuery(`SELECT COALESCE\(added_by, ''\), COUNT\(\*\)\s+FROM files\s+WHERE deleted_at IS NULL\s+GROUP BY 1`).
+		WillReturnRows(rows)
+}
+
+func TestDoctorReportsMalformedHashes(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("sqlmock: %v", err)
+	}
+	defer db.Close()
+
+	expectMalformedHashRows(mock)
+	expectMixedCaseHostnames(mock, 0, 0)
+	expectLegacyImportPaths(mock, 0)
+	expectRowOrigins(mock)
+	out := captureStdout(t, func() {
+		if err := RunDoctor(context.Background(), db, DoctorOptions{}); err != nil {
+			t.Fatalf("RunDoctor: %v", err)
+		}
+	})
+	for _, want := range []string{"[fail] malformed hashes: 1 rows", "id 42  host-a:legacy/movie.mkv (32 characters)", "--fix"} {
+		if !strings.Contains(out, want) {
+			t.Errorf("expected %q in output:\n%s", want, out)
+		}
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatalf("unmet expectations: %v", err)
+	}
+}
+
+func TestDoctorFixClearsMalformedHashes(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("sqlmock: %v", err)
+	}
+	defer db.Close()
+
+	expectMalformedHashRows(mock)
+	mock.ExpectExec(`UPDATE files SET hash = NULL, last_hashed_at = NULL\s+` + malformedHashWhere).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	expectMixedCaseHostnames(mock, 0, 0)
+	expectLegacyImportPaths(mock, 0)
+	expectRowOrigins(mock)
+	out := captureStdout(t, func() {
+		if err := RunDoctor(context.Background(), db, DoctorOptions{Fix: true}); err != nil {
+			t.Fatalf("RunDoctor: %v", err)
+		}
+	})
+	if !strings.Contains(out, "cleared 1 malformed hashes") {
+		t.Errorf("expected the fix to be reported, got:\n%s", out)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatalf("unmet expectations: %v", err)
+	}
+}
+
+func TestDoctorReportsRowOrigins(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("sqlmock: %v", err)
+	}
+	defer db.Close()
+
+	mock.ExpectQuery(`SELECT COUNT\(\*\) FROM files\s+` + malformedHashWhere).
+		WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(int64(0)))
+	expectMixedCaseHostnames(mock, 0, 0)
+	expectLegacyImportPaths(mock, 0)
+	expectRowOrigins(mock, OriginFind, int64(120), "", int64(7), OriginImport, int64(3))
+	out := captureStdout(t, func() {
+		if err := RunDoctor(context.Background(), db, DoctorOptions{}); err != nil {
+			t.Fatalf("RunDoctor: %v", err)
+		}
+	})
+	for _, want := range []string{"[info] row origins: find 120, (unknown) 7, import 3", "No problems found."} {
+		if !strings.Contains(out, want) {
+			t.Errorf("expected %q in output:\n%s", want, out)
+		}
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatalf("unmet expectations: %v", err)
+	}
+}
+
+func TestDoctorReportsMixedCaseHostnames(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("sqlmock: %v", err)
+	}
+	defer db.Close()
+
+	mock.ExpectQuery(`SELECT COUNT\(\*\) FROM files\s+` + malformedHashWhere).
+		WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(int64(0)))
+	expectMixedCaseHostnames(mock, 2, 40)
+	mock.ExpectQuery(`(?s)SELECT m.hostname, COUNT\(f.id\), \(SELECT COUNT\(\*\) FROM hosts o WHERE LOWER\(o.hostname\) = LOWER\(m.hostname\)\) > 1.*UNION.*LIMIT \$1`).
+		WithArgs(doctorSampleLimit).
+		WillReturnRows(sqlmock.NewRows([]string{"hostname", "count", "conflict"}).
+			AddRow("Brain", int64(40), false).
+			AddRow("Pinky", int64(0), true))
+	expectLegacyImportPaths(mock, 0)
+	expectRowOrigins(mock)
+	out := captureStdout(t, func() {
+		if err := RunDoctor(context.Background(), db, DoctorOptions{}); err != nil {
+			t.Fatalf("RunDoctor: %v", err)
+		}
+	})
+	for _, want := range []string{
+		"[fail] mixed-case hostnames: 2 hosts and 40 files rows",
+		"Brain  40 files rows\n",
+		"Pinky  0 files rows (another host differs only by case",
+		"--fix",
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("expected %q in output:\n%s", want, out)
+		}
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatalf("unmet expectations: %v", err)
+	}
+}
+
+func TestDoctorFixFoldsMixedCaseHostnames(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("sqlmock: %v", err)
+	}
+	defer db.Close()
+
+	mock.ExpectQuery(`SELECT COUNT\(\*\) FROM files\s+` + malformedHashWhere).
+		WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(int64(0)))
+	expectMixedCaseHostnames(mock, 1, 3)
+	mock.ExpectQuery(`(?s)SELECT m.hostname, COUNT\(f.id\)`).
+		WithArgs(doctorSampleLimit).
+		WillReturnRows(sqlmock.NewRows([]string{"hostname", "count", "conflict"}).AddRow("Brain", int64(3), false))
+	mock.ExpectBegin()
+	mock.ExpectExec(`(?s)UPDATE files m SET deleted_at = NOW\(\).*b.hostname = LOWER\(b.hostname\) OR b.id < m.id.*AND NOT \(SELECT COUNT\(\*\) FROM hosts o`).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(`(?s)UPDATE files m SET hostname = LOWER\(m.hostname\)\s+WHERE m.hostname <> LOWER\(m.hostname\)\s+AND NOT`).
+		WillReturnResult(sqlmock.NewResult(0, 3))
+	mock.ExpectExec(`(?s)UPDATE hosts m SET hostname = LOWER\(m.hostname\)\s+WHERE m.hostname <> LOWER\(m.hostname\)\s+AND NOT`).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+	expectLegacyImportPaths(mock, 0)
+	expectRowOrigins(mock)
+	out := captureStdout(t, func() {
+		if err := RunDoctor(context.Background(), db, DoctorOptions{Fix: true}); err != nil {
+			t.Fatalf("RunDoctor: %v", err)
+		}
+	})
+	if !strings.Contains(out, "lowercased 1 hosts and 3 files rows; soft-deleted 1 rows") {
+		t.Errorf("expected the fix to be reported, got:\n%s", out)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatalf("unmet expectations: %v", err)
+	}
+}
+
+func TestDoctorFixMovesLegacyImportRowsUnderTheirRootFolder(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("sqlmock: %v", err)
+	}
+	defer db.Close()
+
+	mock.ExpectQuery(`SELECT COUNT\(\*\) FROM files\s+` + malformedHashWhere).
+		WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(int64(0)))
+	expectMixedCaseHostnames(mock, 0, 0)
+	expectLegacyImportPaths(mock, 3)
+	mock.ExpectQuery(`SELECT id, hostname, path FROM files\s+` + legacyImportPathWhere + `\s+ORDER BY id`).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "hostname", "path"}).
+			AddRow(int64(7), "backup1.local", "/data/photos/2024/img.jpg").
+			AddRow(int64(8), "backup1.local", "/data/photos/dup.jpg").
+			AddRow(int64(9), "backup1.local", "/elsewhere/a.txt"))
+	mock.ExpectQuery(`SELECT id, name, hostname, ip, root_path, settings, created_at\s+FROM hosts ORDER BY name`).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "name", "hostname", "ip", "root_path", "settings", "created_at"}).
+			AddRow(1, "Backup1", "backup1.local", "", "/data", []byte(`{"paths":{"photos":"/data/photos"}}`), time.Now()))
+	mock.ExpectBegin()
+	// Nothing else indexes 2024/img.jpg, so the row is rewritten in place.
+	mock.ExpectExec(`(?s)UPDATE files b SET.*FROM files m\s+WHERE m.id = \$1 AND b.path = \$2`).
+		WithArgs(int64(7), "2024/img.jpg").
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec(`UPDATE files SET root_folder = \$1, path = \$2 WHERE id = \$3`).
+		WithArgs("/data/photos", "2024/img.jpg", int64(7)).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	// files find already indexed dup.jpg: its row takes the hash.
+	mock.ExpectExec(`(?s)UPDATE files b SET.*FROM files m\s+WHERE m.id = \$1 AND b.path = \$2`).
+		WithArgs(int64(8), "dup.jpg").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(`UPDATE files SET deleted_at = NOW\(\) WHERE id = \$1`).
+		WithArgs(int64(8)).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+	expectRowOrigins(mock)
+	out := captureStdout(t, func() {
+		if err := RunDoctor(context.Background(), db, DoctorOptions{Fix: true}); err != nil {
+			t.Fatalf("RunDoctor: %v", err)
+		}
+	})
+	for _, want := range []string{
+		"[fail] legacy import paths: 3 imported rows",
+		"id 7  backup1.local:/data/photos/2024/img.jpg",
+		"rewrote 1 rows under their root folder; soft-deleted 1 rows",
+		"1 rows were left alone",
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("expected %q in output:\n%s", want, out)
+		}
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatalf("unmet expectations: %v", err)
+	}
+}
+
+func TestShortHashesAreNeverGrouped(t *testing.T) {
+	// Postgres evaluates the same pattern; RE2 agrees on this simple syntax.
+	pattern := regexp.MustCompile(strings.TrimSuffix(strings.TrimPrefix(WellFormedHash, "hash ~ '"), "'"))
+	full := strings.Repeat("ab", 32)
+	if !pattern.MatchString(full) {
+		t.Fatalf("expected a 64-character hash to be well formed")
+	}
+	for _, bad := range []string{full[:32], strings.ToUpper(full), full + "00"} {
+		if pattern.MatchString(bad) {
+			t.Errorf("expected %q to be rejected", bad)
+		}
+	}
+
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("sqlmock: %v", err)
+	}
+	defer db.Close()
+
+	// The duplicates CTE only groups well-formed hashes, so a short hash
+	// shared by two rows of the same size never forms a group.
+	mock.ExpectQuery(`(?s)WITH duplicates AS \(.*WHERE hash IS NOT NULL\s+AND hash ~ '\^\[0-9a-f\]\{64\}\$'.*GROUP BY hash, size`).
+		WillReturnRows(sqlmock.NewRows([]string{"hash", "path", "hostname", "size", "root_folder"}))
+	groups, err := FindDuplicateGroups(context.Background(), db, "", "", DuplicateSizeRules{}, "", 0, nil)
+	if err != nil {
+		t.Fatalf("FindDuplicateGroups: %v", err)
+	}
+	if len(groups) != 0 {
+		t.Fatalf("expected no groups, got %v", groups)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatalf("unmet expectations: %v", err)
+	}
+}
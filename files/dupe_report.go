@@ -0,0 +1,174 @@
+package files
+
+import (
+	"context"
+	"database/sql"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// DirectoryWaste is the space held by removable duplicate copies under one
+// directory prefix of a host.
+type DirectoryWaste struct {
+	Host      string // host name (hostname for hosts without a row)
+	Directory string // friendly path and directory prefix, such as "photos/2019/phone-backups"
+	Copies    int64  // copies that would be removed
+	Wasted    int64  // their total size in bytes
+}
+
+// DupeReport is the wasted space of every duplicate group, by directory.
+type DupeReport struct {
+	Directories []DirectoryWaste // most wasted first
+	Groups      int64
+	Copies      int64
+	Wasted      int64
+	Unhashed    int64 // files not hashed yet, whose duplicates are not counted
+}
+
+// truncateDir returns the directory of path, cut to its first depth levels.
+// The directory of a file directly under its root is "".
+func truncateDir(path string, depth int) string {
+	dir := filepath.ToSlash(filepath.Dir(path))
+	if dir == "." || dir == "/" {
+		return ""
+	}
+	abs := strings.HasPrefix(dir, "/")
+	parts := strings.Split(strings.TrimPrefix(dir, "/"), "/")
+	if len(parts) > depth {
+		parts = parts[:depth]
+	}
+	dir = strings.Join(parts, "/")
+	if abs {
+		dir = "/" + dir
+	}
+	return dir
+}
+
+// BuildDupeReport adds up, per directory prefix, the copies of each
+// duplicate group that deduplication would remove: every copy but the first
+// by host and path, the copy move-dupes keeps by default. Prefixes are taken
+// relative to each copy's root folder, down to opts.Depth levels. Groups are
+// read with the query of FindDuplicateGroups as the cursor yields them.
+func BuildDupeReport(ctx context.Context, db *sql.DB, opts DupeReportOptions) (*DupeReport, error) {
+	if opts.Depth < 0 {
+		return nil, fmt.Errorf("--depth must not be negative")
+	}
+
+	cursor, err := openDuplicateGroups(ctx, db, "", "", DuplicateSizeRules{MinSize: opts.MinSize}, SortBySize, 0, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close()
+
+	report := &DupeReport{}
+	names := NewPathNameCache(db)
+	byDir := make(map[[2]string]*DirectoryWaste)
+	for cursor.Next() {
+		group := cursor.Group()
+		report.Groups++
+		for i := 1; i < len(group.Files); i++ {
+			pathNames := names.ForHostname(group.Hosts[i])
+			dir := pathNames.Display(group.rootFolder(i), truncateDir(group.Files[i], opts.Depth))
+			key := [2]string{pathNames.Host, dir}
+			w, ok := byDir[key]
+			if !ok {
+				w = &DirectoryWaste{Host: pathNames.Host, Directory: dir}
+				byDir[key] = w
+			}
+			w.Copies++
+			w.Wasted += group.Size
+			report.Copies++
+			report.Wasted += group.Size
+		}
+	}
+	if err := cursor.Err(); err != nil {
+		return nil, err
+	}
+
+	for _, w := range byDir {
+		report.Directories = append(report.Directories, *w)
+	}
+	sort.Slice(report.Directories, func(i, j int) bool {
+		a, b := report.Directories[i], report.Directories[j]
+		if a.Wasted != b.Wasted {
+			return a.Wasted > b.Wasted
+		}
+		if a.Host != b.Host {
+			return a.Host < b.Host
+		}
+		return a.Directory < b.Directory
+	})
+
+	// Hashing may still be running: the report stands, but says how much
+	// it cannot see yet
+	if err := db.QueryRowContext(ctx, `
+		SELECT COUNT(*) FROM files
+		WHERE hash IS NULL AND `+NotDeleted+` AND `+noFileErrorsPredicate+`
+	`).Scan(&report.Unhashed); err != nil {
+		return nil, fmt.Errorf("error counting unhashed files: %v", err)
+	}
+	return report, nil
+}
+
+// WriteDupeReportCSV writes one CSV row per directory of report to w.
+func WriteDupeReportCSV(w io.Writer, report *DupeReport) error {
+	cw := csv.NewWriter(w)
+	if err := cw.Write([]string{"host", "directory", "copies", "wasted_bytes"}); err != nil {
+		return fmt.Errorf("error writing csv: %v", err)
+	}
+	for _, d := range report.Directories {
+		record := []string{d.Host, d.Directory, strconv.FormatInt(d.Copies, 10), strconv.FormatInt(d.Wasted, 10)}
+		if err := cw.Write(record); err != nil {
+			return fmt.Errorf("error writing csv: %v", err)
+		}
+	}
+	cw.Flush()
+	if err := cw.Error(); err != nil {
+		return fmt.Errorf("error writing csv: %v", err)
+	}
+	return nil
+}
+
+// PrintDupeReport is files dupe-report: the table of wasted space by
+// directory, and with opts.CSV the same rows as CSV.
+func PrintDupeReport(ctx context.Context, db *sql.DB, opts DupeReportOptions) error {
+	report, err := BuildDupeReport(ctx, db, opts)
+	if err != nil {
+		return err
+	}
+	if opts.CSV == "-" {
+		return WriteDupeReportCSV(os.Stdout, report)
+	}
+
+	fmt.Printf("%-50s %-16s %10s %20s\n", "Directory", "Host", "Copies", "Wasted bytes")
+	for _, d := range report.Directories {
+		fmt.Printf("%-50s %-16s %10d %20s\n", d.Directory, d.Host, d.Copies, formatBytes(d.Wasted))
+	}
+	fmt.Printf("\n%d duplicate groups: %d removable copies wasting %s bytes\n",
+		report.Groups, report.Copies, formatBytes(report.Wasted))
+	if report.Unhashed > 0 {
+		fmt.Printf("Note: %d files are not hashed yet; their duplicates are not counted\n", report.Unhashed)
+	}
+
+	if opts.CSV != "" {
+		f, err := os.Create(opts.CSV)
+		if err != nil {
+			return fmt.Errorf("error creating %s: %v", opts.CSV, err)
+		}
+		err = WriteDupeReportCSV(f, report)
+		if closeErr := f.Close(); err == nil && closeErr != nil {
+			err = fmt.Errorf("error writing %s: %v", opts.CSV, closeErr)
+		}
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Wrote %d directories to %s\n", len(report.Directories), opts.CSV)
+	}
+	return nil
+}
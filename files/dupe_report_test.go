@@ -0,0 +1,89 @@
+package files
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+func TestTruncateDir(t *testing.T) {
+	tests := []struct {
+		path  string
+		depth int
+		want  string
+	}{
+		{"img.jpg", 2, ""},
+		{"2019/img.jpg", 2, "2019"},
+		{"2019/phone-backups/a/b/img.jpg", 2, "2019/phone-backups"},
+		{"2019/phone-backups/img.jpg", 0, ""},
+		{"/data/photos/2019/img.jpg", 2, "/data/photos"},
+	}
+	for _, tt := range tests {
+		if got := truncateDir(tt.path, tt.depth); got != tt.want {
+			t.Errorf("truncateDir(%q, %d) = %q, want %q", tt.path, tt.depth, got, tt.want)
+		}
+	}
+}
+
+func TestPrintDupeReportCountsRemovableCopiesByDirectory(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("sqlmock: %v", err)
+	}
+	defer db.Close()
+
+	mock.ExpectQuery(`WITH duplicates AS`).
+		WithArgs().
+		WillReturnRows(sqlmock.NewRows([]string{"hash", "path", "hostname", "size", "root_folder"}).
+			// The first copy by host and path is the one kept
+			AddRow("h1", "2019/phone-backups/a/img.jpg", "host-a", int64(100), "/data/photos").
+			AddRow("h1", "2019/phone-backups/b/img.jpg", "host-a", int64(100), "/data/photos").
+			AddRow("h1", "old/x/y/img.jpg", "host-b", int64(100), "/backup").
+			AddRow("h2", "2019/phone-backups/img2.jpg", "host-a", int64(10), "/data/photos").
+			AddRow("h2", "2020/img2.jpg", "host-a", int64(10), "/data/photos"))
+	expectPathNameHosts(mock, [3]string{"Backup1", "host-a", `{"paths":{"photos":"/data/photos"}}`})
+	mock.ExpectQuery(`SELECT COUNT\(\*\) FROM files\s+WHERE hash IS NULL`).
+		WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(3))
+
+	csvPath := filepath.Join(t.TempDir(), "waste.csv")
+	out := captureStdout(t, func() {
+		err = PrintDupeReport(context.Background(), db, DupeReportOptions{Depth: 2, CSV: csvPath})
+	})
+	if err != nil {
+		t.Fatalf("PrintDupeReport: %v", err)
+	}
+
+	lines := strings.Split(out, "\n")
+	if len(lines) < 4 || !strings.HasPrefix(lines[1], "photos/2019/phone-backups ") || !strings.Contains(lines[1], "Backup1") ||
+		!strings.HasPrefix(lines[2], "(unmapped) /backup/old/x ") || !strings.HasPrefix(lines[3], "photos/2020 ") {
+		t.Fatalf("unexpected table:\n%s", out)
+	}
+	for _, want := range []string{
+		"2 duplicate groups: 3 removable copies wasting 210 bytes",
+		"Note: 3 files are not hashed yet",
+		"Wrote 3 directories to " + csvPath,
+	} {
+		if !strings.Contains(out, want) {
+			t.Fatalf("output does not contain %q:\n%s", want, out)
+		}
+	}
+
+	data, err := os.ReadFile(csvPath)
+	if err != nil {
+		t.Fatalf("read csv: %v", err)
+	}
+	want := "host,directory,copies,wasted_bytes\n" +
+		"Backup1,photos/2019/phone-backups,1,100\n" +
+		"host-b,(unmapped) /backup/old/x,1,100\n" +
+		"Backup1,photos/2020,1,10\n"
+	if string(data) != want {
+		t.Fatalf("csv =\n%s\nwant\n%s", data, want)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatalf("unmet expectations: %v", err)
+	}
+}
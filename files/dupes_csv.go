@@ -0,0 +1,87 @@
+package files
+
+import (
+	"context"
+	"database/sql"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+)
+
+// duplicateCSVHeader is the first row of list-dupes --csv.
+var duplicateCSVHeader = []string{"hash", "size", "hostname", "root_folder", "path", "group_savings"}
+
+// WriteDuplicateCSV writes one CSV row per file of every duplicate group to
+// w: its hash, size in bytes, hostname, root_folder, path and the savings of
+// its group in bytes, leaving out the files exclude matches or sizes rules
+// out and, with rootFolder, the files outside it on hostname. Groups are read
+// in the order of sort with the query of FindDuplicateGroups and written as
+// the cursor yields them, so the export never holds more than one group. It returns the number
+// of groups and rows written.
+func WriteDuplicateCSV(ctx context.Context, db *sql.DB, hostname, rootFolder string, sizes DuplicateSizeRules, sort DuplicateSort, count int, exclude PathExcludes, w io.Writer) (groups, rows int, err error) {
+	cw := csv.NewWriter(w)
+	if err := cw.Write(duplicateCSVHeader); err != nil {
+		return 0, 0, fmt.Errorf("error writing csv: %v", err)
+	}
+
+	cursor, err := openDuplicateGroups(ctx, db, hostname, rootFolder, sizes, sort, count, exclude)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer cursor.Close()
+
+	for cursor.Next() {
+		group := cursor.Group()
+		size := strconv.FormatInt(group.Size, 10)
+		savings := strconv.FormatInt(group.Size*int64(len(group.Files)-1), 10)
+		for i := range group.Files {
+			record := []string{group.Hash, size, group.Hosts[i], group.rootFolder(i), group.Files[i], savings}
+			if err := cw.Write(record); err != nil {
+				return groups, rows, fmt.Errorf("error writing csv: %v", err)
+			}
+			rows++
+		}
+		groups++
+		cw.Flush()
+		if err := cw.Error(); err != nil {
+			return groups, rows, fmt.Errorf("error writing csv: %v", err)
+		}
+	}
+	if err := cursor.Err(); err != nil {
+		return groups, rows, err
+	}
+	cw.Flush()
+	if err := cw.Error(); err != nil {
+		return groups, rows, fmt.Errorf("error writing csv: %v", err)
+	}
+	return groups, rows, nil
+}
+
+// exportDuplicateCSV is list-dupes --csv: the duplicate listing written to
+// path ("-" for stdout) for review in a spreadsheet.
+func exportDuplicateCSV(ctx context.Context, db *sql.DB, opts DuplicateListOptions) error {
+	hostname, rootFolder, err := resolveDuplicateScope(db, opts.Path)
+	if err != nil {
+		return err
+	}
+	if opts.CSV == "-" {
+		_, _, err := WriteDuplicateCSV(ctx, db, hostname, rootFolder, opts.sizeRules(), opts.Sort, opts.Count, opts.Exclude, os.Stdout)
+		return err
+	}
+
+	f, err := os.Create(opts.CSV)
+	if err != nil {
+		return fmt.Errorf("error creating %s: %v", opts.CSV, err)
+	}
+	groups, rows, err := WriteDuplicateCSV(ctx, db, hostname, rootFolder, opts.sizeRules(), opts.Sort, opts.Count, opts.Exclude, f)
+	if closeErr := f.Close(); err == nil && closeErr != nil {
+		err = fmt.Errorf("error writing %s: %v", opts.CSV, closeErr)
+	}
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Wrote %d files in %d duplicate groups to %s\n", rows, groups, opts.CSV)
+	return nil
+}
@@ -0,0 +1,102 @@
+package files
+
+import (
+	"bytes"
+	"context"
+	"encoding/csv"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+func TestWriteDuplicateCSVStreamsOneRowPerFile(t *testing.T) {
+	db, mock, err := sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherRegexp))
+	if err != nil {
+		t.Fatalf("sqlmock: %v", err)
+	}
+	defer db.Close()
+
+	mock.ExpectQuery(`(?s)WITH duplicates.*size >= \$1.*LIMIT \$2.*JOIN files`).
+		WithArgs(int64(1000), 2).
+		WillReturnRows(sqlmock.NewRows([]string{"hash", "path", "hostname", "size", "root_folder"}).
+			AddRow("aaaa", "2021/img.jpg", "brain", int64(5000), "/data/photos").
+			AddRow("aaaa", "/legacy/img.jpg", "pinky", int64(5000), "").
+			AddRow("aaaa", "old, copy.jpg", "pinky", int64(5000), "/srv").
+			AddRow("bbbb", "a.txt", "brain", int64(1000), "/data/docs").
+			AddRow("bbbb", "b.txt", "brain", int64(1000), "/data/docs"))
+
+	maxHeld := 0
+	groupCursorHook = func(held int) {
+		if held > maxHeld {
+			maxHeld = held
+		}
+	}
+	t.Cleanup(func() { groupCursorHook = nil })
+
+	var out bytes.Buffer
+	groups, rows, err := WriteDuplicateCSV(context.Background(), db, "", "", DuplicateSizeRules{MinSize: 1000}, "", 2, nil, &out)
+	if err != nil {
+		t.Fatalf("WriteDuplicateCSV: %v", err)
+	}
+	const golden = "hash,size,hostname,root_folder,path,group_savings\n" +
+		"aaaa,5000,brain,/data/photos,2021/img.jpg,10000\n" +
+		"aaaa,5000,pinky,,/legacy/img.jpg,10000\n" +
+		"aaaa,5000,pinky,/srv,\"old, copy.jpg\",10000\n" +
+		"bbbb,1000,brain,/data/docs,a.txt,1000\n" +
+		"bbbb,1000,brain,/data/docs,b.txt,1000\n"
+	if out.String() != golden {
+		t.Fatalf("csv output mismatch\n got: %q\nwant: %q", out.String(), golden)
+	}
+	if groups != 2 || rows != 5 {
+		t.Fatalf("expected 2 groups and 5 rows, got %d and %d", groups, rows)
+	}
+	if maxHeld > 2 {
+		t.Fatalf("expected groups to be written as they are read, %d were held at once", maxHeld)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatalf("unmet expectations: %v", err)
+	}
+}
+
+func TestFindDuplicatesWritesCSVFile(t *testing.T) {
+	db, mock, err := sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherRegexp))
+	if err != nil {
+		t.Fatalf("sqlmock: %v", err)
+	}
+	defer db.Close()
+
+	mock.ExpectQuery(`(?s)WITH duplicates.*JOIN files`).
+		WillReturnRows(sqlmock.NewRows([]string{"hash", "path", "hostname", "size", "root_folder"}).
+			AddRow("aaaa", "a.bin", "brain", int64(10), "/data").
+			AddRow("aaaa", "b.bin", "pinky", int64(10), "/data"))
+
+	path := filepath.Join(t.TempDir(), "dupes.csv")
+	out := captureStdout(t, func() {
+		err = FindDuplicates(context.Background(), db, DuplicateListOptions{CSV: path})
+	})
+	if err != nil {
+		t.Fatalf("FindDuplicates: %v", err)
+	}
+	if !strings.Contains(out, "Wrote 2 files in 1 duplicate groups to "+path) {
+		t.Fatalf("expected the export summary:\n%s", out)
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	defer f.Close()
+	records, err := csv.NewReader(f).ReadAll()
+	if err != nil {
+		t.Fatalf("reading the export back: %v", err)
+	}
+	if len(records) != 3 || records[2][2] != "pinky" || records[2][5] != "10" {
+		t.Fatalf("unexpected export %v", records)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatalf("unmet expectations: %v", err)
+	}
+}
@@ -0,0 +1,177 @@
+package files
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// summaryTopN is how many root folders and extensions list-dupes --summary
+// breaks the totals down by.
+const summaryTopN = 10
+
+// DuplicateBucket is the share of the duplicates held under one root folder
+// or with one extension. Each copy of a group of N copies is charged (N-1)/N
+// of its size, so the buckets add up to the wasted total.
+type DuplicateBucket struct {
+	Name   string `json:"name"`
+	Copies int64  `json:"copies"`
+	Wasted int64  `json:"wasted_bytes"`
+}
+
+// DuplicateSummary is the report of list-dupes --summary: the totals over
+// every duplicate group, and the root folders and extensions wasting most.
+type DuplicateSummary struct {
+	Groups         int64             `json:"groups"`
+	RedundantFiles int64             `json:"redundant_files"` // every copy but one of each group
+	WastedBytes    int64             `json:"wasted_bytes"`
+	ByRootFolder   []DuplicateBucket `json:"by_root_folder"` // "<host>:<root_folder>", top summaryTopN
+	ByExtension    []DuplicateBucket `json:"by_extension"`   // lower-cased, top summaryTopN
+	SizeFiltered   int64             `json:"size_filtered_groups"`
+}
+
+// duplicateSummarizer aggregates duplicate groups one at a time, so a summary
+// of tens of thousands of groups never holds more than one.
+type duplicateSummarizer struct {
+	summary      DuplicateSummary
+	byRootFolder map[string]*DuplicateBucket
+	byExtension  map[string]*DuplicateBucket
+}
+
+func newDuplicateSummarizer() *duplicateSummarizer {
+	return &duplicateSummarizer{
+		byRootFolder: make(map[string]*DuplicateBucket),
+		byExtension:  make(map[string]*DuplicateBucket),
+	}
+}
+
+// add counts group into the totals and the buckets of each of its copies.
+func (s *duplicateSummarizer) add(group DuplicateGroup) {
+	copies := int64(len(group.Files))
+	s.summary.Groups++
+	s.summary.RedundantFiles += copies - 1
+	s.summary.WastedBytes += group.Size * (copies - 1)
+
+	// Spread the wasted bytes over the copies; the remainder of the
+	// division goes to the first ones, so nothing is lost to rounding
+	wasted := group.Size * (copies - 1)
+	for i := range group.Files {
+		share := wasted / copies
+		if int64(i) < wasted%copies {
+			share++
+		}
+		root := group.rootFolder(i)
+		if root == "" {
+			root = "(no root folder)"
+		}
+		addToBucket(s.byRootFolder, group.Hosts[i]+":"+root, share)
+		ext := strings.ToLower(filepath.Ext(group.Files[i]))
+		if ext == "" {
+			ext = "(none)"
+		}
+		addToBucket(s.byExtension, ext, share)
+	}
+}
+
+func addToBucket(buckets map[string]*DuplicateBucket, name string, wasted int64) {
+	b, ok := buckets[name]
+	if !ok {
+		b = &DuplicateBucket{Name: name}
+		buckets[name] = b
+	}
+	b.Copies++
+	b.Wasted += wasted
+}
+
+// topBuckets returns the n buckets wasting the most bytes, by name on ties.
+func topBuckets(buckets map[string]*DuplicateBucket, n int) []DuplicateBucket {
+	top := make([]DuplicateBucket, 0, len(buckets))
+	for _, b := range buckets {
+		top = append(top, *b)
+	}
+	sort.Slice(top, func(i, j int) bool {
+		if top[i].Wasted != top[j].Wasted {
+			return top[i].Wasted > top[j].Wasted
+		}
+		return top[i].Name < top[j].Name
+	})
+	if len(top) > n {
+		top = top[:n]
+	}
+	return top
+}
+
+// Summary returns the totals and the top buckets aggregated so far.
+func (s *duplicateSummarizer) Summary() DuplicateSummary {
+	summary := s.summary
+	summary.ByRootFolder = topBuckets(s.byRootFolder, summaryTopN)
+	summary.ByExtension = topBuckets(s.byExtension, summaryTopN)
+	return summary
+}
+
+// SummarizeDuplicates scans the duplicate groups of FindDuplicateGroups and
+// returns their totals instead of the groups.
+func SummarizeDuplicates(ctx context.Context, db *sql.DB, hostname, rootFolder string, sizes DuplicateSizeRules, count int, exclude PathExcludes) (DuplicateSummary, error) {
+	cursor, err := openDuplicateGroups(ctx, db, hostname, rootFolder, sizes, SortBySize, count, exclude)
+	if err != nil {
+		return DuplicateSummary{}, err
+	}
+	defer cursor.Close()
+
+	summarizer := newDuplicateSummarizer()
+	for cursor.Next() {
+		summarizer.add(cursor.Group())
+	}
+	if err := cursor.Err(); err != nil {
+		return DuplicateSummary{}, err
+	}
+	return summarizer.Summary(), nil
+}
+
+// printDuplicateSummary is list-dupes --summary (and --format json): the
+// totals of the listing, without its groups.
+func printDuplicateSummary(ctx context.Context, db *sql.DB, opts DuplicateListOptions) error {
+	hostname, rootFolder, err := resolveDuplicateScope(db, opts.Path)
+	if err != nil {
+		return err
+	}
+	summary, err := SummarizeDuplicates(ctx, db, hostname, rootFolder, opts.sizeRules(), opts.Count, opts.Exclude)
+	if err != nil {
+		return err
+	}
+	if summary.SizeFiltered, err = countSizeFilteredGroups(ctx, db, hostname, rootFolder, opts.sizeRules()); err != nil {
+		return err
+	}
+
+	if opts.Format == "json" {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(summary)
+	}
+
+	fmt.Printf("Duplicate groups: %d\n", summary.Groups)
+	fmt.Printf("Redundant files:  %d\n", summary.RedundantFiles)
+	fmt.Printf("Wasted space:     %s bytes\n", formatBytes(summary.WastedBytes))
+	for _, section := range []struct {
+		title   string
+		buckets []DuplicateBucket
+	}{
+		{"Root folder", summary.ByRootFolder},
+		{"Extension", summary.ByExtension},
+	} {
+		if len(section.buckets) == 0 {
+			continue
+		}
+		fmt.Printf("\n%-40s %12s %20s\n", section.title, "Copies", "Wasted bytes")
+		for _, b := range section.buckets {
+			fmt.Printf("%-40s %12d %20s\n", b.Name, b.Copies, formatBytes(b.Wasted))
+		}
+	}
+	printSizeFiltered(summary.SizeFiltered)
+	return nil
+}
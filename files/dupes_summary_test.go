@@ -0,0 +1,114 @@
+package files
+
+import (
+	"context"
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+// expectSummaryGroups expects a duplicate query returning a 100-byte group
+// of three .jpg copies on two hosts and a 10-byte group of two copies.
+func expectSummaryGroups(mock sqlmock.Sqlmock) {
+	mock.ExpectQuery(`WITH duplicates AS`).
+		WillReturnRows(sqlmock.NewRows([]string{"hash", "path", "hostname", "size", "root_folder"}).
+			AddRow("h1", "photos/a.JPG", "host-a", int64(100), "/data").
+			AddRow("h1", "b.jpg", "host-a", int64(100), "/data").
+			AddRow("h1", "c.jpg", "host-b", int64(100), "/backup").
+			AddRow("h2", "notes.txt", "host-a", int64(10), "/data").
+			AddRow("h2", "/legacy/notes", "host-a", int64(10), ""))
+}
+
+func TestFindDuplicatesSummaryAggregatesByRootFolderAndExtension(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("sqlmock: %v", err)
+	}
+	defer db.Close()
+
+	maxHeld := 0
+	groupCursorHook = func(held int) {
+		if held > maxHeld {
+			maxHeld = held
+		}
+	}
+	t.Cleanup(func() { groupCursorHook = nil })
+
+	expectSummaryGroups(mock)
+	out := captureStdout(t, func() {
+		err = FindDuplicates(context.Background(), db, DuplicateListOptions{Format: "json"})
+	})
+	if err != nil {
+		t.Fatalf("FindDuplicates: %v", err)
+	}
+	var summary DuplicateSummary
+	if err := json.Unmarshal([]byte(out), &summary); err != nil {
+		t.Fatalf("decode %q: %v", out, err)
+	}
+	// The 200 bytes wasted by h1 are spread 67, 67 and 66 over its copies
+	want := DuplicateSummary{
+		Groups:         2,
+		RedundantFiles: 3,
+		WastedBytes:    210,
+		ByRootFolder: []DuplicateBucket{
+			{Name: "host-a:/data", Copies: 3, Wasted: 139},
+			{Name: "host-b:/backup", Copies: 1, Wasted: 66},
+			{Name: "host-a:(no root folder)", Copies: 1, Wasted: 5},
+		},
+		ByExtension: []DuplicateBucket{
+			{Name: ".jpg", Copies: 3, Wasted: 200},
+			{Name: "(none)", Copies: 1, Wasted: 5},
+			{Name: ".txt", Copies: 1, Wasted: 5},
+		},
+	}
+	if !reflect.DeepEqual(summary, want) {
+		t.Fatalf("summary = %+v\nwant %+v", summary, want)
+	}
+	if maxHeld > 2 {
+		t.Fatalf("expected groups to be summarized as they are read, %d were held at once", maxHeld)
+	}
+
+	expectSummaryGroups(mock)
+	out = captureStdout(t, func() {
+		err = FindDuplicates(context.Background(), db, DuplicateListOptions{Summary: true})
+	})
+	if err != nil {
+		t.Fatalf("FindDuplicates --summary: %v", err)
+	}
+	for _, want := range []string{"Duplicate groups: 2", "Redundant files:  3", "Wasted space:     210 bytes", "host-a:/data", ".jpg"} {
+		if !strings.Contains(out, want) {
+			t.Fatalf("output does not contain %q:\n%s", want, out)
+		}
+	}
+	if strings.Contains(out, "photos/a.JPG") {
+		t.Fatalf("--summary should not list the groups:\n%s", out)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatalf("unmet expectations: %v", err)
+	}
+}
+
+func TestDuplicateSummaryKeepsTopTenBuckets(t *testing.T) {
+	s := newDuplicateSummarizer()
+	for i, ext := range []string{"a", "b", "c", "d", "e", "f", "g", "h", "i", "j", "k", "l"} {
+		size := int64(100 * (i + 1))
+		s.add(DuplicateGroup{
+			Hash:        ext,
+			Size:        size,
+			Files:       []string{"x." + ext, "y." + ext},
+			Hosts:       []string{"host-a", "host-a"},
+			RootFolders: []string{"/data", "/data"},
+			TotalSize:   2 * size,
+		})
+	}
+	summary := s.Summary()
+	if len(summary.ByExtension) != summaryTopN || summary.ByExtension[0].Name != ".l" || summary.ByExtension[9].Name != ".c" {
+		t.Fatalf("ByExtension = %+v", summary.ByExtension)
+	}
+	if len(summary.ByRootFolder) != 1 || summary.ByRootFolder[0].Wasted != summary.WastedBytes {
+		t.Fatalf("ByRootFolder = %+v, wasted %d", summary.ByRootFolder, summary.WastedBytes)
+	}
+}
@@ -3,16 +3,110 @@ package files
 import (
 	"context"
 	"database/sql"
+	"fmt"
+	"os"
+	"strings"
+
+	"deduplicator/db"
 )
 
 // FindDuplicates finds and displays duplicate files
 func FindDuplicates(ctx context.Context, db *sql.DB, opts DuplicateListOptions) error {
-	groups, err := FindDuplicateGroups(ctx, db, "", opts.MinSize, opts.Count)
+	if opts.Format != "" && opts.Format != "text" && opts.Format != "brief" && opts.Format != "json" {
+		return fmt.Errorf("invalid value for --format: %q (use text, brief or json)", opts.Format)
+	}
+	if opts.Print0Paths {
+		return printDuplicatePaths(ctx, db, opts)
+	}
+	if opts.CSV != "" {
+		return exportDuplicateCSV(ctx, db, opts)
+	}
+	// --summary with brief only adds a totals line to the groups
+	if opts.Format == "json" || (opts.Summary && opts.Format != "brief") {
+		return printDuplicateSummary(ctx, db, opts)
+	}
+
+	hostname, rootFolder, err := resolveDuplicateScope(db, opts.Path)
+	if err != nil {
+		return err
+	}
+	groups, err := FindDuplicateGroups(ctx, db, hostname, rootFolder, opts.sizeRules(), opts.Sort, opts.Count, opts.Exclude)
+	if err != nil {
+		return err
+	}
+	if opts.ShowExternal {
+		if err := markKnownExternal(ctx, db, groups); err != nil {
+			return err
+		}
+	}
+
+	if opts.Format == "brief" {
+		if err := RenderBriefGroups(os.Stdout, groups); err != nil {
+			return err
+		}
+		if opts.Summary {
+			return RenderBriefSummary(os.Stdout, groups)
+		}
+		return nil
+	}
+
+	var siblings *SiblingCache
+	if opts.Context > 0 {
+		siblings = NewSiblingCache(ctx, db, opts.Context)
+	}
+
+	sizeFiltered, err := countSizeFilteredGroups(ctx, db, hostname, rootFolder, opts.sizeRules())
 	if err != nil {
 		return err
 	}
 
 	// Print the results
-	PrintDuplicateGroups(groups)
+	PrintDuplicateGroups(groups, NewPathNameCache(db), siblings)
+	printSizeFiltered(sizeFiltered)
 	return nil
 }
+
+// resolveDuplicateScope resolves list-dupes --path: the hostname of this
+// machine and the root folder its friendly path maps to. Without a friendly
+// path both are empty and duplicates are looked for across all hosts.
+func resolveDuplicateScope(database *sql.DB, friendlyPath string) (hostname, rootFolder string, err error) {
+	if friendlyPath == "" {
+		return "", "", nil
+	}
+	host, err := localHostRow(database)
+	if err != nil {
+		return "", "", err
+	}
+	if rootFolder, err = friendlyRootFolder(host, friendlyPath); err != nil {
+		return "", "", err
+	}
+	return normalizeHostname(host.Hostname), rootFolder, nil
+}
+
+// localHostRow returns the host row whose hostname matches this machine's,
+// whatever its friendly name.
+func localHostRow(database *sql.DB) (*db.Host, error) {
+	hostname, err := os.Hostname()
+	if err != nil {
+		return nil, fmt.Errorf("error getting hostname: %v", err)
+	}
+	host, err := db.GetHostByHostname(database, strings.ToLower(hostname))
+	if err != nil {
+		return nil, fmt.Errorf("error finding this host: %v", err)
+	}
+	return host, nil
+}
+
+// friendlyRootFolder returns the root folder the friendly path name maps to
+// on host.
+func friendlyRootFolder(host *db.Host, name string) (string, error) {
+	paths, err := host.GetPaths()
+	if err != nil {
+		return "", fmt.Errorf("error decoding host paths: %v", err)
+	}
+	rootFolder, ok := paths[name]
+	if !ok {
+		return "", fmt.Errorf("friendly path '%s' not found for server '%s'", name, host.Name)
+	}
+	return rootFolder, nil
+}
@@ -2,12 +2,14 @@ package files
 
 import (
 	"context"
+	"errors"
 	"io"
 	"log"
 	"os"
 	"path/filepath"
 	"strings"
 	"testing"
+	"time"
 
 	"deduplicator/logging"
 
@@ -31,17 +33,17 @@ func TestFindDuplicateGroupsRespectsFiltersAndOrdering(t *testing.T) {
 		WithArgs(lower).
 		WillReturnRows(sqlmock.NewRows([]string{"hostname"}).AddRow("host-a"))
 
-	dupRows := sqlmock.NewRows([]string{"hash", "path", "hostname", "size"}).
-		AddRow("hash-b", "/data/b1", "host-a", int64(2*1024*1024)).
-		AddRow("hash-b", "/data/b2", "host-a", int64(2*1024*1024)).
-		AddRow("hash-a", "/data/a1", "host-a", int64(1024*1024)).
-		AddRow("hash-a", "/data/a2", "host-a", int64(1024*1024))
+	dupRows := sqlmock.NewRows([]string{"hash", "path", "hostname", "size", "root_folder"}).
+		AddRow("hash-b", "/data/b1", "host-a", int64(2*1024*1024), "").
+		AddRow("hash-b", "/data/b2", "host-a", int64(2*1024*1024), "").
+		AddRow("hash-a", "/data/a1", "host-a", int64(1024*1024), "").
+		AddRow("hash-a", "/data/a2", "host-a", int64(1024*1024), "")
 
 	mock.ExpectQuery(`(?s)WITH duplicates.*size >= \$2.*LIMIT \$3.*JOIN files.*ORDER BY d.total_size DESC`).
 		WithArgs("host-a", int64(1048576), 2).
 		WillReturnRows(dupRows)
 
-	groups, err := FindDuplicateGroups(context.Background(), db, lower, 1048576, 2)
+	groups, err := FindDuplicateGroups(context.Background(), db, lower, "", DuplicateSizeRules{MinSize: 1048576}, "", 2, nil)
 	if err != nil {
 		t.Fatalf("FindDuplicateGroups error: %v", err)
 	}
@@ -57,6 +59,31 @@ func TestFindDuplicateGroupsRespectsFiltersAndOrdering(t *testing.T) {
 	}
 }
 
+func TestFindDuplicateGroupsUsesLowercasedHostnameEquality(t *testing.T) {
+	db, mock, err := sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherRegexp))
+	if err != nil {
+		t.Fatalf("sqlmock: %v", err)
+	}
+	defer db.Close()
+
+	// A legacy hosts row with a mixed-case hostname must still be queried
+	// against files with the lowercased form and a plain equality.
+	mock.ExpectQuery(`SELECT hostname FROM hosts WHERE LOWER\(hostname\) = LOWER\(\$1\)`).
+		WithArgs("host-a").
+		WillReturnRows(sqlmock.NewRows([]string{"hostname"}).AddRow("Host-A"))
+
+	mock.ExpectQuery(`(?s)WITH duplicates.*AND hostname = \$1.*WHERE f\.hostname = \$1`).
+		WithArgs("host-a").
+		WillReturnRows(sqlmock.NewRows([]string{"hash", "path", "hostname", "size", "root_folder"}))
+
+	if _, err := FindDuplicateGroups(context.Background(), db, "host-a", "", DuplicateSizeRules{}, "", 0, nil); err != nil {
+		t.Fatalf("FindDuplicateGroups error: %v", err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatalf("unmet expectations: %v", err)
+	}
+}
+
 func TestFindDuplicateGroupsSeparatesSameHashDifferentSizes(t *testing.T) {
 	db, mock, err := sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherRegexp))
 	if err != nil {
@@ -74,17 +101,17 @@ func TestFindDuplicateGroupsSeparatesSameHashDifferentSizes(t *testing.T) {
 		WithArgs(lower).
 		WillReturnRows(sqlmock.NewRows([]string{"hostname"}).AddRow("host-a"))
 
-	dupRows := sqlmock.NewRows([]string{"hash", "path", "hostname", "size"}).
-		AddRow("same-hash", "/data/a1", "host-a", int64(10)).
-		AddRow("same-hash", "/data/a2", "host-a", int64(10)).
-		AddRow("same-hash", "/data/b1", "host-a", int64(20)).
-		AddRow("same-hash", "/data/b2", "host-a", int64(20))
+	dupRows := sqlmock.NewRows([]string{"hash", "path", "hostname", "size", "root_folder"}).
+		AddRow("same-hash", "/data/a1", "host-a", int64(10), "").
+		AddRow("same-hash", "/data/a2", "host-a", int64(10), "").
+		AddRow("same-hash", "/data/b1", "host-a", int64(20), "").
+		AddRow("same-hash", "/data/b2", "host-a", int64(20), "")
 
 	mock.ExpectQuery(`(?s)WITH duplicates.*GROUP BY hash, size.*JOIN files f ON f.hash = d.hash AND f.size = d.size`).
 		WithArgs("host-a").
 		WillReturnRows(dupRows)
 
-	groups, err := FindDuplicateGroups(context.Background(), db, lower, 0, 0)
+	groups, err := FindDuplicateGroups(context.Background(), db, lower, "", DuplicateSizeRules{}, "", 0, nil)
 	if err != nil {
 		t.Fatalf("FindDuplicateGroups error: %v", err)
 	}
@@ -107,17 +134,17 @@ func TestFindDuplicateGroupsAcrossHostsWhenHostnameEmpty(t *testing.T) {
 	}
 	defer db.Close()
 
-	dupRows := sqlmock.NewRows([]string{"hash", "path", "hostname", "size"}).
-		AddRow("hash-a", "movie.mkv", "pinky", int64(10*1024*1024*1024)).
-		AddRow("hash-a", "movie.mkv", "rpi4", int64(10*1024*1024*1024)).
-		AddRow("hash-b", "backup.tar", "brain", int64(12*1024*1024*1024)).
-		AddRow("hash-b", "backup.tar", "pinky", int64(12*1024*1024*1024))
+	dupRows := sqlmock.NewRows([]string{"hash", "path", "hostname", "size", "root_folder"}).
+		AddRow("hash-a", "movie.mkv", "pinky", int64(10*1024*1024*1024), "").
+		AddRow("hash-a", "movie.mkv", "rpi4", int64(10*1024*1024*1024), "").
+		AddRow("hash-b", "backup.tar", "brain", int64(12*1024*1024*1024), "").
+		AddRow("hash-b", "backup.tar", "pinky", int64(12*1024*1024*1024), "")
 
-	mock.ExpectQuery(`(?s)WITH duplicates.*WHERE hash IS NOT NULL.*AND hash NOT IN \('TIMEOUT_ERROR', 'HASH_ERROR'\).*AND size >= \$1.*GROUP BY hash, size.*HAVING COUNT\(\*\) > 1.*LIMIT \$2.*JOIN files f ON f.hash = d.hash AND f.size = d.size.*ORDER BY d.total_size DESC, d.hash, d.size, f.hostname, f.path`).
+	mock.ExpectQuery(`(?s)WITH duplicates.*WHERE hash IS NOT NULL\s+AND hash ~ '\^\[0-9a-f\]\{64\}\$'\s+AND size IS NOT NULL.*AND size >= \$1.*GROUP BY hash, size.*HAVING COUNT\(\*\) > 1.*LIMIT \$2.*JOIN files f ON f.hash = d.hash AND f.size = d.size.*ORDER BY d.total_size DESC, d.hash, d.size, f.hostname, f.path`).
 		WithArgs(int64(10*1024*1024*1024), 5).
 		WillReturnRows(dupRows)
 
-	groups, err := FindDuplicateGroups(context.Background(), db, "", 10*1024*1024*1024, 5)
+	groups, err := FindDuplicateGroups(context.Background(), db, "", "", DuplicateSizeRules{MinSize: 10 * 1024 * 1024 * 1024}, "", 5, nil)
 	if err != nil {
 		t.Fatalf("FindDuplicateGroups cross-host error: %v", err)
 	}
@@ -149,23 +176,22 @@ func TestDedupFilesDryRunHandlesSameHashDifferentSizes(t *testing.T) {
 	}
 	lower := strings.ToLower(hostname)
 
+	expectLocalHost(mock, tempDir, "")
 	mock.ExpectQuery(`SELECT hostname FROM hosts WHERE LOWER\(hostname\) = LOWER\(\$1\)`).
 		WithArgs(lower).
 		WillReturnRows(sqlmock.NewRows([]string{"hostname"}).AddRow("host-a"))
 
-	dupRows := sqlmock.NewRows([]string{"hash", "path", "hostname", "size"}).
-		AddRow("partial-hash", "small-a.bin", "host-a", int64(10)).
-		AddRow("partial-hash", "small-b.bin", "host-a", int64(10)).
-		AddRow("partial-hash", "large-a.bin", "host-a", int64(20)).
-		AddRow("partial-hash", "large-b.bin", "host-a", int64(20))
+	dupRows := sqlmock.NewRows([]string{"hash", "path", "hostname", "size", "root_folder"}).
+		AddRow("partial-hash", "small-a.bin", "host-a", int64(10), "").
+		AddRow("partial-hash", "small-b.bin", "host-a", int64(10), "").
+		AddRow("partial-hash", "large-a.bin", "host-a", int64(20), "").
+		AddRow("partial-hash", "large-b.bin", "host-a", int64(20), "")
 
 	mock.ExpectQuery(`(?s)WITH duplicates.*GROUP BY hash, size.*JOIN files f ON f.hash = d.hash AND f.size = d.size`).
 		WithArgs("host-a").
 		WillReturnRows(dupRows)
 
-	mock.ExpectQuery(`SELECT root_path`).
-		WithArgs(lower).
-		WillReturnRows(sqlmock.NewRows([]string{"root_path"}).AddRow(tempDir))
+	expectPathNameHosts(mock)
 
 	err = DedupFiles(context.Background(), db, DedupeOptions{
 		DryRun:        true,
@@ -204,18 +230,17 @@ func TestDedupFilesDryRunSkipsMoves(t *testing.T) {
 	hostname, _ := os.Hostname()
 	lower := strings.ToLower(hostname)
 
+	expectLocalHost(mock, tempDir, "")
 	mock.ExpectQuery("SELECT hostname FROM hosts WHERE LOWER\\(hostname\\) = LOWER\\(\\$1\\)").
 		WithArgs(lower).
 		WillReturnRows(sqlmock.NewRows([]string{"hostname"}).AddRow("host-a"))
 
 	mock.ExpectQuery("WITH duplicates AS").
-		WillReturnRows(sqlmock.NewRows([]string{"hash", "path", "hostname", "size"}).
-			AddRow("h", "a/file1.txt", "host-a", int64(10)).
-			AddRow("h", "a/file2.txt", "host-a", int64(10)))
+		WillReturnRows(sqlmock.NewRows([]string{"hash", "path", "hostname", "size", "root_folder"}).
+			AddRow("h", "a/file1.txt", "host-a", int64(10), "").
+			AddRow("h", "a/file2.txt", "host-a", int64(10), ""))
 
-	mock.ExpectQuery("SELECT root_path").
-		WithArgs(lower).
-		WillReturnRows(sqlmock.NewRows([]string{"root_path"}).AddRow(tempDir))
+	expectPathNameHosts(mock)
 
 	err = DedupFiles(context.Background(), db, DedupeOptions{
 		DryRun:        true,
@@ -272,20 +297,19 @@ func TestDedupFilesMovesAndDeletesFromDB(t *testing.T) {
 	hostname, _ := os.Hostname()
 	lower := strings.ToLower(hostname)
 
+	expectLocalHost(mock, root, "")
 	mock.ExpectQuery("SELECT hostname FROM hosts WHERE LOWER\\(hostname\\) = LOWER\\(\\$1\\)").
 		WithArgs(lower).
 		WillReturnRows(sqlmock.NewRows([]string{"hostname"}).AddRow("host-a"))
 
 	mock.ExpectQuery("WITH duplicates AS").
-		WillReturnRows(sqlmock.NewRows([]string{"hash", "path", "hostname", "size"}).
-			AddRow("hash1", strings.TrimPrefix(moveFile, root+string(os.PathSeparator)), "host-a", int64(4)).
-			AddRow("hash1", strings.TrimPrefix(keepFile, root+string(os.PathSeparator)), "host-a", int64(4)))
+		WillReturnRows(sqlmock.NewRows([]string{"hash", "path", "hostname", "size", "root_folder"}).
+			AddRow("hash1", strings.TrimPrefix(moveFile, root+string(os.PathSeparator)), "host-a", int64(4), "").
+			AddRow("hash1", strings.TrimPrefix(keepFile, root+string(os.PathSeparator)), "host-a", int64(4), ""))
 
-	mock.ExpectQuery("SELECT root_path").
-		WithArgs(lower).
-		WillReturnRows(sqlmock.NewRows([]string{"root_path"}).AddRow(root))
+	expectPathNameHosts(mock)
 
-	mock.ExpectExec("DELETE FROM files").
+	mock.ExpectExec("UPDATE files SET deleted_at = NOW\\(\\)").
 		WithArgs(strings.TrimPrefix(moveFile, root+string(os.PathSeparator)), "host-a").
 		WillReturnResult(sqlmock.NewResult(0, 1))
 
@@ -329,18 +353,15 @@ func TestDedupFilesSkipsGroupWithDestPrefix(t *testing.T) {
 	hostname, _ := os.Hostname()
 	lower := strings.ToLower(hostname)
 
+	expectLocalHost(mock, tempDir, "")
 	mock.ExpectQuery("SELECT hostname FROM hosts WHERE LOWER\\(hostname\\) = LOWER\\(\\$1\\)").
 		WithArgs(lower).
 		WillReturnRows(sqlmock.NewRows([]string{"hostname"}).AddRow("host-a"))
 
 	mock.ExpectQuery("WITH duplicates AS").
-		WillReturnRows(sqlmock.NewRows([]string{"hash", "path", "hostname", "size"}).
-			AddRow("hash1", filepath.Join(destDir, "inside.txt"), "host-a", int64(1)).
-			AddRow("hash1", "/other/outside.txt", "host-a", int64(1)))
-
-	mock.ExpectQuery("SELECT root_path").
-		WithArgs(lower).
-		WillReturnRows(sqlmock.NewRows([]string{"root_path"}).AddRow(tempDir))
+		WillReturnRows(sqlmock.NewRows([]string{"hash", "path", "hostname", "size", "root_folder"}).
+			AddRow("hash1", filepath.Join(destDir, "inside.txt"), "host-a", int64(1), "").
+			AddRow("hash1", "/other/outside.txt", "host-a", int64(1), ""))
 
 	err = DedupFiles(context.Background(), db, DedupeOptions{
 		DryRun:        false,
@@ -387,18 +408,26 @@ func TestMoveDuplicatesDryRunUsesRootFolderAndSkipsChanges(t *testing.T) {
 		WillReturnRows(sqlmock.NewRows([]string{"hash", "path", "hostname", "size", "root_folder"}).
 			AddRow("hash-1", filepath.Base(source1), "host-a", int64(3), root).
 			AddRow("hash-1", filepath.Base(source2), "host-a", int64(3), root))
+	expectPathNameHosts(mock, [3]string{"Backup1", "host-a", `{"paths":{"docs":"` + root + `"}}`})
 
 	logging.InfoLogger = log.New(io.Discard, "", 0)
 	logging.ErrorLogger = log.New(io.Discard, "", 0)
 
-	err = MoveDuplicates(context.Background(), db, DuplicateListOptions{}, MoveOptions{
-		TargetDir: filepath.Join(root, "dupes"),
-		DryRun:    true,
-		Count:     0,
+	out := captureStdout(t, func() {
+		err = MoveDuplicates(context.Background(), db, DuplicateListOptions{}, MoveOptions{
+			TargetDir: filepath.Join(root, "dupes"),
+			DryRun:    true,
+			Count:     0,
+		})
 	})
 	if err != nil {
 		t.Fatalf("MoveDuplicates dry-run error: %v", err)
 	}
+	for _, want := range []string{"Keeping: docs/file1.txt on Backup1", "Would move: docs/file2.txt on Backup1"} {
+		if !strings.Contains(out, want) {
+			t.Fatalf("expected %q in output:\n%s", want, out)
+		}
+	}
 
 	if _, err := os.Stat(filepath.Join(root, "dupes", filepath.Base(source1))); !os.IsNotExist(err) {
 		t.Fatalf("expected no files to be moved in dry-run, stat err: %v", err)
@@ -438,8 +467,9 @@ func TestMoveDuplicatesAcrossHostsMovesOnlyLocalFilesIntoHostFolder(t *testing.T
 		WillReturnRows(sqlmock.NewRows([]string{"hash", "path", "hostname", "size", "root_folder"}).
 			AddRow("hash-1", "movie.mkv", "aa-remote", int64(3), "/remote/media").
 			AddRow("hash-1", "movie.mkv", "zz-local", int64(3), localRoot))
+	expectPathNameHosts(mock)
 
-	mock.ExpectExec("DELETE FROM files").
+	mock.ExpectExec("UPDATE files SET deleted_at = NOW\\(\\)").
 		WithArgs("movie.mkv", "zz-local", localRoot).
 		WillReturnResult(sqlmock.NewResult(0, 1))
 
@@ -469,3 +499,561 @@ func TestMoveDuplicatesAcrossHostsMovesOnlyLocalFilesIntoHostFolder(t *testing.T
 		t.Fatalf("unmet expectations: %v", err)
 	}
 }
+
+func TestDedupFilesKeepsMinCopiesAndReportsCompliantGroups(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("sqlmock: %v", err)
+	}
+	defer db.Close()
+
+	root := t.TempDir()
+	dest := filepath.Join(root, "dest")
+	// disk1 and disk2 hold more files than inbox, so their copies are kept
+	writeFiles(t, root, "filler", "disk1/x.txt", "disk1/y.txt", "disk2/x.txt")
+	writeFiles(t, root, "one", "disk1/a.txt", "disk2/a.txt", "inbox/a.txt")
+	writeFiles(t, root, "two", "disk1/b.txt", "disk2/b.txt")
+
+	expectDedupeQueries(mock, root, sqlmock.NewRows([]string{"hash", "path", "hostname", "size", "root_folder"}).
+		AddRow("hash-a", "disk1/a.txt", "host-a", int64(3), "").
+		AddRow("hash-a", "inbox/a.txt", "host-a", int64(3), "").
+		AddRow("hash-a", "disk2/a.txt", "host-a", int64(3), "").
+		AddRow("hash-b", "disk1/b.txt", "host-a", int64(3), "").
+		AddRow("hash-b", "disk2/b.txt", "host-a", int64(3), ""))
+	mock.ExpectExec("UPDATE files SET deleted_at = NOW\\(\\)").
+		WithArgs("inbox/a.txt", "host-a").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+
+	out := captureStdout(t, func() {
+		err = DedupFiles(context.Background(), db, DedupeOptions{
+			DestDir:   dest,
+			MinCopies: 2,
+		})
+	})
+	if err != nil {
+		t.Fatalf("DedupFiles: %v", err)
+	}
+
+	assertExists(t, filepath.Join(root, "disk1/a.txt"), true)
+	assertExists(t, filepath.Join(root, "disk2/a.txt"), true)
+	assertExists(t, filepath.Join(dest, "inbox/a.txt"), true)
+	assertExists(t, filepath.Join(root, "disk1/b.txt"), true)
+	assertExists(t, filepath.Join(root, "disk2/b.txt"), true)
+	for _, want := range []string{
+		"Potential savings: 3 bytes",
+		"Already compliant: 2 copies, keeping 2",
+		"Processed 1 groups of duplicate files (3 files)",
+		"1 groups already compliant (2 copies or fewer)",
+		"Total space saved: 3 bytes",
+	} {
+		if !strings.Contains(out, want) {
+			t.Fatalf("output does not contain %q:\n%s", want, out)
+		}
+	}
+	if got := strings.Count(out, "Keeping: "); got != 2 {
+		t.Fatalf("expected two kept copies, got %d:\n%s", got, out)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatalf("unmet expectations: %v", err)
+	}
+}
+
+// expectLocalHost expects the lookup of the host row matching the OS
+// hostname, with its deprecated root_path and settings mapping friendly path
+// names to root folders.
+func expectLocalHost(mock sqlmock.Sqlmock, rootPath, settings string) {
+	hostname, _ := os.Hostname()
+	mock.ExpectQuery("SELECT id, name, hostname, ip, root_path, settings, created_at\\s+FROM hosts WHERE LOWER\\(hostname\\)").
+		WithArgs(strings.ToLower(hostname)).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "name", "hostname", "ip", "root_path", "settings", "created_at"}).
+			AddRow(1, "Backup1", "host-a", "", rootPath, []byte(settings), time.Now()))
+}
+
+func TestFindDuplicatesRejectsUnknownFriendlyPath(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("sqlmock: %v", err)
+	}
+	defer db.Close()
+
+	expectLocalHost(mock, "", `{"paths":{"photos":"/data/photos"}}`)
+	err = FindDuplicates(context.Background(), db, DuplicateListOptions{Path: "videos"})
+	if err == nil || !strings.Contains(err.Error(), "friendly path 'videos' not found for server 'Backup1'") {
+		t.Fatalf("expected an unknown friendly path error, got %v", err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatalf("unmet expectations: %v", err)
+	}
+}
+
+func TestDedupFilesPathScopesQueryAndJoinsItsRootFolder(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("sqlmock: %v", err)
+	}
+	defer db.Close()
+
+	photos := t.TempDir()
+	dest := filepath.Join(t.TempDir(), "dest")
+	writeFiles(t, photos, "same", "album/img.jpg", "album/cover.jpg", "inbox/img.jpg")
+	hostname, _ := os.Hostname()
+
+	expectLocalHost(mock, "", `{"paths":{"photos":"`+photos+`"}}`)
+	mock.ExpectQuery("SELECT hostname FROM hosts WHERE LOWER\\(hostname\\) = LOWER\\(\\$1\\)").
+		WithArgs(strings.ToLower(hostname)).
+		WillReturnRows(sqlmock.NewRows([]string{"hostname"}).AddRow("host-a"))
+	// Both the CTE and the outer select are limited to the root folder, and
+	// the host's root_path is never looked up
+	mock.ExpectQuery(`(?s)WITH duplicates AS.*AND hostname = \$1 AND root_folder = \$2.*WHERE f.hostname = \$1 AND f.root_folder = \$2`).
+		WithArgs("host-a", photos).
+		WillReturnRows(sqlmock.NewRows([]string{"hash", "path", "hostname", "size", "root_folder"}).
+			AddRow("hash-1", "album/img.jpg", "host-a", int64(4), photos).
+			AddRow("hash-1", "inbox/img.jpg", "host-a", int64(4), photos))
+	expectPathNameHosts(mock)
+	mock.ExpectExec("UPDATE files SET deleted_at = NOW\\(\\)").
+		WithArgs("inbox/img.jpg", "host-a").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+
+	captureStdout(t, func() {
+		err = DedupFiles(context.Background(), db, DedupeOptions{DestDir: dest, Path: "photos"})
+	})
+	if err != nil {
+		t.Fatalf("DedupFiles: %v", err)
+	}
+	assertExists(t, filepath.Join(photos, "album/img.jpg"), true)
+	assertExists(t, filepath.Join(photos, "inbox/img.jpg"), false)
+	assertExists(t, filepath.Join(dest, "inbox/img.jpg"), true)
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatalf("unmet expectations: %v", err)
+	}
+}
+
+func TestDedupFilesFindsHostByHostnameAndUsesEachRootFolder(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("sqlmock: %v", err)
+	}
+	defer db.Close()
+
+	// The host is named Backup1, not after its hostname, and its copies
+	// live under two friendly path roots, neither of them its root_path
+	photos, archive := t.TempDir(), t.TempDir()
+	dest := filepath.Join(t.TempDir(), "dest")
+	writeFiles(t, photos, "same", "album/img.jpg", "album/cover.jpg")
+	writeFiles(t, archive, "same", "old/img.jpg")
+	hostname, _ := os.Hostname()
+	lower := strings.ToLower(hostname)
+	if lower == "backup1" {
+		t.Skip("the OS hostname matches the host name of the test")
+	}
+
+	expectLocalHost(mock, "/deprecated/root", `{"paths":{"photos":"`+photos+`","archive":"`+archive+`"}}`)
+	mock.ExpectQuery("SELECT hostname FROM hosts WHERE LOWER\\(hostname\\) = LOWER\\(\\$1\\)").
+		WithArgs(lower).
+		WillReturnRows(sqlmock.NewRows([]string{"hostname"}).AddRow("host-a"))
+	mock.ExpectQuery("WITH duplicates AS").
+		WillReturnRows(sqlmock.NewRows([]string{"hash", "path", "hostname", "size", "root_folder"}).
+			AddRow("hash-1", "album/img.jpg", "host-a", int64(4), photos).
+			AddRow("hash-1", "old/img.jpg", "host-a", int64(4), archive))
+	expectPathNameHosts(mock, [3]string{"Backup1", "host-a", `{"paths":{"photos":"` + photos + `","archive":"` + archive + `"}}`})
+	mock.ExpectExec("UPDATE files SET deleted_at = NOW\\(\\)").
+		WithArgs("old/img.jpg", "host-a").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+
+	out := captureStdout(t, func() {
+		err = DedupFiles(context.Background(), db, DedupeOptions{DestDir: dest})
+	})
+	if err != nil {
+		t.Fatalf("DedupFiles: %v", err)
+	}
+	assertExists(t, filepath.Join(photos, "album/img.jpg"), true)
+	assertExists(t, filepath.Join(archive, "old/img.jpg"), false)
+	assertExists(t, filepath.Join(dest, "old/img.jpg"), true)
+	for _, want := range []string{"Keeping: photos/album/img.jpg on Backup1", "Moving: archive/old/img.jpg on Backup1"} {
+		if !strings.Contains(out, want) {
+			t.Fatalf("output does not contain %q:\n%s", want, out)
+		}
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatalf("unmet expectations: %v", err)
+	}
+}
+
+func TestDedupFilesSoftDeletesMovedRowsByHostname(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("sqlmock: %v", err)
+	}
+	defer db.Close()
+
+	root := t.TempDir()
+	dest := filepath.Join(root, "dest")
+	writeFiles(t, root, "same", "keep/a.txt", "keep/other.txt", "move/a.txt", "keep/b.txt", "move/b.txt")
+
+	expectDedupeQueries(mock, root, sqlmock.NewRows([]string{"hash", "path", "hostname", "size", "root_folder"}).
+		AddRow("hash-a", "move/a.txt", "Host-A", int64(4), "").
+		AddRow("hash-a", "keep/a.txt", "Host-A", int64(4), "").
+		AddRow("hash-b", "move/b.txt", "Host-A", int64(4), "").
+		AddRow("hash-b", "keep/b.txt", "Host-A", int64(4), ""))
+	// files has no host_id column: rows are matched on path and hostname
+	softDelete := `^\s*UPDATE files SET deleted_at = NOW\(\)\s+WHERE deleted_at IS NULL AND path = \$1 AND hostname = \$2\s*$`
+	mock.ExpectExec(softDelete).
+		WithArgs("move/a.txt", "Host-A").
+		WillReturnError(errors.New("connection reset"))
+	mock.ExpectExec(softDelete).
+		WithArgs("move/b.txt", "Host-A").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+
+	stats := &RunStats{}
+	out := captureStdout(t, func() {
+		err = DedupFiles(context.Background(), db, DedupeOptions{DestDir: dest, Stats: stats})
+	})
+	if err != nil {
+		t.Fatalf("DedupFiles: %v", err)
+	}
+	assertExists(t, filepath.Join(dest, "move/a.txt"), true)
+	assertExists(t, filepath.Join(dest, "move/b.txt"), true)
+	if !strings.Contains(out, "Failed to update 1 rows of moved files in the database") {
+		t.Fatalf("expected the failed update in the summary:\n%s", out)
+	}
+	if counters := stats.Counters(); counters["db_errors"] != 1 {
+		t.Fatalf("unexpected counters %v", counters)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatalf("unmet expectations: %v", err)
+	}
+}
+
+func TestDedupFilesMinAgeLeavesRecentCopiesAndTheirRows(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("sqlmock: %v", err)
+	}
+	defer db.Close()
+
+	root := t.TempDir()
+	dest := filepath.Join(root, "dest")
+	writeFiles(t, root, "same", "keep/a.txt", "keep/other.txt", "move/a.txt", "keep/b.txt", "inbox/b.txt")
+	old := time.Now().Add(-2 * time.Hour)
+	if err := os.Chtimes(filepath.Join(root, "move/a.txt"), old, old); err != nil {
+		t.Fatalf("chtimes: %v", err)
+	}
+
+	expectDedupeQueries(mock, root, sqlmock.NewRows([]string{"hash", "path", "hostname", "size", "root_folder"}).
+		AddRow("hash-a", "move/a.txt", "Host-A", int64(4), "").
+		AddRow("hash-a", "keep/a.txt", "Host-A", int64(4), "").
+		AddRow("hash-b", "inbox/b.txt", "Host-A", int64(4), "").
+		AddRow("hash-b", "keep/b.txt", "Host-A", int64(4), ""))
+	// Only the copy older than --min-age is moved; inbox/b.txt keeps its row
+	mock.ExpectExec(`UPDATE files SET deleted_at = NOW\(\)`).
+		WithArgs("move/a.txt", "Host-A").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+
+	captureStdout(t, func() {
+		err = DedupFiles(context.Background(), db, DedupeOptions{DestDir: dest, MinAge: time.Hour})
+	})
+	if err != nil {
+		t.Fatalf("DedupFiles: %v", err)
+	}
+	assertExists(t, filepath.Join(dest, "move/a.txt"), true)
+	assertExists(t, filepath.Join(root, "inbox/b.txt"), true)
+	assertExists(t, filepath.Join(dest, "inbox/b.txt"), false)
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatalf("unmet expectations: %v", err)
+	}
+}
+
+func TestDedupFilesMaxBytesFinishesTheGroupReachingTheCap(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("sqlmock: %v", err)
+	}
+	defer db.Close()
+
+	root := t.TempDir()
+	dest := filepath.Join(root, "dest")
+	writeFiles(t, root, "same", "keep/a.txt", "keep/b.txt", "keep/other.txt", "move/a.txt", "move/a2.txt", "move/b.txt")
+	groups := func() *sqlmock.Rows {
+		return sqlmock.NewRows([]string{"hash", "path", "hostname", "size", "root_folder"}).
+			AddRow("hash-a", "move/a.txt", "Host-A", int64(4), "").
+			AddRow("hash-a", "move/a2.txt", "Host-A", int64(4), "").
+			AddRow("hash-a", "keep/a.txt", "Host-A", int64(4), "").
+			AddRow("hash-b", "move/b.txt", "Host-A", int64(4), "").
+			AddRow("hash-b", "keep/b.txt", "Host-A", int64(4), "")
+	}
+
+	// The dry run stops where the real run does: after the first group,
+	// both of whose copies are planned although the first reaches the cap
+	expectDedupeQueries(mock, root, groups())
+	out := captureStdout(t, func() {
+		err = DedupFiles(context.Background(), db, DedupeOptions{DestDir: dest, DryRun: true, MaxBytes: 4})
+	})
+	if err != nil {
+		t.Fatalf("DedupFiles --dry-run: %v", err)
+	}
+	if strings.Contains(out, "move/b.txt") || !strings.Contains(out, "Would stop at --max-bytes (4 bytes) after 8 bytes; 1 groups with 4 bytes of duplicates remain") {
+		t.Fatalf("unexpected dry run:\n%s", out)
+	}
+
+	expectDedupeQueries(mock, root, groups())
+	for _, path := range []string{"move/a.txt", "move/a2.txt"} {
+		mock.ExpectExec(`UPDATE files SET deleted_at = NOW\(\)`).
+			WithArgs(path, "Host-A").
+			WillReturnResult(sqlmock.NewResult(0, 1))
+	}
+	out = captureStdout(t, func() {
+		err = DedupFiles(context.Background(), db, DedupeOptions{DestDir: dest, MaxBytes: 4})
+	})
+	if err != nil {
+		t.Fatalf("DedupFiles: %v", err)
+	}
+	assertExists(t, filepath.Join(dest, "move/a2.txt"), true)
+	assertExists(t, filepath.Join(root, "move/b.txt"), true)
+	if !strings.Contains(out, "Stopped at --max-bytes (4 bytes) after 8 bytes; 1 groups with 4 bytes of duplicates remain") {
+		t.Fatalf("expected the cutoff in the summary:\n%s", out)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatalf("unmet expectations: %v", err)
+	}
+}
+
+func TestDedupFilesSkipsACopyThatFailsToMoveAndGoesOn(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("sqlmock: %v", err)
+	}
+	defer db.Close()
+
+	root := t.TempDir()
+	dest := filepath.Join(root, "dest")
+	writeFiles(t, root, "same", "keep/a.txt", "keep/b.txt", "keep/other.txt", "move/a.txt", "move/b.txt")
+	// The destination is on another mount, and rsync fails for one copy
+	rsynced := simulateCrossDevice(t, func(src string) error {
+		if strings.HasSuffix(src, "move/a.txt") {
+			return errors.New("exit status 11")
+		}
+		return nil
+	})
+
+	expectDedupeQueries(mock, root, sqlmock.NewRows([]string{"hash", "path", "hostname", "size", "root_folder"}).
+		AddRow("hash-a", "move/a.txt", "Host-A", int64(4), "").
+		AddRow("hash-a", "keep/a.txt", "Host-A", int64(4), "").
+		AddRow("hash-b", "move/b.txt", "Host-A", int64(4), "").
+		AddRow("hash-b", "keep/b.txt", "Host-A", int64(4), ""))
+	// Only the row of the copy that moved is soft-deleted
+	mock.ExpectExec(`UPDATE files SET deleted_at = NOW\(\)`).
+		WithArgs("move/b.txt", "Host-A").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+
+	stats := &RunStats{}
+	out := captureStdout(t, func() {
+		err = DedupFiles(context.Background(), db, DedupeOptions{DestDir: dest, Stats: stats})
+	})
+	if err != nil {
+		t.Fatalf("DedupFiles: %v", err)
+	}
+	if len(*rsynced) != 2 {
+		t.Fatalf("expected both moves to fall back to rsync, got %v", *rsynced)
+	}
+	assertExists(t, filepath.Join(root, "move/a.txt"), true)
+	assertExists(t, filepath.Join(dest, "move/b.txt"), true)
+	assertExists(t, filepath.Join(dest, groupJournalFile), false)
+	if !strings.Contains(out, "Failed to move 1 files; they were left in place with their rows") ||
+		!strings.Contains(out, "Total space saved: 4 bytes") {
+		t.Fatalf("unexpected summary:\n%s", out)
+	}
+	if counters := stats.Counters(); counters["move_errors"] != 1 {
+		t.Fatalf("unexpected counters %v", counters)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatalf("unmet expectations: %v", err)
+	}
+}
+
+func TestCheckMinAge(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "f")
+	if err := os.WriteFile(path, []byte("x"), 0644); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatalf("stat: %v", err)
+	}
+	if err := checkMinAge(info, 0); err != nil {
+		t.Fatalf("no --min-age: %v", err)
+	}
+	if err := checkMinAge(info, time.Hour); err == nil || !strings.Contains(err.Error(), "too new") {
+		t.Fatalf("expected a too new error, got %v", err)
+	}
+}
+
+func TestFindDuplicatesIgnoreEmptyCountsFilteredGroups(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("sqlmock: %v", err)
+	}
+	defer db.Close()
+
+	// Without --min-size, --ignore-empty still leaves empty files out
+	mock.ExpectQuery(`(?s)WITH duplicates AS.*AND size > 0\s+GROUP BY hash, size, hash_algo`).
+		WithArgs().
+		WillReturnRows(sqlmock.NewRows([]string{"hash", "path", "hostname", "size", "root_folder"}).
+			AddRow("hash-a", "a/img.jpg", "host-a", int64(4096), "/data").
+			AddRow("hash-a", "b/img.jpg", "host-b", int64(4096), "/data"))
+	mock.ExpectQuery(`(?s)SELECT COUNT\(\*\) FROM \(.*AND NOT \(size > 0\)\s+GROUP BY hash, size, hash_algo\s+HAVING COUNT\(\*\) > 1\s+\) filtered`).
+		WithArgs().
+		WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(3))
+	expectPathNameHosts(mock)
+
+	out := captureStdout(t, func() {
+		err = FindDuplicates(context.Background(), db, DuplicateListOptions{IgnoreEmpty: true})
+	})
+	if err != nil {
+		t.Fatalf("FindDuplicates: %v", err)
+	}
+	if !strings.Contains(out, "Found 1 groups") || !strings.Contains(out, "3 duplicate groups filtered out by the size rules") {
+		t.Fatalf("expected the filtered groups in the summary:\n%s", out)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatalf("unmet expectations: %v", err)
+	}
+}
+
+func TestMoveDuplicatesMinSizeCountsFilteredGroups(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("sqlmock: %v", err)
+	}
+	defer db.Close()
+
+	hostname, _ := os.Hostname()
+	mock.ExpectQuery("SELECT hostname FROM hosts WHERE LOWER\\(hostname\\) = LOWER\\(\\$1\\)").
+		WithArgs(strings.ToLower(hostname)).
+		WillReturnRows(sqlmock.NewRows([]string{"hostname"}).AddRow("host-a"))
+	mock.ExpectQuery(`SELECT COUNT\(\*\) FROM \(.*AND NOT \(size >= \$1\)`).
+		WithArgs(int64(4096)).
+		WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(2))
+	mock.ExpectQuery(`WITH duplicate_hashes AS.*AND size >= \$1`).
+		WithArgs(int64(4096)).
+		WillReturnRows(sqlmock.NewRows([]string{"hash", "path", "hostname", "size", "root_folder"}))
+
+	stats := &RunStats{}
+	out := captureStdout(t, func() {
+		err = MoveDuplicates(context.Background(), db, DuplicateListOptions{MinSize: 4096}, MoveOptions{
+			TargetDir: filepath.Join(t.TempDir(), "dupes"),
+			DryRun:    true,
+			Stats:     stats,
+		})
+	})
+	if err != nil {
+		t.Fatalf("MoveDuplicates: %v", err)
+	}
+	if !strings.Contains(out, "2 duplicate groups filtered out by the size rules") {
+		t.Fatalf("expected the filtered groups in the summary:\n%s", out)
+	}
+	if counters := stats.Counters(); counters["size_filtered"] != 2 {
+		t.Fatalf("unexpected counters %v", counters)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatalf("unmet expectations: %v", err)
+	}
+}
+
+func TestFindDuplicateGroupsSortsGroupsAndFiles(t *testing.T) {
+	tests := []struct {
+		sort   DuplicateSort
+		groups string // ORDER BY of the duplicates CTE, before its LIMIT
+		rows   string // ORDER BY of the files
+	}{
+		{"", `total_size DESC, hash, size`, `d\.total_size DESC, d\.hash, d\.size, f\.hostname, f\.path`},
+		{SortByCount, `count DESC, total_size DESC, hash, size`, `d\.count DESC, d\.total_size DESC, d\.hash, d\.size, f\.hostname, f\.path`},
+		{SortByPath, `first_path, hash, size`, `d\.first_path, d\.hash, d\.size, f\.path, f\.hostname`},
+		{SortBySavings, `total_size - size DESC, hash, size`, `d\.total_size - d\.size DESC, d\.hash, d\.size, f\.hostname, f\.path`},
+	}
+	for _, tt := range tests {
+		db, mock, err := sqlmock.New()
+		if err != nil {
+			t.Fatalf("sqlmock: %v", err)
+		}
+		mock.ExpectQuery(`(?s)MIN\(path\) as first_path.*HAVING COUNT\(\*\) > 1\s+ORDER BY ` + tt.groups + ` LIMIT \$1.*ORDER BY ` + tt.rows + `\s*$`).
+			WithArgs(20).
+			WillReturnRows(sqlmock.NewRows([]string{"hash", "path", "hostname", "size", "root_folder"}).
+				AddRow("hash-a", "a.txt", "host-a", int64(1), "/data").
+				AddRow("hash-a", "b.txt", "host-b", int64(1), "/data"))
+
+		groups, err := FindDuplicateGroups(context.Background(), db, "", "", DuplicateSizeRules{}, tt.sort, 20, nil)
+		if err != nil {
+			t.Fatalf("FindDuplicateGroups(%q): %v", tt.sort, err)
+		}
+		if len(groups) != 1 {
+			t.Fatalf("FindDuplicateGroups(%q) = %+v", tt.sort, groups)
+		}
+		if err := mock.ExpectationsWereMet(); err != nil {
+			t.Fatalf("sort %q: unmet expectations: %v", tt.sort, err)
+		}
+		db.Close()
+	}
+
+	if _, err := ParseDuplicateSort("largest"); err == nil || !strings.Contains(err.Error(), "invalid value for --sort") {
+		t.Fatalf("expected an invalid --sort error, got %v", err)
+	}
+}
+
+func TestDuplicateQueriesCountHardLinksOnce(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("sqlmock: %v", err)
+	}
+	defer db.Close()
+
+	// Both the groups and their files leave out all but the first link of
+	// an inode; rows without an inode compare NULL and always count
+	linked := func(alias string) string {
+		return `NOT EXISTS \(SELECT 1 FROM files hl WHERE hl\.hostname = ` + alias + `\.hostname\s+AND hl\.device = ` + alias + `\.device AND hl\.inode = ` + alias + `\.inode\s+AND hl\.hash = ` + alias + `\.hash AND hl\.path < ` + alias + `\.path AND hl\.deleted_at IS NULL\)`
+	}
+	mock.ExpectQuery(`(?s)WITH duplicates AS.*` + linked("files") + `\s+GROUP BY.*JOIN files f ON .*` + linked("f")).
+		WillReturnRows(sqlmock.NewRows([]string{"hash", "path", "hostname", "size", "root_folder"}))
+
+	groups, err := FindDuplicateGroups(context.Background(), db, "", "", DuplicateSizeRules{}, SortBySize, 0, nil)
+	if err != nil || len(groups) != 0 {
+		t.Fatalf("FindDuplicateGroups = %+v, %v", groups, err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatalf("unmet expectations: %v", err)
+	}
+}
+
+func TestDedupFilesLeavesHardLinksOfTheKeptCopy(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("sqlmock: %v", err)
+	}
+	defer db.Close()
+
+	root := t.TempDir()
+	dest := filepath.Join(root, "dest")
+	writeFiles(t, root, "same", "keep/a.txt", "keep/other.txt")
+	if err := os.MkdirAll(filepath.Join(root, "link"), 0755); err != nil {
+		t.Fatalf("mkdir: %v", err)
+	}
+	if err := os.Link(filepath.Join(root, "keep/a.txt"), filepath.Join(root, "link/a.txt")); err != nil {
+		t.Skipf("hard links unsupported: %v", err)
+	}
+
+	// Rows indexed before the inode columns still list both links
+	expectDedupeQueries(mock, root, sqlmock.NewRows([]string{"hash", "path", "hostname", "size", "root_folder"}).
+		AddRow("hash-a", "link/a.txt", "Host-A", int64(4), "").
+		AddRow("hash-a", "keep/a.txt", "Host-A", int64(4), ""))
+
+	captureStdout(t, func() {
+		err = DedupFiles(context.Background(), db, DedupeOptions{DestDir: dest})
+	})
+	if err != nil {
+		t.Fatalf("DedupFiles: %v", err)
+	}
+	assertExists(t, filepath.Join(root, "link/a.txt"), true)
+	assertExists(t, filepath.Join(dest, "link/a.txt"), false)
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatalf("unmet expectations: %v", err)
+	}
+}
@@ -0,0 +1,105 @@
+package files
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+)
+
+// PathExcludes are the --exclude globs of list-dupes and move-dupes. Rows
+// whose path matches one are left out of duplicate groups, so they are never
+// listed, kept or moved. files import matches its --exclude and --include
+// globs the same way, against paths relative to --source.
+//
+// A pattern without a slash, like *.pkg or Thumbs.db, matches any element of
+// the path, so node_modules excludes everything under such a directory. A
+// pattern with a slash matches the whole path relative to its root folder, or
+// with a leading slash the absolute path; ** in it matches any number of
+// directories. Elements are matched with filepath.Match.
+type PathExcludes []string
+
+// ParsePathExcludes checks the syntax of patterns and returns them cleaned.
+// A trailing slash is dropped: a directory matches the same way as a file.
+func ParsePathExcludes(patterns []string) (PathExcludes, error) {
+	return parsePathGlobs("--exclude", patterns)
+}
+
+// ParsePathIncludes is ParsePathExcludes for the --include globs of files
+// import.
+func ParsePathIncludes(patterns []string) (PathExcludes, error) {
+	return parsePathGlobs("--include", patterns)
+}
+
+func parsePathGlobs(flag string, patterns []string) (PathExcludes, error) {
+	var globs PathExcludes
+	for _, pattern := range patterns {
+		cleaned := strings.TrimSuffix(strings.TrimSpace(pattern), "/")
+		if cleaned == "" {
+			return nil, fmt.Errorf("invalid value for %s: %q", flag, pattern)
+		}
+		for _, elem := range strings.Split(cleaned, "/") {
+			if _, err := filepath.Match(elem, ""); err != nil {
+				return nil, fmt.Errorf("invalid value for %s: %q: %v", flag, pattern, err)
+			}
+		}
+		globs = append(globs, cleaned)
+	}
+	return globs, nil
+}
+
+// Match reports whether the file at path, relative to rootFolder unless it is
+// absolute (legacy rows), matches one of the patterns.
+func (e PathExcludes) Match(rootFolder, path string) bool {
+	if len(e) == 0 {
+		return false
+	}
+	fullPath := path
+	if !filepath.IsAbs(path) {
+		fullPath = filepath.Join(rootFolder, path)
+	}
+	relElems := strings.Split(strings.TrimPrefix(filepath.Clean(path), "/"), "/")
+	fullElems := strings.Split(strings.TrimPrefix(fullPath, "/"), "/")
+
+	for _, pattern := range e {
+		switch {
+		case strings.HasPrefix(pattern, "/"):
+			if matchGlobElems(strings.Split(pattern[1:], "/"), fullElems) {
+				return true
+			}
+		case strings.Contains(pattern, "/"):
+			if matchGlobElems(strings.Split(pattern, "/"), relElems) {
+				return true
+			}
+		default:
+			for _, elem := range relElems {
+				if ok, _ := filepath.Match(pattern, elem); ok {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
+// matchGlobElems matches path elements against pattern elements, where a **
+// element matches zero or more path elements.
+func matchGlobElems(pattern, elems []string) bool {
+	for len(pattern) > 0 {
+		if pattern[0] == "**" {
+			for i := 0; i <= len(elems); i++ {
+				if matchGlobElems(pattern[1:], elems[i:]) {
+					return true
+				}
+			}
+			return false
+		}
+		if len(elems) == 0 {
+			return false
+		}
+		if ok, _ := filepath.Match(pattern[0], elems[0]); !ok {
+			return false
+		}
+		pattern, elems = pattern[1:], elems[1:]
+	}
+	return len(elems) == 0
+}
@@ -0,0 +1,170 @@
+package files
+
+import (
+	"context"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"deduplicator/logging"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+func TestPathExcludesMatch(t *testing.T) {
+	excludes, err := ParsePathExcludes([]string{
+		"*.pkg",
+		"Thumbs.db",
+		"node_modules/",
+		"photos/**/.cache/**",
+		"**/build/*.o",
+		"/mnt/scratch/**",
+	})
+	if err != nil {
+		t.Fatalf("ParsePathExcludes: %v", err)
+	}
+
+	tests := []struct {
+		root, path string
+		want       bool
+	}{
+		{"/data", "installers/tool.pkg", true},
+		{"/data", "bundles/App.pkg/Contents/Info.plist", true},
+		{"/data", "photos/2021/Thumbs.db", true},
+		{"/data", "photos/2021/Thumbs.db.jpg", false},
+		{"/data", "code/app/node_modules/left-pad/index.js", true},
+		{"/data", "code/app/node_modules_backup/index.js", false},
+		// ** matches any number of directories, including none
+		{"/data", "photos/.cache/thumb.jpg", true},
+		{"/data", "photos/2021/06/.cache/thumb.jpg", true},
+		{"/data", "music/.cache/thumb.jpg", false},
+		{"/data", "build/main.o", true},
+		{"/data", "code/a/b/build/main.o", true},
+		{"/data", "code/a/b/build/sub/main.o", false},
+		// A leading slash matches the absolute path
+		{"/mnt/scratch", "deep/nested/file.bin", true},
+		{"/mnt", "scratch/file.bin", true},
+		{"/mnt/scratchpad", "file.bin", false},
+		// Legacy rows store absolute paths without a root folder
+		{"", "/data/code/node_modules/x.js", true},
+		{"", "/mnt/scratch/file.bin", true},
+		{"/data", "photos/2021/img.jpg", false},
+	}
+	for _, tt := range tests {
+		if got := excludes.Match(tt.root, tt.path); got != tt.want {
+			t.Errorf("Match(%q, %q) = %v, want %v", tt.root, tt.path, got, tt.want)
+		}
+	}
+	if PathExcludes(nil).Match("/data", "x.pkg") {
+		t.Error("no patterns should match nothing")
+	}
+}
+
+func TestParsePathExcludesRejectsBadPatterns(t *testing.T) {
+	for _, pattern := range []string{"", "/", "photos/[a-/x"} {
+		if _, err := ParsePathExcludes([]string{pattern}); err == nil {
+			t.Errorf("ParsePathExcludes(%q) should fail", pattern)
+		}
+	}
+}
+
+func TestFindDuplicateGroupsDropsGroupsEmptiedByExclude(t *testing.T) {
+	db, mock, err := sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherRegexp))
+	if err != nil {
+		t.Fatalf("sqlmock: %v", err)
+	}
+	defer db.Close()
+
+	// --count is applied after exclusion, so the query has no LIMIT
+	mock.ExpectQuery(`(?s)WITH duplicates.*HAVING COUNT\(\*\) > 1\s+ORDER BY total_size DESC, hash, size\s+\)`).
+		WithArgs().
+		WillReturnRows(sqlmock.NewRows([]string{"hash", "path", "hostname", "size", "root_folder"}).
+			AddRow("h1", "a/tool.pkg", "host-a", int64(50), "/data").
+			AddRow("h1", "b/tool.pkg", "host-b", int64(50), "/data").
+			AddRow("h2", "app/node_modules/lib/x.js", "host-a", int64(40), "/data").
+			AddRow("h2", "vendor/x.js", "host-a", int64(40), "/data").
+			AddRow("h3", "photos/2021/.cache/t.jpg", "host-a", int64(30), "/data").
+			AddRow("h3", "photos/2021/t.jpg", "host-a", int64(30), "/data").
+			AddRow("h3", "backup/t.jpg", "host-b", int64(30), "/data").
+			AddRow("h4", "x.bin", "host-a", int64(20), "/data").
+			AddRow("h4", "y.bin", "host-b", int64(20), "/data").
+			AddRow("h5", "p.bin", "host-a", int64(10), "/data").
+			AddRow("h5", "q.bin", "host-b", int64(10), "/data"))
+
+	exclude, err := ParsePathExcludes([]string{"*.pkg", "node_modules", "photos/**/.cache/**"})
+	if err != nil {
+		t.Fatalf("ParsePathExcludes: %v", err)
+	}
+	groups, err := FindDuplicateGroups(context.Background(), db, "", "", DuplicateSizeRules{}, "", 2, exclude)
+	if err != nil {
+		t.Fatalf("FindDuplicateGroups: %v", err)
+	}
+	var got []string
+	for _, g := range groups {
+		got = append(got, g.Hash+":"+strings.Join(g.Files, ","))
+	}
+	want := []string{"h3:photos/2021/t.jpg,backup/t.jpg", "h4:x.bin,y.bin"}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("groups = %v, want %v", got, want)
+	}
+	if groups[0].TotalSize != 60 {
+		t.Fatalf("TotalSize = %d, want only the two remaining copies", groups[0].TotalSize)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatalf("unmet expectations: %v", err)
+	}
+}
+
+func TestMoveDuplicatesNeverKeepsOrMovesExcludedFiles(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("sqlmock: %v", err)
+	}
+	defer db.Close()
+
+	root := t.TempDir()
+	writeFiles(t, root, "dup", "a/file1.txt", "b/file2.txt", "a/app/node_modules/file1.txt", "thumbs/one.db", "thumbs/Thumbs.db")
+	hostname, _ := os.Hostname()
+
+	mock.ExpectQuery("SELECT hostname FROM hosts WHERE LOWER\\(hostname\\) = LOWER\\(\\$1\\)").
+		WithArgs(strings.ToLower(hostname)).
+		WillReturnRows(sqlmock.NewRows([]string{"hostname"}).AddRow("host-a"))
+	mock.ExpectQuery("WITH duplicate_hashes AS").
+		WillReturnRows(sqlmock.NewRows([]string{"hash", "path", "hostname", "size", "root_folder"}).
+			// Sorted first, the node_modules copy would be the keeper
+			AddRow("hash-1", "a/app/node_modules/file1.txt", "host-a", int64(3), root).
+			AddRow("hash-1", "a/file1.txt", "host-a", int64(3), root).
+			AddRow("hash-1", "b/file2.txt", "host-a", int64(3), root).
+			AddRow("hash-2", "thumbs/Thumbs.db", "host-a", int64(3), root).
+			AddRow("hash-2", "thumbs/one.db", "host-a", int64(3), root))
+	expectPathNameHosts(mock, [3]string{"Backup1", "host-a", `{"paths":{"docs":"` + root + `"}}`})
+
+	logging.InfoLogger = log.New(io.Discard, "", 0)
+	logging.ErrorLogger = log.New(io.Discard, "", 0)
+
+	exclude, _ := ParsePathExcludes([]string{"node_modules/", "Thumbs.db"})
+	out := captureStdout(t, func() {
+		err = MoveDuplicates(context.Background(), db, DuplicateListOptions{Exclude: exclude}, MoveOptions{
+			TargetDir: filepath.Join(root, "dupes"),
+			DryRun:    true,
+		})
+	})
+	if err != nil {
+		t.Fatalf("MoveDuplicates: %v", err)
+	}
+	for _, want := range []string{"Keeping: docs/a/file1.txt on Backup1", "Would move: docs/b/file2.txt on Backup1", "Would move 1 files"} {
+		if !strings.Contains(out, want) {
+			t.Fatalf("expected %q in output:\n%s", want, out)
+		}
+	}
+	if strings.Contains(out, "node_modules") || strings.Contains(out, "hash-2") {
+		t.Fatalf("excluded files and the group they emptied should not be shown:\n%s", out)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatalf("unmet expectations: %v", err)
+	}
+}
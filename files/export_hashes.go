@@ -0,0 +1,322 @@
+package files
+
+import (
+	"bufio"
+	"context"
+	"database/sql"
+	"encoding/binary"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"path/filepath"
+	"strings"
+
+	"deduplicator/db"
+	"deduplicator/logging"
+
+	"github.com/lib/pq"
+)
+
+// Binary hash export format
+//
+// A binary export starts with the 8-byte magic "DDHASH1\n" and is followed by
+// one record per hash until EOF. A record is:
+//
+//	uvarint  length of the hash
+//	[]byte   the hash as stored in files.hash (lowercase hex)
+//	uvarint  length of the path
+//	[]byte   the canonical absolute path (UTF-8)
+//
+// Lengths use encoding/binary's unsigned varint encoding, so a typical SHA256
+// record costs two length bytes on top of the hash and path.
+const hashExportMagic = "DDHASH1\n"
+
+// maxHashRecordField bounds a single hash or path length when reading a
+// binary export, so a corrupt file cannot trigger a huge allocation.
+const maxHashRecordField = 1 << 16
+
+// defaultImportHashesBatchSize is how many hashes are marked per UPDATE.
+const defaultImportHashesBatchSize = 1000
+
+type hashRecordWriter interface {
+	WriteRecord(hash, path string) error
+}
+
+type csvHashWriter struct {
+	w *csv.Writer
+}
+
+func (c *csvHashWriter) WriteRecord(hash, path string) error {
+	if err := c.w.Write([]string{hash, path}); err != nil {
+		return err
+	}
+	c.w.Flush()
+	return c.w.Error()
+}
+
+type binaryHashWriter struct {
+	w   io.Writer
+	buf []byte
+}
+
+func (b *binaryHashWriter) WriteRecord(hash, path string) error {
+	b.buf = b.buf[:0]
+	b.buf = binary.AppendUvarint(b.buf, uint64(len(hash)))
+	b.buf = append(b.buf, hash...)
+	b.buf = binary.AppendUvarint(b.buf, uint64(len(path)))
+	b.buf = append(b.buf, path...)
+	_, err := b.w.Write(b.buf)
+	return err
+}
+
+func newHashRecordWriter(w io.Writer, format string) (hashRecordWriter, error) {
+	switch format {
+	case "", "csv":
+		cw := csv.NewWriter(w)
+		if err := cw.Write([]string{"hash", "path"}); err != nil {
+			return nil, err
+		}
+		return &csvHashWriter{w: cw}, nil
+	case "binary":
+		if _, err := io.WriteString(w, hashExportMagic); err != nil {
+			return nil, err
+		}
+		return &binaryHashWriter{w: w}, nil
+	default:
+		return nil, fmt.Errorf("invalid value for --format: %q (use csv or binary)", format)
+	}
+}
+
+// ExportHashes writes a hash -> canonical path mapping for the hashed files of
+// a host to w. The canonical path of a hash is the lexicographically smallest
+// full path holding it. Rows are written as they are read from the database,
+// so the export never holds the whole set in memory. It returns the number of
+// records written.
+func ExportHashes(ctx context.Context, database *sql.DB, opts ExportHashesOptions, w io.Writer) (int, error) {
+	host, err := db.GetHost(database, opts.Server)
+	if err != nil {
+		return 0, fmt.Errorf("server not found: %s", opts.Server)
+	}
+
+	args := []interface{}{normalizeHostname(host.Hostname)}
+	query := `
+		SELECT DISTINCT ON (hash) hash, COALESCE(root_folder, ''), path
+		FROM files
+		WHERE hostname = $1 AND hash IS NOT NULL AND ` + NotDeleted
+	if opts.Path != "" {
+		paths, err := host.GetPaths()
+		if err != nil {
+			return 0, fmt.Errorf("error decoding host paths: %v", err)
+		}
+		root, ok := paths[opts.Path]
+		if !ok {
+			return 0, fmt.Errorf("friendly path %q not found for server %s", opts.Path, host.Name)
+		}
+		args = append(args, root)
+		query += fmt.Sprintf(" AND root_folder = $%d", len(args))
+	}
+	if !opts.ChangedSince.IsZero() {
+		args = append(args, opts.ChangedSince)
+		query += fmt.Sprintf(" AND last_hashed_at >= $%d", len(args))
+	}
+	query += `
+		ORDER BY hash, (COALESCE(root_folder, '') || '/' || path) COLLATE "C"`
+
+	out, err := newHashRecordWriter(w, opts.Format)
+	if err != nil {
+		return 0, err
+	}
+
+	rows, err := database.QueryContext(ctx, query, args...)
+	if err != nil {
+		return 0, fmt.Errorf("error querying hashes: %v", err)
+	}
+	defer rows.Close()
+
+	written := 0
+	for rows.Next() {
+		var hash, root, path string
+		if err := rows.Scan(&hash, &root, &path); err != nil {
+			return written, fmt.Errorf("error scanning hash row: %v", err)
+		}
+		fullPath := path
+		if root != "" {
+			fullPath = filepath.Join(root, path)
+		}
+		if err := out.WriteRecord(hash, fullPath); err != nil {
+			return written, fmt.Errorf("error writing hash export: %v", err)
+		}
+		written++
+	}
+	if err := rows.Err(); err != nil {
+		return written, fmt.Errorf("error reading hashes: %v", err)
+	}
+
+	logging.InfoLogger.Printf("Exported %d hashes for host %s", written, host.Name)
+	return written, nil
+}
+
+// readHashRecords calls fn for each record of an export produced by
+// ExportHashes, in either format.
+func readHashRecords(r io.Reader, format string, fn func(hash, path string) error) error {
+	switch format {
+	case "", "csv":
+		cr := csv.NewReader(r)
+		cr.FieldsPerRecord = 2
+		first := true
+		for {
+			record, err := cr.Read()
+			if err == io.EOF {
+				return nil
+			}
+			if err != nil {
+				return fmt.Errorf("error reading csv hash export: %v", err)
+			}
+			if first {
+				first = false
+				if record[0] == "hash" && record[1] == "path" {
+					continue
+				}
+			}
+			if err := fn(strings.TrimSpace(record[0]), record[1]); err != nil {
+				return err
+			}
+		}
+	case "binary":
+		br := bufio.NewReader(r)
+		magic := make([]byte, len(hashExportMagic))
+		if _, err := io.ReadFull(br, magic); err != nil || string(magic) != hashExportMagic {
+			return fmt.Errorf("not a binary hash export (missing %q header)", strings.TrimSpace(hashExportMagic))
+		}
+		for {
+			hash, err := readHashRecordField(br)
+			if err == io.EOF {
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+			path, err := readHashRecordField(br)
+			if err != nil {
+				if err == io.EOF {
+					err = io.ErrUnexpectedEOF
+				}
+				return fmt.Errorf("error reading binary hash export: %v", err)
+			}
+			if err := fn(hash, path); err != nil {
+				return err
+			}
+		}
+	default:
+		return fmt.Errorf("invalid value for --format: %q (use csv or binary)", format)
+	}
+}
+
+func readHashRecordField(br *bufio.Reader) (string, error) {
+	n, err := binary.ReadUvarint(br)
+	if err != nil {
+		if err == io.EOF {
+			return "", io.EOF
+		}
+		return "", fmt.Errorf("error reading binary hash export: %v", err)
+	}
+	if n > maxHashRecordField {
+		return "", fmt.Errorf("error reading binary hash export: field length %d exceeds %d", n, maxHashRecordField)
+	}
+	buf := make([]byte, n)
+	if _, err := io.ReadFull(br, buf); err != nil {
+		if errors.Is(err, io.EOF) {
+			err = io.ErrUnexpectedEOF
+		}
+		return "", fmt.Errorf("error reading binary hash export: %v", err)
+	}
+	return string(buf), nil
+}
+
+// ImportHashes reads a hash export (typically one produced for, or by, an
+// external backup system) and marks every files row with one of its hashes as
+// known_external, on any host.
+func ImportHashes(ctx context.Context, database *sql.DB, opts ImportHashesOptions, r io.Reader) error {
+	batchSize := opts.BatchSize
+	if batchSize <= 0 {
+		batchSize = defaultImportHashesBatchSize
+	}
+
+	var batch []string
+	var hashes int
+	var marked int64
+	flush := func() error {
+		if len(batch) == 0 {
+			return nil
+		}
+		result, err := database.ExecContext(ctx, `
+			UPDATE files SET known_external = TRUE
+			WHERE hash = ANY($1) AND NOT known_external AND `+NotDeleted+`
+		`, pq.Array(batch))
+		if err != nil {
+			return fmt.Errorf("error marking known-external hashes: %v", err)
+		}
+		if n, err := result.RowsAffected(); err == nil {
+			marked += n
+		}
+		batch = batch[:0]
+		return nil
+	}
+
+	err := readHashRecords(r, opts.Format, func(hash, _ string) error {
+		if hash == "" {
+			return nil
+		}
+		hashes++
+		batch = append(batch, hash)
+		if len(batch) >= batchSize {
+			return flush()
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if err := flush(); err != nil {
+		return err
+	}
+
+	fmt.Printf("Read %d hashes, marked %d files as known-external\n", hashes, marked)
+	return nil
+}
+
+// markKnownExternal flags the duplicate groups whose content is already held
+// by an external backup (see ImportHashes).
+func markKnownExternal(ctx context.Context, database *sql.DB, groups []DuplicateGroup) error {
+	if len(groups) == 0 {
+		return nil
+	}
+	hashes := make([]string, len(groups))
+	for i, g := range groups {
+		hashes[i] = g.Hash
+	}
+	rows, err := database.QueryContext(ctx, `
+		SELECT DISTINCT hash FROM files
+		WHERE known_external AND hash = ANY($1) AND `+NotDeleted+`
+	`, pq.Array(hashes))
+	if err != nil {
+		return fmt.Errorf("error checking known-external hashes: %v", err)
+	}
+	defer rows.Close()
+	known := make(map[string]bool)
+	for rows.Next() {
+		var hash string
+		if err := rows.Scan(&hash); err != nil {
+			return fmt.Errorf("error scanning known-external hash: %v", err)
+		}
+		known[hash] = true
+	}
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("error reading known-external hashes: %v", err)
+	}
+	for i := range groups {
+		groups[i].KnownExternal = known[groups[i].Hash]
+	}
+	return nil
+}
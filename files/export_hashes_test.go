@@ -0,0 +1,206 @@
+package files
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+const exportHashesQueryRe = `SELECT DISTINCT ON \(hash\) hash, COALESCE\(root_folder, ''\), path\s+FROM files\s+WHERE hostname = \$1 AND hash IS NOT NULL AND deleted_at IS NULL`
+
+func expectExportHost(mock sqlmock.Sqlmock) {
+	mock.ExpectQuery("SELECT id, name, hostname, ip, root_path, settings, created_at FROM hosts WHERE name = \\$1").
+		WithArgs("Backup1").
+		WillReturnRows(sqlmock.NewRows([]string{"id", "name", "hostname", "ip", "root_path", "settings", "created_at"}).
+			AddRow(1, "Backup1", "backup1.local", "1.1.1.1", "/old", []byte(`{"paths":{"photos":"/data/photos"}}`), time.Now()))
+}
+
+func exportRows() *sqlmock.Rows {
+	return sqlmock.NewRows([]string{"hash", "root_folder", "path"}).
+		AddRow("aaa", "/data/photos", "2019/a.jpg").
+		AddRow("bbb", "", "/srv/legacy/b,c.txt").
+		AddRow("ccc", "/data/photos", "c.jpg")
+}
+
+func TestExportHashesWritesCSV(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("sqlmock: %v", err)
+	}
+	defer db.Close()
+
+	expectExportHost(mock)
+	mock.ExpectQuery(exportHashesQueryRe + `\s+ORDER BY hash, \(COALESCE\(root_folder, ''\) \|\| '/' \|\| path\) COLLATE "C"`).
+		WithArgs("backup1.local").
+		WillReturnRows(exportRows())
+
+	var out bytes.Buffer
+	n, err := ExportHashes(context.Background(), db, ExportHashesOptions{Server: "Backup1"}, &out)
+	if err != nil {
+		t.Fatalf("ExportHashes: %v", err)
+	}
+	want := "hash,path\naaa,/data/photos/2019/a.jpg\nbbb,\"/srv/legacy/b,c.txt\"\nccc,/data/photos/c.jpg\n"
+	if n != 3 || out.String() != want {
+		t.Fatalf("unexpected export (%d records):\n%s", n, out.String())
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatalf("unmet expectations: %v", err)
+	}
+}
+
+func TestExportHashesFiltersByPathAndChangedSince(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("sqlmock: %v", err)
+	}
+	defer db.Close()
+
+	since := time.Date(2024, 5, 1, 0, 0, 0, 0, time.UTC)
+	expectExportHost(mock)
+	mock.ExpectQuery(exportHashesQueryRe+` AND root_folder = \$2 AND last_hashed_at >= \$3`).
+		WithArgs("backup1.local", "/data/photos", since).
+		WillReturnRows(sqlmock.NewRows([]string{"hash", "root_folder", "path"}).AddRow("ccc", "/data/photos", "c.jpg"))
+
+	var out bytes.Buffer
+	n, err := ExportHashes(context.Background(), db, ExportHashesOptions{Server: "Backup1", Path: "photos", ChangedSince: since}, &out)
+	if err != nil {
+		t.Fatalf("ExportHashes: %v", err)
+	}
+	if n != 1 || !strings.HasSuffix(out.String(), "ccc,/data/photos/c.jpg\n") {
+		t.Fatalf("unexpected export (%d records):\n%s", n, out.String())
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatalf("unmet expectations: %v", err)
+	}
+
+	if _, err := ExportHashes(context.Background(), db, ExportHashesOptions{Server: "Backup1", Path: "videos"}, &out); err == nil {
+		t.Fatal("expected an error for an unknown friendly path")
+	}
+}
+
+// failAfterWriter accepts limit writes and fails every write after that.
+type failAfterWriter struct {
+	limit  int
+	writes int
+}
+
+func (w *failAfterWriter) Write(p []byte) (int, error) {
+	w.writes++
+	if w.writes > w.limit {
+		return 0, errors.New("disk full")
+	}
+	return len(p), nil
+}
+
+func TestExportHashesStreamsRecordByRecord(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("sqlmock: %v", err)
+	}
+	defer db.Close()
+
+	expectExportHost(mock)
+	mock.ExpectQuery(exportHashesQueryRe).WithArgs("backup1.local").WillReturnRows(exportRows())
+
+	// The magic header and the first record get through; the second record
+	// must hit the writer before the remaining rows are read.
+	w := &failAfterWriter{limit: 2}
+	n, err := ExportHashes(context.Background(), db, ExportHashesOptions{Server: "Backup1", Format: "binary"}, w)
+	if err == nil || !strings.Contains(err.Error(), "disk full") {
+		t.Fatalf("expected the write error to stop the export, got %v", err)
+	}
+	if n != 1 || w.writes != 3 {
+		t.Fatalf("expected 1 record written in 3 writes, got %d records in %d writes", n, w.writes)
+	}
+}
+
+func TestHashExportRoundTrip(t *testing.T) {
+	for _, format := range []string{"csv", "binary"} {
+		t.Run(format, func(t *testing.T) {
+			db, mock, err := sqlmock.New()
+			if err != nil {
+				t.Fatalf("sqlmock: %v", err)
+			}
+			defer db.Close()
+
+			expectExportHost(mock)
+			mock.ExpectQuery(exportHashesQueryRe).WithArgs("backup1.local").WillReturnRows(exportRows())
+
+			var buf bytes.Buffer
+			if _, err := ExportHashes(context.Background(), db, ExportHashesOptions{Server: "Backup1", Format: format}, &buf); err != nil {
+				t.Fatalf("ExportHashes: %v", err)
+			}
+
+			var records []string
+			if err := readHashRecords(bytes.NewReader(buf.Bytes()), format, func(hash, path string) error {
+				records = append(records, hash+" "+path)
+				return nil
+			}); err != nil {
+				t.Fatalf("readHashRecords: %v", err)
+			}
+			want := "aaa /data/photos/2019/a.jpg|bbb /srv/legacy/b,c.txt|ccc /data/photos/c.jpg"
+			if got := strings.Join(records, "|"); got != want {
+				t.Fatalf("round trip mismatch:\n got %s\nwant %s", got, want)
+			}
+
+			mock.ExpectExec(`UPDATE files SET known_external = TRUE\s+WHERE hash = ANY\(\$1\) AND NOT known_external AND deleted_at IS NULL`).
+				WithArgs(`{"aaa","bbb"}`).
+				WillReturnResult(sqlmock.NewResult(0, 3))
+			mock.ExpectExec(`UPDATE files SET known_external = TRUE`).
+				WithArgs(`{"ccc"}`).
+				WillReturnResult(sqlmock.NewResult(0, 1))
+
+			out := captureStdout(t, func() {
+				if err := ImportHashes(context.Background(), db, ImportHashesOptions{Format: format, BatchSize: 2}, bytes.NewReader(buf.Bytes())); err != nil {
+					t.Fatalf("ImportHashes: %v", err)
+				}
+			})
+			if !strings.Contains(out, "Read 3 hashes, marked 4 files as known-external") {
+				t.Fatalf("unexpected summary: %s", out)
+			}
+			if err := mock.ExpectationsWereMet(); err != nil {
+				t.Fatalf("unmet expectations: %v", err)
+			}
+		})
+	}
+}
+
+func TestReadHashRecordsRejectsTruncatedBinary(t *testing.T) {
+	data := hashExportMagic + "\x03abc\x05/a"
+	err := readHashRecords(strings.NewReader(data), "binary", func(string, string) error { return nil })
+	if err == nil {
+		t.Fatal("expected an error for a truncated record")
+	}
+	if err := readHashRecords(strings.NewReader("hash,path\n"), "binary", func(string, string) error { return nil }); err == nil {
+		t.Fatal("expected an error for a missing binary header")
+	}
+}
+
+func TestFindDuplicatesShowExternalAnnotatesGroups(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("sqlmock: %v", err)
+	}
+	defer db.Close()
+
+	groups := []DuplicateGroup{{Hash: "aaa"}, {Hash: "bbb"}}
+	mock.ExpectQuery(`SELECT DISTINCT hash FROM files\s+WHERE known_external AND hash = ANY\(\$1\)`).
+		WithArgs(`{"aaa","bbb"}`).
+		WillReturnRows(sqlmock.NewRows([]string{"hash"}).AddRow("bbb"))
+
+	if err := markKnownExternal(context.Background(), db, groups); err != nil {
+		t.Fatalf("markKnownExternal: %v", err)
+	}
+	if groups[0].KnownExternal || !groups[1].KnownExternal {
+		t.Fatalf("unexpected annotation: %+v", groups)
+	}
+	out := captureStdout(t, func() { PrintDuplicateGroups(groups[1:], nil, nil) })
+	if !strings.Contains(out, "Backed up externally: yes") {
+		t.Fatalf("expected annotation in output, got:\n%s", out)
+	}
+}
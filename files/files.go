@@ -6,16 +6,113 @@ import (
 	"crypto/sha256"
 	"encoding/hex"
 	"fmt"
+	"hash"
 	"io"
 	"os"
 	"path/filepath"
+	"strings"
+	"sync/atomic"
 	"time"
 
 	"github.com/schollz/progressbar/v3"
+	"lukechampine.com/blake3"
 )
 
+// Hash algorithms recorded in files.hash_algo.
+const (
+	HashAlgoSHA256 = "sha256"
+	HashAlgoBLAKE3 = "blake3"
+)
+
+// hashAlgorithms are the supported hash algorithms by name. Both give 32 byte
+// digests, so every stored hash is 64 hex digits whichever produced it.
+var hashAlgorithms = map[string]func() hash.Hash{
+	HashAlgoSHA256: sha256.New,
+	HashAlgoBLAKE3: func() hash.Hash { return blake3.New(32, nil) },
+}
+
+// ParseHashAlgo returns the hash algorithm named by an --algo value. An
+// empty value is SHA-256.
+func ParseHashAlgo(name string) (string, error) {
+	algo := strings.ToLower(strings.TrimSpace(name))
+	if algo == "" {
+		return HashAlgoSHA256, nil
+	}
+	if _, ok := hashAlgorithms[algo]; !ok {
+		return "", fmt.Errorf("unsupported hash algorithm %q (supported: %s, %s)", name, HashAlgoSHA256, HashAlgoBLAKE3)
+	}
+	return algo, nil
+}
+
+// showFileProgress controls the progress bar drawn for each file hashed. It
+// starts out on only when stdout is a terminal, so output redirected to a
+// log under cron keeps just the per-run bar.
+var showFileProgress atomic.Bool
+
+func init() {
+	info, err := os.Stdout.Stat()
+	showFileProgress.Store(err == nil && info.Mode()&os.ModeCharDevice != 0)
+}
+
+// SetFileProgress turns the per-file hashing progress bars on or off for
+// every command that hashes files. The stall timeout keeps working either
+// way.
+func SetFileProgress(on bool) {
+	showFileProgress.Store(on)
+}
+
+// hashStallTimeout is how long hashing a file may go without reading any
+// data before it is given up as timed out.
+const hashStallTimeout = time.Minute
+
+// maxHashStallTimeout caps the stall timeout --retry-problematic escalates to.
+const maxHashStallTimeout = 16 * time.Minute
+
+// retryStallTimeout is the stall timeout for a file that already timed out
+// the given number of times: it doubles with each timeout, up to
+// maxHashStallTimeout.
+func retryStallTimeout(timeouts int) time.Duration {
+	stall := hashStallTimeout
+	for i := 0; i < timeouts && stall < maxHashStallTimeout; i++ {
+		stall *= 2
+	}
+	if stall > maxHashStallTimeout {
+		stall = maxHashStallTimeout
+	}
+	return stall
+}
+
+// fileHasher returns the function hashing a full file with algo, one of
+// the names ParseHashAlgo returns.
+func fileHasher(algo string) func(filePath string) (string, error) {
+	if algo == HashAlgoSHA256 {
+		return calculateFileHash
+	}
+	return fileHasherWithTimeout(algo, hashStallTimeout)
+}
+
+// fileHasherWithTimeout is fileHasher with its own stall timeout.
+func fileHasherWithTimeout(algo string, stall time.Duration) func(filePath string) (string, error) {
+	newHash := hashAlgorithms[algo]
+	return func(filePath string) (string, error) {
+		return calculateFileHashWithTimeout(filePath, newHash, stall)
+	}
+}
+
 // calculateFileHash computes the SHA-256 hash of a full file.
 func calculateFileHash(filePath string) (string, error) {
+	return calculateFileHashWith(filePath, sha256.New)
+}
+
+// calculateFileHashWith computes the hash of a full file with newHash,
+// giving up after a minute without progress.
+func calculateFileHashWith(filePath string, newHash func() hash.Hash) (string, error) {
+	return calculateFileHashWithTimeout(filePath, newHash, hashStallTimeout)
+}
+
+// calculateFileHashWithTimeout computes the hash of a full file with newHash,
+// giving up after stall without progress.
+func calculateFileHashWithTimeout(filePath string, newHash func() hash.Hash, stall time.Duration) (string, error) {
 	// Create a channel to communicate the result and progress
 	resultCh := make(chan struct {
 		hash string
@@ -31,7 +128,7 @@ func calculateFileHash(filePath string) (string, error) {
 
 	// Start a goroutine to monitor progress and implement timeout
 	go func() {
-		timeout := 1 * time.Minute
+		timeout := stall
 		timer := time.NewTimer(timeout)
 		defer timer.Stop()
 
@@ -56,7 +153,7 @@ func calculateFileHash(filePath string) (string, error) {
 
 	// Run the hashing in a goroutine
 	go func() {
-		hash, err := calculateFileHashInternal(ctx, filePath, progressCh)
+		hash, err := calculateFileHashInternal(ctx, filePath, newHash, progressCh)
 		resultCh <- struct {
 			hash string
 			err  error
@@ -68,12 +165,24 @@ func calculateFileHash(filePath string) (string, error) {
 	case result := <-resultCh:
 		return result.hash, result.err
 	case <-ctx.Done():
-		return "", fmt.Errorf("hashing timed out after 1 minute of inactivity for file: %s", filePath)
+		return "", fmt.Errorf("hashing timed out after %s of inactivity for file: %s", describeStall(stall), filePath)
+	}
+}
+
+// describeStall spells out a stall timeout for error messages, e.g.
+// "1 minute" or "4 minutes".
+func describeStall(stall time.Duration) string {
+	if stall%time.Minute != 0 {
+		return stall.String()
+	}
+	if minutes := int(stall / time.Minute); minutes != 1 {
+		return fmt.Sprintf("%d minutes", minutes)
 	}
+	return "1 minute"
 }
 
 // calculateFileHashInternal is the internal implementation of file hashing
-func calculateFileHashInternal(ctx context.Context, filePath string, progressCh chan struct{}) (string, error) {
+func calculateFileHashInternal(ctx context.Context, filePath string, newHash func() hash.Hash, progressCh chan struct{}) (string, error) {
 	// Use Lstat instead of Stat to detect symlinks without following them
 	fileInfo, err := os.Lstat(filePath)
 	if err != nil {
@@ -101,22 +210,25 @@ func calculateFileHashInternal(ctx context.Context, filePath string, progressCh
 	}
 	defer file.Close()
 
-	// Create a progress bar for this file
-	bar := progressbar.NewOptions64(fileInfo.Size(),
-		progressbar.OptionEnableColorCodes(true),
-		progressbar.OptionShowBytes(true),
-		progressbar.OptionSetWidth(30),
-		progressbar.OptionFullWidth(),
-		progressbar.OptionSetDescription(fmt.Sprintf("[cyan]Hashing %s", filepath.Base(filePath))),
-		progressbar.OptionSetTheme(progressbar.Theme{
-			Saucer:        "[green]=[reset]",
-			SaucerHead:    "[green]>[reset]",
-			SaucerPadding: " ",
-			BarStart:      "[",
-			BarEnd:        "]",
-		}))
-
-	hash := sha256.New()
+	// Create a progress bar for this file, unless per-file bars are off
+	var bar *progressbar.ProgressBar
+	if showFileProgress.Load() {
+		bar = progressbar.NewOptions64(fileInfo.Size(),
+			progressbar.OptionEnableColorCodes(true),
+			progressbar.OptionShowBytes(true),
+			progressbar.OptionSetWidth(30),
+			progressbar.OptionFullWidth(),
+			progressbar.OptionSetDescription(fmt.Sprintf("[cyan]Hashing %s", filepath.Base(filePath))),
+			progressbar.OptionSetTheme(progressbar.Theme{
+				Saucer:        "[green]=[reset]",
+				SaucerHead:    "[green]>[reset]",
+				SaucerPadding: " ",
+				BarStart:      "[",
+				BarEnd:        "]",
+			}))
+	}
+
+	hash := newHash()
 	reader := bufio.NewReader(file)
 	buf := make([]byte, 1024*1024) // 1MB buffer
 
@@ -133,7 +245,9 @@ func calculateFileHashInternal(ctx context.Context, filePath string, progressCh
 		n, err := reader.Read(readBuf)
 		if n > 0 {
 			hash.Write(buf[:n])
-			bar.Add64(int64(n))
+			if bar != nil {
+				bar.Add64(int64(n))
+			}
 
 			// Signal progress was made
 			select {
@@ -151,6 +265,8 @@ func calculateFileHashInternal(ctx context.Context, filePath string, progressCh
 		}
 	}
 
-	fmt.Println() // Add newline after progress bar
+	if bar != nil {
+		fmt.Println() // Add newline after progress bar
+	}
 	return hex.EncodeToString(hash.Sum(nil)), nil
 }
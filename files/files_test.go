@@ -2,11 +2,15 @@ package files
 
 import (
 	"context"
+	"crypto/sha256"
+	"fmt"
 	"os"
 	"path/filepath"
 	"strings"
 	"testing"
 	"time"
+
+	"lukechampine.com/blake3"
 )
 
 func TestCalculateFileHash(t *testing.T) {
@@ -101,6 +105,65 @@ func TestCalculateFileHash(t *testing.T) {
 	}
 }
 
+func TestFileHasherBLAKE3(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "data.bin")
+	content := []byte(strings.Repeat("blake3 ", 1000))
+	if err := os.WriteFile(path, content, 0644); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+
+	algo, err := ParseHashAlgo("BLAKE3")
+	if err != nil {
+		t.Fatalf("ParseHashAlgo: %v", err)
+	}
+	hash, err := fileHasher(algo)(path)
+	if err != nil {
+		t.Fatalf("hash: %v", err)
+	}
+	if want := fmt.Sprintf("%x", blake3.Sum256(content)); hash != want {
+		t.Fatalf("expected %s, got %s", want, hash)
+	}
+
+	if algo, err := ParseHashAlgo(""); err != nil || algo != HashAlgoSHA256 {
+		t.Fatalf("expected the default to be sha256, got %q, %v", algo, err)
+	}
+	if _, err := ParseHashAlgo("md5"); err == nil || !strings.Contains(err.Error(), "unsupported hash algorithm") {
+		t.Fatalf("expected md5 to be rejected, got %v", err)
+	}
+}
+
+func TestFileProgressSwitchKeepsFeedingTheWatchdog(t *testing.T) {
+	previous := showFileProgress.Load()
+	t.Cleanup(func() { SetFileProgress(previous) })
+
+	path := filepath.Join(t.TempDir(), "data.bin")
+	if err := os.WriteFile(path, []byte(strings.Repeat("progress ", 1000)), 0644); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	hashWithProgress := func(on bool) string {
+		SetFileProgress(on)
+		progressCh := make(chan struct{}, 1)
+		out := captureStdout(t, func() {
+			if _, err := calculateFileHashInternal(context.Background(), path, sha256.New, progressCh); err != nil {
+				t.Fatalf("hash: %v", err)
+			}
+		})
+		select {
+		case <-progressCh:
+		default:
+			t.Fatalf("expected progress to be signalled with file progress %t", on)
+		}
+		return out
+	}
+
+	if out := hashWithProgress(false); out != "" {
+		t.Fatalf("expected no output without file progress, got %q", out)
+	}
+	if out := hashWithProgress(true); !strings.Contains(out, "Hashing data.bin") {
+		t.Fatalf("expected the per-file bar, got %q", out)
+	}
+}
+
 func TestCalculateFileHashTimeout(t *testing.T) {
 	// Skip this test in short mode as it involves waiting
 	if testing.Short() {
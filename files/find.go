@@ -1,9 +1,11 @@
 package files
 
 import (
+	"bytes"
 	"context"
 	"database/sql"
 	"fmt"
+	"io"
 	"log"
 	"os"
 	"path/filepath"
@@ -14,6 +16,76 @@ import (
 	"github.com/schollz/progressbar/v3"
 )
 
+// catalogModTime is a modification time as files find stores it in
+// files.mod_time.
+func catalogModTime(t time.Time) time.Time {
+	return t.UTC().Truncate(time.Microsecond)
+}
+
+// fileChangedSQL tells, in the find upsert, whether the file differs from
+// the size or modification time recorded when its row was last written, so
+// its hash is stale and files hash picks it up again. A row recorded before
+// find stored modification times only counts its size.
+const fileChangedSQL = `(files.size IS DISTINCT FROM EXCLUDED.size
+					OR (files.mod_time IS NOT NULL AND files.mod_time IS DISTINCT FROM EXCLUDED.mod_time))`
+
+// inodeCandidate is an existing files row that shares a (device, inode) pair
+// with a file seen during the walk.
+type inodeCandidate struct {
+	id         int64
+	path       string
+	rootFolder string
+	size       sql.NullInt64
+	modTime    sql.NullTime
+}
+
+// findRenamedRow looks for an existing row on the same host that has the same
+// device and inode as the walked file but is stored under a different
+// path. It returns the id of that row only when it is definitively the same
+// file renamed: the old path no longer exists on disk (otherwise it is a hard
+// link) and the size and modification time still match (otherwise the inode
+// was reused by a new file).
+func findRenamedRow(lookup *sql.Stmt, hostname string, device, inode uint64, relPath, rootPath string, size int64, modTime time.Time) (int64, bool, error) {
+	rows, err := lookup.Query(hostname, int64(device), int64(inode))
+	if err != nil {
+		return 0, false, err
+	}
+	defer rows.Close()
+
+	var candidates []inodeCandidate
+	for rows.Next() {
+		var c inodeCandidate
+		if err := rows.Scan(&c.id, &c.path, &c.rootFolder, &c.size, &c.modTime); err != nil {
+			return 0, false, err
+		}
+		if c.path == relPath && c.rootFolder == rootPath {
+			// Already stored under this path; a regular upsert is enough.
+			return 0, false, nil
+		}
+		candidates = append(candidates, c)
+	}
+	if err := rows.Err(); err != nil {
+		return 0, false, err
+	}
+
+	for _, c := range candidates {
+		oldPath := c.path
+		if c.rootFolder != "" {
+			oldPath = filepath.Join(c.rootFolder, c.path)
+		}
+		if _, err := os.Lstat(oldPath); err == nil || !os.IsNotExist(err) {
+			// The old path is still there, so both paths are hard links to
+			// the same inode and must be kept as separate rows.
+			continue
+		}
+		if !c.size.Valid || c.size.Int64 != size || !c.modTime.Valid || !c.modTime.Time.Equal(modTime) {
+			continue
+		}
+		return c.id, true, nil
+	}
+	return 0, false, nil
+}
+
 // FindFiles traverses the root path of the specified host and adds files to the database
 func FindFiles(ctx context.Context, sqldb *sql.DB, opts FindOptions) error {
 	// Get host and its paths
@@ -28,19 +100,74 @@ func FindFiles(ctx context.Context, sqldb *sql.DB, opts FindOptions) error {
 	}
 	log.Printf("Found %d paths for server '%s'", len(paths), host.Name)
 
+	hostname := normalizeHostname(host.Hostname)
+
+	var xattrWhitelist []string
+	if opts.CaptureXattrs {
+		if xattrWhitelist, err = host.GetXattrWhitelist(); err != nil {
+			return fmt.Errorf("error decoding xattr whitelist: %v", err)
+		}
+		if len(xattrWhitelist) == 0 {
+			log.Printf("Warning: --capture-xattrs given but server '%s' has no xattr_whitelist", host.Name)
+		}
+	}
+
 	var processedFiles int64
+	var renamedFiles int64
+	var newFiles, updatedFiles int64
+	pathLengths := newPathLengthCheck(opts.MaxPathLen)
+	defer func() {
+		opts.Stats.Set("processed", processedFiles)
+		opts.Stats.Set("renamed", renamedFiles)
+		opts.Stats.Set("new", newFiles)
+		opts.Stats.Set("updated", updatedFiles)
+		opts.Stats.Set("path_too_long", pathLengths.skipped)
+	}()
+
+	// With --report-new - the report owns stdout, so the progress bar and
+	// summary move to stderr.
+	out := io.Writer(os.Stdout)
+	if opts.ReportNew == io.Writer(os.Stdout) {
+		out = os.Stderr
+	}
+
 	var currentBatch int64
 	var tx *sql.Tx
 	var stmt *sql.Stmt
+	var lookupStmt *sql.Stmt
+	var renameStmt *sql.Stmt
+
+	// Paths inserted by the open transaction, written to opts.ReportNew once
+	// it commits so the report never names a row that was rolled back.
+	var pendingNew bytes.Buffer
+	flushNew := func() error {
+		if opts.ReportNew == nil || pendingNew.Len() == 0 {
+			return nil
+		}
+		_, err := opts.ReportNew.Write(pendingNew.Bytes())
+		pendingNew.Reset()
+		if err != nil {
+			return fmt.Errorf("error writing new files report: %v", err)
+		}
+		return nil
+	}
+	commitBatch := func() error {
+		if err := tx.Commit(); err != nil {
+			return err
+		}
+		return flushNew()
+	}
 
 	// Function to start a new transaction
 	startNewTransaction := func() error {
 		// If we have an existing transaction, commit it
 		if tx != nil {
-			if err := tx.Commit(); err != nil {
+			if err := commitBatch(); err != nil {
 				return fmt.Errorf("error committing transaction: %v", err)
 			}
 			stmt.Close()
+			lookupStmt.Close()
+			renameStmt.Close()
 		}
 
 		// Start new transaction
@@ -49,18 +176,50 @@ func FindFiles(ctx context.Context, sqldb *sql.DB, opts FindOptions) error {
 			return fmt.Errorf("error starting transaction: %v", err)
 		}
 
-		// Prepare statement for batch inserts
+		// Prepare statement for batch inserts. xmax is 0 only on a freshly
+		// inserted row, so it tells new paths from updated ones.
 		stmt, err = tx.Prepare(`
-			INSERT INTO files (path, hostname, size, root_folder)
-			VALUES ($1, $2, $3, $4)
-			ON CONFLICT (path, hostname)
-			DO UPDATE SET size = EXCLUDED.size, root_folder = EXCLUDED.root_folder
+			INSERT INTO files (path, hostname, size, root_folder, device, inode, mod_time, added_by, added_host_user, xattrs)
+			VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)
+			ON CONFLICT (path, hostname) WHERE deleted_at IS NULL
+			DO UPDATE SET size = EXCLUDED.size, root_folder = EXCLUDED.root_folder,
+				device = EXCLUDED.device, inode = EXCLUDED.inode, mod_time = EXCLUDED.mod_time,
+				xattrs = COALESCE(EXCLUDED.xattrs, files.xattrs),
+				quick_hash = CASE WHEN files.size IS DISTINCT FROM EXCLUDED.size
+					OR files.mod_time IS DISTINCT FROM EXCLUDED.mod_time THEN NULL ELSE files.quick_hash END,
+				hash = CASE WHEN ` + fileChangedSQL + ` THEN NULL ELSE files.hash END,
+				last_hashed_at = CASE WHEN ` + fileChangedSQL + ` THEN NULL ELSE files.last_hashed_at END,
+				` + preserveOrigin + `
+			RETURNING (xmax = 0) AS inserted
 		`)
 		if err != nil {
 			tx.Rollback()
 			return fmt.Errorf("error preparing statement: %v", err)
 		}
 
+		lookupStmt, err = tx.Prepare(`
+			SELECT id, path, COALESCE(root_folder, ''), size, mod_time
+			FROM files
+			WHERE hostname = $1 AND device = $2 AND inode = $3 AND ` + NotDeleted + `
+		`)
+		if err != nil {
+			tx.Rollback()
+			return fmt.Errorf("error preparing inode lookup statement: %v", err)
+		}
+
+		// Moving a row in place keeps its hash and last_hashed_at. The NOT EXISTS
+		// guard avoids a unique violation (which would abort the transaction)
+		// when the new path already has a row of its own.
+		renameStmt, err = tx.Prepare(`
+			UPDATE files SET path = $1, root_folder = $2
+			WHERE id = $3
+			AND NOT EXISTS (SELECT 1 FROM files WHERE path = $1 AND hostname = $4 AND ` + NotDeleted + `)
+		`)
+		if err != nil {
+			tx.Rollback()
+			return fmt.Errorf("error preparing rename statement: %v", err)
+		}
+
 		currentBatch = 0
 		return nil
 	}
@@ -72,6 +231,7 @@ func FindFiles(ctx context.Context, sqldb *sql.DB, opts FindOptions) error {
 
 	// Create progress bar (indeterminate)
 	bar := progressbar.NewOptions(-1,
+		progressbar.OptionSetWriter(out),
 		progressbar.OptionEnableColorCodes(true),
 		progressbar.OptionShowCount(),
 		progressbar.OptionSetWidth(15),
@@ -85,39 +245,65 @@ func FindFiles(ctx context.Context, sqldb *sql.DB, opts FindOptions) error {
 			BarEnd:        "]",
 		}))
 
-	// Walk all configured paths, or just the requested one if opts.Path is set
-	if opts.Path != "" {
-		rootPath, ok := paths[opts.Path]
-		if !ok {
-			return fmt.Errorf("friendly path '%s' not found for server '%s'", opts.Path, host.Name)
+	// upsert inserts or updates the row of relPath and counts which of the
+	// two happened, queueing new paths for the report.
+	upsert := func(friendly, relPath, rootPath string, info os.FileInfo, modTime time.Time, device, inode, xattrs interface{}) error {
+		var inserted bool
+		err := stmt.QueryRow(relPath, hostname, info.Size(), rootPath, device, inode, modTime, OriginFind, currentHostUser(), xattrs).Scan(&inserted)
+		if err != nil {
+			return err
 		}
-		log.Printf("Scanning path '%s': %s", opts.Path, rootPath)
-		if _, err := os.Stat(rootPath); os.IsNotExist(err) {
-			log.Printf("Warning: path does not exist: %s", rootPath)
+		if !inserted {
+			updatedFiles++
 			return nil
 		}
-		err = filepath.Walk(rootPath, func(path string, info os.FileInfo, err error) error {
-			select {
-			case <-ctx.Done():
-				return ctx.Err()
-			default:
-			}
+		newFiles++
+		if opts.ReportNew != nil {
+			pendingNew.WriteString(friendly + "/" + filepath.ToSlash(relPath) + "\n")
+		}
+		return nil
+	}
+
+	// recordFile stores a single walked file, moving an existing row in place
+	// when the file turns out to be a rename of something already indexed.
+	recordFile := func(friendly, relPath, rootPath string, info os.FileInfo) error {
+		modTime := catalogModTime(info.ModTime())
+		xattrs := captureXattrs(filepath.Join(rootPath, relPath), xattrWhitelist)
+		device, inode, ok := fileIdentity(info)
+		if !ok {
+			return upsert(friendly, relPath, rootPath, info, modTime, nil, nil, xattrs)
+		}
+
+		id, renamed, err := findRenamedRow(lookupStmt, hostname, device, inode, relPath, rootPath, info.Size(), modTime)
+		if err != nil {
+			return fmt.Errorf("error looking up inode: %v", err)
+		}
+		if renamed {
+			res, err := renameStmt.Exec(relPath, rootPath, id, hostname)
 			if err != nil {
-				log.Printf("Warning: Error accessing path %s: %v", path, err)
-				return nil
+				return err
 			}
-			if info.IsDir() || (info.Mode()&os.ModeSymlink) != 0 {
+			if n, _ := res.RowsAffected(); n > 0 {
+				renamedFiles++
 				return nil
 			}
+		}
+
+		return upsert(friendly, relPath, rootPath, info, modTime, int64(device), int64(inode), xattrs)
+	}
+
+	walkRoot := func(friendly, rootPath string) error {
+		visit := func(path string, info os.FileInfo) error {
 			relPath, err := filepath.Rel(rootPath, path)
 			if err != nil {
 				log.Printf("Warning: Error getting relative path for %s: %v", path, err)
 				return nil
 			}
-			dbPath := relPath
-			_, err = stmt.Exec(dbPath, host.Hostname, info.Size(), rootPath)
-			if err != nil {
-				log.Printf("Warning: Error inserting file %s: %v", dbPath, err)
+			if !pathLengths.allow(path) {
+				return nil
+			}
+			if err := recordFile(friendly, relPath, rootPath, info); err != nil {
+				log.Printf("Warning: Error inserting file %s: %v", relPath, err)
 				return nil
 			}
 			processedFiles++
@@ -130,17 +316,50 @@ func FindFiles(ctx context.Context, sqldb *sql.DB, opts FindOptions) error {
 			}
 			bar.Add(1)
 			return nil
+		}
+
+		if opts.FollowSymlinks || opts.IndexSymlinkTargets {
+			return walkFollowingSymlinks(ctx, rootPath, opts.FollowSymlinks, opts.IndexSymlinkTargets, opts.MaxDepth, visit)
+		}
+		return filepath.Walk(rootPath, func(path string, info os.FileInfo, err error) error {
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			default:
+			}
+			if err != nil {
+				log.Printf("Warning: Error accessing path %s: %v", path, err)
+				return nil
+			}
+			if info.IsDir() || (info.Mode()&os.ModeSymlink) != 0 {
+				return nil
+			}
+			return visit(path, info)
 		})
+	}
+
+	// Walk all configured paths, or just the requested one if opts.Path is set
+	if opts.Path != "" {
+		rootPath, ok := paths[opts.Path]
+		if !ok {
+			return fmt.Errorf("friendly path '%s' not found for server '%s'", opts.Path, host.Name)
+		}
+		log.Printf("Scanning path '%s': %s", opts.Path, rootPath)
+		if _, err := os.Stat(rootPath); os.IsNotExist(err) {
+			log.Printf("Warning: path does not exist: %s", rootPath)
+			return nil
+		}
+		err = walkRoot(opts.Path, rootPath)
 		if err != nil {
 			if err == context.Canceled {
 				if tx != nil {
-					if err := tx.Commit(); err != nil {
+					if err := commitBatch(); err != nil {
 						log.Printf("Warning: Error committing final batch: %v", err)
 					} else {
 						log.Printf("Successfully committed final batch")
 					}
 				}
-				fmt.Printf("\nOperation cancelled after processing %d files\n", processedFiles)
+				fmt.Fprintf(out, "\nOperation cancelled after processing %d files\n", processedFiles)
 				return fmt.Errorf("operation cancelled")
 			}
 			return fmt.Errorf("error walking directory: %v", err)
@@ -155,55 +374,21 @@ func FindFiles(ctx context.Context, sqldb *sql.DB, opts FindOptions) error {
 			}
 			select {
 			case <-ctx.Done():
-				fmt.Printf("\nOperation cancelled after processing %d files\n", processedFiles)
+				fmt.Fprintf(out, "\nOperation cancelled after processing %d files\n", processedFiles)
 				return fmt.Errorf("operation cancelled")
 			default:
 			}
-			err = filepath.Walk(rootPath, func(path string, info os.FileInfo, err error) error {
-				select {
-				case <-ctx.Done():
-					return ctx.Err()
-				default:
-				}
-				if err != nil {
-					log.Printf("Warning: Error accessing path %s: %v", path, err)
-					return nil
-				}
-				if info.IsDir() || (info.Mode()&os.ModeSymlink) != 0 {
-					return nil
-				}
-				relPath, err := filepath.Rel(rootPath, path)
-				if err != nil {
-					log.Printf("Warning: Error getting relative path for %s: %v", path, err)
-					return nil
-				}
-				dbPath := relPath
-				_, err = stmt.Exec(dbPath, host.Hostname, info.Size(), rootPath)
-				if err != nil {
-					log.Printf("Warning: Error inserting file %s: %v", dbPath, err)
-					return nil
-				}
-				processedFiles++
-				currentBatch++
-				if currentBatch >= 1000 {
-					if err := startNewTransaction(); err != nil {
-						return err
-					}
-					bar.Describe(fmt.Sprintf("[cyan]Finding files... (%d processed)[reset]", processedFiles))
-				}
-				bar.Add(1)
-				return nil
-			})
+			err = walkRoot(friendly, rootPath)
 			if err != nil {
 				if err == context.Canceled {
 					if tx != nil {
-						if err := tx.Commit(); err != nil {
+						if err := commitBatch(); err != nil {
 							log.Printf("Warning: Error committing final batch: %v", err)
 						} else {
 							log.Printf("Successfully committed final batch")
 						}
 					}
-					fmt.Printf("\nOperation cancelled after processing %d files\n", processedFiles)
+					fmt.Fprintf(out, "\nOperation cancelled after processing %d files\n", processedFiles)
 					return fmt.Errorf("operation cancelled")
 				}
 				return fmt.Errorf("error walking directory: %v", err)
@@ -212,18 +397,17 @@ func FindFiles(ctx context.Context, sqldb *sql.DB, opts FindOptions) error {
 		}
 	}
 
-
 	if err != nil {
 		if err == context.Canceled {
 			// Try to commit the last batch before returning
 			if tx != nil {
-				if err := tx.Commit(); err != nil {
+				if err := commitBatch(); err != nil {
 					log.Printf("Warning: Error committing final batch: %v", err)
 				} else {
 					log.Printf("Successfully committed final batch")
 				}
 			}
-			fmt.Printf("\nOperation cancelled after processing %d files\n", processedFiles)
+			fmt.Fprintf(out, "\nOperation cancelled after processing %d files\n", processedFiles)
 			return fmt.Errorf("operation cancelled")
 		}
 		return fmt.Errorf("error walking directory: %v", err)
@@ -231,11 +415,17 @@ func FindFiles(ctx context.Context, sqldb *sql.DB, opts FindOptions) error {
 
 	// Commit final transaction if there are any remaining files
 	if currentBatch > 0 && tx != nil {
-		if err := tx.Commit(); err != nil {
+		if err := commitBatch(); err != nil {
 			return fmt.Errorf("error committing final transaction: %v", err)
 		}
 	}
 
-	fmt.Printf("\nSuccessfully processed %d files for \"%s\"\n", processedFiles, host.Name)
+	fmt.Fprintf(out, "\nSuccessfully processed %d files for \"%s\"\n", processedFiles, host.Name)
+	fmt.Fprintf(out, "New files: %d, updated: %d\n", newFiles, updatedFiles)
+	fmt.Fprintf(out, "Renames detected: %d\n", renamedFiles)
+	if warning := pathLengths.warning(); warning != "" {
+		fmt.Fprintf(out, "Skipped (path too long): %d\n", pathLengths.skipped)
+		log.Print(warning)
+	}
 	return nil
 }
@@ -0,0 +1,313 @@
+package files
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+// expectFindSetup registers the host lookup, transaction and prepared
+// statements FindFiles issues before walking root.
+func expectFindSetup(mock sqlmock.Sqlmock, root string) (insert, lookup, rename *sqlmock.ExpectedPrepare) {
+	mock.ExpectQuery("SELECT id, name, hostname, ip, root_path, settings, created_at FROM hosts WHERE name = \\$1").
+		WithArgs("Backup1").
+		WillReturnRows(sqlmock.NewRows([]string{"id", "name", "hostname", "ip", "root_path", "settings", "created_at"}).
+			AddRow(1, "Backup1", "backup1.local", "1.1.1.1", "/old", []byte(`{"paths":{"photos":"`+root+`"}}`), time.Now()))
+	mock.ExpectBegin()
+	insert = mock.ExpectPrepare("INSERT INTO files")
+	lookup = mock.ExpectPrepare("SELECT id, path, COALESCE\\(root_folder, ''\\), size, mod_time")
+	rename = mock.ExpectPrepare("UPDATE files SET path")
+	return insert, lookup, rename
+}
+
+func statIdentity(t *testing.T, path string) (os.FileInfo, int64, int64) {
+	t.Helper()
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatalf("stat %s: %v", path, err)
+	}
+	device, inode, ok := fileIdentity(info)
+	if !ok {
+		t.Skip("device/inode not available on this platform")
+	}
+	return info, int64(device), int64(inode)
+}
+
+// insertedRow is what the find upsert returns: whether the row was new.
+func insertedRow(inserted bool) *sqlmock.Rows {
+	return sqlmock.NewRows([]string{"inserted"}).AddRow(inserted)
+}
+
+func inodeRows() *sqlmock.Rows {
+	return sqlmock.NewRows([]string{"id", "path", "root_folder", "size", "mod_time"})
+}
+
+func TestFindFilesDetectsRenameByInode(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("sqlmock: %v", err)
+	}
+	defer db.Close()
+
+	root := t.TempDir()
+	newPath := filepath.Join(root, "renamed.txt")
+	if err := os.WriteFile(newPath, []byte("hello"), 0644); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	info, device, inode := statIdentity(t, newPath)
+	modTime := info.ModTime().UTC().Truncate(time.Microsecond)
+
+	_, lookup, rename := expectFindSetup(mock, root)
+	// The stored row points at original.txt, which no longer exists on disk.
+	lookup.ExpectQuery().
+		WithArgs("backup1.local", device, inode).
+		WillReturnRows(inodeRows().AddRow(42, "original.txt", root, info.Size(), modTime))
+	rename.ExpectExec().
+		WithArgs("renamed.txt", root, int64(42), "backup1.local").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+
+	if err := FindFiles(context.Background(), db, FindOptions{Server: "Backup1", Path: "photos"}); err != nil {
+		t.Fatalf("FindFiles error: %v", err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatalf("unmet expectations: %v", err)
+	}
+}
+
+func TestFindFilesKeepsHardLinksAsSeparateRows(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("sqlmock: %v", err)
+	}
+	defer db.Close()
+
+	root := t.TempDir()
+	original := filepath.Join(root, "a.txt")
+	if err := os.WriteFile(original, []byte("hello"), 0644); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	if err := os.Link(original, filepath.Join(root, "b.txt")); err != nil {
+		t.Skipf("hard links not supported: %v", err)
+	}
+	info, device, inode := statIdentity(t, original)
+	modTime := info.ModTime().UTC().Truncate(time.Microsecond)
+
+	insert, lookup, _ := expectFindSetup(mock, root)
+	lookup.ExpectQuery().
+		WithArgs("backup1.local", device, inode).
+		WillReturnRows(inodeRows().AddRow(7, "a.txt", root, info.Size(), modTime))
+	insert.ExpectQuery().
+		WithArgs("a.txt", "backup1.local", info.Size(), root, device, inode, sqlmock.AnyArg(), OriginFind, sqlmock.AnyArg(), nil).
+		WillReturnRows(insertedRow(true))
+	// a.txt still exists, so b.txt is a hard link and gets its own row.
+	lookup.ExpectQuery().
+		WithArgs("backup1.local", device, inode).
+		WillReturnRows(inodeRows().AddRow(7, "a.txt", root, info.Size(), modTime))
+	insert.ExpectQuery().
+		WithArgs("b.txt", "backup1.local", info.Size(), root, device, inode, sqlmock.AnyArg(), OriginFind, sqlmock.AnyArg(), nil).
+		WillReturnRows(insertedRow(true))
+	mock.ExpectCommit()
+
+	if err := FindFiles(context.Background(), db, FindOptions{Server: "Backup1", Path: "photos"}); err != nil {
+		t.Fatalf("FindFiles error: %v", err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatalf("unmet expectations: %v", err)
+	}
+}
+
+func TestFindFilesIgnoresReusedInode(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("sqlmock: %v", err)
+	}
+	defer db.Close()
+
+	root := t.TempDir()
+	newPath := filepath.Join(root, "new.txt")
+	if err := os.WriteFile(newPath, []byte("fresh content"), 0644); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	info, device, inode := statIdentity(t, newPath)
+
+	insert, lookup, _ := expectFindSetup(mock, root)
+	// deleted.txt is gone, but its size and mtime do not match: the
+	// filesystem handed its inode to an unrelated new file.
+	lookup.ExpectQuery().
+		WithArgs("backup1.local", device, inode).
+		WillReturnRows(inodeRows().AddRow(9, "deleted.txt", root, int64(3), time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)))
+	insert.ExpectQuery().
+		WithArgs("new.txt", "backup1.local", info.Size(), root, device, inode, sqlmock.AnyArg(), OriginFind, sqlmock.AnyArg(), nil).
+		WillReturnRows(insertedRow(true))
+	mock.ExpectCommit()
+
+	if err := FindFiles(context.Background(), db, FindOptions{Server: "Backup1", Path: "photos"}); err != nil {
+		t.Fatalf("FindFiles error: %v", err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatalf("unmet expectations: %v", err)
+	}
+}
+
+func TestFindFilesStoresLowercasedHostname(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("sqlmock: %v", err)
+	}
+	defer db.Close()
+
+	root := t.TempDir()
+	if err := os.WriteFile(filepath.Join(root, "a.txt"), []byte("a"), 0644); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+
+	mock.ExpectQuery("SELECT id, name, hostname, ip, root_path, settings, created_at FROM hosts WHERE name = \\$1").
+		WithArgs("Backup1").
+		WillReturnRows(sqlmock.NewRows([]string{"id", "name", "hostname", "ip", "root_path", "settings", "created_at"}).
+			AddRow(1, "Backup1", "Backup1.Local", "1.1.1.1", "/old", []byte(`{"paths":{"photos":"`+root+`"}}`), time.Now()))
+	mock.ExpectBegin()
+	insert := mock.ExpectPrepare("INSERT INTO files")
+	lookup := mock.ExpectPrepare("SELECT id, path, COALESCE\\(root_folder, ''\\), size, mod_time")
+	mock.ExpectPrepare("UPDATE files SET path")
+	lookup.ExpectQuery().
+		WithArgs("backup1.local", sqlmock.AnyArg(), sqlmock.AnyArg()).
+		WillReturnRows(inodeRows())
+	insert.ExpectQuery().
+		WithArgs("a.txt", "backup1.local", sqlmock.AnyArg(), root, sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg(), OriginFind, sqlmock.AnyArg(), nil).
+		WillReturnRows(insertedRow(true))
+	mock.ExpectCommit()
+
+	if err := FindFiles(context.Background(), db, FindOptions{Server: "Backup1", Path: "photos"}); err != nil {
+		t.Fatalf("FindFiles error: %v", err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatalf("unmet expectations: %v", err)
+	}
+}
+
+func TestFindFilesFollowsSymlinkedDirectories(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("sqlmock: %v", err)
+	}
+	defer db.Close()
+
+	store := t.TempDir()
+	root := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(store, "albums"), 0755); err != nil {
+		t.Fatalf("mkdir: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(store, "albums", "photo.jpg"), []byte("jpeg"), 0644); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	if err := os.Symlink(filepath.Join(store, "albums"), filepath.Join(root, "albums")); err != nil {
+		t.Skipf("symlinks not supported: %v", err)
+	}
+
+	insert, lookup, _ := expectFindSetup(mock, root)
+	lookup.ExpectQuery().
+		WithArgs("backup1.local", sqlmock.AnyArg(), sqlmock.AnyArg()).
+		WillReturnRows(inodeRows())
+	insert.ExpectQuery().
+		WithArgs(filepath.Join("albums", "photo.jpg"), "backup1.local", int64(4), root, sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg(), OriginFind, sqlmock.AnyArg(), nil).
+		WillReturnRows(insertedRow(true))
+	mock.ExpectCommit()
+
+	if err := FindFiles(context.Background(), db, FindOptions{Server: "Backup1", Path: "photos", FollowSymlinks: true}); err != nil {
+		t.Fatalf("FindFiles error: %v", err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatalf("unmet expectations: %v", err)
+	}
+}
+
+func TestFindFilesReportsOnlyNewPaths(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("sqlmock: %v", err)
+	}
+	defer db.Close()
+
+	root := t.TempDir()
+	for _, name := range []string{"new.mkv", "old.mkv"} {
+		if err := os.WriteFile(filepath.Join(root, name), []byte(name), 0644); err != nil {
+			t.Fatalf("write: %v", err)
+		}
+	}
+
+	mock.ExpectQuery("SELECT id, name, hostname, ip, root_path, settings, created_at FROM hosts WHERE name = \\$1").
+		WithArgs("Backup1").
+		WillReturnRows(sqlmock.NewRows([]string{"id", "name", "hostname", "ip", "root_path", "settings", "created_at"}).
+			AddRow(1, "Backup1", "backup1.local", "1.1.1.1", "/old", []byte(`{"paths":{"photos":"`+root+`"}}`), time.Now()))
+	mock.ExpectBegin()
+	insert := mock.ExpectPrepare(`(?s)INSERT INTO files.*RETURNING \(xmax = 0\) AS inserted`)
+	lookup := mock.ExpectPrepare("SELECT id, path, COALESCE\\(root_folder, ''\\), size, mod_time")
+	mock.ExpectPrepare("UPDATE files SET path")
+	for _, row := range []struct {
+		name     string
+		inserted bool
+	}{{"new.mkv", true}, {"old.mkv", false}} {
+		lookup.ExpectQuery().
+			WithArgs("backup1.local", sqlmock.AnyArg(), sqlmock.AnyArg()).
+			WillReturnRows(inodeRows())
+		insert.ExpectQuery().
+			WithArgs(row.name, "backup1.local", sqlmock.AnyArg(), root, sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg(), OriginFind, sqlmock.AnyArg(), nil).
+			WillReturnRows(insertedRow(row.inserted))
+	}
+	mock.ExpectCommit()
+
+	var report bytes.Buffer
+	stats := &RunStats{}
+	if err := FindFiles(context.Background(), db, FindOptions{Server: "Backup1", Path: "photos", ReportNew: &report, Stats: stats}); err != nil {
+		t.Fatalf("FindFiles error: %v", err)
+	}
+	if report.String() != "photos/new.mkv\n" {
+		t.Fatalf("unexpected report %q", report.String())
+	}
+	if c := stats.Counters(); c["new"] != 1 || c["updated"] != 1 {
+		t.Fatalf("unexpected counters %v", c)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatalf("unmet expectations: %v", err)
+	}
+}
+
+func TestFindFilesReportsNothingWhenTheBatchFailsToCommit(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("sqlmock: %v", err)
+	}
+	defer db.Close()
+
+	root := t.TempDir()
+	if err := os.WriteFile(filepath.Join(root, "new.mkv"), []byte("new"), 0644); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+
+	insert, lookup, _ := expectFindSetup(mock, root)
+	lookup.ExpectQuery().
+		WithArgs("backup1.local", sqlmock.AnyArg(), sqlmock.AnyArg()).
+		WillReturnRows(inodeRows())
+	insert.ExpectQuery().
+		WithArgs("new.mkv", "backup1.local", sqlmock.AnyArg(), root, sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg(), OriginFind, sqlmock.AnyArg(), nil).
+		WillReturnRows(insertedRow(true))
+	mock.ExpectCommit().WillReturnError(errors.New("connection reset"))
+
+	var report bytes.Buffer
+	if err := FindFiles(context.Background(), db, FindOptions{Server: "Backup1", Path: "photos", ReportNew: &report}); err == nil {
+		t.Fatalf("expected the failed commit to be reported")
+	}
+	if report.Len() != 0 {
+		t.Fatalf("expected no report for a batch that never committed, got %q", report.String())
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatalf("unmet expectations: %v", err)
+	}
+}
@@ -0,0 +1,205 @@
+package files
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"deduplicator/db"
+)
+
+// FreeSpaceFloor is the free space a destination filesystem must keep, as
+// given to --min-free: an absolute size, or a percentage of the filesystem.
+// The zero value keeps no headroom.
+type FreeSpaceFloor struct {
+	Bytes   int64
+	Percent float64
+}
+
+// ParseFreeSpaceFloor parses a --min-free value such as "50G" or "5%".
+func ParseFreeSpaceFloor(value string) (FreeSpaceFloor, error) {
+	value = strings.TrimSpace(value)
+	if pct, ok := strings.CutSuffix(value, "%"); ok {
+		percent, err := strconv.ParseFloat(strings.TrimSpace(pct), 64)
+		if err != nil || percent < 0 || percent >= 100 {
+			return FreeSpaceFloor{}, fmt.Errorf("invalid free space percentage: %s", value)
+		}
+		return FreeSpaceFloor{Percent: percent}, nil
+	}
+	size, err := ParseSize(value)
+	if err != nil {
+		return FreeSpaceFloor{}, err
+	}
+	if size < 0 {
+		return FreeSpaceFloor{}, fmt.Errorf("invalid free space size: %s", value)
+	}
+	return FreeSpaceFloor{Bytes: size}, nil
+}
+
+// IsZero reports whether the floor keeps no headroom.
+func (f FreeSpaceFloor) IsZero() bool {
+	return f.Bytes == 0 && f.Percent == 0
+}
+
+func (f FreeSpaceFloor) String() string {
+	if f.Percent > 0 {
+		return strconv.FormatFloat(f.Percent, 'f', -1, 64) + "%"
+	}
+	return formatBytes(f.Bytes) + " bytes"
+}
+
+// bytesOf returns the floor in bytes on a filesystem of space.
+func (f FreeSpaceFloor) bytesOf(space diskSpace) int64 {
+	if f.Percent > 0 {
+		return int64(float64(space.Total) * f.Percent / 100)
+	}
+	return f.Bytes
+}
+
+// diskSpace is the size of a filesystem and the space left on it for
+// unprivileged writers, in bytes.
+type diskSpace struct {
+	Total     int64
+	Available int64
+}
+
+// destinationSpace returns the space of the filesystem holding dir, on host
+// over ssh or locally when host is "". dir does not need to exist yet; its
+// nearest existing parent is checked. Tests swap in a stub.
+var destinationSpace = func(ctx context.Context, host string, settings db.SSHSettings, dir string) (diskSpace, error) {
+	if host == "" {
+		return localDiskSpace(dir)
+	}
+	return remoteDiskSpace(ctx, host, settings, dir)
+}
+
+func localDiskSpace(dir string) (diskSpace, error) {
+	for {
+		var st syscall.Statfs_t
+		err := syscall.Statfs(dir, &st)
+		if err == nil {
+			return diskSpace{
+				Total:     int64(st.Blocks) * int64(st.Bsize),
+				Available: int64(st.Bavail) * int64(st.Bsize),
+			}, nil
+		}
+		parent := filepath.Dir(dir)
+		if !errors.Is(err, os.ErrNotExist) || parent == dir {
+			return diskSpace{}, fmt.Errorf("error checking free space of %s: %v", dir, err)
+		}
+		dir = parent
+	}
+}
+
+func remoteDiskSpace(ctx context.Context, host string, settings db.SSHSettings, dir string) (diskSpace, error) {
+	script := "d=" + shellEscape(dir) + `; while [ ! -e "$d" ]; do d=$(dirname "$d"); done; df -P -k "$d"`
+	cmd, err := sshCommand(ctx, host, settings, script)
+	if err != nil {
+		return diskSpace{}, err
+	}
+	output, err := cmd.Output()
+	if err != nil {
+		return diskSpace{}, fmt.Errorf("error checking free space of %s:%s: %v", host, dir, err)
+	}
+	space, err := parseDfOutput(string(output))
+	if err != nil {
+		return diskSpace{}, fmt.Errorf("error checking free space of %s:%s: %v", host, dir, err)
+	}
+	return space, nil
+}
+
+// parseDfOutput reads the filesystem line of df -P -k output.
+func parseDfOutput(output string) (diskSpace, error) {
+	lines := strings.Split(strings.TrimSpace(output), "\n")
+	if len(lines) < 2 {
+		return diskSpace{}, fmt.Errorf("unexpected df output: %q", output)
+	}
+	fields := strings.Fields(lines[len(lines)-1])
+	if len(fields) < 6 {
+		return diskSpace{}, fmt.Errorf("unexpected df output: %q", output)
+	}
+	total, err := strconv.ParseInt(fields[1], 10, 64)
+	if err != nil {
+		return diskSpace{}, fmt.Errorf("unexpected df size %q", fields[1])
+	}
+	available, err := strconv.ParseInt(fields[3], 10, 64)
+	if err != nil {
+		return diskSpace{}, fmt.Errorf("unexpected df available space %q", fields[3])
+	}
+	return diskSpace{Total: total * 1024, Available: available * 1024}, nil
+}
+
+// DefaultFreeCheckEvery is how many files an import transfers between
+// checks of the destination's free space.
+const DefaultFreeCheckEvery = 20
+
+// errBelowHeadroom stops a run whose destination is running out of space.
+var errBelowHeadroom = errors.New("stopped: destination below headroom")
+
+// spaceGuard keeps a destination above its free space floor during a run.
+// The free space is checked again every `every` files, and sooner when the
+// next file would not fit by the running estimate.
+type spaceGuard struct {
+	floor FreeSpaceFloor
+	host  string // "" for a local destination
+	ssh   db.SSHSettings
+	dir   string
+	every int
+
+	checked    bool
+	space      diskSpace
+	sinceCheck int
+}
+
+func newSpaceGuard(floor FreeSpaceFloor, host string, settings db.SSHSettings, dir string, every int) *spaceGuard {
+	return &spaceGuard{floor: floor, host: host, ssh: settings, dir: dir, every: every}
+}
+
+func (g *spaceGuard) refresh(ctx context.Context) error {
+	space, err := destinationSpace(ctx, g.host, g.ssh, g.dir)
+	if err != nil {
+		return err
+	}
+	g.space, g.checked, g.sinceCheck = space, true, 0
+	return nil
+}
+
+// admit returns an error wrapping errBelowHeadroom if writing size more
+// bytes would take the destination under its floor. A nil guard or a zero
+// floor admits everything.
+func (g *spaceGuard) admit(ctx context.Context, size int64) error {
+	if g == nil || g.floor.IsZero() {
+		return nil
+	}
+	if !g.checked || g.sinceCheck >= g.every || g.space.Available-size < g.floor.bytesOf(g.space) {
+		if err := g.refresh(ctx); err != nil {
+			return err
+		}
+	}
+	if floor := g.floor.bytesOf(g.space); g.space.Available-size < floor {
+		return fmt.Errorf("%w: %s bytes free on %s, %s bytes wanted, floor %s bytes",
+			errBelowHeadroom, formatBytes(g.space.Available), g.label(), formatBytes(size), formatBytes(floor))
+	}
+	return nil
+}
+
+// wrote accounts for size bytes written since the last check.
+func (g *spaceGuard) wrote(size int64) {
+	if g == nil {
+		return
+	}
+	g.space.Available -= size
+	g.sinceCheck++
+}
+
+func (g *spaceGuard) label() string {
+	if g.host == "" {
+		return g.dir
+	}
+	return g.host + ":" + g.dir
+}
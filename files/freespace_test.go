@@ -0,0 +1,192 @@
+package files
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"deduplicator/db"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+func TestParseFreeSpaceFloor(t *testing.T) {
+	cases := []struct {
+		value string
+		want  FreeSpaceFloor
+	}{
+		{"", FreeSpaceFloor{}},
+		{"50G", FreeSpaceFloor{Bytes: 50 * 1024 * 1024 * 1024}},
+		{"5%", FreeSpaceFloor{Percent: 5}},
+		{" 2.5 %", FreeSpaceFloor{Percent: 2.5}},
+	}
+	for _, c := range cases {
+		got, err := ParseFreeSpaceFloor(c.value)
+		if err != nil || got != c.want {
+			t.Errorf("ParseFreeSpaceFloor(%q) = %+v, %v; want %+v", c.value, got, err, c.want)
+		}
+	}
+	for _, bad := range []string{"x%", "100%", "-1%", "lots"} {
+		if _, err := ParseFreeSpaceFloor(bad); err == nil {
+			t.Errorf("ParseFreeSpaceFloor(%q) should fail", bad)
+		}
+	}
+}
+
+func TestParseDfOutput(t *testing.T) {
+	out := "Filesystem     1024-blocks      Used Available Capacity Mounted on\n" +
+		"/dev/sdb1        976762584 900000000  76762584      93% /mnt/photos\n"
+	space, err := parseDfOutput(out)
+	if err != nil {
+		t.Fatalf("parseDfOutput: %v", err)
+	}
+	if space.Total != 976762584*1024 || space.Available != 76762584*1024 {
+		t.Fatalf("unexpected space %+v", space)
+	}
+	if _, err := parseDfOutput("df: /nope: No such file or directory\n"); err == nil {
+		t.Fatalf("expected an error for output without a filesystem line")
+	}
+}
+
+// stubDestinationSpace has every destination report a filesystem of total
+// bytes with free - (bytes of files under dest) available.
+func stubDestinationSpace(t *testing.T, dest string, total, free int64) *int {
+	t.Helper()
+	calls := 0
+	original := destinationSpace
+	t.Cleanup(func() { destinationSpace = original })
+	destinationSpace = func(ctx context.Context, host string, settings db.SSHSettings, dir string) (diskSpace, error) {
+		calls++
+		var used int64
+		filepath.Walk(dest, func(path string, info os.FileInfo, err error) error {
+			if err == nil && !info.IsDir() {
+				used += info.Size()
+			}
+			return nil
+		})
+		return diskSpace{Total: total, Available: free - used}, nil
+	}
+	return &calls
+}
+
+func TestImportStopsBeforeDestinationDropsUnderHeadroom(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("sqlmock: %v", err)
+	}
+	defer db.Close()
+
+	source, dest := routedImportFixture(t)
+	expectRoutedImportHost(mock, dest)
+	stubDestinationSpace(t, dest, 1000, 100)
+
+	// 100 bytes free with an 80 byte floor: the 19 byte photo fits, the
+	// 15 byte report after it does not.
+	hostname, _ := os.Hostname()
+	lower := strings.ToLower(hostname)
+	expectImportHashes(mock, lower)
+	expectImportBatch(mock, lower, importedRow{path: filepath.Join("camera", "2024", "img.jpg"), root: filepath.Join(dest, "inbox"), size: 19})
+
+	stubDir := t.TempDir()
+	writeStub(t, stubDir, "rsync", `#!/bin/sh
+count=$#
+src=$(eval echo \${$((count-1))})
+dst=$(eval echo \${$count})
+mkdir -p "$(dirname "$dst")"
+cp "$src" "$dst"
+`)
+	t.Setenv("PATH", stubDir+string(os.PathListSeparator)+os.Getenv("PATH"))
+
+	stats := &RunStats{}
+	out := captureStdout(t, func() {
+		err = ImportFiles(context.Background(), db, ImportOptions{
+			SourcePath:   source,
+			HostName:     "Backup1",
+			FriendlyPath: "inbox",
+			MinFree:      FreeSpaceFloor{Bytes: 80},
+			Stats:        stats,
+		})
+	})
+	if !errors.Is(err, errBelowHeadroom) {
+		t.Fatalf("expected the import to stop below headroom, got %v\n%s", err, out)
+	}
+	if !strings.Contains(out, "Files transferred: 1 (19 B)") || !strings.Contains(out, "Import stopped: destination below headroom: 81 bytes free") {
+		t.Fatalf("expected a summary of the partial run:\n%s", out)
+	}
+	if _, err := os.Stat(filepath.Join(dest, "inbox", "docs", "report.pdf")); !os.IsNotExist(err) {
+		t.Fatalf("the report should not have been transferred, stat err: %v", err)
+	}
+	if counters := stats.Counters(); counters["transferred"] != 1 || counters["stopped_below_headroom"] != 1 {
+		t.Fatalf("unexpected counters: %v", counters)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatalf("unmet expectations: %v", err)
+	}
+}
+
+func TestImportRefusesToStartBelowHeadroom(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("sqlmock: %v", err)
+	}
+	defer db.Close()
+
+	source, dest := routedImportFixture(t)
+	expectRoutedImportHost(mock, dest)
+	stubDestinationSpace(t, dest, 1000, 40)
+
+	captureStdout(t, func() {
+		err = ImportFiles(context.Background(), db, ImportOptions{
+			SourcePath:   source,
+			HostName:     "Backup1",
+			FriendlyPath: "inbox",
+			MinFree:      FreeSpaceFloor{Percent: 5},
+		})
+	})
+	if !errors.Is(err, errBelowHeadroom) || !strings.Contains(err.Error(), "floor 50 bytes") {
+		t.Fatalf("expected the import not to start, got %v", err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatalf("unmet expectations: %v", err)
+	}
+}
+
+func TestImportDryRunWarnsWhenTransferExceedsHeadroom(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("sqlmock: %v", err)
+	}
+	defer db.Close()
+
+	source, dest := routedImportFixture(t)
+	expectRoutedImportHost(mock, dest)
+	calls := stubDestinationSpace(t, dest, 200, 30)
+
+	out := captureStdout(t, func() {
+		err = ImportFiles(context.Background(), db, ImportOptions{
+			SourcePath:   source,
+			HostName:     "Backup1",
+			FriendlyPath: "inbox",
+			DryRun:       true,
+			MinFree:      FreeSpaceFloor{Percent: 5},
+		})
+	})
+	if err != nil {
+		t.Fatalf("ImportFiles: %v", err)
+	}
+	// 19 + 15 + 14 bytes planned, 30 free and a floor of 5% of 200.
+	for _, want := range []string{
+		"Estimated transfer to " + dest + "/inbox/: 48 bytes",
+		"30 bytes free with a floor of 10 bytes leaves room for 20 bytes; a real run would stop part way",
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("output does not mention %q:\n%s", want, out)
+		}
+	}
+	if *calls != 1 {
+		t.Fatalf("expected one free space check after the walk, got %d", *calls)
+	}
+}
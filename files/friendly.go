@@ -0,0 +1,169 @@
+package files
+
+import (
+	"database/sql"
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"deduplicator/db"
+	"deduplicator/logging"
+)
+
+// UnmappedPath is shown in place of a friendly name when no path mapping of
+// the host covers a root folder.
+const UnmappedPath = "(unmapped)"
+
+// PathNames maps the absolute root folders of one host back to the friendly
+// path names they were registered under.
+type PathNames struct {
+	Host  string // Host name, e.g. "Backup1"
+	roots []friendlyRoot
+}
+
+type friendlyRoot struct {
+	name string
+	root string
+}
+
+// NewPathNames builds the resolver for host from its path mappings.
+func NewPathNames(host *db.Host) (*PathNames, error) {
+	paths, err := host.GetPaths()
+	if err != nil {
+		return nil, fmt.Errorf("error getting path mappings for host %s: %v", host.Name, err)
+	}
+	names := &PathNames{Host: host.Name}
+	for name, root := range paths {
+		names.roots = append(names.roots, friendlyRoot{name: name, root: filepath.Clean(root)})
+	}
+	// Longest root first, so a nested mapping wins over the one it sits in.
+	sort.Slice(names.roots, func(i, j int) bool {
+		if len(names.roots[i].root) != len(names.roots[j].root) {
+			return len(names.roots[i].root) > len(names.roots[j].root)
+		}
+		return names.roots[i].name < names.roots[j].name
+	})
+	return names, nil
+}
+
+// Resolve returns the friendly name whose root is the longest prefix of
+// rootFolder and the part of rootFolder below that root.
+func (n *PathNames) Resolve(rootFolder string) (name, rest string, ok bool) {
+	if n == nil || rootFolder == "" {
+		return "", "", false
+	}
+	rootFolder = filepath.Clean(rootFolder)
+	for _, r := range n.roots {
+		if rootFolder == r.root {
+			return r.name, "", true
+		}
+		prefix := r.root
+		if !strings.HasSuffix(prefix, string(filepath.Separator)) {
+			prefix += string(filepath.Separator)
+		}
+		if strings.HasPrefix(rootFolder, prefix) {
+			return r.name, strings.TrimPrefix(rootFolder, prefix), true
+		}
+	}
+	return "", "", false
+}
+
+// split returns the root of the mapping that holds path, an absolute file
+// path, and path relative to that root: the root_folder and path files find
+// records for the file.
+func (n *PathNames) split(path string) (root, rel string, ok bool) {
+	if n == nil {
+		return "", "", false
+	}
+	path = filepath.Clean(path)
+	for _, r := range n.roots {
+		prefix := r.root
+		if !strings.HasSuffix(prefix, string(filepath.Separator)) {
+			prefix += string(filepath.Separator)
+		}
+		if strings.HasPrefix(path, prefix) {
+			return r.root, strings.TrimPrefix(path, prefix), true
+		}
+	}
+	return "", "", false
+}
+
+// Name returns the friendly name of rootFolder, or UnmappedPath.
+func (n *PathNames) Name(rootFolder string) string {
+	if name, _, ok := n.Resolve(rootFolder); ok {
+		return name
+	}
+	return UnmappedPath
+}
+
+// Display returns path (relative to rootFolder) under its friendly name,
+// such as "photos/2021/img.jpg". Paths outside every mapping are shown in
+// full after UnmappedPath.
+func (n *PathNames) Display(rootFolder, path string) string {
+	if filepath.IsAbs(path) {
+		// Legacy rows store the full path and no root folder.
+		rootFolder, path = filepath.Dir(path), filepath.Base(path)
+	}
+	name, rest, ok := n.Resolve(rootFolder)
+	if !ok {
+		if rootFolder != "" && !filepath.IsAbs(path) {
+			path = filepath.Join(rootFolder, path)
+		}
+		return UnmappedPath + " " + path
+	}
+	return filepath.ToSlash(filepath.Join(name, rest, path))
+}
+
+// Label is Display followed by the host name, as used in logs and reports:
+// "photos/2021/img.jpg on Backup1".
+func (n *PathNames) Label(rootFolder, path string) string {
+	return n.Display(rootFolder, path) + " on " + n.Host
+}
+
+// PathNameCache resolves friendly names for rows of any host. The hosts are
+// loaded once, on first use, and kept for the rest of the run.
+type PathNameCache struct {
+	db         *sql.DB
+	loaded     bool
+	byHostname map[string]*PathNames
+}
+
+// NewPathNameCache returns a cache that loads its hosts from database.
+func NewPathNameCache(database *sql.DB) *PathNameCache {
+	return &PathNameCache{db: database}
+}
+
+// ForHostname returns the resolver for a files.hostname value. Unknown hosts
+// get a resolver that reports every path as unmapped.
+func (c *PathNameCache) ForHostname(hostname string) *PathNames {
+	if !c.loaded {
+		c.loaded = true
+		c.byHostname = make(map[string]*PathNames)
+		hosts, err := db.ListHosts(c.db)
+		if err != nil {
+			logging.ErrorLogger.Printf("Warning: could not load hosts for friendly path names: %v", err)
+		}
+		for i := range hosts {
+			names, err := NewPathNames(&hosts[i])
+			if err != nil {
+				logging.ErrorLogger.Printf("Warning: %v", err)
+				names = &PathNames{Host: hosts[i].Name}
+			}
+			c.byHostname[normalizeHostname(hosts[i].Hostname)] = names
+		}
+	}
+	if names, ok := c.byHostname[normalizeHostname(hostname)]; ok {
+		return names
+	}
+	return &PathNames{Host: hostname}
+}
+
+// Label returns "photos/2021/img.jpg on Backup1" for a files row. A nil
+// cache keeps the raw "path (hostname)" form.
+func (c *PathNameCache) Label(hostname, rootFolder, path string) string {
+	if c == nil {
+		return fmt.Sprintf("%s (%s)", path, hostname)
+	}
+	return c.ForHostname(hostname).Label(rootFolder, path)
+}
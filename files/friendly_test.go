@@ -0,0 +1,128 @@
+package files
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"deduplicator/db"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+// expectPathNameHosts expects the hosts query a PathNameCache runs on first
+// use. Each host is given as name, hostname and its paths settings JSON.
+func expectPathNameHosts(mock sqlmock.Sqlmock, hosts ...[3]string) {
+	rows := sqlmock.NewRows([]string{"id", "name", "hostname", "ip", "root_path", "settings", "created_at"})
+	for i, h := range hosts {
+		rows.AddRow(i+1, h[0], h[1], "", "", []byte(h[2]), time.Now())
+	}
+	mock.ExpectQuery(`SELECT id, name, hostname, ip, root_path, settings, created_at\s+FROM hosts ORDER BY name`).
+		WillReturnRows(rows)
+}
+
+func testPathNames(t *testing.T, paths map[string]string) *PathNames {
+	t.Helper()
+	settings, err := json.Marshal(db.HostPaths{Paths: paths})
+	if err != nil {
+		t.Fatalf("marshal: %v", err)
+	}
+	names, err := NewPathNames(&db.Host{Name: "Backup1", Settings: settings})
+	if err != nil {
+		t.Fatalf("NewPathNames: %v", err)
+	}
+	return names
+}
+
+func TestPathNamesResolveNestedMappingsByLongestPrefix(t *testing.T) {
+	names := testPathNames(t, map[string]string{
+		"media":  "/data/media",
+		"movies": "/data/media/movies",
+		"photos": "/data/photos/",
+	})
+
+	cases := []struct {
+		rootFolder, path, want string
+	}{
+		{"/data/media/movies", "film.mkv", "movies/film.mkv"},
+		{"/data/media/movies/2021", "film.mkv", "movies/2021/film.mkv"},
+		{"/data/media/music", "song.flac", "media/music/song.flac"},
+		{"/data/photos", "2021/img.jpg", "photos/2021/img.jpg"},
+		// A shared name prefix is not a path prefix.
+		{"/data/media-old", "a.txt", "(unmapped) /data/media-old/a.txt"},
+		{"/srv/other", "b.txt", "(unmapped) /srv/other/b.txt"},
+		{"", "/data/photos/legacy.jpg", "photos/legacy.jpg"},
+		{"", "relative.txt", "(unmapped) relative.txt"},
+	}
+	for _, c := range cases {
+		if got := names.Display(c.rootFolder, c.path); got != c.want {
+			t.Errorf("Display(%q, %q) = %q, want %q", c.rootFolder, c.path, got, c.want)
+		}
+	}
+
+	if got := names.Name("/data/media/movies/2021"); got != "movies" {
+		t.Errorf("Name of nested root = %q, want movies", got)
+	}
+	if got := names.Name("/srv/other"); got != UnmappedPath {
+		t.Errorf("Name of unmapped root = %q, want %q", got, UnmappedPath)
+	}
+	if got := names.Label("/data/photos", "2021/img.jpg"); got != "photos/2021/img.jpg on Backup1" {
+		t.Errorf("Label = %q", got)
+	}
+}
+
+func TestPathNameCacheLoadsHostsOnce(t *testing.T) {
+	database, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("sqlmock: %v", err)
+	}
+	defer database.Close()
+
+	expectPathNameHosts(mock, [3]string{"Backup1", "Backup1.Local", `{"paths":{"photos":"/data/photos"}}`})
+
+	names := NewPathNameCache(database)
+	if got := names.Label("backup1.local", "/data/photos", "a.jpg"); got != "photos/a.jpg on Backup1" {
+		t.Fatalf("unexpected label %q", got)
+	}
+	if got := names.Label("brain", "/data/photos", "b.jpg"); got != "(unmapped) /data/photos/b.jpg on brain" {
+		t.Fatalf("unexpected label for an unknown host %q", got)
+	}
+	if got := (*PathNameCache)(nil).Label("brain", "/data", "c.jpg"); got != "c.jpg (brain)" {
+		t.Fatalf("unexpected label without a cache %q", got)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatalf("unmet expectations: %v", err)
+	}
+}
+
+func TestListDupesShowsFriendlyPaths(t *testing.T) {
+	database, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("sqlmock: %v", err)
+	}
+	defer database.Close()
+
+	mock.ExpectQuery("WITH duplicates AS").
+		WillReturnRows(sqlmock.NewRows([]string{"hash", "path", "hostname", "size", "root_folder"}).
+			AddRow("h", "2021/img.jpg", "backup1.local", int64(10), "/data/photos").
+			AddRow("h", "img.jpg", "brain", int64(10), "/home/me/pics"))
+	expectPathNameHosts(mock,
+		[3]string{"Backup1", "backup1.local", `{"paths":{"photos":"/data/photos"}}`},
+		[3]string{"Brain", "brain", `{"paths":{}}`})
+
+	out := captureStdout(t, func() {
+		if err := FindDuplicates(context.Background(), database, DuplicateListOptions{}); err != nil {
+			t.Fatalf("FindDuplicates: %v", err)
+		}
+	})
+	for _, want := range []string{"photos/2021/img.jpg on Backup1", "(unmapped) /home/me/pics/img.jpg on Brain"} {
+		if !strings.Contains(out, want) {
+			t.Errorf("expected %q in output:\n%s", want, out)
+		}
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatalf("unmet expectations: %v", err)
+	}
+}
@@ -0,0 +1,173 @@
+package files
+
+import (
+	"database/sql"
+	"fmt"
+)
+
+// duplicateRow is one files row of a duplicate query. The query must order
+// rows by hash and size so each group's rows are adjacent.
+type duplicateRow struct {
+	Hash       string
+	Size       int64
+	Path       string
+	Hostname   string
+	RootFolder string
+}
+
+// groupAccumulator builds DuplicateGroups from a stream of duplicateRows,
+// so callers can process each group as soon as its last row has been read.
+type groupAccumulator struct {
+	current *DuplicateGroup
+
+	// exclude drops the rows it matches. A group they leave with fewer than
+	// two files is dropped too.
+	exclude PathExcludes
+	// limit stops the accumulator after that many groups (0 = no limit), for
+	// queries that cannot apply --count because exclude drops groups.
+	limit int
+
+	hash     string // group of the last row read, kept or excluded
+	size     int64
+	excluded int // rows of that group dropped by exclude
+	yielded  int
+}
+
+// NextRow adds row to the group being read. When row starts a new group,
+// the previous one is complete and is returned.
+func (a *groupAccumulator) NextRow(row duplicateRow) []DuplicateGroup {
+	var completed []DuplicateGroup
+	if a.hash != row.Hash || a.size != row.Size {
+		completed = a.complete()
+		a.hash, a.size, a.excluded = row.Hash, row.Size, 0
+	}
+	if a.exclude.Match(row.RootFolder, row.Path) {
+		a.excluded++
+		return completed
+	}
+	if a.current == nil {
+		a.current = &DuplicateGroup{
+			Hash:        row.Hash,
+			Size:        row.Size,
+			Files:       make([]string, 0),
+			Hosts:       make([]string, 0),
+			RootFolders: make([]string, 0),
+		}
+	}
+	a.current.Files = append(a.current.Files, row.Path)
+	a.current.Hosts = append(a.current.Hosts, row.Hostname)
+	a.current.RootFolders = append(a.current.RootFolders, row.RootFolder)
+	a.current.TotalSize += row.Size
+	return completed
+}
+
+// Flush returns the group still being read, once the rows are exhausted
+// without error. Do not flush after a failed read: the group may be missing
+// members.
+func (a *groupAccumulator) Flush() []DuplicateGroup {
+	return a.complete()
+}
+
+// complete ends the group being read and returns it, unless exclude left it
+// with a single file or the limit has been reached.
+func (a *groupAccumulator) complete() []DuplicateGroup {
+	group := a.current
+	a.current = nil
+	if group == nil || a.Full() || (a.excluded > 0 && len(group.Files) < 2) {
+		return nil
+	}
+	a.yielded++
+	return []DuplicateGroup{*group}
+}
+
+// Full reports whether the limit has been reached, so the caller can stop
+// reading rows.
+func (a *groupAccumulator) Full() bool {
+	return a.limit > 0 && a.yielded >= a.limit
+}
+
+// Pending returns the hash of the group still being read, or "" if none, so
+// a failed read can name the group it abandons.
+func (a *groupAccumulator) Pending() string {
+	if a.current == nil {
+		return ""
+	}
+	return a.current.Hash
+}
+
+// abandonedGroupError describes a read error, naming the incomplete group
+// it left unprocessed.
+func (a *groupAccumulator) abandonedGroupError(what string, err error) error {
+	if hash := a.Pending(); hash != "" {
+		return fmt.Errorf("error %s (group %s left incomplete and not processed): %v", what, hash, err)
+	}
+	return fmt.Errorf("error %s: %v", what, err)
+}
+
+// groupCursorHook, when set, is told how many groups the cursor holds each
+// time it yields one: the group yielded, any completed behind it and the one
+// still being read. Tests use it to check that memory stays bounded.
+var groupCursorHook func(held int)
+
+// duplicateGroupCursor yields the groups of a duplicate query one at a time,
+// in query order, like sql.Rows yields rows. Close it when done.
+type duplicateGroupCursor struct {
+	rows  *sql.Rows
+	acc   groupAccumulator
+	ready []DuplicateGroup
+	group DuplicateGroup
+	done  bool
+	err   error
+}
+
+// Next advances to the next complete group, reading rows until one ends.
+// It returns false when the rows are exhausted or a read failed; check Err.
+func (c *duplicateGroupCursor) Next() bool {
+	for len(c.ready) == 0 {
+		if c.done || c.acc.Full() {
+			return false
+		}
+		if !c.rows.Next() {
+			c.done = true
+			// A group cut short by a failed read is not yielded: the rows
+			// never read could hold more of its members.
+			if err := c.rows.Err(); err != nil {
+				c.err = c.acc.abandonedGroupError("iterating rows", err)
+				return false
+			}
+			c.ready = c.acc.Flush()
+			continue
+		}
+		var row duplicateRow
+		if err := c.rows.Scan(&row.Hash, &row.Path, &row.Hostname, &row.Size, &row.RootFolder); err != nil {
+			c.done = true
+			c.err = c.acc.abandonedGroupError("scanning row", err)
+			return false
+		}
+		c.ready = c.acc.NextRow(row)
+	}
+	c.group, c.ready = c.ready[0], c.ready[1:]
+	if groupCursorHook != nil {
+		held := 1 + len(c.ready)
+		if c.acc.Pending() != "" {
+			held++
+		}
+		groupCursorHook(held)
+	}
+	return true
+}
+
+// Group returns the group Next advanced to.
+func (c *duplicateGroupCursor) Group() DuplicateGroup {
+	return c.group
+}
+
+// Err returns the error that stopped Next, if any.
+func (c *duplicateGroupCursor) Err() error {
+	return c.err
+}
+
+// Close releases the rows of the query.
+func (c *duplicateGroupCursor) Close() error {
+	return c.rows.Close()
+}
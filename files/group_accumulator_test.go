@@ -0,0 +1,201 @@
+package files
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+// accumulate feeds rows through a groupAccumulator and flushes it, as a
+// successful scan would.
+func accumulate(rows ...duplicateRow) []DuplicateGroup {
+	var acc groupAccumulator
+	var groups []DuplicateGroup
+	for _, row := range rows {
+		groups = append(groups, acc.NextRow(row)...)
+	}
+	return append(groups, acc.Flush()...)
+}
+
+func TestGroupAccumulatorSingleGroup(t *testing.T) {
+	groups := accumulate(
+		duplicateRow{Hash: "h1", Size: 10, Path: "a", Hostname: "host-a", RootFolder: "/r1"},
+		duplicateRow{Hash: "h1", Size: 10, Path: "b", Hostname: "host-b", RootFolder: "/r2"},
+	)
+	want := []DuplicateGroup{{
+		Hash:        "h1",
+		Size:        10,
+		Files:       []string{"a", "b"},
+		Hosts:       []string{"host-a", "host-b"},
+		RootFolders: []string{"/r1", "/r2"},
+		TotalSize:   20,
+	}}
+	if !reflect.DeepEqual(groups, want) {
+		t.Fatalf("groups = %+v, want %+v", groups, want)
+	}
+}
+
+func TestGroupAccumulatorManyGroups(t *testing.T) {
+	var acc groupAccumulator
+	rows := []duplicateRow{
+		{Hash: "h1", Size: 10, Path: "a1"},
+		{Hash: "h1", Size: 10, Path: "a2"},
+		{Hash: "h2", Size: 5, Path: "b1"},
+		{Hash: "h2", Size: 5, Path: "b2"},
+		{Hash: "h2", Size: 5, Path: "b3"},
+		// Same hash, different size: a separate group.
+		{Hash: "h2", Size: 6, Path: "c1"},
+		{Hash: "h2", Size: 6, Path: "c2"},
+	}
+	completedAt := make(map[int]string)
+	for i, row := range rows {
+		for _, g := range acc.NextRow(row) {
+			completedAt[i] = g.Hash + "/" + strings.Join(g.Files, ",")
+		}
+	}
+	want := map[int]string{2: "h1/a1,a2", 5: "h2/b1,b2,b3"}
+	if !reflect.DeepEqual(completedAt, want) {
+		t.Fatalf("groups completed at %v, want %v", completedAt, want)
+	}
+	if acc.Pending() != "h2" {
+		t.Fatalf("Pending = %q, want h2", acc.Pending())
+	}
+}
+
+func TestGroupAccumulatorFlushesTrailingGroup(t *testing.T) {
+	groups := accumulate(
+		duplicateRow{Hash: "h1", Size: 1, Path: "a1"},
+		duplicateRow{Hash: "h1", Size: 1, Path: "a2"},
+		duplicateRow{Hash: "h2", Size: 2, Path: "b1"},
+		duplicateRow{Hash: "h2", Size: 2, Path: "b2"},
+	)
+	if len(groups) != 2 || groups[1].Hash != "h2" || len(groups[1].Files) != 2 || groups[1].TotalSize != 4 {
+		t.Fatalf("expected the trailing h2 group with two files, got %+v", groups)
+	}
+
+	var acc groupAccumulator
+	if acc.Flush() != nil || acc.Pending() != "" {
+		t.Fatalf("an empty accumulator should flush nothing")
+	}
+	acc.NextRow(duplicateRow{Hash: "h3", Size: 3, Path: "c1"})
+	if len(acc.Flush()) != 1 || acc.Flush() != nil {
+		t.Fatalf("Flush should return the trailing group exactly once")
+	}
+}
+
+func TestGroupAccumulatorNamesGroupAbandonedMidRead(t *testing.T) {
+	var acc groupAccumulator
+	acc.NextRow(duplicateRow{Hash: "h1", Size: 1, Path: "a1"})
+	acc.NextRow(duplicateRow{Hash: "h1", Size: 1, Path: "a2"})
+	acc.NextRow(duplicateRow{Hash: "h2", Size: 2, Path: "b1"})
+
+	err := acc.abandonedGroupError("iterating rows", errors.New("connection reset"))
+	if want := "error iterating rows (group h2 left incomplete and not processed): connection reset"; err.Error() != want {
+		t.Fatalf("error = %q, want %q", err, want)
+	}
+	var empty groupAccumulator
+	if err := empty.abandonedGroupError("scanning row", errors.New("bad")); err.Error() != "error scanning row: bad" {
+		t.Fatalf("unexpected error without a pending group: %q", err)
+	}
+}
+
+func TestFindDuplicateGroupsReportsGroupLostToRowError(t *testing.T) {
+	db, mock, err := sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherRegexp))
+	if err != nil {
+		t.Fatalf("sqlmock: %v", err)
+	}
+	defer db.Close()
+
+	mock.ExpectQuery(`WITH duplicates`).
+		WillReturnRows(sqlmock.NewRows([]string{"hash", "path", "hostname", "size", "root_folder"}).
+			AddRow("hash-a", "/data/a1", "host-a", int64(10), "").
+			AddRow("hash-a", "/data/a2", "host-a", int64(10), "").
+			AddRow("hash-b", "/data/b1", "host-a", int64(5), "").
+			AddRow("hash-b", "/data/b2", "host-a", int64(5), "").
+			RowError(3, errors.New("connection reset")))
+
+	groups, err := FindDuplicateGroups(context.Background(), db, "", "", DuplicateSizeRules{}, "", 0, nil)
+	if err == nil || !strings.Contains(err.Error(), "group hash-b left incomplete") {
+		t.Fatalf("expected the lost hash-b group to be named, got %v", err)
+	}
+	if groups != nil {
+		t.Fatalf("expected no groups after a failed read, got %+v", groups)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatalf("unmet expectations: %v", err)
+	}
+}
+
+func TestDedupFilesStreamsGroupsWithBoundedMemory(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("sqlmock: %v", err)
+	}
+	defer db.Close()
+
+	tempDir := t.TempDir()
+	hostname, _ := os.Hostname()
+	lower := strings.ToLower(hostname)
+
+	const groupCount = 3000
+	rows := sqlmock.NewRows([]string{"hash", "path", "hostname", "size", "root_folder"})
+	for i := 0; i < groupCount; i++ {
+		hash := fmt.Sprintf("%064x", i)
+		rows.AddRow(hash, fmt.Sprintf("a/%d.bin", i), "host-a", int64(10), "")
+		rows.AddRow(hash, fmt.Sprintf("b/%d.bin", i), "host-a", int64(10), "")
+	}
+	expectLocalHost(mock, tempDir, "")
+	mock.ExpectQuery("SELECT hostname FROM hosts WHERE LOWER\\(hostname\\) = LOWER\\(\\$1\\)").
+		WithArgs(lower).
+		WillReturnRows(sqlmock.NewRows([]string{"hostname"}).AddRow("host-a"))
+	mock.ExpectQuery("WITH duplicates AS").WillReturnRows(rows)
+	expectPathNameHosts(mock)
+
+	yielded, maxHeld := 0, 0
+	groupCursorHook = func(held int) {
+		yielded++
+		if held > maxHeld {
+			maxHeld = held
+		}
+	}
+	t.Cleanup(func() { groupCursorHook = nil })
+	log.SetOutput(io.Discard)
+	t.Cleanup(func() { log.SetOutput(os.Stderr) })
+
+	out := captureStdout(t, func() {
+		err = DedupFiles(context.Background(), db, DedupeOptions{
+			DryRun:  true,
+			DestDir: filepath.Join(tempDir, "dupes"),
+		})
+	})
+	if err != nil {
+		t.Fatalf("DedupFiles: %v", err)
+	}
+	if yielded != groupCount {
+		t.Fatalf("cursor yielded %d groups, want %d", yielded, groupCount)
+	}
+	// The group handed out plus the next one being read.
+	if maxHeld > 2 {
+		t.Fatalf("cursor held %d groups at once", maxHeld)
+	}
+	for _, want := range []string{
+		"Processed 3000 groups of duplicate files (6000 files)",
+		"Total potential space savings: " + formatBytes(groupCount*10) + " bytes",
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("output does not contain %q", want)
+		}
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatalf("unmet expectations: %v", err)
+	}
+}
@@ -1,29 +1,50 @@
 package files
 
 import (
+	"bytes"
 	"context"
 	"database/sql"
 	"deduplicator/db"
 	"deduplicator/logging"
+	"errors"
 	"fmt"
+	"io"
 	"os"
 	"path/filepath"
 	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/lib/pq"
 )
 
 // GroupDedupeOptions extends DedupeOptions with group-aware settings
 type GroupDedupeOptions struct {
-	GroupName     string // Path group to process
-	BalanceMode   string // "priority", "equal", "capacity"
-	RespectLimits bool   // Honor min/max copies from group settings
-	DryRun        bool   // If true, only show what would be done
-	MinSize       int64  // Minimum file size to consider
-	Count         int    // Limit the number of duplicate groups to process
+	GroupName     string     // Path group to process
+	BalanceMode   string     // "priority", "equal", "capacity"
+	RespectLimits bool       // Honor min/max copies from group settings
+	DryRun        bool       // If true, only show what would be done
+	MinSize       int64      // Minimum file size to consider
+	Count         int        // Limit the number of duplicate groups to process
+	Keep          KeepPolicy // Ranks copies of equal priority (zero = by host name only)
+	// VerifyBeforeAction re-hashes the kept copies and each copy to remove
+	// (over ssh for remote hosts) before removing anything. A group whose
+	// kept copies cannot all be confirmed is left alone, other copies that
+	// cannot be confirmed are skipped, and a copy found to no longer match
+	// has its hash cleared so files hash re-hashes it.
+	VerifyBeforeAction bool
+	// Workers is how many duplicate groups are processed at once (0 = 1).
+	Workers int
+	// Report is a file the plan for every duplicate hash is written to as
+	// JSON, with the outcome of each removal in real runs ("" = none).
+	Report string
 }
 
 // FileLocation represents a file's location with metadata
 type FileLocation struct {
 	Hash         string
+	HashAlgo     string // algorithm the hash was computed with (files.hash_algo)
 	Path         string
 	Hostname     string
 	HostName     string
@@ -31,6 +52,82 @@ type FileLocation struct {
 	RootFolder   string
 	Size         int64
 	Priority     int
+	Protected    bool // on a protected group member; never removed
+	ReadOnly     bool // on a read-only group member; never removed
+
+	keep keepCandidate // what a --keep policy compares
+}
+
+// groupCopySelection is the keep/remove decision for one duplicate group.
+type groupCopySelection struct {
+	Keep   []FileLocation
+	Remove []FileLocation
+	// AtMinimum is set when the group has no more than min_copies copies.
+	AtMinimum bool
+	// OverReplicated is set when protected copies that would otherwise have
+	// been removed leave the group above max_copies.
+	OverReplicated bool
+	// ReadOnlySkipped is set when the only copies that would otherwise have
+	// been removed are on read-only members, so nothing is.
+	ReadOnlySkipped bool
+}
+
+// selectGroupCopies decides which copies of a duplicate group to keep. Copies
+// are ranked by priority (lower = keep first), then by the keep policy, then
+// by host name; the first min_copies, or max_copies with respectLimits, are
+// kept. Copies on protected or read-only members are never removed, even if
+// that keeps the group above max_copies.
+func selectGroupCopies(locations []FileLocation, group *db.PathGroup, respectLimits bool, keep KeepPolicy) groupCopySelection {
+	sort.Slice(locations, func(i, j int) bool {
+		if locations[i].Priority != locations[j].Priority {
+			return locations[i].Priority < locations[j].Priority
+		}
+		if c := keep.compare(locations[i].keep, locations[j].keep); c != 0 {
+			return c < 0
+		}
+		return locations[i].HostName < locations[j].HostName
+	})
+
+	keepCount := group.MinCopies
+	if respectLimits && group.MaxCopies != nil && len(locations) > *group.MaxCopies {
+		keepCount = *group.MaxCopies
+	} else if len(locations) <= group.MinCopies {
+		return groupCopySelection{Keep: locations, AtMinimum: true}
+	}
+
+	selection := groupCopySelection{Keep: append([]FileLocation(nil), locations[:keepCount]...)}
+	spared, readOnly := 0, 0
+	for _, loc := range locations[keepCount:] {
+		if loc.Protected || loc.ReadOnly {
+			selection.Keep = append(selection.Keep, loc)
+			spared++
+			if loc.ReadOnly {
+				readOnly++
+			}
+			continue
+		}
+		selection.Remove = append(selection.Remove, loc)
+	}
+	selection.OverReplicated = spared > 0 && group.MaxCopies != nil && len(selection.Keep) > *group.MaxCopies
+	selection.ReadOnlySkipped = readOnly > 0 && len(selection.Remove) == 0
+	return selection
+}
+
+// label shows the copy under its group member's friendly path:
+// "photos/2021/img.jpg on Backup1".
+func (l FileLocation) label() string {
+	return filepath.ToSlash(filepath.Join(l.FriendlyPath, l.Path)) + " on " + l.HostName
+}
+
+// describe is label plus the copy's priority, protection and read-only flag.
+func (l FileLocation) describe() string {
+	switch {
+	case l.ReadOnly:
+		return fmt.Sprintf("%s (priority %d, read-only)", l.label(), l.Priority)
+	case l.Protected:
+		return fmt.Sprintf("%s (priority %d, protected)", l.label(), l.Priority)
+	}
+	return fmt.Sprintf("%s (priority %d)", l.label(), l.Priority)
 }
 
 // DeduplicateByGroup performs group-aware deduplication across multiple hosts
@@ -55,31 +152,70 @@ func DeduplicateByGroup(ctx context.Context, database *sql.DB, opts GroupDedupeO
 		group.Name, group.MinCopies, formatMaxCopies(group.MaxCopies))
 	fmt.Printf("Group members: %d paths across hosts\n\n", len(members))
 
+	var report *groupDedupeReport
+	if opts.Report != "" {
+		report = &groupDedupeReport{Group: group.Name, DryRun: opts.DryRun, Hashes: []groupDedupeReportEntry{}}
+		// Written before anything is removed, so a bad path stops the run
+		// instead of losing the record of it.
+		if err := report.write(opts.Report); err != nil {
+			return err
+		}
+	}
+
+	resolved, err := resolveGroupMembers(database, members)
+	if err != nil {
+		return fmt.Errorf("error finding duplicates: %v", err)
+	}
+
 	// Find duplicates across all hosts in the group
-	duplicates, err := findGroupDuplicates(ctx, database, members, opts)
+	duplicates, err := findGroupDuplicates(ctx, database, resolved, opts)
 	if err != nil {
 		return fmt.Errorf("error finding duplicates: %v", err)
 	}
 
 	if len(duplicates) == 0 {
 		fmt.Println("No duplicates found in this group.")
-		return nil
+		return report.write(opts.Report)
 	}
 
 	fmt.Printf("Found %d duplicate file groups\n\n", len(duplicates))
 
-	// Process each duplicate group
+	results := processGroupDuplicatesConcurrently(ctx, database, duplicates, group, resolved, opts)
+
 	totalRemoved := 0
 	totalSaved := int64(0)
-
-	for _, dupGroup := range duplicates {
-		removed, saved, err := processGroupDuplicates(ctx, database, dupGroup, group, members, opts)
-		if err != nil {
-			logging.ErrorLogger.Printf("Error processing hash %s: %v", dupGroup[0].Hash, err)
+	totalVerified := 0
+	totalUnverified := 0
+	totalFailed := 0
+	totalReset := 0
+	totalKeptUnverified := 0
+	totalOverReplicated := 0
+	totalReadOnlySkipped := 0
+	processed := 0
+
+	for _, result := range results {
+		if result == nil {
 			continue
 		}
-		totalRemoved += removed
-		totalSaved += saved
+		processed++
+		totalRemoved += result.Removed
+		totalSaved += result.Saved
+		totalVerified += result.Verified
+		totalUnverified += result.Unverified
+		totalFailed += result.Failed
+		totalReset += result.Reset
+		if result.KeptUnverified {
+			totalKeptUnverified++
+		}
+		if result.OverReplicated {
+			totalOverReplicated++
+		}
+		if result.ReadOnlySkipped {
+			totalReadOnlySkipped++
+		}
+		if report != nil {
+			report.add(result.Entry)
+		}
 	}
 
 	if opts.DryRun {
@@ -87,20 +223,176 @@ func DeduplicateByGroup(ctx context.Context, database *sql.DB, opts GroupDedupeO
 	} else {
 		fmt.Printf("\nRemoved %d files, saved %s\n", totalRemoved, formatBytes(totalSaved))
 	}
+	if opts.VerifyBeforeAction && !opts.DryRun {
+		fmt.Printf("Verified %d copies before removing them\n", totalVerified)
+	}
+	if totalUnverified > 0 {
+		fmt.Printf("Skipped %d copies that could not be verified\n", totalUnverified)
+	}
+	if totalKeptUnverified > 0 {
+		fmt.Printf("Left %d groups alone whose kept copies could not be verified\n", totalKeptUnverified)
+	}
+	if totalReset > 0 {
+		fmt.Printf("Cleared the hash of %d copies that no longer match; run files hash to re-hash them\n", totalReset)
+	}
+	if totalFailed > 0 {
+		fmt.Printf("Failed to remove %d copies; their rows were kept\n", totalFailed)
+	}
+	if totalOverReplicated > 0 {
+		fmt.Printf("%d groups left over-replicated but protected\n", totalOverReplicated)
+	}
+	if totalReadOnlySkipped > 0 {
+		fmt.Printf("%d groups skipped: their only removable copies are on read-only members\n", totalReadOnlySkipped)
+	}
 
+	if report != nil {
+		report.Totals.BytesSaved = totalSaved
+		if err := report.write(opts.Report); err != nil {
+			return err
+		}
+		fmt.Printf("Report written to %s\n", opts.Report)
+	}
+	if ctx.Err() != nil {
+		return fmt.Errorf("operation cancelled after processing %d of %d duplicate groups", processed, len(duplicates))
+	}
 	return nil
 }
 
+// processGroupDuplicatesConcurrently runs processGroupDuplicates over
+// duplicates with opts.Workers goroutines. The output of each group is
+// buffered and printed whole once it is done, so groups never interleave.
+// Results come back in the order of duplicates, nil for the groups that
+// failed or were never started because ctx was cancelled.
+func processGroupDuplicatesConcurrently(ctx context.Context, database *sql.DB, duplicates [][]FileLocation, group *db.PathGroup, members *groupMembers, opts GroupDedupeOptions) []*groupDedupeResult {
+	workers := opts.Workers
+	if workers < 1 {
+		workers = 1
+	}
+
+	results := make([]*groupDedupeResult, len(duplicates))
+	jobs := make(chan int)
+	var outputMu sync.Mutex
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for idx := range jobs {
+				if ctx.Err() != nil {
+					continue
+				}
+				var output bytes.Buffer
+				result, err := processGroupDuplicates(ctx, &output, database, duplicates[idx], group, members, opts)
+				outputMu.Lock()
+				os.Stdout.Write(output.Bytes())
+				outputMu.Unlock()
+				if err != nil {
+					logging.ErrorLogger.Printf("Error processing hash %s: %v", duplicates[idx][0].Hash, err)
+					continue
+				}
+				results[idx] = &result
+			}
+		}()
+	}
+
+dispatch:
+	for idx := range duplicates {
+		select {
+		case jobs <- idx:
+		case <-ctx.Done():
+			break dispatch
+		}
+	}
+	close(jobs)
+	wg.Wait()
+	return results
+}
+
+// groupMemberRoot is a group member resolved to the root folder its friendly
+// path points at.
+type groupMemberRoot struct {
+	HostName     string
+	FriendlyPath string
+	RootFolder   string
+	Priority     int
+	Protected    bool
+	ReadOnly     bool
+}
+
+// groupMembers is the members of a path group resolved once per run, so that
+// the per-hash work does not look the hosts up again.
+type groupMembers struct {
+	roots  []groupMemberRoot
+	byRoot map[string]groupMemberRoot // by "host name:root folder"
+	hosts  map[string]*db.Host        // by host name
+}
+
+// resolveGroupMembers looks up each host of members once and resolves every
+// member's friendly path to its root folder.
+func resolveGroupMembers(database *sql.DB, members []db.PathGroupMember) (*groupMembers, error) {
+	resolved := &groupMembers{
+		byRoot: make(map[string]groupMemberRoot, len(members)),
+		hosts:  make(map[string]*db.Host),
+	}
+	for _, member := range members {
+		host, ok := resolved.hosts[member.HostName]
+		if !ok {
+			var err error
+			host, err = db.GetHost(database, member.HostName)
+			if err != nil {
+				return nil, err
+			}
+			resolved.hosts[member.HostName] = host
+		}
+		paths, err := host.GetPaths()
+		if err != nil {
+			return nil, err
+		}
+		absPath, ok := paths[member.FriendlyPath]
+		if !ok {
+			return nil, fmt.Errorf("friendly path '%s' not found on host '%s'", member.FriendlyPath, member.HostName)
+		}
+		root := groupMemberRoot{
+			HostName:     member.HostName,
+			FriendlyPath: member.FriendlyPath,
+			RootFolder:   absPath,
+			Priority:     member.Priority,
+			Protected:    member.Protected,
+			ReadOnly:     member.ReadOnly,
+		}
+		resolved.roots = append(resolved.roots, root)
+		resolved.byRoot[member.HostName+":"+absPath] = root
+	}
+	return resolved, nil
+}
+
+// host returns the resolved host named name, or nil.
+func (m *groupMembers) host(name string) *db.Host {
+	if m == nil {
+		return nil
+	}
+	return m.hosts[name]
+}
+
+// groupDuplicateKey is one duplicate hash/size pair of a group.
+type groupDuplicateKey struct {
+	hash string
+	size int64
+}
+
 // findGroupDuplicates finds all duplicate files across hosts in a path group
-func findGroupDuplicates(ctx context.Context, database *sql.DB, members []db.PathGroupMember, opts GroupDedupeOptions) ([][]FileLocation, error) {
+func findGroupDuplicates(ctx context.Context, database *sql.DB, members *groupMembers, opts GroupDedupeOptions) ([][]FileLocation, error) {
 	// Build query to find files across all group members
 	query := `
 		WITH group_files AS (
-			SELECT f.hash, f.path, f.hostname, f.root_folder, f.size, h.name as host_name
+			SELECT f.hash, f.hash_algo, f.path, f.hostname, f.root_folder, f.size, h.name as host_name
 			FROM files f
-			JOIN hosts h ON LOWER(f.hostname) = LOWER(h.hostname)
+			JOIN hosts h ON f.hostname = h.hostname
 			WHERE f.hash IS NOT NULL
+			AND ` + WellFormedHashAs("f") + `
 			AND f.size IS NOT NULL
+			AND ` + NotDeletedAs("f") + `
+			AND ` + NotHardLinkedAs("f") + `
 			AND (
 	`
 
@@ -108,31 +400,17 @@ func findGroupDuplicates(ctx context.Context, database *sql.DB, members []db.Pat
 	argCount := 0
 
 	// Add conditions for each group member
-	for i, member := range members {
+	for i, root := range members.roots {
 		if i > 0 {
 			query += " OR "
 		}
 		argCount++
 		query += fmt.Sprintf("(h.name = $%d", argCount)
-		args = append(args, member.HostName)
-
-		// Get the absolute path for this friendly path
-		host, err := db.GetHost(database, member.HostName)
-		if err != nil {
-			return nil, err
-		}
-		paths, err := host.GetPaths()
-		if err != nil {
-			return nil, err
-		}
-		absPath, ok := paths[member.FriendlyPath]
-		if !ok {
-			return nil, fmt.Errorf("friendly path '%s' not found on host '%s'", member.FriendlyPath, member.HostName)
-		}
+		args = append(args, root.HostName)
 
 		argCount++
 		query += fmt.Sprintf(" AND f.root_folder = $%d)", argCount)
-		args = append(args, absPath)
+		args = append(args, root.RootFolder)
 	}
 
 	query += ")"
@@ -147,7 +425,7 @@ func findGroupDuplicates(ctx context.Context, database *sql.DB, members []db.Pat
 		)
 		SELECT hash, size, COUNT(*) as count, SUM(size) as total_size
 		FROM group_files
-		GROUP BY hash, size
+		GROUP BY hash, size, hash_algo
 		HAVING COUNT(*) > 1
 		ORDER BY total_size DESC, hash, size
 	`
@@ -164,11 +442,7 @@ func findGroupDuplicates(ctx context.Context, database *sql.DB, members []db.Pat
 	}
 	defer rows.Close()
 
-	type duplicateKey struct {
-		hash string
-		size int64
-	}
-	var duplicates []duplicateKey
+	var duplicates []groupDuplicateKey
 	for rows.Next() {
 		var hash string
 		var size int64
@@ -177,21 +451,24 @@ func findGroupDuplicates(ctx context.Context, database *sql.DB, members []db.Pat
 		if err := rows.Scan(&hash, &size, &count, &totalSize); err != nil {
 			return nil, err
 		}
-		duplicates = append(duplicates, duplicateKey{hash: hash, size: size})
+		duplicates = append(duplicates, groupDuplicateKey{hash: hash, size: size})
 	}
 
 	if err := rows.Err(); err != nil {
 		return nil, err
 	}
+	if len(duplicates) == 0 {
+		return nil, nil
+	}
 
-	// Now get all file locations for each duplicate hash/size pair.
+	// Now get all file locations of the duplicate hash/size pairs at once.
+	locationsByKey, err := getFileLocationsForHashes(ctx, database, duplicates, members)
+	if err != nil {
+		return nil, err
+	}
 	var result [][]FileLocation
 	for _, duplicate := range duplicates {
-		locations, err := getFileLocationsForHash(ctx, database, duplicate.hash, duplicate.size, members)
-		if err != nil {
-			return nil, err
-		}
-		if len(locations) > 1 {
+		if locations := locationsByKey[duplicate]; len(locations) > 1 {
 			result = append(result, locations)
 		}
 	}
@@ -199,143 +476,330 @@ func findGroupDuplicates(ctx context.Context, database *sql.DB, members []db.Pat
 	return result, nil
 }
 
-// getFileLocationsForHash gets all file locations for a specific hash and size within the group.
-func getFileLocationsForHash(ctx context.Context, database *sql.DB, hash string, size int64, members []db.PathGroupMember) ([]FileLocation, error) {
-	// Create a map of host+path to priority
-	priorityMap := make(map[string]int)
-	friendlyPathMap := make(map[string]string)
-	for _, member := range members {
-		host, err := db.GetHost(database, member.HostName)
-		if err != nil {
-			continue
-		}
-		paths, err := host.GetPaths()
-		if err != nil {
-			continue
-		}
-		absPath, ok := paths[member.FriendlyPath]
-		if ok {
-			key := fmt.Sprintf("%s:%s", member.HostName, absPath)
-			priorityMap[key] = member.Priority
-			friendlyPathMap[key] = member.FriendlyPath
+// getFileLocationsForHashes gets the file locations of the given hash/size
+// pairs within the group, in one query.
+func getFileLocationsForHashes(ctx context.Context, database *sql.DB, keys []groupDuplicateKey, members *groupMembers) (map[groupDuplicateKey][]FileLocation, error) {
+	wanted := make(map[groupDuplicateKey]bool, len(keys))
+	hashes := make([]string, 0, len(keys))
+	for _, key := range keys {
+		if !wanted[key] {
+			hashes = append(hashes, key.hash)
 		}
+		wanted[key] = true
 	}
 
 	query := `
-		SELECT f.hash, f.path, f.hostname, f.root_folder, f.size, h.name
+		SELECT f.hash, f.hash_algo, f.path, f.hostname, f.root_folder, f.size, h.name
 		FROM files f
-		JOIN hosts h ON LOWER(f.hostname) = LOWER(h.hostname)
-		WHERE f.hash = $1
-		AND f.size = $2
-		ORDER BY f.hostname, f.path
+		JOIN hosts h ON f.hostname = h.hostname
+		WHERE f.hash = ANY($1)
+		AND ` + NotDeletedAs("f") + `
+		AND ` + NotHardLinkedAs("f") + `
+		ORDER BY f.hash, f.hostname, f.path
 	`
 
-	rows, err := database.QueryContext(ctx, query, hash, size)
+	rows, err := database.QueryContext(ctx, query, pq.Array(hashes))
 	if err != nil {
 		return nil, err
 	}
 	defer rows.Close()
 
-	var locations []FileLocation
+	locations := make(map[groupDuplicateKey][]FileLocation, len(keys))
 	for rows.Next() {
 		var loc FileLocation
-		if err := rows.Scan(&loc.Hash, &loc.Path, &loc.Hostname, &loc.RootFolder, &loc.Size, &loc.HostName); err != nil {
+		if err := rows.Scan(&loc.Hash, &loc.HashAlgo, &loc.Path, &loc.Hostname, &loc.RootFolder, &loc.Size, &loc.HostName); err != nil {
 			return nil, err
 		}
 
-		key := fmt.Sprintf("%s:%s", loc.HostName, loc.RootFolder)
-		if priority, ok := priorityMap[key]; ok {
-			loc.Priority = priority
-			loc.FriendlyPath = friendlyPathMap[key]
-			locations = append(locations, loc)
+		key := groupDuplicateKey{hash: loc.Hash, size: loc.Size}
+		if !wanted[key] {
+			continue
+		}
+		if root, ok := members.byRoot[loc.HostName+":"+loc.RootFolder]; ok {
+			loc.Priority = root.Priority
+			loc.FriendlyPath = root.FriendlyPath
+			loc.Protected = root.Protected
+			loc.ReadOnly = root.ReadOnly
+			locations[key] = append(locations[key], loc)
 		}
 	}
 
 	return locations, rows.Err()
 }
 
-// processGroupDuplicates processes a group of duplicate files and decides which to keep/remove
-func processGroupDuplicates(ctx context.Context, database *sql.DB, locations []FileLocation, group *db.PathGroup, members []db.PathGroupMember, opts GroupDedupeOptions) (int, int64, error) {
+// groupDedupeResult is the outcome of processing one duplicate group.
+type groupDedupeResult struct {
+	Removed         int   // copies removed (or that would be, in a dry run)
+	Saved           int64 // bytes freed by the removals
+	Verified        int   // copies re-hashed and confirmed before removal
+	Unverified      int   // copies skipped because verification failed
+	Failed          int   // copies that could not be removed; their rows are kept
+	Reset           int   // copies found to no longer match whose hash was cleared
+	KeptUnverified  bool  // nothing removed: a kept copy could not be verified
+	OverReplicated  bool  // kept above max_copies because of protected copies
+	ReadOnlySkipped bool  // nothing removed: the removable copies are all read-only
+
+	Entry groupDedupeReportEntry // the plan and outcomes, for --report
+}
+
+// processGroupDuplicates processes a group of duplicate files and decides which to keep/remove.
+func processGroupDuplicates(ctx context.Context, w io.Writer, database *sql.DB, locations []FileLocation, group *db.PathGroup, members *groupMembers, opts GroupDedupeOptions) (groupDedupeResult, error) {
 	if len(locations) < 2 {
-		return 0, 0, nil
+		return groupDedupeResult{}, nil
 	}
 
-	fmt.Printf("Hash: %s (size: %s, copies: %d)\n", locations[0].Hash, formatBytes(locations[0].Size), len(locations))
+	fmt.Fprintf(w, "Hash: %s (size: %s, copies: %d)\n", locations[0].Hash, formatBytes(locations[0].Size), len(locations))
 
-	// Sort by priority (lower = higher priority to keep)
-	sort.Slice(locations, func(i, j int) bool {
-		if locations[i].Priority != locations[j].Priority {
-			return locations[i].Priority < locations[j].Priority
+	policy := "priority"
+	if opts.Keep.Name != "" {
+		policy = "priority, then " + opts.Keep.String()
+		if err := loadGroupKeepCandidates(ctx, database, locations, opts.Keep); err != nil {
+			return groupDedupeResult{}, err
 		}
-		return locations[i].HostName < locations[j].HostName
-	})
-
-	// Determine how many copies to keep
-	keepCount := group.MinCopies
-	if opts.RespectLimits && group.MaxCopies != nil && len(locations) > *group.MaxCopies {
-		keepCount = *group.MaxCopies
-	} else if len(locations) <= group.MinCopies {
+	}
+	selection := selectGroupCopies(locations, group, opts.RespectLimits, opts.Keep)
+	entry := groupDedupeReportEntry{
+		Hash:            locations[0].Hash,
+		Size:            locations[0].Size,
+		AtMinimum:       selection.AtMinimum,
+		OverReplicated:  selection.OverReplicated,
+		ReadOnlySkipped: selection.ReadOnlySkipped,
+		Keep:            newGroupDedupeReportCopies(selection.Keep),
+		Remove:          newGroupDedupeReportCopies(selection.Remove),
+	}
+	if selection.AtMinimum {
 		// Already at or below minimum, don't remove any
-		fmt.Printf("  Keeping all %d copies (at or below minimum)\n", len(locations))
+		fmt.Fprintf(w, "  Keeping all %d copies (at or below minimum)\n", len(locations))
 		for _, loc := range locations {
-			fmt.Printf("  - %s:%s/%s (priority %d)\n", loc.HostName, loc.FriendlyPath, loc.Path, loc.Priority)
+			fmt.Fprintf(w, "  - %s\n", loc.describe())
 		}
-		fmt.Println()
-		return 0, 0, nil
+		fmt.Fprintln(w)
+		return groupDedupeResult{Entry: entry}, nil
 	}
-
-	// Keep the first keepCount files (highest priority)
-	toKeep := locations[:keepCount]
-	toRemove := locations[keepCount:]
+	toKeep, toRemove := selection.Keep, selection.Remove
 
 	// Display what we're keeping
-	fmt.Printf("  Keeping %d copies:\n", len(toKeep))
+	fmt.Fprintf(w, "  Keeping %d copies (keep policy: %s):\n", len(toKeep), policy)
 	for _, loc := range toKeep {
-		fmt.Printf("  - %s:%s/%s (priority %d)\n", loc.HostName, loc.FriendlyPath, loc.Path, loc.Priority)
+		fmt.Fprintf(w, "  - %s\n", loc.describe())
+	}
+	if selection.OverReplicated {
+		fmt.Fprintf(w, "  Over-replicated but protected: keeping %d copies, max_copies is %d\n", len(toKeep), *group.MaxCopies)
+	}
+	if selection.ReadOnlySkipped {
+		fmt.Fprintf(w, "  Skipped: the only removable copies are on read-only members\n\n")
+		return groupDedupeResult{OverReplicated: selection.OverReplicated, ReadOnlySkipped: true, Entry: entry}, nil
 	}
 
 	// Display and process removals
-	removed := 0
-	saved := int64(0)
+	result := groupDedupeResult{OverReplicated: selection.OverReplicated, Entry: entry}
+
+	var localHost string
+	if !opts.DryRun {
+		localHost, _ = os.Hostname()
+	}
+
+	if !opts.DryRun && opts.VerifyBeforeAction && len(toRemove) > 0 {
+		for _, loc := range toKeep {
+			if err := verifyGroupCopy(ctx, database, members.host(loc.HostName), localHost, loc); err != nil {
+				// Fail safe: nothing is removed unless every kept copy still
+				// holds the content.
+				logging.ErrorLogger.Printf("Warning: Skipping hash %s, kept copy %s:%s could not be verified: %v", loc.Hash, loc.HostName, filepath.Join(loc.RootFolder, loc.Path), err)
+				fmt.Fprintf(w, "  Skipped: kept copy %s could not be verified: %v\n\n", loc.label(), err)
+				if resetGroupCopyHash(database, loc, err) {
+					result.Reset++
+				}
+				for i := range result.Entry.Remove {
+					result.Entry.Remove[i].Outcome, result.Entry.Remove[i].Error = groupCopySkipped, "kept copy could not be verified: "+err.Error()
+				}
+				result.KeptUnverified = true
+				return result, nil
+			}
+			result.Verified++
+		}
+	}
 
 	if len(toRemove) > 0 {
 		if opts.DryRun {
-			fmt.Printf("  Would remove %d copies:\n", len(toRemove))
+			fmt.Fprintf(w, "  Would remove %d copies:\n", len(toRemove))
 		} else {
-			fmt.Printf("  Removing %d copies:\n", len(toRemove))
+			fmt.Fprintf(w, "  Removing %d copies:\n", len(toRemove))
 		}
 
-		for _, loc := range toRemove {
+		for i, loc := range toRemove {
+			outcome := &result.Entry.Remove[i]
 			fullPath := filepath.Join(loc.RootFolder, loc.Path)
-			fmt.Printf("  - %s:%s/%s (priority %d)\n", loc.HostName, loc.FriendlyPath, loc.Path, loc.Priority)
+			fmt.Fprintf(w, "  - %s\n", loc.describe())
 
 			if !opts.DryRun {
-				// Delete the file
-				if err := os.Remove(fullPath); err != nil {
-					if !os.IsNotExist(err) {
-						logging.ErrorLogger.Printf("Warning: Failed to delete file %s: %v", fullPath, err)
+				if ctx.Err() != nil {
+					// Cancelled: leave this copy and the rest of the group alone.
+					fmt.Fprintf(w, "    skipped: run cancelled\n")
+					for j := i; j < len(toRemove); j++ {
+						result.Entry.Remove[j].Outcome, result.Entry.Remove[j].Error = groupCopySkipped, "run cancelled"
+					}
+					break
+				}
+				if opts.VerifyBeforeAction {
+					if err := verifyGroupCopy(ctx, database, members.host(loc.HostName), localHost, loc); err != nil {
+						// Fail safe: a copy we cannot re-hash is never removed.
+						logging.ErrorLogger.Printf("Warning: Skipping %s:%s, verification failed: %v", loc.HostName, fullPath, err)
+						fmt.Fprintf(w, "    skipped: verification failed: %v\n", err)
+						outcome.Outcome, outcome.Error = groupCopySkipped, "verification failed: "+err.Error()
+						if resetGroupCopyHash(database, loc, err) {
+							result.Reset++
+						}
+						result.Unverified++
 						continue
 					}
+					result.Verified++
 				}
 
-				// Remove from database
+				// Delete the file where it lives; its row goes only once it is gone
+				if err := removeGroupCopy(ctx, members.host(loc.HostName), localHost, loc); err != nil {
+					logging.ErrorLogger.Printf("Warning: Failed to delete file %s:%s: %v", loc.HostName, fullPath, err)
+					fmt.Fprintf(w, "    failed: %v\n", err)
+					outcome.Outcome, outcome.Error = groupCopyFailed, err.Error()
+					result.Failed++
+					continue
+				}
+
+				// Soft-delete the row; files vacuum removes it for good
 				_, err := database.Exec(`
-					DELETE FROM files
-					WHERE path = $1 AND LOWER(hostname) = LOWER($2)
+					UPDATE files SET deleted_at = NOW()
+					WHERE path = $1 AND hostname = $2 AND deleted_at IS NULL
 				`, loc.Path, loc.Hostname)
+				outcome.Outcome = groupCopyRemoved
 				if err != nil {
 					logging.ErrorLogger.Printf("Warning: Failed to delete file from database: %v", err)
+					outcome.Error = "error soft-deleting row: " + err.Error()
 					continue
 				}
 			}
 
-			removed++
-			saved += loc.Size
+			result.Removed++
+			result.Saved += loc.Size
 		}
 	}
 
-	fmt.Println()
-	return removed, saved, nil
+	fmt.Fprintln(w)
+	return result, nil
+}
+
+// removeGroupCopy deletes a copy: on this machine directly, where a copy
+// already gone counts as removed, and on any other host with rm over ssh,
+// connecting with the ssh settings of host when it is known.
+func removeGroupCopy(ctx context.Context, host *db.Host, localHost string, loc FileLocation) error {
+	fullPath := filepath.Join(loc.RootFolder, loc.Path)
+	if strings.EqualFold(localHost, loc.Hostname) {
+		if err := os.Remove(fullPath); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	}
+
+	settings, err := hostSSH(host)
+	if err != nil {
+		return err
+	}
+	cmd, err := sshCommand(ctx, loc.Hostname, settings, "rm -- "+shellEscape(fullPath))
+	if err != nil {
+		return err
+	}
+	if output, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("remote rm failed: %v %s", err, strings.TrimSpace(string(output)))
+	}
+	return nil
+}
+
+// loadGroupKeepCandidates fills in what keep compares for each copy. The size
+// of a copy's directory is only known on this host; elsewhere it counts as 0.
+func loadGroupKeepCandidates(ctx context.Context, database *sql.DB, locations []FileLocation, keep KeepPolicy) error {
+	var modTimes map[string]time.Time
+	if keep.needsModTimes() {
+		var err error
+		if modTimes, err = loadKeepModTimes(ctx, database, locations[0].Hash, locations[0].Size); err != nil {
+			return err
+		}
+	}
+	localHost, _ := os.Hostname()
+	for i := range locations {
+		loc := &locations[i]
+		loc.keep = keepCandidate{
+			fullPath: filepath.Join(loc.RootFolder, loc.Path),
+			modTime:  modTimes[keepModTimeKey(loc.Hostname, loc.RootFolder, loc.Path)],
+		}
+		if keep.Name == KeepMostPopulated && strings.EqualFold(localHost, loc.Hostname) {
+			loc.keep.parentDirCount = countDirFiles(loc.keep.fullPath)
+		}
+	}
+	return nil
+}
+
+// verifyGroupCopy re-hashes a copy and returns an error unless it still
+// matches loc.Hash. Copies on other hosts are hashed over ssh, on host when it
+// was already resolved.
+func verifyGroupCopy(ctx context.Context, database *sql.DB, host *db.Host, localHost string, loc FileLocation) error {
+	fullPath := filepath.Join(loc.RootFolder, loc.Path)
+
+	algo, err := ParseHashAlgo(loc.HashAlgo)
+	if err != nil {
+		return err
+	}
+
+	var sum string
+	if strings.EqualFold(localHost, loc.Hostname) {
+		sum, err = fileHasher(algo)(fullPath)
+	} else {
+		if algo != HashAlgoSHA256 {
+			return fmt.Errorf("cannot verify a %s hash over ssh", algo)
+		}
+		if host == nil {
+			var hostErr error
+			host, hostErr = db.GetHost(database, loc.HostName)
+			if hostErr != nil {
+				return fmt.Errorf("error getting host '%s': %v", loc.HostName, hostErr)
+			}
+		}
+		sum, err = hashRemoteFile(ctx, host, fullPath)
+	}
+	if err != nil {
+		return err
+	}
+	if !strings.EqualFold(sum, loc.Hash) {
+		return &groupHashMismatch{expected: loc.Hash, got: sum}
+	}
+	return nil
+}
+
+// groupHashMismatch is the error of a copy that hashes to something other
+// than its row records.
+type groupHashMismatch struct {
+	expected, got string
+}
+
+func (e *groupHashMismatch) Error() string {
+	return fmt.Sprintf("hash mismatch: expected %s, got %s", e.expected, e.got)
+}
+
+// resetGroupCopyHash clears the hash of a copy that failed verification with
+// a mismatch, so the next files hash run re-hashes it, and reports whether it
+// did. Other errors, such as an unreachable host, say nothing about the
+// content and leave the row alone.
+func resetGroupCopyHash(database *sql.DB, loc FileLocation, verifyErr error) bool {
+	var mismatch *groupHashMismatch
+	if !errors.As(verifyErr, &mismatch) {
+		return false
+	}
+	_, err := database.Exec(`
+		UPDATE files SET hash = NULL, last_hashed_at = NULL, quick_hash = NULL
+		WHERE path = $1 AND hostname = $2 AND deleted_at IS NULL
+	`, loc.Path, loc.Hostname)
+	if err != nil {
+		logging.ErrorLogger.Printf("Warning: Failed to clear the hash of %s:%s: %v", loc.HostName, filepath.Join(loc.RootFolder, loc.Path), err)
+		return false
+	}
+	return true
 }
 
 // formatMaxCopies formats the max copies value
@@ -0,0 +1,112 @@
+package files
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+)
+
+// Outcomes of a copy in a dedupe-group report. Dry runs leave them empty.
+const (
+	groupCopyRemoved = "removed"
+	groupCopyFailed  = "failed"
+	groupCopySkipped = "skipped"
+)
+
+// groupDedupeReport is the JSON document dedupe-group --report writes: the
+// plan for every duplicate hash and, in a real run, what became of each copy
+// it meant to remove.
+type groupDedupeReport struct {
+	Group       string                   `json:"group"`
+	DryRun      bool                     `json:"dry_run"`
+	GeneratedAt time.Time                `json:"generated_at"`
+	Hashes      []groupDedupeReportEntry `json:"hashes"`
+	Totals      groupDedupeReportTotals  `json:"totals"`
+}
+
+type groupDedupeReportEntry struct {
+	Hash            string                  `json:"hash"`
+	Size            int64                   `json:"size"`
+	AtMinimum       bool                    `json:"at_minimum,omitempty"`
+	OverReplicated  bool                    `json:"over_replicated,omitempty"`
+	ReadOnlySkipped bool                    `json:"read_only_skipped,omitempty"`
+	Keep            []groupDedupeReportCopy `json:"keep"`
+	Remove          []groupDedupeReportCopy `json:"remove"`
+}
+
+type groupDedupeReportCopy struct {
+	Host         string `json:"host"`
+	FriendlyPath string `json:"friendly_path"`
+	Path         string `json:"path"`
+	Priority     int    `json:"priority"`
+	Protected    bool   `json:"protected,omitempty"`
+	ReadOnly     bool   `json:"read_only,omitempty"`
+	Outcome      string `json:"outcome,omitempty"` // removed, failed or skipped; empty in dry runs
+	Error        string `json:"error,omitempty"`
+}
+
+type groupDedupeReportTotals struct {
+	Hashes     int   `json:"hashes"`
+	Kept       int   `json:"kept"`
+	ToRemove   int   `json:"to_remove"`
+	Removed    int   `json:"removed"`
+	Failed     int   `json:"failed"`
+	Skipped    int   `json:"skipped"`
+	BytesSaved int64 `json:"bytes_saved"` // would be saved, in a dry run
+}
+
+func newGroupDedupeReportCopies(locations []FileLocation) []groupDedupeReportCopy {
+	copies := make([]groupDedupeReportCopy, 0, len(locations))
+	for _, loc := range locations {
+		copies = append(copies, groupDedupeReportCopy{
+			Host:         loc.HostName,
+			FriendlyPath: loc.FriendlyPath,
+			Path:         loc.Path,
+			Priority:     loc.Priority,
+			Protected:    loc.Protected,
+			ReadOnly:     loc.ReadOnly,
+		})
+	}
+	return copies
+}
+
+// add records the plan and outcome of one duplicate hash.
+func (r *groupDedupeReport) add(entry groupDedupeReportEntry) {
+	r.Hashes = append(r.Hashes, entry)
+	r.Totals.Hashes++
+	r.Totals.Kept += len(entry.Keep)
+	r.Totals.ToRemove += len(entry.Remove)
+	for _, c := range entry.Remove {
+		switch c.Outcome {
+		case groupCopyRemoved:
+			r.Totals.Removed++
+		case groupCopyFailed:
+			r.Totals.Failed++
+		case groupCopySkipped:
+			r.Totals.Skipped++
+		}
+	}
+}
+
+// write replaces the report file through a temporary file and rename, so a
+// reader never sees a partial document. A nil report or an empty path writes
+// nothing.
+func (r *groupDedupeReport) write(path string) error {
+	if r == nil || path == "" {
+		return nil
+	}
+	r.GeneratedAt = time.Now()
+	data, err := json.MarshalIndent(r, "", "  ")
+	if err != nil {
+		return fmt.Errorf("error encoding report: %v", err)
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, append(data, '\n'), 0644); err != nil {
+		return fmt.Errorf("error writing report %s: %v", tmp, err)
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return fmt.Errorf("error writing report %s: %v", path, err)
+	}
+	return nil
+}
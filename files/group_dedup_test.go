@@ -0,0 +1,535 @@
+package files
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"deduplicator/db"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/lib/pq"
+)
+
+func TestProcessGroupDuplicatesSkipsUnverifiableRemoteCopies(t *testing.T) {
+	const storedHash = "9f86d081884c7d659a2feaa0c55ad015a3bf4f1b2b0b822cd15d6c15b0f00a08"
+
+	tests := []struct {
+		name     string
+		stub     string
+		mismatch bool
+	}{
+		{name: "ssh failure", stub: "#!/bin/sh\necho 'connection refused' >&2\nexit 255\n"},
+		{name: "malformed output", stub: "#!/bin/sh\necho 'sha256sum: command not found'\n"},
+		{name: "hash mismatch", stub: "#!/bin/sh\necho 'aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa  x'\n", mismatch: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			database, mock, err := sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherRegexp))
+			if err != nil {
+				t.Fatalf("sqlmock: %v", err)
+			}
+			defer database.Close()
+
+			stubDir := t.TempDir()
+			writeStub(t, stubDir, "ssh", tt.stub)
+			t.Setenv("PATH", stubDir+string(os.PathListSeparator)+os.Getenv("PATH"))
+
+			mock.ExpectQuery(`SELECT id, name, hostname, ip, root_path, settings, created_at FROM hosts WHERE name = \$1`).
+				WithArgs("NAS").
+				WillReturnRows(sqlmock.NewRows([]string{"id", "name", "hostname", "ip", "root_path", "settings", "created_at"}).
+					AddRow(2, "NAS", "nas.remote.invalid", "", "", []byte(`{"paths":{"photos":"/srv/photos"}}`), time.Now()))
+
+			// A copy that no longer matches has its hash cleared for re-hashing
+			if tt.mismatch {
+				mock.ExpectExec(`UPDATE files SET hash = NULL, last_hashed_at = NULL, quick_hash = NULL`).
+					WithArgs("a.jpg", "nas.remote.invalid").
+					WillReturnResult(sqlmock.NewResult(0, 1))
+			}
+
+			// The kept copy is on this machine and still holds the content
+			localHost, _ := os.Hostname()
+			keepRoot := t.TempDir()
+			writeFiles(t, keepRoot, "test", "a.jpg")
+			locations := []FileLocation{
+				{Hash: storedHash, Path: "a.jpg", Hostname: localHost, HostName: "Keeper", FriendlyPath: "photos", RootFolder: keepRoot, Size: 4, Priority: 1},
+				{Hash: storedHash, Path: "a.jpg", Hostname: "nas.remote.invalid", HostName: "NAS", FriendlyPath: "photos", RootFolder: "/srv/photos", Size: 4, Priority: 2},
+			}
+			group := &db.PathGroup{Name: "photos", MinCopies: 1}
+			opts := GroupDedupeOptions{GroupName: "photos", VerifyBeforeAction: true}
+
+			result, err := processGroupDuplicates(context.Background(), os.Stdout, database, locations, group, nil, opts)
+			if err != nil {
+				t.Fatalf("processGroupDuplicates error: %v", err)
+			}
+			if result.Removed != 0 || result.Saved != 0 || result.Unverified != 1 || result.Verified != 1 {
+				t.Fatalf("expected 0 removed, 0 saved, 1 unverified, 1 verified; got %+v", result)
+			}
+			wantReset := 0
+			if tt.mismatch {
+				wantReset = 1
+			}
+			if result.Reset != wantReset {
+				t.Fatalf("expected %d hashes cleared, got %d", wantReset, result.Reset)
+			}
+			// No DELETE expectation: an unverified copy must stay indexed.
+			if err := mock.ExpectationsWereMet(); err != nil {
+				t.Fatalf("unmet expectations: %v", err)
+			}
+		})
+	}
+}
+
+func TestProcessGroupDuplicatesLeavesGroupAloneWhenKeptCopyChanged(t *testing.T) {
+	const storedHash = "9f86d081884c7d659a2feaa0c55ad015a3bf4f1b2b0b822cd15d6c15b0f00a08"
+
+	database, mock, err := sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherRegexp))
+	if err != nil {
+		t.Fatalf("sqlmock: %v", err)
+	}
+	defer database.Close()
+
+	// ssh must never run: nothing is verified or removed past the kept copy
+	stubDir := t.TempDir()
+	writeStub(t, stubDir, "ssh", "#!/bin/sh\necho \"$@\" >> \"$SSH_LOG\"\n")
+	t.Setenv("PATH", stubDir+string(os.PathListSeparator)+os.Getenv("PATH"))
+	sshLog := filepath.Join(stubDir, "ssh.log")
+	t.Setenv("SSH_LOG", sshLog)
+
+	localHost, _ := os.Hostname()
+	keepRoot := t.TempDir()
+	writeFiles(t, keepRoot, "edited since it was hashed", "a.jpg")
+	mock.ExpectExec(`UPDATE files SET hash = NULL, last_hashed_at = NULL, quick_hash = NULL`).
+		WithArgs("a.jpg", localHost).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+
+	locations := []FileLocation{
+		{Hash: storedHash, HashAlgo: "sha256", Path: "a.jpg", Hostname: localHost, HostName: "Keeper", FriendlyPath: "photos", RootFolder: keepRoot, Size: 4, Priority: 1},
+		{Hash: storedHash, HashAlgo: "sha256", Path: "a.jpg", Hostname: "nas.remote.invalid", HostName: "NAS", FriendlyPath: "photos", RootFolder: "/srv/photos", Size: 4, Priority: 2},
+	}
+	group := &db.PathGroup{Name: "photos", MinCopies: 1}
+
+	var result groupDedupeResult
+	out := captureStdout(t, func() {
+		result, err = processGroupDuplicates(context.Background(), os.Stdout, database, locations, group, nil, GroupDedupeOptions{GroupName: "photos", VerifyBeforeAction: true})
+	})
+	if err != nil {
+		t.Fatalf("processGroupDuplicates error: %v", err)
+	}
+	if result.Removed != 0 || !result.KeptUnverified || result.Reset != 1 {
+		t.Fatalf("expected the group left alone and the kept copy's hash cleared, got %+v", result)
+	}
+	if !strings.Contains(out, "Skipped: kept copy photos/a.jpg on Keeper could not be verified: hash mismatch") {
+		t.Fatalf("expected the skip to be reported:\n%s", out)
+	}
+	if got := result.Entry.Remove[0]; got.Outcome != groupCopySkipped {
+		t.Fatalf("expected the copy to remove to be reported skipped, got %+v", got)
+	}
+	if _, err := os.Stat(sshLog); !os.IsNotExist(err) {
+		t.Fatalf("ssh ran although the kept copy failed verification")
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatalf("unmet expectations: %v", err)
+	}
+}
+
+func TestProcessGroupDuplicatesRemovesRemoteCopiesOverSSH(t *testing.T) {
+	tests := []struct {
+		name    string
+		stub    string
+		removed bool
+	}{
+		{name: "rm succeeds", stub: "#!/bin/sh\necho \"$@\" >> \"$SSH_LOG\"\n", removed: true},
+		{name: "rm fails", stub: "#!/bin/sh\necho \"$@\" >> \"$SSH_LOG\"\necho 'rm: cannot remove: Permission denied' >&2\nexit 1\n"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			database, mock, err := sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherRegexp))
+			if err != nil {
+				t.Fatalf("sqlmock: %v", err)
+			}
+			defer database.Close()
+
+			stubDir := t.TempDir()
+			writeStub(t, stubDir, "ssh", tt.stub)
+			t.Setenv("PATH", stubDir+string(os.PathListSeparator)+os.Getenv("PATH"))
+			sshLog := filepath.Join(stubDir, "ssh.log")
+			t.Setenv("SSH_LOG", sshLog)
+
+			// The row of a remote copy goes only once rm succeeded there
+			if tt.removed {
+				mock.ExpectExec(`UPDATE files SET deleted_at = NOW\(\)`).
+					WithArgs("it's.jpg", "nas.remote.invalid").
+					WillReturnResult(sqlmock.NewResult(0, 1))
+			}
+
+			locations := []FileLocation{
+				{Hash: "h", Path: "it's.jpg", Hostname: "keeper.remote.invalid", HostName: "Keeper", FriendlyPath: "photos", RootFolder: "/data/photos", Size: 4, Priority: 1},
+				{Hash: "h", Path: "it's.jpg", Hostname: "nas.remote.invalid", HostName: "NAS", FriendlyPath: "photos", RootFolder: "/srv/photos", Size: 4, Priority: 2},
+			}
+			group := &db.PathGroup{Name: "photos", MinCopies: 1}
+
+			var result groupDedupeResult
+			out := captureStdout(t, func() {
+				result, err = processGroupDuplicates(context.Background(), os.Stdout, database, locations, group, nil, GroupDedupeOptions{GroupName: "photos"})
+			})
+			if err != nil {
+				t.Fatalf("processGroupDuplicates error: %v", err)
+			}
+
+			calls, err := os.ReadFile(sshLog)
+			if err != nil {
+				t.Fatalf("ssh was not run: %v", err)
+			}
+			if want := `nas.remote.invalid rm -- '/srv/photos/it'\''s.jpg'` + "\n"; string(calls) != want {
+				t.Fatalf("ssh calls = %q, want %q", calls, want)
+			}
+			if tt.removed && (result.Removed != 1 || result.Failed != 0) {
+				t.Fatalf("expected 1 removed, got %+v", result)
+			}
+			if !tt.removed && (result.Removed != 0 || result.Failed != 1 || !strings.Contains(out, "Permission denied")) {
+				t.Fatalf("expected 1 failed copy, got %+v:\n%s", result, out)
+			}
+			if err := mock.ExpectationsWereMet(); err != nil {
+				t.Fatalf("unmet expectations: %v", err)
+			}
+		})
+	}
+}
+
+func TestGroupDedupeReportRecordsThePlanAndOutcomes(t *testing.T) {
+	database, mock, err := sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherRegexp))
+	if err != nil {
+		t.Fatalf("sqlmock: %v", err)
+	}
+	defer database.Close()
+
+	stubDir := t.TempDir()
+	writeStub(t, stubDir, "ssh", "#!/bin/sh\n[ \"$1\" = pinky.remote.invalid ] && { echo 'Permission denied' >&2; exit 1; }\nexit 0\n")
+	t.Setenv("PATH", stubDir+string(os.PathListSeparator)+os.Getenv("PATH"))
+	mock.ExpectExec(`UPDATE files SET deleted_at = NOW\(\)`).
+		WithArgs("a.jpg", "nas.remote.invalid").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+
+	locations := []FileLocation{
+		{Hash: "h", Path: "a.jpg", Hostname: "keeper.remote.invalid", HostName: "Keeper", FriendlyPath: "photos", RootFolder: "/data/photos", Size: 4, Priority: 1},
+		{Hash: "h", Path: "a.jpg", Hostname: "nas.remote.invalid", HostName: "NAS", FriendlyPath: "photos", RootFolder: "/srv/photos", Size: 4, Priority: 2},
+		{Hash: "h", Path: "a.jpg", Hostname: "pinky.remote.invalid", HostName: "Pinky", FriendlyPath: "backup", RootFolder: "/mnt/backup", Size: 4, Priority: 3},
+	}
+	group := &db.PathGroup{Name: "photos", MinCopies: 1}
+
+	var result groupDedupeResult
+	captureStdout(t, func() {
+		result, err = processGroupDuplicates(context.Background(), os.Stdout, database, locations, group, nil, GroupDedupeOptions{GroupName: "photos"})
+	})
+	if err != nil {
+		t.Fatalf("processGroupDuplicates error: %v", err)
+	}
+
+	report := &groupDedupeReport{Group: "photos"}
+	report.add(result.Entry)
+	path := filepath.Join(t.TempDir(), "report.json")
+	if err := report.write(path); err != nil {
+		t.Fatalf("write report: %v", err)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("read report: %v", err)
+	}
+	var got groupDedupeReport
+	if err := json.Unmarshal(data, &got); err != nil {
+		t.Fatalf("decode report: %v\n%s", err, data)
+	}
+
+	if len(got.Hashes) != 1 || len(got.Hashes[0].Keep) != 1 || got.Hashes[0].Keep[0].Host != "Keeper" {
+		t.Fatalf("expected Keeper's copy to be kept, got %s", data)
+	}
+	remove := got.Hashes[0].Remove
+	if len(remove) != 2 || remove[0].Host != "NAS" || remove[0].Outcome != groupCopyRemoved ||
+		remove[1].Host != "Pinky" || remove[1].FriendlyPath != "backup" || remove[1].Priority != 3 ||
+		remove[1].Outcome != groupCopyFailed || !strings.Contains(remove[1].Error, "Permission denied") {
+		t.Fatalf("unexpected removals in report:\n%s", data)
+	}
+	want := groupDedupeReportTotals{Hashes: 1, Kept: 1, ToRemove: 2, Removed: 1, Failed: 1}
+	if got.Totals != want {
+		t.Fatalf("totals = %+v, want %+v", got.Totals, want)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatalf("unmet expectations: %v", err)
+	}
+}
+
+// copyHosts lists the host names of locations, in order.
+func copyHosts(locations []FileLocation) []string {
+	hosts := make([]string, 0, len(locations))
+	for _, loc := range locations {
+		hosts = append(hosts, loc.HostName)
+	}
+	return hosts
+}
+
+func TestSelectGroupCopies(t *testing.T) {
+	two, three := 2, 3
+	copies := func(protected ...string) []FileLocation {
+		locations := []FileLocation{
+			{HostName: "D", Priority: 40},
+			{HostName: "A", Priority: 10},
+			{HostName: "C", Priority: 30},
+			{HostName: "B", Priority: 20},
+		}
+		for i := range locations {
+			for _, name := range protected {
+				if locations[i].HostName == name {
+					locations[i].Protected = true
+				}
+			}
+		}
+		return locations
+	}
+	readOnly := func(locations []FileLocation, names ...string) []FileLocation {
+		for i := range locations {
+			for _, name := range names {
+				if locations[i].HostName == name {
+					locations[i].ReadOnly = true
+				}
+			}
+		}
+		return locations
+	}
+
+	tests := []struct {
+		name            string
+		locations       []FileLocation
+		group           db.PathGroup
+		respectLimits   bool
+		keep, remove    []string
+		atMinimum       bool
+		overReplicated  bool
+		readOnlySkipped bool
+	}{
+		{name: "keeps min_copies by priority", locations: copies(), group: db.PathGroup{MinCopies: 2},
+			keep: []string{"A", "B"}, remove: []string{"C", "D"}},
+		{name: "respects max_copies", locations: copies(), group: db.PathGroup{MinCopies: 1, MaxCopies: &three}, respectLimits: true,
+			keep: []string{"A", "B", "C"}, remove: []string{"D"}},
+		{name: "at minimum keeps everything", locations: copies("D"), group: db.PathGroup{MinCopies: 4},
+			keep: []string{"A", "B", "C", "D"}, atMinimum: true},
+		{name: "protected low-priority copy is spared", locations: copies("D"), group: db.PathGroup{MinCopies: 2},
+			keep: []string{"A", "B", "D"}, remove: []string{"C"}},
+		{name: "protected copy already kept changes nothing", locations: copies("A"), group: db.PathGroup{MinCopies: 2, MaxCopies: &two}, respectLimits: true,
+			keep: []string{"A", "B"}, remove: []string{"C", "D"}},
+		{name: "protection above max_copies is over-replicated", locations: copies("C", "D"), group: db.PathGroup{MinCopies: 1, MaxCopies: &two}, respectLimits: true,
+			keep: []string{"A", "B", "C", "D"}, overReplicated: true},
+		{name: "spared copy within max_copies is not over-replicated", locations: copies("D"), group: db.PathGroup{MinCopies: 2, MaxCopies: &three},
+			keep: []string{"A", "B", "D"}, remove: []string{"C"}},
+		{name: "all protected removes nothing", locations: copies("A", "B", "C", "D"), group: db.PathGroup{MinCopies: 1, MaxCopies: &two}, respectLimits: true,
+			keep: []string{"A", "B", "C", "D"}, overReplicated: true},
+		{name: "read-only lowest-priority copy survives", locations: readOnly(copies(), "D"), group: db.PathGroup{MinCopies: 1},
+			keep: []string{"A", "D"}, remove: []string{"B", "C"}},
+		{name: "only read-only copies removable skips the group", locations: readOnly(copies(), "C", "D"), group: db.PathGroup{MinCopies: 2},
+			keep: []string{"A", "B", "C", "D"}, readOnlySkipped: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := selectGroupCopies(tt.locations, &tt.group, tt.respectLimits, KeepPolicy{})
+			if keep := copyHosts(got.Keep); !reflect.DeepEqual(keep, tt.keep) {
+				t.Errorf("kept %v, want %v", keep, tt.keep)
+			}
+			if remove := copyHosts(got.Remove); !reflect.DeepEqual(remove, append([]string{}, tt.remove...)) {
+				t.Errorf("removed %v, want %v", remove, tt.remove)
+			}
+			if got.AtMinimum != tt.atMinimum || got.OverReplicated != tt.overReplicated || got.ReadOnlySkipped != tt.readOnlySkipped {
+				t.Errorf("AtMinimum=%v OverReplicated=%v ReadOnlySkipped=%v, want %v %v %v",
+					got.AtMinimum, got.OverReplicated, got.ReadOnlySkipped, tt.atMinimum, tt.overReplicated, tt.readOnlySkipped)
+			}
+		})
+	}
+}
+
+func TestProcessGroupDuplicatesReportsOverReplicatedProtectedGroup(t *testing.T) {
+	database, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("sqlmock: %v", err)
+	}
+	defer database.Close()
+
+	one := 1
+	locations := []FileLocation{
+		{Hash: "h", Path: "a.jpg", HostName: "Brain", FriendlyPath: "photos", Size: 4, Priority: 10},
+		{Hash: "h", Path: "a.jpg", HostName: "Archive", FriendlyPath: "photos", Size: 4, Priority: 90, Protected: true},
+	}
+	group := &db.PathGroup{Name: "photos", MinCopies: 1, MaxCopies: &one}
+
+	var result groupDedupeResult
+	out := captureStdout(t, func() {
+		result, err = processGroupDuplicates(context.Background(), os.Stdout, database, locations, group, nil, GroupDedupeOptions{RespectLimits: true})
+	})
+	if err != nil {
+		t.Fatalf("processGroupDuplicates error: %v", err)
+	}
+	if result.Removed != 0 || !result.OverReplicated {
+		t.Fatalf("expected nothing removed and the group flagged, got %+v", result)
+	}
+	for _, want := range []string{"photos/a.jpg on Archive (priority 90, protected)", "Over-replicated but protected: keeping 2 copies, max_copies is 1"} {
+		if !strings.Contains(out, want) {
+			t.Errorf("expected %q in output:\n%s", want, out)
+		}
+	}
+	// No UPDATE expectation: the protected copy must stay indexed.
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatalf("unmet expectations: %v", err)
+	}
+}
+
+func TestProcessGroupDuplicatesSkipsGroupWhoseRemovableCopiesAreReadOnly(t *testing.T) {
+	database, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("sqlmock: %v", err)
+	}
+	defer database.Close()
+
+	locations := []FileLocation{
+		{Hash: "h", Path: "a.jpg", Hostname: "brain", HostName: "Brain", FriendlyPath: "photos", RootFolder: "/data/photos", Size: 4, Priority: 10},
+		{Hash: "h", Path: "a.jpg", Hostname: "archive", HostName: "Archive", FriendlyPath: "photos", RootFolder: "/mnt/archive", Size: 4, Priority: 999, ReadOnly: true},
+	}
+	group := &db.PathGroup{Name: "photos", MinCopies: 1}
+
+	var result groupDedupeResult
+	out := captureStdout(t, func() {
+		result, err = processGroupDuplicates(context.Background(), os.Stdout, database, locations, group, nil, GroupDedupeOptions{GroupName: "photos"})
+	})
+	if err != nil {
+		t.Fatalf("processGroupDuplicates error: %v", err)
+	}
+	if result.Removed != 0 || !result.ReadOnlySkipped {
+		t.Fatalf("expected the group to be skipped, got %+v", result)
+	}
+	for _, want := range []string{"photos/a.jpg on Archive (priority 999, read-only)", "Skipped: the only removable copies are on read-only members"} {
+		if !strings.Contains(out, want) {
+			t.Errorf("expected %q in output:\n%s", want, out)
+		}
+	}
+	// No UPDATE expectation: nothing on the read-only member is touched.
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatalf("unmet expectations: %v", err)
+	}
+}
+
+func TestProcessGroupDuplicatesConcurrentlyKeepsGroupsWhole(t *testing.T) {
+	database, _, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("sqlmock: %v", err)
+	}
+	defer database.Close()
+
+	group := &db.PathGroup{Name: "photos", MinCopies: 1}
+	var duplicates [][]FileLocation
+	for i := 0; i < 20; i++ {
+		hash := fmt.Sprintf("h%02d", i)
+		duplicates = append(duplicates, []FileLocation{
+			{Hash: hash, Path: hash + ".jpg", HostName: "Brain", FriendlyPath: "photos", Size: 4, Priority: 1},
+			{Hash: hash, Path: hash + ".jpg", HostName: "NAS", FriendlyPath: "photos", Size: 4, Priority: 2},
+		})
+	}
+	opts := GroupDedupeOptions{GroupName: "photos", DryRun: true, Workers: 4}
+
+	var results []*groupDedupeResult
+	out := captureStdout(t, func() {
+		results = processGroupDuplicatesConcurrently(context.Background(), database, duplicates, group, nil, opts)
+	})
+	for i, dupGroup := range duplicates {
+		var block bytes.Buffer
+		if _, err := processGroupDuplicates(context.Background(), &block, database, dupGroup, group, nil, opts); err != nil {
+			t.Fatalf("processGroupDuplicates error: %v", err)
+		}
+		if !strings.Contains(out, block.String()) {
+			t.Fatalf("output of %s is not whole:\n%s", dupGroup[0].Hash, out)
+		}
+		if results[i] == nil || results[i].Entry.Hash != dupGroup[0].Hash || results[i].Removed != 1 {
+			t.Fatalf("result %d = %+v, want the plan of %s", i, results[i], dupGroup[0].Hash)
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	captureStdout(t, func() {
+		results = processGroupDuplicatesConcurrently(ctx, database, duplicates, group, nil, opts)
+	})
+	for i, result := range results {
+		if result != nil {
+			t.Fatalf("group %d was processed after cancellation: %+v", i, result)
+		}
+	}
+}
+
+func TestDeduplicateByGroupLooksUpHostsOnceAndBatchesLocations(t *testing.T) {
+	database, mock, err := sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherRegexp))
+	if err != nil {
+		t.Fatalf("sqlmock: %v", err)
+	}
+	defer database.Close()
+
+	hostColumns := []string{"id", "name", "hostname", "ip", "root_path", "settings", "created_at"}
+	mock.ExpectQuery(`FROM path_groups WHERE name = \$1`).
+		WithArgs("photos").
+		WillReturnRows(sqlmock.NewRows([]string{"id", "name", "description", "min_copies", "max_copies", "created_at"}).
+			AddRow(1, "photos", "", 1, nil, time.Now()))
+	mock.ExpectQuery(`FROM path_group_members pgm`).
+		WithArgs("photos").
+		WillReturnRows(sqlmock.NewRows([]string{"id", "group_id", "host_name", "friendly_path", "priority", "protected", "read_only"}).
+			AddRow(1, 1, "Brain", "photos", 1, false, false).
+			AddRow(2, 1, "Brain", "archive", 2, false, false).
+			AddRow(3, 1, "NAS", "photos", 3, false, false))
+	// One lookup per host, although Brain has two members.
+	mock.ExpectQuery(`FROM hosts WHERE name = \$1`).
+		WithArgs("Brain").
+		WillReturnRows(sqlmock.NewRows(hostColumns).
+			AddRow(1, "Brain", "brain", "", "", []byte(`{"paths":{"photos":"/data/photos","archive":"/data/archive"}}`), time.Now()))
+	mock.ExpectQuery(`FROM hosts WHERE name = \$1`).
+		WithArgs("NAS").
+		WillReturnRows(sqlmock.NewRows(hostColumns).
+			AddRow(2, "NAS", "nas", "", "", []byte(`{"paths":{"photos":"/srv/photos"}}`), time.Now()))
+	mock.ExpectQuery(`(?s)WITH group_files AS .*GROUP BY hash, size`).
+		WithArgs("Brain", "/data/photos", "Brain", "/data/archive", "NAS", "/srv/photos").
+		WillReturnRows(sqlmock.NewRows([]string{"hash", "size", "count", "total_size"}).
+			AddRow("h2", 20, 3, 60).
+			AddRow("h1", 10, 2, 20).
+			AddRow("h3", 5, 2, 10))
+	// A single query fetches the locations of every duplicate hash.
+	mock.ExpectQuery(`(?s)FROM files f.*WHERE f.hash = ANY\(\$1\)`).
+		WithArgs(pq.Array([]string{"h2", "h1", "h3"})).
+		WillReturnRows(sqlmock.NewRows([]string{"hash", "hash_algo", "path", "hostname", "root_folder", "size", "name"}).
+			AddRow("h1", "sha256", "a.jpg", "brain", "/data/photos", 10, "Brain").
+			AddRow("h1", "sha256", "a.jpg", "nas", "/srv/photos", 10, "NAS").
+			AddRow("h2", "sha256", "b.jpg", "brain", "/data/archive", 20, "Brain").
+			AddRow("h2", "sha256", "b.jpg", "brain", "/data/photos", 20, "Brain").
+			AddRow("h2", "sha256", "b.jpg", "brain", "/data/other", 20, "Brain").
+			AddRow("h2", "sha256", "b.jpg", "nas", "/srv/photos", 20, "NAS").
+			AddRow("h3", "sha256", "c.jpg", "brain", "/data/photos", 5, "Brain").
+			AddRow("h3", "sha256", "c.jpg", "nas", "/srv/photos", 6, "NAS"))
+
+	out := captureStdout(t, func() {
+		err = DeduplicateByGroup(context.Background(), database, GroupDedupeOptions{GroupName: "photos", DryRun: true})
+	})
+	if err != nil {
+		t.Fatalf("DeduplicateByGroup error: %v", err)
+	}
+	// h3 has one copy of each size, and /data/other is not a member.
+	for _, want := range []string{"Found 2 duplicate file groups", "Dry run: Would remove 3 files, saving 50"} {
+		if !strings.Contains(out, want) {
+			t.Errorf("expected %q in output:\n%s", want, out)
+		}
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatalf("unmet expectations: %v", err)
+	}
+}
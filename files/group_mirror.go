@@ -1,8 +1,11 @@
 package files
 
 import (
+	"bytes"
 	"context"
+	"crypto/sha256"
 	"database/sql"
+	"encoding/hex"
 	"errors"
 	"fmt"
 	"os"
@@ -19,6 +22,8 @@ import (
 type GroupMirrorOptions struct {
 	GroupName string
 	DryRun    bool
+	Replicate bool      // Only bring each hash up to the group's min_copies, instead of onto every member
+	Stats     *RunStats // Receives the final counters of the run (optional)
 }
 
 type groupMirrorMember struct {
@@ -28,7 +33,9 @@ type groupMirrorMember struct {
 	FriendlyPath string
 	RootFolder   string
 	Priority     int
+	ReadOnly     bool // never written to; its copies only serve as sources
 	FileCount    int64
+	SSH          db.SSHSettings
 }
 
 type groupMirrorLocation struct {
@@ -54,14 +61,16 @@ type groupMirrorConflict struct {
 	Reason string
 }
 
-// MirrorGroup mirrors every hash in a path group to every member path.
+// MirrorGroup mirrors every hash in a path group to every member path. With
+// opts.Replicate, it only copies the hashes held by fewer members than the
+// group's min_copies, onto as many members as they are short of.
 func MirrorGroup(ctx context.Context, database *sql.DB, opts GroupMirrorOptions) error {
 	groupName := strings.TrimSpace(opts.GroupName)
 	if groupName == "" {
 		return fmt.Errorf("mirror-group requires a group name")
 	}
 
-	members, err := resolveGroupMirrorMembers(ctx, database, groupName)
+	group, members, err := resolveGroupMirrorMembers(ctx, database, groupName)
 	if err != nil {
 		return err
 	}
@@ -69,6 +78,18 @@ func MirrorGroup(ctx context.Context, database *sql.DB, opts GroupMirrorOptions)
 		return fmt.Errorf("path group '%s' needs at least 2 member paths to mirror", groupName)
 	}
 
+	localHost, _ := os.Hostname()
+	localHost = strings.ToLower(localHost)
+	wantCopies := len(members)
+	var targets *groupReplicaTargets
+	if opts.Replicate {
+		wantCopies = group.MinCopies
+		if wantCopies > len(members) {
+			wantCopies = len(members)
+		}
+		targets = newGroupReplicaTargets(ctx, localHost, members, wantCopies)
+	}
+
 	hashLocations, memberPathHashes, err := loadGroupMirrorHashes(ctx, database, members)
 	if err != nil {
 		return err
@@ -78,9 +99,19 @@ func MirrorGroup(ctx context.Context, database *sql.DB, opts GroupMirrorOptions)
 		return nil
 	}
 
-	tasks, conflicts := planGroupMirrorTasks(hashLocations, members, memberPathHashes)
+	tasks, conflicts := planGroupMirrorTasks(hashLocations, members, memberPathHashes, targets)
+	copied := 0
+	defer func() {
+		opts.Stats.Set("missing_copies", int64(len(tasks)))
+		opts.Stats.Set("copied", int64(copied))
+		opts.Stats.Set("conflicts", int64(len(conflicts)))
+	}()
 
-	fmt.Printf("Mirroring group '%s' across %d paths (target copies per hash: %d)\n", groupName, len(members), len(members))
+	if opts.Replicate {
+		fmt.Printf("Replicating group '%s' across %d paths (min_copies per hash: %d)\n", groupName, len(members), wantCopies)
+	} else {
+		fmt.Printf("Mirroring group '%s' across %d paths (target copies per hash: %d)\n", groupName, len(members), wantCopies)
+	}
 	fmt.Printf("Found %d unique hashes; %d missing copies to create\n", len(hashLocations), len(tasks))
 	if opts.DryRun {
 		printGroupMirrorTasks("Would copy", tasks)
@@ -88,9 +119,6 @@ func MirrorGroup(ctx context.Context, database *sql.DB, opts GroupMirrorOptions)
 		return nil
 	}
 
-	localHost, _ := os.Hostname()
-	localHost = strings.ToLower(localHost)
-	copied := 0
 	for _, task := range tasks {
 		conflictRoot, conflictHash, conflictsWithOtherRoot, err := groupMirrorIndexedPathConflict(ctx, database, task)
 		if err != nil {
@@ -176,29 +204,34 @@ func MirrorGroup(ctx context.Context, database *sql.DB, opts GroupMirrorOptions)
 	return nil
 }
 
-func resolveGroupMirrorMembers(ctx context.Context, database *sql.DB, groupName string) ([]groupMirrorMember, error) {
-	if _, err := db.GetPathGroup(database, groupName); err != nil {
-		return nil, fmt.Errorf("error getting path group: %v", err)
+func resolveGroupMirrorMembers(ctx context.Context, database *sql.DB, groupName string) (*db.PathGroup, []groupMirrorMember, error) {
+	group, err := db.GetPathGroup(database, groupName)
+	if err != nil {
+		return nil, nil, fmt.Errorf("error getting path group: %v", err)
 	}
 
 	groupMembers, err := db.ListGroupMembers(database, groupName)
 	if err != nil {
-		return nil, fmt.Errorf("error listing group members: %v", err)
+		return nil, nil, fmt.Errorf("error listing group members: %v", err)
 	}
 
 	members := make([]groupMirrorMember, 0, len(groupMembers))
 	for i, member := range groupMembers {
 		host, err := db.GetHost(database, member.HostName)
 		if err != nil {
-			return nil, fmt.Errorf("error getting host '%s': %v", member.HostName, err)
+			return nil, nil, fmt.Errorf("error getting host '%s': %v", member.HostName, err)
 		}
 		paths, err := host.GetPaths()
 		if err != nil {
-			return nil, fmt.Errorf("error decoding paths for host '%s': %v", member.HostName, err)
+			return nil, nil, fmt.Errorf("error decoding paths for host '%s': %v", member.HostName, err)
 		}
 		rootFolder, ok := paths[member.FriendlyPath]
 		if !ok {
-			return nil, fmt.Errorf("friendly path '%s' not found on host '%s'", member.FriendlyPath, member.HostName)
+			return nil, nil, fmt.Errorf("friendly path '%s' not found on host '%s'", member.FriendlyPath, member.HostName)
+		}
+		settings, err := hostSSH(host)
+		if err != nil {
+			return nil, nil, err
 		}
 
 		mirrorMember := groupMirrorMember{
@@ -208,15 +241,17 @@ func resolveGroupMirrorMembers(ctx context.Context, database *sql.DB, groupName
 			FriendlyPath: member.FriendlyPath,
 			RootFolder:   rootFolder,
 			Priority:     member.Priority,
+			ReadOnly:     member.ReadOnly,
+			SSH:          settings,
 		}
 		mirrorMember.FileCount, err = countGroupMirrorMemberFiles(ctx, database, mirrorMember)
 		if err != nil {
-			return nil, err
+			return nil, nil, err
 		}
 		members = append(members, mirrorMember)
 	}
 
-	return members, nil
+	return group, members, nil
 }
 
 func countGroupMirrorMemberFiles(ctx context.Context, database *sql.DB, member groupMirrorMember) (int64, error) {
@@ -224,9 +259,10 @@ func countGroupMirrorMemberFiles(ctx context.Context, database *sql.DB, member g
 	err := database.QueryRowContext(ctx, `
 		SELECT COUNT(*)
 		FROM files
-		WHERE LOWER(hostname) = LOWER($1)
+		WHERE hostname = $1
 		AND root_folder = $2
-	`, member.Hostname, member.RootFolder).Scan(&count)
+		AND `+NotDeleted+`
+	`, normalizeHostname(member.Hostname), member.RootFolder).Scan(&count)
 	if err != nil {
 		return 0, fmt.Errorf("error counting files for %s: %v", groupMirrorMemberLabel(member), err)
 	}
@@ -242,13 +278,14 @@ func loadGroupMirrorHashes(ctx context.Context, database *sql.DB, members []grou
 		rows, err := database.QueryContext(ctx, `
 			SELECT path, hash, size
 			FROM files
-			WHERE LOWER(hostname) = LOWER($1)
+			WHERE hostname = $1
 			AND root_folder = $2
 			AND hash IS NOT NULL
-			AND hash NOT IN ('TIMEOUT_ERROR', 'HASH_ERROR')
+			AND hash_algo = '`+HashAlgoSHA256+`'
 			AND size IS NOT NULL
+			AND `+NotDeleted+`
 			ORDER BY hash, path
-		`, member.Hostname, member.RootFolder)
+		`, normalizeHostname(member.Hostname), member.RootFolder)
 		if err != nil {
 			return nil, nil, fmt.Errorf("error loading files for %s: %v", groupMirrorMemberLabel(member), err)
 		}
@@ -278,7 +315,10 @@ func loadGroupMirrorHashes(ctx context.Context, database *sql.DB, members []grou
 	return hashLocations, memberPathHashes, nil
 }
 
-func planGroupMirrorTasks(hashLocations map[string][]groupMirrorLocation, members []groupMirrorMember, memberPathHashes map[int]map[string]string) ([]groupMirrorTask, []groupMirrorConflict) {
+// planGroupMirrorTasks plans the copies that put each hash on every member,
+// or with targets, on as many members as it is short of the wanted copies.
+// Read-only members are never a destination.
+func planGroupMirrorTasks(hashLocations map[string][]groupMirrorLocation, members []groupMirrorMember, memberPathHashes map[int]map[string]string, targets *groupReplicaTargets) ([]groupMirrorTask, []groupMirrorConflict) {
 	var tasks []groupMirrorTask
 	var conflicts []groupMirrorConflict
 	plannedDestPaths := make(map[int]map[string]string, len(members))
@@ -322,9 +362,22 @@ func planGroupMirrorTasks(hashLocations map[string][]groupMirrorLocation, member
 			present[loc.MemberIndex] = struct{}{}
 		}
 
+		var missing []groupMirrorMember
 		for _, member := range members {
-			if _, ok := present[member.Index]; ok {
-				continue
+			if _, ok := present[member.Index]; !ok && !member.ReadOnly {
+				missing = append(missing, member)
+			}
+		}
+		need := len(missing)
+		if targets != nil {
+			need = targets.want - len(present)
+			missing = targets.order(missing)
+		}
+
+		planned := 0
+		for _, member := range missing {
+			if planned >= need {
+				break
 			}
 
 			if existingHash, ok := memberPathHashes[member.Index][cleanRelPath]; ok && existingHash != hash {
@@ -349,7 +402,11 @@ func planGroupMirrorTasks(hashLocations map[string][]groupMirrorLocation, member
 				})
 				continue
 			}
+			if targets != nil && !targets.take(member, size) {
+				continue
+			}
 			plannedDestPaths[member.Index][cleanRelPath] = hash
+			planned++
 
 			tasks = append(tasks, groupMirrorTask{
 				Hash:      hash,
@@ -360,11 +417,68 @@ func planGroupMirrorTasks(hashLocations map[string][]groupMirrorLocation, member
 				DstMember: member,
 			})
 		}
+		if targets != nil && planned < need {
+			conflicts = append(conflicts, groupMirrorConflict{
+				Hash:   hash,
+				Path:   cleanRelPath,
+				Reason: fmt.Sprintf("%d copies short of min_copies %d: no other member can take it", need-planned, targets.want),
+			})
+		}
 	}
 
 	return tasks, conflicts
 }
 
+// groupReplicaTargets picks the members that receive the copies a replicating
+// run creates: lowest priority number first, then the most free space. The
+// space of each member is checked once and the planned copies are taken off
+// it, so a member is never planned beyond what it can hold.
+type groupReplicaTargets struct {
+	want int
+	free map[int]int64 // Bytes left per member index; members whose space could not be checked are absent
+}
+
+func newGroupReplicaTargets(ctx context.Context, localHost string, members []groupMirrorMember, want int) *groupReplicaTargets {
+	targets := &groupReplicaTargets{want: want, free: make(map[int]int64, len(members))}
+	for _, member := range members {
+		if member.ReadOnly {
+			continue
+		}
+		host := member.Hostname
+		if groupMirrorIsLocal(localHost, member) {
+			host = ""
+		}
+		space, err := destinationSpace(ctx, host, member.SSH, member.RootFolder)
+		if err != nil {
+			fmt.Printf("Warning: Skipping %s as a replication target: %v\n", groupMirrorMemberLabel(member), err)
+			continue
+		}
+		targets.free[member.Index] = space.Available
+	}
+	return targets
+}
+
+func (t *groupReplicaTargets) order(members []groupMirrorMember) []groupMirrorMember {
+	ordered := append([]groupMirrorMember(nil), members...)
+	sort.SliceStable(ordered, func(i, j int) bool {
+		if ordered[i].Priority != ordered[j].Priority {
+			return ordered[i].Priority < ordered[j].Priority
+		}
+		return t.free[ordered[i].Index] > t.free[ordered[j].Index]
+	})
+	return ordered
+}
+
+// take reserves size bytes on member, reporting false when it cannot hold them.
+func (t *groupReplicaTargets) take(member groupMirrorMember, size int64) bool {
+	free, ok := t.free[member.Index]
+	if !ok || free < size {
+		return false
+	}
+	t.free[member.Index] = free - size
+	return true
+}
+
 func groupMirrorCommonSize(locations []groupMirrorLocation) (int64, bool) {
 	if len(locations) == 0 {
 		return 0, false
@@ -472,8 +586,11 @@ func groupMirrorFileExists(ctx context.Context, localHost string, member groupMi
 		return false, fmt.Errorf("error checking destination file: %v", err)
 	}
 
-	cmd := exec.CommandContext(ctx, "ssh", member.Hostname, "test -e "+shellEscape(absPath))
-	err := cmd.Run()
+	cmd, err := sshCommand(ctx, member.Hostname, member.SSH, "test -e "+shellEscape(absPath))
+	if err != nil {
+		return false, err
+	}
+	err = cmd.Run()
 	if err == nil {
 		return true, nil
 	}
@@ -493,7 +610,10 @@ func ensureGroupMirrorParentDir(ctx context.Context, localHost string, member gr
 		return nil
 	}
 
-	cmd := exec.CommandContext(ctx, "ssh", member.Hostname, "mkdir -p "+shellEscape(parentDir))
+	cmd, err := sshCommand(ctx, member.Hostname, member.SSH, "mkdir -p "+shellEscape(parentDir))
+	if err != nil {
+		return err
+	}
 	output, err := cmd.CombinedOutput()
 	if err != nil {
 		return fmt.Errorf("remote mkdir failed: %v %s", err, strings.TrimSpace(string(output)))
@@ -501,6 +621,46 @@ func ensureGroupMirrorParentDir(ctx context.Context, localHost string, member gr
 	return nil
 }
 
+// hashRemoteFile returns the SHA256 of absPath on host, computed over ssh with
+// the host's configured hash command (sha256sum unless overridden in settings).
+func hashRemoteFile(ctx context.Context, host *db.Host, absPath string) (string, error) {
+	hashCommand, err := host.GetHashCommand()
+	if err != nil {
+		return "", fmt.Errorf("error reading hash command for host '%s': %v", host.Name, err)
+	}
+	settings, err := hostSSH(host)
+	if err != nil {
+		return "", err
+	}
+
+	var stderr bytes.Buffer
+	cmd, err := sshCommand(ctx, host.Hostname, settings, hashCommand+" -- "+shellEscape(absPath))
+	if err != nil {
+		return "", err
+	}
+	cmd.Stderr = &stderr
+	output, err := cmd.Output()
+	if err != nil {
+		return "", fmt.Errorf("remote hash failed: %w %s", err, strings.TrimSpace(stderr.String()))
+	}
+	return parseChecksumOutput(output)
+}
+
+// parseChecksumOutput extracts the digest from sha256sum/shasum output
+// ("<hex>  <path>"). GNU sha256sum prefixes the line with a backslash when
+// the file name contains special characters.
+func parseChecksumOutput(output []byte) (string, error) {
+	fields := strings.Fields(string(output))
+	if len(fields) == 0 {
+		return "", fmt.Errorf("empty checksum output")
+	}
+	sum := strings.ToLower(strings.TrimPrefix(fields[0], "\\"))
+	if _, err := hex.DecodeString(sum); err != nil || len(sum) != sha256.Size*2 {
+		return "", fmt.Errorf("malformed checksum output: %q", strings.TrimSpace(string(output)))
+	}
+	return sum, nil
+}
+
 func copyGroupMirrorFile(ctx context.Context, localHost string, task groupMirrorTask) error {
 	srcAbs := filepath.Join(task.SrcMember.RootFolder, task.RelPath)
 	dstAbs := filepath.Join(task.DstMember.RootFolder, task.RelPath)
@@ -510,8 +670,14 @@ func copyGroupMirrorFile(ctx context.Context, localHost string, task groupMirror
 	srcLocal := groupMirrorIsLocal(localHost, task.SrcMember)
 	dstLocal := groupMirrorIsLocal(localHost, task.DstMember)
 
-	if srcLocal || dstLocal {
-		return runGroupMirrorRsync(ctx, srcEndpoint, dstEndpoint)
+	if srcLocal && dstLocal {
+		return runGroupMirrorRsync(ctx, db.SSHSettings{}, srcEndpoint, dstEndpoint)
+	}
+	if srcLocal {
+		return runGroupMirrorRsync(ctx, task.DstMember.SSH, srcEndpoint, dstEndpoint)
+	}
+	if dstLocal {
+		return runGroupMirrorRsync(ctx, task.SrcMember.SSH, srcEndpoint, dstEndpoint)
 	}
 
 	tmpFile, err := os.CreateTemp("", "deduplicator-mirror-*")
@@ -525,14 +691,17 @@ func copyGroupMirrorFile(ctx context.Context, localHost string, task groupMirror
 	}
 	defer os.Remove(tmpPath)
 
-	if err := runGroupMirrorRsync(ctx, srcEndpoint, tmpPath); err != nil {
+	if err := runGroupMirrorRsync(ctx, task.SrcMember.SSH, srcEndpoint, tmpPath); err != nil {
 		return err
 	}
-	return runGroupMirrorRsync(ctx, tmpPath, dstEndpoint)
+	return runGroupMirrorRsync(ctx, task.DstMember.SSH, tmpPath, dstEndpoint)
 }
 
-func runGroupMirrorRsync(ctx context.Context, source, destination string) error {
-	cmd := exec.CommandContext(ctx, "rsync", "-a", source, destination)
+// runGroupMirrorRsync copies source to destination, at most one of which is
+// on a remote host, reached with settings.
+func runGroupMirrorRsync(ctx context.Context, settings db.SSHSettings, source, destination string) error {
+	args := append([]string{"-a"}, rsyncShell(settings)...)
+	cmd := exec.CommandContext(ctx, "rsync", append(args, source, destination)...)
 	output, err := cmd.CombinedOutput()
 	if err != nil {
 		return fmt.Errorf("rsync failed: %v %s", err, strings.TrimSpace(string(output)))
@@ -545,11 +714,12 @@ func groupMirrorIndexedPathConflict(ctx context.Context, database *sql.DB, task
 	err := database.QueryRowContext(ctx, `
 		SELECT root_folder, hash
 		FROM files
-		WHERE LOWER(hostname) = LOWER($1)
+		WHERE hostname = $1
 		AND path = $2
 		AND COALESCE(root_folder, '') <> $3
+		AND `+NotDeleted+`
 		LIMIT 1
-	`, task.DstMember.Hostname, task.RelPath, task.DstMember.RootFolder).Scan(&rootFolder, &hash)
+	`, normalizeHostname(task.DstMember.Hostname), task.RelPath, task.DstMember.RootFolder).Scan(&rootFolder, &hash)
 	if err == sql.ErrNoRows {
 		return "", "", false, nil
 	}
@@ -561,16 +731,18 @@ func groupMirrorIndexedPathConflict(ctx context.Context, database *sql.DB, task
 
 func recordGroupMirrorCopy(ctx context.Context, database *sql.DB, task groupMirrorTask) error {
 	result, err := database.ExecContext(ctx, `
-		INSERT INTO files (path, hostname, size, hash, root_folder, last_hashed_at)
-		VALUES ($1, $2, $3, $4, $5, NOW())
-		ON CONFLICT (path, hostname)
+		INSERT INTO files (path, hostname, size, hash, root_folder, last_hashed_at, added_by, added_host_user)
+		VALUES ($1, $2, $3, $4, $5, NOW(), $6, $7)
+		ON CONFLICT (path, hostname) WHERE deleted_at IS NULL
 		DO UPDATE SET
 			size = EXCLUDED.size,
 			hash = EXCLUDED.hash,
+			hash_algo = EXCLUDED.hash_algo,
 			root_folder = EXCLUDED.root_folder,
-			last_hashed_at = EXCLUDED.last_hashed_at
+			last_hashed_at = EXCLUDED.last_hashed_at,
+			`+preserveOrigin+`
 		WHERE COALESCE(files.root_folder, '') = COALESCE(EXCLUDED.root_folder, '')
-	`, task.RelPath, task.DstMember.Hostname, task.Size, task.Hash, task.DstMember.RootFolder)
+	`, task.RelPath, normalizeHostname(task.DstMember.Hostname), task.Size, task.Hash, task.DstMember.RootFolder, OriginMirror, currentHostUser())
 	if err != nil {
 		return fmt.Errorf("error recording mirrored file: %v", err)
 	}
@@ -603,12 +775,17 @@ func printGroupMirrorTasks(prefix string, tasks []groupMirrorTask) {
 	if len(tasks) == 0 {
 		return
 	}
-	fmt.Printf("\n%s %d files:\n", prefix, len(tasks))
+	var total int64
+	for _, task := range tasks {
+		total += task.Size
+	}
+	fmt.Printf("\n%s %d files (%s):\n", prefix, len(tasks), formatBytes(total))
 	for _, task := range tasks {
-		fmt.Printf("  %s -> %s: %s (%s)\n",
+		fmt.Printf("  %s -> %s: %s (%s, %s)\n",
 			groupMirrorMemberLabel(task.SrcMember),
 			groupMirrorMemberLabel(task.DstMember),
 			task.RelPath,
+			formatBytes(task.Size),
 			task.Hash,
 		)
 	}
@@ -11,6 +11,7 @@ import (
 	"testing"
 	"time"
 
+	"deduplicator/db"
 	"deduplicator/logging"
 
 	"github.com/DATA-DOG/go-sqlmock"
@@ -73,7 +74,7 @@ func TestPlanGroupMirrorTasksSkipsOccupiedDestinationPath(t *testing.T) {
 		1: {"albums/photo.jpg": "hash-b"},
 	}
 
-	tasks, conflicts := planGroupMirrorTasks(hashLocations, members, memberPathHashes)
+	tasks, conflicts := planGroupMirrorTasks(hashLocations, members, memberPathHashes, nil)
 	if len(tasks) != 0 {
 		t.Fatalf("expected no tasks for occupied destination path, got %+v", tasks)
 	}
@@ -82,6 +83,63 @@ func TestPlanGroupMirrorTasksSkipsOccupiedDestinationPath(t *testing.T) {
 	}
 }
 
+func TestPlanGroupMirrorTasksReplicatesUpToMinCopiesByPriorityAndSpace(t *testing.T) {
+	members := []groupMirrorMember{
+		{Index: 0, HostName: "Brain", FriendlyPath: "Personal", Priority: 100},
+		{Index: 1, HostName: "PI4", FriendlyPath: "BKP_Media", Priority: 10},
+		{Index: 2, HostName: "NAS", FriendlyPath: "Personal", Priority: 50},
+		{Index: 3, HostName: "Pinky", FriendlyPath: "Personal", Priority: 50},
+	}
+	hashLocations := map[string][]groupMirrorLocation{
+		"hash-a": {{Hash: "hash-a", Path: "a.jpg", Size: 50, MemberIndex: 0}},
+		"hash-b": {
+			{Hash: "hash-b", Path: "b.jpg", Size: 50, MemberIndex: 0},
+			{Hash: "hash-b", Path: "b.jpg", Size: 50, MemberIndex: 3},
+		},
+		"hash-c": {{Hash: "hash-c", Path: "c.jpg", Size: 500, MemberIndex: 0}},
+	}
+	memberPathHashes := map[int]map[string]string{0: {}, 1: {}, 2: {}, 3: {}}
+	// PI4 ranks first but has no room; NAS has more free space than Pinky.
+	targets := &groupReplicaTargets{want: 2, free: map[int]int64{0: 1000, 1: 10, 2: 300, 3: 200}}
+
+	tasks, conflicts := planGroupMirrorTasks(hashLocations, members, memberPathHashes, targets)
+	if len(tasks) != 1 || tasks[0].Hash != "hash-a" || tasks[0].DstMember.HostName != "NAS" {
+		t.Fatalf("expected hash-a to be copied to NAS only, got %+v", tasks)
+	}
+	if len(conflicts) != 1 || conflicts[0].Hash != "hash-c" || !strings.Contains(conflicts[0].Reason, "1 copies short of min_copies 2") {
+		t.Fatalf("expected hash-c to be reported short of min_copies, got %+v", conflicts)
+	}
+	if targets.free[2] != 250 {
+		t.Fatalf("expected the planned copy to be taken off NAS's free space, got %d", targets.free[2])
+	}
+}
+
+func TestPlanGroupMirrorTasksNeverWritesToReadOnlyMembers(t *testing.T) {
+	members := []groupMirrorMember{
+		{Index: 0, HostName: "Brain", FriendlyPath: "Personal", Priority: 100},
+		{Index: 1, HostName: "Archive", FriendlyPath: "Personal", Priority: 1, ReadOnly: true},
+		{Index: 2, HostName: "NAS", FriendlyPath: "Personal", Priority: 50},
+	}
+	hashLocations := map[string][]groupMirrorLocation{
+		"hash-a": {{Hash: "hash-a", Path: "a.jpg", Size: 5, MemberIndex: 1}},
+	}
+	memberPathHashes := map[int]map[string]string{0: {}, 1: {"a.jpg": "hash-a"}, 2: {}}
+
+	tasks, _ := planGroupMirrorTasks(hashLocations, members, memberPathHashes, nil)
+	if len(tasks) != 2 || tasks[0].DstMember.ReadOnly || tasks[1].DstMember.ReadOnly || tasks[0].SrcMember.HostName != "Archive" {
+		t.Fatalf("expected copies from Archive to Brain and NAS only, got %+v", tasks)
+	}
+
+	// Replicating to two copies picks NAS by priority, never Archive.
+	hashLocations["hash-b"] = []groupMirrorLocation{{Hash: "hash-b", Path: "b.jpg", Size: 5, MemberIndex: 0}}
+	delete(hashLocations, "hash-a")
+	targets := &groupReplicaTargets{want: 2, free: map[int]int64{0: 100, 2: 100}}
+	tasks, conflicts := planGroupMirrorTasks(hashLocations, members, memberPathHashes, targets)
+	if len(tasks) != 1 || tasks[0].DstMember.HostName != "NAS" || len(conflicts) != 0 {
+		t.Fatalf("expected hash-b to be copied to NAS, got %+v %+v", tasks, conflicts)
+	}
+}
+
 func TestMirrorGroupCopiesMissingHashAcrossDifferentFriendlyPaths(t *testing.T) {
 	database, mock, err := sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherRegexp))
 	if err != nil {
@@ -109,12 +167,12 @@ func TestMirrorGroupCopiesMissingHashAcrossDifferentFriendlyPaths(t *testing.T)
 		WillReturnRows(sqlmock.NewRows([]string{"id", "name", "description", "min_copies", "max_copies", "created_at"}).
 			AddRow(1, "family", "Family files", 2, 3, time.Now()))
 
-	mock.ExpectQuery(`(?s)SELECT pgm.id, pgm.group_id, pgm.host_name, pgm.friendly_path, pgm.priority\s+FROM path_group_members pgm`).
+	mock.ExpectQuery(`(?s)SELECT pgm.id, pgm.group_id, pgm.host_name, pgm.friendly_path, pgm.priority, pgm.protected, pgm.read_only\s+FROM path_group_members pgm`).
 		WithArgs("family").
-		WillReturnRows(sqlmock.NewRows([]string{"id", "group_id", "host_name", "friendly_path", "priority"}).
-			AddRow(1, 1, "Brain", "Personal", 100).
-			AddRow(2, 1, "PI4", "BKP_Media", 100).
-			AddRow(3, 1, "Pinky", "Personal", 100))
+		WillReturnRows(sqlmock.NewRows([]string{"id", "group_id", "host_name", "friendly_path", "priority", "protected", "read_only"}).
+			AddRow(1, 1, "Brain", "Personal", 100, false, false).
+			AddRow(2, 1, "PI4", "BKP_Media", 100, false, false).
+			AddRow(3, 1, "Pinky", "Personal", 100, false, false))
 
 	expectGroupMirrorHost(mock, "Brain", localHost, "Personal", brainRoot)
 	expectGroupMirrorHost(mock, "PI4", "pi4.local", "BKP_Media", piRoot)
@@ -131,8 +189,8 @@ func TestMirrorGroupCopiesMissingHashAcrossDifferentFriendlyPaths(t *testing.T)
 	expectGroupMirrorFiles(mock, "pinky.local", pinkyRoot, nil)
 
 	expectGroupMirrorNoIndexedPathConflict(mock, "pinky.local", "albums/2020/photo.jpg", pinkyRoot)
-	mock.ExpectExec(`(?s)INSERT INTO files \(path, hostname, size, hash, root_folder, last_hashed_at\)`).
-		WithArgs("albums/2020/photo.jpg", "pinky.local", int64(5), "hash-family", pinkyRoot).
+	mock.ExpectExec(`(?s)INSERT INTO files \(path, hostname, size, hash, root_folder, last_hashed_at, added_by, added_host_user\).*added_by = COALESCE\(files.added_by, EXCLUDED.added_by\)`).
+		WithArgs("albums/2020/photo.jpg", "pinky.local", int64(5), "hash-family", pinkyRoot, OriginMirror, sqlmock.AnyArg()).
 		WillReturnResult(sqlmock.NewResult(1, 1))
 
 	stubDir := t.TempDir()
@@ -161,7 +219,7 @@ func expectGroupMirrorHost(mock sqlmock.Sqlmock, name, hostname, friendlyPath, r
 }
 
 func expectGroupMirrorCount(mock sqlmock.Sqlmock, hostname, root string, count int64) {
-	mock.ExpectQuery(`(?s)SELECT COUNT\(\*\)\s+FROM files\s+WHERE LOWER\(hostname\) = LOWER\(\$1\)\s+AND root_folder = \$2`).
+	mock.ExpectQuery(`(?s)SELECT COUNT\(\*\)\s+FROM files\s+WHERE hostname = \$1\s+AND root_folder = \$2`).
 		WithArgs(hostname, root).
 		WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(count))
 }
@@ -171,13 +229,94 @@ func expectGroupMirrorFiles(mock sqlmock.Sqlmock, hostname, root string, locatio
 	for _, loc := range locations {
 		rows.AddRow(loc.Path, loc.Hash, loc.Size)
 	}
-	mock.ExpectQuery(`(?s)SELECT path, hash, size\s+FROM files\s+WHERE LOWER\(hostname\) = LOWER\(\$1\)\s+AND root_folder = \$2\s+AND hash IS NOT NULL`).
+	mock.ExpectQuery(`(?s)SELECT path, hash, size\s+FROM files\s+WHERE hostname = \$1\s+AND root_folder = \$2\s+AND hash IS NOT NULL`).
 		WithArgs(hostname, root).
 		WillReturnRows(rows)
 }
 
 func expectGroupMirrorNoIndexedPathConflict(mock sqlmock.Sqlmock, hostname, path, root string) {
-	mock.ExpectQuery(`(?s)SELECT root_folder, hash\s+FROM files\s+WHERE LOWER\(hostname\) = LOWER\(\$1\)\s+AND path = \$2\s+AND COALESCE\(root_folder, ''\) <> \$3\s+LIMIT 1`).
+	mock.ExpectQuery(`(?s)SELECT root_folder, hash\s+FROM files\s+WHERE hostname = \$1\s+AND path = \$2\s+AND COALESCE\(root_folder, ''\) <> \$3\s+AND deleted_at IS NULL\s+LIMIT 1`).
 		WithArgs(hostname, path, root).
 		WillReturnRows(sqlmock.NewRows([]string{"root_folder", "hash"}))
 }
+
+func TestHashRemoteFileParsesChecksumOutput(t *testing.T) {
+	const sum = "9f86d081884c7d659a2feaa0c55ad015a3bf4f1b2b0b822cd15d6c15b0f00a08"
+	host := &db.Host{Name: "NAS", Hostname: "nas.local", Settings: []byte(`{"paths":{}}`)}
+
+	tests := []struct {
+		name    string
+		stub    string
+		want    string
+		wantErr string
+	}{
+		{
+			name: "well formed",
+			stub: "#!/bin/sh\necho \"" + sum + "  /data/a b.txt\"\n",
+			want: sum,
+		},
+		{
+			name: "escaped file name",
+			stub: "#!/bin/sh\necho '\\" + sum + "  /data/a\\\\nb.txt'\n",
+			want: sum,
+		},
+		{
+			name:    "malformed digest",
+			stub:    "#!/bin/sh\necho \"sha256sum: not-a-digest\"\n",
+			wantErr: "malformed checksum output",
+		},
+		{
+			name:    "empty output",
+			stub:    "#!/bin/sh\nexit 0\n",
+			wantErr: "empty checksum output",
+		},
+		{
+			name:    "ssh failure",
+			stub:    "#!/bin/sh\necho 'connection refused' >&2\nexit 255\n",
+			wantErr: "connection refused",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stubDir := t.TempDir()
+			writeStub(t, stubDir, "ssh", tt.stub)
+			t.Setenv("PATH", stubDir+string(os.PathListSeparator)+os.Getenv("PATH"))
+
+			got, err := hashRemoteFile(context.Background(), host, "/data/a b.txt")
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("expected error containing %q, got %v", tt.wantErr, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("hashRemoteFile error: %v", err)
+			}
+			if got != tt.want {
+				t.Fatalf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestHashRemoteFileUsesConfiguredCommandAndEscapesPath(t *testing.T) {
+	stubDir := t.TempDir()
+	argsFile := filepath.Join(stubDir, "args")
+	writeStub(t, stubDir, "ssh", "#!/bin/sh\nprintf '%s\\n' \"$@\" > "+argsFile+"\necho 9f86d081884c7d659a2feaa0c55ad015a3bf4f1b2b0b822cd15d6c15b0f00a08  x\n")
+	t.Setenv("PATH", stubDir+string(os.PathListSeparator)+os.Getenv("PATH"))
+
+	host := &db.Host{Name: "Mac", Hostname: "mac.local", Settings: []byte(`{"hash_command":"shasum -a 256"}`)}
+	if _, err := hashRemoteFile(context.Background(), host, "/data/it's here.txt"); err != nil {
+		t.Fatalf("hashRemoteFile error: %v", err)
+	}
+
+	args, err := os.ReadFile(argsFile)
+	if err != nil {
+		t.Fatalf("read args: %v", err)
+	}
+	want := "mac.local\nshasum -a 256 -- " + shellEscape("/data/it's here.txt") + "\n"
+	if string(args) != want {
+		t.Fatalf("ssh args = %q, want %q", args, want)
+	}
+}
@@ -3,7 +3,10 @@ package files
 import (
 	"context"
 	"database/sql"
+	"errors"
 	"fmt"
+	"io/fs"
+	"os"
 	"path/filepath"
 	"strings"
 	"time"
@@ -15,43 +18,154 @@ import (
 	"github.com/schollz/progressbar/v3"
 )
 
+// Kinds of failure recorded in file_errors. A timeout becomes permanent
+// once it was recorded HashOptions.MaxAttempts times.
+const (
+	FileErrorTimeout    = "timeout"
+	FileErrorPermission = "permission"
+	FileErrorHash       = "hash_error"
+	FileErrorPermanent  = "permanent"
+)
+
+// DefaultHashMaxAttempts is how many timeouts files hash allows a file before
+// it is given up as permanent.
+const DefaultHashMaxAttempts = 5
+
+// storeHashSQL saves hash $1, produced by algorithm $3 in $4 milliseconds,
+// for file $2. A successful hash also clears any errors recorded for the file
+// on earlier attempts.
+const storeHashSQL = `
+		WITH cleared AS (DELETE FROM file_errors WHERE file_id = $2)
+		UPDATE files
+		SET hash = $1, last_hashed_at = NOW(), hash_algo = $3, hash_duration_ms = $4
+		WHERE id = $2
+	`
+
+// recordFileErrorSQL records that file $1 could not be hashed, with kind $2
+// and message $3, keeping its hash column untouched.
+const recordFileErrorSQL = `
+		INSERT INTO file_errors (file_id, kind, message, occurred_at, attempts)
+		VALUES ($1, $2, $3, NOW(), 1)
+		ON CONFLICT (file_id, kind)
+		DO UPDATE SET message = EXCLUDED.message, occurred_at = EXCLUDED.occurred_at,
+			attempts = file_errors.attempts + 1
+	`
+
+// markPermanentSQL turns the timeout recorded for file $1 into a permanent
+// failure once it has been recorded $2 times.
+const markPermanentSQL = `
+		UPDATE file_errors SET kind = '` + FileErrorPermanent + `'
+		WHERE file_id = $1 AND kind = '` + FileErrorTimeout + `' AND attempts >= $2
+	`
+
+// timeoutAttemptsSQL returns how many times file $1 timed out so far.
+const timeoutAttemptsSQL = `SELECT COALESCE(MAX(attempts), 0) FROM file_errors WHERE file_id = $1 AND kind = '` + FileErrorTimeout + `'`
+
+// noFileErrorsPredicate excludes files with a recorded hashing failure.
+const noFileErrorsPredicate = `NOT EXISTS (SELECT 1 FROM file_errors fe WHERE fe.file_id = files.id)`
+
+// notPermanentPredicate excludes files given up on after too many timeouts.
+const notPermanentPredicate = `NOT EXISTS (SELECT 1 FROM file_errors fe WHERE fe.file_id = files.id AND fe.kind = '` + FileErrorPermanent + `')`
+
+// classifyHashError maps a calculateFileHash error to a file_errors kind.
+func classifyHashError(err error) string {
+	msg := err.Error()
+	switch {
+	case strings.Contains(msg, "hashing timed out") || strings.Contains(msg, "hashing operation cancelled"):
+		return FileErrorTimeout
+	case errors.Is(err, fs.ErrPermission) || strings.Contains(msg, "permission denied"):
+		return FileErrorPermission
+	default:
+		return FileErrorHash
+	}
+}
+
+// hashSizeLimitPredicate restricts files to --min-size and --max-size, or is
+// empty when neither is set. Rows without a size count as 0 bytes.
+func hashSizeLimitPredicate(opts HashOptions) string {
+	var limits []string
+	if opts.MinSize > 0 {
+		limits = append(limits, fmt.Sprintf("COALESCE(size, 0) >= %d", opts.MinSize))
+	}
+	if opts.MaxSize > 0 {
+		limits = append(limits, fmt.Sprintf("COALESCE(size, 0) <= %d", opts.MaxSize))
+	}
+	return strings.Join(limits, " AND ")
+}
+
 func buildHashWhereClause(opts HashOptions) string {
-	// Base: filter to the target hostname (case-insensitive).
+	// Base: filter to the target hostname. Hostnames are stored lowercased, so
+	// a plain comparison lets the (hostname, hash) partial indexes be used.
 	whereClause := `
-		WHERE LOWER(hostname) = LOWER($1)
+		WHERE hostname = $1 AND ` + NotDeleted + `
 	`
+	// Every query built on the clause binds the hostname as $1 and its own
+	// bookmark after it, so the root folder is inlined as a quoted literal.
+	// The duplicate-size filter below still looks at the whole host, so a
+	// file whose only same-size twin lives under another path is hashed too.
+	if opts.rootFolder != "" {
+		whereClause += ` AND root_folder = ` + pq.QuoteLiteral(opts.rootFolder)
+	}
+	if limits := hashSizeLimitPredicate(opts); limits != "" {
+		whereClause += ` AND ` + limits
+	}
 
 	// If --refresh is set, we intentionally don't add any hash-related predicate.
+	// Files that failed to hash keep a NULL hash and get a file_errors row, so
+	// they are only picked up again when --retry-problematic is set, and once
+	// marked permanent only by --refresh.
 	if !opts.Refresh {
 		if opts.RetryProblematic && opts.Renew {
-			whereClause += ` AND (hash IS NULL OR hash IN ('TIMEOUT_ERROR', 'HASH_ERROR') OR last_hashed_at < NOW() - INTERVAL '1 week')`
+			whereClause += ` AND ((hash IS NULL AND ` + notPermanentPredicate + `) OR last_hashed_at < NOW() - INTERVAL '1 week')`
 		} else if opts.RetryProblematic {
-			whereClause += ` AND (hash IS NULL OR hash IN ('TIMEOUT_ERROR', 'HASH_ERROR'))`
+			whereClause += ` AND hash IS NULL AND ` + notPermanentPredicate
 		} else if opts.Renew {
-			whereClause += ` AND (hash IS NULL OR last_hashed_at < NOW() - INTERVAL '1 week')`
+			whereClause += ` AND ((hash IS NULL AND ` + noFileErrorsPredicate + `) OR last_hashed_at < NOW() - INTERVAL '1 week')`
 		} else {
-			whereClause += ` AND hash IS NULL`
+			whereClause += ` AND hash IS NULL AND ` + noFileErrorsPredicate
 		}
 	}
 
 	if !opts.FullHash {
+		sizeFilter := `size IS NOT NULL
+			AND size IN (
+				SELECT size
+				FROM files
+				WHERE hostname = $1
+				AND ` + NotDeleted + `
+				AND size IS NOT NULL
+				GROUP BY size
+				HAVING COUNT(*) > 1
+			)`
+		// A forced run also re-hashes every row hashed with another algorithm,
+		// so --force --algo moves a whole host over.
+		if opts.Refresh && opts.Algo != "" {
+			sizeFilter = `((` + sizeFilter + `)
+			OR (hash IS NOT NULL AND hash_algo <> '` + opts.Algo + `'))`
+		}
 		whereClause += `
-		AND size IS NOT NULL
-		AND size IN (
-			SELECT size
-			FROM files
-			WHERE LOWER(hostname) = LOWER($1)
-			AND size IS NOT NULL
-			GROUP BY size
-			HAVING COUNT(*) > 1
-		)`
+		AND ` + sizeFilter
 	}
 
 	return whereClause
 }
 
+// fileUnchanged reports whether the file at path still has the size and
+// modification time recorded for it by files find.
+func fileUnchanged(path string, size int64, modTime sql.NullTime) bool {
+	if !modTime.Valid {
+		return false
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return false
+	}
+	return info.Size() == size && catalogModTime(info.ModTime()).Equal(modTime.Time)
+}
+
 type hashBatchQueryOptions struct {
 	LargeFirst      bool
+	NewestFirst     bool
 	PrioritizePaths bool
 }
 
@@ -64,7 +178,7 @@ func buildHashBatchQuery(whereClause string, batchSize int, opts hashBatchQueryO
 		priorityExpr := buildHashPathPriorityExpression(2)
 		if opts.LargeFirst {
 			return fmt.Sprintf(
-				`SELECT id, path, root_folder, COALESCE(size, -1) AS effective_size, %s AS path_priority
+				`SELECT id, path, root_folder, COALESCE(size, -1) AS effective_size, mod_time, hash IS NOT NULL AS hashed, %s AS path_priority
 				FROM files %s
 				AND (
 					$3::int IS NULL
@@ -88,27 +202,33 @@ func buildHashBatchQuery(whereClause string, batchSize int, opts hashBatchQueryO
 			)
 		}
 
+		idAfter, idOrder := "id > $4", "id ASC"
+		if opts.NewestFirst {
+			idAfter, idOrder = "id < $4", "id DESC"
+		}
 		return fmt.Sprintf(
-			`SELECT id, path, root_folder, COALESCE(size, -1) AS effective_size, %s AS path_priority
+			`SELECT id, path, root_folder, COALESCE(size, -1) AS effective_size, mod_time, hash IS NOT NULL AS hashed, %s AS path_priority
 			FROM files %s
 			AND (
 				$3::int IS NULL
 				OR %s > $3::int
-				OR (%s = $3::int AND id > $4)
+				OR (%s = $3::int AND %s)
 			)
-			ORDER BY path_priority ASC, id ASC
+			ORDER BY path_priority ASC, %s
 			LIMIT %d`,
 			priorityExpr,
 			whereClause,
 			priorityExpr,
 			priorityExpr,
+			idAfter,
+			idOrder,
 			batchSize,
 		)
 	}
 
 	if opts.LargeFirst {
 		return fmt.Sprintf(
-			`SELECT id, path, root_folder, COALESCE(size, -1) AS effective_size
+			`SELECT id, path, root_folder, COALESCE(size, -1) AS effective_size, mod_time, hash IS NOT NULL AS hashed
 			FROM files %s
 			AND (
 				$2::bigint IS NULL
@@ -122,8 +242,20 @@ func buildHashBatchQuery(whereClause string, batchSize int, opts hashBatchQueryO
 		)
 	}
 
+	if opts.NewestFirst {
+		// The bookmark starts at 0, before any file has been processed.
+		return fmt.Sprintf(
+			`SELECT id, path, root_folder, COALESCE(size, -1) AS effective_size, mod_time, hash IS NOT NULL AS hashed
+			FROM files %s AND ($2::int = 0 OR id < $2::int)
+			ORDER BY id DESC
+			LIMIT %d`,
+			whereClause,
+			batchSize,
+		)
+	}
+
 	return fmt.Sprintf(
-		`SELECT id, path, root_folder, COALESCE(size, -1) AS effective_size
+		`SELECT id, path, root_folder, COALESCE(size, -1) AS effective_size, mod_time, hash IS NOT NULL AS hashed
 		FROM files %s AND id > $2
 		ORDER BY id ASC
 		LIMIT %d`,
@@ -184,25 +316,70 @@ func resolveHashPriorityRootFolders(host *db.Host, paths []string) ([]string, er
 
 // HashFiles calculates hashes for files in the database
 func HashFiles(ctx context.Context, sqldb *sql.DB, opts HashOptions) error {
-	// Get host information by hostname (case-insensitive)
-	host, err := db.GetHostByHostname(sqldb, opts.Server)
+	host := opts.Host
+	if host == nil {
+		return fmt.Errorf("no host to hash")
+	}
+	hostname := normalizeHostname(host.Hostname)
+	algo, err := ParseHashAlgo(opts.Algo)
 	if err != nil {
-		// Try by name if not found by hostname
-		host, err = db.GetHost(sqldb, opts.Server)
-		if err != nil {
-			return fmt.Errorf("server not found: %s", opts.Server)
-		}
+		return err
+	}
+	opts.Algo = algo
+	if opts.LargeFirst && opts.NewestFirst {
+		return fmt.Errorf("files cannot be hashed both largest first and newest first")
 	}
-	hostname := host.Hostname
 	priorityRootFolders, err := resolveHashPriorityRootFolders(host, opts.Paths)
 	if err != nil {
 		return err
 	}
+	if opts.OnlyPath != "" {
+		paths, err := host.GetPaths()
+		if err != nil {
+			return fmt.Errorf("error decoding host paths: %v", err)
+		}
+		rootFolder, ok := paths[opts.OnlyPath]
+		if !ok {
+			return fmt.Errorf("friendly path '%s' not found for server '%s'", opts.OnlyPath, host.Name)
+		}
+		opts.rootFolder = rootFolder
+	}
 
 	// Build base WHERE clause (no SELECT list) based on options.
 	// We batch using `id > lastID` so we don't re-process rows even if the filter
 	// would still match after updating their hash (notably for --retry-problematic).
 	whereClause := buildHashWhereClause(opts)
+
+	// Count the files the size limits leave out, so the summary tells how
+	// much stays unhashed.
+	var sizeExcluded int64
+	if limits := hashSizeLimitPredicate(opts); limits != "" {
+		unlimited := opts
+		unlimited.MinSize, unlimited.MaxSize = 0, 0
+		excludedQuery := fmt.Sprintf("SELECT COUNT(*) FROM files %s AND NOT (%s)", buildHashWhereClause(unlimited), limits)
+		if err := sqldb.QueryRow(excludedQuery, hostname).Scan(&sizeExcluded); err != nil {
+			return fmt.Errorf("error counting files outside the size limits: %v", err)
+		}
+		opts.Stats.Set("size_excluded", sizeExcluded)
+	}
+	reportSizeExcluded := func() {
+		if sizeExcluded > 0 {
+			fmt.Printf("\nExcluded %d files outside the size limits (--min-size/--max-size)\n", sizeExcluded)
+		}
+	}
+
+	if opts.Prescreen {
+		// Stage one: quick-hash every candidate, then fully hash only the
+		// ones whose size and quick hash collide with another file.
+		quick, err := quickHashCandidates(ctx, sqldb, hostname, whereClause, opts.Refresh)
+		opts.Stats.Set("quick_hashed", quick)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Quick-hashed %d files\n", quick)
+		whereClause += `
+		AND ` + quickHashCollisionPredicate
+	}
 	// First, count total files to process
 	var totalFiles int64
 	countQuery := fmt.Sprintf("SELECT COUNT(*) FROM files %s", whereClause)
@@ -213,9 +390,31 @@ func HashFiles(ctx context.Context, sqldb *sql.DB, opts HashOptions) error {
 
 	if totalFiles == 0 {
 		// fmt.Println("No files need hashing")
+		reportSizeExcluded()
 		return nil
 	}
 
+	// With --remote, the files of another machine are hashed on it over ssh
+	// with the host's hash command. A host that cannot be reached stops the
+	// run before any file is marked problematic.
+	remote := false
+	if opts.Remote {
+		localHostname, err := os.Hostname()
+		if err != nil {
+			return fmt.Errorf("error getting hostname: %v", err)
+		}
+		if !strings.EqualFold(localHostname, hostname) {
+			if algo != HashAlgoSHA256 {
+				return fmt.Errorf("--remote hashes with the host's hash command, which must produce %s", HashAlgoSHA256)
+			}
+			if err := checkRemoteHashing(ctx, host); err != nil {
+				return err
+			}
+			remote = true
+			fmt.Printf("Hashing the files of %s on it over ssh\n", host.Hostname)
+		}
+	}
+
 	// Create progress bar
 	bar := progressbar.NewOptions64(totalFiles,
 		progressbar.OptionEnableColorCodes(true),
@@ -230,38 +429,19 @@ func HashFiles(ctx context.Context, sqldb *sql.DB, opts HashOptions) error {
 			BarEnd:        "]",
 		}))
 
-	// Prepare update statement
-	stmt, err := sqldb.Prepare(`
-		UPDATE files
-		SET hash = $1, last_hashed_at = NOW()
-		WHERE id = $2
-	`)
+	// Prepare update statement.
+	stmt, err := sqldb.Prepare(storeHashSQL)
 	if err != nil {
 		return fmt.Errorf("error preparing statement: %v", err)
 	}
 	defer stmt.Close()
 
-	// Prepare statement to mark files that timed out
-	skipStmt, err := sqldb.Prepare(`
-		UPDATE files
-		SET hash = 'TIMEOUT_ERROR', last_hashed_at = NOW()
-		WHERE id = $1
-	`)
-	if err != nil {
-		return fmt.Errorf("error preparing skip statement: %v", err)
-	}
-	defer skipStmt.Close()
-
-	// Prepare statement to mark files that errored (non-timeout)
-	hashErrStmt, err := sqldb.Prepare(`
-		UPDATE files
-		SET hash = 'HASH_ERROR', last_hashed_at = NOW()
-		WHERE id = $1
-	`)
+	// Prepare statement to record files that could not be hashed.
+	errStmt, err := sqldb.Prepare(recordFileErrorSQL)
 	if err != nil {
-		return fmt.Errorf("error preparing hash error statement: %v", err)
+		return fmt.Errorf("error preparing file error statement: %v", err)
 	}
-	defer hashErrStmt.Close()
+	defer errStmt.Close()
 
 	// Instead of querying all files at once, we'll fetch them in batches
 	// to avoid keeping all file records in memory
@@ -272,12 +452,42 @@ func HashFiles(ctx context.Context, sqldb *sql.DB, opts HashOptions) error {
 	var lastEffectiveSize sql.NullInt64
 	var lastPathPriority sql.NullInt64
 
+	// Start after the last file of an interrupted run with the same options.
+	checkpointKey := hashCheckpointKey(opts)
+	if opts.Checkpoint && opts.Resume {
+		bookmark, savedAt, found, err := loadHashCheckpoint(ctx, sqldb, hostname, checkpointKey)
+		if err != nil {
+			return err
+		}
+		if found {
+			lastID, lastEffectiveSize, lastPathPriority = bookmark.id, bookmark.size, bookmark.priority
+			fmt.Printf("Resuming the run interrupted at %s (after file id %d)\n", savedAt.Format("2006-01-02 15:04:05"), lastID)
+		}
+	}
+
+	hasher := opts.hasher
+	if hasher == nil {
+		hasher = fileHasher(algo)
+	}
+	audit := newHashAudit(opts.AuditSample, nil)
+
 	// Track statistics
-	var processed, skipped int64
+	var processed, skipped, unchanged, permanent int64
+	defer func() {
+		opts.Stats.Set("processed", processed)
+		opts.Stats.Set("skipped", skipped)
+		opts.Stats.Set("unchanged", unchanged)
+		opts.Stats.Set("permanent", permanent)
+	}()
+
+	// With --count the run stops after that many files were hashed; files
+	// that fail or are unchanged do not count towards it.
+	limitReached := false
 
 	prioritizePaths := len(priorityRootFolders) > 0
 	batchQuery := buildHashBatchQuery(whereClause, batchSize, hashBatchQueryOptions{
 		LargeFirst:      opts.LargeFirst,
+		NewestFirst:     opts.NewestFirst,
 		PrioritizePaths: prioritizePaths,
 	})
 	for {
@@ -311,15 +521,21 @@ func HashFiles(ctx context.Context, sqldb *sql.DB, opts HashOptions) error {
 				return fmt.Errorf("operation cancelled")
 			default:
 			}
+			// Every row returned counts towards the batch, even one that
+			// cannot be scanned, so a full batch always fetches the next one.
+			fileCount++
+
 			var id int
 			var dbPath string
 			var rootFolder sql.NullString
 			var effectiveSize int64
+			var modTime sql.NullTime
+			var hashed bool
 			var pathPriority int64
 			if prioritizePaths {
-				err = rows.Scan(&id, &dbPath, &rootFolder, &effectiveSize, &pathPriority)
+				err = rows.Scan(&id, &dbPath, &rootFolder, &effectiveSize, &modTime, &hashed, &pathPriority)
 			} else {
-				err = rows.Scan(&id, &dbPath, &rootFolder, &effectiveSize)
+				err = rows.Scan(&id, &dbPath, &rootFolder, &effectiveSize, &modTime, &hashed)
 			}
 			if err != nil {
 				logging.InfoLogger.Printf("Warning: Error scanning row: %v", err)
@@ -332,32 +548,69 @@ func HashFiles(ctx context.Context, sqldb *sql.DB, opts HashOptions) error {
 			if prioritizePaths {
 				lastPathPriority = sql.NullInt64{Int64: pathPriority, Valid: true}
 			}
-			fileCount++
 
 			// Construct the full dbPath from root_folder + dbPath
 			fullPath := filepath.Join(rootFolder.String, dbPath)
 
+			// Unless forced, a hashed file whose size and modification time
+			// still match the catalog keeps its hash.
+			if !opts.Refresh && !remote && hashed && fileUnchanged(fullPath, effectiveSize, modTime) {
+				unchanged++
+				bar.Add(1)
+				continue
+			}
+
 			// Display the file name before hashing
 			logging.InfoLogger.Printf("Hashing file: %s", filepath.Base(dbPath))
 
+			// A file retried after timing out gets a longer stall timeout
+			// for every timeout recorded so far.
+			hashFile := hasher
+			stall := hashStallTimeout
+			if opts.RetryProblematic {
+				var timeouts int
+				if err := sqldb.QueryRow(timeoutAttemptsSQL, id).Scan(&timeouts); err != nil {
+					logging.InfoLogger.Printf("Warning: Error reading timeouts of %s: %v", dbPath, err)
+				} else if timeouts > 0 {
+					stall = retryStallTimeout(timeouts)
+					if opts.hasher == nil {
+						hashFile = fileHasherWithTimeout(algo, stall)
+					}
+				}
+			}
+			targetPath := hashTargetPath(fullPath)
+			if remote {
+				hashFile = remoteFileHasher(ctx, host, remoteHashTimeout(stall, effectiveSize))
+				targetPath = fullPath
+			}
+
 			// Calculate hash - this will block until the hash is complete or times out
-			hash, err := calculateFileHash(fullPath)
+			started := time.Now()
+			hash, err := hashFile(targetPath)
+			duration := time.Since(started)
+			if errors.Is(err, errRemoteUnreachable) {
+				rows.Close()
+				return fmt.Errorf("error hashing %s: %v", dbPath, err)
+			}
 			if err != nil {
-				if strings.Contains(err.Error(), "hashing timed out") || strings.Contains(err.Error(), "hashing operation cancelled") {
+				kind := classifyHashError(err)
+				if kind == FileErrorTimeout {
 					logging.InfoLogger.Printf("Warning: Timeout while hashing file %s: %v", dbPath, err)
-					// Mark file as problematic in the database
-					_, dbErr := skipStmt.Exec(id)
-					if dbErr != nil {
-						logging.InfoLogger.Printf("Warning: Error marking file as problematic: %v", dbErr)
-					} else {
-						skipped++
-						logging.InfoLogger.Printf("Marked file as problematic: %s", dbPath)
-					}
 				} else {
 					logging.InfoLogger.Printf("Warning: Error hashing file %s: %v", dbPath, err)
-					_, dbErr := hashErrStmt.Exec(id)
-					if dbErr != nil {
-						logging.InfoLogger.Printf("Warning: Error marking file as hash error: %v", dbErr)
+				}
+				if _, dbErr := errStmt.Exec(id, kind, err.Error()); dbErr != nil {
+					logging.InfoLogger.Printf("Warning: Error recording hash failure: %v", dbErr)
+				} else {
+					skipped++
+					logging.InfoLogger.Printf("Marked file as problematic (%s): %s", kind, dbPath)
+				}
+				if kind == FileErrorTimeout && opts.MaxAttempts > 0 {
+					if res, dbErr := sqldb.Exec(markPermanentSQL, id, opts.MaxAttempts); dbErr != nil {
+						logging.InfoLogger.Printf("Warning: Error marking hash failure permanent: %v", dbErr)
+					} else if n, _ := res.RowsAffected(); n > 0 {
+						permanent++
+						logging.InfoLogger.Printf("Giving up on %s after %d timeouts", dbPath, opts.MaxAttempts)
 					}
 				}
 				bar.Add(1)
@@ -365,14 +618,19 @@ func HashFiles(ctx context.Context, sqldb *sql.DB, opts HashOptions) error {
 			}
 
 			// Update database
-			_, err = stmt.Exec(hash, id)
+			_, err = stmt.Exec(hash, id, algo, duration.Milliseconds())
 			if err != nil {
 				logging.InfoLogger.Printf("Warning: Error updating hash for file %s: %v", dbPath, err)
 				continue
 			}
 
 			processed++
+			audit.observe(hashAuditEntry{id: id, path: targetPath, hash: hash})
 			bar.Add(1)
+			if opts.Count > 0 && processed >= int64(opts.Count) {
+				limitReached = true
+				break
+			}
 
 			// Check for context cancellation after each file
 			select {
@@ -389,27 +647,70 @@ func HashFiles(ctx context.Context, sqldb *sql.DB, opts HashOptions) error {
 			return fmt.Errorf("error iterating rows: %v", err)
 		}
 
-		if fileCount < batchSize {
+		if opts.Checkpoint && fileCount > 0 {
+			bookmark := hashBookmark{id: lastID, size: lastEffectiveSize, priority: lastPathPriority}
+			if err := saveHashCheckpoint(ctx, sqldb, hostname, checkpointKey, bookmark); err != nil {
+				return err
+			}
+		}
+
+		if limitReached || fileCount < batchSize {
 			break
 		}
 	}
 
+	// A run stopped by --count resumes from its checkpoint next time.
+	if opts.Checkpoint && !limitReached {
+		if err := clearHashCheckpoint(ctx, sqldb, hostname, checkpointKey); err != nil {
+			return err
+		}
+	}
+
 	// fmt.Printf("\nSuccessfully processed %d files\n", processed)
 	if skipped > 0 {
-		// fmt.Printf("Skipped %d problematic files (marked with TIMEOUT_ERROR in database)\n", skipped)
+		// fmt.Printf("Skipped %d problematic files (recorded in file_errors)\n", skipped)
 	}
-	return nil
+
+	if unchanged > 0 {
+		fmt.Printf("\nSkipped %d unchanged files (size and modification time match the catalog)\n", unchanged)
+	}
+	if permanent > 0 {
+		fmt.Printf("\nGave up on %d files after %d timeouts; only files hash --force retries them\n", permanent, opts.MaxAttempts)
+	}
+	if limitReached {
+		remaining := totalFiles - processed - skipped - unchanged
+		opts.Stats.Set("remaining", remaining)
+		fmt.Printf("\nStopped after hashing %d files (--count); %d files remain to be hashed\n", processed, remaining)
+	}
+	reportSizeExcluded()
+
+	if audit.seen == 0 {
+		return nil
+	}
+	auditHasher := hasher
+	if remote {
+		auditHasher = remoteFileHasher(ctx, host, maxHashStallTimeout)
+	}
+	result := audit.recheck(auditHasher)
+	result.record(opts.Stats)
+	fmt.Printf("\nHash audit: %d of %d sampled files matched on a second read", result.Matched, result.Sampled)
+	if result.Unreadable > 0 {
+		fmt.Printf(", %d could not be read again", result.Unreadable)
+	}
+	fmt.Println()
+	return result.err()
 }
 
-// ListProblematicFiles lists files that have been marked with TIMEOUT_ERROR
+// ListProblematicFiles lists files with recorded hashing failures for a host,
+// most recent first, with how often each failed and the last error message.
 func ListProblematicFiles(ctx context.Context, db *sql.DB, hostname string) error {
 	// Get host information
-	var rootPath string
+	var fileHostname string
 	err := db.QueryRow(`
-		SELECT root_path
+		SELECT hostname
 		FROM hosts
 		WHERE LOWER(name) = LOWER($1)
-	`, hostname).Scan(&rootPath)
+	`, hostname).Scan(&fileHostname)
 	if err != nil {
 		if err == sql.ErrNoRows {
 			return fmt.Errorf("host not found: %s", hostname)
@@ -419,38 +720,39 @@ func ListProblematicFiles(ctx context.Context, db *sql.DB, hostname string) erro
 
 	// Query for problematic files
 	query := `
-		SELECT id, dbPath, size, last_hashed_at
-		FROM files
-		WHERE LOWER(hostname) = LOWER($1) AND hash = 'TIMEOUT_ERROR'
-		ORDER BY last_hashed_at DESC
+		SELECT f.id, f.path, COALESCE(f.size, 0), fe.kind, fe.attempts, COALESCE(fe.message, ''), fe.occurred_at
+		FROM file_errors fe
+		JOIN files f ON f.id = fe.file_id
+		WHERE f.hostname = $1 AND ` + NotDeletedAs("f") + `
+		ORDER BY fe.occurred_at DESC
 	`
 
-	rows, err := db.QueryContext(ctx, query, hostname)
+	rows, err := db.QueryContext(ctx, query, normalizeHostname(fileHostname))
 	if err != nil {
 		return fmt.Errorf("error querying problematic files: %v", err)
 	}
 	defer rows.Close()
 
-	// Count the results
 	var count int
-	// fmt.Println("Files marked as problematic (TIMEOUT_ERROR):")
-	// fmt.Println("--------------------------------------------")
-	// fmt.Printf("%-10s %-20s %-15s %s\n", "ID", "Last Attempt", "Size", "Path")
-	// fmt.Println("--------------------------------------------")
-
 	for rows.Next() {
 		var id int
-		var dbPath string
+		var path, kind, message string
 		var size int64
-		var lastHashedAt time.Time
+		var attempts int
+		var occurredAt time.Time
 
-		err := rows.Scan(&id, &dbPath, &size, &lastHashedAt)
+		err := rows.Scan(&id, &path, &size, &kind, &attempts, &message, &occurredAt)
 		if err != nil {
 			return fmt.Errorf("error scanning row: %v", err)
 		}
 
-		// Format the size in a human-readable way
-		// sizeStr calculation removed as it's not used when output is suppressed
+		if count == 0 {
+			fmt.Printf("%-10s %-12s %-8s %-20s %-10s %s\n", "ID", "Kind", "Attempts", "Last Attempt", "Size", "Path")
+		}
+		fmt.Printf("%-10d %-12s %-8d %-20s %-10s %s\n", id, kind, attempts, occurredAt.Format("2006-01-02 15:04:05"), formatBytes(size), path)
+		if message != "" {
+			fmt.Printf("           %s\n", message)
+		}
 		count++
 	}
 
@@ -459,10 +761,11 @@ func ListProblematicFiles(ctx context.Context, db *sql.DB, hostname string) erro
 	}
 
 	if count == 0 {
-		// fmt.Println("No problematic files found.")
+		fmt.Println("No problematic files found.")
 	} else {
-		// fmt.Printf("\nFound %d problematic files.\n", count)
-		// fmt.Println("\nTo retry these files, use: dedupe hash --retry-problematic")
+		fmt.Printf("\nFound %d problematic files.\n", count)
+		fmt.Println("To retry these files, use: deduplicator files hash --retry-problematic")
+		fmt.Printf("Files of kind %s are only retried by: deduplicator files hash --force\n", FileErrorPermanent)
 	}
 
 	return nil
@@ -0,0 +1,114 @@
+package files
+
+import (
+	"fmt"
+	"math/rand"
+	"sort"
+	"strings"
+	"time"
+
+	"deduplicator/logging"
+)
+
+// DefaultHashAuditSample is how many files hashed during a run files hash
+// re-hashes at the end to check that a second read gives the same hash.
+const DefaultHashAuditSample = 5
+
+// hashAuditEntry is a file hashed during the run and the hash stored for it.
+type hashAuditEntry struct {
+	id   int
+	path string
+	hash string
+}
+
+// hashAudit keeps a uniform random sample of the files hashed during a run,
+// with reservoir sampling so memory stays bounded by the sample size however
+// many files are hashed.
+type hashAudit struct {
+	limit   int
+	seen    int
+	entries []hashAuditEntry
+	rng     *rand.Rand
+}
+
+func newHashAudit(limit int, rng *rand.Rand) *hashAudit {
+	if rng == nil {
+		rng = rand.New(rand.NewSource(time.Now().UnixNano()))
+	}
+	return &hashAudit{limit: limit, rng: rng}
+}
+
+// observe offers a freshly hashed file to the sample.
+func (a *hashAudit) observe(e hashAuditEntry) {
+	if a.limit <= 0 {
+		return
+	}
+	a.seen++
+	if len(a.entries) < a.limit {
+		a.entries = append(a.entries, e)
+		return
+	}
+	if i := a.rng.Intn(a.seen); i < a.limit {
+		a.entries[i] = e
+	}
+}
+
+// hashAuditMismatch is a sampled file whose second read hashed differently.
+type hashAuditMismatch struct {
+	ID     int
+	Path   string
+	Stored string
+	Reread string
+}
+
+// hashAuditResult is the outcome of recheck.
+type hashAuditResult struct {
+	Sampled    int
+	Matched    int
+	Unreadable int // files that could not be read again, e.g. removed since
+	Mismatches []hashAuditMismatch
+}
+
+// recheck hashes the sample again with hasher and compares each result with
+// the hash stored during the run.
+func (a *hashAudit) recheck(hasher func(path string) (string, error)) hashAuditResult {
+	result := hashAuditResult{Sampled: len(a.entries)}
+	sort.Slice(a.entries, func(i, j int) bool { return a.entries[i].id < a.entries[j].id })
+	for _, e := range a.entries {
+		hash, err := hasher(e.path)
+		if err != nil {
+			logging.InfoLogger.Printf("Warning: Could not re-hash audit sample %s: %v", e.path, err)
+			result.Unreadable++
+			continue
+		}
+		if hash != e.hash {
+			result.Mismatches = append(result.Mismatches, hashAuditMismatch{ID: e.id, Path: e.path, Stored: e.hash, Reread: hash})
+			continue
+		}
+		result.Matched++
+	}
+	return result
+}
+
+// record adds the audit counters to the run's summary.
+func (r hashAuditResult) record(stats *RunStats) {
+	stats.Set("audit_sampled", int64(r.Sampled))
+	stats.Set("audit_matched", int64(r.Matched))
+	stats.Set("audit_unreadable", int64(r.Unreadable))
+	stats.Set("audit_mismatched", int64(len(r.Mismatches)))
+}
+
+// err returns an error naming every mismatch, or nil when there is none.
+// A mismatch means the same bytes hashed differently on two reads, which
+// points at failing hardware or a hashing bug, so it fails the run.
+func (r hashAuditResult) err() error {
+	if len(r.Mismatches) == 0 {
+		return nil
+	}
+	lines := make([]string, len(r.Mismatches))
+	for i, m := range r.Mismatches {
+		lines[i] = fmt.Sprintf("  file %d %s: stored %s, re-read %s", m.ID, m.Path, m.Stored, m.Reread)
+	}
+	return fmt.Errorf("hash audit failed: %d of %d sampled files hashed differently on a second read; check the disk and memory of this host\n%s",
+		len(r.Mismatches), r.Sampled, strings.Join(lines, "\n"))
+}
@@ -0,0 +1,112 @@
+package files
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"math/rand"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"deduplicator/logging"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+func TestHashAuditReservoirIsBoundedAndUniform(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	picks := make(map[int]int)
+	const trials, files, sample = 2000, 10, 2
+	for trial := 0; trial < trials; trial++ {
+		a := newHashAudit(sample, rng)
+		for id := 1; id <= files; id++ {
+			a.observe(hashAuditEntry{id: id})
+			if len(a.entries) > sample {
+				t.Fatalf("reservoir grew to %d entries", len(a.entries))
+			}
+		}
+		if a.seen != files || len(a.entries) != sample {
+			t.Fatalf("seen %d, kept %d", a.seen, len(a.entries))
+		}
+		for _, e := range a.entries {
+			picks[e.id]++
+		}
+	}
+
+	// Each file should be picked about trials*sample/files = 400 times.
+	for id := 1; id <= files; id++ {
+		if picks[id] < 320 || picks[id] > 480 {
+			t.Fatalf("file %d picked %d times, want about 400: %v", id, picks[id], picks)
+		}
+	}
+
+	disabled := newHashAudit(0, rng)
+	disabled.observe(hashAuditEntry{id: 1})
+	if disabled.seen != 0 || len(disabled.entries) != 0 {
+		t.Fatalf("a zero sample should record nothing")
+	}
+}
+
+func TestHashFilesAuditMismatchFailsRun(t *testing.T) {
+	logging.InfoLogger = log.New(io.Discard, "", 0)
+	logging.ErrorLogger = log.New(io.Discard, "", 0)
+	db, mock, err := sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherRegexp))
+	if err != nil {
+		t.Fatalf("Failed to create mock database: %v", err)
+	}
+	defer db.Close()
+
+	root := t.TempDir()
+	mock.ExpectQuery(`SELECT COUNT\(\*\) FROM files`).
+		WithArgs("backup1.local").
+		WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(2))
+	updateRe := `(?s)UPDATE files\s+SET hash = \$1`
+	mock.ExpectPrepare(updateRe)
+	mock.ExpectPrepare(`INSERT INTO file_errors`)
+	mock.ExpectQuery(`SELECT id, path, root_folder`).
+		WithArgs("backup1.local", 0).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "path", "root_folder", "effective_size", "mod_time", "hashed"}).
+			AddRow(1, "steady.bin", root, int64(10), nil, false).
+			AddRow(2, "flaky.bin", root, int64(10), nil, false))
+	// The batch query holds the first connection, so the update is prepared
+	// again on a second one.
+	mock.ExpectPrepare(updateRe).ExpectExec().WithArgs("hash-steady.bin", 1, HashAlgoSHA256, sqlmock.AnyArg()).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(updateRe).WithArgs("hash-flaky.bin", 2, HashAlgoSHA256, sqlmock.AnyArg()).WillReturnResult(sqlmock.NewResult(0, 1))
+
+	// The hasher lies about flaky.bin on its second read.
+	reads := make(map[string]int)
+	hasher := func(path string) (string, error) {
+		reads[path]++
+		if filepath.Base(path) == "flaky.bin" && reads[path] == 2 {
+			return "corrupted", nil
+		}
+		return "hash-" + filepath.Base(path), nil
+	}
+
+	stats := &RunStats{}
+	out := captureStdout(t, func() {
+		err = HashFiles(context.Background(), db, HashOptions{
+			Host:        backup1Host(root, `{}`),
+			FullHash:    true,
+			AuditSample: 5,
+			Stats:       stats,
+			hasher:      hasher,
+		})
+	})
+	if err == nil || !strings.Contains(err.Error(), "hash audit failed: 1 of 2 sampled files") ||
+		!strings.Contains(err.Error(), fmt.Sprintf("file 2 %s: stored hash-flaky.bin, re-read corrupted", filepath.Join(root, "flaky.bin"))) {
+		t.Fatalf("expected the audit mismatch to fail the run, got %v", err)
+	}
+	if !strings.Contains(out, "Hash audit: 1 of 2 sampled files matched") {
+		t.Fatalf("expected the audit result printed:\n%s", out)
+	}
+	counters := stats.Counters()
+	if counters["processed"] != 2 || counters["audit_sampled"] != 2 || counters["audit_matched"] != 1 || counters["audit_mismatched"] != 1 {
+		t.Fatalf("unexpected run counters: %v", counters)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatalf("unmet expectations: %v", err)
+	}
+}
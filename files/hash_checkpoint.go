@@ -0,0 +1,79 @@
+package files
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// hashBookmark is the keyset position of the last file a hash run did.
+// size and priority only matter in the --large-first and --path orders.
+type hashBookmark struct {
+	id       int
+	size     sql.NullInt64
+	priority sql.NullInt64
+}
+
+// hashCheckpointKey names the option set a hash_checkpoints row belongs to.
+// Runs that select or order files differently keep separate checkpoints;
+// --count and --audit-sample do not change the selection and are left out.
+func hashCheckpointKey(opts HashOptions) string {
+	key := fmt.Sprintf("force=%t renew=%t retry-problematic=%t full-hash=%t large-first=%t prescreen=%t algo=%s paths=%s",
+		opts.Refresh, opts.Renew, opts.RetryProblematic, opts.FullHash, opts.LargeFirst, opts.Prescreen,
+		opts.Algo, strings.Join(opts.Paths, ","))
+	// Keys saved before --only-path, the size limits and --order newest
+	// existed stay valid for runs without them.
+	if opts.OnlyPath != "" {
+		key += " only-path=" + opts.OnlyPath
+	}
+	if opts.NewestFirst {
+		key += " newest-first=true"
+	}
+	if opts.MinSize > 0 || opts.MaxSize > 0 {
+		key += fmt.Sprintf(" min-size=%d max-size=%d", opts.MinSize, opts.MaxSize)
+	}
+	return key
+}
+
+// loadHashCheckpoint returns the bookmark saved for hostname and key, if any,
+// and when it was saved.
+func loadHashCheckpoint(ctx context.Context, sqldb *sql.DB, hostname, key string) (hashBookmark, time.Time, bool, error) {
+	var b hashBookmark
+	var updatedAt time.Time
+	err := sqldb.QueryRowContext(ctx, `
+		SELECT cursor_id, cursor_size, cursor_priority, updated_at
+		FROM hash_checkpoints
+		WHERE hostname = $1 AND options = $2
+	`, hostname, key).Scan(&b.id, &b.size, &b.priority, &updatedAt)
+	if err == sql.ErrNoRows {
+		return hashBookmark{}, time.Time{}, false, nil
+	}
+	if err != nil {
+		return hashBookmark{}, time.Time{}, false, fmt.Errorf("error loading hash checkpoint: %v", err)
+	}
+	return b, updatedAt, true, nil
+}
+
+func saveHashCheckpoint(ctx context.Context, sqldb *sql.DB, hostname, key string, b hashBookmark) error {
+	_, err := sqldb.ExecContext(ctx, `
+		INSERT INTO hash_checkpoints (hostname, options, cursor_id, cursor_size, cursor_priority, updated_at)
+		VALUES ($1, $2, $3, $4, $5, NOW())
+		ON CONFLICT (hostname, options) DO UPDATE SET
+			cursor_id = EXCLUDED.cursor_id, cursor_size = EXCLUDED.cursor_size,
+			cursor_priority = EXCLUDED.cursor_priority, updated_at = EXCLUDED.updated_at
+	`, hostname, key, b.id, b.size, b.priority)
+	if err != nil {
+		return fmt.Errorf("error saving hash checkpoint: %v", err)
+	}
+	return nil
+}
+
+// clearHashCheckpoint forgets the checkpoint of a run that finished.
+func clearHashCheckpoint(ctx context.Context, sqldb *sql.DB, hostname, key string) error {
+	if _, err := sqldb.ExecContext(ctx, `DELETE FROM hash_checkpoints WHERE hostname = $1 AND options = $2`, hostname, key); err != nil {
+		return fmt.Errorf("error clearing hash checkpoint: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,122 @@
+package files
+
+import (
+	"context"
+	"io"
+	"log"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"deduplicator/logging"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+func TestHashCheckpointKeySeparatesOptionSets(t *testing.T) {
+	base := HashOptions{FullHash: true, Algo: HashAlgoSHA256}
+	withCount := base
+	withCount.Count = 500
+	withCount.AuditSample = 20
+	if hashCheckpointKey(base) != hashCheckpointKey(withCount) {
+		t.Fatal("--count and --audit-sample should not change the checkpoint")
+	}
+	largeFirst := base
+	largeFirst.LargeFirst = true
+	if hashCheckpointKey(base) == hashCheckpointKey(largeFirst) {
+		t.Fatal("a different order should keep its own checkpoint")
+	}
+}
+
+// expectCheckpointedRun expects a run resuming after file 150 that hashes
+// file 151.
+func expectCheckpointedRun(mock sqlmock.Sqlmock, root string) {
+	mock.ExpectQuery(`SELECT COUNT\(\*\) FROM files`).
+		WithArgs("backup1.local").
+		WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(1))
+	mock.ExpectPrepare(`(?s)UPDATE files\s+SET hash = \$1`)
+	mock.ExpectPrepare(`INSERT INTO file_errors`)
+	mock.ExpectQuery(`SELECT cursor_id, cursor_size, cursor_priority, updated_at\s+FROM hash_checkpoints`).
+		WithArgs("backup1.local", hashCheckpointKey(HashOptions{FullHash: true, Algo: HashAlgoSHA256})).
+		WillReturnRows(sqlmock.NewRows([]string{"cursor_id", "cursor_size", "cursor_priority", "updated_at"}).
+			AddRow(150, nil, nil, time.Date(2026, 10, 14, 2, 30, 0, 0, time.UTC)))
+	mock.ExpectQuery(`SELECT id, path, root_folder`).
+		WithArgs("backup1.local", 150).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "path", "root_folder", "effective_size", "mod_time", "hashed"}).
+			AddRow(151, "next.bin", root, int64(10), nil, false))
+	mock.ExpectPrepare(`(?s)UPDATE files\s+SET hash = \$1`).ExpectExec().
+		WithArgs("hash-next.bin", 151, HashAlgoSHA256, sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(`INSERT INTO hash_checkpoints`).
+		WithArgs("backup1.local", sqlmock.AnyArg(), 151, int64(10), nil).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+}
+
+func TestHashFilesResumesAndClearsCheckpoint(t *testing.T) {
+	logging.InfoLogger = log.New(io.Discard, "", 0)
+	db, mock, err := sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherRegexp))
+	if err != nil {
+		t.Fatalf("Failed to create mock database: %v", err)
+	}
+	defer db.Close()
+
+	root := t.TempDir()
+	expectCheckpointedRun(mock, root)
+	mock.ExpectExec(`DELETE FROM hash_checkpoints WHERE hostname = \$1 AND options = \$2`).
+		WithArgs("backup1.local", sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+
+	out := captureStdout(t, func() {
+		err = HashFiles(context.Background(), db, HashOptions{
+			Host:       backup1Host(root, `{}`),
+			FullHash:   true,
+			Checkpoint: true,
+			Resume:     true,
+			hasher: func(path string) (string, error) {
+				return "hash-" + filepath.Base(path), nil
+			},
+		})
+	})
+	if err != nil {
+		t.Fatalf("HashFiles: %v", err)
+	}
+	if !strings.Contains(out, "Resuming the run interrupted at 2026-10-14 02:30:00 (after file id 150)") {
+		t.Fatalf("expected the resume notice:\n%s", out)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatalf("unmet expectations: %v", err)
+	}
+}
+
+func TestHashFilesKeepsCheckpointWhenCountStopsRun(t *testing.T) {
+	logging.InfoLogger = log.New(io.Discard, "", 0)
+	db, mock, err := sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherRegexp))
+	if err != nil {
+		t.Fatalf("Failed to create mock database: %v", err)
+	}
+	defer db.Close()
+
+	root := t.TempDir()
+	// No DELETE is expected: the next run continues after file 151.
+	expectCheckpointedRun(mock, root)
+
+	captureStdout(t, func() {
+		err = HashFiles(context.Background(), db, HashOptions{
+			Host:       backup1Host(root, `{}`),
+			FullHash:   true,
+			Count:      1,
+			Checkpoint: true,
+			Resume:     true,
+			hasher: func(path string) (string, error) {
+				return "hash-" + filepath.Base(path), nil
+			},
+		})
+	})
+	if err != nil {
+		t.Fatalf("HashFiles: %v", err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatalf("unmet expectations: %v", err)
+	}
+}
@@ -0,0 +1,106 @@
+package files
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"path/filepath"
+	"time"
+
+	"deduplicator/db"
+)
+
+// DefaultHashStatsSlowest is how many files files stats lists without
+// --slowest.
+const DefaultHashStatsSlowest = 20
+
+// hashThroughput formats bytes hashed in ms milliseconds as MB/s, or "-"
+// when the time is too short to measure.
+func hashThroughput(bytes, ms int64) string {
+	if ms <= 0 {
+		return "-"
+	}
+	return fmt.Sprintf("%.1f", float64(bytes)/1e6/(float64(ms)/1000))
+}
+
+// ListHashStats prints the files of a host that took longest to hash and the
+// hash throughput of each root folder, slowest first, from the
+// hash_duration_ms recorded by the last hash of each file. Root folders far
+// slower than the others usually sit on a failing disk.
+func ListHashStats(ctx context.Context, database *sql.DB, opts HashStatsOptions) error {
+	if opts.Slowest <= 0 {
+		return fmt.Errorf("--slowest must be greater than 0")
+	}
+	host, err := db.GetHost(database, opts.Server)
+	if err != nil {
+		return fmt.Errorf("server not found: %s", opts.Server)
+	}
+	hostname := normalizeHostname(host.Hostname)
+	names, err := NewPathNames(host)
+	if err != nil {
+		return err
+	}
+	where := `WHERE hostname = $1 AND ` + NotDeleted + ` AND hash_duration_ms IS NOT NULL`
+
+	rows, err := database.QueryContext(ctx, `
+		SELECT path, COALESCE(root_folder, ''), COALESCE(size, 0), hash_duration_ms
+		FROM files `+where+`
+		ORDER BY hash_duration_ms DESC, id
+		LIMIT $2
+	`, hostname, opts.Slowest)
+	if err != nil {
+		return fmt.Errorf("error listing slowest hashed files: %v", err)
+	}
+	defer rows.Close()
+
+	fmt.Printf("Slowest hashed files for host '%s':\n\n", host.Name)
+	fmt.Printf("%12s %16s %10s  %s\n", "Duration", "Size", "MB/s", "Path")
+	listed := 0
+	for rows.Next() {
+		var path, root string
+		var size, ms int64
+		if err := rows.Scan(&path, &root, &size, &ms); err != nil {
+			return fmt.Errorf("error scanning hashed file: %v", err)
+		}
+		listed++
+		duration := (time.Duration(ms) * time.Millisecond).String()
+		fmt.Printf("%12s %16s %10s  %s (%s)\n", duration, formatBytes(size), hashThroughput(size, ms),
+			names.Display(root, path), filepath.Join(root, path))
+	}
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("error reading hashed files: %v", err)
+	}
+	if listed == 0 {
+		fmt.Println("No hash durations recorded yet; run files hash to record them")
+		return nil
+	}
+
+	rows, err = database.QueryContext(ctx, `
+		SELECT COALESCE(root_folder, ''), COUNT(*), COALESCE(SUM(size), 0), SUM(hash_duration_ms)
+		FROM files `+where+`
+		GROUP BY COALESCE(root_folder, '')
+		ORDER BY COALESCE(SUM(size), 0)::float8 / NULLIF(SUM(hash_duration_ms), 0) ASC NULLS LAST, COALESCE(root_folder, '')
+	`, hostname)
+	if err != nil {
+		return fmt.Errorf("error summing hash durations: %v", err)
+	}
+	defer rows.Close()
+
+	fmt.Printf("\n%-30s %12s %16s %10s\n", "Friendly path", "Files", "Size", "MB/s")
+	for rows.Next() {
+		var root string
+		var files, bytes, ms int64
+		if err := rows.Scan(&root, &files, &bytes, &ms); err != nil {
+			return fmt.Errorf("error scanning hash durations: %v", err)
+		}
+		label := "(no root folder)"
+		if root != "" {
+			label = names.Display(root, "")
+		}
+		fmt.Printf("%-30s %12d %16s %10s\n", label, files, formatBytes(bytes), hashThroughput(bytes, ms))
+	}
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("error reading hash durations: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,84 @@
+package files
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+func TestHashThroughput(t *testing.T) {
+	if got := hashThroughput(500_000_000, 2000); got != "250.0" {
+		t.Fatalf("expected 250.0 MB/s, got %s", got)
+	}
+	if got := hashThroughput(10, 0); got != "-" {
+		t.Fatalf("expected an unmeasurable time to print -, got %s", got)
+	}
+}
+
+func TestListHashStatsSlowestFilesAndPaths(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("sqlmock: %v", err)
+	}
+	defer db.Close()
+
+	expectUnhashedHost(mock)
+	mock.ExpectQuery("SELECT path, COALESCE\\(root_folder, ''\\), COALESCE\\(size, 0\\), hash_duration_ms\\s+FROM files WHERE hostname = \\$1 AND deleted_at IS NULL AND hash_duration_ms IS NOT NULL\\s+ORDER BY hash_duration_ms DESC, id\\s+LIMIT \\$2").
+		WithArgs("backup1.local", 2).
+		WillReturnRows(sqlmock.NewRows([]string{"path", "root_folder", "size", "hash_duration_ms"}).
+			AddRow("disk.img", "/data/photos", int64(100_000_000), int64(20_000)).
+			AddRow("tiny.txt", "", int64(3), int64(0)))
+	mock.ExpectQuery("SELECT COALESCE\\(root_folder, ''\\), COUNT\\(\\*\\), COALESCE\\(SUM\\(size\\), 0\\), SUM\\(hash_duration_ms\\)\\s+FROM files WHERE hostname = \\$1 AND deleted_at IS NULL AND hash_duration_ms IS NOT NULL\\s+GROUP BY COALESCE\\(root_folder, ''\\)\\s+ORDER BY .* ASC NULLS LAST").
+		WithArgs("backup1.local").
+		WillReturnRows(sqlmock.NewRows([]string{"root_folder", "count", "sum", "ms"}).
+			AddRow("/data/photos", int64(4), int64(200_000_000), int64(40_000)).
+			AddRow("", int64(1), int64(3), int64(0)))
+
+	out := captureStdout(t, func() {
+		err = ListHashStats(context.Background(), db, HashStatsOptions{Server: "Backup1", Slowest: 2})
+	})
+	if err != nil {
+		t.Fatalf("ListHashStats: %v", err)
+	}
+	for _, want := range []string{
+		"Slowest hashed files for host 'Backup1':",
+		"20s      100,000,000        5.0  photos/disk.img (/data/photos/disk.img)",
+		"photos                                    4      200,000,000        5.0",
+		"(no root folder)                          1                3          -",
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("output does not contain %q:\n%s", want, out)
+		}
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatalf("unmet expectations: %v", err)
+	}
+}
+
+func TestListHashStatsWithoutDurations(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("sqlmock: %v", err)
+	}
+	defer db.Close()
+
+	expectUnhashedHost(mock)
+	mock.ExpectQuery("SELECT path, COALESCE\\(root_folder, ''\\), COALESCE\\(size, 0\\), hash_duration_ms").
+		WithArgs("backup1.local", DefaultHashStatsSlowest).
+		WillReturnRows(sqlmock.NewRows([]string{"path", "root_folder", "size", "hash_duration_ms"}))
+
+	out := captureStdout(t, func() {
+		err = ListHashStats(context.Background(), db, HashStatsOptions{Server: "Backup1", Slowest: DefaultHashStatsSlowest})
+	})
+	if err != nil {
+		t.Fatalf("ListHashStats: %v", err)
+	}
+	if !strings.Contains(out, "No hash durations recorded yet") {
+		t.Fatalf("expected the empty notice:\n%s", out)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatalf("unmet expectations: %v", err)
+	}
+}
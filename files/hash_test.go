@@ -20,8 +20,14 @@ import (
 	"deduplicator/logging"
 
 	"github.com/DATA-DOG/go-sqlmock"
+	"lukechampine.com/blake3"
 )
 
+// backup1Host is the resolved host the HashFiles tests hash for.
+func backup1Host(root, settings string) *dedupdb.Host {
+	return &dedupdb.Host{ID: 1, Name: "Backup1", Hostname: "backup1.local", RootPath: root, Settings: json.RawMessage(settings)}
+}
+
 func TestHashOptions(t *testing.T) {
 	// Test that HashOptions are correctly applied to the SQL query
 	tests := []struct {
@@ -34,110 +40,100 @@ func TestHashOptions(t *testing.T) {
 		{
 			name: "Hash only files without hashes and duplicate sizes",
 			options: HashOptions{
-				Server:           "testhost",
 				Refresh:          false,
 				Renew:            false,
 				RetryProblematic: false,
 			},
-			expectedCountRe: `(?s)SELECT COUNT\(\*\) FROM files.*WHERE LOWER\(hostname\) = LOWER\(\$1\).*AND hash IS NULL.*AND size IS NOT NULL.*HAVING COUNT\(\*\) > 1`,
+			expectedCountRe: `(?s)SELECT COUNT\(\*\) FROM files.*WHERE hostname = \$1.*AND hash IS NULL.*AND size IS NOT NULL.*HAVING COUNT\(\*\) > 1`,
 			expectedParam:   "testhost",
 		},
 		{
 			name: "Refresh duplicate-size files",
 			options: HashOptions{
-				Server:           "testhost",
 				Refresh:          true,
 				Renew:            false,
 				RetryProblematic: false,
 			},
-			expectedCountRe: `(?s)SELECT COUNT\(\*\) FROM files.*WHERE LOWER\(hostname\) = LOWER\(\$1\).*AND size IS NOT NULL.*HAVING COUNT\(\*\) > 1`,
+			expectedCountRe: `(?s)SELECT COUNT\(\*\) FROM files.*WHERE hostname = \$1.*AND size IS NOT NULL.*HAVING COUNT\(\*\) > 1`,
 			expectedParam:   "testhost",
 		},
 		{
 			name: "Full hash scans all unhashed files",
 			options: HashOptions{
-				Server:           "testhost",
 				Refresh:          false,
 				Renew:            false,
 				RetryProblematic: false,
 				FullHash:         true,
 			},
-			expectedCountRe: `(?s)SELECT COUNT\(\*\) FROM files.*WHERE LOWER\(hostname\) = LOWER\(\$1\) AND hash IS NULL\s*$`,
+			expectedCountRe: `(?s)SELECT COUNT\(\*\) FROM files.*WHERE hostname = \$1 AND deleted_at IS NULL AND hash IS NULL AND NOT EXISTS \(SELECT 1 FROM file_errors fe WHERE fe.file_id = files.id\)\s*$`,
 			expectedParam:   "testhost",
 		},
 		{
 			name: "Full hash with refresh scans all files",
 			options: HashOptions{
-				Server:           "testhost",
 				Refresh:          true,
 				Renew:            false,
 				RetryProblematic: false,
 				FullHash:         true,
 			},
-			expectedCountRe: `(?s)SELECT COUNT\(\*\) FROM files.*WHERE LOWER\(hostname\) = LOWER\(\$1\)\s*$`,
+			expectedCountRe: `(?s)SELECT COUNT\(\*\) FROM files.*WHERE hostname = \$1 AND deleted_at IS NULL\s*$`,
 			expectedParam:   "testhost",
 		},
 		{
 			name: "Renew old hashes",
 			options: HashOptions{
-				Server:           "testhost",
 				Refresh:          false,
 				Renew:            true,
 				RetryProblematic: false,
 			},
-			expectedCountRe: `(?s)SELECT COUNT\(\*\) FROM files.*WHERE LOWER\(hostname\) = LOWER\(\$1\).*AND \(hash IS NULL OR last_hashed_at < NOW\(\) - INTERVAL '1 week'\).*AND size IS NOT NULL.*HAVING COUNT\(\*\) > 1`,
+			expectedCountRe: `(?s)SELECT COUNT\(\*\) FROM files.*WHERE hostname = \$1.*AND \(\(hash IS NULL AND NOT EXISTS \(SELECT 1 FROM file_errors fe WHERE fe.file_id = files.id\)\) OR last_hashed_at < NOW\(\) - INTERVAL '1 week'\).*AND size IS NOT NULL.*HAVING COUNT\(\*\) > 1`,
 			expectedParam:   "testhost",
 		},
 		{
 			name: "Retry problematic files",
 			options: HashOptions{
-				Server:           "testhost",
 				Refresh:          false,
 				Renew:            false,
 				RetryProblematic: true,
 			},
-			expectedCountRe: `(?s)SELECT COUNT\(\*\) FROM files.*WHERE LOWER\(hostname\) = LOWER\(\$1\).*AND \(hash IS NULL OR hash IN \('TIMEOUT_ERROR', 'HASH_ERROR'\)\).*AND size IS NOT NULL.*HAVING COUNT\(\*\) > 1`,
+			expectedCountRe: `(?s)SELECT COUNT\(\*\) FROM files.*WHERE hostname = \$1.*AND hash IS NULL AND NOT EXISTS \(SELECT 1 FROM file_errors fe WHERE fe.file_id = files.id AND fe.kind = 'permanent'\)\s+AND size IS NOT NULL.*HAVING COUNT\(\*\) > 1`,
 			expectedParam:   "testhost",
 		},
 		{
 			name: "Retry problematic and renew old hashes",
 			options: HashOptions{
-				Server:           "testhost",
 				Refresh:          false,
 				Renew:            true,
 				RetryProblematic: true,
 			},
-			expectedCountRe: `(?s)SELECT COUNT\(\*\) FROM files.*WHERE LOWER\(hostname\) = LOWER\(\$1\).*AND \(hash IS NULL OR hash IN \('TIMEOUT_ERROR', 'HASH_ERROR'\) OR last_hashed_at < NOW\(\) - INTERVAL '1 week'\).*AND size IS NOT NULL.*HAVING COUNT\(\*\) > 1`,
+			expectedCountRe: `(?s)SELECT COUNT\(\*\) FROM files.*WHERE hostname = \$1.*AND \(\(hash IS NULL AND NOT EXISTS \(SELECT 1 FROM file_errors fe WHERE fe.file_id = files.id AND fe.kind = 'permanent'\)\) OR last_hashed_at < NOW\(\) - INTERVAL '1 week'\).*AND size IS NOT NULL.*HAVING COUNT\(\*\) > 1`,
 			expectedParam:   "testhost",
 		},
 		{
 			name: "Full hash large first scans all unhashed files",
 			options: HashOptions{
-				Server:     "testhost",
 				FullHash:   true,
 				LargeFirst: true,
 			},
-			expectedCountRe: `(?s)SELECT COUNT\(\*\) FROM files.*WHERE LOWER\(hostname\) = LOWER\(\$1\) AND hash IS NULL\s*$`,
+			expectedCountRe: `(?s)SELECT COUNT\(\*\) FROM files.*WHERE hostname = \$1 AND deleted_at IS NULL AND hash IS NULL AND NOT EXISTS \(SELECT 1 FROM file_errors fe WHERE fe.file_id = files.id\)\s*$`,
 			expectedParam:   "testhost",
 		},
 		{
 			name: "Full hash force large first scans all files",
 			options: HashOptions{
-				Server:     "testhost",
 				Refresh:    true,
 				FullHash:   true,
 				LargeFirst: true,
 			},
-			expectedCountRe: `(?s)SELECT COUNT\(\*\) FROM files.*WHERE LOWER\(hostname\) = LOWER\(\$1\)\s*$`,
+			expectedCountRe: `(?s)SELECT COUNT\(\*\) FROM files.*WHERE hostname = \$1 AND deleted_at IS NULL\s*$`,
 			expectedParam:   "testhost",
 		},
 		{
 			name: "Path priority preserves default duplicate-size eligibility",
 			options: HashOptions{
-				Server: "testhost",
-				Paths:  []string{"photos"},
+				Paths: []string{"photos"},
 			},
-			expectedCountRe: `(?s)SELECT COUNT\(\*\) FROM files.*WHERE LOWER\(hostname\) = LOWER\(\$1\).*AND hash IS NULL.*AND size IS NOT NULL.*HAVING COUNT\(\*\) > 1`,
+			expectedCountRe: `(?s)SELECT COUNT\(\*\) FROM files.*WHERE hostname = \$1.*AND hash IS NULL.*AND size IS NOT NULL.*HAVING COUNT\(\*\) > 1`,
 			expectedParam:   "testhost",
 			hostSettings:    []byte(`{"paths":{"photos":"/data/photos"}}`),
 		},
@@ -156,18 +152,15 @@ func TestHashOptions(t *testing.T) {
 			if hostSettings == nil {
 				hostSettings = []byte(`{}`)
 			}
-			hostRows := sqlmock.NewRows([]string{"id", "name", "hostname", "ip", "root_path", "settings", "created_at"}).
-				AddRow(1, "testhost", "testhost", "", "/test/path", hostSettings, time.Now())
-			mock.ExpectQuery(`SELECT id, name, hostname, ip, root_path, settings, created_at FROM hosts WHERE LOWER\(hostname\) = LOWER\(\$1\)`).
-				WithArgs(tc.options.Server).
-				WillReturnRows(hostRows)
+			opts := tc.options
+			opts.Host = &dedupdb.Host{ID: 1, Name: "testhost", Hostname: "testhost", RootPath: "/test/path", Settings: hostSettings}
 
 			countRows := sqlmock.NewRows([]string{"count"}).AddRow(0)
 			mock.ExpectQuery(tc.expectedCountRe).
 				WithArgs(tc.expectedParam).
 				WillReturnRows(countRows)
 
-			err = HashFiles(context.Background(), db, tc.options)
+			err = HashFiles(context.Background(), db, opts)
 			if err != nil {
 				t.Errorf("HashFiles returned error: %v", err)
 			}
@@ -180,26 +173,16 @@ func TestHashOptions(t *testing.T) {
 	}
 }
 
-func TestHashFilesHostNotFound(t *testing.T) {
+func TestHashFilesRequiresResolvedHost(t *testing.T) {
 	db, mock, err := sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherRegexp))
 	if err != nil {
 		t.Fatalf("Failed to create mock database: %v", err)
 	}
 	defer db.Close()
 
-	mock.ExpectQuery(`SELECT id, name, hostname, ip, root_path, settings, created_at FROM hosts WHERE LOWER\(hostname\) = LOWER\(\$1\)`).
-		WithArgs("nonexistent").
-		WillReturnError(sql.ErrNoRows)
-	mock.ExpectQuery(`SELECT id, name, hostname, ip, root_path, settings, created_at FROM hosts WHERE name = \$1`).
-		WithArgs("nonexistent").
-		WillReturnError(sql.ErrNoRows)
-
-	err = HashFiles(context.Background(), db, HashOptions{Server: "nonexistent"})
-
-	if err == nil {
-		t.Error("Expected error for non-existent host, got nil")
-	} else if err.Error() != "server not found: nonexistent" {
-		t.Errorf("Expected 'server not found' error, got: %v", err)
+	// The host is resolved by the caller; HashFiles does not look it up again.
+	if err := HashFiles(context.Background(), db, HashOptions{}); err == nil {
+		t.Error("Expected error without a host, got nil")
 	}
 
 	if err := mock.ExpectationsWereMet(); err != nil {
@@ -212,7 +195,6 @@ func TestHashFilesBatchQueryDoesNotBreakWithLocalEnvironmentLimit(t *testing.T)
 	// The goal is to prevent future regressions where LIMIT/ORDER get composed in
 	// an invalid order.
 	whereClause := buildHashWhereClause(HashOptions{
-		Server:           "testhost",
 		Refresh:          false,
 		Renew:            false,
 		RetryProblematic: false,
@@ -237,6 +219,18 @@ func TestHashFilesBatchQueryDoesNotBreakWithLocalEnvironmentLimit(t *testing.T)
 	}
 }
 
+func TestHashForceWithAlgoAlsoSelectsRowsOfOtherAlgorithms(t *testing.T) {
+	whereClause := buildHashWhereClause(HashOptions{Refresh: true, Algo: HashAlgoBLAKE3})
+	if !strings.Contains(whereClause, "OR (hash IS NOT NULL AND hash_algo <> 'blake3'))") {
+		t.Fatalf("expected rows hashed with another algorithm to be selected; got: %s", whereClause)
+	}
+
+	whereClause = buildHashWhereClause(HashOptions{Algo: HashAlgoBLAKE3})
+	if strings.Contains(whereClause, "hash_algo") {
+		t.Fatalf("only a forced run should re-hash rows of other algorithms; got: %s", whereClause)
+	}
+}
+
 func TestHashFilesLargeFirstBatchQueryUsesSizeBookmark(t *testing.T) {
 	whereClause := buildHashWhereClause(HashOptions{LargeFirst: true})
 
@@ -258,6 +252,75 @@ func TestHashFilesLargeFirstBatchQueryUsesSizeBookmark(t *testing.T) {
 	}
 }
 
+func TestHashFilesNewestFirstBatchQueryWalksIDsDownwards(t *testing.T) {
+	whereClause := buildHashWhereClause(HashOptions{NewestFirst: true})
+
+	batch := buildHashBatchQuery(whereClause, 100, hashBatchQueryOptions{NewestFirst: true})
+	if !strings.Contains(batch, "AND ($2::int = 0 OR id < $2::int)") || !strings.Contains(batch, "ORDER BY id DESC") {
+		t.Fatalf("expected newest-first query to walk ids downwards; got: %s", batch)
+	}
+
+	batch = buildHashBatchQuery(whereClause, 100, hashBatchQueryOptions{NewestFirst: true, PrioritizePaths: true})
+	if !strings.Contains(batch, "= $3::int AND id < $4)") || !strings.Contains(batch, "ORDER BY path_priority ASC, id DESC") {
+		t.Fatalf("expected prioritized newest-first query to walk ids downwards per path; got: %s", batch)
+	}
+}
+
+func TestHashFilesNewestFirstHashesHighestIDsFirst(t *testing.T) {
+	db, mock, err := sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherRegexp))
+	if err != nil {
+		t.Fatalf("Failed to create mock database: %v", err)
+	}
+	defer db.Close()
+	mock.MatchExpectationsInOrder(false)
+
+	root := t.TempDir()
+	mock.ExpectQuery(`SELECT COUNT\(\*\) FROM files`).
+		WithArgs("backup1.local").
+		WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(2))
+	updateRe := `(?s)UPDATE files\s+SET hash = \$1`
+	mock.ExpectPrepare(updateRe)
+	mock.ExpectPrepare(`INSERT INTO file_errors`)
+	mock.ExpectQuery(`(?s)SELECT id, path, root_folder.*ORDER BY id DESC`).
+		WithArgs("backup1.local", 0).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "path", "root_folder", "effective_size", "mod_time", "hashed"}).
+			AddRow(9, "new.bin", root, int64(5), nil, false).
+			AddRow(4, "old.bin", root, int64(5), nil, false))
+	mock.ExpectPrepare(updateRe).ExpectExec().
+		WithArgs("hash-new.bin", 9, HashAlgoSHA256, sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(updateRe).
+		WithArgs("hash-old.bin", 4, HashAlgoSHA256, sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+
+	var hashed []string
+	captureStdout(t, func() {
+		err = HashFiles(context.Background(), db, HashOptions{
+			Host:        backup1Host(root, `{}`),
+			FullHash:    true,
+			NewestFirst: true,
+			hasher: func(path string) (string, error) {
+				hashed = append(hashed, filepath.Base(path))
+				return "hash-" + filepath.Base(path), nil
+			},
+		})
+	})
+	if err != nil {
+		t.Fatalf("HashFiles: %v", err)
+	}
+	if strings.Join(hashed, ",") != "new.bin,old.bin" {
+		t.Fatalf("expected the newest file first, hashed %v", hashed)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatalf("unmet expectations: %v", err)
+	}
+
+	err = HashFiles(context.Background(), db, HashOptions{Host: backup1Host(root, `{}`), LargeFirst: true, NewestFirst: true})
+	if err == nil {
+		t.Fatal("expected largest-first and newest-first to be rejected together")
+	}
+}
+
 func TestHashFilesPathPriorityBatchQueryUsesPriorityBookmark(t *testing.T) {
 	whereClause := buildHashWhereClause(HashOptions{})
 
@@ -328,6 +391,78 @@ func TestResolveHashPriorityRootFoldersRejectsUnknownFriendlyPath(t *testing.T)
 	}
 }
 
+func TestHashFilesOnlyPathRestrictsToItsRootFolder(t *testing.T) {
+	db, mock, err := sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherRegexp))
+	if err != nil {
+		t.Fatalf("Failed to create mock database: %v", err)
+	}
+	defer db.Close()
+
+	host := backup1Host("/data", `{"paths":{"photos":"/data/photos","it's":"/data/it's"}}`)
+	mock.ExpectQuery(`SELECT COUNT\(\*\) FROM files\s+WHERE hostname = \$1 AND deleted_at IS NULL\s+AND root_folder = '/data/it''s'`).
+		WithArgs("backup1.local").
+		WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(0))
+
+	if err := HashFiles(context.Background(), db, HashOptions{Host: host, FullHash: true, OnlyPath: "it's"}); err != nil {
+		t.Fatalf("HashFiles: %v", err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatalf("unmet expectations: %v", err)
+	}
+
+	err = HashFiles(context.Background(), db, HashOptions{Host: host, OnlyPath: "music"})
+	if err == nil || err.Error() != "friendly path 'music' not found for server 'Backup1'" {
+		t.Fatalf("expected unknown friendly path error, got %v", err)
+	}
+}
+
+func TestHashSizeLimitsComposeWithRenewAndRetry(t *testing.T) {
+	whereClause := buildHashWhereClause(HashOptions{Renew: true, RetryProblematic: true, MinSize: 1024, MaxSize: 50 << 30})
+	for _, want := range []string{
+		"COALESCE(size, 0) >= 1024 AND COALESCE(size, 0) <= 53687091200",
+		"fe.kind = 'permanent')) OR last_hashed_at < NOW() - INTERVAL '1 week'",
+	} {
+		if !strings.Contains(whereClause, want) {
+			t.Fatalf("expected %q in the where clause; got: %s", want, whereClause)
+		}
+	}
+	if strings.Contains(buildHashWhereClause(HashOptions{}), "COALESCE(size, 0)") {
+		t.Fatal("no size limit should be applied by default")
+	}
+}
+
+func TestHashFilesReportsFilesExcludedBySizeLimits(t *testing.T) {
+	db, mock, err := sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherRegexp))
+	if err != nil {
+		t.Fatalf("Failed to create mock database: %v", err)
+	}
+	defer db.Close()
+
+	mock.ExpectQuery(`(?s)SELECT COUNT\(\*\) FROM files.*hash IS NULL.*AND NOT \(COALESCE\(size, 0\) <= 1000\)`).
+		WithArgs("backup1.local").
+		WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(3))
+	mock.ExpectQuery(`(?s)SELECT COUNT\(\*\) FROM files.*AND COALESCE\(size, 0\) <= 1000 AND hash IS NULL`).
+		WithArgs("backup1.local").
+		WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(0))
+
+	stats := &RunStats{}
+	out := captureStdout(t, func() {
+		err = HashFiles(context.Background(), db, HashOptions{Host: backup1Host("/data", `{}`), FullHash: true, MaxSize: 1000, Stats: stats})
+	})
+	if err != nil {
+		t.Fatalf("HashFiles: %v", err)
+	}
+	if !strings.Contains(out, "Excluded 3 files outside the size limits (--min-size/--max-size)") {
+		t.Fatalf("expected the excluded count:\n%s", out)
+	}
+	if got := stats.Counters()["size_excluded"]; got != 3 {
+		t.Fatalf("expected size_excluded 3 in the run stats, got %d", got)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatalf("unmet expectations: %v", err)
+	}
+}
+
 func TestHashFilesProcessesFullHashLargeFirstCombination(t *testing.T) {
 	var logBuffer bytes.Buffer
 	logging.InfoLogger = log.New(&logBuffer, "", 0)
@@ -356,38 +491,31 @@ func TestHashFilesProcessesFullHashLargeFirstCombination(t *testing.T) {
 	secondExpected := sha256.Sum256(secondContent)
 	secondExpectedHash := hex.EncodeToString(secondExpected[:])
 
-	hostRows := sqlmock.NewRows([]string{"id", "name", "hostname", "ip", "root_path", "settings", "created_at"}).
-		AddRow(1, "Backup1", "backup1.local", "", root, []byte(`{}`), time.Now())
-	mock.ExpectQuery(`SELECT id, name, hostname, ip, root_path, settings, created_at FROM hosts WHERE LOWER\(hostname\) = LOWER\(\$1\)`).
-		WithArgs("backup1.local").
-		WillReturnRows(hostRows)
-
-	mock.ExpectQuery(`(?s)SELECT COUNT\(\*\) FROM files.*WHERE LOWER\(hostname\) = LOWER\(\$1\).*AND hash IS NULL.*AND size IS NOT NULL.*HAVING COUNT\(\*\) > 1`).
+	mock.ExpectQuery(`(?s)SELECT COUNT\(\*\) FROM files.*WHERE hostname = \$1.*AND hash IS NULL.*AND size IS NOT NULL.*HAVING COUNT\(\*\) > 1`).
 		WithArgs("backup1.local").
 		WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(2))
 
-	updateRe := `(?s)UPDATE files\s+SET hash = \$1, last_hashed_at = NOW\(\)\s+WHERE id = \$2`
-	mock.ExpectPrepare(`(?s)UPDATE files\s+SET hash = 'TIMEOUT_ERROR', last_hashed_at = NOW\(\)\s+WHERE id = \$1`)
-	mock.ExpectPrepare(`(?s)UPDATE files\s+SET hash = 'HASH_ERROR', last_hashed_at = NOW\(\)\s+WHERE id = \$1`)
+	updateRe := `(?s)DELETE FROM file_errors WHERE file_id = \$2.*UPDATE files\s+SET hash = \$1, last_hashed_at = NOW\(\), hash_algo = \$3, hash_duration_ms = \$4\s+WHERE id = \$2`
+	mock.ExpectPrepare(`(?s)INSERT INTO file_errors \(file_id, kind, message, occurred_at, attempts\).*ON CONFLICT \(file_id, kind\)`)
 
-	fileRows := sqlmock.NewRows([]string{"id", "path", "root_folder", "effective_size"}).
-		AddRow(1, "first.bin", root, int64(len(firstContent))).
-		AddRow(2, "second.bin", root, int64(len(secondContent)))
+	fileRows := sqlmock.NewRows([]string{"id", "path", "root_folder", "effective_size", "mod_time", "hashed"}).
+		AddRow(1, "first.bin", root, int64(len(firstContent)), nil, false).
+		AddRow(2, "second.bin", root, int64(len(secondContent)), nil, false)
 	mock.ExpectQuery(`(?s)SELECT id, path, root_folder, COALESCE\(size, -1\) AS effective_size.*COALESCE\(size, -1\) < \$2::bigint.*ORDER BY COALESCE\(size, -1\) DESC, id ASC`).
 		WithArgs("backup1.local", nil, 0).
 		WillReturnRows(fileRows)
 
 	mock.ExpectPrepare(updateRe).
 		ExpectExec().
-		WithArgs(firstExpectedHash, 1).
+		WithArgs(firstExpectedHash, 1, HashAlgoSHA256, sqlmock.AnyArg()).
 		WillReturnResult(sqlmock.NewResult(0, 1))
 	mock.ExpectPrepare(updateRe).
 		ExpectExec().
-		WithArgs(secondExpectedHash, 2).
+		WithArgs(secondExpectedHash, 2, HashAlgoSHA256, sqlmock.AnyArg()).
 		WillReturnResult(sqlmock.NewResult(0, 1))
 
 	err = HashFiles(context.Background(), db, HashOptions{
-		Server:     "backup1.local",
+		Host:       backup1Host(root, `{}`),
 		LargeFirst: true,
 	})
 	if err != nil {
@@ -399,6 +527,316 @@ func TestHashFilesProcessesFullHashLargeFirstCombination(t *testing.T) {
 	}
 }
 
+func TestHashFilesForceBLAKE3RecordsTheAlgorithm(t *testing.T) {
+	logging.InfoLogger = log.New(io.Discard, "", 0)
+	logging.ErrorLogger = log.New(io.Discard, "", 0)
+
+	db, mock, err := sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherRegexp))
+	if err != nil {
+		t.Fatalf("Failed to create mock database: %v", err)
+	}
+	defer db.Close()
+	mock.MatchExpectationsInOrder(false)
+
+	root := t.TempDir()
+	content := []byte("hashed with sha256 before")
+	if err := os.WriteFile(filepath.Join(root, "old.bin"), content, 0644); err != nil {
+		t.Fatalf("write file: %v", err)
+	}
+	expected := blake3.Sum256(content)
+
+	mock.ExpectQuery(`(?s)SELECT COUNT\(\*\) FROM files.*HAVING COUNT\(\*\) > 1\s*\)\)\s*OR \(hash IS NOT NULL AND hash_algo <> 'blake3'\)\)`).
+		WithArgs("backup1.local").
+		WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(1))
+	mock.ExpectPrepare(`(?s)INSERT INTO file_errors`)
+	mock.ExpectQuery(`(?s)SELECT id, path, root_folder, COALESCE\(size, -1\) AS effective_size`).
+		WithArgs("backup1.local", nil, 0).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "path", "root_folder", "effective_size", "mod_time", "hashed"}).
+			AddRow(1, "old.bin", root, int64(len(content)), nil, false))
+	// The update is prepared again on a second connection while the batch
+	// rows are open.
+	updateRe := `(?s)UPDATE files\s+SET hash = \$1, last_hashed_at = NOW\(\), hash_algo = \$3`
+	mock.ExpectPrepare(updateRe)
+	mock.ExpectPrepare(updateRe).
+		ExpectExec().
+		WithArgs(hex.EncodeToString(expected[:]), 1, HashAlgoBLAKE3, sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+
+	err = HashFiles(context.Background(), db, HashOptions{
+		Host:       backup1Host(root, `{}`),
+		Refresh:    true,
+		LargeFirst: true,
+		Algo:       "blake3",
+	})
+	if err != nil {
+		t.Fatalf("HashFiles: %v", err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatalf("unmet expectations: %v", err)
+	}
+}
+
+func TestHashFilesRenewSkipsUnchangedFiles(t *testing.T) {
+	logging.InfoLogger = log.New(io.Discard, "", 0)
+	logging.ErrorLogger = log.New(io.Discard, "", 0)
+
+	db, mock, err := sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherRegexp))
+	if err != nil {
+		t.Fatalf("Failed to create mock database: %v", err)
+	}
+	defer db.Close()
+	mock.MatchExpectationsInOrder(false)
+
+	root := t.TempDir()
+	writeFiles(t, root, "same", "same.bin")
+	writeFiles(t, root, "edited", "edited.bin")
+	info, err := os.Stat(filepath.Join(root, "same.bin"))
+	if err != nil {
+		t.Fatalf("stat: %v", err)
+	}
+	stored := catalogModTime(info.ModTime())
+	edited := sha256.Sum256([]byte("edited"))
+
+	mock.ExpectQuery(`(?s)SELECT COUNT\(\*\) FROM files.*last_hashed_at < NOW\(\) - INTERVAL '1 week'`).
+		WithArgs("backup1.local").
+		WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(2))
+	mock.ExpectPrepare(`(?s)INSERT INTO file_errors`)
+	// The edited file was rewritten after files find recorded its mtime.
+	mock.ExpectQuery(`(?s)SELECT id, path, root_folder, COALESCE\(size, -1\) AS effective_size, mod_time, hash IS NOT NULL AS hashed`).
+		WithArgs("backup1.local", 0).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "path", "root_folder", "effective_size", "mod_time", "hashed"}).
+			AddRow(1, "same.bin", root, int64(4), stored, true).
+			AddRow(2, "edited.bin", root, int64(6), stored.Add(-time.Hour), true))
+	updateRe := `(?s)UPDATE files\s+SET hash = \$1, last_hashed_at = NOW\(\), hash_algo = \$3`
+	mock.ExpectPrepare(updateRe)
+	mock.ExpectPrepare(updateRe).
+		ExpectExec().
+		WithArgs(hex.EncodeToString(edited[:]), 2, HashAlgoSHA256, sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+
+	stats := &RunStats{}
+	out := captureStdout(t, func() {
+		err = HashFiles(context.Background(), db, HashOptions{
+			Host:  backup1Host(root, `{}`),
+			Renew: true,
+			Stats: stats,
+		})
+	})
+	if err != nil {
+		t.Fatalf("HashFiles: %v", err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatalf("unmet expectations: %v", err)
+	}
+	counters := stats.Counters()
+	if counters["unchanged"] != 1 || counters["processed"] != 1 {
+		t.Fatalf("expected 1 unchanged and 1 processed file, got %v", counters)
+	}
+	if !strings.Contains(out, "Skipped 1 unchanged files") {
+		t.Fatalf("expected the unchanged count in the summary:\n%s", out)
+	}
+}
+
+func TestHashFilesRenewRehashesFileEditedBeforeFind(t *testing.T) {
+	logging.InfoLogger = log.New(io.Discard, "", 0)
+	logging.ErrorLogger = log.New(io.Discard, "", 0)
+
+	db, mock, err := sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherRegexp))
+	if err != nil {
+		t.Fatalf("Failed to create mock database: %v", err)
+	}
+	defer db.Close()
+
+	// edited.bin was hashed, then rewritten, and files find ran before the
+	// next hash --renew, so the catalog already has its new size and mtime
+	root := t.TempDir()
+	writeFiles(t, root, "edited", "edited.bin")
+	info, err := os.Stat(filepath.Join(root, "edited.bin"))
+	if err != nil {
+		t.Fatalf("stat: %v", err)
+	}
+	modTime := catalogModTime(info.ModTime())
+
+	mock.ExpectQuery("SELECT id, name, hostname, ip, root_path, settings, created_at FROM hosts WHERE name = \\$1").
+		WithArgs("Backup1").
+		WillReturnRows(sqlmock.NewRows([]string{"id", "name", "hostname", "ip", "root_path", "settings", "created_at"}).
+			AddRow(1, "Backup1", "backup1.local", "1.1.1.1", "/old", []byte(`{"paths":{"photos":"`+root+`"}}`), time.Now()))
+	mock.ExpectBegin()
+	// The upsert drops the hash of a row whose size or mtime changed
+	insert := mock.ExpectPrepare(`(?s)INSERT INTO files.*hash = CASE WHEN \(files.size IS DISTINCT FROM EXCLUDED.size.*THEN NULL ELSE files.hash END,\s+last_hashed_at = CASE WHEN`)
+	lookup := mock.ExpectPrepare("SELECT id, path, COALESCE\\(root_folder, ''\\), size, mod_time")
+	mock.ExpectPrepare("UPDATE files SET path")
+	lookup.ExpectQuery().
+		WithArgs("backup1.local", sqlmock.AnyArg(), sqlmock.AnyArg()).
+		WillReturnRows(inodeRows())
+	insert.ExpectQuery().
+		WithArgs("edited.bin", "backup1.local", int64(6), root, sqlmock.AnyArg(), sqlmock.AnyArg(), modTime, OriginFind, sqlmock.AnyArg(), nil).
+		WillReturnRows(insertedRow(false))
+	mock.ExpectCommit()
+	if err := FindFiles(context.Background(), db, FindOptions{Server: "Backup1", Path: "photos"}); err != nil {
+		t.Fatalf("FindFiles: %v", err)
+	}
+
+	// With its hash gone the row no longer counts as hashed, so matching
+	// stat values do not keep the stale hash
+	edited := sha256.Sum256([]byte("edited"))
+	mock.MatchExpectationsInOrder(false)
+	mock.ExpectQuery(`(?s)SELECT COUNT\(\*\) FROM files.*last_hashed_at < NOW\(\) - INTERVAL '1 week'`).
+		WithArgs("backup1.local").
+		WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(1))
+	mock.ExpectPrepare(`(?s)INSERT INTO file_errors`)
+	mock.ExpectQuery(`(?s)SELECT id, path, root_folder, COALESCE\(size, -1\) AS effective_size, mod_time, hash IS NOT NULL AS hashed`).
+		WithArgs("backup1.local", 0).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "path", "root_folder", "effective_size", "mod_time", "hashed"}).
+			AddRow(1, "edited.bin", root, int64(6), modTime, false))
+	updateRe := `(?s)UPDATE files\s+SET hash = \$1, last_hashed_at = NOW\(\), hash_algo = \$3`
+	mock.ExpectPrepare(updateRe)
+	mock.ExpectPrepare(updateRe).
+		ExpectExec().
+		WithArgs(hex.EncodeToString(edited[:]), 1, HashAlgoSHA256, sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+
+	stats := &RunStats{}
+	captureStdout(t, func() {
+		err = HashFiles(context.Background(), db, HashOptions{Host: backup1Host(root, `{}`), Renew: true, Stats: stats})
+	})
+	if err != nil {
+		t.Fatalf("HashFiles: %v", err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatalf("unmet expectations: %v", err)
+	}
+	if counters := stats.Counters(); counters["unchanged"] != 0 || counters["processed"] != 1 {
+		t.Fatalf("expected the edited file to be rehashed, got %v", counters)
+	}
+}
+
+func TestHashFilesStopsAfterCount(t *testing.T) {
+	logging.InfoLogger = log.New(io.Discard, "", 0)
+	logging.ErrorLogger = log.New(io.Discard, "", 0)
+
+	db, mock, err := sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherRegexp))
+	if err != nil {
+		t.Fatalf("Failed to create mock database: %v", err)
+	}
+	defer db.Close()
+	mock.MatchExpectationsInOrder(false)
+
+	root := t.TempDir()
+	writeFiles(t, root, "first", "first.bin")
+	writeFiles(t, root, "second", "second.bin")
+	first := sha256.Sum256([]byte("first"))
+	second := sha256.Sum256([]byte("second"))
+
+	mock.ExpectQuery(`SELECT COUNT`).
+		WithArgs("backup1.local").
+		WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(5))
+	mock.ExpectPrepare(`(?s)INSERT INTO file_errors`)
+	// missing.bin fails and does not count towards the limit of two.
+	mock.ExpectQuery(`(?s)SELECT id, path, root_folder`).
+		WithArgs("backup1.local", 0).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "path", "root_folder", "effective_size", "mod_time", "hashed"}).
+			AddRow(1, "missing.bin", root, int64(5), nil, false).
+			AddRow(2, "first.bin", root, int64(5), nil, false).
+			AddRow(3, "second.bin", root, int64(6), nil, false).
+			AddRow(4, "third.bin", root, int64(5), nil, false))
+	mock.ExpectPrepare(`(?s)INSERT INTO file_errors`).
+		ExpectExec().
+		WithArgs(1, FileErrorHash, sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	updateRe := `(?s)UPDATE files\s+SET hash = \$1`
+	mock.ExpectPrepare(updateRe)
+	mock.ExpectPrepare(updateRe).
+		ExpectExec().
+		WithArgs(hex.EncodeToString(first[:]), 2, HashAlgoSHA256, sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(updateRe).
+		WithArgs(hex.EncodeToString(second[:]), 3, HashAlgoSHA256, sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+
+	stats := &RunStats{}
+	out := captureStdout(t, func() {
+		err = HashFiles(context.Background(), db, HashOptions{
+			Host:  backup1Host(root, `{}`),
+			Count: 2,
+			Stats: stats,
+		})
+	})
+	if err != nil {
+		t.Fatalf("HashFiles: %v", err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatalf("unmet expectations: %v", err)
+	}
+	if !strings.Contains(out, "Stopped after hashing 2 files (--count); 2 files remain to be hashed") {
+		t.Fatalf("expected the remaining count:\n%s", out)
+	}
+	if counters := stats.Counters(); counters["processed"] != 2 || counters["skipped"] != 1 || counters["remaining"] != 2 {
+		t.Fatalf("unexpected counters %v", counters)
+	}
+}
+
+func TestHashFilesProcessesEveryBatch(t *testing.T) {
+	logging.InfoLogger = log.New(io.Discard, "", 0)
+	logging.ErrorLogger = log.New(io.Discard, "", 0)
+
+	// Two full batches of 100 and a partial one. With --force the where
+	// clause still matches updated rows, so only the id bookmark keeps a run
+	// from hashing them again.
+	for _, refresh := range []bool{false, true} {
+		t.Run(fmt.Sprintf("refresh=%v", refresh), func(t *testing.T) {
+			db, mock, err := sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherRegexp))
+			if err != nil {
+				t.Fatalf("Failed to create mock database: %v", err)
+			}
+			defer db.Close()
+			mock.MatchExpectationsInOrder(false)
+
+			root := t.TempDir()
+			mock.ExpectQuery(`SELECT COUNT\(\*\) FROM files`).
+				WithArgs("backup1.local").
+				WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(250))
+			updateRe := `(?s)UPDATE files\s+SET hash = \$1`
+			mock.ExpectPrepare(`INSERT INTO file_errors`)
+			mock.ExpectPrepare(updateRe)
+			mock.ExpectPrepare(updateRe)
+			for _, batch := range [][2]int{{1, 100}, {101, 200}, {201, 250}} {
+				rows := sqlmock.NewRows([]string{"id", "path", "root_folder", "effective_size", "mod_time", "hashed"})
+				for id := batch[0]; id <= batch[1]; id++ {
+					path := fmt.Sprintf("file-%d.bin", id)
+					rows.AddRow(id, path, root, int64(10), nil, refresh)
+					mock.ExpectExec(updateRe).
+						WithArgs("hash-"+path, id, HashAlgoSHA256, sqlmock.AnyArg()).
+						WillReturnResult(sqlmock.NewResult(0, 1))
+				}
+				mock.ExpectQuery(`(?s)SELECT id, path, root_folder.*AND id > \$2`).
+					WithArgs("backup1.local", batch[0]-1).
+					WillReturnRows(rows)
+			}
+
+			stats := &RunStats{}
+			err = HashFiles(context.Background(), db, HashOptions{
+				Host:     backup1Host(root, `{}`),
+				FullHash: true,
+				Refresh:  refresh,
+				Stats:    stats,
+				hasher: func(path string) (string, error) {
+					return "hash-" + filepath.Base(path), nil
+				},
+			})
+			if err != nil {
+				t.Fatalf("HashFiles: %v", err)
+			}
+			if err := mock.ExpectationsWereMet(); err != nil {
+				t.Fatalf("unmet expectations: %v", err)
+			}
+			if got := stats.Counters()["processed"]; got != 250 {
+				t.Fatalf("expected all 250 files hashed, got %d", got)
+			}
+		})
+	}
+}
+
 func TestHashFilesProcessesPrioritizedFriendlyPathFirst(t *testing.T) {
 	var logBuffer bytes.Buffer
 	logging.InfoLogger = log.New(&logBuffer, "", 0)
@@ -430,39 +868,32 @@ func TestHashFilesProcessesPrioritizedFriendlyPathFirst(t *testing.T) {
 	otherHashBytes := sha256.Sum256(otherContent)
 	otherHash := hex.EncodeToString(otherHashBytes[:])
 
-	hostRows := sqlmock.NewRows([]string{"id", "name", "hostname", "ip", "root_path", "settings", "created_at"}).
-		AddRow(1, "Backup1", "backup1.local", "", priorityRoot, []byte(fmt.Sprintf(`{"paths":{"photos":%q}}`, priorityRoot)), time.Now())
-	mock.ExpectQuery(`SELECT id, name, hostname, ip, root_path, settings, created_at FROM hosts WHERE LOWER\(hostname\) = LOWER\(\$1\)`).
-		WithArgs("backup1.local").
-		WillReturnRows(hostRows)
-
-	mock.ExpectQuery(`(?s)SELECT COUNT\(\*\) FROM files.*WHERE LOWER\(hostname\) = LOWER\(\$1\).*AND hash IS NULL.*AND size IS NOT NULL.*HAVING COUNT\(\*\) > 1`).
+	mock.ExpectQuery(`(?s)SELECT COUNT\(\*\) FROM files.*WHERE hostname = \$1.*AND hash IS NULL.*AND size IS NOT NULL.*HAVING COUNT\(\*\) > 1`).
 		WithArgs("backup1.local").
 		WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(2))
 
-	updateRe := `(?s)UPDATE files\s+SET hash = \$1, last_hashed_at = NOW\(\)\s+WHERE id = \$2`
-	mock.ExpectPrepare(`(?s)UPDATE files\s+SET hash = 'TIMEOUT_ERROR', last_hashed_at = NOW\(\)\s+WHERE id = \$1`)
-	mock.ExpectPrepare(`(?s)UPDATE files\s+SET hash = 'HASH_ERROR', last_hashed_at = NOW\(\)\s+WHERE id = \$1`)
+	updateRe := `(?s)DELETE FROM file_errors WHERE file_id = \$2.*UPDATE files\s+SET hash = \$1, last_hashed_at = NOW\(\), hash_algo = \$3, hash_duration_ms = \$4\s+WHERE id = \$2`
+	mock.ExpectPrepare(`(?s)INSERT INTO file_errors \(file_id, kind, message, occurred_at, attempts\).*ON CONFLICT \(file_id, kind\)`)
 
-	fileRows := sqlmock.NewRows([]string{"id", "path", "root_folder", "effective_size", "path_priority"}).
-		AddRow(2, "priority.bin", priorityRoot, int64(len(priorityContent)), int64(1)).
-		AddRow(1, "other.bin", otherRoot, int64(len(otherContent)), int64(2))
-	mock.ExpectQuery(`(?s)SELECT id, path, root_folder, COALESCE\(size, -1\) AS effective_size, .* AS path_priority.*array_position\(\$2::text\[\], COALESCE\(root_folder, ''\)\).*ORDER BY path_priority ASC, id ASC`).
+	fileRows := sqlmock.NewRows([]string{"id", "path", "root_folder", "effective_size", "mod_time", "hashed", "path_priority"}).
+		AddRow(2, "priority.bin", priorityRoot, int64(len(priorityContent)), nil, false, int64(1)).
+		AddRow(1, "other.bin", otherRoot, int64(len(otherContent)), nil, false, int64(2))
+	mock.ExpectQuery(`(?s)SELECT id, path, root_folder, COALESCE\(size, -1\) AS effective_size, mod_time, hash IS NOT NULL AS hashed, .* AS path_priority.*array_position\(\$2::text\[\], COALESCE\(root_folder, ''\)\).*ORDER BY path_priority ASC, id ASC`).
 		WithArgs("backup1.local", sqlmock.AnyArg(), nil, 0).
 		WillReturnRows(fileRows)
 
 	mock.ExpectPrepare(updateRe).
 		ExpectExec().
-		WithArgs(priorityHash, 2).
+		WithArgs(priorityHash, 2, HashAlgoSHA256, sqlmock.AnyArg()).
 		WillReturnResult(sqlmock.NewResult(0, 1))
 	mock.ExpectPrepare(updateRe).
 		ExpectExec().
-		WithArgs(otherHash, 1).
+		WithArgs(otherHash, 1, HashAlgoSHA256, sqlmock.AnyArg()).
 		WillReturnResult(sqlmock.NewResult(0, 1))
 
 	err = HashFiles(context.Background(), db, HashOptions{
-		Server: "backup1.local",
-		Paths:  []string{"photos"},
+		Host:  backup1Host(priorityRoot, fmt.Sprintf(`{"paths":{"photos":%q}}`, priorityRoot)),
+		Paths: []string{"photos"},
 	})
 	if err != nil {
 		t.Fatalf("HashFiles path priority error: %v", err)
@@ -473,6 +904,135 @@ func TestHashFilesProcessesPrioritizedFriendlyPathFirst(t *testing.T) {
 	}
 }
 
+func TestHashFilesRecordsFailuresInFileErrors(t *testing.T) {
+	db, mock, err := sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherRegexp))
+	if err != nil {
+		t.Fatalf("Failed to create mock database: %v", err)
+	}
+	defer db.Close()
+
+	root := t.TempDir()
+	mock.ExpectQuery(`(?s)SELECT COUNT\(\*\) FROM files.*WHERE hostname = \$1 AND deleted_at IS NULL AND hash IS NULL AND NOT EXISTS`).
+		WithArgs("backup1.local").
+		WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(1))
+	// The successful-hash statement must never run: a failure leaves the hash
+	// column alone and only records a file_errors row.
+	mock.ExpectPrepare(`(?s)UPDATE files\s+SET hash = \$1`)
+	errorRe := `(?s)INSERT INTO file_errors \(file_id, kind, message, occurred_at, attempts\).*ON CONFLICT \(file_id, kind\).*attempts = file_errors.attempts \+ 1`
+	mock.ExpectPrepare(errorRe)
+	mock.ExpectQuery(`(?s)SELECT id, path, root_folder, COALESCE\(size, -1\) AS effective_size.*ORDER BY id ASC`).
+		WithArgs("backup1.local", 0).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "path", "root_folder", "effective_size", "mod_time", "hashed"}).
+			AddRow(5, "missing.bin", root, int64(10), nil, false))
+	mock.ExpectPrepare(errorRe).
+		ExpectExec().
+		WithArgs(5, FileErrorHash, sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+
+	var logBuffer bytes.Buffer
+	logging.InfoLogger = log.New(&logBuffer, "", 0)
+	if err := HashFiles(context.Background(), db, HashOptions{Host: backup1Host(root, `{}`), FullHash: true}); err != nil {
+		t.Fatalf("HashFiles error: %v", err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatalf("unmet expectations: %v\nlogs:\n%s", err, logBuffer.String())
+	}
+}
+
+func TestHashFilesGivesUpAfterMaxTimeouts(t *testing.T) {
+	db, mock, err := sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherRegexp))
+	if err != nil {
+		t.Fatalf("Failed to create mock database: %v", err)
+	}
+	defer db.Close()
+
+	root := t.TempDir()
+	mock.ExpectQuery(`(?s)SELECT COUNT\(\*\) FROM files.*AND hash IS NULL AND NOT EXISTS \(SELECT 1 FROM file_errors fe WHERE fe.file_id = files.id AND fe.kind = 'permanent'\)`).
+		WithArgs("backup1.local").
+		WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(1))
+	mock.ExpectPrepare(`(?s)UPDATE files\s+SET hash = \$1`)
+	errorRe := `(?s)INSERT INTO file_errors`
+	mock.ExpectPrepare(errorRe)
+	mock.ExpectQuery(`(?s)SELECT id, path, root_folder, COALESCE\(size, -1\) AS effective_size.*ORDER BY id ASC`).
+		WithArgs("backup1.local", 0).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "path", "root_folder", "effective_size", "mod_time", "hashed"}).
+			AddRow(7, "stuck.bin", root, int64(10), nil, false))
+	mock.ExpectQuery(`SELECT COALESCE\(MAX\(attempts\), 0\) FROM file_errors WHERE file_id = \$1 AND kind = 'timeout'`).
+		WithArgs(7).
+		WillReturnRows(sqlmock.NewRows([]string{"attempts"}).AddRow(2))
+	mock.ExpectPrepare(errorRe).
+		ExpectExec().
+		WithArgs(7, FileErrorTimeout, sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(`(?s)UPDATE file_errors SET kind = 'permanent'\s+WHERE file_id = \$1 AND kind = 'timeout' AND attempts >= \$2`).
+		WithArgs(7, 3).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+
+	stats := &RunStats{}
+	logging.InfoLogger = log.New(io.Discard, "", 0)
+	out := captureStdout(t, func() {
+		err = HashFiles(context.Background(), db, HashOptions{
+			Host:             backup1Host(root, `{}`),
+			FullHash:         true,
+			RetryProblematic: true,
+			MaxAttempts:      3,
+			Stats:            stats,
+			hasher: func(path string) (string, error) {
+				return "", fmt.Errorf("hashing timed out after 4 minutes of inactivity for file: %s", path)
+			},
+		})
+	})
+	if err != nil {
+		t.Fatalf("HashFiles: %v", err)
+	}
+	if !strings.Contains(out, "Gave up on 1 files after 3 timeouts; only files hash --force retries them") {
+		t.Fatalf("expected the give-up summary:\n%s", out)
+	}
+	if got := stats.Counters()["permanent"]; got != 1 {
+		t.Fatalf("expected permanent 1 in the run stats, got %d", got)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatalf("unmet expectations: %v", err)
+	}
+}
+
+func TestRetryStallTimeoutDoublesUpToTheCap(t *testing.T) {
+	for timeouts, want := range map[int]time.Duration{
+		0:  time.Minute,
+		1:  2 * time.Minute,
+		2:  4 * time.Minute,
+		4:  16 * time.Minute,
+		10: 16 * time.Minute,
+	} {
+		if got := retryStallTimeout(timeouts); got != want {
+			t.Errorf("retryStallTimeout(%d) = %v, want %v", timeouts, got, want)
+		}
+	}
+	if got := describeStall(4 * time.Minute); got != "4 minutes" {
+		t.Fatalf("describeStall(4m) = %q", got)
+	}
+	if got := describeStall(time.Minute); got != "1 minute" {
+		t.Fatalf("describeStall(1m) = %q", got)
+	}
+}
+
+func TestClassifyHashError(t *testing.T) {
+	tests := []struct {
+		err  error
+		want string
+	}{
+		{fmt.Errorf("hashing timed out after 1 minute of inactivity for file: /a"), FileErrorTimeout},
+		{&os.PathError{Op: "open", Path: "/a", Err: os.ErrPermission}, FileErrorPermission},
+		{fmt.Errorf("error accessing file: lstat /a: permission denied"), FileErrorPermission},
+		{fmt.Errorf("path is a symlink"), FileErrorHash},
+	}
+	for _, tc := range tests {
+		if got := classifyHashError(tc.err); got != tc.want {
+			t.Errorf("classifyHashError(%v) = %q, want %q", tc.err, got, tc.want)
+		}
+	}
+}
+
 func TestHashWhereClauseModeSelection(t *testing.T) {
 	defaultWhere := buildHashWhereClause(HashOptions{})
 	if !strings.Contains(defaultWhere, "hash IS NULL") {
@@ -535,7 +1095,7 @@ func TestHashFilesProcessing(t *testing.T) {
 		WillReturnRows(countRows)
 
 	// Call the function
-	err = HashFiles(context.Background(), db, HashOptions{Server: "testhost"})
+	err = HashFiles(context.Background(), db, HashOptions{Host: &dedupdb.Host{Name: "testhost", Hostname: "testhost", RootPath: tempDir}})
 	if err != nil {
 		t.Errorf("HashFiles returned error: %v", err)
 	}
@@ -546,6 +1106,12 @@ func TestHashFilesProcessing(t *testing.T) {
 	}
 }
 
+const problematicQueryRe = `(?s)SELECT f.id, f.path, COALESCE\(f.size, 0\), fe.kind, fe.attempts, COALESCE\(fe.message, ''\), fe.occurred_at\s+FROM file_errors fe\s+JOIN files f ON f.id = fe.file_id\s+WHERE f.hostname = \$1 AND f.deleted_at IS NULL\s+ORDER BY fe.occurred_at DESC`
+
+func problematicRows() *sqlmock.Rows {
+	return sqlmock.NewRows([]string{"id", "path", "size", "kind", "attempts", "message", "occurred_at"})
+}
+
 func TestListProblematicFiles(t *testing.T) {
 	db, mock, err := sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherRegexp))
 	if err != nil {
@@ -553,24 +1119,31 @@ func TestListProblematicFiles(t *testing.T) {
 	}
 	defer db.Close()
 
-	hostRows := sqlmock.NewRows([]string{"root_path"}).
-		AddRow("/test/path")
-	mock.ExpectQuery(`SELECT root_path FROM hosts WHERE LOWER\(name\) = LOWER\(\$1\)`).
+	hostRows := sqlmock.NewRows([]string{"hostname"}).
+		AddRow("TestHost.Local")
+	mock.ExpectQuery(`SELECT hostname FROM hosts WHERE LOWER\(name\) = LOWER\(\$1\)`).
 		WithArgs("testhost").
 		WillReturnRows(hostRows)
 
 	now := time.Now()
-	fileRows := sqlmock.NewRows([]string{"id", "dbPath", "size", "last_hashed_at"}).
-		AddRow(1, "problem1.txt", 1024*1024, now).
-		AddRow(2, "problem2.txt", 1024*1024*1024, now.Add(-24*time.Hour))
-	mock.ExpectQuery(`SELECT id, dbPath, size, last_hashed_at FROM files WHERE LOWER\(hostname\) = LOWER\(\$1\) AND hash = 'TIMEOUT_ERROR' ORDER BY last_hashed_at DESC`).
-		WithArgs("testhost").
+	fileRows := problematicRows().
+		AddRow(1, "problem1.txt", 1024*1024, FileErrorTimeout, 3, "hashing timed out after 1 minute of inactivity", now).
+		AddRow(2, "problem2.txt", 1024*1024*1024, FileErrorPermission, 1, "open problem2.txt: permission denied", now.Add(-24*time.Hour))
+	mock.ExpectQuery(problematicQueryRe).
+		WithArgs("testhost.local").
 		WillReturnRows(fileRows)
 
-	err = ListProblematicFiles(context.Background(), db, "testhost")
+	out := captureStdout(t, func() {
+		err = ListProblematicFiles(context.Background(), db, "testhost")
+	})
 	if err != nil {
 		t.Errorf("ListProblematicFiles returned error: %v", err)
 	}
+	for _, want := range []string{"problem1.txt", "timeout", "hashing timed out", "permission denied", "Found 2 problematic files"} {
+		if !strings.Contains(out, want) {
+			t.Errorf("expected output to contain %q, got:\n%s", want, out)
+		}
+	}
 
 	// Verify all expectations were met
 	if err := mock.ExpectationsWereMet(); err != nil {
@@ -585,7 +1158,7 @@ func TestListProblematicFilesHostNotFound(t *testing.T) {
 	}
 	defer db.Close()
 
-	mock.ExpectQuery(`SELECT root_path FROM hosts WHERE LOWER\(name\) = LOWER\(\$1\)`).
+	mock.ExpectQuery(`SELECT hostname FROM hosts WHERE LOWER\(name\) = LOWER\(\$1\)`).
 		WithArgs("nonexistent").
 		WillReturnError(sql.ErrNoRows)
 
@@ -609,16 +1182,15 @@ func TestListProblematicFilesNoResults(t *testing.T) {
 	}
 	defer db.Close()
 
-	hostRows := sqlmock.NewRows([]string{"root_path"}).
-		AddRow("/test/path")
-	mock.ExpectQuery(`SELECT root_path FROM hosts WHERE LOWER\(name\) = LOWER\(\$1\)`).
+	hostRows := sqlmock.NewRows([]string{"hostname"}).
+		AddRow("TestHost.Local")
+	mock.ExpectQuery(`SELECT hostname FROM hosts WHERE LOWER\(name\) = LOWER\(\$1\)`).
 		WithArgs("testhost").
 		WillReturnRows(hostRows)
 
-	fileRows := sqlmock.NewRows([]string{"id", "dbPath", "size", "last_hashed_at"})
-	mock.ExpectQuery(`SELECT id, dbPath, size, last_hashed_at FROM files WHERE LOWER\(hostname\) = LOWER\(\$1\) AND hash = 'TIMEOUT_ERROR' ORDER BY last_hashed_at DESC`).
-		WithArgs("testhost").
-		WillReturnRows(fileRows)
+	mock.ExpectQuery(problematicQueryRe).
+		WithArgs("testhost.local").
+		WillReturnRows(problematicRows())
 
 	err = ListProblematicFiles(context.Background(), db, "testhost")
 	if err != nil {
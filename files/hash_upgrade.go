@@ -15,19 +15,19 @@ const hashUpgradeBatchSize = 100
 
 // UpgradeStoredHashes recalculates full-file hashes for files with existing stored hashes.
 func UpgradeStoredHashes(ctx context.Context, sqldb *sql.DB, opts HashUpgradeOptions) error {
-	host, err := db.GetHostByHostname(sqldb, opts.Server)
+	host, err := db.ResolveHost(sqldb, opts.Server)
 	if err != nil {
-		host, err = db.GetHost(sqldb, opts.Server)
-		if err != nil {
-			return fmt.Errorf("server not found: %s", opts.Server)
-		}
+		return err
 	}
-	hostname := host.Hostname
+	hostname := normalizeHostname(host.Hostname)
 
+	// Only SHA-256 hashes can be partial: BLAKE3 hashes were always taken
+	// over the whole file.
 	whereClause := `
-			WHERE LOWER(hostname) = LOWER($1)
+			WHERE hostname = $1
+			AND hash_algo = '` + HashAlgoSHA256 + `'
 			AND hash IS NOT NULL
-			AND hash NOT IN ('TIMEOUT_ERROR', 'HASH_ERROR')
+			AND ` + NotDeleted + `
 		`
 
 	var total int64
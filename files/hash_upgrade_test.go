@@ -44,7 +44,7 @@ func TestUpgradeStoredHashesUpdatesOnlyChangedHashes(t *testing.T) {
 		WithArgs("backup1.local").
 		WillReturnRows(hostRows)
 
-	mock.ExpectQuery(`(?s)SELECT COUNT\(\*\) FROM files\s+WHERE LOWER\(hostname\) = LOWER\(\$1\).*AND hash IS NOT NULL.*AND hash NOT IN \('TIMEOUT_ERROR', 'HASH_ERROR'\)`).
+	mock.ExpectQuery(`(?s)SELECT COUNT\(\*\) FROM files\s+WHERE hostname = \$1.*AND hash IS NOT NULL\s+AND deleted_at IS NULL\s*$`).
 		WithArgs("backup1.local").
 		WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(2))
 
@@ -56,7 +56,7 @@ func TestUpgradeStoredHashesUpdatesOnlyChangedHashes(t *testing.T) {
 	fileRows := sqlmock.NewRows([]string{"id", "path", "root_folder", "hash"}).
 		AddRow(1, "changed.bin", root, partialHash).
 		AddRow(2, "same.bin", root, sameFullHash)
-	mock.ExpectQuery(`(?s)SELECT id, path, root_folder, hash\s+FROM files\s+WHERE LOWER\(hostname\) = LOWER\(\$1\).*AND hash IS NOT NULL.*AND hash NOT IN \('TIMEOUT_ERROR', 'HASH_ERROR'\).*AND id > \$2\s+ORDER BY id ASC\s+LIMIT 100`).
+	mock.ExpectQuery(`(?s)SELECT id, path, root_folder, hash\s+FROM files\s+WHERE hostname = \$1.*AND hash IS NOT NULL\s+AND deleted_at IS NULL\s+AND id > \$2\s+ORDER BY id ASC\s+LIMIT 100`).
 		WithArgs("backup1.local", 0).
 		WillReturnRows(fileRows)
 
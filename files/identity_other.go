@@ -0,0 +1,11 @@
+//go:build !unix
+
+package files
+
+import "os"
+
+// fileIdentity reports no device and inode numbers: this platform has none,
+// so the device and inode columns stay NULL.
+func fileIdentity(info os.FileInfo) (device, inode uint64, ok bool) {
+	return 0, 0, false
+}
@@ -3,10 +3,14 @@ package files
 import (
 	"context"
 	"database/sql"
+	"errors"
 	"fmt"
+	"io"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"regexp"
+	"sort"
 	"strings"
 	"time"
 
@@ -19,8 +23,43 @@ func shellEscape(s string) string {
 	return "'" + strings.ReplaceAll(s, "'", "'\\''") + "'"
 }
 
+// shellJoin renders args as a shell command line for display, quoting the
+// ones that need it. Commands are always run with argv, never through it.
+func shellJoin(args []string) string {
+	quoted := make([]string, len(args))
+	for i, arg := range args {
+		if arg == "" || strings.IndexFunc(arg, isShellUnsafe) >= 0 {
+			arg = shellEscape(arg)
+		}
+		quoted[i] = arg
+	}
+	return strings.Join(quoted, " ")
+}
+
+func isShellUnsafe(r rune) bool {
+	switch {
+	case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9':
+		return false
+	}
+	return !strings.ContainsRune("-_./=:@%+,", r)
+}
+
+// importFileHook, when set, runs after every path the import walks. Tests use
+// it to act part way through a run.
+var importFileHook func(path string)
+
 // ImportFiles imports files from a source directory to a target host
 func ImportFiles(ctx context.Context, database *sql.DB, opts ImportOptions) error {
+	// With --summary-json -, stdout carries the JSON summary alone: the
+	// human output of the run goes to stderr meanwhile.
+	var summaryOut io.Writer
+	if opts.SummaryJSON == "-" {
+		stdout := os.Stdout
+		summaryOut, os.Stdout = stdout, os.Stderr
+		defer func() { os.Stdout = stdout }()
+	}
+	startedAt := time.Now()
+
 	// Validate options
 	if opts.SourcePath == "" {
 		return fmt.Errorf("source path is required")
@@ -52,11 +91,15 @@ func ImportFiles(ctx context.Context, database *sql.DB, opts ImportOptions) erro
 		return fmt.Errorf("error querying host: %v", err)
 	}
 
-	// Try to get the actual hostname for the target from the hosts table
+	// Rows are stored under the canonical hosts.hostname, never the friendly
+	// server name the user typed, so every files query below must use it.
 	err = database.QueryRow(`SELECT hostname FROM hosts WHERE LOWER(name) = LOWER($1)`, opts.HostName).Scan(&dbHostName)
-	if err != nil || dbHostName == "" {
-		// fallback to opts.HostName if not present
-		dbHostName = opts.HostName
+	if err != nil {
+		return fmt.Errorf("error getting hostname for host %s: %v", opts.HostName, err)
+	}
+	dbHostName = normalizeHostname(dbHostName)
+	if dbHostName == "" {
+		return fmt.Errorf("host %s has no hostname", displayName)
 	}
 
 	// Get the current machine's hostname
@@ -83,41 +126,198 @@ func ImportFiles(ctx context.Context, database *sql.DB, opts ImportOptions) erro
 	if err != nil {
 		return fmt.Errorf("error getting path mappings: %v", err)
 	}
-
-	// Look up the actual path for the friendly name
-	actualPath, exists := paths[opts.FriendlyPath]
-	if !exists {
-		// If no mapping exists, fall back to the old behavior for backward compatibility
-		actualPath = filepath.Join(host.RootPath, opts.FriendlyPath)
-		fmt.Printf("Warning: No path mapping found for friendly name '%s', using default path: %s\n",
-			opts.FriendlyPath, actualPath)
+	names, err := NewPathNames(&host)
+	if err != nil {
+		return err
+	}
+	var xattrWhitelist []string
+	if opts.CaptureXattrs {
+		if xattrWhitelist, err = host.GetXattrWhitelist(); err != nil {
+			return fmt.Errorf("error decoding xattr whitelist: %v", err)
+		}
+	}
+	sshSettings, err := hostSSH(&host)
+	if err != nil {
+		return err
 	}
 
-	// Use the actual path from the mapping
-	destRoot := actualPath
-	if !strings.HasSuffix(destRoot, "/") {
-		destRoot += "/"
+	// Files go to the default --path unless their top-level source
+	// subdirectory is routed to a friendly path of its own.
+	defaultRoute := &importRoute{friendly: opts.FriendlyPath}
+	if opts.FriendlyPath != "" || !opts.StrictRoutes {
+		defaultRoute.rootFolder, defaultRoute.destRoot = importDestRoot(&host, paths, opts.FriendlyPath)
+	}
+	routes := make(map[string]*importRoute, len(opts.Routes))
+	for subdir, friendly := range opts.Routes {
+		route := &importRoute{subdir: subdir, friendly: friendly}
+		route.rootFolder, route.destRoot = importDestRoot(&host, paths, friendly)
+		routes[subdir] = route
 	}
+	routeNames := make([]string, 0, len(routes))
+	for subdir := range routes {
+		routeNames = append(routeNames, subdir)
+	}
+	sort.Strings(routeNames)
 
-	fmt.Printf("Importing files from %s to %s (%s:%s)\n", opts.SourcePath, targetHost, targetHost, destRoot)
+	if defaultRoute.destRoot != "" {
+		fmt.Printf("Importing files from %s to %s (%s:%s)\n", opts.SourcePath, displayName, targetHost, defaultRoute.destRoot)
+	} else {
+		fmt.Printf("Importing files from %s to %s (%s), routed subdirectories only\n", opts.SourcePath, displayName, targetHost)
+	}
+	for _, subdir := range routeNames {
+		route := routes[subdir]
+		fmt.Printf("  Route %s/ -> %s (%s:%s)\n", subdir, route.friendly, targetHost, route.destRoot)
+	}
+	// A dry run re-checks the files it would transfer once the walk is done,
+	// to catch directories that are still being written to.
+	var stability *stabilityCheck
 	if opts.DryRun {
 		fmt.Println("DRY RUN: No files will be transferred or removed")
+		stability = newStabilityCheck(importStabilitySample)
+	}
+
+	// Each destination keeps --min-free of headroom; a run that starts
+	// below it transfers nothing.
+	spaceHost := targetHost
+	if isLocal {
+		spaceHost = ""
+	}
+	freeCheckEvery := opts.FreeCheckEvery
+	if freeCheckEvery <= 0 {
+		freeCheckEvery = DefaultFreeCheckEvery
+	}
+	allRoutes := []*importRoute{defaultRoute}
+	for _, subdir := range routeNames {
+		allRoutes = append(allRoutes, routes[subdir])
+	}
+	for _, route := range allRoutes {
+		if route.destRoot == "" {
+			continue
+		}
+		route.space = newSpaceGuard(opts.MinFree, spaceHost, sshSettings, route.destRoot, freeCheckEvery)
+		if opts.DryRun {
+			continue
+		}
+		if err := route.space.admit(ctx, 0); err != nil {
+			if errors.Is(err, errBelowHeadroom) {
+				opts.Stats.Set("stopped_below_headroom", 1)
+			}
+			return err
+		}
+	}
+	if !opts.MinFree.IsZero() {
+		fmt.Printf("  Keeping %s free on each destination\n", opts.MinFree)
 	}
 
-	// Walk through the source directory
+	// On a remote host the destinations are listed once, instead of
+	// checking each target path with its own ssh test -e. A destination
+	// that cannot be listed falls back to those checks.
+	var listing *remoteTargetList
+	if !isLocal {
+		listing = newRemoteTargetList()
+		for _, route := range allRoutes {
+			if route.destRoot == "" {
+				continue
+			}
+			if err := listing.list(ctx, targetHost, sshSettings, route.destRoot); err != nil {
+				fmt.Printf("Warning: could not list %s:%s, checking each file with ssh instead: %v\n", targetHost, route.destRoot, err)
+			}
+		}
+	}
+
+	// Walk through the source directory. Counters are kept per route and
+	// summed for the totals.
 	var (
-		transferCount       int
-		transferTotalSize   int64 // Total size of transferred files
-		skipCount           int
-		skipTotalSize       int64 // Total size of skipped files
-		errorCount          int
-		fileCount           int
-		removedCount        int   // Track number of files removed from source
-		moveCount           int   // Track number of files moved to duplicate dir
-		moveTotalSize       int64 // Total size of files moved to duplicate dir
-		skipTooNewCount     int   // Track number of files skipped because they are too new
-		skipTooNewTotalSize int64 // Total size of files skipped because they are too new
+		fileCount     int   // Files processed across all routes, for --count
+		unroutedCount int   // Files skipped by --strict-routes
+		unroutedSize  int64 // Total size of files skipped by --strict-routes
+		excludedCount int   // Files skipped by --exclude
+		excludedSize  int64 // Total size of files skipped by --exclude
+		excludedDirs  int   // Directories skipped whole by --exclude
+		notIncluded   int   // Files skipped for matching no --include
+		notInclSize   int64 // Total size of files skipped for matching no --include
 	)
+	pathLengths := newPathLengthCheck(opts.MaxPathLen)
+	pool := newImportPool(opts.Workers)
+	if pool != nil {
+		fmt.Printf("  Transferring with %d workers\n", opts.Workers)
+	}
+
+	// The hashes already on the host are loaded once, instead of being
+	// looked up for every file. The files being imported are added as they
+	// go, so that two workers never both import the same content.
+	known := make(map[string]bool)
+	if !opts.DryRun {
+		if known, err = loadHostHashes(database, dbHostName); err != nil {
+			return err
+		}
+	}
+	claimHash := func(hash string) (ok bool) {
+		pool.locked(func() {
+			if ok = !known[hash]; ok {
+				known[hash] = true
+			}
+		})
+		return ok
+	}
+	releaseHash := func(hash string) {
+		pool.locked(func() { delete(known, hash) })
+	}
+
+	// fail reports an error of the file at path, counts it in c and keeps
+	// it for --summary-json.
+	failures := &importFailures{}
+	fail := func(c *importCounters, path, format string, args ...interface{}) {
+		msg := fmt.Sprintf(format, args...)
+		fmt.Printf("Error %s\n", msg)
+		c.errors++
+		failures.add(path, msg)
+	}
+
+	batchSize := opts.BatchSize
+	if batchSize <= 0 {
+		batchSize = DefaultImportBatchSize
+	}
+	batch := &importBatch{
+		database: database,
+		hostname: dbHostName,
+		hostUser: currentHostUser(),
+		size:     batchSize,
+		failed: func(row importRow, err error) {
+			logging.ErrorLogger.Printf("Error adding file to database: %v", err)
+			row.route.transferred--
+			row.route.transferredSize -= row.size
+			row.route.errors++
+			failures.add(filepath.Join(row.rootFolder, row.path), err.Error())
+			delete(known, row.hash)
+		},
+	}
+	totals := func() importCounters {
+		total := defaultRoute.importCounters
+		for _, route := range routes {
+			total.add(route.importCounters)
+		}
+		return total
+	}
+	defer func() {
+		total := totals()
+		opts.Stats.Set("files", int64(total.files))
+		opts.Stats.Set("transferred", int64(total.transferred))
+		opts.Stats.Set("transferred_bytes", total.transferredSize)
+		opts.Stats.Set("moved_to_duplicates", int64(total.moved))
+		opts.Stats.Set("skipped", int64(total.skipped))
+		opts.Stats.Set("path_conflicts", int64(total.conflicts))
+		opts.Stats.Set("skipped_too_new", int64(total.tooNew))
+		opts.Stats.Set("skipped_too_old", int64(total.tooOld))
+		opts.Stats.Set("skipped_unrouted", int64(unroutedCount))
+		opts.Stats.Set("skipped_excluded", int64(excludedCount))
+		opts.Stats.Set("skipped_excluded_dirs", int64(excludedDirs))
+		opts.Stats.Set("skipped_not_included", int64(notIncluded))
+		opts.Stats.Set("skipped_path_too_long", pathLengths.skipped)
+		opts.Stats.Set("removed_from_source", int64(total.removed))
+		opts.Stats.Set("verified", int64(total.verified))
+		opts.Stats.Set("errors", int64(total.errors))
+	}()
 
 	// Helper function to format file sizes
 	formatSize := func(size int64) string {
@@ -133,285 +333,724 @@ func ImportFiles(ctx context.Context, database *sql.DB, opts ImportOptions) erro
 		return fmt.Sprintf("%.1f %cB", float64(size)/float64(div), "KMGTPE"[exp])
 	}
 
-	err = filepath.Walk(opts.SourcePath, func(path string, info os.FileInfo, err error) error {
-		if err != nil {
-			fmt.Printf("Error accessing path %s: %v\n", path, err)
-			errorCount++
-			return nil
+	// statusCounters is what --status-file reports while the run goes on.
+	statusCounters := func() map[string]int64 {
+		total := totals()
+		return map[string]int64{
+			"processed":           int64(fileCount),
+			"transferred":         int64(total.transferred),
+			"bytes":               total.transferredSize,
+			"skipped":             int64(total.skipped+total.tooNew+total.tooOld+unroutedCount+excludedCount+notIncluded) + pathLengths.skipped,
+			"moved_to_duplicates": int64(total.moved),
+			"path_conflicts":      int64(total.conflicts),
+			"errors":              int64(total.errors),
 		}
+	}
 
-		// Skip directories
-		if info.IsDir() {
-			return nil
-		}
+	// --bwlimit and --rsync-opt go to every rsync the import runs, also
+	// when a duplicate is moved to --duplicate across filesystems.
+	var rsyncOpts []string
+	if opts.BwLimit != "" {
+		rsyncOpts = append(rsyncOpts, "--bwlimit="+opts.BwLimit)
+	}
+	rsyncOpts = append(rsyncOpts, opts.RsyncOptions...)
 
-		// Check file age if specified
-		if opts.Age > 0 {
-			ageDuration := time.Duration(opts.Age) * time.Minute
-			if time.Since(info.ModTime()) < ageDuration {
-				fmt.Printf("SKIP (too new): %s (age %s)\n", path, time.Since(info.ModTime()).Round(time.Second))
-				skipTooNewCount++
-				skipTooNewTotalSize += info.Size()
-				return nil
-			}
+	// transferArgs is the rsync argument list of the transfer of path to
+	// targetPath. With --verify the source is only removed once the copy
+	// is known to have landed whole, so rsync never removes it.
+	transferArgs := func(path, targetPath string) []string {
+		args := []string{"-avz"}
+		if opts.RemoveSource && !opts.Verify {
+			args = append(args, "--remove-source-files")
 		}
-
-		// Check if we've reached the count limit
-		if opts.Count > 0 && fileCount >= opts.Count {
-			return filepath.SkipAll
+		args = append(args, rsyncOpts...)
+		if isLocal {
+			return append(args, path, targetPath)
 		}
+		args = append(args, rsyncShell(sshSettings)...)
+		return append(args, path, targetHost+":"+targetPath)
+	}
 
-		// Check if context is cancelled
-		select {
-		case <-ctx.Done():
-			return ctx.Err()
-		default:
+	// reserveRename returns the first free name --on-conflict rename finds
+	// for targetPath. The names handed out are kept for the run, so that two
+	// workers never pick the same one.
+	reserved := make(map[string]bool)
+	reserveRename := func(targetPath string) (string, error) {
+		for n := 1; ; n++ {
+			candidate := conflictRenamePath(targetPath, n)
+			var taken bool
+			pool.locked(func() { taken = reserved[candidate] })
+			if taken {
+				continue
+			}
+			exists, err := importTargetExists(ctx, targetHost, sshSettings, isLocal, listing, candidate)
+			if err != nil {
+				return "", err
+			}
+			if exists {
+				continue
+			}
+			pool.locked(func() {
+				if taken = reserved[candidate]; !taken {
+					reserved[candidate] = true
+				}
+			})
+			if !taken {
+				return candidate, nil
+			}
 		}
+	}
 
-		fileCount++
+	// importFile checks, transfers and records one file. Its counters are
+	// kept in c and added to the route once it is done. With --workers it
+	// runs on the pool, so everything else it shares with the walk goes
+	// through pool.locked.
+	importFile := func(job importJob) error {
+		path, info, relPath, route, destRel, targetPath := job.path, job.info, job.relPath, job.route, job.destRel, job.targetPath
+		var c importCounters
+		defer pool.locked(func() { route.add(c) })
 
-		// Get relative path from source directory
-		relPath, err := filepath.Rel(opts.SourcePath, path)
-		if err != nil {
-			fmt.Printf("Error getting relative path for %s: %v\n", path, err)
-			errorCount++
-			return nil
-		}
+		targetLabel := names.Label(route.destRoot, destRel)
 
-		// Construct target path
-		targetPath := filepath.Join(destRoot, relPath)
-
-		// Check if target file exists
-		targetExists := false
-		if isLocal {
-			if _, err := os.Stat(targetPath); err == nil {
-				targetExists = true
-			}
-		} else {
-			// For remote, use ssh to check existence
-			sshCmd := exec.CommandContext(ctx, "ssh", targetHost, "test -e "+shellEscape(targetPath))
-			if err := sshCmd.Run(); err == nil {
-				targetExists = true
+		// duplicate moves a source whose content is already on the host to
+		// --duplicate, or else skips it, saying why with shown.
+		duplicate := func(reason, shown string) {
+			if opts.DuplicateDir == "" {
+				fmt.Printf("SKIP (%s): %s\n", reason, shown)
+				c.skipped++
+				c.skippedSize += info.Size()
+				return
 			}
-		}
-
-		// Handle duplicate files if DuplicateDir is specified
-		if targetExists && opts.DuplicateDir != "" {
 			// Create the duplicate directory path by appending the relative path
 			duplicatePath := filepath.Join(opts.DuplicateDir, relPath)
 			duplicateDir := filepath.Dir(duplicatePath)
-
 			if opts.DryRun {
 				fmt.Printf("Would move duplicate %s to %s\n", path, duplicatePath)
-			} else {
-				// Create the target directory structure
-				if err := os.MkdirAll(duplicateDir, 0755); err != nil {
-					fmt.Printf("Error creating duplicate directory %s: %v\n", duplicateDir, err)
-					errorCount++
-					return nil
-				}
+				return
+			}
+			if err := os.MkdirAll(duplicateDir, 0755); err != nil {
+				fail(&c, path, "creating duplicate directory %s: %v", duplicateDir, err)
+				return
+			}
+			// Move the file to the duplicate directory, with rsync for cross-filesystem moves
+			fmt.Printf("Moving duplicate %s (%s) to %s\n", path, formatSize(info.Size()), duplicatePath)
+			if err := moveFile(path, duplicatePath, rsyncOpts...); err != nil {
+				fail(&c, path, "moving duplicate: %v", err)
+				return
+			}
+			c.moved++
+			c.movedSize += info.Size()
+		}
 
-				// Move the file to the duplicate directory using rsync for cross-filesystem moves
-				fmt.Printf("Moving duplicate %s (%s) to %s\n", path, formatSize(info.Size()), duplicatePath)
-				err = os.Rename(path, duplicatePath)
-				if err != nil {
-					// If rename fails due to cross-device link, use rsync
-					if strings.Contains(err.Error(), "invalid cross-device link") {
-						cmd := exec.Command("rsync", "-a", "--remove-source-files", path, duplicatePath)
-						output, rsyncErr := cmd.CombinedOutput()
-						if rsyncErr != nil {
-							fmt.Printf("Error moving duplicate file %s with rsync: %v\nOutput: %s\n", path, rsyncErr, output)
-							errorCount++
-							return nil
-						}
-					} else {
-						// If it's another error, log it and continue
-						fmt.Printf("Error moving duplicate file %s: %v\n", path, err)
-						errorCount++
-						return nil
-					}
-				}
+		// Check if target file exists
+		targetExists, err := importTargetExists(ctx, targetHost, sshSettings, isLocal, listing, targetPath)
+		if err != nil {
+			fail(&c, path, "checking %s: %v", targetPath, err)
+			return nil
+		}
 
-				moveCount++
-				moveTotalSize += info.Size()
+		// The source is hashed before anything is decided about it, but a
+		// dry run only hashes the files whose target path is taken.
+		var hash string
+		if !opts.DryRun || targetExists {
+			if hash, err = calculateFileHash(path); err != nil {
+				fail(&c, path, "calculating hash for %s: %v", path, err)
+				return nil
 			}
-			return nil
 		}
 
-		if opts.DryRun {
-			if targetExists {
-				fmt.Printf("SKIP (target exists): %s\n", targetPath)
-			} else if isLocal {
-				fmt.Printf("Would transfer %s (%s) to %s\n", path, formatSize(info.Size()), targetPath)
+		// A taken target path holds either this very content, which makes
+		// the source a duplicate, or another file: a path conflict, settled
+		// by --on-conflict.
+		if targetExists {
+			var targetHash string
+			if isLocal {
+				targetHash, err = calculateFileHash(targetPath)
 			} else {
-				fmt.Printf("Would transfer %s (%s) to %s:%s\n", path, formatSize(info.Size()), targetHost, targetPath)
+				targetHash, err = hashRemoteFile(ctx, &host, targetPath)
 			}
-			if opts.RemoveSource && !targetExists {
-				fmt.Printf("Would remove source file %s (%s) after transfer\n", path, formatSize(info.Size()))
+			if err != nil {
+				fail(&c, path, "hashing %s: %v", targetPath, err)
+				return nil
 			}
-		} else {
-			if targetExists {
-				fmt.Printf("SKIP (target exists): %s\n", targetPath)
-				skipCount++
-				skipTotalSize += info.Size()
+			if strings.EqualFold(targetHash, hash) {
+				duplicate("target exists", targetPath)
 				return nil
 			}
 
-			// Calculate file hash
-			hash, err := calculateFileHash(path)
-			if err != nil {
-				fmt.Printf("Error calculating hash for %s: %v\n", path, err)
-				errorCount++
+			c.conflicts++
+			c.conflictsSize += info.Size()
+			switch opts.OnConflict {
+			case ImportConflictOverwrite:
+				fmt.Printf("CONFLICT (overwriting): %s differs from %s\n", path, targetPath)
+			case ImportConflictRename:
+				renamed, err := reserveRename(targetPath)
+				if err != nil {
+					fail(&c, path, "finding a free name for %s: %v", targetPath, err)
+					return nil
+				}
+				fmt.Printf("CONFLICT (renaming): %s differs from %s, importing it as %s\n", path, targetPath, filepath.Base(renamed))
+				destRel = filepath.Join(filepath.Dir(destRel), filepath.Base(renamed))
+				targetPath = renamed
+				targetLabel = names.Label(route.destRoot, destRel)
+			default:
+				fmt.Printf("SKIP (path conflict): %s differs from %s\n", path, targetPath)
 				return nil
 			}
-			transferTotalSize += info.Size()
+		}
 
-			// Check if file with this hash already exists for this host
-			var existingCount int
-			err = database.QueryRow(`
-				SELECT COUNT(*)
-				FROM files
-				WHERE hash = $1 AND hostname = $2
-			`, hash, dbHostName).Scan(&existingCount)
-			if err != nil {
-				fmt.Printf("Error querying database for hash %s: %v\n", hash, err)
-				errorCount++
+		if opts.DryRun {
+			if isLocal {
+				fmt.Printf("Would transfer %s (%s) to %s (%s)\n", path, formatSize(info.Size()), targetLabel, targetPath)
+			} else {
+				fmt.Printf("Would transfer %s (%s) to %s (%s:%s)\n", path, formatSize(info.Size()), targetLabel, targetHost, targetPath)
+			}
+			fmt.Printf("  rsync %s\n", shellJoin(transferArgs(path, targetPath)))
+			pool.locked(func() {
+				stability.observe(path, info)
+				route.plannedSize += info.Size()
+			})
+			if opts.RemoveSource {
+				fmt.Printf("Would remove source file %s (%s) after transfer\n", path, formatSize(info.Size()))
+			}
+		} else {
+			// Skip content already on the host, or being imported by
+			// another worker.
+			if !claimHash(hash) {
+				duplicate("hash exists on target host", path)
 				return nil
 			}
 
-			if existingCount > 0 {
-				if opts.DuplicateDir != "" {
-					duplicatePath := filepath.Join(opts.DuplicateDir, relPath)
-					duplicateDir := filepath.Dir(duplicatePath)
-
-					if opts.DryRun {
-						fmt.Printf("Would move duplicate %s to %s\n", path, duplicatePath)
-					} else {
-						if err := os.MkdirAll(duplicateDir, 0755); err != nil {
-							fmt.Printf("Error creating duplicate directory %s: %v\n", duplicateDir, err)
-							errorCount++
-							return nil
-						}
-
-						fmt.Printf("Moving duplicate %s (%s) to %s\n", path, formatSize(info.Size()), duplicatePath)
-						if err := os.Rename(path, duplicatePath); err != nil {
-							if strings.Contains(err.Error(), "invalid cross-device link") {
-								cmd := exec.Command("rsync", "-a", "--remove-source-files", path, duplicatePath)
-								output, rsyncErr := cmd.CombinedOutput()
-								if rsyncErr != nil {
-									fmt.Printf("Error moving duplicate file %s with rsync: %v\nOutput: %s\n", path, rsyncErr, output)
-									errorCount++
-									return nil
-								}
-							} else {
-								fmt.Printf("Error moving duplicate file %s: %v\n", path, err)
-								errorCount++
-								return nil
-							}
-						}
-
-						moveCount++
-						moveTotalSize += info.Size()
-					}
-					return nil
+			// Stop before a transfer that would eat into the headroom. The
+			// space is taken at once, so that parallel transfers cannot all
+			// be admitted to the same free space.
+			pool.locked(func() {
+				if err = route.space.admit(ctx, info.Size()); err == nil {
+					route.space.wrote(info.Size())
 				}
-
-				fmt.Printf("SKIP (hash exists on target host): %s\n", path)
-				skipCount++
-				skipTotalSize += info.Size()
-				return nil
+			})
+			if err != nil {
+				releaseHash(hash)
+				return err
 			}
 
 			// Create target directory structure first
 			targetDir := filepath.Dir(targetPath)
 			if isLocal {
 				if err := os.MkdirAll(targetDir, 0755); err != nil {
-					fmt.Printf("Error creating directory %s: %v\n", targetDir, err)
-					errorCount++
+					fail(&c, path, "creating directory %s: %v", targetDir, err)
 					return nil
 				}
 			} else {
-				mkdirCmd := exec.CommandContext(ctx, "ssh", targetHost, "mkdir", "-p", targetDir)
-				if err := mkdirCmd.Run(); err != nil {
-					fmt.Printf("Error creating directory %s: %v\n", targetDir, err)
-					errorCount++
+				err := retryTransfer(ctx, opts.TransferRetries, "mkdir on "+targetHost, func() error {
+					cmd, err := sshCommand(ctx, targetHost, sshSettings, "mkdir", "-p", targetDir)
+					if err != nil {
+						return err
+					}
+					return cmd.Run()
+				})
+				if err != nil {
+					fail(&c, path, "creating directory %s: %v", targetDir, err)
 					return nil
 				}
 			}
 
+			// Read xattrs now: the source may be removed by the transfer.
+			xattrs := captureXattrs(path, xattrWhitelist)
+
+			// A transfer can take a while; show which file it is at once.
+			pool.locked(func() { opts.Status.Event(path, statusCounters()) })
+
 			// Use rsync to transfer the file
-			var rsyncArgs []string
+			rsyncArgs := transferArgs(path, targetPath)
 			if isLocal {
-				if opts.RemoveSource {
-					rsyncArgs = []string{"-avz", "--remove-source-files", path, targetPath}
-				} else {
-					rsyncArgs = []string{"-avz", path, targetPath}
-				}
-				fmt.Printf("Transferring %s (%s) to %s\n", path, formatSize(info.Size()), targetPath)
+				fmt.Printf("Transferring %s (%s) to %s (%s)\n", path, formatSize(info.Size()), targetLabel, targetPath)
 			} else {
+				fmt.Printf("Transferring %s (%s) to %s (%s:%s)\n", path, formatSize(info.Size()), targetLabel, targetHost, targetPath)
+			}
+
+			// Once the run is cancelled no new transfer starts, but one
+			// already running is left to finish.
+			if err := ctx.Err(); err != nil {
+				releaseHash(hash)
+				return err
+			}
+			var output []byte
+			err = retryTransfer(ctx, opts.TransferRetries, "rsync of "+path, func() error {
+				var runErr error
+				output, runErr = exec.CommandContext(context.WithoutCancel(ctx), "rsync", rsyncArgs...).CombinedOutput()
+				return runErr
+			})
+			if err != nil {
+				fail(&c, path, "transferring file %s: %v\n%s", path, err, output)
+				releaseHash(hash)
+				return nil
+			}
+
+			if opts.Verify {
+				// The copy is checked even when the run was cancelled
+				// meanwhile: it is part of the transfer in flight.
+				verifyCtx := context.WithoutCancel(ctx)
+				if err := verifyImportedFile(verifyCtx, &host, isLocal, targetPath, hash); err != nil {
+					fail(&c, path, "verifying %s: %v; removing it and keeping the source", targetPath, err)
+					if err := removeImportedFile(verifyCtx, targetHost, sshSettings, isLocal, targetPath); err != nil {
+						fmt.Printf("Error removing %s: %v\n", targetPath, err)
+					}
+					releaseHash(hash)
+					return nil
+				}
+				c.verified++
 				if opts.RemoveSource {
-					rsyncArgs = []string{"-avz", "--remove-source-files", path, targetHost + ":" + targetPath}
-				} else {
-					rsyncArgs = []string{"-avz", path, targetHost + ":" + targetPath}
+					if err := os.Remove(path); err != nil {
+						fail(&c, path, "removing source file %s: %v", path, err)
+					} else {
+						c.removed++
+					}
 				}
-				fmt.Printf("Transferring %s (%s) to %s:%s\n", path, formatSize(info.Size()), targetHost, targetPath)
+			} else if opts.RemoveSource {
+				c.removed++
 			}
+			c.transferredSize += info.Size()
+			listing.add(targetPath)
 
-			rsyncCmd := exec.CommandContext(ctx, "rsync", rsyncArgs...)
+			// The row is recorded with the next batch, under the canonical
+			// hostname and the way files find stores it: relative to the
+			// root folder of the path mapping, so a later find of the
+			// destination updates this row instead of adding a second one.
+			pool.locked(func() {
+				batch.add(importRow{path: destRel, rootFolder: route.rootFolder, size: info.Size(), hash: hash, xattrs: xattrs, route: route})
+			})
+		}
 
-			output, err := rsyncCmd.CombinedOutput()
-			if err != nil {
-				fmt.Printf("Error transferring file %s: %v\n%s\n", path, err, output)
-				errorCount++
-				return nil
+		c.transferred++
+		return nil
+	}
+
+	visit := func(path string, info os.FileInfo, err error) error {
+		// Get relative path from source directory
+		relPath, relErr := filepath.Rel(opts.SourcePath, path)
+		if relErr != nil {
+			fail(&defaultRoute.importCounters, path, "getting relative path for %s: %v", path, relErr)
+			return nil
+		}
+
+		// Pick the destination from the top-level source subdirectory
+		route, destRel := defaultRoute, relPath
+		if subdir, rest, nested := strings.Cut(filepath.ToSlash(relPath), "/"); nested {
+			if routed, ok := routes[subdir]; ok {
+				route, destRel = routed, filepath.FromSlash(rest)
 			}
+		}
 
-			if opts.RemoveSource {
-				removedCount++
-			}
-
-			// Debug output: print query and parameters with canonical hostname
-			logging.InfoLogger.Printf("INSERT INTO files (path, size, hash, hostname) VALUES ('%s', %d, '%s', '%s')", targetPath, info.Size(), hash, dbHostName)
-			// Add file to database using canonical hostname
-			_, err = database.Exec(`
-				INSERT INTO files (path, size, hash, hostname)
-				VALUES ($1, $2, $3, $4)
-				ON CONFLICT (path, hostname) DO UPDATE
-				SET size = $2, hash = $3
-			`, targetPath, info.Size(), hash, dbHostName)
-			if err != nil {
-				logging.ErrorLogger.Printf("Error adding file to database: %v", err)
-				errorCount++
+		if err != nil {
+			fail(&route.importCounters, path, "accessing path %s: %v", path, err)
+			return nil
+		}
+
+		// Excluded directories are not walked at all; --include only
+		// decides about files, since any directory may hold a match.
+		if relPath != "." && opts.Exclude.Match(opts.SourcePath, relPath) {
+			if info.IsDir() {
+				fmt.Printf("SKIP (excluded): %s/\n", path)
+				excludedDirs++
+				return filepath.SkipDir
+			}
+			fmt.Printf("SKIP (excluded): %s\n", path)
+			excludedCount++
+			excludedSize += info.Size()
+			return nil
+		}
+
+		// Skip directories
+		if info.IsDir() {
+			return nil
+		}
+
+		if len(opts.Include) > 0 && !opts.Include.Match(opts.SourcePath, relPath) {
+			fmt.Printf("SKIP (not included): %s\n", path)
+			notIncluded++
+			notInclSize += info.Size()
+			return nil
+		}
+
+		if route.destRoot == "" {
+			fmt.Printf("SKIP (unrouted): %s\n", path)
+			unroutedCount++
+			unroutedSize += info.Size()
+			return nil
+		}
+
+		// Skip paths too long to survive the ssh commands and duplicate
+		// moves below; they are summarized once at the end.
+		targetPath := filepath.Join(route.destRoot, destRel)
+		checked := []string{path, targetPath}
+		if opts.DuplicateDir != "" {
+			checked = append(checked, filepath.Join(opts.DuplicateDir, relPath))
+		}
+		if !pathLengths.allow(checked...) {
+			return nil
+		}
+
+		// Check file age if specified
+		if opts.Age > 0 {
+			if time.Since(info.ModTime()) < opts.Age {
+				fmt.Printf("SKIP (too new): %s (age %s)\n", path, time.Since(info.ModTime()).Round(time.Second))
+				route.tooNew++
+				route.tooNewSize += info.Size()
+				return nil
+			}
+		}
+		if opts.MaxAge > 0 {
+			if age := time.Since(info.ModTime()); age >= opts.MaxAge {
+				fmt.Printf("SKIP (too old): %s (age %s)\n", path, age.Round(time.Second))
+				route.tooOld++
+				route.tooOldSize += info.Size()
 				return nil
 			}
 		}
 
-		transferCount++
+		// Check if we've reached the count limit
+		if opts.Count > 0 && fileCount >= opts.Count {
+			return filepath.SkipAll
+		}
+
+		// Check if context is cancelled, or a cancel file asks us to stop
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		default:
+		}
+		if err := opts.Status.CheckCancel(); err != nil {
+			return err
+		}
+
+		fileCount++
+		route.files++
+
+		job := importJob{path: path, info: info, relPath: relPath, route: route, destRel: destRel, targetPath: targetPath}
+		if pool == nil {
+			return importFile(job)
+		}
+		return pool.start(ctx, func() error { return importFile(job) })
+	}
+
+	lastErrors := 0
+	err = filepath.Walk(opts.SourcePath, func(path string, info os.FileInfo, err error) error {
+		if pool != nil {
+			pool.mu.Lock()
+			defer pool.mu.Unlock()
+		}
+		if walkErr := visit(path, info, err); walkErr != nil {
+			return walkErr
+		}
+		if err == nil && info.IsDir() {
+			return nil
+		}
+		// Errors are worth showing at once; other progress is throttled.
+		if failed := totals().errors; failed != lastErrors {
+			lastErrors = failed
+			opts.Status.Event(path, statusCounters())
+		} else {
+			opts.Status.Update(path, statusCounters())
+		}
+		if importFileHook != nil {
+			importFileHook(path)
+		}
 		return nil
 	})
+	if pool != nil {
+		// Wait for the transfers in flight, also when the walk was
+		// cancelled, so that what they did is recorded and summarized.
+		if transferErr := pool.wait(); err == nil {
+			err = transferErr
+		}
+	}
+	// The rows of the last batch are recorded however the walk ended.
+	batch.flush()
+
+	// Running out of headroom ends the run like the end of the source:
+	// the files transferred so far are recorded and summarized.
+	var stopped error
+	if errors.Is(err, errBelowHeadroom) {
+		stopped, err = err, nil
+	}
+	// writeSummary writes the --summary-json document of the run.
+	writeSummary := func(err error) error {
+		if opts.SummaryJSON == "" {
+			return nil
+		}
+		summary := importSummary{
+			Server:             displayName,
+			Hostname:           dbHostName,
+			DryRun:             opts.DryRun,
+			StartedAt:          startedAt,
+			FinishedAt:         time.Now(),
+			FilesProcessed:     fileCount,
+			Totals:             newImportSummaryCounts(totals()),
+			SkippedUnrouted:    unroutedCount,
+			SkippedExcluded:    excludedCount,
+			ExcludedDirs:       excludedDirs,
+			SkippedNotIncluded: notIncluded,
+			SkippedPathTooLong: pathLengths.skipped,
+			Errors:             failures.list,
+		}
+		summary.setResult(err, stopped)
+		if len(routes) > 0 {
+			for _, subdir := range routeNames {
+				summary.Routes = append(summary.Routes, newImportSummaryRoute(routes[subdir]))
+			}
+			if defaultRoute.destRoot != "" {
+				summary.Routes = append(summary.Routes, newImportSummaryRoute(defaultRoute))
+			}
+		}
+		return summary.write(opts.SummaryJSON, summaryOut)
+	}
 
 	if err != nil {
-		return fmt.Errorf("error walking source directory: %v", err)
+		opts.Status.Finish(statusCounters(), err)
+		if summaryErr := writeSummary(err); summaryErr != nil {
+			logging.ErrorLogger.Printf("Warning: %v", summaryErr)
+		}
+		return fmt.Errorf("error walking source directory: %w", err)
+	}
+	opts.Status.Finish(statusCounters(), stopped)
+
+	var unstable []unstableFile
+	if stability != nil {
+		unstable = stability.recheck()
 	}
 
-	fmt.Printf("\nImport summary:\n")
+	total := totals()
+	fmt.Printf("\nImport summary for %s (%s):\n", displayName, targetHost)
 	fmt.Printf("  Total files processed: %d\n", fileCount)
-	fmt.Printf("  Files transferred: %d (%s)\n", transferCount, formatSize(transferTotalSize))
-	if moveCount > 0 {
-		fmt.Printf("  Files moved to duplicates: %d (%s)\n", moveCount, formatSize(moveTotalSize))
+	conflictOutcome := map[ImportConflict]string{
+		ImportConflictOverwrite: "overwritten",
+		ImportConflictRename:    "renamed",
+	}[opts.OnConflict]
+	if conflictOutcome == "" {
+		conflictOutcome = "skipped"
+	}
+	printCounters := func(indent string, c importCounters) {
+		fmt.Printf("%sFiles transferred: %d (%s)\n", indent, c.transferred, formatSize(c.transferredSize))
+		if c.moved > 0 {
+			fmt.Printf("%sFiles moved to duplicates: %d (%s)\n", indent, c.moved, formatSize(c.movedSize))
+		}
+		if c.skipped > 0 {
+			fmt.Printf("%sFiles skipped (content already on the host): %d (%s)\n", indent, c.skipped, formatSize(c.skippedSize))
+		}
+		if c.conflicts > 0 {
+			fmt.Printf("%sPath conflicts (%s): %d (%s)\n", indent, conflictOutcome, c.conflicts, formatSize(c.conflictsSize))
+		}
+		if c.tooNew > 0 {
+			fmt.Printf("%sFiles skipped (too new): %d (%s)\n", indent, c.tooNew, formatSize(c.tooNewSize))
+		}
+		if c.tooOld > 0 {
+			fmt.Printf("%sFiles skipped (too old): %d (%s)\n", indent, c.tooOld, formatSize(c.tooOldSize))
+		}
+		if opts.Verify && !opts.DryRun {
+			fmt.Printf("%sFiles verified at the destination: %d\n", indent, c.verified)
+		}
+		if opts.RemoveSource {
+			fmt.Printf("%sSource files removed: %d\n", indent, c.removed)
+		}
+		if c.errors > 0 {
+			fmt.Printf("%sErrors: %d\n", indent, c.errors)
+		}
 	}
-	if skipCount > 0 {
-		fmt.Printf("  Files skipped (already exist): %d (%s)\n", skipCount, formatSize(skipTotalSize))
+	printCounters("  ", total)
+	if unroutedCount > 0 {
+		fmt.Printf("  Files skipped (unrouted): %d (%s)\n", unroutedCount, formatSize(unroutedSize))
 	}
-	if skipTooNewCount > 0 {
-		fmt.Printf("  Files skipped (too new): %d (%s)\n", skipTooNewCount, formatSize(skipTooNewTotalSize))
+	if excludedCount > 0 {
+		fmt.Printf("  Files skipped (excluded): %d (%s)\n", excludedCount, formatSize(excludedSize))
 	}
-	if opts.RemoveSource {
-		fmt.Printf("  Source files removed: %d\n", removedCount)
+	if excludedDirs > 0 {
+		fmt.Printf("  Directories skipped (excluded): %d\n", excludedDirs)
 	}
-	if errorCount > 0 {
-		fmt.Printf("  Errors: %d\n", errorCount)
+	if notIncluded > 0 {
+		fmt.Printf("  Files skipped (not included): %d (%s)\n", notIncluded, formatSize(notInclSize))
+	}
+	if warning := pathLengths.warning(); warning != "" {
+		fmt.Printf("  Files skipped (path too long): %d\n", pathLengths.skipped)
+		fmt.Println(warning)
 	}
 
+	if len(routes) > 0 {
+		for _, subdir := range routeNames {
+			route := routes[subdir]
+			fmt.Printf("\n  Route %s/ -> %s: %d files processed\n", subdir, route.friendly, route.files)
+			printCounters("    ", route.importCounters)
+		}
+		if defaultRoute.destRoot != "" {
+			fmt.Printf("\n  Unrouted -> %s: %d files processed\n", defaultRoute.friendly, defaultRoute.files)
+			printCounters("    ", defaultRoute.importCounters)
+		}
+	}
+
+	if stability != nil {
+		stability.printStability(unstable, time.Now())
+		for _, route := range allRoutes {
+			route.printPlannedSpace(ctx)
+		}
+	}
+
+	if stopped != nil {
+		opts.Stats.Set("stopped_below_headroom", 1)
+		fmt.Printf("\n  Import %v\n", stopped)
+	}
+	if err := writeSummary(nil); err != nil {
+		return err
+	}
+	return stopped
+}
+
+// loadHostHashes returns the SHA-256 hashes of the files on host.
+func loadHostHashes(database *sql.DB, host string) (map[string]bool, error) {
+	rows, err := database.Query(`
+		SELECT DISTINCT hash FROM files
+		WHERE hostname = $1 AND hash IS NOT NULL AND `+NotDeleted+` AND hash_algo = '`+HashAlgoSHA256+`'
+	`, host)
+	if err != nil {
+		return nil, fmt.Errorf("error loading the hashes on %s: %v", host, err)
+	}
+	defer rows.Close()
+	hashes := make(map[string]bool)
+	for rows.Next() {
+		var hash string
+		if err := rows.Scan(&hash); err != nil {
+			return nil, fmt.Errorf("error loading the hashes on %s: %v", host, err)
+		}
+		hashes[hash] = true
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error loading the hashes on %s: %v", host, err)
+	}
+	return hashes, nil
+}
+
+// importCounters tallies the outcome of an import, overall or for one route.
+type importCounters struct {
+	files           int   // Files processed
+	transferred     int   // Files transferred
+	transferredSize int64 // Total size of transferred files
+	skipped         int   // Files skipped because their content is already on the host
+	skippedSize     int64 // Total size of skipped files
+	conflicts       int   // Files whose target path holds a different file
+	conflictsSize   int64 // Total size of files with a path conflict
+	moved           int   // Files moved to the duplicate dir
+	movedSize       int64 // Total size of files moved to the duplicate dir
+	tooNew          int   // Files skipped because they are too new
+	tooNewSize      int64 // Total size of files skipped because they are too new
+	tooOld          int   // Files skipped because they are too old
+	tooOldSize      int64 // Total size of files skipped because they are too old
+	removed         int   // Files removed from the source
+	verified        int   // Transferred files whose copy hashed to the source's hash
+	errors          int
+}
+
+func (c *importCounters) add(o importCounters) {
+	c.files += o.files
+	c.transferred += o.transferred
+	c.transferredSize += o.transferredSize
+	c.skipped += o.skipped
+	c.skippedSize += o.skippedSize
+	c.conflicts += o.conflicts
+	c.conflictsSize += o.conflictsSize
+	c.moved += o.moved
+	c.movedSize += o.movedSize
+	c.tooNew += o.tooNew
+	c.tooNewSize += o.tooNewSize
+	c.tooOld += o.tooOld
+	c.tooOldSize += o.tooOldSize
+	c.removed += o.removed
+	c.verified += o.verified
+	c.errors += o.errors
+}
+
+// importRoute is a destination of an import: the default --path, or the
+// friendly path a top-level source subdirectory is routed to.
+type importRoute struct {
+	subdir     string // Top-level source subdirectory ("" for the default route)
+	friendly   string
+	rootFolder string // The mapped path, stored as root_folder like files find does
+	destRoot   string // Absolute destination with a trailing slash; "" skips the files
+	importCounters
+	space       *spaceGuard // Keeps the destination above --min-free
+	plannedSize int64       // Bytes a dry run would transfer
+}
+
+// printPlannedSpace is the dry run's space estimate for the route: it warns
+// when the files it would transfer do not fit above the --min-free floor.
+func (r *importRoute) printPlannedSpace(ctx context.Context) {
+	if r.space == nil || r.plannedSize == 0 {
+		return
+	}
+	fmt.Printf("\n  Estimated transfer to %s: %s bytes\n", r.space.label(), formatBytes(r.plannedSize))
+	if err := r.space.refresh(ctx); err != nil {
+		fmt.Printf("  Warning: could not check free space: %v\n", err)
+		return
+	}
+	floor := r.space.floor.bytesOf(r.space.space)
+	if room := r.space.space.Available - floor; r.plannedSize > room {
+		fmt.Printf("  Warning: %s bytes free with a floor of %s bytes leaves room for %s bytes; a real run would stop part way\n",
+			formatBytes(r.space.space.Available), formatBytes(floor), formatBytes(max(room, 0)))
+		return
+	}
+	fmt.Printf("  Free space: %s bytes, floor %s bytes\n", formatBytes(r.space.space.Available), formatBytes(floor))
+}
+
+// importDestRoot resolves a friendly path through the host's path mappings,
+// falling back to root_path/friendly for hosts without a mapping. It returns
+// the mapped path as files find records it in root_folder, and the same path
+// with a trailing slash as the rsync destination.
+func importDestRoot(host *db.Host, paths map[string]string, friendly string) (rootFolder, destRoot string) {
+	actualPath, exists := paths[friendly]
+	if !exists {
+		// If no mapping exists, fall back to the old behavior for backward compatibility
+		actualPath = filepath.Join(host.RootPath, friendly)
+		fmt.Printf("Warning: No path mapping found for friendly name '%s', using default path: %s\n",
+			friendly, actualPath)
+	}
+	destRoot = actualPath
+	if !strings.HasSuffix(destRoot, "/") {
+		destRoot += "/"
+	}
+	return actualPath, destRoot
+}
+
+// ParseImportRoute parses a SUBDIR=FRIENDLY routing rule for files import.
+func ParseImportRoute(rule string) (string, string, error) {
+	subdir, friendly, ok := strings.Cut(rule, "=")
+	subdir = strings.Trim(strings.TrimSpace(subdir), "/")
+	friendly = strings.TrimSpace(friendly)
+	if !ok || subdir == "" || friendly == "" {
+		return "", "", fmt.Errorf("invalid route %q: expected SUBDIR=FRIENDLY", rule)
+	}
+	if strings.Contains(subdir, "/") || subdir == "." || subdir == ".." {
+		return "", "", fmt.Errorf("invalid route %q: %s is not a top-level subdirectory", rule, subdir)
+	}
+	return subdir, friendly, nil
+}
+
+// bwLimitPattern is a --bwlimit rate as rsync takes it: a number with an
+// optional unit, such as 500, 1.5m or 2M.
+var bwLimitPattern = regexp.MustCompile(`^[0-9]+(\.[0-9]+)?[A-Za-z]*$`)
+
+// CheckImportRsyncOptions checks the --bwlimit and --rsync-opt values of files
+// import before any transfer starts. Each option must start with a dash, so
+// that it cannot be taken for a source or destination, and the source is only
+// ever removed through --remove-source.
+func CheckImportRsyncOptions(bwLimit string, options []string) error {
+	if bwLimit != "" && !bwLimitPattern.MatchString(bwLimit) {
+		return fmt.Errorf("invalid value for --bwlimit: %q (want a rate such as 500, 1.5m or 2M)", bwLimit)
+	}
+	for _, option := range options {
+		if !strings.HasPrefix(option, "-") {
+			return fmt.Errorf("invalid value for --rsync-opt: %q is not an option (pass --opt=value as one value)", option)
+		}
+		if name, _, _ := strings.Cut(option, "="); name == "--remove-source-files" {
+			return fmt.Errorf("invalid value for --rsync-opt: use --remove-source instead of %s", option)
+		}
+	}
 	return nil
 }
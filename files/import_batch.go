@@ -0,0 +1,100 @@
+package files
+
+import (
+	"database/sql"
+	"fmt"
+	"path/filepath"
+
+	"deduplicator/logging"
+)
+
+// DefaultImportBatchSize is how many transferred files files import records
+// per transaction.
+const DefaultImportBatchSize = 100
+
+// importRow is the files row of a transferred file, waiting for its batch.
+type importRow struct {
+	path       string // Relative to rootFolder
+	rootFolder string
+	size       int64
+	hash       string
+	xattrs     interface{}
+	route      *importRoute
+}
+
+// importBatch records the rows of transferred files size at a time, each
+// batch in one transaction through a prepared INSERT, instead of one
+// autocommit statement per file. failed is called for each row that could
+// not be inserted.
+type importBatch struct {
+	database *sql.DB
+	hostname string
+	hostUser string
+	size     int
+	pending  []importRow
+	failed   func(row importRow, err error)
+}
+
+// add queues row and records the batch once it is full.
+func (b *importBatch) add(row importRow) {
+	logging.InfoLogger.Printf("INSERT INTO files (path, root_folder, size, hash, hostname, added_by) VALUES ('%s', '%s', %d, '%s', '%s', '%s')", row.path, row.rootFolder, row.size, row.hash, b.hostname, OriginImport)
+	b.pending = append(b.pending, row)
+	if len(b.pending) >= b.size {
+		b.flush()
+	}
+}
+
+// flush records the pending rows. A statement that fails aborts the whole
+// transaction, so a batch that fails is rolled back and its rows inserted
+// one at a time: a bad row then costs only itself.
+func (b *importBatch) flush() {
+	if len(b.pending) == 0 {
+		return
+	}
+	rows := b.pending
+	b.pending = nil
+	err := b.insert(rows)
+	if err == nil {
+		return
+	}
+	if len(rows) > 1 {
+		logging.ErrorLogger.Printf("Warning: %v; inserting the %d rows of the batch one at a time", err, len(rows))
+		for _, row := range rows {
+			if err := b.insert([]importRow{row}); err != nil {
+				b.failed(row, err)
+			}
+		}
+		return
+	}
+	b.failed(rows[0], err)
+}
+
+func (b *importBatch) insert(rows []importRow) error {
+	tx, err := b.database.Begin()
+	if err != nil {
+		return fmt.Errorf("error starting transaction: %v", err)
+	}
+	stmt, err := tx.Prepare(`
+		INSERT INTO files (path, root_folder, size, hash, hostname, added_by, added_host_user, xattrs)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
+		ON CONFLICT (path, hostname) WHERE deleted_at IS NULL DO UPDATE
+		SET root_folder = EXCLUDED.root_folder, size = EXCLUDED.size, hash = EXCLUDED.hash, hash_algo = EXCLUDED.hash_algo,
+			xattrs = COALESCE(EXCLUDED.xattrs, files.xattrs),
+		` + preserveOrigin + `
+	`)
+	if err != nil {
+		tx.Rollback()
+		return fmt.Errorf("error preparing statement: %v", err)
+	}
+	defer stmt.Close()
+	for _, row := range rows {
+		if _, err := stmt.Exec(row.path, row.rootFolder, row.size, row.hash, b.hostname, OriginImport, b.hostUser, row.xattrs); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("error adding file %s to database: %v", filepath.Join(row.rootFolder, row.path), err)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("error committing transaction: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,66 @@
+package files
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"deduplicator/db"
+)
+
+// ImportConflict is what files import does with a source file when a
+// different file already sits at its target path (--on-conflict). The zero
+// value is ImportConflictSkip.
+type ImportConflict string
+
+const (
+	ImportConflictSkip      ImportConflict = "skip"      // leave both files where they are
+	ImportConflictOverwrite ImportConflict = "overwrite" // replace the target with the source
+	ImportConflictRename    ImportConflict = "rename"    // import the source next to the target, with a suffix
+)
+
+// ParseImportConflict parses the value of --on-conflict ("" is
+// ImportConflictSkip).
+func ParseImportConflict(value string) (ImportConflict, error) {
+	switch policy := ImportConflict(value); policy {
+	case "":
+		return ImportConflictSkip, nil
+	case ImportConflictSkip, ImportConflictOverwrite, ImportConflictRename:
+		return policy, nil
+	}
+	return "", fmt.Errorf("invalid value for --on-conflict: %q (use skip, overwrite or rename)", value)
+}
+
+// importTargetExists reports whether targetPath exists, locally or on
+// targetHost: from listing when it covers the path, over ssh otherwise.
+func importTargetExists(ctx context.Context, targetHost string, settings db.SSHSettings, isLocal bool, listing *remoteTargetList, targetPath string) (bool, error) {
+	if isLocal {
+		if _, err := os.Stat(targetPath); err == nil {
+			return true, nil
+		} else if !os.IsNotExist(err) {
+			return false, err
+		}
+		return false, nil
+	}
+	if exists, listed := listing.lookup(targetPath); listed {
+		return exists, nil
+	}
+	cmd, err := sshCommand(ctx, targetHost, settings, "test -e "+shellEscape(targetPath))
+	if err != nil {
+		return false, err
+	}
+	return cmd.Run() == nil, nil
+}
+
+// conflictRenamePath returns the n-th name --on-conflict rename tries for
+// targetPath: img.jpg becomes img-1.jpg, img-2.jpg and so on.
+func conflictRenamePath(targetPath string, n int) string {
+	ext := filepath.Ext(targetPath)
+	if ext == filepath.Base(targetPath) {
+		// A dotfile such as .profile has no extension to keep.
+		ext = ""
+	}
+	return fmt.Sprintf("%s-%d%s", strings.TrimSuffix(targetPath, ext), n, ext)
+}
@@ -0,0 +1,81 @@
+package files
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"deduplicator/db"
+)
+
+// remoteTargetList is what sits under the destinations of an import to a
+// remote host. Each destination is listed once, with ssh find, before the
+// walk, so that learning whether a target path is taken costs a map lookup
+// instead of an ssh handshake per file.
+type remoteTargetList struct {
+	mu    sync.Mutex
+	roots []string        // Destinations that were listed
+	paths map[string]bool // Everything but directories under roots
+}
+
+func newRemoteTargetList() *remoteTargetList {
+	return &remoteTargetList{paths: make(map[string]bool)}
+}
+
+// list adds what sits under destRoot on host. A destination that does not
+// exist yet lists as empty.
+func (l *remoteTargetList) list(ctx context.Context, host string, settings db.SSHSettings, destRoot string) error {
+	root := filepath.Clean(destRoot)
+	quoted := shellEscape(root)
+	cmd, err := sshCommand(ctx, host, settings, "if [ -d "+quoted+" ]; then find "+quoted+" ! -type d -print0; fi")
+	if err != nil {
+		return err
+	}
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	output, err := cmd.Output()
+	if err != nil {
+		return fmt.Errorf("%v %s", err, strings.TrimSpace(stderr.String()))
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for _, path := range bytes.Split(output, []byte{0}) {
+		if len(path) > 0 {
+			l.paths[filepath.Clean(string(path))] = true
+		}
+	}
+	l.roots = append(l.roots, root)
+	return nil
+}
+
+// lookup reports whether targetPath exists, as far as the listings tell:
+// listed is false for a path under no listed destination. A nil list has
+// listed nothing.
+func (l *remoteTargetList) lookup(targetPath string) (exists, listed bool) {
+	if l == nil {
+		return false, false
+	}
+	targetPath = filepath.Clean(targetPath)
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for _, root := range l.roots {
+		if strings.HasPrefix(targetPath, root+string(filepath.Separator)) {
+			return l.paths[targetPath], true
+		}
+	}
+	return false, false
+}
+
+// add records a file the import put at targetPath.
+func (l *remoteTargetList) add(targetPath string) {
+	if l == nil {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.paths[filepath.Clean(targetPath)] = true
+}
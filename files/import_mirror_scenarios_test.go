@@ -3,6 +3,10 @@ package files
 import (
 	"bytes"
 	"context"
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"fmt"
 	"os"
 	"path/filepath"
 	"strings"
@@ -104,8 +108,8 @@ func TestMirrorFriendlyPathCopiesMissingAndFlagsConflicts(t *testing.T) {
 	mock.ExpectQuery("SELECT path, hash FROM files WHERE hostname = \\$1 AND root_folder = \\$2 AND hash IS NOT NULL").
 		WithArgs(localHost, hostAPath).
 		WillReturnRows(sqlmock.NewRows([]string{"path", "hash"}).
-			AddRow("missing.jpg", "hash1").
-			AddRow("conflict.txt", "hashX"))
+			AddRow("conflict.txt", "hashX").
+			AddRow("missing.jpg", "hash1"))
 
 	mock.ExpectQuery("SELECT path, hash FROM files WHERE hostname = \\$1 AND root_folder = \\$2 AND hash IS NOT NULL").
 		WithArgs("remote.local", hostBPath).
@@ -121,7 +125,7 @@ func TestMirrorFriendlyPathCopiesMissingAndFlagsConflicts(t *testing.T) {
 	logging.InfoLogger = log.New(&infoBuf, "", 0)
 	logging.ErrorLogger = log.New(&errBuf, "", 0)
 
-	if err := MirrorFriendlyPath(context.Background(), db, "photos"); err != nil {
+	if err := MirrorFriendlyPath(context.Background(), db, "photos", 1); err != nil {
 		t.Fatalf("MirrorFriendlyPath error: %v", err)
 	}
 
@@ -182,13 +186,9 @@ func TestImportSkipsExistingAndHashesNewFiles(t *testing.T) {
 		WillReturnRows(sqlmock.NewRows([]string{"id", "name", "hostname", "root_path", "settings"}).
 			AddRow(1, "Backup1", lower, "/backups", []byte(`{"paths":{"photos":"`+destRoot+`"}}`)))
 
-	mock.ExpectQuery("SELECT COUNT\\(\\*\\) FROM files WHERE hash = \\$1 AND hostname = \\$2").
-		WithArgs(sqlmock.AnyArg(), lower).
-		WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(0))
+	expectImportHashes(mock, lower)
 
-	mock.ExpectExec("INSERT INTO files").
-		WithArgs(filepath.Join(destRoot, "new.txt"), int64(len("fresh")), sqlmock.AnyArg(), lower).
-		WillReturnResult(sqlmock.NewResult(1, 1))
+	expectImportBatch(mock, lower, importedRow{path: "new.txt", root: destRoot, size: int64(len("fresh"))})
 
 	stubDir := t.TempDir()
 	rsyncScript := `#!/bin/sh
@@ -232,6 +232,208 @@ exit 0
 	}
 }
 
+func TestImportWorkersTransferConcurrentlyAndImportContentOnce(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("sqlmock: %v", err)
+	}
+	defer db.Close()
+	mock.MatchExpectationsInOrder(false)
+
+	source, dest := t.TempDir(), t.TempDir()
+	contents := map[string]string{"a.txt": "one", "b.txt": "two", "c.txt": "three", "d.txt": "four", "e.txt": "one"}
+	for name, content := range contents {
+		if err := os.WriteFile(filepath.Join(source, name), []byte(content), 0644); err != nil {
+			t.Fatalf("write %s: %v", name, err)
+		}
+	}
+	expectRoutedImportHost(mock, dest)
+	hostname, _ := os.Hostname()
+	lower := strings.ToLower(hostname)
+	expectImportHashes(mock, lower)
+	mock.ExpectBegin()
+	insert := mock.ExpectPrepare("INSERT INTO files")
+	for i := 0; i < 4; i++ {
+		insert.ExpectExec().WillReturnResult(sqlmock.NewResult(1, 1))
+	}
+	mock.ExpectCommit()
+
+	// The stub notes how many transfers are in flight while it runs.
+	stubDir, inflight := t.TempDir(), t.TempDir()
+	rsyncLog := filepath.Join(t.TempDir(), "rsync.log")
+	writeStub(t, stubDir, "rsync", `#!/bin/sh
+count=$#
+src=$(eval echo \${$((count-1))})
+dst=$(eval echo \${$count})
+touch "$INFLIGHT/$(basename "$src")"
+sleep 0.3
+ls "$INFLIGHT" | wc -l >> "$RSYNC_LOG"
+rm -f "$INFLIGHT/$(basename "$src")"
+mkdir -p "$(dirname "$dst")"
+cp "$src" "$dst"
+`)
+	t.Setenv("PATH", stubDir+string(os.PathListSeparator)+os.Getenv("PATH"))
+	t.Setenv("INFLIGHT", inflight)
+	t.Setenv("RSYNC_LOG", rsyncLog)
+
+	stats := &RunStats{}
+	out := captureStdout(t, func() {
+		err = ImportFiles(context.Background(), db, ImportOptions{
+			SourcePath:   source,
+			HostName:     "Backup1",
+			FriendlyPath: "inbox",
+			Workers:      3,
+			Stats:        stats,
+		})
+	})
+	if err != nil {
+		t.Fatalf("ImportFiles: %v", err)
+	}
+
+	counters := stats.Counters()
+	if counters["files"] != 5 || counters["transferred"] != 4 || counters["skipped"] != 1 {
+		t.Errorf("unexpected counters: %v", counters)
+	}
+	if !strings.Contains(out, "SKIP (hash exists on target host)") {
+		t.Errorf("expected one of the two copies of the same content to be skipped, got:\n%s", out)
+	}
+	data, err := os.ReadFile(rsyncLog)
+	if err != nil {
+		t.Fatalf("read rsync log: %v", err)
+	}
+	concurrent := false
+	for _, line := range strings.Fields(string(data)) {
+		if line != "1" {
+			concurrent = true
+		}
+	}
+	if !concurrent {
+		t.Errorf("expected transfers to overlap, in flight: %q", data)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatalf("unmet expectations: %v", err)
+	}
+}
+
+func TestImportVerifyDeletesMismatchedCopiesAndKeepsTheirSource(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("sqlmock: %v", err)
+	}
+	defer db.Close()
+
+	source, dest := t.TempDir(), t.TempDir()
+	bad, good := filepath.Join(source, "bad.txt"), filepath.Join(source, "good.txt")
+	for path, content := range map[string]string{bad: "complete content", good: "fine"} {
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatalf("write %s: %v", path, err)
+		}
+	}
+	expectRoutedImportHost(mock, dest)
+	hostname, _ := os.Hostname()
+	lower := strings.ToLower(hostname)
+	expectImportHashes(mock, lower)
+	expectImportBatch(mock, lower, importedRow{path: "good.txt", root: filepath.Join(dest, "inbox"), size: int64(len("fine"))})
+
+	// The stub truncates bad.txt on its way over, and fails the test if it
+	// is asked to remove sources itself.
+	stubDir := t.TempDir()
+	writeStub(t, stubDir, "rsync", `#!/bin/sh
+for a in "$@"; do
+  if [ "$a" = "--remove-source-files" ]; then exit 1; fi
+done
+count=$#
+src=$(eval echo \${$((count-1))})
+dst=$(eval echo \${$count})
+mkdir -p "$(dirname "$dst")"
+case "$src" in
+  *bad.txt) head -c 4 "$src" > "$dst";;
+  *) cp "$src" "$dst";;
+esac
+`)
+	t.Setenv("PATH", stubDir+string(os.PathListSeparator)+os.Getenv("PATH"))
+
+	stats := &RunStats{}
+	out := captureStdout(t, func() {
+		err = ImportFiles(context.Background(), db, ImportOptions{
+			SourcePath:   source,
+			HostName:     "Backup1",
+			FriendlyPath: "inbox",
+			RemoveSource: true,
+			Verify:       true,
+			Stats:        stats,
+		})
+	})
+	if err != nil {
+		t.Fatalf("ImportFiles: %v", err)
+	}
+
+	if !strings.Contains(out, "Error verifying "+filepath.Join(dest, "inbox", "bad.txt")) {
+		t.Errorf("expected the truncated copy to fail verification, got:\n%s", out)
+	}
+	assertExists(t, bad, true)
+	assertExists(t, filepath.Join(dest, "inbox", "bad.txt"), false)
+	assertExists(t, good, false)
+	assertExists(t, filepath.Join(dest, "inbox", "good.txt"), true)
+	counters := stats.Counters()
+	if counters["transferred"] != 1 || counters["verified"] != 1 || counters["removed_from_source"] != 1 || counters["errors"] != 1 {
+		t.Errorf("unexpected counters: %v", counters)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatalf("unmet expectations: %v", err)
+	}
+}
+
+func TestImportCountsNothingForAFailedTransfer(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("sqlmock: %v", err)
+	}
+	defer db.Close()
+
+	source, dest := t.TempDir(), t.TempDir()
+	src := filepath.Join(source, "a.txt")
+	if err := os.WriteFile(src, []byte("data"), 0644); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	hostname, _ := os.Hostname()
+	expectRoutedImportHost(mock, dest)
+	expectImportHashes(mock, strings.ToLower(hostname))
+
+	// rsync 23: a partial transfer, which is not retried.
+	stubDir := t.TempDir()
+	writeStub(t, stubDir, "rsync", "#!/bin/sh\necho 'rsync: write failed' >&2\nexit 23\n")
+	t.Setenv("PATH", stubDir+string(os.PathListSeparator)+os.Getenv("PATH"))
+
+	stats := &RunStats{}
+	out := captureStdout(t, func() {
+		err = ImportFiles(context.Background(), db, ImportOptions{
+			SourcePath:   source,
+			HostName:     "Backup1",
+			FriendlyPath: "inbox",
+			RemoveSource: true,
+			Stats:        stats,
+		})
+	})
+	if err != nil {
+		t.Fatalf("ImportFiles: %v", err)
+	}
+
+	counters := stats.Counters()
+	if counters["transferred"] != 0 || counters["transferred_bytes"] != 0 || counters["removed_from_source"] != 0 || counters["errors"] != 1 {
+		t.Errorf("unexpected counters: %v", counters)
+	}
+	for _, want := range []string{"Error transferring file " + src, "Files transferred: 0 (0 B)", "Source files removed: 0", "Errors: 1"} {
+		if !strings.Contains(out, want) {
+			t.Errorf("expected output to contain %q, got:\n%s", want, out)
+		}
+	}
+	assertExists(t, src, true)
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatalf("unmet expectations: %v", err)
+	}
+}
+
 func TestImportWithDuplicateDirMovesConflicts(t *testing.T) {
 	db, mock, err := sqlmock.New()
 	if err != nil {
@@ -268,6 +470,7 @@ func TestImportWithDuplicateDirMovesConflicts(t *testing.T) {
 		WithArgs("Backup1").
 		WillReturnRows(sqlmock.NewRows([]string{"id", "name", "hostname", "root_path", "settings"}).
 			AddRow(1, "Backup1", lower, "/backups", []byte(`{"paths":{"photos":"`+destRoot+`"}}`)))
+	expectImportHashes(mock, lower)
 
 	stubDir := t.TempDir()
 	writeStub(t, stubDir, "rsync", "#!/bin/sh\nexit 0\n")
@@ -296,6 +499,110 @@ func TestImportWithDuplicateDirMovesConflicts(t *testing.T) {
 	}
 }
 
+func TestImportTellsPathConflictsFromDuplicates(t *testing.T) {
+	for _, tc := range []struct {
+		policy   ImportConflict
+		imported string // Where b.txt lands, "" when it is not imported
+	}{
+		{policy: ImportConflictSkip},
+		{policy: ImportConflictOverwrite, imported: "b.txt"},
+		{policy: ImportConflictRename, imported: "b-2.txt"},
+	} {
+		t.Run(string(tc.policy), func(t *testing.T) {
+			db, mock, err := sqlmock.New()
+			if err != nil {
+				t.Fatalf("sqlmock: %v", err)
+			}
+			defer db.Close()
+
+			source := t.TempDir()
+			destRoot := filepath.Join(t.TempDir(), "dest")
+			if err := os.MkdirAll(destRoot, 0755); err != nil {
+				t.Fatalf("mkdir dest: %v", err)
+			}
+			// a.txt is already at its target path, b.txt's target path
+			// holds other content and b-1.txt is taken too.
+			for name, content := range map[string]string{"a.txt": "same", "b.txt": "mine"} {
+				if err := os.WriteFile(filepath.Join(source, name), []byte(content), 0644); err != nil {
+					t.Fatalf("write: %v", err)
+				}
+			}
+			for name, content := range map[string]string{"a.txt": "same", "b.txt": "theirs", "b-1.txt": "other"} {
+				if err := os.WriteFile(filepath.Join(destRoot, name), []byte(content), 0644); err != nil {
+					t.Fatalf("write: %v", err)
+				}
+			}
+
+			hostname, _ := os.Hostname()
+			lower := strings.ToLower(hostname)
+			mock.ExpectQuery("SELECT name, ip, root_path FROM hosts").
+				WillReturnRows(sqlmock.NewRows([]string{"name", "ip", "root_path"}).AddRow("Backup1", "", "/backups"))
+			mock.ExpectQuery("SELECT hostname FROM hosts").
+				WillReturnRows(sqlmock.NewRows([]string{"hostname"}).AddRow(lower))
+			mock.ExpectQuery("SELECT id, name, hostname, root_path, settings FROM hosts").
+				WillReturnRows(sqlmock.NewRows([]string{"id", "name", "hostname", "root_path", "settings"}).
+					AddRow(1, "Backup1", lower, "/backups", []byte(`{"paths":{"photos":"`+destRoot+`"}}`)))
+			expectImportHashes(mock, lower)
+			if tc.imported != "" {
+				expectImportBatch(mock, lower, importedRow{path: tc.imported, root: destRoot, size: 4})
+			}
+
+			stubDir := t.TempDir()
+			writeStub(t, stubDir, "rsync", `#!/bin/sh
+eval src=\${$(($#-1))}
+eval dst=\${$#}
+cp "$src" "$dst"
+`)
+			t.Setenv("PATH", stubDir+string(os.PathListSeparator)+os.Getenv("PATH"))
+
+			stats := &RunStats{}
+			out := captureStdout(t, func() {
+				err = ImportFiles(context.Background(), db, ImportOptions{
+					SourcePath:   source,
+					HostName:     "Backup1",
+					FriendlyPath: "photos",
+					OnConflict:   tc.policy,
+					Stats:        stats,
+				})
+			})
+			if err != nil {
+				t.Fatalf("ImportFiles: %v", err)
+			}
+
+			counters := stats.Counters()
+			if counters["skipped"] != 1 || counters["path_conflicts"] != 1 {
+				t.Fatalf("expected one duplicate and one path conflict, got %v\n%s", counters, out)
+			}
+			if !strings.Contains(out, "SKIP (target exists): "+filepath.Join(destRoot, "a.txt")) {
+				t.Errorf("expected a.txt to be skipped as a duplicate:\n%s", out)
+			}
+			theirs, _ := os.ReadFile(filepath.Join(destRoot, "b.txt"))
+			if tc.imported == "" {
+				if counters["transferred"] != 0 || string(theirs) != "theirs" {
+					t.Fatalf("expected b.txt to be left alone, got %v and %q", counters, theirs)
+				}
+				if !strings.Contains(out, "Path conflicts (skipped): 1") {
+					t.Errorf("expected the skipped conflict in the summary:\n%s", out)
+				}
+			} else {
+				if counters["transferred"] != 1 {
+					t.Fatalf("expected b.txt to be imported, got %v", counters)
+				}
+				mine, _ := os.ReadFile(filepath.Join(destRoot, tc.imported))
+				if string(mine) != "mine" {
+					t.Fatalf("expected b.txt's content in %s, got %q", tc.imported, mine)
+				}
+				if tc.policy == ImportConflictRename && string(theirs) != "theirs" {
+					t.Fatalf("rename must keep the existing b.txt, got %q", theirs)
+				}
+			}
+			if err := mock.ExpectationsWereMet(); err != nil {
+				t.Fatalf("unmet expectations: %v", err)
+			}
+		})
+	}
+}
+
 func TestImportAgeAndRemoveSourceRules(t *testing.T) {
 	db, mock, err := sqlmock.New()
 	if err != nil {
@@ -338,13 +645,9 @@ func TestImportAgeAndRemoveSourceRules(t *testing.T) {
 		WillReturnRows(sqlmock.NewRows([]string{"id", "name", "hostname", "root_path", "settings"}).
 			AddRow(1, "Backup1", lower, "/backups", []byte(`{"paths":{"photos":"`+destRoot+`"}}`)))
 
-	mock.ExpectQuery("SELECT COUNT\\(\\*\\) FROM files WHERE hash = \\$1 AND hostname = \\$2").
-		WithArgs(sqlmock.AnyArg(), lower).
-		WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(0))
+	expectImportHashes(mock, lower)
 
-	mock.ExpectExec("INSERT INTO files").
-		WithArgs(filepath.Join(destRoot, "older.txt"), int64(1), sqlmock.AnyArg(), lower).
-		WillReturnResult(sqlmock.NewResult(1, 1))
+	expectImportBatch(mock, lower, importedRow{path: "older.txt", root: destRoot, size: 1})
 
 	stubDir := t.TempDir()
 	rsyncScript := `#!/bin/sh
@@ -369,7 +672,7 @@ exit 0
 		FriendlyPath: "photos",
 		RemoveSource: true,
 		DryRun:       false,
-		Age:          10,
+		Age:          10 * time.Minute,
 	})
 	if err != nil {
 		t.Fatalf("ImportFiles age/remove error: %v", err)
@@ -386,3 +689,952 @@ exit 0
 		t.Fatalf("unmet expectations: %v", err)
 	}
 }
+
+func TestImportAgeWindowSkipsFilesBeforeCounting(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("sqlmock: %v", err)
+	}
+	defer db.Close()
+
+	source := t.TempDir()
+	destRoot := filepath.Join(t.TempDir(), "dest")
+	if err := os.MkdirAll(destRoot, 0755); err != nil {
+		t.Fatalf("mkdir dest: %v", err)
+	}
+	// The walk meets the files outside the window before the one in it.
+	for name, age := range map[string]time.Duration{"a-fresh.txt": 0, "b-stale.txt": 3 * time.Hour, "c-mid.txt": 15 * time.Minute} {
+		path := filepath.Join(source, name)
+		if err := os.WriteFile(path, []byte(name), 0644); err != nil {
+			t.Fatalf("write: %v", err)
+		}
+		modTime := time.Now().Add(-age)
+		if err := os.Chtimes(path, modTime, modTime); err != nil {
+			t.Fatalf("chtimes: %v", err)
+		}
+	}
+
+	hostname, _ := os.Hostname()
+	lower := strings.ToLower(hostname)
+	mock.ExpectQuery("SELECT name, ip, root_path FROM hosts").
+		WillReturnRows(sqlmock.NewRows([]string{"name", "ip", "root_path"}).AddRow("Backup1", "", "/backups"))
+	mock.ExpectQuery("SELECT hostname FROM hosts").
+		WillReturnRows(sqlmock.NewRows([]string{"hostname"}).AddRow(lower))
+	mock.ExpectQuery("SELECT id, name, hostname, root_path, settings FROM hosts").
+		WillReturnRows(sqlmock.NewRows([]string{"id", "name", "hostname", "root_path", "settings"}).
+			AddRow(1, "Backup1", lower, "/backups", []byte(`{"paths":{"photos":"`+destRoot+`"}}`)))
+	expectImportHashes(mock, lower)
+	expectImportBatch(mock, lower, importedRow{path: "c-mid.txt", root: destRoot, size: int64(len("c-mid.txt"))})
+
+	stubDir := t.TempDir()
+	writeStub(t, stubDir, "rsync", `#!/bin/sh
+eval src=\${$(($#-1))}
+eval dst=\${$#}
+cp "$src" "$dst"
+`)
+	t.Setenv("PATH", stubDir+string(os.PathListSeparator)+os.Getenv("PATH"))
+
+	stats := &RunStats{}
+	out := captureStdout(t, func() {
+		err = ImportFiles(context.Background(), db, ImportOptions{
+			SourcePath:   source,
+			HostName:     "Backup1",
+			FriendlyPath: "photos",
+			Age:          10 * time.Minute,
+			MaxAge:       time.Hour,
+			Count:        1,
+			Stats:        stats,
+		})
+	})
+	if err != nil {
+		t.Fatalf("ImportFiles: %v", err)
+	}
+
+	counters := stats.Counters()
+	if counters["skipped_too_new"] != 1 || counters["skipped_too_old"] != 1 || counters["transferred"] != 1 {
+		t.Fatalf("expected one file too new, one too old and one transferred, got %v\n%s", counters, out)
+	}
+	if !strings.Contains(out, "SKIP (too old): "+filepath.Join(source, "b-stale.txt")) || !strings.Contains(out, "Files skipped (too old): 1") {
+		t.Errorf("expected the stale file to be skipped as too old:\n%s", out)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatalf("unmet expectations: %v", err)
+	}
+}
+
+func TestImportWritesSummaryJSON(t *testing.T) {
+	for _, dryRun := range []bool{true, false} {
+		t.Run(fmt.Sprintf("dry-run=%v", dryRun), func(t *testing.T) {
+			db, mock, err := sqlmock.New()
+			if err != nil {
+				t.Fatalf("sqlmock: %v", err)
+			}
+			defer db.Close()
+
+			source, dest := routedImportFixture(t)
+			hostname, _ := os.Hostname()
+			lower := strings.ToLower(hostname)
+			expectRoutedImportHost(mock, dest)
+			if !dryRun {
+				expectImportHashes(mock, lower)
+				expectImportBatch(mock, lower,
+					importedRow{path: filepath.Join("2024", "img.jpg"), root: filepath.Join(dest, "photos"), size: 19},
+					importedRow{path: filepath.Join("misc", "notes.txt"), root: filepath.Join(dest, "inbox"), size: 14})
+			}
+
+			// The transfer of report.pdf fails.
+			stubDir := t.TempDir()
+			writeStub(t, stubDir, "rsync", `#!/bin/sh
+eval src=\${$(($#-1))}
+eval dst=\${$#}
+case "$src" in *report.pdf) echo "disk on fire" >&2; exit 11;; esac
+mkdir -p "$(dirname "$dst")" && cp "$src" "$dst"
+`)
+			t.Setenv("PATH", stubDir+string(os.PathListSeparator)+os.Getenv("PATH"))
+
+			// A real run writes the document to stdout, a dry run to a file.
+			summaryFile := "-"
+			if dryRun {
+				summaryFile = filepath.Join(t.TempDir(), "summary.json")
+			}
+			out := captureStdout(t, func() {
+				err = ImportFiles(context.Background(), db, ImportOptions{
+					SourcePath:      source,
+					HostName:        "Backup1",
+					FriendlyPath:    "inbox",
+					Routes:          map[string]string{"camera": "photos"},
+					DryRun:          dryRun,
+					TransferRetries: 1,
+					SummaryJSON:     summaryFile,
+				})
+			})
+			if err != nil {
+				t.Fatalf("ImportFiles: %v", err)
+			}
+			data := []byte(out)
+			if dryRun {
+				if data, err = os.ReadFile(summaryFile); err != nil {
+					t.Fatalf("read summary: %v", err)
+				}
+			}
+
+			var summary importSummary
+			if err := json.Unmarshal(data, &summary); err != nil {
+				t.Fatalf("expected a JSON document, got %v:\n%s", err, data)
+			}
+			if summary.Result != "finished" || summary.DryRun != dryRun || summary.Hostname != lower || summary.FilesProcessed != 3 {
+				t.Fatalf("unexpected summary header: %+v", summary)
+			}
+			if len(summary.Routes) != 2 || summary.Routes[0].Subdir != "camera" || summary.Routes[0].Transferred != 1 {
+				t.Fatalf("expected the camera route and the default one, got %+v", summary.Routes)
+			}
+			if dryRun {
+				if summary.Totals.Transferred != 3 || summary.Totals.Errors != 0 || len(summary.Errors) != 0 {
+					t.Fatalf("expected the dry run to plan 3 transfers, got %+v", summary)
+				}
+			} else {
+				if summary.Totals.Transferred != 2 || summary.Totals.TransferredBytes != 33 || summary.Totals.Errors != 1 {
+					t.Fatalf("expected 2 transfers and 1 error, got %+v", summary.Totals)
+				}
+				if len(summary.Errors) != 1 || summary.Errors[0].Path != filepath.Join(source, "docs", "report.pdf") ||
+					!strings.Contains(summary.Errors[0].Error, "disk on fire") {
+					t.Fatalf("expected the failed transfer of report.pdf, got %+v", summary.Errors)
+				}
+			}
+			if err := mock.ExpectationsWereMet(); err != nil {
+				t.Fatalf("unmet expectations: %v", err)
+			}
+		})
+	}
+}
+
+func TestImportListsRemoteDestinationsOnce(t *testing.T) {
+	for _, tc := range []struct {
+		name      string
+		listFails bool
+		wantTestE int // ssh test -e calls
+	}{
+		{name: "listed"},
+		{name: "fallback", listFails: true, wantTestE: 3},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			db, mock, err := sqlmock.New()
+			if err != nil {
+				t.Fatalf("sqlmock: %v", err)
+			}
+			defer db.Close()
+
+			source := t.TempDir()
+			destRoot := filepath.Join(t.TempDir(), "dest")
+			if err := os.MkdirAll(filepath.Join(destRoot, "sub"), 0755); err != nil {
+				t.Fatalf("mkdir dest: %v", err)
+			}
+			for _, name := range []string{"a.txt", "b.txt", filepath.Join("sub", "c.txt")} {
+				if err := os.MkdirAll(filepath.Dir(filepath.Join(source, name)), 0755); err != nil {
+					t.Fatalf("mkdir: %v", err)
+				}
+				if err := os.WriteFile(filepath.Join(source, name), []byte(name), 0644); err != nil {
+					t.Fatalf("write: %v", err)
+				}
+			}
+			// sub/c.txt is already on the remote host.
+			if err := os.WriteFile(filepath.Join(destRoot, "sub", "c.txt"), []byte(filepath.Join("sub", "c.txt")), 0644); err != nil {
+				t.Fatalf("write: %v", err)
+			}
+
+			mock.ExpectQuery("SELECT name, ip, root_path FROM hosts").
+				WillReturnRows(sqlmock.NewRows([]string{"name", "ip", "root_path"}).AddRow("NAS", "", "/backups"))
+			mock.ExpectQuery("SELECT hostname FROM hosts").
+				WillReturnRows(sqlmock.NewRows([]string{"hostname"}).AddRow("nas.invalid"))
+			mock.ExpectQuery("SELECT id, name, hostname, root_path, settings FROM hosts").
+				WillReturnRows(sqlmock.NewRows([]string{"id", "name", "hostname", "root_path", "settings"}).
+					AddRow(1, "NAS", "nas.invalid", "/backups", []byte(`{"paths":{"photos":"`+destRoot+`"}}`)))
+
+			// The ssh stub logs each remote command and runs it locally.
+			stubDir := t.TempDir()
+			sshLog := filepath.Join(t.TempDir(), "ssh.log")
+			failFind := "false"
+			if tc.listFails {
+				failFind = "true"
+			}
+			writeStub(t, stubDir, "ssh", `#!/bin/sh
+shift
+echo "$*" >> `+sshLog+`
+case "$*" in *find*) if `+failFind+`; then echo "find: permission denied" >&2; exit 1; fi;; esac
+exec sh -c "$*"
+`)
+			t.Setenv("PATH", stubDir+string(os.PathListSeparator)+os.Getenv("PATH"))
+
+			out := captureStdout(t, func() {
+				err = ImportFiles(context.Background(), db, ImportOptions{
+					SourcePath:   source,
+					HostName:     "NAS",
+					FriendlyPath: "photos",
+					DryRun:       true,
+				})
+			})
+			if err != nil {
+				t.Fatalf("ImportFiles: %v", err)
+			}
+
+			logged, _ := os.ReadFile(sshLog)
+			calls := strings.Split(strings.TrimSpace(string(logged)), "\n")
+			var finds, testE int
+			for _, call := range calls {
+				switch {
+				case strings.Contains(call, "find "):
+					finds++
+				case strings.HasPrefix(call, "test -e "):
+					testE++
+				}
+			}
+			if finds != 1 || testE != tc.wantTestE {
+				t.Fatalf("expected 1 listing and %d ssh test -e, got %d and %d:\n%s", tc.wantTestE, finds, testE, logged)
+			}
+			if tc.listFails && !strings.Contains(out, "Warning: could not list nas.invalid:"+destRoot) {
+				t.Errorf("expected a warning about the failed listing:\n%s", out)
+			}
+			// Either way sub/c.txt is found to be there already.
+			if !strings.Contains(out, "SKIP (target exists): "+filepath.Join(destRoot, "sub", "c.txt")) ||
+				!strings.Contains(out, "Would transfer "+filepath.Join(source, "a.txt")) {
+				t.Errorf("expected a.txt planned and sub/c.txt skipped:\n%s", out)
+			}
+			if err := mock.ExpectationsWereMet(); err != nil {
+				t.Fatalf("unmet expectations: %v", err)
+			}
+		})
+	}
+}
+
+func TestImportSecondSessionSkipsContentImportedByFirst(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("sqlmock: %v", err)
+	}
+	defer db.Close()
+
+	logging.InfoLogger = log.New(io.Discard, "", 0)
+	logging.ErrorLogger = log.New(io.Discard, "", 0)
+
+	destRoot := filepath.Join(t.TempDir(), "dest")
+	first, second := t.TempDir(), t.TempDir()
+	if err := os.WriteFile(filepath.Join(first, "video.mkv"), []byte("same content"), 0644); err != nil {
+		t.Fatalf("write first source: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(second, "video (1).mkv"), []byte("same content"), 0644); err != nil {
+		t.Fatalf("write second source: %v", err)
+	}
+
+	// The hosts row stores the hostname in mixed case and the user types the
+	// friendly name in yet another case; files rows use the lowercased hostname.
+	hostname, _ := os.Hostname()
+	canonical := strings.ToLower(hostname)
+	expectHost := func() {
+		mock.ExpectQuery("SELECT name, ip, root_path FROM hosts WHERE LOWER\\(name\\) = LOWER\\(\\$1\\)").
+			WithArgs("backup1").
+			WillReturnRows(sqlmock.NewRows([]string{"name", "ip", "root_path"}).AddRow("Backup1", "", "/backups"))
+		mock.ExpectQuery("SELECT hostname FROM hosts WHERE LOWER\\(name\\) = LOWER\\(\\$1\\)").
+			WithArgs("backup1").
+			WillReturnRows(sqlmock.NewRows([]string{"hostname"}).AddRow(strings.ToUpper(hostname)))
+		mock.ExpectQuery("SELECT id, name, hostname, root_path, settings FROM hosts WHERE LOWER\\(name\\) = LOWER\\(\\$1\\)").
+			WithArgs("backup1").
+			WillReturnRows(sqlmock.NewRows([]string{"id", "name", "hostname", "root_path", "settings"}).
+				AddRow(1, "Backup1", strings.ToUpper(hostname), "/backups", []byte(`{"paths":{"media":"`+destRoot+`"}}`)))
+	}
+
+	sum, err := calculateFileHash(filepath.Join(first, "video.mkv"))
+	if err != nil {
+		t.Fatalf("hash: %v", err)
+	}
+	expectHost()
+	expectImportHashes(mock, canonical)
+	expectImportBatch(mock, canonical, importedRow{path: "video.mkv", root: destRoot, size: int64(len("same content")), hash: sum})
+
+	// The second session sees the row the first one inserted, under the same
+	// hash and hostname, and must skip instead of transferring again.
+	expectHost()
+	expectImportHashes(mock, canonical, sum)
+
+	stubDir := t.TempDir()
+	writeStub(t, stubDir, "rsync", `#!/bin/sh
+count=$#
+src=$(eval echo \${$((count-1))})
+dst=$(eval echo \${$count})
+mkdir -p "$(dirname "$dst")"
+cp "$src" "$dst"
+`)
+	t.Setenv("PATH", stubDir+string(os.PathListSeparator)+os.Getenv("PATH"))
+
+	for _, source := range []string{first, second} {
+		if err := ImportFiles(context.Background(), db, ImportOptions{
+			SourcePath:   source,
+			HostName:     "backup1",
+			FriendlyPath: "media",
+		}); err != nil {
+			t.Fatalf("ImportFiles(%s): %v", source, err)
+		}
+	}
+
+	if _, err := os.Stat(filepath.Join(destRoot, "video (1).mkv")); !os.IsNotExist(err) {
+		t.Fatalf("expected the second session to skip the duplicate, stat err: %v", err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatalf("unmet expectations: %v", err)
+	}
+}
+
+func routedImportFixture(t *testing.T) (source, dest string) {
+	t.Helper()
+	source, dest = t.TempDir(), t.TempDir()
+	for _, rel := range []string{"camera/2024/img.jpg", "docs/report.pdf", "misc/notes.txt"} {
+		path := filepath.Join(source, rel)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatalf("mkdir: %v", err)
+		}
+		if err := os.WriteFile(path, []byte(rel), 0644); err != nil {
+			t.Fatalf("write %s: %v", rel, err)
+		}
+	}
+	return source, dest
+}
+
+func expectRoutedImportHost(mock sqlmock.Sqlmock, dest string) {
+	hostname, _ := os.Hostname()
+	lower := strings.ToLower(hostname)
+	settings := `{"paths":{"photos":"` + dest + `/photos","documents":"` + dest + `/documents","inbox":"` + dest + `/inbox"}}`
+	mock.ExpectQuery("SELECT name, ip, root_path FROM hosts").
+		WillReturnRows(sqlmock.NewRows([]string{"name", "ip", "root_path"}).AddRow("Backup1", "", dest))
+	mock.ExpectQuery("SELECT hostname FROM hosts").
+		WillReturnRows(sqlmock.NewRows([]string{"hostname"}).AddRow(lower))
+	mock.ExpectQuery("SELECT id, name, hostname, root_path, settings FROM hosts").
+		WillReturnRows(sqlmock.NewRows([]string{"id", "name", "hostname", "root_path", "settings"}).
+			AddRow(1, "Backup1", lower, dest, []byte(settings)))
+}
+
+// expectImportHashes expects files import to load the hashes already on
+// host, and answers with hashes.
+func expectImportHashes(mock sqlmock.Sqlmock, host string, hashes ...string) {
+	rows := sqlmock.NewRows([]string{"hash"})
+	for _, hash := range hashes {
+		rows.AddRow(hash)
+	}
+	mock.ExpectQuery("SELECT DISTINCT hash FROM files WHERE hostname = \\$1").
+		WithArgs(host).
+		WillReturnRows(rows)
+}
+
+// importedRow is a files row files import is expected to record.
+type importedRow struct {
+	path string // Relative to root
+	root string
+	size int64
+	hash driver.Value // nil for any hash
+}
+
+// expectImportBatch expects files import to record rows in one transaction
+// through a prepared statement.
+func expectImportBatch(mock sqlmock.Sqlmock, host string, rows ...importedRow) {
+	mock.ExpectBegin()
+	insert := mock.ExpectPrepare("INSERT INTO files")
+	for _, row := range rows {
+		hash := row.hash
+		if hash == nil {
+			hash = sqlmock.AnyArg()
+		}
+		insert.ExpectExec().
+			WithArgs(row.path, row.root, row.size, hash, host, OriginImport, sqlmock.AnyArg(), nil).
+			WillReturnResult(sqlmock.NewResult(1, 1))
+	}
+	mock.ExpectCommit()
+}
+
+func TestImportRoutesTopLevelSubdirectories(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("sqlmock: %v", err)
+	}
+	defer db.Close()
+
+	source, dest := routedImportFixture(t)
+	expectRoutedImportHost(mock, dest)
+
+	stats := &RunStats{}
+	out := captureStdout(t, func() {
+		err = ImportFiles(context.Background(), db, ImportOptions{
+			SourcePath:   source,
+			HostName:     "Backup1",
+			FriendlyPath: "inbox",
+			DryRun:       true,
+			Routes:       map[string]string{"camera": "photos", "docs": "documents"},
+			Stats:        stats,
+		})
+	})
+	if err != nil {
+		t.Fatalf("ImportFiles: %v", err)
+	}
+
+	for _, want := range []string{
+		"to photos/2024/img.jpg on Backup1 (" + filepath.Join(dest, "photos", "2024", "img.jpg") + ")",
+		"to documents/report.pdf on Backup1 (" + filepath.Join(dest, "documents", "report.pdf") + ")",
+		"to inbox/misc/notes.txt on Backup1 (" + filepath.Join(dest, "inbox", "misc", "notes.txt") + ")",
+		"Route camera/ -> photos: 1 files processed",
+		"Route docs/ -> documents: 1 files processed",
+		"Unrouted -> inbox: 1 files processed",
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("expected output to contain %q, got:\n%s", want, out)
+		}
+	}
+	if got := stats.Counters()["files"]; got != 3 {
+		t.Errorf("expected 3 files in total, got %d", got)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatalf("unmet expectations: %v", err)
+	}
+}
+
+func TestImportStrictRoutesSkipsUnroutedSubdirectories(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("sqlmock: %v", err)
+	}
+	defer db.Close()
+
+	source, dest := routedImportFixture(t)
+	expectRoutedImportHost(mock, dest)
+
+	stats := &RunStats{}
+	out := captureStdout(t, func() {
+		err = ImportFiles(context.Background(), db, ImportOptions{
+			SourcePath:   source,
+			HostName:     "Backup1",
+			DryRun:       true,
+			Routes:       map[string]string{"camera": "photos", "docs": "documents"},
+			StrictRoutes: true,
+			Stats:        stats,
+		})
+	})
+	if err != nil {
+		t.Fatalf("ImportFiles: %v", err)
+	}
+
+	if !strings.Contains(out, "SKIP (unrouted): "+filepath.Join(source, "misc", "notes.txt")) {
+		t.Errorf("expected misc/ to be skipped, got:\n%s", out)
+	}
+	if strings.Contains(out, "Unrouted ->") || strings.Contains(out, "inbox") {
+		t.Errorf("expected no default route in strict mode, got:\n%s", out)
+	}
+	counters := stats.Counters()
+	if counters["files"] != 2 || counters["skipped_unrouted"] != 1 {
+		t.Errorf("unexpected counters: %v", counters)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatalf("unmet expectations: %v", err)
+	}
+}
+
+func TestImportExcludeAndIncludeGlobs(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("sqlmock: %v", err)
+	}
+	defer db.Close()
+
+	source, dest := routedImportFixture(t)
+	for _, rel := range []string{".DS_Store", "camera/.img.jpg.swp", "camera/cache/thumb.jpg", "camera/cache/deep/thumb2.jpg"} {
+		path := filepath.Join(source, rel)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatalf("mkdir: %v", err)
+		}
+		if err := os.WriteFile(path, []byte(rel), 0644); err != nil {
+			t.Fatalf("write %s: %v", rel, err)
+		}
+	}
+	expectRoutedImportHost(mock, dest)
+
+	exclude, err := ParsePathExcludes([]string{".DS_Store", "*.swp", "**/cache/"})
+	if err != nil {
+		t.Fatalf("ParsePathExcludes: %v", err)
+	}
+	include, err := ParsePathIncludes([]string{"**/*.jpg", "docs/**"})
+	if err != nil {
+		t.Fatalf("ParsePathIncludes: %v", err)
+	}
+	stats := &RunStats{}
+	out := captureStdout(t, func() {
+		err = ImportFiles(context.Background(), db, ImportOptions{
+			SourcePath:   source,
+			HostName:     "Backup1",
+			FriendlyPath: "inbox",
+			DryRun:       true,
+			Exclude:      exclude,
+			Include:      include,
+			Stats:        stats,
+		})
+	})
+	if err != nil {
+		t.Fatalf("ImportFiles: %v", err)
+	}
+
+	for _, want := range []string{
+		"SKIP (excluded): " + filepath.Join(source, ".DS_Store"),
+		"SKIP (excluded): " + filepath.Join(source, "camera", ".img.jpg.swp"),
+		"SKIP (excluded): " + filepath.Join(source, "camera", "cache") + "/",
+		"SKIP (not included): " + filepath.Join(source, "misc", "notes.txt"),
+		"Files skipped (excluded): 2",
+		"Directories skipped (excluded): 1",
+		"Files skipped (not included): 1",
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("expected output to contain %q, got:\n%s", want, out)
+		}
+	}
+	if strings.Contains(out, "thumb") {
+		t.Errorf("expected the excluded directory not to be walked, got:\n%s", out)
+	}
+	counters := stats.Counters()
+	if counters["files"] != 2 || counters["skipped_excluded"] != 2 || counters["skipped_excluded_dirs"] != 1 || counters["skipped_not_included"] != 1 {
+		t.Errorf("unexpected counters: %v", counters)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatalf("unmet expectations: %v", err)
+	}
+}
+
+func TestImportRecordsRowsInBatchesAndIsolatesAFailingRow(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("sqlmock: %v", err)
+	}
+	defer db.Close()
+
+	logging.ErrorLogger = log.New(io.Discard, "", 0)
+	source, dest := routedImportFixture(t)
+	expectRoutedImportHost(mock, dest)
+	hostname, _ := os.Hostname()
+	lower := strings.ToLower(hostname)
+	img := importedRow{path: filepath.Join("camera", "2024", "img.jpg"), root: filepath.Join(dest, "inbox"), size: 19}
+	report := importedRow{path: filepath.Join("docs", "report.pdf"), root: filepath.Join(dest, "inbox"), size: 15}
+	notes := importedRow{path: filepath.Join("misc", "notes.txt"), root: filepath.Join(dest, "inbox"), size: 14}
+	expectImportHashes(mock, lower)
+
+	// The first batch of two fails on its second row and is rolled back;
+	// its rows are then tried one at a time.
+	mock.ExpectBegin()
+	insert := mock.ExpectPrepare("INSERT INTO files")
+	insert.ExpectExec().WithArgs(img.path, img.root, img.size, sqlmock.AnyArg(), lower, OriginImport, sqlmock.AnyArg(), nil).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	insert.ExpectExec().WithArgs(report.path, report.root, report.size, sqlmock.AnyArg(), lower, OriginImport, sqlmock.AnyArg(), nil).
+		WillReturnError(errors.New("value too long"))
+	mock.ExpectRollback()
+	expectImportBatch(mock, lower, img)
+	mock.ExpectBegin()
+	mock.ExpectPrepare("INSERT INTO files").ExpectExec().
+		WithArgs(report.path, report.root, report.size, sqlmock.AnyArg(), lower, OriginImport, sqlmock.AnyArg(), nil).
+		WillReturnError(errors.New("value too long"))
+	mock.ExpectRollback()
+	// The last file goes in a batch of its own once the walk is done.
+	expectImportBatch(mock, lower, notes)
+
+	stubDir := t.TempDir()
+	writeStub(t, stubDir, "rsync", `#!/bin/sh
+count=$#
+src=$(eval echo \${$((count-1))})
+dst=$(eval echo \${$count})
+mkdir -p "$(dirname "$dst")"
+cp "$src" "$dst"
+`)
+	t.Setenv("PATH", stubDir+string(os.PathListSeparator)+os.Getenv("PATH"))
+
+	stats := &RunStats{}
+	captureStdout(t, func() {
+		err = ImportFiles(context.Background(), db, ImportOptions{
+			SourcePath:   source,
+			HostName:     "Backup1",
+			FriendlyPath: "inbox",
+			BatchSize:    2,
+			Stats:        stats,
+		})
+	})
+	if err != nil {
+		t.Fatalf("ImportFiles: %v", err)
+	}
+	if counters := stats.Counters(); counters["transferred"] != 2 || counters["errors"] != 1 {
+		t.Errorf("unexpected counters: %v", counters)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatalf("unmet expectations: %v", err)
+	}
+}
+
+func TestImportPassesRsyncOptionsAsSeparateArguments(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("sqlmock: %v", err)
+	}
+	defer db.Close()
+
+	source, dest := t.TempDir(), t.TempDir()
+	src := filepath.Join(source, "a.txt")
+	if err := os.WriteFile(src, []byte("data"), 0644); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	target := filepath.Join(dest, "inbox", "a.txt")
+	hostname, _ := os.Hostname()
+	lower := strings.ToLower(hostname)
+	expectRoutedImportHost(mock, dest)
+	expectRoutedImportHost(mock, dest)
+	expectImportHashes(mock, lower)
+	expectImportBatch(mock, lower, importedRow{path: "a.txt", root: filepath.Join(dest, "inbox"), size: 4})
+
+	// The stub logs one argument per line, then copies the file.
+	stubDir := t.TempDir()
+	rsyncLog := filepath.Join(t.TempDir(), "rsync.log")
+	writeStub(t, stubDir, "rsync", `#!/bin/sh
+for a in "$@"; do echo "$a" >> "$RSYNC_LOG"; done
+count=$#
+src=$(eval echo \${$((count-1))})
+dst=$(eval echo \${$count})
+mkdir -p "$(dirname "$dst")"
+cp "$src" "$dst"
+`)
+	t.Setenv("PATH", stubDir+string(os.PathListSeparator)+os.Getenv("PATH"))
+	t.Setenv("RSYNC_LOG", rsyncLog)
+
+	opts := ImportOptions{
+		SourcePath:   source,
+		HostName:     "Backup1",
+		FriendlyPath: "inbox",
+		BwLimit:      "500",
+		RsyncOptions: []string{"--partial", "--rsh=ssh -p 2222"},
+		DryRun:       true,
+	}
+	out := captureStdout(t, func() { err = ImportFiles(context.Background(), db, opts) })
+	if err != nil {
+		t.Fatalf("ImportFiles dry run: %v", err)
+	}
+	if want := "  rsync -avz --bwlimit=500 --partial '--rsh=ssh -p 2222' " + src + " " + target + "\n"; !strings.Contains(out, want) {
+		t.Errorf("expected the dry run to show %q, got:\n%s", want, out)
+	}
+
+	opts.DryRun = false
+	captureStdout(t, func() { err = ImportFiles(context.Background(), db, opts) })
+	if err != nil {
+		t.Fatalf("ImportFiles: %v", err)
+	}
+	data, err := os.ReadFile(rsyncLog)
+	if err != nil {
+		t.Fatalf("read rsync log: %v", err)
+	}
+	want := strings.Join([]string{"-avz", "--bwlimit=500", "--partial", "--rsh=ssh -p 2222", src, target}, "\n") + "\n"
+	if string(data) != want {
+		t.Errorf("expected rsync arguments\n%s\ngot\n%s", want, data)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatalf("unmet expectations: %v", err)
+	}
+}
+
+func TestCheckImportRsyncOptions(t *testing.T) {
+	if err := CheckImportRsyncOptions("1.5m", []string{"--partial", "--timeout=60", "-z"}); err != nil {
+		t.Fatalf("CheckImportRsyncOptions: %v", err)
+	}
+	for _, bad := range []struct {
+		bwLimit string
+		options []string
+	}{
+		{bwLimit: "fast"},
+		{bwLimit: "500; rm -rf /"},
+		{options: []string{"/etc/passwd"}},
+		{options: []string{"--remove-source-files"}},
+	} {
+		if err := CheckImportRsyncOptions(bad.bwLimit, bad.options); err == nil {
+			t.Errorf("expected %q %q to be rejected", bad.bwLimit, bad.options)
+		}
+	}
+}
+
+func TestParseImportRoute(t *testing.T) {
+	subdir, friendly, err := ParseImportRoute(" camera/ = photos ")
+	if err != nil || subdir != "camera" || friendly != "photos" {
+		t.Fatalf("ParseImportRoute = %q, %q, %v", subdir, friendly, err)
+	}
+	for _, bad := range []string{"camera", "=photos", "camera=", "a/b=photos", "..=photos"} {
+		if _, _, err := ParseImportRoute(bad); err == nil {
+			t.Errorf("expected %q to be rejected", bad)
+		}
+	}
+}
+
+func TestImportStatusFileShowsProgressAndHonoursCancelFile(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("sqlmock: %v", err)
+	}
+	defer db.Close()
+
+	source, dest := routedImportFixture(t)
+	expectRoutedImportHost(mock, dest)
+
+	statusPath := filepath.Join(t.TempDir(), "import.json")
+	clk := &fakeClock{now: at(9, 0)}
+	status, err := newStatusWriter(statusPath, "files import", clk)
+	if err != nil {
+		t.Fatalf("newStatusWriter: %v", err)
+	}
+
+	// Walk order: camera/2024/img.jpg, docs/report.pdf, misc/notes.txt.
+	var midRun *RunStatus
+	importFileHook = func(path string) {
+		switch filepath.Base(path) {
+		case "img.jpg":
+			// The injected tick: the next update is due.
+			clk.now = clk.now.Add(statusInterval)
+		case "report.pdf":
+			midRun = readStatus(t, statusPath)
+			if err := os.WriteFile(statusPath+".cancel", nil, 0644); err != nil {
+				t.Fatalf("write cancel file: %v", err)
+			}
+		}
+	}
+	t.Cleanup(func() { importFileHook = nil })
+
+	captureStdout(t, func() {
+		err = ImportFiles(context.Background(), db, ImportOptions{
+			SourcePath:   source,
+			HostName:     "Backup1",
+			FriendlyPath: "inbox",
+			DryRun:       true,
+			Routes:       map[string]string{"camera": "photos", "docs": "documents"},
+			Status:       status,
+		})
+	})
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected the cancel file to stop the import like a cancellation, got %v", err)
+	}
+
+	if midRun == nil || midRun.State != "running" || midRun.Counters["processed"] != 2 ||
+		midRun.CurrentFile != filepath.Join(source, "docs", "report.pdf") || !midRun.UpdatedAt.Equal(at(9, 0).Add(statusInterval)) {
+		t.Fatalf("unexpected mid-run status %+v", midRun)
+	}
+	final := readStatus(t, statusPath)
+	if final.State != "cancelled" || final.Counters["processed"] != 2 {
+		t.Fatalf("expected a cancelled status after two files, got %+v", final)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatalf("unmet expectations: %v", err)
+	}
+}
+
+// recordArg matches any argument and keeps it, so a later expectation can
+// require the same value.
+type recordArg struct{ value *driver.Value }
+
+func (a recordArg) Match(v driver.Value) bool {
+	*a.value = v
+	return true
+}
+
+func TestImportedRowIsTheOneFindUpdates(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("sqlmock: %v", err)
+	}
+	defer db.Close()
+
+	source := t.TempDir()
+	destRoot := filepath.Join(t.TempDir(), "dest")
+	if err := os.MkdirAll(filepath.Join(source, "2024"), 0755); err != nil {
+		t.Fatalf("mkdir: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(source, "2024", "img.jpg"), []byte("jpeg"), 0644); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	hostname, _ := os.Hostname()
+	lower := strings.ToLower(hostname)
+	settings := []byte(`{"paths":{"photos":"` + destRoot + `"}}`)
+
+	mock.ExpectQuery("SELECT name, ip, root_path FROM hosts").
+		WillReturnRows(sqlmock.NewRows([]string{"name", "ip", "root_path"}).AddRow("Backup1", "", "/backups"))
+	mock.ExpectQuery("SELECT hostname FROM hosts").
+		WillReturnRows(sqlmock.NewRows([]string{"hostname"}).AddRow(lower))
+	mock.ExpectQuery("SELECT id, name, hostname, root_path, settings FROM hosts").
+		WillReturnRows(sqlmock.NewRows([]string{"id", "name", "hostname", "root_path", "settings"}).
+			AddRow(1, "Backup1", lower, "/backups", settings))
+	expectImportHashes(mock, lower)
+	var path, root driver.Value
+	mock.ExpectBegin()
+	mock.ExpectPrepare("INSERT INTO files").ExpectExec().
+		WithArgs(recordArg{&path}, recordArg{&root}, int64(4), sqlmock.AnyArg(), lower, OriginImport, sqlmock.AnyArg(), nil).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectCommit()
+
+	stubDir := t.TempDir()
+	writeStub(t, stubDir, "rsync", `#!/bin/sh
+eval src=\${$(($#-1))}
+eval dst=\${$#}
+mkdir -p "$(dirname "$dst")" && cp "$src" "$dst"
+`)
+	t.Setenv("PATH", stubDir+string(os.PathListSeparator)+os.Getenv("PATH"))
+
+	captureStdout(t, func() {
+		if err := ImportFiles(context.Background(), db, ImportOptions{SourcePath: source, HostName: "Backup1", FriendlyPath: "photos"}); err != nil {
+			t.Fatalf("ImportFiles: %v", err)
+		}
+	})
+	if path != filepath.Join("2024", "img.jpg") || root != destRoot {
+		t.Fatalf("expected img.jpg recorded as 2024/img.jpg under %s, got %v under %v", destRoot, path, root)
+	}
+
+	// files find of the destination must upsert the same (path, hostname)
+	// key, so it updates the imported row instead of adding a second one.
+	mock.ExpectQuery("SELECT id, name, hostname, ip, root_path, settings, created_at FROM hosts WHERE name = \\$1").
+		WithArgs("Backup1").
+		WillReturnRows(sqlmock.NewRows([]string{"id", "name", "hostname", "ip", "root_path", "settings", "created_at"}).
+			AddRow(1, "Backup1", lower, "", "/backups", settings, time.Now()))
+	mock.ExpectBegin()
+	insert := mock.ExpectPrepare("INSERT INTO files")
+	lookup := mock.ExpectPrepare("SELECT id, path, COALESCE\\(root_folder, ''\\), size, mod_time")
+	mock.ExpectPrepare("UPDATE files SET path")
+	lookup.ExpectQuery().
+		WithArgs(lower, sqlmock.AnyArg(), sqlmock.AnyArg()).
+		WillReturnRows(inodeRows())
+	insert.ExpectQuery().
+		WithArgs(path, lower, int64(4), root, sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg(), OriginFind, sqlmock.AnyArg(), nil).
+		WillReturnRows(insertedRow(false))
+	mock.ExpectCommit()
+
+	if err := FindFiles(context.Background(), db, FindOptions{Server: "Backup1", Path: "photos"}); err != nil {
+		t.Fatalf("FindFiles: %v", err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatalf("unmet expectations: %v", err)
+	}
+}
+
+func TestImportReachesRemoteHostWithItsSSHSettings(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("sqlmock: %v", err)
+	}
+	defer db.Close()
+
+	source := t.TempDir()
+	destRoot := filepath.Join(t.TempDir(), "dest")
+	if err := os.MkdirAll(filepath.Join(source, "2024"), 0755); err != nil {
+		t.Fatalf("mkdir: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(source, "2024", "img.jpg"), []byte("img"), 0644); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+
+	settings := `{"paths":{"photos":"` + destRoot + `"},"ssh":{"user":"backup","port":2222,"identity_file":"/keys/nas","options":["BatchMode=yes"]}}`
+	mock.ExpectQuery("SELECT name, ip, root_path FROM hosts").
+		WillReturnRows(sqlmock.NewRows([]string{"name", "ip", "root_path"}).AddRow("NAS", "", "/backups"))
+	mock.ExpectQuery("SELECT hostname FROM hosts").
+		WillReturnRows(sqlmock.NewRows([]string{"hostname"}).AddRow("nas.invalid"))
+	mock.ExpectQuery("SELECT id, name, hostname, root_path, settings FROM hosts").
+		WillReturnRows(sqlmock.NewRows([]string{"id", "name", "hostname", "root_path", "settings"}).
+			AddRow(1, "NAS", "nas.invalid", "/backups", []byte(settings)))
+	expectImportHashes(mock, "nas.invalid")
+	expectImportBatch(mock, "nas.invalid", importedRow{path: filepath.Join("2024", "img.jpg"), root: destRoot, size: 3})
+
+	// The stubs log their argv, one [arg] each. ssh drops its options and
+	// the host and runs the command locally; rsync copies to the path after
+	// the host.
+	stubDir := t.TempDir()
+	logDir := t.TempDir()
+	sshLog, rsyncLog := filepath.Join(logDir, "ssh.log"), filepath.Join(logDir, "rsync.log")
+	writeStub(t, stubDir, "ssh", `#!/bin/sh
+printf '[%s]' "$@" >> `+sshLog+`
+echo >> `+sshLog+`
+while [ "${1#-}" != "$1" ]; do shift 2; done
+shift
+exec sh -c "$*"
+`)
+	writeStub(t, stubDir, "rsync", `#!/bin/sh
+printf '[%s]' "$@" >> `+rsyncLog+`
+echo >> `+rsyncLog+`
+count=$#
+src=$(eval echo \${$((count-1))})
+dst=$(eval echo \${$count})
+dst=${dst#*:}
+mkdir -p "$(dirname "$dst")"
+cp "$src" "$dst"
+`)
+	t.Setenv("PATH", stubDir+string(os.PathListSeparator)+os.Getenv("PATH"))
+
+	captureStdout(t, func() {
+		err = ImportFiles(context.Background(), db, ImportOptions{
+			SourcePath:   source,
+			HostName:     "NAS",
+			FriendlyPath: "photos",
+		})
+	})
+	if err != nil {
+		t.Fatalf("ImportFiles: %v", err)
+	}
+
+	logged, _ := os.ReadFile(sshLog)
+	calls := strings.Split(strings.TrimSpace(string(logged)), "\n")
+	if len(calls) != 2 {
+		t.Fatalf("expected the listing and the mkdir over ssh, got:\n%s", logged)
+	}
+	for _, call := range calls {
+		if !strings.HasPrefix(call, "[-p][2222][-i][/keys/nas][-l][backup][-o][BatchMode=yes][nas.invalid][") {
+			t.Errorf("expected ssh to connect with the host's settings, got %s", call)
+		}
+	}
+	target := filepath.Join(destRoot, "2024", "img.jpg")
+	logged, _ = os.ReadFile(rsyncLog)
+	want := "[-avz][-e][ssh -p 2222 -i /keys/nas -l backup -o BatchMode=yes][" + filepath.Join(source, "2024", "img.jpg") + "][nas.invalid:" + target + "]"
+	if got := strings.TrimSpace(string(logged)); got != want {
+		t.Fatalf("unexpected rsync argv:\n got %s\nwant %s", got, want)
+	}
+	if _, err := os.Stat(target); err != nil {
+		t.Fatalf("expected the file on the destination: %v", err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatalf("unmet expectations: %v", err)
+	}
+}
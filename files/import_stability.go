@@ -0,0 +1,136 @@
+package files
+
+import (
+	"container/heap"
+	"fmt"
+	"os"
+	"sort"
+	"time"
+)
+
+// importStabilitySample is how many planned transfers an import dry run
+// re-stats once its walk is done: all of them when there are fewer, otherwise
+// the most recently modified ones, which are the files likely still being
+// written to.
+const importStabilitySample = 1000
+
+// importAgeMargin is added to the age of the newest file seen when suggesting
+// an --age value, so that a writer pausing briefly is still skipped.
+const importAgeMargin = 10 * time.Minute
+
+// stabilityEntry is the size and mtime of a file when the walk saw it.
+type stabilityEntry struct {
+	path    string
+	size    int64
+	modTime time.Time
+}
+
+// stabilityHeap is a min-heap on modTime, so the oldest sampled file is the
+// one dropped when a newer file comes along.
+type stabilityHeap []stabilityEntry
+
+func (h stabilityHeap) Len() int           { return len(h) }
+func (h stabilityHeap) Less(i, j int) bool { return h[i].modTime.Before(h[j].modTime) }
+func (h stabilityHeap) Swap(i, j int)      { h[i], h[j] = h[j], h[i] }
+func (h *stabilityHeap) Push(x any)        { *h = append(*h, x.(stabilityEntry)) }
+func (h *stabilityHeap) Pop() any {
+	old := *h
+	e := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return e
+}
+
+// stabilityCheck samples the files a dry run would transfer so that they can
+// be re-stated after the walk; a file that changed in between is still being
+// written, and the real run would copy it half done.
+type stabilityCheck struct {
+	limit   int
+	seen    int
+	entries stabilityHeap
+	newest  time.Time
+}
+
+func newStabilityCheck(limit int) *stabilityCheck {
+	return &stabilityCheck{limit: limit}
+}
+
+// observe records path as the walk saw it.
+func (c *stabilityCheck) observe(path string, info os.FileInfo) {
+	c.seen++
+	e := stabilityEntry{path: path, size: info.Size(), modTime: info.ModTime()}
+	if e.modTime.After(c.newest) {
+		c.newest = e.modTime
+	}
+	if len(c.entries) < c.limit {
+		heap.Push(&c.entries, e)
+	} else if len(c.entries) > 0 && e.modTime.After(c.entries[0].modTime) {
+		c.entries[0] = e
+		heap.Fix(&c.entries, 0)
+	}
+}
+
+// unstableFile is a sampled file whose size or mtime changed after the walk
+// saw it, or that is gone.
+type unstableFile struct {
+	Path       string
+	SizeBefore int64
+	SizeAfter  int64
+	Gone       bool
+}
+
+func (u unstableFile) String() string {
+	if u.Gone {
+		return fmt.Sprintf("%s (removed during the walk)", u.Path)
+	}
+	return fmt.Sprintf("%s (%s -> %s bytes)", u.Path, formatBytes(u.SizeBefore), formatBytes(u.SizeAfter))
+}
+
+// recheck re-stats the sample and returns the files that changed, by path.
+// Changed files also move newest forward.
+func (c *stabilityCheck) recheck() []unstableFile {
+	var unstable []unstableFile
+	for _, e := range c.entries {
+		info, err := os.Stat(e.path)
+		if err != nil {
+			unstable = append(unstable, unstableFile{Path: e.path, SizeBefore: e.size, Gone: true})
+			continue
+		}
+		if info.Size() == e.size && info.ModTime().Equal(e.modTime) {
+			continue
+		}
+		if info.ModTime().After(c.newest) {
+			c.newest = info.ModTime()
+		}
+		unstable = append(unstable, unstableFile{Path: e.path, SizeBefore: e.size, SizeAfter: info.Size()})
+	}
+	sort.Slice(unstable, func(i, j int) bool { return unstable[i].Path < unstable[j].Path })
+	return unstable
+}
+
+// suggestImportAge returns an --age, in whole minutes, that skips every file
+// modified as recently as newest.
+func suggestImportAge(newest, now time.Time) time.Duration {
+	since := now.Sub(newest)
+	if since < 0 {
+		since = 0
+	}
+	return since.Round(time.Minute) + importAgeMargin
+}
+
+// printStability reports the outcome of recheck in the import summary.
+func (c *stabilityCheck) printStability(unstable []unstableFile, now time.Time) {
+	if c.seen == 0 {
+		return
+	}
+	if len(unstable) == 0 {
+		fmt.Printf("\n  Re-checked %d of %d planned files: none changed during the walk\n", len(c.entries), c.seen)
+		return
+	}
+	fmt.Printf("\n  Unstable files: %d of %d re-checked changed during the walk\n", len(unstable), len(c.entries))
+	for _, u := range unstable {
+		fmt.Printf("    unstable — still being written: %s\n", u)
+	}
+	age := suggestImportAge(c.newest, now)
+	fmt.Printf("  A real run would copy them half written; re-run with --age %dm to skip files modified in the last %d minutes\n",
+		int(age/time.Minute), int(age/time.Minute))
+}
@@ -0,0 +1,146 @@
+package files
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+func TestStabilityCheckKeepsNewestFiles(t *testing.T) {
+	dir := t.TempDir()
+	c := newStabilityCheck(2)
+	base := time.Date(2024, 5, 1, 10, 0, 0, 0, time.UTC)
+	for i, name := range []string{"a", "b", "c", "d"} {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte(name), 0644); err != nil {
+			t.Fatalf("write: %v", err)
+		}
+		// b and d are the newest.
+		mtime := base.Add(time.Duration([]int{1, 4, 2, 3}[i]) * time.Hour)
+		if err := os.Chtimes(path, mtime, mtime); err != nil {
+			t.Fatalf("chtimes: %v", err)
+		}
+		info, _ := os.Stat(path)
+		c.observe(path, info)
+	}
+
+	var sampled []string
+	for _, e := range c.entries {
+		sampled = append(sampled, filepath.Base(e.path))
+	}
+	if c.seen != 4 || len(sampled) != 2 || !strings.Contains(strings.Join(sampled, ","), "b") || !strings.Contains(strings.Join(sampled, ","), "d") {
+		t.Fatalf("expected b and d sampled out of 4, got %v (seen %d)", sampled, c.seen)
+	}
+	if !c.newest.Equal(base.Add(4 * time.Hour)) {
+		t.Fatalf("newest = %v", c.newest)
+	}
+	if unstable := c.recheck(); len(unstable) != 0 {
+		t.Fatalf("unchanged files reported unstable: %v", unstable)
+	}
+}
+
+func TestSuggestImportAgeRoundsUpWithMargin(t *testing.T) {
+	now := time.Date(2024, 5, 1, 10, 0, 0, 0, time.UTC)
+	cases := []struct {
+		newest time.Time
+		want   time.Duration
+	}{
+		{now, importAgeMargin},
+		{now.Add(-90 * time.Second), importAgeMargin + 2*time.Minute},
+		{now.Add(time.Minute), importAgeMargin}, // clock skew
+	}
+	for _, c := range cases {
+		if got := suggestImportAge(c.newest, now); got != c.want {
+			t.Errorf("suggestImportAge(%v) = %v, want %v", now.Sub(c.newest), got, c.want)
+		}
+	}
+}
+
+func TestImportDryRunWarnsAboutFilesStillBeingWritten(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("sqlmock: %v", err)
+	}
+	defer db.Close()
+
+	source, dest := routedImportFixture(t)
+	expectRoutedImportHost(mock, dest)
+
+	// The "download" keeps growing after the walk has seen it, and the
+	// notes are deleted before the re-check.
+	growing := filepath.Join(source, "docs", "report.pdf")
+	importFileHook = func(path string) {
+		switch filepath.Base(path) {
+		case "report.pdf":
+			if err := os.WriteFile(growing, []byte("a much longer report, still downloading"), 0644); err != nil {
+				t.Fatalf("grow: %v", err)
+			}
+		case "notes.txt":
+			if err := os.Remove(path); err != nil {
+				t.Fatalf("remove: %v", err)
+			}
+		}
+	}
+	t.Cleanup(func() { importFileHook = nil })
+
+	out := captureStdout(t, func() {
+		err = ImportFiles(context.Background(), db, ImportOptions{
+			SourcePath:   source,
+			HostName:     "Backup1",
+			FriendlyPath: "inbox",
+			DryRun:       true,
+			Routes:       map[string]string{"camera": "photos", "docs": "documents"},
+		})
+	})
+	if err != nil {
+		t.Fatalf("ImportFiles: %v", err)
+	}
+
+	for _, want := range []string{
+		"Unstable files: 2 of 3 re-checked changed during the walk",
+		"unstable — still being written: " + growing + " (15 -> 39 bytes)",
+		"unstable — still being written: " + filepath.Join(source, "misc", "notes.txt") + " (removed during the walk)",
+		"re-run with --age 10m",
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("output does not mention %q:\n%s", want, out)
+		}
+	}
+	if strings.Contains(out, "still being written: "+filepath.Join(source, "camera")) {
+		t.Errorf("the stable photo was reported:\n%s", out)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatalf("unmet expectations: %v", err)
+	}
+}
+
+func TestImportDryRunReportsStableWalk(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("sqlmock: %v", err)
+	}
+	defer db.Close()
+
+	source, dest := routedImportFixture(t)
+	expectRoutedImportHost(mock, dest)
+
+	out := captureStdout(t, func() {
+		err = ImportFiles(context.Background(), db, ImportOptions{
+			SourcePath:   source,
+			HostName:     "Backup1",
+			FriendlyPath: "inbox",
+			DryRun:       true,
+		})
+	})
+	if err != nil {
+		t.Fatalf("ImportFiles: %v", err)
+	}
+	if !strings.Contains(out, "Re-checked 3 of 3 planned files: none changed during the walk") || strings.Contains(out, "Unstable") {
+		t.Fatalf("unexpected stability report:\n%s", out)
+	}
+}
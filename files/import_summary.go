@@ -0,0 +1,152 @@
+package files
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+// importFailure is a file files import counted as an error, and why.
+type importFailure struct {
+	Path  string `json:"path"`
+	Error string `json:"error"`
+}
+
+// importFailures collects the failures of a run for --summary-json. It has a
+// lock of its own, since the walk reports failures while holding the pool's.
+type importFailures struct {
+	mu   sync.Mutex
+	list []importFailure
+}
+
+func (f *importFailures) add(path, msg string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.list = append(f.list, importFailure{Path: path, Error: msg})
+}
+
+// importSummary is the JSON document files import --summary-json writes when
+// the run ends: the counters of the printed summary, the result of the run
+// and the files that failed.
+type importSummary struct {
+	Server     string    `json:"server"`
+	Hostname   string    `json:"hostname"`
+	DryRun     bool      `json:"dry_run"`
+	StartedAt  time.Time `json:"started_at"`
+	FinishedAt time.Time `json:"finished_at"`
+	Result     string    `json:"result"` // finished, stopped (--min-free), cancelled or failed
+	Error      string    `json:"error,omitempty"`
+
+	FilesProcessed     int                  `json:"files_processed"`
+	Totals             importSummaryCounts  `json:"totals"`
+	SkippedUnrouted    int                  `json:"skipped_unrouted"`
+	SkippedExcluded    int                  `json:"skipped_excluded"`
+	ExcludedDirs       int                  `json:"skipped_excluded_dirs"`
+	SkippedNotIncluded int                  `json:"skipped_not_included"`
+	SkippedPathTooLong int64                `json:"skipped_path_too_long"`
+	Routes             []importSummaryRoute `json:"routes,omitempty"`
+	Errors             []importFailure      `json:"errors"`
+}
+
+// importSummaryCounts are the counters of a run or of one route. Skipped
+// files are those whose content is already on the host.
+type importSummaryCounts struct {
+	Transferred            int   `json:"transferred"`
+	TransferredBytes       int64 `json:"transferred_bytes"`
+	Skipped                int   `json:"skipped"`
+	SkippedBytes           int64 `json:"skipped_bytes"`
+	PathConflicts          int   `json:"path_conflicts"`
+	PathConflictsBytes     int64 `json:"path_conflicts_bytes"`
+	MovedToDuplicates      int   `json:"moved_to_duplicates"`
+	MovedToDuplicatesBytes int64 `json:"moved_to_duplicates_bytes"`
+	SkippedTooNew          int   `json:"skipped_too_new"`
+	SkippedTooNewBytes     int64 `json:"skipped_too_new_bytes"`
+	SkippedTooOld          int   `json:"skipped_too_old"`
+	SkippedTooOldBytes     int64 `json:"skipped_too_old_bytes"`
+	RemovedFromSource      int   `json:"removed_from_source"`
+	Verified               int   `json:"verified"`
+	Errors                 int   `json:"errors"`
+}
+
+type importSummaryRoute struct {
+	Subdir         string `json:"subdir"` // "" for the files that go to --path
+	Friendly       string `json:"friendly_path"`
+	FilesProcessed int    `json:"files_processed"`
+	importSummaryCounts
+}
+
+func newImportSummaryCounts(c importCounters) importSummaryCounts {
+	return importSummaryCounts{
+		Transferred:            c.transferred,
+		TransferredBytes:       c.transferredSize,
+		Skipped:                c.skipped,
+		SkippedBytes:           c.skippedSize,
+		PathConflicts:          c.conflicts,
+		PathConflictsBytes:     c.conflictsSize,
+		MovedToDuplicates:      c.moved,
+		MovedToDuplicatesBytes: c.movedSize,
+		SkippedTooNew:          c.tooNew,
+		SkippedTooNewBytes:     c.tooNewSize,
+		SkippedTooOld:          c.tooOld,
+		SkippedTooOldBytes:     c.tooOldSize,
+		RemovedFromSource:      c.removed,
+		Verified:               c.verified,
+		Errors:                 c.errors,
+	}
+}
+
+func newImportSummaryRoute(r *importRoute) importSummaryRoute {
+	return importSummaryRoute{
+		Subdir:              r.subdir,
+		Friendly:            r.friendly,
+		FilesProcessed:      r.files,
+		importSummaryCounts: newImportSummaryCounts(r.importCounters),
+	}
+}
+
+// setResult records how the run ended: err is what it stopped with, stopped
+// the headroom error of a run that ran out of space.
+func (s *importSummary) setResult(err, stopped error) {
+	switch {
+	case err == nil && stopped == nil:
+		s.Result = "finished"
+	case err == nil:
+		s.Result, s.Error = "stopped", stopped.Error()
+	case errors.Is(err, context.Canceled):
+		s.Result, s.Error = "cancelled", err.Error()
+	default:
+		s.Result, s.Error = "failed", err.Error()
+	}
+}
+
+// write encodes the summary to w, or replaces the file at path through a
+// temporary file and rename, so a reader never sees a partial document.
+func (s *importSummary) write(path string, w io.Writer) error {
+	if s.Errors == nil {
+		s.Errors = []importFailure{}
+	}
+	data, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return fmt.Errorf("error encoding import summary: %v", err)
+	}
+	data = append(data, '\n')
+	if w != nil {
+		if _, err := w.Write(data); err != nil {
+			return fmt.Errorf("error writing import summary: %v", err)
+		}
+		return nil
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return fmt.Errorf("error writing import summary %s: %v", tmp, err)
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return fmt.Errorf("error writing import summary %s: %v", path, err)
+	}
+	return nil
+}
@@ -0,0 +1,49 @@
+package files
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+
+	"deduplicator/db"
+)
+
+// verifyImportedFile re-hashes the copy files import --verify left at
+// targetPath, locally or with the host's hash command over ssh, and returns
+// an error unless it matches hash, the SHA-256 of the source.
+func verifyImportedFile(ctx context.Context, host *db.Host, isLocal bool, targetPath, hash string) error {
+	var sum string
+	var err error
+	if isLocal {
+		sum, err = calculateFileHash(targetPath)
+	} else {
+		sum, err = hashRemoteFile(ctx, host, targetPath)
+	}
+	if err != nil {
+		return fmt.Errorf("cannot hash the copy: %v", err)
+	}
+	if !strings.EqualFold(sum, hash) {
+		return fmt.Errorf("the copy hashes to %s, expected %s", sum, hash)
+	}
+	return nil
+}
+
+// removeImportedFile deletes a copy that failed verification, so that a
+// truncated transfer is not taken for the file by a later import.
+func removeImportedFile(ctx context.Context, targetHost string, settings db.SSHSettings, isLocal bool, targetPath string) error {
+	if isLocal {
+		if err := os.Remove(targetPath); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	}
+	cmd, err := sshCommand(ctx, targetHost, settings, "rm -f -- "+shellEscape(targetPath))
+	if err != nil {
+		return err
+	}
+	if output, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("%v %s", err, strings.TrimSpace(string(output)))
+	}
+	return nil
+}
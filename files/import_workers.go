@@ -0,0 +1,90 @@
+package files
+
+import (
+	"context"
+	"os"
+	"sync"
+)
+
+// importJob is a file the walk of files import has admitted: it passed the
+// route, path length, age and --count checks and awaits its transfer.
+type importJob struct {
+	path       string
+	info       os.FileInfo
+	relPath    string // Relative to the source directory
+	route      *importRoute
+	destRel    string // Relative to the route's destination
+	targetPath string
+}
+
+// importPool runs the transfers of files import --workers N, at most N at a
+// time. mu guards the counters and everything else the walk shares with the
+// transfers: the walk holds it while it runs and lets go only while it
+// waits for a free worker, and the transfers take it through locked.
+type importPool struct {
+	mu    sync.Mutex
+	slots chan struct{}
+	wg    sync.WaitGroup
+	err   error // First error a transfer stopped the run with
+}
+
+// newImportPool returns a pool of workers transfers, or nil for one: the
+// walk then transfers each file itself.
+func newImportPool(workers int) *importPool {
+	if workers <= 1 {
+		return nil
+	}
+	return &importPool{slots: make(chan struct{}, workers)}
+}
+
+// locked runs f holding mu. A nil pool runs it as it is.
+func (p *importPool) locked(f func()) {
+	if p == nil {
+		f()
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	f()
+}
+
+// start runs transfer once a worker is free. It is called with mu held and
+// returns the error of an earlier transfer that stopped the run, or ctx's
+// error when the run is cancelled while it waits; either ends the walk.
+func (p *importPool) start(ctx context.Context, transfer func() error) error {
+	if p.err != nil {
+		return p.err
+	}
+	p.mu.Unlock()
+	select {
+	case p.slots <- struct{}{}:
+	case <-ctx.Done():
+		p.mu.Lock()
+		return ctx.Err()
+	}
+	p.mu.Lock()
+	if p.err != nil {
+		<-p.slots
+		return p.err
+	}
+
+	p.wg.Add(1)
+	go func() {
+		defer p.wg.Done()
+		err := transfer()
+		p.mu.Lock()
+		if err != nil && p.err == nil {
+			p.err = err
+		}
+		p.mu.Unlock()
+		<-p.slots
+	}()
+	return nil
+}
+
+// wait waits for the transfers in flight and returns the first error that
+// stopped the run.
+func (p *importPool) wait() error {
+	p.wg.Wait()
+	return p.err
+}
@@ -48,7 +48,7 @@ func TestProcessStdinOnlyInsertsRegularFiles(t *testing.T) {
 	mock.ExpectBegin()
 	mock.ExpectPrepare("INSERT INTO files").
 		ExpectExec().
-		WithArgs(regular, "host-row", int64(len("ok"))).
+		WithArgs(regular, "host-row", int64(len("ok")), OriginUpdate, currentHostUser()).
 		WillReturnResult(sqlmock.NewResult(1, 1))
 	mock.ExpectCommit()
 
@@ -65,7 +65,7 @@ func TestProcessStdinOnlyInsertsRegularFiles(t *testing.T) {
 		w.WriteString(fifo + "\n")
 	}()
 
-	if err := ProcessStdin(context.Background(), db); err != nil {
+	if err := ProcessStdin(context.Background(), db, UpdateOptions{}); err != nil {
 		t.Fatalf("ProcessStdin error: %v", err)
 	}
 
@@ -74,6 +74,81 @@ func TestProcessStdinOnlyInsertsRegularFiles(t *testing.T) {
 	}
 }
 
+func TestProcessStdinNamesTheRealRegistrationCommand(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("sqlmock: %v", err)
+	}
+	defer db.Close()
+
+	hostname, _ := os.Hostname()
+	lower := strings.ToLower(hostname)
+	mock.ExpectQuery("SELECT name FROM hosts WHERE LOWER\\(hostname\\) = LOWER\\(\\$1\\)").
+		WithArgs(lower).
+		WillReturnError(sql.ErrNoRows)
+
+	err = ProcessStdin(context.Background(), db, UpdateOptions{})
+	want := "please add it using 'deduplicator manage server-add " + lower + " --hostname " + lower + "', or rerun with --register"
+	if err == nil || !strings.Contains(err.Error(), want) {
+		t.Fatalf("expected %q, got %v", want, err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatalf("unmet expectations: %v", err)
+	}
+}
+
+func TestProcessStdinRegisterCreatesMissingHost(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("sqlmock: %v", err)
+	}
+	defer db.Close()
+
+	temp := t.TempDir()
+	regular := filepath.Join(temp, "file.txt")
+	if err := os.WriteFile(regular, []byte("ok"), 0644); err != nil {
+		t.Fatalf("write regular: %v", err)
+	}
+
+	hostname, _ := os.Hostname()
+	lower := strings.ToLower(hostname)
+	mock.ExpectQuery("SELECT name FROM hosts WHERE LOWER\\(hostname\\) = LOWER\\(\\$1\\)").
+		WithArgs(lower).
+		WillReturnError(sql.ErrNoRows)
+	mock.ExpectQuery("SELECT EXISTS \\(SELECT 1 FROM hosts WHERE LOWER\\(hostname\\) = LOWER\\(\\$1\\)\\)").
+		WithArgs(lower).
+		WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(false))
+	mock.ExpectExec("INSERT INTO hosts \\(name, hostname, ip, root_path, settings\\)\\s+VALUES \\(\\$1, \\$1, '', '', \\$2\\)").
+		WithArgs(lower, sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectQuery("SELECT name FROM hosts WHERE LOWER\\(hostname\\) = LOWER\\(\\$1\\)").
+		WithArgs(lower).
+		WillReturnRows(sqlmock.NewRows([]string{"name"}).AddRow(lower))
+
+	mock.ExpectBegin()
+	mock.ExpectPrepare("INSERT INTO files").
+		ExpectExec().
+		WithArgs(regular, lower, int64(len("ok")), OriginUpdate, currentHostUser()).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectCommit()
+
+	r, w, _ := os.Pipe()
+	orig := os.Stdin
+	os.Stdin = r
+	defer func() { os.Stdin = orig }()
+	go func() {
+		defer w.Close()
+		w.WriteString(regular + "\n")
+	}()
+
+	if err := ProcessStdin(context.Background(), db, UpdateOptions{Register: true}); err != nil {
+		t.Fatalf("ProcessStdin error: %v", err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatalf("unmet expectations: %v", err)
+	}
+}
+
 func TestFindFilesStoresRootFolder(t *testing.T) {
 	db, mock, err := sqlmock.New()
 	if err != nil {
@@ -97,12 +172,16 @@ func TestFindFilesStoresRootFolder(t *testing.T) {
 
 	mock.ExpectBegin()
 	prep := mock.ExpectPrepare("INSERT INTO files")
-	prep.ExpectExec().
-		WithArgs("a.txt", "backup1.local", sqlmock.AnyArg(), root).
-		WillReturnResult(sqlmock.NewResult(1, 1))
-	prep.ExpectExec().
-		WithArgs("nested.txt", "backup1.local", sqlmock.AnyArg(), root).
-		WillReturnResult(sqlmock.NewResult(1, 1))
+	lookup := mock.ExpectPrepare("SELECT id, path, COALESCE\\(root_folder, ''\\), size, mod_time")
+	mock.ExpectPrepare("UPDATE files SET path")
+	for _, name := range []string{"a.txt", "nested.txt"} {
+		lookup.ExpectQuery().
+			WithArgs("backup1.local", sqlmock.AnyArg(), sqlmock.AnyArg()).
+			WillReturnRows(sqlmock.NewRows([]string{"id", "path", "root_folder", "size", "mod_time"}))
+		prep.ExpectQuery().
+			WithArgs(name, "backup1.local", sqlmock.AnyArg(), root, sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg(), OriginFind, currentHostUser(), nil).
+			WillReturnRows(insertedRow(true))
+	}
 	mock.ExpectCommit()
 
 	if err := FindFiles(context.Background(), db, FindOptions{Server: "Backup1", Path: "photos"}); err != nil {
@@ -127,16 +206,11 @@ func TestHashFilesOnlyUnhashedByDefault(t *testing.T) {
 		t.Fatalf("write file: %v", err)
 	}
 
-	mock.ExpectQuery(`SELECT id, name, hostname, ip, root_path, settings, created_at FROM hosts WHERE LOWER\(hostname\) = LOWER\(\$1\)`).
-		WithArgs("backup1.local").
-		WillReturnRows(sqlmock.NewRows([]string{"id", "name", "hostname", "ip", "root_path", "settings", "created_at"}).
-			AddRow(1, "Backup1", "backup1.local", "", "/root", []byte(`{}`), time.Now()))
-
-	mock.ExpectQuery(`(?s)SELECT COUNT\(\*\) FROM files.*WHERE LOWER\(hostname\) = LOWER\(\$1\).*AND hash IS NULL.*AND size IS NOT NULL.*HAVING COUNT\(\*\) > 1`).
+	mock.ExpectQuery(`(?s)SELECT COUNT\(\*\) FROM files.*WHERE hostname = \$1.*AND hash IS NULL.*AND size IS NOT NULL.*HAVING COUNT\(\*\) > 1`).
 		WithArgs("backup1.local").
 		WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(0))
 
-	if err := HashFiles(context.Background(), db, HashOptions{Server: "backup1.local"}); err != nil {
+	if err := HashFiles(context.Background(), db, HashOptions{Host: backup1Host("/root", `{}`)}); err != nil {
 		t.Fatalf("HashFiles error: %v", err)
 	}
 
@@ -158,16 +232,11 @@ func TestHashFilesRetriesProblematic(t *testing.T) {
 		t.Fatalf("write file: %v", err)
 	}
 
-	mock.ExpectQuery(`SELECT id, name, hostname, ip, root_path, settings, created_at FROM hosts WHERE LOWER\(hostname\) = LOWER\(\$1\)`).
-		WithArgs("backup1.local").
-		WillReturnRows(sqlmock.NewRows([]string{"id", "name", "hostname", "ip", "root_path", "settings", "created_at"}).
-			AddRow(1, "Backup1", "backup1.local", "", "/root", []byte(`{}`), time.Now()))
-
-	mock.ExpectQuery(`(?s)SELECT COUNT\(\*\) FROM files.*WHERE LOWER\(hostname\) = LOWER\(\$1\).*AND \(hash IS NULL OR hash IN \('TIMEOUT_ERROR', 'HASH_ERROR'\)\).*AND size IS NOT NULL.*HAVING COUNT\(\*\) > 1`).
+	mock.ExpectQuery(`(?s)SELECT COUNT\(\*\) FROM files.*WHERE hostname = \$1.*AND hash IS NULL AND NOT EXISTS \(SELECT 1 FROM file_errors fe WHERE fe.file_id = files.id AND fe.kind = 'permanent'\)\s+AND size IS NOT NULL.*HAVING COUNT\(\*\) > 1`).
 		WithArgs("backup1.local").
 		WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(0))
 
-	if err := HashFiles(context.Background(), db, HashOptions{Server: "backup1.local", RetryProblematic: true}); err != nil {
+	if err := HashFiles(context.Background(), db, HashOptions{Host: backup1Host("/root", `{}`), RetryProblematic: true}); err != nil {
 		t.Fatalf("HashFiles retry error: %v", err)
 	}
 
@@ -189,16 +258,11 @@ func TestHashFilesForceRehashesExisting(t *testing.T) {
 		t.Fatalf("write file: %v", err)
 	}
 
-	mock.ExpectQuery(`SELECT id, name, hostname, ip, root_path, settings, created_at FROM hosts WHERE LOWER\(hostname\) = LOWER\(\$1\)`).
-		WithArgs("backup1.local").
-		WillReturnRows(sqlmock.NewRows([]string{"id", "name", "hostname", "ip", "root_path", "settings", "created_at"}).
-			AddRow(1, "Backup1", "backup1.local", "", "/root", []byte(`{}`), time.Now()))
-
-	mock.ExpectQuery(`(?s)SELECT COUNT\(\*\) FROM files.*WHERE LOWER\(hostname\) = LOWER\(\$1\).*AND size IS NOT NULL.*HAVING COUNT\(\*\) > 1`).
+	mock.ExpectQuery(`(?s)SELECT COUNT\(\*\) FROM files.*WHERE hostname = \$1.*AND size IS NOT NULL.*HAVING COUNT\(\*\) > 1`).
 		WithArgs("backup1.local").
 		WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(0))
 
-	if err := HashFiles(context.Background(), db, HashOptions{Server: "backup1.local", Refresh: true}); err != nil {
+	if err := HashFiles(context.Background(), db, HashOptions{Host: backup1Host("/root", `{}`), Refresh: true}); err != nil {
 		t.Fatalf("HashFiles refresh error: %v", err)
 	}
 
@@ -206,22 +270,3 @@ func TestHashFilesForceRehashesExisting(t *testing.T) {
 		t.Fatalf("unmet expectations: %v", err)
 	}
 }
-
-func TestHashFilesFailsWhenHostUnknown(t *testing.T) {
-	db, mock, err := sqlmock.New()
-	if err != nil {
-		t.Fatalf("sqlmock: %v", err)
-	}
-	defer db.Close()
-
-	mock.ExpectQuery("SELECT id, name, hostname, ip, root_path, settings, created_at FROM hosts WHERE LOWER\\(hostname\\) = LOWER\\(\\$1\\)").
-		WithArgs("missing").
-		WillReturnError(sql.ErrNoRows)
-	mock.ExpectQuery("SELECT id, name, hostname, ip, root_path, settings, created_at FROM hosts WHERE name = \\$1").
-		WithArgs("missing").
-		WillReturnError(sql.ErrNoRows)
-
-	if err := HashFiles(context.Background(), db, HashOptions{Server: "missing"}); err == nil {
-		t.Fatalf("expected error for unknown host")
-	}
-}
@@ -0,0 +1,383 @@
+package files
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+
+	"deduplicator/db"
+)
+
+// groupJournalFile is kept in the destination directory while the files of a
+// duplicate group are being moved. It lists the planned moves and how far each
+// one got, so a run that dies part way through a group can be finished or
+// undone instead of leaving the catalog half updated.
+const groupJournalFile = ".deduplicator-journal.json"
+
+// journalAction is one planned move. Each action takes two steps, in order:
+// the file is moved from Source to Target, then its files row is soft-deleted,
+// or rewritten to NewHost, NewRoot and NewPath when the target is on a
+// tracked remote destination. With Link set (--symlink), a relative symlink
+// to the kept copy at Link is left at Source in between.
+type journalAction struct {
+	Path       string          `json:"path"` // files.path of the row
+	Host       string          `json:"host"`
+	RootFolder string          `json:"root_folder,omitempty"`
+	Source     string          `json:"source"`
+	Target     string          `json:"target"`
+	Remote     string          `json:"remote,omitempty"` // ssh host holding Target, if not this machine
+	SSH        *db.SSHSettings `json:"ssh,omitempty"`    // ssh settings of Remote, if it has any
+	NewHost    string          `json:"new_host,omitempty"`
+	NewRoot    string          `json:"new_root,omitempty"`
+	NewPath    string          `json:"new_path,omitempty"`
+	Link       string          `json:"link,omitempty"` // kept copy to symlink Source to once moved
+	Moved      bool            `json:"moved"`
+	Linked     bool            `json:"linked,omitempty"`
+	RowDeleted bool            `json:"row_deleted"`
+	Failed     bool            `json:"failed,omitempty"` // the move failed and was skipped; file and row are untouched
+}
+
+// moveToTarget moves the file of a from Source to Target.
+func (a journalAction) moveToTarget() error {
+	if a.Remote != "" {
+		return moveToRemote(context.Background(), a.Remote, a.sshSettings(), a.Source, a.Target)
+	}
+	return moveJournaledFile(a.Source, a.Target)
+}
+
+// moveToSource moves the file of a back from Target to Source.
+func (a journalAction) moveToSource() error {
+	if a.Remote != "" {
+		return moveFromRemote(context.Background(), a.Remote, a.sshSettings(), a.Target, a.Source)
+	}
+	return moveJournaledFile(a.Target, a.Source)
+}
+
+// sshSettings returns how to reach Remote.
+func (a journalAction) sshSettings() db.SSHSettings {
+	if a.SSH == nil {
+		return db.SSHSettings{}
+	}
+	return *a.SSH
+}
+
+// linkToKeeper leaves a relative symlink to the kept copy at Source. It
+// refuses when the kept copy is missing, so it never creates a dangling link,
+// and is a no-op when the link is already in place.
+func (a journalAction) linkToKeeper() error {
+	rel, err := filepath.Rel(filepath.Dir(a.Source), a.Link)
+	if err != nil {
+		return fmt.Errorf("error linking %s to %s: %v", a.Source, a.Link, err)
+	}
+	if existing, err := os.Readlink(a.Source); err == nil && existing == rel {
+		return nil
+	}
+	if info, err := os.Stat(a.Link); err != nil || !info.Mode().IsRegular() {
+		return fmt.Errorf("kept copy %s is missing, not linking %s to it", a.Link, a.Source)
+	}
+	if err := os.Symlink(rel, a.Source); err != nil {
+		return fmt.Errorf("error linking %s to %s: %v", a.Source, a.Link, err)
+	}
+	return nil
+}
+
+// unlinkFromKeeper removes the symlink linkToKeeper left at Source, leaving
+// anything that is not a symlink alone.
+func (a journalAction) unlinkFromKeeper() error {
+	info, err := os.Lstat(a.Source)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil || info.Mode()&os.ModeSymlink == 0 {
+		return fmt.Errorf("not removing %s: it is no longer the symlink to %s", a.Source, a.Link)
+	}
+	return os.Remove(a.Source)
+}
+
+// groupJournal records the actions planned for a single duplicate group.
+type groupJournal struct {
+	Hash    string          `json:"hash"`
+	Size    int64           `json:"size,omitempty"` // of each copy, for the move manifest
+	Started time.Time       `json:"started"`
+	Actions []journalAction `json:"actions"`
+
+	path            string
+	skipFailedMoves bool // a failed move is skipped instead of stopping the group
+}
+
+// groupJournalRows updates the catalog for journaled actions. DedupFiles and
+// MoveDuplicates identify rows differently, so each supplies its own.
+// markDeleted reports whether it updated the row; one it could not update is
+// counted, not returned as an error.
+type groupJournalRows struct {
+	markDeleted func(a journalAction) (bool, error)
+	restore     func(a journalAction) error
+}
+
+// rowErrorCount counts the rows a run failed to update after moving their
+// file. Such a row still lists the file where it was, so the count goes into
+// the run summary instead of a warning that scrolls by. A nil count counts
+// nothing.
+type rowErrorCount struct {
+	n int64
+}
+
+func (c *rowErrorCount) add() {
+	if c != nil {
+		c.n++
+	}
+}
+
+// print adds the count to the summary, if any update failed.
+func (c *rowErrorCount) print() {
+	if c.n > 0 {
+		fmt.Printf("Failed to update %d rows of moved files in the database; files prune removes them\n", c.n)
+	}
+}
+
+// record adds the count to the run summary.
+func (c *rowErrorCount) record(stats *RunStats) {
+	stats.Set("db_errors", c.n)
+}
+
+// journalStepHook, when set, runs after every completed journal step. Tests
+// use it to stop a group part way through, as a crash would.
+var journalStepHook func() error
+
+func newGroupJournal(dir, hash string, size int64, actions []journalAction) *groupJournal {
+	return &groupJournal{
+		Hash:    hash,
+		Size:    size,
+		Started: time.Now(),
+		Actions: actions,
+		path:    filepath.Join(dir, groupJournalFile),
+	}
+}
+
+// loadGroupJournal returns the journal left in dir, or nil if there is none.
+func loadGroupJournal(dir string) (*groupJournal, error) {
+	path := filepath.Join(dir, groupJournalFile)
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error reading journal %s: %v", path, err)
+	}
+	var j groupJournal
+	if err := json.Unmarshal(data, &j); err != nil {
+		return nil, fmt.Errorf("error decoding journal %s: %v", path, err)
+	}
+	j.path = path
+	return &j, nil
+}
+
+// save writes the journal through a temporary file and a rename, so a crash
+// never leaves a truncated journal behind.
+func (j *groupJournal) save() error {
+	data, err := json.MarshalIndent(j, "", "  ")
+	if err != nil {
+		return fmt.Errorf("error encoding journal: %v", err)
+	}
+	tmp := j.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return fmt.Errorf("error writing journal %s: %v", tmp, err)
+	}
+	if err := os.Rename(tmp, j.path); err != nil {
+		return fmt.Errorf("error writing journal %s: %v", j.path, err)
+	}
+	return nil
+}
+
+func (j *groupJournal) step() error {
+	if err := j.save(); err != nil {
+		return err
+	}
+	if journalStepHook != nil {
+		return journalStepHook()
+	}
+	return nil
+}
+
+// failed returns the number of actions whose move failed and was skipped.
+func (j *groupJournal) failed() int64 {
+	var n int64
+	for _, a := range j.Actions {
+		if a.Failed {
+			n++
+		}
+	}
+	return n
+}
+
+// progress returns the completed and total number of steps.
+func (j *groupJournal) progress() (int, int) {
+	done, total := 0, 0
+	for _, a := range j.Actions {
+		if a.Moved {
+			done++
+		}
+		if a.Linked {
+			done++
+		}
+		if a.RowDeleted {
+			done++
+		}
+		if a.Link != "" {
+			total++
+		}
+	}
+	return done, total + 2*len(j.Actions)
+}
+
+// forward performs the remaining steps in journal order and removes the
+// journal once all of them are done. A move whose source is gone but whose
+// target exists is taken as already done. Each finished move is added to the
+// move manifest next to the journal, noting a row markDeleted left alone.
+// With skipFailedMoves, a move that fails is marked Failed and the other
+// actions go on.
+func (j *groupJournal) forward(rows groupJournalRows) error {
+	for i := range j.Actions {
+		a := &j.Actions[i]
+		if a.Failed {
+			continue
+		}
+		if !a.Moved {
+			if err := a.moveToTarget(); err != nil {
+				if !j.skipFailedMoves {
+					return err
+				}
+				log.Printf("Warning: Skipping %s: %v", a.Source, err)
+				a.Failed = true
+				if err := j.step(); err != nil {
+					return err
+				}
+				continue
+			}
+			a.Moved = true
+			if err := j.step(); err != nil {
+				return err
+			}
+		}
+		if a.Link != "" && !a.Linked {
+			if err := a.linkToKeeper(); err != nil {
+				return err
+			}
+			a.Linked = true
+			if err := j.step(); err != nil {
+				return err
+			}
+		}
+		if !a.RowDeleted {
+			updated, err := rows.markDeleted(*a)
+			if err != nil {
+				return fmt.Errorf("error deleting file %s from database: %v", a.Path, err)
+			}
+			moved := newMovedFile(j, *a)
+			moved.RowKept = !updated
+			if err := appendMoveManifest(filepath.Dir(j.path), moved); err != nil {
+				return err
+			}
+			a.RowDeleted = true
+			if err := j.step(); err != nil {
+				return err
+			}
+		}
+	}
+	return os.Remove(j.path)
+}
+
+// back undoes the completed steps in reverse order, restoring rows, removing
+// symlinks and moving files back to their source, and removes the journal once nothing is left.
+func (j *groupJournal) back(rows groupJournalRows) error {
+	for i := len(j.Actions) - 1; i >= 0; i-- {
+		a := &j.Actions[i]
+		if a.RowDeleted {
+			if err := rows.restore(*a); err != nil {
+				return fmt.Errorf("error restoring file %s in database: %v", a.Path, err)
+			}
+			a.RowDeleted = false
+			if err := j.step(); err != nil {
+				return err
+			}
+		}
+		if a.Linked {
+			if err := a.unlinkFromKeeper(); err != nil {
+				return err
+			}
+			a.Linked = false
+			if err := j.step(); err != nil {
+				return err
+			}
+		}
+		if a.Moved {
+			if err := a.moveToSource(); err != nil {
+				return err
+			}
+			a.Moved = false
+			if err := j.step(); err != nil {
+				return err
+			}
+		}
+	}
+	return os.Remove(j.path)
+}
+
+// recoverGroupJournal deals with a journal left in dir by an interrupted run.
+// Without a recovery mode it reports the journal and refuses to continue; in
+// dry-run mode it only reports it.
+func recoverGroupJournal(dir, mode string, dryRun bool, rows groupJournalRows) error {
+	if mode != "" && mode != "forward" && mode != "back" {
+		return fmt.Errorf("invalid value for --recover: %q (use forward or back)", mode)
+	}
+	j, err := loadGroupJournal(dir)
+	if err != nil || j == nil {
+		return err
+	}
+
+	done, total := j.progress()
+	fmt.Printf("Found an incomplete group in %s: hash %s, %d of %d steps done (started %s)\n",
+		j.path, j.Hash, done, total, j.Started.Format(time.RFC3339))
+	if dryRun {
+		fmt.Println("Dry run mode - the group will be resolved by the next run with --recover forward|back.")
+		return nil
+	}
+
+	switch mode {
+	case "forward":
+		if err := j.forward(rows); err != nil {
+			return fmt.Errorf("error rolling group %s forward: %v", j.Hash, err)
+		}
+		fmt.Printf("Finished the remaining moves for hash %s\n", j.Hash)
+	case "back":
+		if err := j.back(rows); err != nil {
+			return fmt.Errorf("error rolling group %s back: %v", j.Hash, err)
+		}
+		fmt.Printf("Restored the moved files for hash %s\n", j.Hash)
+	default:
+		return fmt.Errorf("incomplete group for hash %s in %s; rerun with --recover forward to finish it or --recover back to undo it", j.Hash, j.path)
+	}
+	return nil
+}
+
+// moveJournaledFile moves src to dst, falling back to rsync across
+// filesystems. It is a no-op if src is gone and dst is already in place.
+func moveJournaledFile(src, dst string) error {
+	if _, err := os.Stat(src); os.IsNotExist(err) {
+		if _, err := os.Stat(dst); err == nil {
+			return nil
+		}
+		return fmt.Errorf("neither %s nor %s exists", src, dst)
+	}
+
+	dir := filepath.Dir(dst)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return fmt.Errorf("error creating directory %s: %v", dir, err)
+	}
+
+	return moveFile(src, dst)
+}
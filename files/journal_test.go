@@ -0,0 +1,370 @@
+package files
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+var errSimulatedCrash = errors.New("simulated crash")
+
+type journalFixture struct {
+	root, dest, local string
+	sources           []string
+	targets           []string
+}
+
+func newJournalFixture(t *testing.T) journalFixture {
+	t.Helper()
+	root := t.TempDir()
+	f := journalFixture{root: root, dest: filepath.Join(root, "dupes"), local: filepath.Join(root, "local")}
+	if err := os.MkdirAll(f.local, 0755); err != nil {
+		t.Fatalf("mkdir: %v", err)
+	}
+	for _, name := range []string{"a.mkv", "b.mkv"} {
+		src := filepath.Join(f.local, name)
+		if err := os.WriteFile(src, []byte("dup"), 0644); err != nil {
+			t.Fatalf("write %s: %v", src, err)
+		}
+		f.sources = append(f.sources, src)
+		f.targets = append(f.targets, filepath.Join(f.dest, "zz-local", name))
+	}
+	return f
+}
+
+func expectMoveLookup(mock sqlmock.Sqlmock, f journalFixture, withGroup bool) {
+	hostname, _ := os.Hostname()
+	mock.ExpectQuery(`SELECT hostname FROM hosts WHERE LOWER\(hostname\) = LOWER\(\$1\)`).
+		WithArgs(strings.ToLower(hostname)).
+		WillReturnRows(sqlmock.NewRows([]string{"hostname"}).AddRow("zz-local"))
+	rows := sqlmock.NewRows([]string{"hash", "path", "hostname", "size", "root_folder"})
+	if withGroup {
+		rows.AddRow("hash-1", "a.mkv", "aa-remote", int64(3), "/remote/media").
+			AddRow("hash-1", "a.mkv", "zz-local", int64(3), f.local).
+			AddRow("hash-1", "b.mkv", "zz-local", int64(3), f.local)
+	}
+	mock.ExpectQuery("WITH duplicate_hashes AS").WillReturnRows(rows)
+}
+
+// crashMoveAfter runs MoveDuplicates and stops it after the given number of
+// journal steps: a move and a row update for a.mkv, then the move of b.mkv.
+func crashMoveAfter(t *testing.T, db *sql.DB, mock sqlmock.Sqlmock, f journalFixture, steps int) {
+	t.Helper()
+	expectMoveLookup(mock, f, true)
+	mock.ExpectExec(`UPDATE files SET deleted_at = NOW\(\)`).
+		WithArgs("a.mkv", "zz-local", f.local).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+
+	taken := 0
+	journalStepHook = func() error {
+		taken++
+		if taken == steps {
+			return errSimulatedCrash
+		}
+		return nil
+	}
+	t.Cleanup(func() { journalStepHook = nil })
+
+	err := MoveDuplicates(context.Background(), db, DuplicateListOptions{}, MoveOptions{TargetDir: f.dest})
+	if err == nil || !strings.Contains(err.Error(), errSimulatedCrash.Error()) {
+		t.Fatalf("expected the simulated crash, got %v", err)
+	}
+	journalStepHook = nil
+}
+
+func TestMoveDuplicatesCountsRowsItFailsToUpdate(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("sqlmock: %v", err)
+	}
+	defer db.Close()
+
+	f := newJournalFixture(t)
+	expectMoveLookup(mock, f, true)
+	mock.ExpectExec(`UPDATE files SET deleted_at = NOW\(\)`).
+		WithArgs("a.mkv", "zz-local", f.local).
+		WillReturnError(errors.New("connection reset"))
+	mock.ExpectExec(`UPDATE files SET deleted_at = NOW\(\)`).
+		WithArgs("b.mkv", "zz-local", f.local).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+
+	stats := &RunStats{}
+	out := captureStdout(t, func() {
+		err = MoveDuplicates(context.Background(), db, DuplicateListOptions{}, MoveOptions{TargetDir: f.dest, Stats: stats})
+	})
+	if err != nil {
+		t.Fatalf("MoveDuplicates: %v", err)
+	}
+	// The move itself stands; only the row is left behind
+	assertExists(t, f.targets[0], true)
+	assertExists(t, f.targets[1], true)
+	if !strings.Contains(out, "Moved 2 files") || !strings.Contains(out, "Failed to update 1 rows of moved files in the database") {
+		t.Fatalf("expected the failed update in the summary:\n%s", out)
+	}
+	if counters := stats.Counters(); counters["db_errors"] != 1 {
+		t.Fatalf("unexpected counters %v", counters)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatalf("unmet expectations: %v", err)
+	}
+}
+
+func assertExists(t *testing.T, path string, want bool) {
+	t.Helper()
+	_, err := os.Stat(path)
+	if want && err != nil {
+		t.Fatalf("expected %s to exist: %v", path, err)
+	}
+	if !want && !os.IsNotExist(err) {
+		t.Fatalf("expected %s to be absent, stat err: %v", path, err)
+	}
+}
+
+func TestMoveDuplicatesRefusesUntilJournalResolved(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("sqlmock: %v", err)
+	}
+	defer db.Close()
+
+	f := newJournalFixture(t)
+	crashMoveAfter(t, db, mock, f, 3)
+
+	err = MoveDuplicates(context.Background(), db, DuplicateListOptions{}, MoveOptions{TargetDir: f.dest})
+	if err == nil || !strings.Contains(err.Error(), "--recover forward") {
+		t.Fatalf("expected a refusal pointing at --recover, got %v", err)
+	}
+	if err := MoveDuplicates(context.Background(), db, DuplicateListOptions{}, MoveOptions{TargetDir: f.dest, Recover: "sideways"}); err == nil {
+		t.Fatal("expected an error for an invalid --recover value")
+	}
+	assertExists(t, filepath.Join(f.dest, groupJournalFile), true)
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatalf("unmet expectations: %v", err)
+	}
+}
+
+func TestMoveDuplicatesRecoverForwardFinishesGroup(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("sqlmock: %v", err)
+	}
+	defer db.Close()
+
+	f := newJournalFixture(t)
+	crashMoveAfter(t, db, mock, f, 3)
+	assertExists(t, f.targets[1], true)
+
+	mock.ExpectExec(`UPDATE files SET deleted_at = NOW\(\)`).
+		WithArgs("b.mkv", "zz-local", f.local).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	expectMoveLookup(mock, f, false)
+
+	out := captureStdout(t, func() {
+		if err := MoveDuplicates(context.Background(), db, DuplicateListOptions{}, MoveOptions{TargetDir: f.dest, Recover: "forward"}); err != nil {
+			t.Fatalf("recover forward: %v", err)
+		}
+	})
+	if !strings.Contains(out, "3 of 4 steps done") {
+		t.Fatalf("expected the journal to be reported, got:\n%s", out)
+	}
+	for i := range f.sources {
+		assertExists(t, f.sources[i], false)
+		assertExists(t, f.targets[i], true)
+	}
+	assertExists(t, filepath.Join(f.dest, groupJournalFile), false)
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatalf("unmet expectations: %v", err)
+	}
+}
+
+func TestMoveDuplicatesRecoverBackRestoresGroup(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("sqlmock: %v", err)
+	}
+	defer db.Close()
+
+	f := newJournalFixture(t)
+	crashMoveAfter(t, db, mock, f, 3)
+
+	mock.ExpectExec(`(?s)UPDATE files SET deleted_at = NULL\s+WHERE id = \(.*AND deleted_at IS NOT NULL`).
+		WithArgs("a.mkv", "zz-local", f.local).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	expectMoveLookup(mock, f, false)
+
+	if err := MoveDuplicates(context.Background(), db, DuplicateListOptions{}, MoveOptions{TargetDir: f.dest, Recover: "back"}); err != nil {
+		t.Fatalf("recover back: %v", err)
+	}
+	for i := range f.sources {
+		assertExists(t, f.sources[i], true)
+		assertExists(t, f.targets[i], false)
+	}
+	assertExists(t, filepath.Join(f.dest, groupJournalFile), false)
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatalf("unmet expectations: %v", err)
+	}
+}
+
+func TestGroupJournalForwardTreatsFinishedMoveAsDone(t *testing.T) {
+	dir := t.TempDir()
+	src := filepath.Join(dir, "src.txt")
+	dst := filepath.Join(dir, "out", "src.txt")
+	if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		t.Fatalf("mkdir: %v", err)
+	}
+	// The crash hit after the rename but before the journal recorded it.
+	if err := os.WriteFile(dst, []byte("x"), 0644); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+
+	j := newGroupJournal(dir, "h", 1, []journalAction{{Path: "src.txt", Host: "h1", Source: src, Target: dst}})
+	if err := j.save(); err != nil {
+		t.Fatalf("save: %v", err)
+	}
+	var deleted []string
+	rows := groupJournalRows{
+		markDeleted: func(a journalAction) (bool, error) { deleted = append(deleted, a.Path); return true, nil },
+		restore:     func(journalAction) error { return nil },
+	}
+	if err := recoverGroupJournal(dir, "forward", false, rows); err != nil {
+		t.Fatalf("recover forward: %v", err)
+	}
+	if len(deleted) != 1 || deleted[0] != "src.txt" {
+		t.Fatalf("expected the row to be deleted once, got %v", deleted)
+	}
+	assertExists(t, filepath.Join(dir, groupJournalFile), false)
+}
+
+// expectLocalGroupLookup expects a group whose copies are both on this host,
+// so a.mkv, first by path, is the keeper and b.mkv is moved.
+func expectLocalGroupLookup(mock sqlmock.Sqlmock, f journalFixture) {
+	hostname, _ := os.Hostname()
+	mock.ExpectQuery(`SELECT hostname FROM hosts WHERE LOWER\(hostname\) = LOWER\(\$1\)`).
+		WithArgs(strings.ToLower(hostname)).
+		WillReturnRows(sqlmock.NewRows([]string{"hostname"}).AddRow("zz-local"))
+	mock.ExpectQuery("WITH duplicate_hashes AS").
+		WillReturnRows(sqlmock.NewRows([]string{"hash", "path", "hostname", "size", "root_folder"}).
+			AddRow("hash-1", "a.mkv", "zz-local", int64(3), f.local).
+			AddRow("hash-1", "b.mkv", "zz-local", int64(3), f.local))
+}
+
+func TestMoveDuplicatesSymlinkLeavesRelativeLinkToKeeper(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("sqlmock: %v", err)
+	}
+	defer db.Close()
+
+	f := newJournalFixture(t)
+	expectLocalGroupLookup(mock, f)
+	out := captureStdout(t, func() {
+		err = MoveDuplicates(context.Background(), db, DuplicateListOptions{}, MoveOptions{TargetDir: f.dest, DryRun: true, Symlink: true})
+	})
+	if err != nil {
+		t.Fatalf("dry run: %v", err)
+	}
+	if !strings.Contains(out, "Would symlink "+f.sources[1]+" -> a.mkv") {
+		t.Fatalf("expected the planned link in the dry run:\n%s", out)
+	}
+	if info, err := os.Lstat(f.sources[1]); err != nil || info.Mode()&os.ModeSymlink != 0 {
+		t.Fatalf("a dry run must not touch %s", f.sources[1])
+	}
+
+	expectLocalGroupLookup(mock, f)
+	mock.ExpectExec(`UPDATE files SET deleted_at = NOW\(\)`).
+		WithArgs("b.mkv", "zz-local", f.local).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	captureStdout(t, func() {
+		err = MoveDuplicates(context.Background(), db, DuplicateListOptions{}, MoveOptions{TargetDir: f.dest, Symlink: true})
+	})
+	if err != nil {
+		t.Fatalf("MoveDuplicates: %v", err)
+	}
+	if link, err := os.Readlink(f.sources[1]); err != nil || link != "a.mkv" {
+		t.Fatalf("expected b.mkv to be a relative link to a.mkv, got %q (%v)", link, err)
+	}
+	assertExists(t, f.targets[1], true)
+	assertExists(t, filepath.Join(f.dest, groupJournalFile), false)
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatalf("unmet expectations: %v", err)
+	}
+}
+
+func TestMoveDuplicatesSymlinkNeverLinksAcrossHosts(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("sqlmock: %v", err)
+	}
+	defer db.Close()
+
+	// The keeper of the fixture group is on aa-remote, so nothing is moved.
+	f := newJournalFixture(t)
+	expectMoveLookup(mock, f, true)
+	captureStdout(t, func() {
+		err = MoveDuplicates(context.Background(), db, DuplicateListOptions{}, MoveOptions{TargetDir: f.dest, Symlink: true})
+	})
+	if err != nil {
+		t.Fatalf("MoveDuplicates: %v", err)
+	}
+	for i := range f.sources {
+		assertExists(t, f.sources[i], true)
+		assertExists(t, f.targets[i], false)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatalf("unmet expectations: %v", err)
+	}
+}
+
+func TestGroupJournalSymlinkStepRefusesMissingKeeperAndRollsBack(t *testing.T) {
+	f := newJournalFixture(t)
+	keeper, source := f.sources[0], f.sources[1]
+	rows := groupJournalRows{
+		markDeleted: func(journalAction) (bool, error) { return true, nil },
+		restore:     func(journalAction) error { return nil },
+	}
+
+	// A keeper that vanished mid-run stops the group before a dangling link
+	// is made; the journal stays for --recover back.
+	if err := os.Rename(keeper, keeper+".gone"); err != nil {
+		t.Fatalf("rename: %v", err)
+	}
+	j := newGroupJournal(f.root, "h", 3, []journalAction{{Path: "b.mkv", Host: "zz-local", Source: source, Target: f.targets[1], Link: keeper}})
+	if err := j.save(); err != nil {
+		t.Fatalf("save: %v", err)
+	}
+	if err := j.forward(rows); err == nil || !strings.Contains(err.Error(), "is missing, not linking") {
+		t.Fatalf("expected the missing keeper to stop the link, got %v", err)
+	}
+	if _, err := os.Lstat(source); !os.IsNotExist(err) {
+		t.Fatalf("expected no link at %s, stat err: %v", source, err)
+	}
+
+	if err := os.Rename(keeper+".gone", keeper); err != nil {
+		t.Fatalf("rename: %v", err)
+	}
+	if err := recoverGroupJournal(f.root, "forward", false, rows); err != nil {
+		t.Fatalf("recover forward: %v", err)
+	}
+	if link, err := os.Readlink(source); err != nil || link != "a.mkv" {
+		t.Fatalf("expected a link to a.mkv, got %q (%v)", link, err)
+	}
+
+	// Rolling a linked move back replaces the link with the moved copy.
+	j = newGroupJournal(f.root, "h", 3, []journalAction{{Path: "b.mkv", Host: "zz-local", Source: source, Target: f.targets[1], Link: keeper, Moved: true, Linked: true, RowDeleted: true}})
+	if err := j.save(); err != nil {
+		t.Fatalf("save: %v", err)
+	}
+	if err := recoverGroupJournal(f.root, "back", false, rows); err != nil {
+		t.Fatalf("recover back: %v", err)
+	}
+	if info, err := os.Lstat(source); err != nil || !info.Mode().IsRegular() {
+		t.Fatalf("expected %s to be the moved file again: %v", source, err)
+	}
+	assertExists(t, f.targets[1], false)
+}
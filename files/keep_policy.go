@@ -0,0 +1,168 @@
+package files
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Keep policies accepted by --keep.
+const (
+	KeepMostPopulated = "most-populated"
+	KeepOldest        = "oldest"
+	KeepNewest        = "newest"
+	KeepShortestPath  = "shortest-path"
+	KeepPathPrefix    = "path-prefix"
+)
+
+// KeepPolicy decides which copy of a duplicate group is kept. The zero value
+// leaves each dedupe flow its own default: most-populated for DedupFiles, the
+// first copy by host and path for MoveDuplicates and priority alone for
+// DeduplicateByGroup.
+type KeepPolicy struct {
+	Name   string
+	Prefix string // directory whose copies path-prefix prefers
+}
+
+// ParseKeepPolicy parses a --keep value.
+func ParseKeepPolicy(value string) (KeepPolicy, error) {
+	name, prefix, hasPrefix := strings.Cut(value, "=")
+	switch {
+	case value == "":
+		return KeepPolicy{}, nil
+	case name == KeepPathPrefix && hasPrefix:
+		if strings.TrimSpace(prefix) == "" {
+			return KeepPolicy{}, fmt.Errorf("invalid value for --keep: %s needs a directory", KeepPathPrefix)
+		}
+		return KeepPolicy{Name: KeepPathPrefix, Prefix: filepath.Clean(prefix)}, nil
+	case !hasPrefix && (name == KeepMostPopulated || name == KeepOldest || name == KeepNewest || name == KeepShortestPath):
+		return KeepPolicy{Name: name}, nil
+	}
+	return KeepPolicy{}, fmt.Errorf("invalid value for --keep: %q (use most-populated, oldest, newest, shortest-path or path-prefix=DIR)", value)
+}
+
+// String returns the policy as given to --keep.
+func (p KeepPolicy) String() string {
+	if p.Name == KeepPathPrefix {
+		return KeepPathPrefix + "=" + p.Prefix
+	}
+	return p.Name
+}
+
+// needsModTimes reports whether the policy compares recorded mod_time values,
+// which the duplicate queries do not select.
+func (p KeepPolicy) needsModTimes() bool {
+	return p.Name == KeepOldest || p.Name == KeepNewest
+}
+
+// keepCandidate is one copy of a duplicate group as a KeepPolicy sees it.
+type keepCandidate struct {
+	fullPath       string
+	modTime        time.Time // recorded by files find; zero when unknown
+	parentDirCount int       // files in its directory; 0 when it cannot be read
+}
+
+// compare returns a negative number when the policy would rather keep a than
+// b, a positive one for the opposite and 0 for a tie. A copy without a
+// recorded mod_time loses to any copy with one under oldest and newest.
+func (p KeepPolicy) compare(a, b keepCandidate) int {
+	switch p.Name {
+	case KeepMostPopulated:
+		return b.parentDirCount - a.parentDirCount
+	case KeepOldest, KeepNewest:
+		switch {
+		case a.modTime.IsZero() || b.modTime.IsZero():
+			return boolRank(a.modTime.IsZero()) - boolRank(b.modTime.IsZero())
+		case a.modTime.Equal(b.modTime):
+			return 0
+		case a.modTime.Before(b.modTime) == (p.Name == KeepOldest):
+			return -1
+		}
+		return 1
+	case KeepShortestPath:
+		return len(a.fullPath) - len(b.fullPath)
+	case KeepPathPrefix:
+		return boolRank(p.underPrefix(b.fullPath)) - boolRank(p.underPrefix(a.fullPath))
+	}
+	return 0
+}
+
+func boolRank(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// underPrefix reports whether path lies in the policy's directory.
+func (p KeepPolicy) underPrefix(path string) bool {
+	return path == p.Prefix || strings.HasPrefix(path, strings.TrimSuffix(p.Prefix, "/")+"/")
+}
+
+// rank returns the indexes of candidates ordered from the copy the policy
+// gives up first to the one it keeps, which comes last. Ties keep the order
+// of candidates, so of several equally good copies the last one is kept.
+func (p KeepPolicy) rank(candidates []keepCandidate) []int {
+	order := make([]int, len(candidates))
+	for i := range order {
+		order[i] = i
+	}
+	sort.SliceStable(order, func(i, j int) bool {
+		return p.compare(candidates[order[i]], candidates[order[j]]) > 0
+	})
+	return order
+}
+
+// countDirFiles returns how many files (not directories) the directory of
+// path holds, or 0 when it cannot be read.
+func countDirFiles(path string) int {
+	entries, err := os.ReadDir(filepath.Dir(path))
+	if err != nil {
+		return 0
+	}
+	count := 0
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			count++
+		}
+	}
+	return count
+}
+
+// keepModTimeKey identifies a files row in the result of loadKeepModTimes.
+func keepModTimeKey(hostname, rootFolder, path string) string {
+	return hostname + "\x00" + rootFolder + "\x00" + path
+}
+
+// loadKeepModTimes returns the recorded mod_time of the copies of a duplicate
+// group, keyed by keepModTimeKey, for the oldest and newest policies.
+func loadKeepModTimes(ctx context.Context, db *sql.DB, hash string, size int64) (map[string]time.Time, error) {
+	rows, err := db.QueryContext(ctx, `
+		SELECT hostname, COALESCE(root_folder, ''), path, mod_time
+		FROM files
+		WHERE hash = $1 AND size = $2 AND mod_time IS NOT NULL AND `+NotDeleted+`
+	`, hash, size)
+	if err != nil {
+		return nil, fmt.Errorf("error querying modification times: %v", err)
+	}
+	defer rows.Close()
+
+	modTimes := make(map[string]time.Time)
+	for rows.Next() {
+		var hostname, root, path string
+		var modTime time.Time
+		if err := rows.Scan(&hostname, &root, &path, &modTime); err != nil {
+			return nil, fmt.Errorf("error scanning modification time: %v", err)
+		}
+		modTimes[keepModTimeKey(hostname, root, path)] = modTime
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error reading modification times: %v", err)
+	}
+	return modTimes, nil
+}
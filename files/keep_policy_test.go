@@ -0,0 +1,79 @@
+package files
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"deduplicator/db"
+)
+
+func TestParseKeepPolicy(t *testing.T) {
+	for value, want := range map[string]KeepPolicy{
+		"":                        {},
+		"most-populated":          {Name: KeepMostPopulated},
+		"oldest":                  {Name: KeepOldest},
+		"newest":                  {Name: KeepNewest},
+		"shortest-path":           {Name: KeepShortestPath},
+		"path-prefix=/data/lib/":  {Name: KeepPathPrefix, Prefix: "/data/lib"},
+		"path-prefix=/data/lib/a": {Name: KeepPathPrefix, Prefix: "/data/lib/a"},
+	} {
+		got, err := ParseKeepPolicy(value)
+		if err != nil {
+			t.Errorf("ParseKeepPolicy(%q): %v", value, err)
+			continue
+		}
+		if got != want {
+			t.Errorf("ParseKeepPolicy(%q) = %+v, want %+v", value, got, want)
+		}
+	}
+	for _, value := range []string{"largest", "path-prefix", "path-prefix=", "oldest=/data"} {
+		if _, err := ParseKeepPolicy(value); err == nil {
+			t.Errorf("ParseKeepPolicy(%q) should fail", value)
+		}
+	}
+}
+
+func TestKeepPolicyRank(t *testing.T) {
+	day := func(d int) time.Time { return time.Date(2026, 10, d, 0, 0, 0, 0, time.UTC) }
+	candidates := []keepCandidate{
+		{fullPath: "/data/inbox/a.jpg", modTime: day(3), parentDirCount: 2},
+		{fullPath: "/data/library/2026/a.jpg", modTime: day(1), parentDirCount: 9},
+		{fullPath: "/data/x/a.jpg", parentDirCount: 2},
+		{fullPath: "/data/library/a.jpg", modTime: day(3), parentDirCount: 9},
+	}
+
+	tests := []struct {
+		name   string
+		policy KeepPolicy
+		want   []int // last is the keeper
+	}{
+		// Ties keep the given order, so the later of two equal copies wins
+		{"most-populated tie", KeepPolicy{Name: KeepMostPopulated}, []int{0, 2, 1, 3}},
+		{"oldest", KeepPolicy{Name: KeepOldest}, []int{2, 0, 3, 1}},
+		{"newest tie, unknown mod_time loses", KeepPolicy{Name: KeepNewest}, []int{2, 1, 0, 3}},
+		{"shortest-path", KeepPolicy{Name: KeepShortestPath}, []int{1, 3, 0, 2}},
+		{"path-prefix tie", KeepPolicy{Name: KeepPathPrefix, Prefix: "/data/library"}, []int{0, 2, 1, 3}},
+		{"path-prefix matches directories only", KeepPolicy{Name: KeepPathPrefix, Prefix: "/data/lib"}, []int{0, 1, 2, 3}},
+		{"zero policy keeps the order", KeepPolicy{}, []int{0, 1, 2, 3}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.policy.rank(candidates); !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("rank = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSelectGroupCopiesUsesKeepPolicyWithinPriority(t *testing.T) {
+	locations := []FileLocation{
+		{HostName: "a", Priority: 1, keep: keepCandidate{fullPath: "/srv/a/deep/dir/f"}},
+		{HostName: "b", Priority: 1, keep: keepCandidate{fullPath: "/srv/b/f"}},
+		{HostName: "c", Priority: 2, keep: keepCandidate{fullPath: "/f"}},
+	}
+	got := selectGroupCopies(locations, &db.PathGroup{MinCopies: 1}, false, KeepPolicy{Name: KeepShortestPath})
+	if len(got.Keep) != 1 || got.Keep[0].HostName != "b" {
+		t.Fatalf("expected the shorter path of the first priority to be kept, got %+v", got.Keep)
+	}
+}
@@ -3,26 +3,25 @@ package files
 import (
 	"context"
 	"database/sql"
-)
-
-import (
 	"encoding/json"
 	"fmt"
 	"os"
 	"os/exec"
 	"strings"
 
-	"github.com/schollz/progressbar/v3"
+	"deduplicator/db"
 	"deduplicator/logging"
+
+	"github.com/schollz/progressbar/v3"
 )
 
 // hostPath describes a host and its absolute path for the friendly path
-//
 type hostPath struct {
-	Name      string
-	Hostname  string
-	RootPath  string
-	AbsPath   string
+	Name     string
+	Hostname string
+	RootPath string
+	AbsPath  string
+	SSH      db.SSHSettings
 }
 
 type conflictEntry struct {
@@ -32,8 +31,44 @@ type conflictEntry struct {
 	Reason  string
 }
 
+// mirrorTask is a single copy of relPath from srcHost to dstHost.
+type mirrorTask struct {
+	relPath string
+	srcHost hostPath
+	dstHost hostPath
+	hashVal string
+}
+
+// mirrorCursor walks one host's hashed files for a friendly path in path order.
+type mirrorCursor struct {
+	rows    *sql.Rows
+	path    string
+	hash    string
+	started bool
+	done    bool
+}
+
+func (c *mirrorCursor) advance() error {
+	if c.rows.Next() {
+		prev, started := c.path, c.started
+		if err := c.rows.Scan(&c.path, &c.hash); err != nil {
+			return err
+		}
+		c.started = true
+		if started && c.path <= prev {
+			// The merge relies on strictly increasing paths; anything else
+			// would silently plan the wrong copies.
+			return fmt.Errorf("files are not sorted by path (%q after %q)", c.path, prev)
+		}
+		return nil
+	}
+	c.done = true
+	return c.rows.Err()
+}
+
 // MirrorFriendlyPath syncs files across all hosts that have the same friendly path registered.
-func MirrorFriendlyPath(ctx context.Context, db *sql.DB, friendlyPath string) error {
+// Each transfer is attempted up to retries times while it fails transiently.
+func MirrorFriendlyPath(ctx context.Context, db *sql.DB, friendlyPath string, retries int) error {
 	// 1. Find all hosts with the friendly path
 	hosts, err := getHostsForFriendlyPath(db, friendlyPath)
 	if err != nil {
@@ -43,210 +78,248 @@ func MirrorFriendlyPath(ctx context.Context, db *sql.DB, friendlyPath string) er
 		return fmt.Errorf("need at least 2 hosts with this friendly path to mirror")
 	}
 
-	// 2. Build file hash maps for each host
-	hostFiles := make(map[string]map[string]string) // hostname -> relpath -> hash
-	allRelPaths := map[string]struct{}{}
+	// 2. Merge the per-host file lists and run each transfer as soon as it is
+	// planned, so memory stays flat no matter how many files the path holds.
+	var conflicts []conflictEntry
+	var copies []string
+	localHost, _ := os.Hostname()
+	bar := progressbar.Default(-1, "Mirroring files")
+
+	err = planMirrorFriendlyPath(db, hosts,
+		func(task mirrorTask) {
+			copied, conflict := runMirrorTask(ctx, localHost, task, retries)
+			if conflict != nil {
+				conflicts = append(conflicts, *conflict)
+			} else if copied != "" {
+				copies = append(copies, copied)
+			}
+			_ = bar.Add(1)
+		},
+		func(conflict conflictEntry) {
+			conflicts = append(conflicts, conflict)
+		})
+	if err != nil {
+		return err
+	}
+
+	// Log summary
+	if len(copies) > 0 {
+		logging.InfoLogger.Printf("Files copied:")
+		for _, c := range copies {
+			logging.InfoLogger.Printf("%s", c)
+		}
+	} else {
+		logging.InfoLogger.Printf("No files copied.")
+	}
+	if len(conflicts) > 0 {
+		logging.ErrorLogger.Printf("Conflicts:")
+		for _, conf := range conflicts {
+			logging.ErrorLogger.Printf("%s: %s | hosts: %v | hashes: %v", conf.RelPath, conf.Reason, conf.Hosts, conf.Hashes)
+		}
+	} else {
+		logging.InfoLogger.Printf("No conflicts detected.")
+	}
+	return nil
+}
+
+// planMirrorFriendlyPath performs a k-way merge over each host's files sorted
+// by relative path. For every relative path it reports a hash conflict when
+// hosts disagree, or one task per host missing the file, sourced from the
+// first host (in hosts order) that has it.
+func planMirrorFriendlyPath(db *sql.DB, hosts []hostPath, emitTask func(mirrorTask), emitConflict func(conflictEntry)) error {
+	cursors := make([]*mirrorCursor, 0, len(hosts))
+	defer func() {
+		for _, c := range cursors {
+			c.rows.Close()
+		}
+	}()
 	for _, h := range hosts {
-		files, err := getFilesForHostPath(db, h)
+		rows, err := queryFilesForHostPath(db, h)
 		if err != nil {
 			return fmt.Errorf("error fetching files for host %s: %w", h.Hostname, err)
 		}
-		hostFiles[h.Hostname] = files
-		for rel := range files {
-			allRelPaths[rel] = struct{}{}
+		c := &mirrorCursor{rows: rows}
+		cursors = append(cursors, c)
+		if err := c.advance(); err != nil {
+			return fmt.Errorf("error reading files for host %s: %w", h.Hostname, err)
 		}
 	}
 
-	// 3. Aggregate, compare, and sync
-	var conflicts []conflictEntry
-	var copies []string
-
-	// Build a slice of all transfers to do (for progress bar)
-	type transferTask struct {
-		relPath string
-		srcHost hostPath
-		dstHost hostPath
-		hashVal string
-	}
-	var tasks []transferTask
-	for relPath := range allRelPaths {
-		present := map[string]string{} // hostname -> hash
-		missing := []hostPath{}
-		for _, h := range hosts {
-			hash, ok := hostFiles[h.Hostname][relPath]
-			if ok {
-				present[h.Hostname] = hash
-			} else {
-				missing = append(missing, h)
+	for {
+		relPath := ""
+		found := false
+		for _, c := range cursors {
+			if !c.done && (!found || c.path < relPath) {
+				relPath = c.path
+				found = true
 			}
 		}
-		// Check for hash conflicts
+		if !found {
+			return nil
+		}
+
+		var presentIdx []int
+		var missing []hostPath
 		hashSet := map[string]struct{}{}
-		for _, hash := range present {
-			hashSet[hash] = struct{}{}
+		for i, c := range cursors {
+			if !c.done && c.path == relPath {
+				presentIdx = append(presentIdx, i)
+				hashSet[c.hash] = struct{}{}
+			} else {
+				missing = append(missing, hosts[i])
+			}
 		}
+
 		if len(hashSet) > 1 {
 			// Conflict: different hashes for same relPath
 			var hostsList, hashesList []string
-			for host, hash := range present {
-				hostsList = append(hostsList, host)
-				hashesList = append(hashesList, hash)
+			for _, i := range presentIdx {
+				hostsList = append(hostsList, hosts[i].Hostname)
+				hashesList = append(hashesList, cursors[i].hash)
 			}
-			conflicts = append(conflicts, conflictEntry{
+			emitConflict(conflictEntry{
 				RelPath: relPath,
-				Hosts: hostsList,
-				Hashes: hashesList,
-				Reason: "hash mismatch",
+				Hosts:   hostsList,
+				Hashes:  hashesList,
+				Reason:  "hash mismatch",
 			})
-			continue
-		}
-		if len(present) == 0 || len(missing) == 0 {
-			continue // nothing to do
-		}
-		// All present hashes are the same
-		var hashVal string
-		for _, v := range present {
-			hashVal = v
-			break
-		}
-		// Pick a source host (first present)
-		var srcHost hostPath
-		for _, h := range hosts {
-			if _, ok := present[h.Hostname]; ok {
-				srcHost = h
-				break
+		} else {
+			src := presentIdx[0]
+			for _, dst := range missing {
+				emitTask(mirrorTask{
+					relPath: relPath,
+					srcHost: hosts[src],
+					dstHost: dst,
+					hashVal: cursors[src].hash,
+				})
 			}
 		}
-		for _, dst := range missing {
-			tasks = append(tasks, transferTask{
-				relPath: relPath,
-				srcHost: srcHost,
-				dstHost: dst,
-				hashVal: hashVal,
-			})
+
+		for _, i := range presentIdx {
+			if err := cursors[i].advance(); err != nil {
+				return fmt.Errorf("error reading files for host %s: %w", hosts[i].Hostname, err)
+			}
 		}
 	}
-	bar := progressbar.Default(int64(len(tasks)), "Mirroring files")
+}
 
-	for _, task := range tasks {
-		relPath := task.relPath
-		srcHost := task.srcHost
-		dst := task.dstHost
-		hashVal := task.hashVal
-		// Check if file exists on destination's file system (using ssh)
-		absDst := strings.TrimRight(dst.AbsPath, "/") + "/" + relPath
-		cmd := exec.CommandContext(ctx, "ssh", dst.Hostname, "test", "-e", absDst)
-		err := cmd.Run()
-		if err == nil {
-			// File exists on disk but not in DB: log conflict
-			conflicts = append(conflicts, conflictEntry{
-				RelPath: relPath,
-				Hosts: []string{dst.Hostname},
-				Hashes: []string{"n/a"},
-				Reason: "file exists on disk but not in DB",
-			})
-			_ = bar.Add(1)
-			continue
+// runMirrorTask copies one file to its destination host, attempting the mkdir
+// and each rsync up to retries times (see retryTransfer). It returns a copy
+// summary line on success or the conflict describing why it was skipped.
+func runMirrorTask(ctx context.Context, localHost string, task mirrorTask, retries int) (string, *conflictEntry) {
+	relPath := task.relPath
+	srcHost := task.srcHost
+	dst := task.dstHost
+	hashVal := task.hashVal
+
+	// Check if file exists on destination's file system (using ssh)
+	absDst := strings.TrimRight(dst.AbsPath, "/") + "/" + relPath
+	cmd, err := sshCommand(ctx, dst.Hostname, dst.SSH, "test", "-e", absDst)
+	if err != nil {
+		return "", &conflictEntry{
+			RelPath: relPath,
+			Hosts:   []string{dst.Hostname},
+			Hashes:  []string{"n/a"},
+			Reason:  err.Error(),
 		}
-		// Ensure parent directory exists on destination
-		parentDir := absDst[:strings.LastIndex(absDst, "/")]
-		mkdirCmd := exec.CommandContext(ctx, "ssh", dst.Hostname, "mkdir", "-p", parentDir)
-		logging.InfoLogger.Printf("Ensuring directory on %s: %s", dst.Hostname, parentDir)
-		if mkErr := mkdirCmd.Run(); mkErr != nil {
-			logging.ErrorLogger.Printf("Failed to create parent directory on %s: %v", dst.Hostname, mkErr)
-			conflicts = append(conflicts, conflictEntry{
-				RelPath: relPath,
-				Hosts: []string{dst.Hostname},
-				Hashes: []string{"n/a"},
-				Reason: fmt.Sprintf("mkdir failed: %v", mkErr),
-			})
-			_ = bar.Add(1)
-			continue
+	}
+	err = cmd.Run()
+	if err == nil {
+		// File exists on disk but not in DB: log conflict
+		return "", &conflictEntry{
+			RelPath: relPath,
+			Hosts:   []string{dst.Hostname},
+			Hashes:  []string{"n/a"},
+			Reason:  "file exists on disk but not in DB",
 		}
+	}
+	// Ensure parent directory exists on destination
+	parentDir := absDst[:strings.LastIndex(absDst, "/")]
+	logging.InfoLogger.Printf("Ensuring directory on %s: %s", dst.Hostname, parentDir)
+	mkErr := retryTransfer(ctx, retries, "mkdir on "+dst.Hostname, func() error {
+		cmd, err := sshCommand(ctx, dst.Hostname, dst.SSH, "mkdir", "-p", parentDir)
+		if err != nil {
+			return err
+		}
+		return cmd.Run()
+	})
+	if mkErr != nil {
+		logging.ErrorLogger.Printf("Failed to create parent directory on %s: %v", dst.Hostname, mkErr)
+		return "", &conflictEntry{
+			RelPath: relPath,
+			Hosts:   []string{dst.Hostname},
+			Hashes:  []string{"n/a"},
+			Reason:  fmt.Sprintf("mkdir failed: %v", mkErr),
+		}
+	}
 
-		srcAbs := strings.TrimRight(srcHost.AbsPath, "/") + "/" + relPath
-		dstAbs := absDst
+	srcAbs := strings.TrimRight(srcHost.AbsPath, "/") + "/" + relPath
+	dstAbs := absDst
+	copied := fmt.Sprintf("%s -> %s: %s", srcHost.Hostname, dst.Hostname, relPath)
 
-		localHost, _ := os.Hostname()
-		localIsSrc := strings.EqualFold(localHost, srcHost.Hostname)
-		if localIsSrc {
-			// Local is source: rsync local to remote
-			rsyncCmd := fmt.Sprintf("rsync %s %s:%s", srcAbs, dst.Hostname, dstAbs)
-			logging.InfoLogger.Printf("Running: %s", rsyncCmd)
-			copyCmd := exec.CommandContext(ctx, "rsync", srcAbs, dst.Hostname+":"+dstAbs)
-			copyErr := copyCmd.Run()
-			if copyErr != nil {
-				conflicts = append(conflicts, conflictEntry{
-					RelPath: relPath,
-					Hosts: []string{srcHost.Hostname, dst.Hostname},
-					Hashes: []string{hashVal},
-					Reason: fmt.Sprintf("rsync failed: %v", copyErr),
-				})
-			} else {
-				copies = append(copies, fmt.Sprintf("%s -> %s: %s", srcHost.Hostname, dst.Hostname, relPath))
-			}
-			_ = bar.Add(1)
-		} else {
-			// Orchestrator is not source: pull to tmp, then push
-			tmpPath := "/tmp/mirror-tmp-" + hashVal
-			// Pull
-			pullCmdStr := fmt.Sprintf("rsync %s:%s %s", srcHost.Hostname, srcAbs, tmpPath)
-			logging.InfoLogger.Printf("Running: %s", pullCmdStr)
-			pullCmd := exec.CommandContext(ctx, "rsync", srcHost.Hostname+":"+srcAbs, tmpPath)
-			pullErr := pullCmd.Run()
-			if pullErr != nil {
-				conflicts = append(conflicts, conflictEntry{
-					RelPath: relPath,
-					Hosts: []string{srcHost.Hostname, dst.Hostname},
-					Hashes: []string{hashVal},
-					Reason: fmt.Sprintf("pull failed: %v", pullErr),
-				})
-				_ = bar.Add(1)
-				continue
-			}
-			// Push
-			pushCmdStr := fmt.Sprintf("rsync %s %s:%s", tmpPath, dst.Hostname, dstAbs)
-			logging.InfoLogger.Printf("Running: %s", pushCmdStr)
-			pushCmd := exec.CommandContext(ctx, "rsync", tmpPath, dst.Hostname+":"+dstAbs)
-			pushErr := pushCmd.Run()
-			if pushErr != nil {
-				conflicts = append(conflicts, conflictEntry{
-					RelPath: relPath,
-					Hosts: []string{srcHost.Hostname, dst.Hostname},
-					Hashes: []string{hashVal},
-					Reason: fmt.Sprintf("push failed: %v", pushErr),
-				})
-			} else {
-				// Cleanup
-				_ = os.Remove(tmpPath)
-				copies = append(copies, fmt.Sprintf("%s -> %s: %s", srcHost.Hostname, dst.Hostname, relPath))
+	if strings.EqualFold(localHost, srcHost.Hostname) {
+		// Local is source: rsync local to remote
+		rsyncCmd := fmt.Sprintf("rsync %s %s:%s", srcAbs, dst.Hostname, dstAbs)
+		logging.InfoLogger.Printf("Running: %s", rsyncCmd)
+		copyErr := retryTransfer(ctx, retries, rsyncCmd, func() error {
+			return mirrorRsync(ctx, dst.SSH, srcAbs, dst.Hostname+":"+dstAbs).Run()
+		})
+		if copyErr != nil {
+			return "", &conflictEntry{
+				RelPath: relPath,
+				Hosts:   []string{srcHost.Hostname, dst.Hostname},
+				Hashes:  []string{hashVal},
+				Reason:  fmt.Sprintf("rsync failed: %v", copyErr),
 			}
-			_ = bar.Add(1)
 		}
+		return copied, nil
 	}
-	// Log summary
-	if len(copies) > 0 {
-		logging.InfoLogger.Printf("Files copied:")
-		for _, c := range copies {
-			logging.InfoLogger.Printf("%s", c)
+
+	// Orchestrator is not source: pull to tmp, then push
+	tmpPath := "/tmp/mirror-tmp-" + hashVal
+	// Pull
+	pullCmdStr := fmt.Sprintf("rsync %s:%s %s", srcHost.Hostname, srcAbs, tmpPath)
+	logging.InfoLogger.Printf("Running: %s", pullCmdStr)
+	pullErr := retryTransfer(ctx, retries, pullCmdStr, func() error {
+		return mirrorRsync(ctx, srcHost.SSH, srcHost.Hostname+":"+srcAbs, tmpPath).Run()
+	})
+	if pullErr != nil {
+		return "", &conflictEntry{
+			RelPath: relPath,
+			Hosts:   []string{srcHost.Hostname, dst.Hostname},
+			Hashes:  []string{hashVal},
+			Reason:  fmt.Sprintf("pull failed: %v", pullErr),
 		}
-	} else {
-		logging.InfoLogger.Printf("No files copied.")
 	}
-	if len(conflicts) > 0 {
-		logging.ErrorLogger.Printf("Conflicts:")
-		for _, conf := range conflicts {
-			logging.ErrorLogger.Printf("%s: %s | hosts: %v | hashes: %v", conf.RelPath, conf.Reason, conf.Hosts, conf.Hashes)
+	// Push
+	pushCmdStr := fmt.Sprintf("rsync %s %s:%s", tmpPath, dst.Hostname, dstAbs)
+	logging.InfoLogger.Printf("Running: %s", pushCmdStr)
+	pushErr := retryTransfer(ctx, retries, pushCmdStr, func() error {
+		return mirrorRsync(ctx, dst.SSH, tmpPath, dst.Hostname+":"+dstAbs).Run()
+	})
+	if pushErr != nil {
+		return "", &conflictEntry{
+			RelPath: relPath,
+			Hosts:   []string{srcHost.Hostname, dst.Hostname},
+			Hashes:  []string{hashVal},
+			Reason:  fmt.Sprintf("push failed: %v", pushErr),
 		}
-	} else {
-		logging.InfoLogger.Printf("No conflicts detected.")
 	}
-	return nil
+	// Cleanup
+	_ = os.Remove(tmpPath)
+	return copied, nil
+}
+
+// mirrorRsync returns the rsync of source to destination, connecting to the
+// remote end of the copy with settings.
+func mirrorRsync(ctx context.Context, settings db.SSHSettings, source, destination string) *exec.Cmd {
+	args := append(rsyncShell(settings), source, destination)
+	return exec.CommandContext(ctx, "rsync", args...)
 }
 
 // getHostsForFriendlyPath returns hosts and the absolute path for the friendly path
-func getHostsForFriendlyPath(db *sql.DB, friendlyPath string) ([]hostPath, error) {
-	rows, err := db.Query("SELECT name, hostname, root_path, settings FROM hosts")
+func getHostsForFriendlyPath(database *sql.DB, friendlyPath string) ([]hostPath, error) {
+	rows, err := database.Query("SELECT name, hostname, root_path, settings FROM hosts")
 	if err != nil {
 		return nil, err
 	}
@@ -260,6 +333,7 @@ func getHostsForFriendlyPath(db *sql.DB, friendlyPath string) ([]hostPath, error
 		}
 		var settings struct {
 			Paths map[string]string `json:"paths"`
+			SSH   db.SSHSettings    `json:"ssh"`
 		}
 		if err := json.Unmarshal(settingsRaw, &settings); err != nil {
 			continue // skip hosts with bad json
@@ -271,27 +345,16 @@ func getHostsForFriendlyPath(db *sql.DB, friendlyPath string) ([]hostPath, error
 				Hostname: hostname,
 				RootPath: rootPath,
 				AbsPath:  abs,
+				SSH:      settings.SSH,
 			})
 		}
 	}
 	return result, nil
 }
 
-// getFilesForHostPath returns relative path -> hash for a given host/path
-func getFilesForHostPath(db *sql.DB, h hostPath) (map[string]string, error) {
-	q := `SELECT path, hash FROM files WHERE hostname = $1 AND root_folder = $2 AND hash IS NOT NULL`
-	rows, err := db.Query(q, h.Hostname, h.AbsPath)
-	if err != nil {
-		return nil, err
-	}
-	defer rows.Close()
-	result := make(map[string]string)
-	for rows.Next() {
-		var path, hash string
-		if err := rows.Scan(&path, &hash); err != nil {
-			return nil, err
-		}
-		result[path] = hash
-	}
-	return result, nil
+// queryFilesForHostPath streams relative path and hash for a given host/path,
+// ordered bytewise (COLLATE "C") so the order matches Go string comparison.
+func queryFilesForHostPath(db *sql.DB, h hostPath) (*sql.Rows, error) {
+	q := `SELECT path, hash FROM files WHERE hostname = $1 AND root_folder = $2 AND hash IS NOT NULL AND ` + NotDeleted + ` ORDER BY path COLLATE "C"`
+	return db.Query(q, h.Hostname, h.AbsPath)
 }
@@ -0,0 +1,136 @@
+package files
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+// legacyMirrorPlan is the map-based planning MirrorFriendlyPath used before the
+// streaming merge, kept here as the reference the merge must agree with.
+func legacyMirrorPlan(hosts []hostPath, hostFiles map[string]map[string]string) ([]mirrorTask, []conflictEntry) {
+	allRelPaths := map[string]struct{}{}
+	for _, files := range hostFiles {
+		for rel := range files {
+			allRelPaths[rel] = struct{}{}
+		}
+	}
+	var tasks []mirrorTask
+	var conflicts []conflictEntry
+	for relPath := range allRelPaths {
+		present := map[string]string{}
+		var missing []hostPath
+		for _, h := range hosts {
+			if hashVal, ok := hostFiles[h.Hostname][relPath]; ok {
+				present[h.Hostname] = hashVal
+			} else {
+				missing = append(missing, h)
+			}
+		}
+		hashSet := map[string]struct{}{}
+		for _, hashVal := range present {
+			hashSet[hashVal] = struct{}{}
+		}
+		if len(hashSet) > 1 {
+			var hostsList, hashesList []string
+			for host, hashVal := range present {
+				hostsList = append(hostsList, host)
+				hashesList = append(hashesList, hashVal)
+			}
+			conflicts = append(conflicts, conflictEntry{RelPath: relPath, Hosts: hostsList, Hashes: hashesList, Reason: "hash mismatch"})
+			continue
+		}
+		var src hostPath
+		for _, h := range hosts {
+			if _, ok := present[h.Hostname]; ok {
+				src = h
+				break
+			}
+		}
+		for _, dst := range missing {
+			tasks = append(tasks, mirrorTask{relPath: relPath, srcHost: src, dstHost: dst, hashVal: present[src.Hostname]})
+		}
+	}
+	return tasks, conflicts
+}
+
+// canonicalMirrorPlan renders tasks and conflicts in a stable order so plans
+// built from map iteration and from the merge can be compared.
+func canonicalMirrorPlan(tasks []mirrorTask, conflicts []conflictEntry) ([]string, []string) {
+	var t, c []string
+	for _, task := range tasks {
+		t = append(t, fmt.Sprintf("%s %s->%s %s", task.relPath, task.srcHost.Hostname, task.dstHost.Hostname, task.hashVal))
+	}
+	for _, conf := range conflicts {
+		var pairs []string
+		for i := range conf.Hosts {
+			pairs = append(pairs, conf.Hosts[i]+"="+conf.Hashes[i])
+		}
+		sort.Strings(pairs)
+		c = append(c, fmt.Sprintf("%s %s %v", conf.RelPath, conf.Reason, pairs))
+	}
+	sort.Strings(t)
+	sort.Strings(c)
+	return t, c
+}
+
+func TestPlanMirrorFriendlyPathMatchesMapBasedPlan(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("sqlmock: %v", err)
+	}
+	defer db.Close()
+
+	hosts := []hostPath{
+		{Name: "A", Hostname: "a.local", AbsPath: "/a/photos"},
+		{Name: "B", Hostname: "b.local", AbsPath: "/b/photos"},
+		{Name: "C", Hostname: "c.local", AbsPath: "/c/photos"},
+	}
+	// Rows are sorted per host and interleave across hosts: some paths live on
+	// one host, some on two, some everywhere, and two disagree on content.
+	hostFiles := map[string][][2]string{
+		"a.local": {{"a-only.txt", "h1"}, {"all.txt", "h2"}, {"dir/ab.txt", "h3"}, {"dir/mismatch.txt", "h4"}, {"z-ac.txt", "h5"}},
+		"b.local": {{"all.txt", "h2"}, {"b-only.txt", "h6"}, {"dir/ab.txt", "h3"}, {"dir/bc.txt", "h7"}, {"dir/mismatch.txt", "h8"}},
+		"c.local": {{"all.txt", "h2"}, {"c-only.txt", "h9"}, {"dir/bc.txt", "h7"}, {"dir/mismatch.txt", "h4"}, {"z-ac.txt", "h5"}},
+	}
+	legacyFiles := map[string]map[string]string{}
+	for _, h := range hosts {
+		rows := sqlmock.NewRows([]string{"path", "hash"})
+		legacyFiles[h.Hostname] = map[string]string{}
+		for _, f := range hostFiles[h.Hostname] {
+			rows.AddRow(f[0], f[1])
+			legacyFiles[h.Hostname][f[0]] = f[1]
+		}
+		mock.ExpectQuery("SELECT path, hash FROM files WHERE hostname = \\$1 AND root_folder = \\$2 AND hash IS NOT NULL AND deleted_at IS NULL ORDER BY path").
+			WithArgs(h.Hostname, h.AbsPath).
+			WillReturnRows(rows)
+	}
+
+	var tasks []mirrorTask
+	var conflicts []conflictEntry
+	err = planMirrorFriendlyPath(db, hosts,
+		func(task mirrorTask) { tasks = append(tasks, task) },
+		func(conf conflictEntry) { conflicts = append(conflicts, conf) })
+	if err != nil {
+		t.Fatalf("planMirrorFriendlyPath error: %v", err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatalf("unmet expectations: %v", err)
+	}
+
+	gotTasks, gotConflicts := canonicalMirrorPlan(tasks, conflicts)
+	wantTasks, wantConflicts := canonicalMirrorPlan(legacyMirrorPlan(hosts, legacyFiles))
+	if !reflect.DeepEqual(gotTasks, wantTasks) {
+		t.Fatalf("tasks differ from map-based plan:\n got %v\nwant %v", gotTasks, wantTasks)
+	}
+	if !reflect.DeepEqual(gotConflicts, wantConflicts) {
+		t.Fatalf("conflicts differ from map-based plan:\n got %v\nwant %v", gotConflicts, wantConflicts)
+	}
+	// Sanity-check the fixture actually exercises every branch.
+	if len(gotTasks) != 9 || len(gotConflicts) != 1 {
+		t.Fatalf("expected 9 tasks and 1 conflict, got %d and %d", len(gotTasks), len(gotConflicts))
+	}
+}
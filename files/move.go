@@ -6,28 +6,37 @@ import (
 	"deduplicator/logging"
 	"fmt"
 	"os"
-	"os/exec"
 	"path/filepath"
 	"sort"
 	"strings"
+	"time"
 )
 
-type duplicateMoveGroup struct {
-	Hash      string
-	Files     []string
-	Hosts     []string
-	RootPaths []string
-	Size      int64
-}
-
 func MoveDuplicates(ctx context.Context, db *sql.DB, opts DuplicateListOptions, moveOpts MoveOptions) error {
-	// Create target directory if it doesn't exist
+	dest, err := newMoveDestination(db, moveOpts.TargetDir)
+	if err != nil {
+		return err
+	}
+
+	// Create target (or, for a remote one, journal) directory if it doesn't exist
 	if !moveOpts.DryRun {
-		if err := os.MkdirAll(moveOpts.TargetDir, 0755); err != nil {
+		if err := os.MkdirAll(dest.JournalDir, 0755); err != nil {
 			return fmt.Errorf("error creating target directory: %v", err)
 		}
 	}
 
+	// Rows that cannot be updated after their file moved are counted
+	var rowErrors rowErrorCount
+	journalRows := moveJournalRows(db, &rowErrors)
+	if !moveOpts.DryRun {
+		defer rowErrors.record(moveOpts.Stats)
+	}
+
+	// Resolve a group left half done by an interrupted run first
+	if err := recoverGroupJournal(dest.JournalDir, moveOpts.Recover, moveOpts.DryRun, journalRows); err != nil {
+		return err
+	}
+
 	// Get hostname for current machine
 	hostname, err := os.Hostname()
 	if err != nil {
@@ -47,36 +56,43 @@ func MoveDuplicates(ctx context.Context, db *sql.DB, opts DuplicateListOptions,
 	`, hostname).Scan(&hostName)
 	if err != nil {
 		if err == sql.ErrNoRows {
-			return fmt.Errorf("no host found for hostname %s, please add it using 'dedupe manage add'", hostname)
+			return UnknownHostError(hostname)
 		}
 		return fmt.Errorf("error finding host: %v", err)
 	}
 	logging.InfoLogger.Printf("Found host: %s", hostName)
 
+	var xattrWhitelist []string
+	if moveOpts.MergeXattrs && !moveOpts.DryRun {
+		xattrWhitelist = xattrWhitelistFor(db, hostName)
+	}
+
 	// Build query based on options
 	query := `
 		WITH duplicate_hashes AS (
-			SELECT hash, size, SUM(size) as total_size
+			SELECT hash, size, hash_algo, SUM(size) as total_size
 			FROM files
 			WHERE hash IS NOT NULL
-			AND hash NOT IN ('TIMEOUT_ERROR', 'HASH_ERROR')
+			AND ` + WellFormedHash + `
 			AND size IS NOT NULL
+			AND ` + NotDeleted + `
+			AND ` + NotHardLinkedAs("files") + `
 	`
 	var args []interface{}
 	var argCount int
 
-	if opts.MinSize > 0 {
-		argCount++
-		query += fmt.Sprintf(" AND size >= $%d", argCount)
-		args = append(args, opts.MinSize)
+	if sizeFilter := opts.sizeRules().predicate("size", &argCount, &args); sizeFilter != "" {
+		query += " AND " + sizeFilter
 	}
 
 	query += `
-			GROUP BY hash, size
+			GROUP BY hash, size, hash_algo
 			HAVING COUNT(*) > 1
 			ORDER BY total_size DESC, hash, size
 	`
-	if opts.Count > 0 {
+	// Groups that opts.Exclude drops must not count towards --count, so then
+	// the accumulator limits them instead of the query.
+	if opts.Count > 0 && len(opts.Exclude) == 0 {
 		argCount++
 		query += fmt.Sprintf(" LIMIT $%d", argCount)
 		args = append(args, opts.Count)
@@ -85,10 +101,20 @@ func MoveDuplicates(ctx context.Context, db *sql.DB, opts DuplicateListOptions,
 		)
 		SELECT f.hash, f.path, f.hostname, f.size, COALESCE(f.root_folder, '') as root_folder
 		FROM duplicate_hashes d
-		JOIN files f ON f.hash = d.hash AND f.size = d.size
+		JOIN files f ON f.hash = d.hash AND f.size = d.size AND ` + NotDeletedAs("f") + ` AND f.hash_algo = d.hash_algo
+			AND ` + NotHardLinkedAs("f") + `
 		ORDER BY d.total_size DESC, d.hash, d.size, f.hostname, f.path
 	`
 
+	// Count the groups the size rules leave out, for the summary
+	sizeFiltered, err := countSizeFilteredGroups(ctx, db, "", "", opts.sizeRules())
+	if err != nil {
+		return err
+	}
+	if sizeFiltered > 0 {
+		moveOpts.Stats.Set("size_filtered", sizeFiltered)
+	}
+
 	// Query duplicate groups
 	rows, err := db.QueryContext(ctx, query, args...)
 	if err != nil {
@@ -97,73 +123,78 @@ func MoveDuplicates(ctx context.Context, db *sql.DB, opts DuplicateListOptions,
 	defer rows.Close()
 
 	// Process results
-	var currentHash string
-	var currentSize int64
-	var currentGroup duplicateMoveGroup
+	names := NewPathNameCache(db)
+	dest.announce()
+	acc := groupAccumulator{exclude: opts.Exclude}
+	if len(opts.Exclude) > 0 {
+		acc.limit = opts.Count
+	}
 	var totalMoved, totalSaved int64
-
-	for rows.Next() {
-		var hash, path, hostname, rootPath string
-		var size int64
-
-		if err := rows.Scan(&hash, &path, &hostname, &size, &rootPath); err != nil {
-			return fmt.Errorf("error scanning row: %v", err)
-		}
-
-		if hash != currentHash || size != currentSize {
-			// Process previous group
-			if currentHash != "" {
-				moved, err := moveGroupDuplicates(currentGroup, moveOpts, db, hostName)
-				if err != nil {
-					return fmt.Errorf("error moving duplicates for hash %s: %v", currentHash, err)
-				}
-				totalMoved += moved
-				totalSaved += currentGroup.Size * moved
+	var verification copyVerification
+	if moveOpts.Verify && !moveOpts.DryRun {
+		defer verification.record(moveOpts.Stats)
+	}
+	budget := byteCap{max: moveOpts.MaxBytes}
+	moveGroups := func(groups []DuplicateGroup) error {
+		for _, group := range groups {
+			if budget.full() {
+				budget.leave(group.Size * int64(len(group.Files)-1))
+				continue
 			}
-
-			// Start new group
-			currentHash = hash
-			currentSize = size
-			currentGroup = duplicateMoveGroup{
-				Hash:      hash,
-				Size:      size,
-				Files:     make([]string, 0),
-				Hosts:     make([]string, 0),
-				RootPaths: make([]string, 0),
+			moved, err := moveGroupDuplicates(ctx, group, moveOpts, dest, db, journalRows, hostName, names, xattrWhitelist, &verification)
+			if err != nil {
+				return fmt.Errorf("error moving duplicates for hash %s: %v", group.Hash, err)
 			}
+			totalMoved += moved
+			totalSaved += group.Size * moved
+			budget.moved += group.Size * moved
 		}
-
-		currentGroup.Files = append(currentGroup.Files, path)
-		currentGroup.Hosts = append(currentGroup.Hosts, hostname)
-		currentGroup.RootPaths = append(currentGroup.RootPaths, rootPath)
+		return nil
 	}
 
-	// Process the last group
-	if currentHash != "" {
-		// Debug log for root paths
-		logging.InfoLogger.Printf("[DEBUG] Looping through these root paths: %v", currentGroup.RootPaths)
-		moved, err := moveGroupDuplicates(currentGroup, moveOpts, db, hostName)
-		if err != nil {
-			return fmt.Errorf("error moving duplicates for hash %s: %v", currentHash, err)
+	for rows.Next() {
+		var row duplicateRow
+		if err := rows.Scan(&row.Hash, &row.Path, &row.Hostname, &row.Size, &row.RootFolder); err != nil {
+			return acc.abandonedGroupError("scanning row", err)
+		}
+		if err := moveGroups(acc.NextRow(row)); err != nil {
+			return err
+		}
+		if acc.Full() {
+			break
 		}
-		totalMoved += moved
-		totalSaved += currentGroup.Size * moved
 	}
-
+	// A group cut short by a failed read is not moved: its keeper could be
+	// one of the rows never read.
 	if err := rows.Err(); err != nil {
-		return fmt.Errorf("error iterating rows: %v", err)
+		return acc.abandonedGroupError("iterating rows", err)
+	}
+	if err := moveGroups(acc.Flush()); err != nil {
+		return err
 	}
 
 	if moveOpts.DryRun {
 		fmt.Printf("\nWould move %d files, saving %s bytes\n", totalMoved, formatBytes(totalSaved))
 	} else {
 		fmt.Printf("\nMoved %d files, saved %s bytes\n", totalMoved, formatBytes(totalSaved))
+		if totalMoved > 0 {
+			printMoveManifest(dest.JournalDir)
+		}
+	}
+	if moveOpts.Verify && !moveOpts.DryRun {
+		verification.print()
 	}
+	budget.print(moveOpts.DryRun)
+	rowErrors.print()
+	printSizeFiltered(sizeFiltered)
 	return nil
 }
 
 // moveGroupDuplicates moves local duplicate files that are not the deterministic global keeper.
-func moveGroupDuplicates(group duplicateMoveGroup, opts MoveOptions, db *sql.DB, localHost string) (int64, error) {
+// When the keeper is local too, whitelisted xattrs only present on a moved
+// copy are first merged onto it. With opts.Verify, a copy whose content no
+// longer matches the catalog is left in place.
+func moveGroupDuplicates(ctx context.Context, group DuplicateGroup, opts MoveOptions, dest moveDestination, db *sql.DB, journalRows groupJournalRows, localHost string, names *PathNameCache, xattrWhitelist []string, verification *copyVerification) (int64, error) {
 	if len(group.Files) < 2 {
 		return 0, nil // Nothing to move
 	}
@@ -185,13 +216,13 @@ func moveGroupDuplicates(group duplicateMoveGroup, opts MoveOptions, db *sql.DB,
 		info := fileInfo{
 			path:     path,
 			host:     group.Hosts[i],
-			rootPath: group.RootPaths[i],
+			rootPath: group.RootFolders[i],
 			local:    strings.EqualFold(group.Hosts[i], localHost),
 		}
 		if filepath.IsAbs(path) {
 			info.sourcePath = path
 		} else {
-			info.sourcePath = filepath.Join(group.RootPaths[i], path)
+			info.sourcePath = filepath.Join(group.RootFolders[i], path)
 		}
 
 		if !info.local {
@@ -199,7 +230,7 @@ func moveGroupDuplicates(group duplicateMoveGroup, opts MoveOptions, db *sql.DB,
 			continue
 		}
 
-		logging.InfoLogger.Printf("[DEBUG] Using rootPath: %s, path: %s, fullPath: %s", group.RootPaths[i], path, info.sourcePath)
+		logging.InfoLogger.Printf("[DEBUG] Using rootPath: %s, path: %s, fullPath: %s", group.RootFolders[i], path, info.sourcePath)
 		parentDir := filepath.Dir(info.sourcePath)
 		entries, err := os.ReadDir(parentDir)
 		if err != nil {
@@ -233,6 +264,32 @@ func moveGroupDuplicates(group duplicateMoveGroup, opts MoveOptions, db *sql.DB,
 		return files[i].path < files[j].path
 	})
 
+	// A --keep policy picks the keeper among them instead; ties go to the
+	// copy last in that order. Directory sizes are only known for copies on
+	// this host.
+	policy := "first by host and path"
+	if opts.Keep.Name != "" {
+		policy = opts.Keep.String()
+		var modTimes map[string]time.Time
+		if opts.Keep.needsModTimes() {
+			var err error
+			if modTimes, err = loadKeepModTimes(ctx, db, group.Hash, group.Size); err != nil {
+				return 0, err
+			}
+		}
+		candidates := make([]keepCandidate, len(files))
+		for i, f := range files {
+			candidates[i] = keepCandidate{
+				fullPath:       f.sourcePath,
+				modTime:        modTimes[keepModTimeKey(f.host, f.rootPath, f.path)],
+				parentDirCount: f.parentDirCount,
+			}
+		}
+		ranked := opts.Keep.rank(candidates)
+		k := ranked[len(ranked)-1]
+		files[0], files[k] = files[k], files[0]
+	}
+
 	keeper := files[0]
 	hasLocalMove := false
 	for i := 1; i < len(files); i++ {
@@ -246,9 +303,23 @@ func moveGroupDuplicates(group duplicateMoveGroup, opts MoveOptions, db *sql.DB,
 	}
 
 	fmt.Printf("\nHash: %s (size: %s)\n", group.Hash, formatBytes(group.Size))
-	fmt.Printf("Keeping: %s (%s)\n", keeper.path, keeper.host)
+	fmt.Printf("Keeping: %s (keep policy: %s)\n", names.Label(keeper.host, keeper.rootPath, keeper.path), policy)
+
+	// --symlink replaces each moved copy with a link to the keeper, which
+	// only works when the keeper is on this host and still there
+	if opts.Symlink {
+		if !keeper.local {
+			logging.ErrorLogger.Printf("Warning: Not moving the copies of %s: kept copy is on %s and --symlink never links across hosts", group.Hash, keeper.host)
+			return 0, nil
+		}
+		if _, err := os.Stat(keeper.sourcePath); err != nil {
+			logging.ErrorLogger.Printf("Warning: Not moving the copies of %s: kept copy %s is missing and --symlink never leaves a dangling link", group.Hash, keeper.sourcePath)
+			return 0, nil
+		}
+	}
 
 	var moved int64
+	var actions []journalAction
 	for i := 1; i < len(files); i++ {
 		if !files[i].local {
 			continue
@@ -256,61 +327,194 @@ func moveGroupDuplicates(group duplicateMoveGroup, opts MoveOptions, db *sql.DB,
 		sourcePath := files[i].sourcePath
 		logging.InfoLogger.Printf("[DEBUG] Moving file. rootPath: %s, path: %s, sourcePath: %s", files[i].rootPath, files[i].path, sourcePath)
 
-		// Skip if source file doesn't exist
-		if _, err := os.Stat(sourcePath); os.IsNotExist(err) {
+		// Skip if source file doesn't exist, or may still be written to
+		info, err := os.Stat(sourcePath)
+		if os.IsNotExist(err) {
 			logging.ErrorLogger.Printf("Warning: Source file does not exist: %s", sourcePath)
 			continue
 		}
+		if err == nil {
+			if err := checkMinAge(info, opts.MinAge); err != nil {
+				logging.ErrorLogger.Printf("Warning: Skipping %s: %v", sourcePath, err)
+				continue
+			}
+			// Moving a hard link of the kept copy only renames the inode
+			if keeper.local && sameFile(info, keeper.sourcePath) {
+				logging.ErrorLogger.Printf("Warning: Skipping %s: it is the same file as a kept copy", sourcePath)
+				continue
+			}
+		}
+		if opts.Verify && !opts.DryRun && !verification.check(db, files[i].path, files[i].host, sourcePath, group.Hash) {
+			continue
+		}
 
 		// Create target path
-		targetPath := filepath.Join(opts.TargetDir, files[i].host, archiveRelativePath(files[i].path))
-		targetDir := filepath.Dir(targetPath)
+		targetPath := filepath.Join(dest.Dir, files[i].host, archiveRelativePath(files[i].path))
+
+		// A remote target is checked over ssh first; rsync would overwrite it
+		if exists, err := dest.targetExists(ctx, targetPath); err != nil || exists {
+			if err == nil {
+				err = fmt.Errorf("target already exists")
+			}
+			logging.ErrorLogger.Printf("Warning: Skipping %s: %s: %v", sourcePath, dest.label(targetPath), err)
+			continue
+		}
 
+		label := names.Label(files[i].host, files[i].rootPath, files[i].path)
 		if opts.DryRun {
-			fmt.Printf("Would move: %s (%s) [parent dir has %d files]\n  -> %s\n",
-				sourcePath, files[i].host, files[i].parentDirCount, targetPath)
+			fmt.Printf("Would move: %s [parent dir has %d files]\n  %s -> %s\n",
+				label, files[i].parentDirCount, sourcePath, dest.label(targetPath))
 		} else {
-			fmt.Printf("Moving: %s (%s) [parent dir has %d files]\n  -> %s\n",
-				sourcePath, files[i].host, files[i].parentDirCount, targetPath)
+			fmt.Printf("Moving: %s [parent dir has %d files]\n  %s -> %s\n",
+				label, files[i].parentDirCount, sourcePath, dest.label(targetPath))
+		}
+		action := journalAction{
+			Path:       files[i].path,
+			Host:       files[i].host,
+			RootFolder: files[i].rootPath,
+			Source:     sourcePath,
+			Target:     targetPath,
+		}
+		if opts.Symlink {
+			action.Link = keeper.sourcePath
+			printSymlinkPlan(sourcePath, keeper.sourcePath, opts.DryRun)
+		}
+		if !opts.DryRun {
+			actions = append(actions, dest.track(action))
+		}
+		moved++
+	}
 
-			// Create target directory
-			if err := os.MkdirAll(targetDir, 0755); err != nil {
-				return moved, fmt.Errorf("error creating directory %s: %v", targetDir, err)
+	if len(actions) > 0 && len(xattrWhitelist) > 0 {
+		if keeper.local {
+			for _, a := range actions {
+				if merged := mergeXattrs(keeper.sourcePath, a.Source, xattrWhitelist); len(merged) > 0 {
+					fmt.Printf("  Merged xattrs %s from %s onto the keeper\n", strings.Join(merged, ", "), a.Source)
+				}
 			}
+		} else {
+			logging.InfoLogger.Printf("Not merging xattrs: keeper %s is on %s", keeper.path, keeper.host)
+		}
+	}
 
-			// Move the file using rsync to handle cross-filesystem moves
-			// First try with os.Rename for efficiency (same filesystem)
-			err := os.Rename(sourcePath, targetPath)
-			if err != nil {
-				// If rename fails due to cross-device link, use rsync
-				if strings.Contains(err.Error(), "invalid cross-device link") {
-					// Use rsync to copy the file
-					cmd := exec.Command("rsync", "-a", "--remove-source-files", sourcePath, targetPath)
-					output, err := cmd.CombinedOutput()
-					if err != nil {
-						return moved, fmt.Errorf("error moving file %s with rsync: %v\nOutput: %s", sourcePath, err, output)
-					}
-				} else {
-					// If it's another error, return it
-					return moved, fmt.Errorf("error moving file %s: %v", sourcePath, err)
+	if len(actions) > 0 {
+		journal := newGroupJournal(dest.JournalDir, group.Hash, group.Size, actions)
+		if err := journal.save(); err != nil {
+			return 0, err
+		}
+		if err := journal.forward(journalRows); err != nil {
+			return 0, err
+		}
+	}
+
+	return moved, nil
+}
+
+// moveJournalRows soft-deletes and restores the rows of files moved by
+// MoveDuplicates, or rewrites them when the copy went to a tracked remote
+// destination. A failed delete does not undo the move: it is logged and
+// counted in rowErrors.
+func moveJournalRows(db *sql.DB, rowErrors *rowErrorCount) groupJournalRows {
+	return groupJournalRows{
+		markDeleted: func(a journalAction) (bool, error) {
+			if a.NewHost != "" {
+				_, err := db.Exec(`
+					UPDATE files SET hostname = $4, root_folder = $5, path = $6
+					WHERE path = $1
+					AND hostname = $2
+					AND COALESCE(root_folder, '') = $3
+					AND deleted_at IS NULL
+				`, a.Path, a.Host, a.RootFolder, a.NewHost, a.NewRoot, a.NewPath)
+				if err == nil {
+					return true, nil
 				}
+				logging.ErrorLogger.Printf("Warning: Failed to point %s at %s:%s, deleting it instead: %v", a.Path, a.Remote, a.Target, err)
 			}
-
-			// Delete the file from the database
-			_, err = db.Exec(`
-				DELETE FROM files
+			_, err := db.Exec(`
+				UPDATE files SET deleted_at = NOW()
 				WHERE path = $1
-				AND LOWER(hostname) = LOWER($2)
+				AND hostname = $2
 				AND COALESCE(root_folder, '') = $3
-			`, files[i].path, files[i].host, files[i].rootPath)
+				AND deleted_at IS NULL
+			`, a.Path, a.Host, a.RootFolder)
 			if err != nil {
-				logging.ErrorLogger.Printf("Warning: Failed to delete file %s from database: %v", files[i].path, err)
+				logging.ErrorLogger.Printf("Warning: Failed to delete file %s from database: %v", a.Path, err)
+				rowErrors.add()
+				return false, nil
 			}
-		}
-		moved++
+			return true, nil
+		},
+		restore: func(a journalAction) error {
+			if a.NewHost != "" {
+				if restored, err := restoreRewrittenRow(db, a); err != nil || restored {
+					return err
+				}
+			}
+			_, err := db.Exec(`
+				UPDATE files SET deleted_at = NULL
+				WHERE id = (
+					SELECT id FROM files
+					WHERE path = $1
+					AND hostname = $2
+					AND COALESCE(root_folder, '') = $3
+					AND deleted_at IS NOT NULL
+					ORDER BY deleted_at DESC, id DESC
+					LIMIT 1
+				)
+				AND NOT EXISTS (
+					SELECT 1 FROM files
+					WHERE path = $1 AND hostname = $2 AND `+NotDeleted+`
+				)
+			`, a.Path, a.Host, a.RootFolder)
+			return err
+		},
 	}
+}
 
-	return moved, nil
+// checkMinAge returns an error when the file described by info was modified
+// less than minAge ago: another process may still be uploading it, and moving
+// it would corrupt the transfer. Such a copy is skipped and keeps its row, so
+// the next run reconsiders it.
+func checkMinAge(info os.FileInfo, minAge time.Duration) error {
+	if age := time.Since(info.ModTime()); minAge > 0 && age < minAge {
+		return fmt.Errorf("too new: modified %s ago (--min-age %s)", age.Round(time.Second), minAge)
+	}
+	return nil
+}
+
+// byteCap is --max-bytes: once the copies moved add up to max bytes, no new
+// group is started. The group that reaches it is finished, so no group is
+// left half moved. The groups after it are only added up, for the summary. A
+// zero max moves without a limit.
+type byteCap struct {
+	max        int64
+	moved      int64
+	leftGroups int64
+	leftBytes  int64
+}
+
+// full reports whether no new group may be started.
+func (c *byteCap) full() bool {
+	return c.max > 0 && c.moved >= c.max
+}
+
+// leave counts a group left for the next run, whose duplicates hold bytes.
+func (c *byteCap) leave(bytes int64) {
+	c.leftGroups++
+	c.leftBytes += bytes
+}
+
+// print adds the cutoff to the summary, if the cap was reached.
+func (c *byteCap) print(dryRun bool) {
+	if !c.full() {
+		return
+	}
+	verb := "Stopped"
+	if dryRun {
+		verb = "Would stop"
+	}
+	fmt.Printf("%s at --max-bytes (%s bytes) after %s bytes; %d groups with %s bytes of duplicates remain for the next run\n",
+		verb, formatBytes(c.max), formatBytes(c.moved), c.leftGroups, formatBytes(c.leftBytes))
 }
 
 func archiveRelativePath(path string) string {
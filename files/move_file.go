@@ -0,0 +1,37 @@
+package files
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"syscall"
+)
+
+// renameFile and rsyncFile carry out the moves of moveFile. Tests replace them
+// to simulate a move across filesystems.
+var (
+	renameFile = os.Rename
+	rsyncFile  = func(src, dst string, opts []string) ([]byte, error) {
+		args := append([]string{"-a", "--remove-source-files"}, opts...)
+		return exec.Command("rsync", append(args, src, dst)...).CombinedOutput()
+	}
+)
+
+// moveFile moves src to dst. A rename cannot cross filesystems, so when dst
+// is on another mount (EXDEV) the file is copied with rsync
+// --remove-source-files instead, which only removes src once dst is complete;
+// rsyncOpts are added to its arguments. The directory of dst must exist.
+func moveFile(src, dst string, rsyncOpts ...string) error {
+	err := renameFile(src, dst)
+	if err == nil {
+		return nil
+	}
+	if !errors.Is(err, syscall.EXDEV) {
+		return fmt.Errorf("error moving file %s: %v", src, err)
+	}
+	if output, err := rsyncFile(src, dst, rsyncOpts); err != nil {
+		return fmt.Errorf("error moving file %s with rsync: %v\nOutput: %s", src, err, output)
+	}
+	return nil
+}
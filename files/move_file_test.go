@@ -0,0 +1,74 @@
+package files
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+)
+
+var defaultRsyncFile = rsyncFile
+
+// simulateCrossDevice makes every rename fail with EXDEV, as it does when
+// the target is on another mount, and records the rsync fallbacks, which
+// rename the file themselves unless fail returns an error for it.
+func simulateCrossDevice(t *testing.T, fail func(src string) error) *[]string {
+	var rsynced []string
+	renameFile = func(src, dst string) error {
+		return &os.LinkError{Op: "rename", Old: src, New: dst, Err: syscall.EXDEV}
+	}
+	rsyncFile = func(src, dst string, opts []string) ([]byte, error) {
+		rsynced = append(rsynced, src)
+		if err := fail(src); err != nil {
+			return []byte("rsync: write failed"), err
+		}
+		return nil, os.Rename(src, dst)
+	}
+	t.Cleanup(func() {
+		renameFile = os.Rename
+		rsyncFile = defaultRsyncFile
+	})
+	return &rsynced
+}
+
+func TestMoveFileFallsBackToRsyncAcrossFilesystems(t *testing.T) {
+	root := t.TempDir()
+	src, dst := filepath.Join(root, "a.txt"), filepath.Join(root, "b.txt")
+	if err := os.WriteFile(src, []byte("data"), 0644); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	rsynced := simulateCrossDevice(t, func(string) error { return nil })
+
+	if err := moveFile(src, dst); err != nil {
+		t.Fatalf("moveFile: %v", err)
+	}
+	if len(*rsynced) != 1 || (*rsynced)[0] != src {
+		t.Fatalf("expected one rsync of %s, got %v", src, *rsynced)
+	}
+	assertExists(t, src, false)
+	assertExists(t, dst, true)
+}
+
+func TestMoveFileReportsOtherRenameErrors(t *testing.T) {
+	var rsynced bool
+	renameFile = func(src, dst string) error {
+		return &os.LinkError{Op: "rename", Old: src, New: dst, Err: syscall.EACCES}
+	}
+	rsyncFile = func(src, dst string, opts []string) ([]byte, error) {
+		rsynced = true
+		return nil, nil
+	}
+	t.Cleanup(func() {
+		renameFile = os.Rename
+		rsyncFile = defaultRsyncFile
+	})
+
+	err := moveFile("/data/a.txt", "/dupes/a.txt")
+	if err == nil || !strings.Contains(err.Error(), "permission denied") {
+		t.Fatalf("expected the rename error, got %v", err)
+	}
+	if rsynced {
+		t.Fatal("rsync should only be used across filesystems")
+	}
+}
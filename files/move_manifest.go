@@ -0,0 +1,312 @@
+package files
+
+import (
+	"bufio"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"deduplicator/db"
+)
+
+// moveManifestFile is kept next to the group journal: in the destination
+// directory, or on this machine for a remote destination. list-dupes --dest
+// and move-dupes append one JSON line to it per copy they move, run after
+// run, and files undo-moves reads it to move the copies back.
+const moveManifestFile = ".deduplicator-moves.jsonl"
+
+// movedFile is one line of the move manifest: a copy moved from Source to
+// Target, and the files row it had.
+type movedFile struct {
+	Source     string          `json:"source"`
+	Target     string          `json:"target"`
+	Remote     string          `json:"remote,omitempty"` // ssh host holding Target, if not this machine
+	SSH        *db.SSHSettings `json:"ssh,omitempty"`
+	Link       string          `json:"link,omitempty"` // kept copy a symlink at Source points to
+	Hostname   string          `json:"hostname"`
+	RootFolder string          `json:"root_folder,omitempty"`
+	Path       string          `json:"path"` // files.path of the row
+	Hash       string          `json:"hash"`
+	Size       int64           `json:"size"`
+	NewHost    string          `json:"new_host,omitempty"` // the row a tracked remote destination took over
+	NewRoot    string          `json:"new_root,omitempty"`
+	NewPath    string          `json:"new_path,omitempty"`
+	RowKept    bool            `json:"row_kept,omitempty"` // the row could not be updated and still lists Source
+	MovedAt    time.Time       `json:"moved_at"`
+}
+
+func newMovedFile(j *groupJournal, a journalAction) movedFile {
+	return movedFile{
+		Source:     a.Source,
+		Target:     a.Target,
+		Remote:     a.Remote,
+		SSH:        a.SSH,
+		Link:       a.Link,
+		Hostname:   a.Host,
+		RootFolder: a.RootFolder,
+		Path:       a.Path,
+		Hash:       j.Hash,
+		Size:       j.Size,
+		NewHost:    a.NewHost,
+		NewRoot:    a.NewRoot,
+		NewPath:    a.NewPath,
+		MovedAt:    time.Now(),
+	}
+}
+
+// action returns the journal action that moved m, to move it back with.
+func (m movedFile) action() journalAction {
+	return journalAction{
+		Path:       m.Path,
+		Host:       m.Hostname,
+		RootFolder: m.RootFolder,
+		Source:     m.Source,
+		Target:     m.Target,
+		Remote:     m.Remote,
+		SSH:        m.SSH,
+		NewHost:    m.NewHost,
+		NewRoot:    m.NewRoot,
+		NewPath:    m.NewPath,
+		Link:       m.Link,
+	}
+}
+
+// appendMoveManifest adds m to the manifest in dir.
+func appendMoveManifest(dir string, m movedFile) error {
+	path := filepath.Join(dir, moveManifestFile)
+	data, err := json.Marshal(m)
+	if err != nil {
+		return fmt.Errorf("error encoding move manifest entry: %v", err)
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return fmt.Errorf("error opening move manifest %s: %v", path, err)
+	}
+	if _, err := f.Write(append(data, '\n')); err != nil {
+		f.Close()
+		return fmt.Errorf("error writing move manifest %s: %v", path, err)
+	}
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("error writing move manifest %s: %v", path, err)
+	}
+	return nil
+}
+
+// readMoveManifest returns the entries of the manifest at path, oldest first.
+func readMoveManifest(path string) ([]movedFile, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("error opening move manifest: %v", err)
+	}
+	defer f.Close()
+
+	var entries []movedFile
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for line := 1; scanner.Scan(); line++ {
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+		var m movedFile
+		if err := json.Unmarshal(scanner.Bytes(), &m); err != nil {
+			return nil, fmt.Errorf("error decoding line %d of %s: %v", line, path, err)
+		}
+		if m.Source == "" || m.Target == "" || m.Path == "" || m.Hostname == "" {
+			return nil, fmt.Errorf("line %d of %s is not a move manifest entry", line, path)
+		}
+		entries = append(entries, m)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("error reading %s: %v", path, err)
+	}
+	return entries, nil
+}
+
+// printMoveManifest tells where the moves of a run were recorded.
+func printMoveManifest(dir string) {
+	path := filepath.Join(dir, moveManifestFile)
+	fmt.Printf("Moves recorded in %s; files undo-moves --manifest %s moves them back\n", path, path)
+}
+
+// undoTally counts what files undo-moves did with the entries of a manifest.
+type undoTally struct {
+	restored    int64
+	alreadyBack int64
+	conflicts   int64
+	failed      int64
+}
+
+// UndoMoves moves the copies recorded in a move manifest back to where they
+// were, latest first, and brings their rows back: the row a tracked remote
+// destination took over, the row the move soft-deleted, or a new one when
+// that row is gone. A copy whose original path is taken again is left where
+// it is and reported as a conflict; one already back is skipped, so a
+// manifest can be undone again after an interruption. Like the moves, it
+// runs on the machine the copies were moved from.
+func UndoMoves(ctx context.Context, database *sql.DB, opts UndoMovesOptions) error {
+	entries, err := readMoveManifest(opts.Manifest)
+	if err != nil {
+		return err
+	}
+	if len(entries) == 0 {
+		fmt.Printf("No moves recorded in %s\n", opts.Manifest)
+		return nil
+	}
+
+	var tally undoTally
+	for i := len(entries) - 1; i >= 0; i-- {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		undoMovedFile(ctx, database, entries[i], opts.DryRun, &tally)
+	}
+
+	verb := "Moved back"
+	if opts.DryRun {
+		verb = "Would move back"
+	}
+	fmt.Printf("\n%s %d files", verb, tally.restored)
+	if tally.alreadyBack > 0 {
+		fmt.Printf(", %d already back", tally.alreadyBack)
+	}
+	fmt.Println()
+	if tally.conflicts > 0 {
+		fmt.Printf("Left %d files at their destination: their original path is taken\n", tally.conflicts)
+	}
+	opts.Stats.Set("restored", tally.restored)
+	opts.Stats.Set("already_back", tally.alreadyBack)
+	opts.Stats.Set("conflicts", tally.conflicts)
+	opts.Stats.Set("errors", tally.failed)
+	if tally.failed > 0 {
+		return fmt.Errorf("failed to undo %d moves", tally.failed)
+	}
+	if opts.DryRun {
+		fmt.Println("Dry run mode - nothing was moved back.")
+	}
+	return nil
+}
+
+// undoMovedFile moves one copy back and restores its row.
+func undoMovedFile(ctx context.Context, database *sql.DB, m movedFile, dryRun bool, tally *undoTally) {
+	a := m.action()
+	target := m.Target
+	if m.Remote != "" {
+		target = m.Remote + ":" + m.Target
+	}
+
+	targetExists, err := movedTargetExists(ctx, m)
+	if err != nil {
+		fmt.Printf("Failed: %s: %v\n", target, err)
+		tally.failed++
+		return
+	}
+	if info, err := os.Lstat(m.Source); err == nil {
+		isLink := m.Link != "" && info.Mode()&os.ModeSymlink != 0
+		switch {
+		case !targetExists && !isLink:
+			tally.alreadyBack++
+			return
+		case !isLink:
+			fmt.Printf("Conflict: %s is taken; leaving %s in place\n", m.Source, target)
+			tally.conflicts++
+			return
+		}
+	} else if !os.IsNotExist(err) {
+		fmt.Printf("Failed: %s: %v\n", m.Source, err)
+		tally.failed++
+		return
+	}
+	if !targetExists {
+		fmt.Printf("Failed: %s is gone; cannot move it back to %s\n", target, m.Source)
+		tally.failed++
+		return
+	}
+
+	if dryRun {
+		fmt.Printf("Would move back: %s -> %s\n", target, m.Source)
+		tally.restored++
+		return
+	}
+	if m.Link != "" {
+		if err := a.unlinkFromKeeper(); err != nil {
+			fmt.Printf("Failed: %v\n", err)
+			tally.failed++
+			return
+		}
+	}
+	if err := a.moveToSource(); err != nil {
+		fmt.Printf("Failed: moving %s back to %s: %v\n", target, m.Source, err)
+		tally.failed++
+		return
+	}
+	// A row the move could not update still lists the source: leave it as is
+	if !m.RowKept {
+		if err := restoreMovedRow(ctx, database, m); err != nil {
+			fmt.Printf("Failed: moved %s back, but its row could not be restored: %v\n", m.Source, err)
+			tally.failed++
+			return
+		}
+	}
+	fmt.Printf("Moved back: %s -> %s\n", target, m.Source)
+	tally.restored++
+}
+
+// movedTargetExists reports whether the moved copy is still at its target.
+func movedTargetExists(ctx context.Context, m movedFile) (bool, error) {
+	if m.Remote != "" {
+		return remoteFileExists(ctx, m.Remote, m.action().sshSettings(), m.Target)
+	}
+	if _, err := os.Stat(m.Target); err != nil {
+		if os.IsNotExist(err) {
+			return false, nil
+		}
+		return false, err
+	}
+	return true, nil
+}
+
+// restoreMovedRow brings back the row of a copy moved back to its source. It
+// is a no-op when the path is indexed again.
+func restoreMovedRow(ctx context.Context, database *sql.DB, m movedFile) error {
+	if m.NewHost != "" {
+		if restored, err := restoreRewrittenRow(database, m.action()); err != nil || restored {
+			return err
+		}
+	}
+	result, err := database.ExecContext(ctx, `
+		UPDATE files SET deleted_at = NULL
+		WHERE id = (
+			SELECT id FROM files
+			WHERE path = $1
+			AND hostname = $2
+			AND COALESCE(root_folder, '') = $3
+			AND deleted_at IS NOT NULL
+			ORDER BY deleted_at DESC, id DESC
+			LIMIT 1
+		)
+		AND NOT EXISTS (
+			SELECT 1 FROM files
+			WHERE path = $1 AND hostname = $2 AND `+NotDeleted+`
+		)
+	`, m.Path, m.Hostname, m.RootFolder)
+	if err != nil {
+		return err
+	}
+	if n, err := result.RowsAffected(); err != nil || n > 0 {
+		return err
+	}
+	// files vacuum purged the row: insert it again
+	_, err = database.ExecContext(ctx, `
+		INSERT INTO files (path, root_folder, size, hash, hostname, added_by, added_host_user)
+		SELECT $1, NULLIF($3, ''), $4, $5, $2, $6, $7
+		WHERE NOT EXISTS (
+			SELECT 1 FROM files
+			WHERE path = $1 AND hostname = $2 AND `+NotDeleted+`
+		)
+	`, m.Path, m.Hostname, m.RootFolder, m.Size, m.Hash, OriginUndo, currentHostUser())
+	return err
+}
@@ -0,0 +1,204 @@
+package files
+
+import (
+	"context"
+	"database/sql"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+const undoRestoreRow = `(?s)UPDATE files SET deleted_at = NULL\s+WHERE id = \(.*AND deleted_at IS NOT NULL`
+
+// moveBothCopies runs MoveDuplicates over the fixture, moving a.mkv and
+// b.mkv while the remote copy is kept.
+func moveBothCopies(t *testing.T, db *sql.DB, mock sqlmock.Sqlmock, f journalFixture) string {
+	t.Helper()
+	expectMoveLookup(mock, f, true)
+	for _, name := range []string{"a.mkv", "b.mkv"} {
+		mock.ExpectExec(`UPDATE files SET deleted_at = NOW\(\)`).
+			WithArgs(name, "zz-local", f.local).
+			WillReturnResult(sqlmock.NewResult(0, 1))
+	}
+	var err error
+	out := captureStdout(t, func() {
+		err = MoveDuplicates(context.Background(), db, DuplicateListOptions{}, MoveOptions{TargetDir: f.dest})
+	})
+	if err != nil {
+		t.Fatalf("MoveDuplicates: %v", err)
+	}
+	return out
+}
+
+func TestUndoMovesRestoresMovedCopiesAndRows(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("sqlmock: %v", err)
+	}
+	defer db.Close()
+
+	f := newJournalFixture(t)
+	manifest := filepath.Join(f.dest, moveManifestFile)
+	out := moveBothCopies(t, db, mock, f)
+	if !strings.Contains(out, "Moves recorded in "+manifest) {
+		t.Fatalf("expected the summary to name the manifest:\n%s", out)
+	}
+	entries, err := readMoveManifest(manifest)
+	if err != nil {
+		t.Fatalf("readMoveManifest: %v", err)
+	}
+	if len(entries) != 2 {
+		t.Fatalf("expected 2 manifest entries, got %+v", entries)
+	}
+	for i, m := range entries {
+		if m.Source != f.sources[i] || m.Target != f.targets[i] || m.Hash != "hash-1" || m.Size != 3 || m.Hostname != "zz-local" || m.MovedAt.IsZero() {
+			t.Fatalf("unexpected manifest entry %d: %+v", i, m)
+		}
+	}
+
+	// The latest move is undone first; a.mkv's row was purged and comes back by INSERT
+	mock.ExpectExec(undoRestoreRow).
+		WithArgs("b.mkv", "zz-local", f.local).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(undoRestoreRow).
+		WithArgs("a.mkv", "zz-local", f.local).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec(`INSERT INTO files \(path, root_folder, size, hash, hostname, added_by, added_host_user\)`).
+		WithArgs("a.mkv", "zz-local", f.local, int64(3), "hash-1", OriginUndo, sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+
+	stats := &RunStats{}
+	out = captureStdout(t, func() {
+		err = UndoMoves(context.Background(), db, UndoMovesOptions{Manifest: manifest, Stats: stats})
+	})
+	if err != nil {
+		t.Fatalf("UndoMoves: %v", err)
+	}
+	for i := range f.sources {
+		assertExists(t, f.sources[i], true)
+		assertExists(t, f.targets[i], false)
+	}
+	if !strings.Contains(out, "Moved back 2 files") {
+		t.Fatalf("unexpected summary:\n%s", out)
+	}
+	if counters := stats.Counters(); counters["restored"] != 2 {
+		t.Fatalf("unexpected counters %v", counters)
+	}
+
+	// Undoing again finds every copy back and touches nothing
+	out = captureStdout(t, func() {
+		err = UndoMoves(context.Background(), db, UndoMovesOptions{Manifest: manifest})
+	})
+	if err != nil || !strings.Contains(out, "Moved back 0 files, 2 already back") {
+		t.Fatalf("expected a no-op second undo, got %v:\n%s", err, out)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatalf("unmet expectations: %v", err)
+	}
+}
+
+func TestUndoMovesReportsOccupiedOriginalPath(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("sqlmock: %v", err)
+	}
+	defer db.Close()
+
+	f := newJournalFixture(t)
+	manifest := filepath.Join(f.dest, moveManifestFile)
+	moveBothCopies(t, db, mock, f)
+	if err := os.WriteFile(f.sources[0], []byte("new"), 0644); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+
+	out := captureStdout(t, func() {
+		err = UndoMoves(context.Background(), db, UndoMovesOptions{Manifest: manifest, DryRun: true})
+	})
+	if err != nil {
+		t.Fatalf("dry run: %v", err)
+	}
+	if !strings.Contains(out, "Would move back: "+f.targets[1]+" -> "+f.sources[1]) || !strings.Contains(out, "Conflict: "+f.sources[0]+" is taken") {
+		t.Fatalf("unexpected dry run:\n%s", out)
+	}
+	assertExists(t, f.targets[1], true)
+
+	mock.ExpectExec(undoRestoreRow).
+		WithArgs("b.mkv", "zz-local", f.local).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	stats := &RunStats{}
+	out = captureStdout(t, func() {
+		err = UndoMoves(context.Background(), db, UndoMovesOptions{Manifest: manifest, Stats: stats})
+	})
+	if err != nil {
+		t.Fatalf("UndoMoves: %v", err)
+	}
+	if data, _ := os.ReadFile(f.sources[0]); string(data) != "new" {
+		t.Fatalf("the file now at %s must be left alone, got %q", f.sources[0], data)
+	}
+	assertExists(t, f.targets[0], true)
+	assertExists(t, f.sources[1], true)
+	if !strings.Contains(out, "Left 1 files at their destination: their original path is taken") {
+		t.Fatalf("expected the conflict in the summary:\n%s", out)
+	}
+	if counters := stats.Counters(); counters["restored"] != 1 || counters["conflicts"] != 1 {
+		t.Fatalf("unexpected counters %v", counters)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatalf("unmet expectations: %v", err)
+	}
+}
+
+func TestUndoMovesLeavesRowTheMoveCouldNotUpdate(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("sqlmock: %v", err)
+	}
+	defer db.Close()
+
+	f := newJournalFixture(t)
+	manifest := filepath.Join(f.dest, moveManifestFile)
+	expectMoveLookup(mock, f, true)
+	mock.ExpectExec(`UPDATE files SET deleted_at = NOW\(\)`).
+		WithArgs("a.mkv", "zz-local", f.local).
+		WillReturnError(sql.ErrConnDone)
+	mock.ExpectExec(`UPDATE files SET deleted_at = NOW\(\)`).
+		WithArgs("b.mkv", "zz-local", f.local).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	captureStdout(t, func() {
+		err = MoveDuplicates(context.Background(), db, DuplicateListOptions{}, MoveOptions{TargetDir: f.dest})
+	})
+	if err != nil {
+		t.Fatalf("MoveDuplicates: %v", err)
+	}
+	entries, err := readMoveManifest(manifest)
+	if err != nil {
+		t.Fatalf("readMoveManifest: %v", err)
+	}
+	if len(entries) != 2 || !entries[0].RowKept || entries[1].RowKept {
+		t.Fatalf("expected only a.mkv's entry to keep its row, got %+v", entries)
+	}
+
+	// Only b.mkv's row was soft-deleted, so only it is restored
+	mock.ExpectExec(undoRestoreRow).
+		WithArgs("b.mkv", "zz-local", f.local).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	out := captureStdout(t, func() {
+		err = UndoMoves(context.Background(), db, UndoMovesOptions{Manifest: manifest})
+	})
+	if err != nil {
+		t.Fatalf("UndoMoves: %v", err)
+	}
+	for i := range f.sources {
+		assertExists(t, f.sources[i], true)
+		assertExists(t, f.targets[i], false)
+	}
+	if !strings.Contains(out, "Moved back 2 files") {
+		t.Fatalf("unexpected summary:\n%s", out)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatalf("unmet expectations: %v", err)
+	}
+}
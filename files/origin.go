@@ -0,0 +1,42 @@
+package files
+
+import (
+	"os"
+	"os/user"
+	"sync"
+)
+
+// Values of files.added_by, naming the command that first inserted a row.
+const (
+	OriginFind   = "find"
+	OriginImport = "import"
+	OriginUpdate = "update"
+	OriginMirror = "mirror"
+	OriginUndo   = "undo-moves"
+)
+
+// preserveOrigin keeps the added_by and added_host_user of an existing row
+// when an upsert hits it; rows from before the columns existed get them
+// filled in.
+const preserveOrigin = `added_by = COALESCE(files.added_by, EXCLUDED.added_by),
+			added_host_user = COALESCE(files.added_host_user, EXCLUDED.added_host_user)`
+
+var (
+	hostUserOnce sync.Once
+	hostUser     string
+)
+
+// currentHostUser returns the OS user this process runs as, recorded in
+// files.added_host_user. It falls back to $USER and then to "unknown".
+func currentHostUser() string {
+	hostUserOnce.Do(func() {
+		if u, err := user.Current(); err == nil && u.Username != "" {
+			hostUser = u.Username
+		} else if name := os.Getenv("USER"); name != "" {
+			hostUser = name
+		} else {
+			hostUser = "unknown"
+		}
+	})
+	return hostUser
+}
@@ -0,0 +1,105 @@
+package files
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os/exec"
+	"sort"
+	"strings"
+
+	"deduplicator/db"
+)
+
+// DefaultMaxPathLen is the longest absolute path, in bytes, that find and
+// import index or transfer (--max-path-len). Postgres stores longer paths
+// fine, but they break later: in the ssh commands that quote them and in
+// moves into a duplicates directory, which fail with ENAMETOOLONG.
+const DefaultMaxPathLen = 3800
+
+// pathLengthWorst is how many of the longest skipped paths the warning lists.
+const pathLengthWorst = 5
+
+// pathLengthCheck skips files whose path is longer than limit, counting them
+// and keeping the longest for one summarized warning at the end of a run.
+type pathLengthCheck struct {
+	limit   int
+	skipped int64
+	worst   []string // longest first
+}
+
+func newPathLengthCheck(limit int) *pathLengthCheck {
+	if limit <= 0 {
+		limit = DefaultMaxPathLen
+	}
+	return &pathLengthCheck{limit: limit}
+}
+
+// allow reports whether every one of paths fits the limit. Otherwise it
+// counts the file as skipped under the longest of them.
+func (c *pathLengthCheck) allow(paths ...string) bool {
+	longest := ""
+	for _, p := range paths {
+		if len(p) > len(longest) {
+			longest = p
+		}
+	}
+	if len(longest) <= c.limit {
+		return true
+	}
+	c.skipped++
+	c.worst = append(c.worst, longest)
+	sort.SliceStable(c.worst, func(i, j int) bool { return len(c.worst[i]) > len(c.worst[j]) })
+	if len(c.worst) > pathLengthWorst {
+		c.worst = c.worst[:pathLengthWorst]
+	}
+	return false
+}
+
+// warning returns the summary of the skipped files, or "" if there were none.
+func (c *pathLengthCheck) warning() string {
+	if c.skipped == 0 {
+		return ""
+	}
+	var b strings.Builder
+	fmt.Fprintf(&b, "Warning: skipped %d files whose path is longer than %d bytes (--max-path-len); the longest:", c.skipped, c.limit)
+	for _, p := range c.worst {
+		fmt.Fprintf(&b, "\n  %d bytes: %s", len(p), abbreviatePath(p))
+	}
+	return b.String()
+}
+
+// abbreviatePath keeps the start and end of a long path, which is what tells
+// runaway nesting apart, and elides the middle.
+func abbreviatePath(p string) string {
+	const keep = 60
+	if len(p) <= 2*keep+3 {
+		return p
+	}
+	return p[:keep] + "..." + p[len(p)-keep:]
+}
+
+// remoteArgMax bounds the arguments of the ssh commands built by sshCommand.
+// It is _POSIX_ARG_MAX, the smallest ARG_MAX a POSIX system may have, so the
+// remote shell accepts the command whatever the host runs; a path that fits
+// --max-path-len leaves room for the command around it.
+const remoteArgMax = 4096
+
+// errRemoteCommandTooLong is returned by sshCommand for oversized commands.
+var errRemoteCommandTooLong = errors.New("path too long for a remote command")
+
+// sshCommand returns the command running args on host over ssh, connecting
+// with the host's ssh settings, or errRemoteCommandTooLong when the arguments
+// would exceed remoteArgMax, so the failure names the cause instead of
+// surfacing as an ssh error.
+func sshCommand(ctx context.Context, host string, settings db.SSHSettings, args ...string) (*exec.Cmd, error) {
+	size := len("ssh") + 1 + len(host) + 1
+	for _, arg := range args {
+		size += len(arg) + 1
+	}
+	if size > remoteArgMax {
+		return nil, fmt.Errorf("%w: %d bytes for ssh to %s, over the %d byte limit", errRemoteCommandTooLong, size, host, remoteArgMax)
+	}
+	argv := append(sshOptions(settings), host)
+	return exec.CommandContext(ctx, "ssh", append(argv, args...)...), nil
+}
@@ -0,0 +1,147 @@
+package files
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"deduplicator/db"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+// deepFile creates a file under root nested deep enough for its path to be
+// longer than length bytes, and returns that path.
+func deepFile(t *testing.T, root string, length int) string {
+	t.Helper()
+	dir := root
+	for i := 0; len(dir) <= length; i++ {
+		dir = filepath.Join(dir, strings.Repeat("d", 40)+string(rune('a'+i%26)))
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		t.Fatalf("mkdir deep path: %v", err)
+	}
+	path := filepath.Join(dir, "runaway.txt")
+	if err := os.WriteFile(path, []byte("deep"), 0644); err != nil {
+		t.Fatalf("write deep file: %v", err)
+	}
+	return path
+}
+
+func TestPathLengthCheckKeepsTheLongest(t *testing.T) {
+	c := newPathLengthCheck(10)
+	if !c.allow("/short", "/also/ok") {
+		t.Fatalf("paths within the limit were refused")
+	}
+	for _, p := range []string{"/a/bbbbbbbbbbb", "/a/bbbbbbbbbbbbbbbbbbbbb", "/ok", "/a/bbbbbbbbbbbbbbbb", "/a/bbbbbbbbbbbbbbbbbbbbbbbbbbbb", "/a/bbbbbbbbbbbbbbbbbbbbbbbbb", "/a/bbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbb"} {
+		c.allow(p)
+	}
+	if c.skipped != 6 || len(c.worst) != pathLengthWorst {
+		t.Fatalf("skipped %d, kept %d", c.skipped, len(c.worst))
+	}
+	if c.worst[0] != "/a/bbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbb" || c.worst[len(c.worst)-1] != "/a/bbbbbbbbbbbbbbbb" {
+		t.Fatalf("unexpected worst offenders %v", c.worst)
+	}
+	if w := c.warning(); !strings.HasPrefix(w, "Warning: skipped 6 files whose path is longer than 10 bytes") || !strings.Contains(w, "\n  37 bytes: /a/b") {
+		t.Fatalf("unexpected warning %q", w)
+	}
+	if newPathLengthCheck(0).limit != DefaultMaxPathLen {
+		t.Fatalf("expected the default limit for 0")
+	}
+}
+
+func TestSSHCommandRefusesOversizedCommands(t *testing.T) {
+	if _, err := sshCommand(context.Background(), "nas", db.SSHSettings{}, "test -e "+shellEscape("/data/"+strings.Repeat("x", DefaultMaxPathLen-6))); err != nil {
+		t.Fatalf("a path at --max-path-len should fit: %v", err)
+	}
+	_, err := sshCommand(context.Background(), "nas", db.SSHSettings{}, "mkdir", "-p", "/data/"+strings.Repeat("x", remoteArgMax))
+	if !errors.Is(err, errRemoteCommandTooLong) {
+		t.Fatalf("expected errRemoteCommandTooLong, got %v", err)
+	}
+}
+
+func TestFindFilesSkipsPathsOverMaxPathLen(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("sqlmock: %v", err)
+	}
+	defer db.Close()
+
+	root := t.TempDir()
+	if err := os.WriteFile(filepath.Join(root, "ok.txt"), []byte("ok"), 0644); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	limit := len(root) + 200
+	deepFile(t, root, limit)
+
+	insert, lookup, _ := expectFindSetup(mock, root)
+	lookup.ExpectQuery().
+		WithArgs("backup1.local", sqlmock.AnyArg(), sqlmock.AnyArg()).
+		WillReturnRows(inodeRows())
+	insert.ExpectQuery().
+		WithArgs("ok.txt", "backup1.local", sqlmock.AnyArg(), root, sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg(), OriginFind, sqlmock.AnyArg(), nil).
+		WillReturnRows(insertedRow(true))
+	mock.ExpectCommit()
+
+	stats := &RunStats{}
+	out := captureStdout(t, func() {
+		err = FindFiles(context.Background(), db, FindOptions{Server: "Backup1", Path: "photos", MaxPathLen: limit, Stats: stats})
+	})
+	if err != nil {
+		t.Fatalf("FindFiles error: %v", err)
+	}
+	if c := stats.Counters(); c["path_too_long"] != 1 || c["processed"] != 1 {
+		t.Fatalf("unexpected counters %v", c)
+	}
+	if !strings.Contains(out, "Skipped (path too long): 1") {
+		t.Fatalf("expected the skip in the summary:\n%s", out)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatalf("unmet expectations: %v", err)
+	}
+}
+
+func TestImportSkipsPathsOverMaxPathLen(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("sqlmock: %v", err)
+	}
+	defer db.Close()
+
+	source, dest := routedImportFixture(t)
+	limit := len(dest) + 300
+	deep := deepFile(t, filepath.Join(source, "misc"), limit)
+	expectRoutedImportHost(mock, dest)
+
+	stats := &RunStats{}
+	out := captureStdout(t, func() {
+		err = ImportFiles(context.Background(), db, ImportOptions{
+			SourcePath:   source,
+			HostName:     "Backup1",
+			FriendlyPath: "inbox",
+			DryRun:       true,
+			MaxPathLen:   limit,
+			Stats:        stats,
+		})
+	})
+	if err != nil {
+		t.Fatalf("ImportFiles: %v", err)
+	}
+	if c := stats.Counters(); c["skipped_path_too_long"] != 1 || c["files"] != 3 {
+		t.Fatalf("unexpected counters %v", c)
+	}
+	for _, want := range []string{"Files skipped (path too long): 1", "Warning: skipped 1 files whose path is longer than"} {
+		if !strings.Contains(out, want) {
+			t.Errorf("output does not mention %q:\n%s", want, out)
+		}
+	}
+	if strings.Contains(out, "Would transfer "+deep) {
+		t.Errorf("the deep file was planned for transfer:\n%s", out)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatalf("unmet expectations: %v", err)
+	}
+}
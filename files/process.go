@@ -12,11 +12,49 @@ import (
 	"sync"
 	"time"
 
+	"deduplicator/db"
+
 	"github.com/schollz/progressbar/v3"
 )
 
+// LocalHostName returns the name of the hosts row whose hostname is
+// hostname. With register, a missing row is first created under the
+// lowercased hostname, as --auto-register does.
+func LocalHostName(sqldb *sql.DB, hostname string, register bool) (string, error) {
+	var hostName string
+	err := sqldb.QueryRow(`
+		SELECT name
+		FROM hosts
+		WHERE LOWER(hostname) = LOWER($1)
+	`, hostname).Scan(&hostName)
+	if err == sql.ErrNoRows && register {
+		added, regErr := db.RegisterHostIfMissing(sqldb, hostname, nil)
+		if regErr != nil {
+			return "", regErr
+		}
+		if added {
+			log.Printf("Registered host %s (used as both name and hostname); add its friendly paths with 'deduplicator manage path-add'", strings.ToLower(hostname))
+		}
+		err = sqldb.QueryRow(`
+			SELECT name
+			FROM hosts
+			WHERE LOWER(hostname) = LOWER($1)
+		`, hostname).Scan(&hostName)
+	}
+	if err != nil {
+		if err == sql.ErrNoRows {
+			if register {
+				return "", UnknownHostError(hostname)
+			}
+			return "", fmt.Errorf("%v, or rerun with --register", UnknownHostError(hostname))
+		}
+		return "", fmt.Errorf("error finding host: %v", err)
+	}
+	return hostName, nil
+}
+
 // ProcessStdin processes a list of files from standard input and adds them to the database
-func ProcessStdin(ctx context.Context, db *sql.DB) error {
+func ProcessStdin(ctx context.Context, db *sql.DB, opts UpdateOptions) error {
 	// Get hostname for current machine
 	hostname, err := os.Hostname()
 	if err != nil {
@@ -28,17 +66,9 @@ func ProcessStdin(ctx context.Context, db *sql.DB) error {
 	log.Printf("Looking up host for hostname: %s", hostname)
 
 	// Find host in database by hostname (case-insensitive)
-	var hostName string
-	err = db.QueryRow(`
-		SELECT name
-		FROM hosts
-		WHERE LOWER(hostname) = LOWER($1)
-	`, hostname).Scan(&hostName)
+	hostName, err := LocalHostName(db, hostname, opts.Register)
 	if err != nil {
-		if err == sql.ErrNoRows {
-			return fmt.Errorf("no host found for hostname %s, please add it using 'dedupe manage add'", hostname)
-		}
-		return fmt.Errorf("error finding host: %v", err)
+		return err
 	}
 	log.Printf("Found host: %s", hostName)
 
@@ -51,10 +81,11 @@ func ProcessStdin(ctx context.Context, db *sql.DB) error {
 
 	// Prepare statement for batch inserts
 	stmt, err := tx.Prepare(`
-		INSERT INTO files (path, hostname, size)
-		VALUES ($1, $2, $3)
-		ON CONFLICT (path, hostname) 
-		DO UPDATE SET size = EXCLUDED.size
+		INSERT INTO files (path, hostname, size, added_by, added_host_user)
+		VALUES ($1, $2, $3, $4, $5)
+		ON CONFLICT (path, hostname) WHERE deleted_at IS NULL
+		DO UPDATE SET size = EXCLUDED.size,
+			` + preserveOrigin + `
 	`)
 	if err != nil {
 		return fmt.Errorf("error preparing statement: %v", err)
@@ -101,7 +132,7 @@ func ProcessStdin(ctx context.Context, db *sql.DB) error {
 		}
 
 		// Insert file into database
-		_, err = stmt.Exec(path, hostName, fileInfo.Size())
+		_, err = stmt.Exec(path, normalizeHostname(hostName), fileInfo.Size(), OriginUpdate, currentHostUser())
 		if err != nil {
 			log.Printf("Warning: Error inserting file %s: %v", path, err)
 			skipped++
@@ -140,17 +171,9 @@ func ProcessFiles(ctx context.Context, db *sql.DB, dir string, opts FindOptions)
 	log.Printf("Looking up host for hostname: %s", hostname)
 
 	// Find host in database by hostname (case-insensitive)
-	var hostName string
-	err = db.QueryRow(`
-		SELECT name
-		FROM hosts
-		WHERE LOWER(hostname) = LOWER($1)
-	`, hostname).Scan(&hostName)
+	hostName, err := LocalHostName(db, hostname, opts.Register)
 	if err != nil {
-		if err == sql.ErrNoRows {
-			return fmt.Errorf("no host found for hostname %s, please add it using 'dedupe manage add'", hostname)
-		}
-		return fmt.Errorf("error finding host: %v", err)
+		return err
 	}
 	log.Printf("Found host: %s", hostName)
 
@@ -254,6 +277,8 @@ func ProcessFiles(ctx context.Context, db *sql.DB, dir string, opts FindOptions)
 		hash     string
 		size     int64
 		modTime  time.Time
+		device   interface{} // nil without an inode
+		inode    interface{}
 		err      error
 		duration time.Duration
 	}, numWorkers*2)
@@ -274,6 +299,8 @@ func ProcessFiles(ctx context.Context, db *sql.DB, dir string, opts FindOptions)
 						hash     string
 						size     int64
 						modTime  time.Time
+						device   interface{}
+						inode    interface{}
 						err      error
 						duration time.Duration
 					}{path: path, err: err, duration: duration}
@@ -288,20 +315,29 @@ func ProcessFiles(ctx context.Context, db *sql.DB, dir string, opts FindOptions)
 						hash     string
 						size     int64
 						modTime  time.Time
+						device   interface{}
+						inode    interface{}
 						err      error
 						duration time.Duration
 					}{path: path, err: err, duration: duration}
 					continue
 				}
 
+				// Hard links are told apart by their (device, inode)
+				var device, inode interface{}
+				if dev, ino, ok := fileIdentity(info); ok {
+					device, inode = int64(dev), int64(ino)
+				}
 				resultChan <- struct {
 					path     string
 					hash     string
 					size     int64
 					modTime  time.Time
+					device   interface{}
+					inode    interface{}
 					err      error
 					duration time.Duration
-				}{path: path, hash: hash, size: info.Size(), modTime: info.ModTime(), err: nil, duration: duration}
+				}{path: path, hash: hash, size: info.Size(), modTime: info.ModTime(), device: device, inode: inode, err: nil, duration: duration}
 			}
 		}()
 	}
@@ -325,10 +361,11 @@ func ProcessFiles(ctx context.Context, db *sql.DB, dir string, opts FindOptions)
 
 		// Prepare statements
 		insertStmt, err := tx.Prepare(`
-			INSERT INTO files (hash, path, size, mod_time, hostname)
-			VALUES ($1, $2, $3, $4, $5)
+			INSERT INTO files (hash, path, size, mod_time, hostname, added_by, added_host_user, hash_duration_ms, device, inode)
+			VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)
 			ON CONFLICT (hash, path, hostname) DO UPDATE
-			SET size = $3, mod_time = $4
+			SET size = $3, mod_time = $4, hash_duration_ms = $8, device = $9, inode = $10,
+			` + preserveOrigin + `
 		`)
 		if err != nil {
 			log.Printf("Error preparing insert statement: %v", err)
@@ -340,7 +377,7 @@ func ProcessFiles(ctx context.Context, db *sql.DB, dir string, opts FindOptions)
 		checkStmt, err := tx.Prepare(`
 			SELECT hash, size, mod_time
 			FROM files
-			WHERE path = $1 AND LOWER(hostname) = LOWER($2)
+			WHERE path = $1 AND hostname = $2 AND ` + NotDeleted + `
 		`)
 		if err != nil {
 			log.Printf("Error preparing check statement: %v", err)
@@ -370,7 +407,7 @@ func ProcessFiles(ctx context.Context, db *sql.DB, dir string, opts FindOptions)
 			var dbHash string
 			var dbSize int64
 			var dbModTime time.Time
-			err = checkStmt.QueryRow(relPath, host.name).Scan(&dbHash, &dbSize, &dbModTime)
+			err = checkStmt.QueryRow(relPath, normalizeHostname(host.name)).Scan(&dbHash, &dbSize, &dbModTime)
 			if err == nil {
 				// File exists in database
 				if dbHash == result.hash && dbSize == result.size && dbModTime.Equal(result.modTime) {
@@ -393,7 +430,7 @@ func ProcessFiles(ctx context.Context, db *sql.DB, dir string, opts FindOptions)
 			}
 
 			// Insert or update file in database
-			_, err = insertStmt.Exec(result.hash, relPath, result.size, result.modTime, host.name)
+			_, err = insertStmt.Exec(result.hash, relPath, result.size, result.modTime, normalizeHostname(host.name), OriginFind, currentHostUser(), result.duration.Milliseconds(), result.device, result.inode)
 			if err != nil {
 				log.Printf("Error inserting file %s: %v", relPath, err)
 				errors++
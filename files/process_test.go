@@ -66,7 +66,7 @@ func TestProcessStdinWithMockDB(t *testing.T) {
 	// Set up expectations for the prepared statement
 	mock.ExpectPrepare("INSERT INTO files").
 		ExpectExec().
-		WithArgs(regularFile, "testhost", sqlmock.AnyArg()).
+		WithArgs(regularFile, "testhost", sqlmock.AnyArg(), OriginUpdate, sqlmock.AnyArg()).
 		WillReturnResult(sqlmock.NewResult(1, 1))
 
 	// Set up expectations for the transaction commit
@@ -94,7 +94,7 @@ func TestProcessStdinWithMockDB(t *testing.T) {
 	}()
 
 	// Call the function
-	err = ProcessStdin(context.Background(), db)
+	err = ProcessStdin(context.Background(), db, UpdateOptions{})
 	if err != nil {
 		t.Errorf("ProcessStdin returned error: %v", err)
 	}
@@ -145,7 +145,7 @@ func TestProcessStdinHostNotFound(t *testing.T) {
 	}()
 
 	// Call the function
-	err = ProcessStdin(context.Background(), db)
+	err = ProcessStdin(context.Background(), db, UpdateOptions{})
 
 	// Verify the error
 	if err == nil {
@@ -205,7 +205,7 @@ func TestProcessStdinEmptyInput(t *testing.T) {
 	}()
 
 	// Call the function
-	err = ProcessStdin(context.Background(), db)
+	err = ProcessStdin(context.Background(), db, UpdateOptions{})
 	if err != nil {
 		t.Errorf("ProcessStdin returned error for empty input: %v", err)
 	}
@@ -358,7 +358,7 @@ func TestProcessStdinWithMockDBNoHost(t *testing.T) {
 	}()
 
 	// Call the function
-	err = ProcessStdin(context.Background(), db)
+	err = ProcessStdin(context.Background(), db, UpdateOptions{})
 
 	// Verify the error
 	if err == nil {
@@ -412,7 +412,7 @@ func TestProcessStdinWithMockDBError(t *testing.T) {
 	}()
 
 	// Call the function
-	err = ProcessStdin(context.Background(), db)
+	err = ProcessStdin(context.Background(), db, UpdateOptions{})
 
 	// Verify the error
 	if err == nil {
@@ -12,27 +12,61 @@ import (
 	"deduplicator/db"
 	"deduplicator/logging"
 
+	"github.com/lib/pq"
 	"github.com/schollz/progressbar/v3"
 )
 
 // PruneOptions represents options for pruning files
 type PruneOptions struct {
-	BatchSize int // Number of deletions per transaction commit
+	BatchSize          int       // Number of deletions per transaction commit
+	KeepSymlinkTargets bool      // Keep entries for symlinks that resolve to regular files
+	Stats              *RunStats // Receives the final counters of the run (optional)
 }
 
-func pruneFullPath(dbPath string, rootFolder sql.NullString) (string, bool) {
+// pruneFullPath returns where a row's file lives. Rows without a root_folder
+// predate friendly paths: their path is absolute, or relative to the host's
+// deprecated root_path or to one of its configured paths, so each of those is
+// tried and the first that exists wins. legacy reports such a row; ok is
+// false when a relative legacy path resolves to nothing.
+func pruneFullPath(dbPath string, rootFolder sql.NullString, rootPath string, names *PathNames) (fullPath string, legacy, ok bool) {
 	root := ""
 	if rootFolder.Valid {
 		root = strings.TrimSpace(rootFolder.String)
 	}
 
 	if root != "" {
-		return filepath.Join(root, dbPath), true
+		return filepath.Join(root, dbPath), false, true
 	}
 	if filepath.IsAbs(dbPath) {
-		return dbPath, true
+		return dbPath, true, true
 	}
-	return "", false
+	for _, candidate := range legacyCandidates(dbPath, rootPath, names) {
+		if _, err := os.Lstat(candidate); err == nil {
+			return candidate, true, true
+		}
+	}
+	return "", true, false
+}
+
+// legacyCandidates lists the absolute paths a relative row without a
+// root_folder may stand for: joined to root_path, joined to each configured
+// path, and read as absolute when a configured path is a prefix of that.
+func legacyCandidates(dbPath, rootPath string, names *PathNames) []string {
+	var candidates []string
+	if rootPath = strings.TrimSpace(rootPath); rootPath != "" {
+		candidates = append(candidates, filepath.Join(rootPath, dbPath))
+	}
+	if names == nil {
+		return candidates
+	}
+	for _, r := range names.roots {
+		candidates = append(candidates, filepath.Join(r.root, dbPath))
+	}
+	absolute := filepath.Join(string(filepath.Separator), dbPath)
+	if _, _, ok := names.Resolve(filepath.Dir(absolute)); ok {
+		candidates = append(candidates, absolute)
+	}
+	return candidates
 }
 
 // PruneNonExistentFiles removes entries for files that no longer exist
@@ -61,11 +95,17 @@ func PruneNonExistentFiles(ctx context.Context, sqldb *sql.DB, opts PruneOptions
 	}
 
 	fmt.Printf("Checking files for host '%s'...\n", host.Name)
+	names, err := NewPathNames(host)
+	if err != nil {
+		return err
+	}
+
+	hostname = normalizeHostname(host.Hostname)
 
-	// First, count total files to check - use case-insensitive comparison
+	// First, count total files to check
 	var totalFiles int
-	countQuery := "SELECT COUNT(*) FROM files WHERE LOWER(hostname) = LOWER($1)" + getRowLimitClause()
-	err = sqldb.QueryRow(countQuery, host.Hostname).Scan(&totalFiles)
+	countQuery := "SELECT COUNT(*) FROM files WHERE hostname = $1 AND " + NotDeleted + getRowLimitClause()
+	err = sqldb.QueryRow(countQuery, hostname).Scan(&totalFiles)
 	if err != nil {
 		return fmt.Errorf("error counting files: %v", err)
 	}
@@ -76,32 +116,14 @@ func PruneNonExistentFiles(ctx context.Context, sqldb *sql.DB, opts PruneOptions
 		return nil
 	}
 
-	// Get files for this host - use case-insensitive comparison
-	query := "SELECT id, path, root_folder FROM files WHERE LOWER(hostname) = LOWER($1) ORDER BY LENGTH(COALESCE(root_folder, '')) DESC, id ASC" + getRowLimitClause()
-	rows, err := sqldb.Query(query, host.Hostname)
+	// Get files for this host
+	query := "SELECT id, path, root_folder FROM files WHERE hostname = $1 AND " + NotDeleted + " ORDER BY LENGTH(COALESCE(root_folder, '')) DESC, id ASC" + getRowLimitClause()
+	rows, err := sqldb.Query(query, hostname)
 	if err != nil {
 		return fmt.Errorf("error querying files: %v", err)
 	}
 	defer rows.Close()
 
-	// Begin transaction for batch deletes
-	tx, err := sqldb.Begin()
-	if err != nil {
-		return fmt.Errorf("error starting transaction: %v", err)
-	}
-	defer func() {
-		_ = tx.Rollback() // safe to call, will be ignored if already committed
-	}()
-
-	// Prepare delete statement
-	stmt, err := tx.Prepare(`DELETE FROM files WHERE id = $1`)
-	if err != nil {
-		return fmt.Errorf("error preparing statement: %v", err)
-	}
-	defer stmt.Close()
-
-	batchDeletes := 0
-
 	// Create progress bar
 	bar := progressbar.NewOptions64(int64(totalFiles), // This now matches the limited row count
 		progressbar.OptionEnableColorCodes(true),
@@ -116,9 +138,45 @@ func PruneNonExistentFiles(ctx context.Context, sqldb *sql.DB, opts PruneOptions
 			BarEnd:        "]",
 		}))
 
+	// Rows slated for deletion are queued and removed with one statement per
+	// batch; each remembers its category so the counters stay accurate.
+	var pending []pruneDeletion
+	removed := make(map[pruneCategory]int)
+	flush := func() error {
+		if len(pending) == 0 {
+			return nil
+		}
+		deleted, err := deletePruneBatch(sqldb, pending)
+		if err != nil {
+			return err
+		}
+		for _, d := range deleted {
+			removed[d.category]++
+			logging.InfoLogger.Printf("%s", d.message)
+		}
+		logging.InfoLogger.Printf("Committed batch of %d deletions", len(deleted))
+		pending = pending[:0]
+		return nil
+	}
+	queue := func(id int, category pruneCategory, message string) error {
+		pending = append(pending, pruneDeletion{id: id, category: category, message: message})
+		if len(pending) >= batchSize {
+			return flush()
+		}
+		return nil
+	}
+
 	// Check each file
-	var removedNonexistent, removedSymlinks, removedDevices, removedMissing, removedDuplicatePaths int
-	var checked int
+	var checked, legacyKept int
+	defer func() {
+		opts.Stats.Set("checked", int64(checked))
+		opts.Stats.Set("removed_nonexistent", int64(removed[pruneNonexistent]))
+		opts.Stats.Set("removed_symlink", int64(removed[pruneSymlink]))
+		opts.Stats.Set("removed_device", int64(removed[pruneDevice]))
+		opts.Stats.Set("removed_missing_root", int64(removed[pruneMissingRoot]))
+		opts.Stats.Set("removed_duplicate_path", int64(removed[pruneDuplicatePath]))
+		opts.Stats.Set("legacy_resolved", int64(legacyKept))
+	}()
 	seenFullPaths := make(map[string]int, totalFiles)
 	for rows.Next() {
 		select {
@@ -142,154 +200,14 @@ func PruneNonExistentFiles(ctx context.Context, sqldb *sql.DB, opts PruneOptions
 			logging.InfoLogger.Printf("Checked %d/%d files...", checked, totalFiles)
 		}
 
-		fullPath, validRoot := pruneFullPath(dbPath, rootFolder)
-		if !validRoot {
-			_, err = stmt.Exec(id)
-			if err != nil {
-				logging.ErrorLogger.Printf("Warning: Error deleting file with missing root_folder %s: %v", dbPath, err)
-				bar.Add(1)
-				continue
-			}
-			removedMissing++
-			batchDeletes++
-			logging.InfoLogger.Printf("Deleted entry for file missing root_folder: %s", dbPath)
-			if batchDeletes >= batchSize {
-				if err := tx.Commit(); err != nil {
-					return fmt.Errorf("error committing transaction: %v", err)
-				}
-				logging.InfoLogger.Printf("Committed batch of %d deletions", batchDeletes)
-				tx, err = sqldb.Begin()
-				if err != nil {
-					return fmt.Errorf("error starting new transaction: %v", err)
-				}
-				stmt, err = tx.Prepare(`DELETE FROM files WHERE id = $1`)
-				if err != nil {
-					return fmt.Errorf("error preparing statement: %v", err)
-				}
-				batchDeletes = 0
-			}
-			bar.Add(1)
-			continue
-		}
-
-		cleanFullPath := filepath.Clean(fullPath)
-		if firstID, seen := seenFullPaths[cleanFullPath]; seen {
-			_, err = stmt.Exec(id)
-			if err != nil {
-				logging.ErrorLogger.Printf("Warning: Error deleting duplicate path row %s: %v", dbPath, err)
-				bar.Add(1)
-				continue
-			}
-			removedDuplicatePaths++
-			batchDeletes++
-			logging.InfoLogger.Printf("Deleted duplicate DB row for %s; keeping row id %d", cleanFullPath, firstID)
-			if batchDeletes >= batchSize {
-				if err := tx.Commit(); err != nil {
-					return fmt.Errorf("error committing transaction: %v", err)
-				}
-				logging.InfoLogger.Printf("Committed batch of %d deletions", batchDeletes)
-				tx, err = sqldb.Begin()
-				if err != nil {
-					return fmt.Errorf("error starting new transaction: %v", err)
-				}
-				stmt, err = tx.Prepare(`DELETE FROM files WHERE id = $1`)
-				if err != nil {
-					return fmt.Errorf("error preparing statement: %v", err)
-				}
-				batchDeletes = 0
+		category, message, remove := pruneCheck(id, dbPath, rootFolder, seenFullPaths, opts, host.RootPath, names)
+		if remove {
+			if err := queue(id, category, message); err != nil {
+				return err
 			}
-			bar.Add(1)
-			continue
+		} else if category == pruneLegacyResolved {
+			legacyKept++
 		}
-		seenFullPaths[cleanFullPath] = id
-
-		fileInfo, err := os.Lstat(fullPath)
-		if err != nil {
-			// Could not stat the file for any reason – treat as non-existent
-			_, err = stmt.Exec(id)
-			if err != nil {
-				logging.ErrorLogger.Printf("Warning: Error deleting file %s: %v", dbPath, err)
-				bar.Add(1)
-				continue
-			}
-			removedNonexistent++
-			batchDeletes++
-			logging.InfoLogger.Printf("Deleted entry for non-existent or invalid file: %s", dbPath)
-			if batchDeletes >= batchSize {
-				if err := tx.Commit(); err != nil {
-					return fmt.Errorf("error committing transaction: %v", err)
-				}
-				logging.InfoLogger.Printf("Committed batch of %d deletions", batchDeletes)
-				tx, err = sqldb.Begin()
-				if err != nil {
-					return fmt.Errorf("error starting new transaction: %v", err)
-				}
-				stmt, err = tx.Prepare(`DELETE FROM files WHERE id = $1`)
-				if err != nil {
-					return fmt.Errorf("error preparing statement: %v", err)
-				}
-				batchDeletes = 0
-			}
-			bar.Add(1)
-			continue
-		}
-
-		// Check for symlinks
-		if fileInfo.Mode()&os.ModeSymlink != 0 {
-			// Delete symlinks from database
-			_, err = stmt.Exec(id)
-			if err != nil {
-				logging.ErrorLogger.Printf("Warning: Error deleting symlink %s: %v", dbPath, err)
-				continue
-			}
-			removedSymlinks++
-			batchDeletes++
-			logging.InfoLogger.Printf("Deleted entry for symlink: %s", fullPath)
-			if batchDeletes >= batchSize {
-				if err := tx.Commit(); err != nil {
-					return fmt.Errorf("error committing transaction: %v", err)
-				}
-				logging.InfoLogger.Printf("Committed batch of %d deletions", batchDeletes)
-				tx, err = sqldb.Begin()
-				if err != nil {
-					return fmt.Errorf("error starting new transaction: %v", err)
-				}
-				stmt, err = tx.Prepare(`DELETE FROM files WHERE id = $1`)
-				if err != nil {
-					return fmt.Errorf("error preparing statement: %v", err)
-				}
-				batchDeletes = 0
-			}
-		}
-
-		// Check for device files, pipes, sockets, etc.
-		if fileInfo.Mode()&(os.ModeDevice|os.ModeCharDevice|os.ModeNamedPipe|os.ModeSocket) != 0 {
-			// Delete device files from database
-			_, err = stmt.Exec(id)
-			if err != nil {
-				logging.ErrorLogger.Printf("Warning: Error deleting device file %s: %v", dbPath, err)
-				continue
-			}
-			removedDevices++
-			batchDeletes++
-			logging.InfoLogger.Printf("Deleted entry for device file: %s", fullPath)
-			if batchDeletes >= batchSize {
-				if err := tx.Commit(); err != nil {
-					return fmt.Errorf("error committing transaction: %v", err)
-				}
-				logging.InfoLogger.Printf("Committed batch of %d deletions", batchDeletes)
-				tx, err = sqldb.Begin()
-				if err != nil {
-					return fmt.Errorf("error starting new transaction: %v", err)
-				}
-				stmt, err = tx.Prepare(`DELETE FROM files WHERE id = $1`)
-				if err != nil {
-					return fmt.Errorf("error preparing statement: %v", err)
-				}
-				batchDeletes = 0
-			}
-		}
-
 		bar.Add(1)
 	}
 
@@ -297,21 +215,119 @@ func PruneNonExistentFiles(ctx context.Context, sqldb *sql.DB, opts PruneOptions
 		return fmt.Errorf("error iterating rows: %v", err)
 	}
 
-	// Commit any remaining deletions
-	if batchDeletes > 0 {
-		if err := tx.Commit(); err != nil {
-			return fmt.Errorf("error committing final transaction: %v", err)
-		}
-		logging.InfoLogger.Printf("Committed final batch of %d deletions", batchDeletes)
+	// Delete any remaining queued rows
+	if err := flush(); err != nil {
+		return err
 	}
 
 	elapsed := time.Since(startTime)
 	fmt.Printf("\nChecked %d files in total\n", checked)
-	fmt.Printf("Removed %d entries for non-existent files\n", removedNonexistent)
-	fmt.Printf("Removed %d entries for symlinks\n", removedSymlinks)
-	fmt.Printf("Removed %d entries for device files\n", removedDevices)
-	fmt.Printf("Removed %d entries for missing root_folder\n", removedMissing)
-	fmt.Printf("Removed %d duplicate rows for the same resolved path\n", removedDuplicatePaths)
+	fmt.Printf("Removed %d entries for non-existent files\n", removed[pruneNonexistent])
+	fmt.Printf("Removed %d entries for symlinks\n", removed[pruneSymlink])
+	fmt.Printf("Removed %d entries for device files\n", removed[pruneDevice])
+	fmt.Printf("Removed %d entries for missing root_folder\n", removed[pruneMissingRoot])
+	fmt.Printf("Removed %d duplicate rows for the same resolved path\n", removed[pruneDuplicatePath])
+	if legacyKept > 0 {
+		fmt.Printf("Kept %d legacy rows without root_folder that resolve to existing files\n", legacyKept)
+		fmt.Println("  Re-index those paths with 'deduplicator files find --path NAME' to store them under their friendly path;")
+		fmt.Println("  the next prune then removes the legacy rows as duplicates of the new ones.")
+	}
 	fmt.Printf("Wall time: %s\n", elapsed.Round(time.Millisecond))
 	return nil
 }
+
+// pruneCategory is the reason a files row is removed by prune.
+type pruneCategory int
+
+const (
+	pruneNonexistent pruneCategory = iota
+	pruneSymlink
+	pruneDevice
+	pruneMissingRoot
+	pruneDuplicatePath
+	// pruneLegacyResolved marks a kept row without root_folder that was found
+	// through root_path or a configured path; it is never removed.
+	pruneLegacyResolved
+)
+
+// pruneDeletion is a files row queued for deletion in the current batch.
+type pruneDeletion struct {
+	id       int
+	category pruneCategory
+	message  string
+}
+
+// pruneCheck decides whether a row should be removed, returning its category
+// and the message to log once it is deleted. Messages name the file by its
+// friendly path, followed by the absolute path. A kept legacy row is reported
+// as pruneLegacyResolved with remove false.
+func pruneCheck(id int, dbPath string, rootFolder sql.NullString, seenFullPaths map[string]int, opts PruneOptions, rootPath string, names *PathNames) (category pruneCategory, message string, remove bool) {
+	fullPath, legacy, ok := pruneFullPath(dbPath, rootFolder, rootPath, names)
+	if !ok {
+		return pruneMissingRoot, fmt.Sprintf("Deleted legacy entry missing root_folder that resolves to no existing file: %s", dbPath), true
+	}
+
+	cleanFullPath := filepath.Clean(fullPath)
+	label := names.Label(strings.TrimSpace(rootFolder.String), dbPath)
+	if firstID, seen := seenFullPaths[cleanFullPath]; seen {
+		return pruneDuplicatePath, fmt.Sprintf("Deleted duplicate DB row for %s (%s); keeping row id %d", label, cleanFullPath, firstID), true
+	}
+	seenFullPaths[cleanFullPath] = id
+
+	fileInfo, err := os.Lstat(fullPath)
+	if err != nil {
+		// Could not stat the file for any reason – treat as non-existent
+		return pruneNonexistent, fmt.Sprintf("Deleted entry for non-existent or invalid file: %s (%s)", label, fullPath), true
+	}
+
+	// Check for symlinks
+	if fileInfo.Mode()&os.ModeSymlink != 0 && !(opts.KeepSymlinkTargets && isSymlinkToRegularFile(fullPath)) {
+		return pruneSymlink, fmt.Sprintf("Deleted entry for symlink: %s (%s)", label, fullPath), true
+	}
+
+	// Check for device files, pipes, sockets, etc.
+	if fileInfo.Mode()&(os.ModeDevice|os.ModeCharDevice|os.ModeNamedPipe|os.ModeSocket) != 0 {
+		return pruneDevice, fmt.Sprintf("Deleted entry for device file: %s (%s)", label, fullPath), true
+	}
+
+	if legacy {
+		return pruneLegacyResolved, "", false
+	}
+	return 0, "", false
+}
+
+// deletePruneBatch soft-deletes the batch (sets deleted_at) with a single
+// statement in one transaction. If that fails it falls back to row by row
+// updates outside a transaction, so one bad id cannot block the rest of the
+// batch. It returns the rows that were actually deleted.
+func deletePruneBatch(sqldb *sql.DB, batch []pruneDeletion) ([]pruneDeletion, error) {
+	ids := make([]int64, len(batch))
+	for i, d := range batch {
+		ids[i] = int64(d.id)
+	}
+
+	tx, err := sqldb.Begin()
+	if err != nil {
+		return nil, fmt.Errorf("error starting transaction: %v", err)
+	}
+	_, err = tx.Exec(`UPDATE files SET deleted_at = NOW() WHERE id = ANY($1) AND deleted_at IS NULL`, pq.Array(ids))
+	if err == nil {
+		err = tx.Commit()
+		if err == nil {
+			return batch, nil
+		}
+	} else {
+		_ = tx.Rollback()
+	}
+	logging.ErrorLogger.Printf("Warning: Batch delete of %d rows failed, retrying one by one: %v", len(batch), err)
+
+	var deleted []pruneDeletion
+	for _, d := range batch {
+		if _, err := sqldb.Exec(`UPDATE files SET deleted_at = NOW() WHERE id = $1 AND deleted_at IS NULL`, d.id); err != nil {
+			logging.ErrorLogger.Printf("Warning: Error deleting row %d: %v", d.id, err)
+			continue
+		}
+		deleted = append(deleted, d)
+	}
+	return deleted, nil
+}
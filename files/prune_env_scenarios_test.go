@@ -3,6 +3,7 @@ package files
 import (
 	"context"
 	"database/sql"
+	"fmt"
 	"os"
 	"path/filepath"
 	"strconv"
@@ -43,11 +44,11 @@ func TestPruneRemovesMissingSymlinkAndDevicesInBatches(t *testing.T) {
 		WillReturnRows(sqlmock.NewRows([]string{"id", "name", "hostname", "ip", "root_path", "settings", "created_at"}).
 			AddRow(1, "HostA", lower, "", root, []byte(`{}`), time.Now()))
 
-	mock.ExpectQuery(`SELECT COUNT\(\*\) FROM files WHERE LOWER\(hostname\) = LOWER\(\$1\)`).
+	mock.ExpectQuery(`SELECT COUNT\(\*\) FROM files WHERE hostname = \$1`).
 		WithArgs(lower).
 		WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(3))
 
-	mock.ExpectQuery(`SELECT id, path, root_folder FROM files WHERE LOWER\(hostname\) = LOWER\(\$1\)`).
+	mock.ExpectQuery(`SELECT id, path, root_folder FROM files WHERE hostname = \$1`).
 		WithArgs(lower).
 		WillReturnRows(sqlmock.NewRows([]string{"id", "path", "root_folder"}).
 			AddRow(1, "missing.txt", sql.NullString{String: root, Valid: true}).
@@ -55,13 +56,10 @@ func TestPruneRemovesMissingSymlinkAndDevicesInBatches(t *testing.T) {
 			AddRow(3, "fifo", sql.NullString{String: root, Valid: true}))
 
 	mock.ExpectBegin()
-	prep := mock.ExpectPrepare(`DELETE FROM files`)
-	prep.ExpectExec().WithArgs(1).WillReturnResult(sqlmock.NewResult(0, 1))
-	prep.ExpectExec().WithArgs(2).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(`UPDATE files SET deleted_at = NOW\(\) WHERE id = ANY\(\$1\)`).WithArgs("{1,2}").WillReturnResult(sqlmock.NewResult(0, 2))
 	mock.ExpectCommit()
 	mock.ExpectBegin()
-	prep2 := mock.ExpectPrepare(`DELETE FROM files`)
-	prep2.ExpectExec().WithArgs(3).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(`UPDATE files SET deleted_at = NOW\(\) WHERE id = ANY\(\$1\)`).WithArgs("{3}").WillReturnResult(sqlmock.NewResult(0, 1))
 	mock.ExpectCommit()
 
 	if err := PruneNonExistentFiles(context.Background(), db, PruneOptions{BatchSize: 2}); err != nil {
@@ -73,6 +71,105 @@ func TestPruneRemovesMissingSymlinkAndDevicesInBatches(t *testing.T) {
 	}
 }
 
+func TestPruneKeepsSymlinkTargetsWhenRequested(t *testing.T) {
+	db, mock, err := sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherRegexp))
+	if err != nil {
+		t.Fatalf("sqlmock: %v", err)
+	}
+	defer db.Close()
+
+	root := t.TempDir()
+	symlinkTarget := filepath.Join(root, "target.txt")
+	if err := os.WriteFile(symlinkTarget, []byte("x"), 0644); err != nil {
+		t.Fatalf("write target: %v", err)
+	}
+	if err := os.Symlink(symlinkTarget, filepath.Join(root, "link.txt")); err != nil {
+		t.Fatalf("symlink: %v", err)
+	}
+	if err := os.Symlink(filepath.Join(root, "gone.txt"), filepath.Join(root, "dangling.txt")); err != nil {
+		t.Fatalf("symlink: %v", err)
+	}
+
+	hostname, _ := os.Hostname()
+	lower := strings.ToLower(hostname)
+
+	mock.ExpectQuery(`SELECT id, name, hostname, ip, root_path, settings, created_at FROM hosts WHERE LOWER\(hostname\) = LOWER\(\$1\)`).
+		WithArgs(lower).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "name", "hostname", "ip", "root_path", "settings", "created_at"}).
+			AddRow(1, "HostA", lower, "", root, []byte(`{}`), time.Now()))
+	mock.ExpectQuery(`SELECT COUNT\(\*\) FROM files WHERE hostname = \$1`).
+		WithArgs(lower).
+		WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(3))
+	mock.ExpectQuery(`SELECT id, path, root_folder FROM files WHERE hostname = \$1`).
+		WithArgs(lower).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "path", "root_folder"}).
+			AddRow(1, "missing.txt", sql.NullString{String: root, Valid: true}).
+			AddRow(2, "link.txt", sql.NullString{String: root, Valid: true}).
+			AddRow(3, "dangling.txt", sql.NullString{String: root, Valid: true}))
+
+	// link.txt resolves to a regular file and is kept; the dangling link is
+	// still removed.
+	mock.ExpectBegin()
+	mock.ExpectExec(`UPDATE files SET deleted_at = NOW\(\) WHERE id = ANY\(\$1\)`).WithArgs("{1,3}").WillReturnResult(sqlmock.NewResult(0, 2))
+	mock.ExpectCommit()
+
+	if err := PruneNonExistentFiles(context.Background(), db, PruneOptions{KeepSymlinkTargets: true}); err != nil {
+		t.Fatalf("PruneNonExistentFiles error: %v", err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatalf("unmet expectations: %v", err)
+	}
+}
+
+func TestPruneFallsBackToPerRowDeletesWhenBatchFails(t *testing.T) {
+	db, mock, err := sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherRegexp))
+	if err != nil {
+		t.Fatalf("sqlmock: %v", err)
+	}
+	defer db.Close()
+
+	root := t.TempDir()
+	hostname, _ := os.Hostname()
+	lower := strings.ToLower(hostname)
+
+	mock.ExpectQuery(`SELECT id, name, hostname, ip, root_path, settings, created_at FROM hosts WHERE LOWER\(hostname\) = LOWER\(\$1\)`).
+		WithArgs(lower).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "name", "hostname", "ip", "root_path", "settings", "created_at"}).
+			AddRow(1, "HostA", lower, "", root, []byte(`{}`), time.Now()))
+	mock.ExpectQuery(`SELECT COUNT\(\*\) FROM files WHERE hostname = \$1`).
+		WithArgs(lower).
+		WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(3))
+	mock.ExpectQuery(`SELECT id, path, root_folder FROM files WHERE hostname = \$1`).
+		WithArgs(lower).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "path", "root_folder"}).
+			AddRow(1, "gone1", sql.NullString{String: root, Valid: true}).
+			AddRow(2, "gone2", sql.NullString{String: root, Valid: true}).
+			AddRow(3, "gone3", sql.NullString{String: root, Valid: true}))
+
+	// The batched delete fails, so each row is retried on its own; row 2
+	// still fails but rows 1 and 3 are removed.
+	mock.ExpectBegin()
+	mock.ExpectExec(`UPDATE files SET deleted_at = NOW\(\) WHERE id = ANY\(\$1\)`).WithArgs("{1,2,3}").WillReturnError(fmt.Errorf("foreign key violation"))
+	mock.ExpectRollback()
+	mock.ExpectExec(`UPDATE files SET deleted_at = NOW\(\) WHERE id = \$1`).WithArgs(1).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(`UPDATE files SET deleted_at = NOW\(\) WHERE id = \$1`).WithArgs(2).WillReturnError(fmt.Errorf("foreign key violation"))
+	mock.ExpectExec(`UPDATE files SET deleted_at = NOW\(\) WHERE id = \$1`).WithArgs(3).WillReturnResult(sqlmock.NewResult(0, 1))
+
+	var runErr error
+	out := captureStdout(t, func() {
+		runErr = PruneNonExistentFiles(context.Background(), db, PruneOptions{})
+	})
+	if runErr != nil {
+		t.Fatalf("PruneNonExistentFiles error: %v", runErr)
+	}
+	if !strings.Contains(out, "Removed 2 entries for non-existent files") {
+		t.Fatalf("expected only the deleted rows to be counted, got:\n%s", out)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatalf("unmet expectations: %v", err)
+	}
+}
+
 func TestPruneHonorsEnvironmentLocalLimit(t *testing.T) {
 	db, mock, err := sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherRegexp))
 	if err != nil {
@@ -90,7 +187,7 @@ func TestPruneHonorsEnvironmentLocalLimit(t *testing.T) {
 		WillReturnRows(sqlmock.NewRows([]string{"id", "name", "hostname", "ip", "root_path", "settings", "created_at"}).
 			AddRow(1, "HostA", lower, "", "/", []byte(`{}`), time.Now()))
 
-	mock.ExpectQuery(`(?s)SELECT COUNT\(\*\) FROM files WHERE LOWER\(hostname\) = LOWER\(\$1\) LIMIT \d+`).
+	mock.ExpectQuery(`(?s)SELECT COUNT\(\*\) FROM files WHERE hostname = \$1 AND deleted_at IS NULL LIMIT \d+`).
 		WithArgs(lower).
 		WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(0))
 
@@ -128,11 +225,11 @@ func TestPruneTrustsRootFolderAndRemovesDuplicateResolvedPaths(t *testing.T) {
 		WillReturnRows(sqlmock.NewRows([]string{"id", "name", "hostname", "ip", "root_path", "settings", "created_at"}).
 			AddRow(1, "HostA", lower, "", "/", settings, time.Now()))
 
-	mock.ExpectQuery(`SELECT COUNT\(\*\) FROM files WHERE LOWER\(hostname\) = LOWER\(\$1\)`).
+	mock.ExpectQuery(`SELECT COUNT\(\*\) FROM files WHERE hostname = \$1`).
 		WithArgs(lower).
 		WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(3))
 
-	mock.ExpectQuery(`SELECT id, path, root_folder FROM files WHERE LOWER\(hostname\) = LOWER\(\$1\)`).
+	mock.ExpectQuery(`SELECT id, path, root_folder FROM files WHERE hostname = \$1`).
 		WithArgs(lower).
 		WillReturnRows(sqlmock.NewRows([]string{"id", "path", "root_folder"}).
 			AddRow(1, "movies/movie.mkv", sql.NullString{String: root, Valid: true}).
@@ -140,9 +237,7 @@ func TestPruneTrustsRootFolderAndRemovesDuplicateResolvedPaths(t *testing.T) {
 			AddRow(3, "movies/movie.mkv", sql.NullString{}))
 
 	mock.ExpectBegin()
-	prep := mock.ExpectPrepare(`DELETE FROM files`)
-	prep.ExpectExec().WithArgs(2).WillReturnResult(sqlmock.NewResult(0, 1))
-	prep.ExpectExec().WithArgs(3).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(`UPDATE files SET deleted_at = NOW\(\) WHERE id = ANY\(\$1\)`).WithArgs("{2,3}").WillReturnResult(sqlmock.NewResult(0, 2))
 	mock.ExpectCommit()
 
 	if err := PruneNonExistentFiles(context.Background(), db, PruneOptions{}); err != nil {
@@ -154,6 +249,82 @@ func TestPruneTrustsRootFolderAndRemovesDuplicateResolvedPaths(t *testing.T) {
 	}
 }
 
+func TestPruneKeepsLegacyRowsThatResolveToExistingFiles(t *testing.T) {
+	db, mock, err := sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherRegexp))
+	if err != nil {
+		t.Fatalf("sqlmock: %v", err)
+	}
+	defer db.Close()
+
+	// rootPath is the deprecated hosts.root_path; media is a configured path.
+	rootPath := t.TempDir()
+	media := t.TempDir()
+	for _, p := range []string{
+		filepath.Join(rootPath, "old", "present.txt"),
+		filepath.Join(media, "albums", "present.flac"),
+		filepath.Join(media, "absolute.txt"),
+	} {
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			t.Fatalf("mkdir: %v", err)
+		}
+		if err := os.WriteFile(p, []byte("x"), 0644); err != nil {
+			t.Fatalf("write %s: %v", p, err)
+		}
+	}
+	// Legacy rows relative to "/" read as absolute under a configured path.
+	fromSlash := strings.TrimPrefix(filepath.Join(media, "absolute.txt"), string(os.PathSeparator))
+
+	hostname, _ := os.Hostname()
+	lower := strings.ToLower(hostname)
+	settings := []byte(`{"paths":{"Media":` + strconv.Quote(media) + `}}`)
+
+	mock.ExpectQuery(`SELECT id, name, hostname, ip, root_path, settings, created_at FROM hosts WHERE LOWER\(hostname\) = LOWER\(\$1\)`).
+		WithArgs(lower).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "name", "hostname", "ip", "root_path", "settings", "created_at"}).
+			AddRow(1, "HostA", lower, "", rootPath, settings, time.Now()))
+
+	mock.ExpectQuery(`SELECT COUNT\(\*\) FROM files WHERE hostname = \$1`).
+		WithArgs(lower).
+		WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(7))
+
+	mock.ExpectQuery(`SELECT id, path, root_folder FROM files WHERE hostname = \$1`).
+		WithArgs(lower).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "path", "root_folder"}).
+			AddRow(1, filepath.Join(media, "absolute.txt"), sql.NullString{}).
+			AddRow(2, filepath.Join(media, "gone.txt"), sql.NullString{}).
+			AddRow(3, "old/present.txt", sql.NullString{}).
+			AddRow(4, "albums/present.flac", sql.NullString{String: "", Valid: true}).
+			AddRow(5, "old/gone.txt", sql.NullString{}).
+			AddRow(6, fromSlash, sql.NullString{}).
+			AddRow(7, "albums/present.flac", sql.NullString{}))
+
+	// Only the legacy rows whose files are gone are removed, plus the second
+	// row resolving to albums/present.flac.
+	mock.ExpectBegin()
+	mock.ExpectExec(`UPDATE files SET deleted_at = NOW\(\) WHERE id = ANY\(\$1\)`).WithArgs("{2,5,6,7}").WillReturnResult(sqlmock.NewResult(0, 4))
+	mock.ExpectCommit()
+
+	stats := &RunStats{}
+	var pruneErr error
+	out := captureStdout(t, func() {
+		pruneErr = PruneNonExistentFiles(context.Background(), db, PruneOptions{Stats: stats})
+	})
+	if pruneErr != nil {
+		t.Fatalf("PruneNonExistentFiles error: %v", pruneErr)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatalf("unmet expectations: %v", err)
+	}
+
+	counters := stats.Counters()
+	if counters["legacy_resolved"] != 3 || counters["removed_nonexistent"] != 1 || counters["removed_missing_root"] != 1 || counters["removed_duplicate_path"] != 2 {
+		t.Fatalf("counters = %v", counters)
+	}
+	if !strings.Contains(out, "Kept 3 legacy rows without root_folder") || !strings.Contains(out, "files find --path NAME") {
+		t.Fatalf("output does not report the kept legacy rows:\n%s", out)
+	}
+}
+
 func TestPruneCancellationStopsMidRun(t *testing.T) {
 	db, mock, err := sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherRegexp))
 	if err != nil {
@@ -171,23 +342,19 @@ func TestPruneCancellationStopsMidRun(t *testing.T) {
 		WillReturnRows(sqlmock.NewRows([]string{"id", "name", "hostname", "ip", "root_path", "settings", "created_at"}).
 			AddRow(1, "HostA", lower, "", root, []byte(`{}`), time.Now()))
 
-	mock.ExpectQuery(`SELECT COUNT\(\*\) FROM files WHERE LOWER\(hostname\) = LOWER\(\$1\)`).
+	mock.ExpectQuery(`SELECT COUNT\(\*\) FROM files WHERE hostname = \$1`).
 		WithArgs(lower).
 		WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(2))
 
-	mock.ExpectQuery(`SELECT id, path, root_folder FROM files WHERE LOWER\(hostname\) = LOWER\(\$1\)`).
+	mock.ExpectQuery(`SELECT id, path, root_folder FROM files WHERE hostname = \$1`).
 		WithArgs(lower).
 		WillReturnRows(sqlmock.NewRows([]string{"id", "path", "root_folder"}).
 			AddRow(1, "gone1", sql.NullString{String: root, Valid: true}).
 			AddRow(2, "gone2", sql.NullString{String: root, Valid: true}))
 
 	mock.ExpectBegin()
-	prep := mock.ExpectPrepare(`DELETE FROM files`)
-	prep.ExpectExec().WithArgs(1).WillDelayFor(10 * time.Millisecond).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(`UPDATE files SET deleted_at = NOW\(\) WHERE id = ANY\(\$1\)`).WithArgs("{1}").WillDelayFor(10 * time.Millisecond).WillReturnResult(sqlmock.NewResult(0, 1))
 	mock.ExpectCommit()
-	mock.ExpectBegin()
-	mock.ExpectPrepare(`DELETE FROM files`)
-	mock.ExpectRollback()
 
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Millisecond)
 	defer cancel()
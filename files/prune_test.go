@@ -50,7 +50,7 @@ func TestPruneNonExistentFiles(t *testing.T) {
 
 	// Set up expectations for the count query
 	countRows := sqlmock.NewRows([]string{"count"}).AddRow(3)
-	mock.ExpectQuery(`SELECT COUNT\(\*\) FROM files WHERE LOWER\(hostname\) = LOWER\(\$1\)`).
+	mock.ExpectQuery(`SELECT COUNT\(\*\) FROM files WHERE hostname = \$1`).
 		WithArgs(hostname).
 		WillReturnRows(countRows)
 
@@ -59,23 +59,17 @@ func TestPruneNonExistentFiles(t *testing.T) {
 		AddRow(1, "existing.txt", sql.NullString{String: tempDir, Valid: true}).
 		AddRow(2, "nonexistent.txt", sql.NullString{String: tempDir, Valid: true}).
 		AddRow(3, "symlink.txt", sql.NullString{String: tempDir, Valid: true})
-	mock.ExpectQuery(`SELECT id, path, root_folder FROM files WHERE LOWER\(hostname\) = LOWER\(\$1\)`).
+	mock.ExpectQuery(`SELECT id, path, root_folder FROM files WHERE hostname = \$1`).
 		WithArgs(hostname).
 		WillReturnRows(fileRows)
 
 	// Set up expectations for transaction
 	mock.ExpectBegin()
 
-	// Set up expectations for the delete statement
-	mock.ExpectPrepare("DELETE FROM files WHERE id = \\$1").
-		ExpectExec().
-		WithArgs(2).
-		WillReturnResult(sqlmock.NewResult(0, 1))
-
-	// Set up expectations for the delete statement for symlinks
-	mock.ExpectExec("DELETE FROM files").
-		WithArgs(3).
-		WillReturnResult(sqlmock.NewResult(0, 1))
+	// Both stale rows are removed with a single batched delete
+	mock.ExpectExec("UPDATE files SET deleted_at = NOW\\(\\) WHERE id = ANY\\(\\$1\\)").
+		WithArgs("{2,3}").
+		WillReturnResult(sqlmock.NewResult(0, 2))
 
 	// Set up expectations for transaction commit
 	mock.ExpectCommit()
@@ -164,7 +158,7 @@ func TestPruneNonExistentFilesDeviceFiles(t *testing.T) {
 
 	// Set up expectations for the count query
 	countRows := sqlmock.NewRows([]string{"count"}).AddRow(2)
-	mock.ExpectQuery(`SELECT COUNT\(\*\) FROM files WHERE LOWER\(hostname\) = LOWER\(\$1\)`).
+	mock.ExpectQuery(`SELECT COUNT\(\*\) FROM files WHERE hostname = \$1`).
 		WithArgs(hostname).
 		WillReturnRows(countRows)
 
@@ -172,17 +166,16 @@ func TestPruneNonExistentFilesDeviceFiles(t *testing.T) {
 	fileRows := sqlmock.NewRows([]string{"id", "path", "root_folder"}).
 		AddRow(1, "regular.txt", sql.NullString{String: tempDir, Valid: true}).
 		AddRow(2, "device.pipe", sql.NullString{String: tempDir, Valid: true})
-	mock.ExpectQuery(`SELECT id, path, root_folder FROM files WHERE LOWER\(hostname\) = LOWER\(\$1\)`).
+	mock.ExpectQuery(`SELECT id, path, root_folder FROM files WHERE hostname = \$1`).
 		WithArgs(hostname).
 		WillReturnRows(fileRows)
 
 	// Set up expectations for transaction
 	mock.ExpectBegin()
 
-	// Set up expectations for the prepared statement
-	mock.ExpectPrepare("DELETE FROM files WHERE id = \\$1").
-		ExpectExec().
-		WithArgs(2).
+	// Set up expectations for the batched delete
+	mock.ExpectExec("UPDATE files SET deleted_at = NOW\\(\\) WHERE id = ANY\\(\\$1\\)").
+		WithArgs("{2}").
 		WillReturnResult(sqlmock.NewResult(0, 1))
 
 	// Set up expectations for transaction commit
@@ -0,0 +1,145 @@
+package files
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"deduplicator/logging"
+)
+
+const (
+	// quickHashSpan is how much of each end of a file a quick hash reads.
+	quickHashSpan = 64 * 1024
+
+	quickHashBatchSize = 100
+)
+
+// quickHashCollisionPredicate keeps the files whose size and quick hash
+// match another live row of the host. A row without a quick hash, such as
+// one hashed before --prescreen was used, might match, so it counts as a
+// collision too.
+const quickHashCollisionPredicate = `quick_hash IS NOT NULL AND EXISTS (
+			SELECT 1 FROM files o
+			WHERE o.hostname = files.hostname
+			AND o.size = files.size
+			AND o.id <> files.id
+			AND o.deleted_at IS NULL
+			AND (o.quick_hash IS NULL OR o.quick_hash = files.quick_hash)
+		)`
+
+// calculateQuickHash returns the SHA-256 of a file's size followed by its
+// first and last 64KB. Files of up to 128KB are read whole. Two files with
+// different quick hashes cannot be identical.
+func calculateQuickHash(filePath string) (string, error) {
+	info, err := os.Lstat(filePath)
+	if err != nil {
+		return "", fmt.Errorf("error accessing file: %v", err)
+	}
+	if !info.Mode().IsRegular() {
+		return "", fmt.Errorf("path is not a regular file")
+	}
+
+	file, err := os.Open(filePath)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	hash := sha256.New()
+	size := info.Size()
+	binary.Write(hash, binary.BigEndian, size)
+	if size <= 2*quickHashSpan {
+		if _, err := io.Copy(hash, file); err != nil {
+			return "", err
+		}
+		return hex.EncodeToString(hash.Sum(nil)), nil
+	}
+	if _, err := io.CopyN(hash, file, quickHashSpan); err != nil {
+		return "", err
+	}
+	if _, err := file.Seek(size-quickHashSpan, io.SeekStart); err != nil {
+		return "", err
+	}
+	if _, err := io.CopyN(hash, file, quickHashSpan); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// quickHashCandidates stores a quick hash for every row matching
+// whereClause (with the hostname as $1) that has none yet, or for every
+// matching row when refresh is set. Files that cannot be read are recorded
+// in file_errors like failed full hashes. It returns how many quick hashes
+// were stored.
+func quickHashCandidates(ctx context.Context, sqldb *sql.DB, hostname, whereClause string, refresh bool) (int64, error) {
+	if !refresh {
+		whereClause += `
+		AND quick_hash IS NULL`
+	}
+	query := fmt.Sprintf(`
+		SELECT id, path, COALESCE(root_folder, '')
+		FROM files %s
+		AND id > $2
+		ORDER BY id ASC
+		LIMIT %d
+	`, whereClause, quickHashBatchSize)
+
+	type candidate struct {
+		id         int
+		path, root string
+	}
+	var stored int64
+	lastID := 0
+	for {
+		select {
+		case <-ctx.Done():
+			return stored, fmt.Errorf("operation cancelled after quick-hashing %d files", stored)
+		default:
+		}
+
+		rows, err := sqldb.QueryContext(ctx, query, hostname, lastID)
+		if err != nil {
+			return stored, fmt.Errorf("error querying files to quick-hash: %v", err)
+		}
+		var batch []candidate
+		for rows.Next() {
+			var c candidate
+			if err := rows.Scan(&c.id, &c.path, &c.root); err != nil {
+				rows.Close()
+				return stored, fmt.Errorf("error scanning file row: %v", err)
+			}
+			batch = append(batch, c)
+		}
+		err = rows.Err()
+		rows.Close()
+		if err != nil {
+			return stored, fmt.Errorf("error reading files to quick-hash: %v", err)
+		}
+		if len(batch) == 0 {
+			return stored, nil
+		}
+
+		for _, c := range batch {
+			lastID = c.id
+			quick, err := calculateQuickHash(hashTargetPath(filepath.Join(c.root, c.path)))
+			if err != nil {
+				logging.InfoLogger.Printf("Warning: Error quick-hashing file %s: %v", c.path, err)
+				if _, dbErr := sqldb.ExecContext(ctx, recordFileErrorSQL, c.id, classifyHashError(err), err.Error()); dbErr != nil {
+					logging.InfoLogger.Printf("Warning: Error recording hash failure: %v", dbErr)
+				}
+				continue
+			}
+			if _, err := sqldb.ExecContext(ctx, `UPDATE files SET quick_hash = $1 WHERE id = $2`, quick, c.id); err != nil {
+				return stored, fmt.Errorf("error storing quick hash of %s: %v", c.path, err)
+			}
+			stored++
+		}
+	}
+}
@@ -0,0 +1,109 @@
+package files
+
+import (
+	"context"
+	"io"
+	"log"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"deduplicator/logging"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+func TestCalculateQuickHashReadsOnlyBothEnds(t *testing.T) {
+	dir := t.TempDir()
+	head := strings.Repeat("h", quickHashSpan)
+	tail := strings.Repeat("t", quickHashSpan)
+	writeFiles(t, dir, head+strings.Repeat("a", 1000)+tail, "a.bin")
+	writeFiles(t, dir, head+strings.Repeat("b", 1000)+tail, "b.bin")
+	writeFiles(t, dir, head+strings.Repeat("a", 1000)+tail[1:]+"x", "c.bin")
+	writeFiles(t, dir, head+strings.Repeat("a", 999)+tail, "shorter.bin")
+
+	quick := func(name string) string {
+		hash, err := calculateQuickHash(filepath.Join(dir, name))
+		if err != nil {
+			t.Fatalf("quick hash %s: %v", name, err)
+		}
+		return hash
+	}
+	if quick("a.bin") != quick("b.bin") {
+		t.Fatal("files differing only in the middle should share a quick hash")
+	}
+	if quick("a.bin") == quick("c.bin") {
+		t.Fatal("files with different tails should not share a quick hash")
+	}
+	if quick("a.bin") == quick("shorter.bin") {
+		t.Fatal("files of different sizes should not share a quick hash")
+	}
+
+	if _, err := calculateQuickHash(dir); err == nil {
+		t.Fatal("expected a directory to be rejected")
+	}
+}
+
+func TestHashFilesPrescreenFullyHashesOnlyCollisions(t *testing.T) {
+	logging.InfoLogger = log.New(io.Discard, "", 0)
+	logging.ErrorLogger = log.New(io.Discard, "", 0)
+
+	db, mock, err := sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherRegexp))
+	if err != nil {
+		t.Fatalf("Failed to create mock database: %v", err)
+	}
+	defer db.Close()
+
+	root := t.TempDir()
+	writeFiles(t, root, "same bytes", "one.bin", "two.bin")
+	writeFiles(t, root, "other byte", "three.bin")
+	sameQuick, err := calculateQuickHash(filepath.Join(root, "one.bin"))
+	if err != nil {
+		t.Fatalf("quick hash: %v", err)
+	}
+	otherQuick, err := calculateQuickHash(filepath.Join(root, "three.bin"))
+	if err != nil {
+		t.Fatalf("quick hash: %v", err)
+	}
+
+	mock.ExpectQuery(`(?s)SELECT id, path, COALESCE\(root_folder, ''\)\s+FROM files.*AND quick_hash IS NULL\s+AND id > \$2`).
+		WithArgs("backup1.local", 0).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "path", "root_folder"}).
+			AddRow(1, "one.bin", root).
+			AddRow(2, "two.bin", root).
+			AddRow(3, "three.bin", root))
+	for id, quick := range []string{sameQuick, sameQuick, otherQuick} {
+		mock.ExpectExec(`UPDATE files SET quick_hash = \$1 WHERE id = \$2`).
+			WithArgs(quick, id+1).
+			WillReturnResult(sqlmock.NewResult(0, 1))
+	}
+	mock.ExpectQuery(`(?s)SELECT id, path, COALESCE\(root_folder, ''\)\s+FROM files.*AND id > \$2`).
+		WithArgs("backup1.local", 3).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "path", "root_folder"}))
+
+	// The full-hash stage only counts files whose quick hash collides.
+	mock.ExpectQuery(`(?s)SELECT COUNT\(\*\) FROM files.*AND quick_hash IS NOT NULL AND EXISTS \(.*o.quick_hash IS NULL OR o.quick_hash = files.quick_hash`).
+		WithArgs("backup1.local").
+		WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(0))
+
+	stats := &RunStats{}
+	out := captureStdout(t, func() {
+		err = HashFiles(context.Background(), db, HashOptions{
+			Host:      backup1Host(root, `{}`),
+			Prescreen: true,
+			Stats:     stats,
+		})
+	})
+	if err != nil {
+		t.Fatalf("HashFiles: %v", err)
+	}
+	if !strings.Contains(out, "Quick-hashed 3 files") {
+		t.Fatalf("expected the quick-hash count:\n%s", out)
+	}
+	if got := stats.Counters()["quick_hashed"]; got != 3 {
+		t.Fatalf("expected quick_hashed 3 in the run stats, got %d", got)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatalf("unmet expectations: %v", err)
+	}
+}
@@ -0,0 +1,409 @@
+package files
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"deduplicator/db"
+	"deduplicator/logging"
+)
+
+const rehashBatchSize = 100
+
+// clock is the time source of the rehash scheduler; tests swap in a fake.
+type clock interface {
+	Now() time.Time
+	// Sleep waits for d, returning early with ctx's error if it is cancelled.
+	Sleep(ctx context.Context, d time.Duration) error
+}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time { return time.Now() }
+
+func (realClock) Sleep(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+// ParseRate parses a files-per-time rate such as "200/s", "600/m" or
+// "5000/h" into files per second. A bare number is per second; 0 means
+// unlimited.
+func ParseRate(value string) (float64, error) {
+	value = strings.TrimSpace(value)
+	count, unit, hasUnit := strings.Cut(value, "/")
+	per := time.Second
+	if hasUnit {
+		switch strings.TrimSpace(unit) {
+		case "s":
+		case "m":
+			per = time.Minute
+		case "h":
+			per = time.Hour
+		default:
+			return 0, fmt.Errorf("invalid rate %q: unit must be s, m or h", value)
+		}
+	}
+	n, err := strconv.ParseFloat(strings.TrimSpace(count), 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid rate %q: use N/s, N/m or N/h", value)
+	}
+	return n / per.Seconds(), nil
+}
+
+// rateLimiter spaces out operations to at most perSecond per second. It does
+// not bank unused time, so a pause never turns into a burst.
+type rateLimiter struct {
+	clock    clock
+	interval time.Duration
+	next     time.Time
+}
+
+func newRateLimiter(c clock, perSecond float64) *rateLimiter {
+	if perSecond <= 0 {
+		return nil
+	}
+	return &rateLimiter{clock: c, interval: time.Duration(float64(time.Second) / perSecond)}
+}
+
+// Wait blocks until the next operation may start. A nil limiter never waits.
+func (l *rateLimiter) Wait(ctx context.Context) error {
+	if l == nil {
+		return nil
+	}
+	now := l.clock.Now()
+	if l.next.Before(now) {
+		l.next = now
+	}
+	wait := l.next.Sub(now)
+	l.next = l.next.Add(l.interval)
+	if wait <= 0 {
+		return nil
+	}
+	return l.clock.Sleep(ctx, wait)
+}
+
+// dailyWindow is a time-of-day range, as offsets from local midnight. A
+// window whose end is before its start runs past midnight.
+type dailyWindow struct {
+	start, end time.Duration
+}
+
+// parseDailyWindow parses "HH:MM-HH:MM", such as "01:00-06:00" or
+// "22:00-04:00". An empty value means no window.
+func parseDailyWindow(value string) (*dailyWindow, error) {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return nil, nil
+	}
+	from, to, ok := strings.Cut(value, "-")
+	if !ok {
+		return nil, fmt.Errorf("invalid daily window %q: use HH:MM-HH:MM", value)
+	}
+	start, err := parseTimeOfDay(from)
+	if err != nil {
+		return nil, fmt.Errorf("invalid daily window %q: %v", value, err)
+	}
+	end, err := parseTimeOfDay(to)
+	if err != nil {
+		return nil, fmt.Errorf("invalid daily window %q: %v", value, err)
+	}
+	if start == end {
+		return nil, fmt.Errorf("invalid daily window %q: start and end are the same", value)
+	}
+	return &dailyWindow{start: start, end: end}, nil
+}
+
+func parseTimeOfDay(value string) (time.Duration, error) {
+	t, err := time.Parse("15:04", strings.TrimSpace(value))
+	if err != nil {
+		return 0, fmt.Errorf("%q is not a HH:MM time", value)
+	}
+	return time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute, nil
+}
+
+// untilOpen returns how long after now the window next opens, or 0 when now
+// is inside it. A nil window is always open.
+func (w *dailyWindow) untilOpen(now time.Time) time.Duration {
+	if w == nil {
+		return 0
+	}
+	midnight := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, now.Location())
+	offset := now.Sub(midnight)
+	if w.start < w.end {
+		if offset >= w.start && offset < w.end {
+			return 0
+		}
+		if offset < w.start {
+			return w.start - offset
+		}
+		return 24*time.Hour - offset + w.start
+	}
+	if offset >= w.start || offset < w.end {
+		return 0
+	}
+	return w.start - offset
+}
+
+// rehashScheduler decides when the next file may be rehashed: only inside
+// the daily window, and no faster than the rate limit.
+type rehashScheduler struct {
+	clock   clock
+	window  *dailyWindow
+	limiter *rateLimiter
+}
+
+// wait blocks until the next file may be rehashed, sleeping through the
+// hours outside the window.
+func (s *rehashScheduler) wait(ctx context.Context) error {
+	if d := s.window.untilOpen(s.clock.Now()); d > 0 {
+		resumeAt := s.clock.Now().Add(d)
+		fmt.Printf("Outside the daily window; sleeping until %s\n", resumeAt.Format("2006-01-02 15:04"))
+		if err := s.clock.Sleep(ctx, d); err != nil {
+			return err
+		}
+	}
+	return s.limiter.Wait(ctx)
+}
+
+// rehashDay counts the files rehashed on one calendar day.
+type rehashDay struct {
+	date                       string
+	processed, changed, failed int64
+}
+
+func (d rehashDay) String() string {
+	return fmt.Sprintf("%s: rehashed %d files (%d changed, %d failed)", d.date, d.processed, d.changed, d.failed)
+}
+
+// rehashCheckpoint is the rehash_checkpoints row of a host.
+type rehashCheckpoint struct {
+	algo                       string
+	startedAt                  time.Time
+	cursorHashedAt             sql.NullTime
+	cursorID                   int
+	processed, changed, failed int64
+}
+
+// loadRehashCheckpoint returns the unfinished checkpoint of hostname, or
+// starts a new one. A checkpoint for another algorithm is only replaced when
+// restart is set.
+func loadRehashCheckpoint(ctx context.Context, sqldb *sql.DB, hostname, algo string, restart bool) (*rehashCheckpoint, bool, error) {
+	cp := &rehashCheckpoint{}
+	var completedAt sql.NullTime
+	err := sqldb.QueryRowContext(ctx, `
+		SELECT algo, started_at, cursor_hashed_at, cursor_id, processed, changed, failed, completed_at
+		FROM rehash_checkpoints
+		WHERE hostname = $1
+	`, hostname).Scan(&cp.algo, &cp.startedAt, &cp.cursorHashedAt, &cp.cursorID, &cp.processed, &cp.changed, &cp.failed, &completedAt)
+	if err != nil && err != sql.ErrNoRows {
+		return nil, false, fmt.Errorf("error loading rehash checkpoint: %v", err)
+	}
+	if err == nil && !completedAt.Valid && !restart {
+		if cp.algo != algo {
+			return nil, false, fmt.Errorf("an unfinished %s rehash exists for %s; finish it or pass --restart to start over with %s", cp.algo, hostname, algo)
+		}
+		return cp, true, nil
+	}
+
+	cp = &rehashCheckpoint{algo: algo}
+	err = sqldb.QueryRowContext(ctx, `
+		INSERT INTO rehash_checkpoints (hostname, algo, started_at, updated_at)
+		VALUES ($1, $2, NOW(), NOW())
+		ON CONFLICT (hostname) DO UPDATE SET
+			algo = EXCLUDED.algo, started_at = EXCLUDED.started_at,
+			cursor_hashed_at = NULL, cursor_id = 0,
+			processed = 0, changed = 0, failed = 0,
+			updated_at = EXCLUDED.updated_at, completed_at = NULL
+		RETURNING started_at
+	`, hostname, algo).Scan(&cp.startedAt)
+	if err != nil {
+		return nil, false, fmt.Errorf("error creating rehash checkpoint: %v", err)
+	}
+	return cp, false, nil
+}
+
+func saveRehashCheckpoint(ctx context.Context, sqldb *sql.DB, hostname string, cp *rehashCheckpoint, completed bool) error {
+	_, err := sqldb.ExecContext(ctx, `
+		UPDATE rehash_checkpoints
+		SET cursor_hashed_at = $2, cursor_id = $3, processed = $4, changed = $5, failed = $6,
+			updated_at = NOW(), completed_at = CASE WHEN $7 THEN NOW() END
+		WHERE hostname = $1
+	`, hostname, cp.cursorHashedAt, cp.cursorID, cp.processed, cp.changed, cp.failed, completed)
+	if err != nil {
+		return fmt.Errorf("error saving rehash checkpoint: %v", err)
+	}
+	return nil
+}
+
+// rehashPendingWhere selects the live rows of host $1 not rehashed since the
+// run started at $2. Rows done by this run get a newer last_hashed_at and
+// drop out; the (last_hashed_at, id) cursor in $3, $4 skips the rows that
+// failed.
+const rehashPendingWhere = `
+		WHERE hostname = $1
+		AND ` + NotDeleted + `
+		AND COALESCE(last_hashed_at, '-infinity') < $2
+		AND (COALESCE(last_hashed_at, '-infinity'), id) > (COALESCE($3::timestamp, '-infinity'), $4)
+	`
+
+// RehashAll recomputes the hash of every live row of a host with opts.Algo,
+// oldest last_hashed_at first, at no more than opts.Rate files per second
+// and only inside opts.Window. Progress is saved in rehash_checkpoints after
+// every batch, so an interrupted run resumes where it stopped.
+func RehashAll(ctx context.Context, sqldb *sql.DB, opts RehashAllOptions) error {
+	return rehashAll(ctx, sqldb, opts, realClock{})
+}
+
+func rehashAll(ctx context.Context, sqldb *sql.DB, opts RehashAllOptions, c clock) error {
+	algo, err := ParseHashAlgo(opts.Algo)
+	if err != nil {
+		return err
+	}
+	hashFile := fileHasher(algo)
+	window, err := parseDailyWindow(opts.Window)
+	if err != nil {
+		return err
+	}
+	scheduler := &rehashScheduler{clock: c, window: window, limiter: newRateLimiter(c, opts.Rate)}
+
+	host, err := db.ResolveHost(sqldb, opts.Server)
+	if err != nil {
+		return err
+	}
+	hostname := normalizeHostname(host.Hostname)
+
+	cp, resumed, err := loadRehashCheckpoint(ctx, sqldb, hostname, algo, opts.Restart)
+	if err != nil {
+		return err
+	}
+
+	var pending int64
+	if err := sqldb.QueryRowContext(ctx, "SELECT COUNT(*) FROM files"+rehashPendingWhere,
+		hostname, cp.startedAt, cp.cursorHashedAt, cp.cursorID).Scan(&pending); err != nil {
+		return fmt.Errorf("error counting files to rehash: %v", err)
+	}
+	if resumed {
+		fmt.Printf("Resuming %s rehash of %s started %s: %d done, %d remaining\n",
+			algo, host.Name, cp.startedAt.Format("2006-01-02 15:04"), cp.processed, pending)
+	} else {
+		fmt.Printf("Rehashing %d files of %s with %s\n", pending, host.Name, algo)
+	}
+
+	stmt, err := sqldb.PrepareContext(ctx, storeHashSQL)
+	if err != nil {
+		return fmt.Errorf("error preparing statement: %v", err)
+	}
+	defer stmt.Close()
+	errStmt, err := sqldb.PrepareContext(ctx, recordFileErrorSQL)
+	if err != nil {
+		return fmt.Errorf("error preparing file error statement: %v", err)
+	}
+	defer errStmt.Close()
+
+	query := fmt.Sprintf(`
+		SELECT id, path, COALESCE(root_folder, ''), COALESCE(hash, ''), last_hashed_at
+		FROM files%s
+		ORDER BY COALESCE(last_hashed_at, '-infinity'), id
+		LIMIT %d
+	`, rehashPendingWhere, rehashBatchSize)
+
+	day := rehashDay{date: c.Now().Format("2006-01-02")}
+	defer func() {
+		opts.Stats.Set("processed", cp.processed)
+		opts.Stats.Set("changed", cp.changed)
+		opts.Stats.Set("failed", cp.failed)
+	}()
+
+	type rehashRow struct {
+		id           int
+		path, root   string
+		hash         string
+		lastHashedAt sql.NullTime
+	}
+	for {
+		rows, err := sqldb.QueryContext(ctx, query, hostname, cp.startedAt, cp.cursorHashedAt, cp.cursorID)
+		if err != nil {
+			return fmt.Errorf("error querying files to rehash: %v", err)
+		}
+		var batch []rehashRow
+		for rows.Next() {
+			var r rehashRow
+			if err := rows.Scan(&r.id, &r.path, &r.root, &r.hash, &r.lastHashedAt); err != nil {
+				rows.Close()
+				return fmt.Errorf("error scanning row: %v", err)
+			}
+			batch = append(batch, r)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return fmt.Errorf("error iterating rows: %v", err)
+		}
+
+		for _, r := range batch {
+			if err := scheduler.wait(ctx); err != nil {
+				if saveErr := saveRehashCheckpoint(context.Background(), sqldb, hostname, cp, false); saveErr != nil {
+					logging.ErrorLogger.Printf("Warning: %v", saveErr)
+				}
+				return fmt.Errorf("rehash stopped after %d files; rerun to resume: %v", cp.processed, err)
+			}
+			if today := c.Now().Format("2006-01-02"); today != day.date {
+				if day.processed > 0 {
+					fmt.Println(day)
+				}
+				day = rehashDay{date: today}
+			}
+
+			fullPath := r.path
+			if r.root != "" {
+				fullPath = filepath.Join(r.root, r.path)
+			}
+			started := time.Now()
+			hash, err := hashFile(hashTargetPath(fullPath))
+			duration := time.Since(started)
+			if err != nil {
+				logging.ErrorLogger.Printf("Warning: Error rehashing %s: %v", fullPath, err)
+				if _, dbErr := errStmt.ExecContext(ctx, r.id, classifyHashError(err), err.Error()); dbErr != nil {
+					logging.ErrorLogger.Printf("Warning: Error recording hash failure: %v", dbErr)
+				}
+				cp.failed++
+				day.failed++
+			} else if _, err := stmt.ExecContext(ctx, hash, r.id, algo, duration.Milliseconds()); err != nil {
+				logging.ErrorLogger.Printf("Warning: Error updating hash for %s: %v", fullPath, err)
+				cp.failed++
+				day.failed++
+			} else if hash != r.hash {
+				cp.changed++
+				day.changed++
+			}
+			cp.processed++
+			day.processed++
+			cp.cursorHashedAt, cp.cursorID = r.lastHashedAt, r.id
+		}
+
+		done := len(batch) < rehashBatchSize
+		if err := saveRehashCheckpoint(ctx, sqldb, hostname, cp, done); err != nil {
+			return err
+		}
+		if done {
+			break
+		}
+	}
+
+	if day.processed > 0 {
+		fmt.Println(day)
+	}
+	fmt.Printf("Rehash completed: %d files rehashed with %s, %d changed, %d failed\n", cp.processed, algo, cp.changed, cp.failed)
+	return nil
+}
@@ -0,0 +1,242 @@
+package files
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+// fakeClock advances only when slept on.
+type fakeClock struct {
+	now   time.Time
+	slept []time.Duration
+}
+
+func (c *fakeClock) Now() time.Time { return c.now }
+
+func (c *fakeClock) Sleep(ctx context.Context, d time.Duration) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	c.slept = append(c.slept, d)
+	c.now = c.now.Add(d)
+	return nil
+}
+
+func at(hour, minute int) time.Time {
+	return time.Date(2026, 3, 14, hour, minute, 0, 0, time.UTC)
+}
+
+func TestParseRate(t *testing.T) {
+	cases := map[string]float64{"200/s": 200, "600/m": 10, "7200/h": 2, "5": 5, "0": 0}
+	for value, want := range cases {
+		got, err := ParseRate(value)
+		if err != nil || got != want {
+			t.Errorf("ParseRate(%q) = %v, %v; want %v", value, got, err, want)
+		}
+	}
+	for _, bad := range []string{"", "fast", "10/d", "-1/s"} {
+		if _, err := ParseRate(bad); err == nil {
+			t.Errorf("expected ParseRate(%q) to fail", bad)
+		}
+	}
+}
+
+func TestDailyWindowUntilOpen(t *testing.T) {
+	night, err := parseDailyWindow("01:00-06:00")
+	if err != nil {
+		t.Fatalf("parseDailyWindow: %v", err)
+	}
+	wrapping, err := parseDailyWindow("22:00-04:00")
+	if err != nil {
+		t.Fatalf("parseDailyWindow: %v", err)
+	}
+
+	cases := []struct {
+		window *dailyWindow
+		now    time.Time
+		want   time.Duration
+	}{
+		{night, at(0, 30), 30 * time.Minute},
+		{night, at(1, 0), 0},
+		{night, at(5, 59), 0},
+		{night, at(6, 0), 19 * time.Hour},
+		{night, at(23, 0), 2 * time.Hour},
+		{wrapping, at(23, 0), 0},
+		{wrapping, at(3, 0), 0},
+		{wrapping, at(4, 0), 18 * time.Hour},
+		{wrapping, at(21, 15), 45 * time.Minute},
+		{nil, at(12, 0), 0},
+	}
+	for _, c := range cases {
+		if got := c.window.untilOpen(c.now); got != c.want {
+			t.Errorf("untilOpen(%s) with %+v = %v, want %v", c.now.Format("15:04"), c.window, got, c.want)
+		}
+	}
+
+	for _, bad := range []string{"01:00", "25:00-06:00", "01:00-01:00"} {
+		if _, err := parseDailyWindow(bad); err == nil {
+			t.Errorf("expected parseDailyWindow(%q) to fail", bad)
+		}
+	}
+}
+
+func TestRateLimiterSpacesOperations(t *testing.T) {
+	clk := &fakeClock{now: at(12, 0)}
+	limiter := newRateLimiter(clk, 4)
+	for i := 0; i < 5; i++ {
+		if err := limiter.Wait(context.Background()); err != nil {
+			t.Fatalf("Wait: %v", err)
+		}
+	}
+	if got := clk.now.Sub(at(12, 0)); got != time.Second {
+		t.Fatalf("5 operations at 4/s took %v, want 1s", got)
+	}
+
+	// Idle time is not banked: after a long pause the next two are spaced again.
+	clk.now = clk.now.Add(time.Minute)
+	clk.slept = nil
+	limiter.Wait(context.Background())
+	limiter.Wait(context.Background())
+	if len(clk.slept) != 1 || clk.slept[0] != 250*time.Millisecond {
+		t.Fatalf("expected one 250ms sleep after a pause, got %v", clk.slept)
+	}
+
+	if newRateLimiter(clk, 0).Wait(context.Background()) != nil {
+		t.Fatalf("an unlimited rate should never wait")
+	}
+}
+
+func TestRehashSchedulerSleepsOutsideWindow(t *testing.T) {
+	window, _ := parseDailyWindow("01:00-06:00")
+	clk := &fakeClock{now: at(23, 0)}
+	scheduler := &rehashScheduler{clock: clk, window: window, limiter: newRateLimiter(clk, 2)}
+
+	out := captureStdout(t, func() {
+		for i := 0; i < 3; i++ {
+			if err := scheduler.wait(context.Background()); err != nil {
+				t.Fatalf("wait: %v", err)
+			}
+		}
+	})
+	// Two hours to the window, then the limiter spaces the three files.
+	if want := at(1, 0).Add(24*time.Hour + time.Second); !clk.now.Equal(want) {
+		t.Fatalf("clock at %v, want %v", clk.now, want)
+	}
+	if !strings.Contains(out, "sleeping until 2026-03-15 01:00") {
+		t.Errorf("expected the sleep to be reported, got:\n%s", out)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	clk.now = at(7, 0)
+	captureStdout(t, func() {
+		if err := scheduler.wait(ctx); !errors.Is(err, context.Canceled) {
+			t.Errorf("expected a cancelled wait outside the window, got %v", err)
+		}
+	})
+}
+
+func TestRehashAllResumesFromCheckpoint(t *testing.T) {
+	database, mock, err := sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherRegexp))
+	if err != nil {
+		t.Fatalf("sqlmock: %v", err)
+	}
+	defer database.Close()
+
+	root := t.TempDir()
+	content := []byte("rehash me")
+	if err := os.WriteFile(filepath.Join(root, "b.bin"), content, 0644); err != nil {
+		t.Fatalf("write fixture: %v", err)
+	}
+	sum := sha256.Sum256(content)
+	newHash := hex.EncodeToString(sum[:])
+
+	startedAt := at(0, 0)
+	cursorAt := at(0, 0).Add(-48 * time.Hour)
+	mock.ExpectQuery(`SELECT id, name, hostname, ip, root_path, settings, created_at FROM hosts WHERE LOWER\(hostname\) = LOWER\(\$1\)`).
+		WithArgs("backup1.local").
+		WillReturnRows(sqlmock.NewRows([]string{"id", "name", "hostname", "ip", "root_path", "settings", "created_at"}).
+			AddRow(1, "Backup1", "backup1.local", "", root, []byte(`{}`), time.Now()))
+	mock.ExpectQuery(`SELECT algo, started_at, cursor_hashed_at, cursor_id, processed, changed, failed, completed_at\s+FROM rehash_checkpoints\s+WHERE hostname = \$1`).
+		WithArgs("backup1.local").
+		WillReturnRows(sqlmock.NewRows([]string{"algo", "started_at", "cursor_hashed_at", "cursor_id", "processed", "changed", "failed", "completed_at"}).
+			AddRow("sha256", startedAt, cursorAt, 41, int64(40), int64(1), int64(0), nil))
+
+	pending := `WHERE hostname = \$1\s+AND deleted_at IS NULL\s+AND COALESCE\(last_hashed_at, '-infinity'\) < \$2\s+AND \(COALESCE\(last_hashed_at, '-infinity'\), id\) > \(COALESCE\(\$3::timestamp, '-infinity'\), \$4\)`
+	mock.ExpectQuery(`SELECT COUNT\(\*\) FROM files\s+`+pending).
+		WithArgs("backup1.local", startedAt, cursorAt, 41).
+		WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(int64(1)))
+	mock.ExpectPrepare(`UPDATE files\s+SET hash = \$1, last_hashed_at = NOW\(\)`)
+	mock.ExpectPrepare(`INSERT INTO file_errors`)
+	mock.ExpectQuery(`SELECT id, path, COALESCE\(root_folder, ''\), COALESCE\(hash, ''\), last_hashed_at\s+FROM files\s+`+pending+`\s+ORDER BY COALESCE\(last_hashed_at, '-infinity'\), id\s+LIMIT 100`).
+		WithArgs("backup1.local", startedAt, cursorAt, 41).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "path", "root_folder", "hash", "last_hashed_at"}).
+			AddRow(42, "b.bin", root, "stale", cursorAt))
+	mock.ExpectExec(`UPDATE files\s+SET hash = \$1, last_hashed_at = NOW\(\)`).
+		WithArgs(newHash, 42, HashAlgoSHA256, sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(`UPDATE rehash_checkpoints\s+SET cursor_hashed_at = \$2, cursor_id = \$3`).
+		WithArgs("backup1.local", cursorAt, 42, int64(41), int64(2), int64(0), true).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+
+	clk := &fakeClock{now: at(2, 0)}
+	stats := &RunStats{}
+	out := captureStdout(t, func() {
+		err := rehashAll(context.Background(), database, RehashAllOptions{
+			Server: "backup1.local",
+			Algo:   "sha256",
+			Rate:   100,
+			Window: "01:00-06:00",
+			Stats:  stats,
+		}, clk)
+		if err != nil {
+			t.Fatalf("rehashAll: %v", err)
+		}
+	})
+	for _, want := range []string{"Resuming sha256 rehash of Backup1", "40 done, 1 remaining", "2026-03-14: rehashed 1 files (1 changed, 0 failed)"} {
+		if !strings.Contains(out, want) {
+			t.Errorf("expected %q in output:\n%s", want, out)
+		}
+	}
+	if got := stats.Counters()["processed"]; got != 41 {
+		t.Errorf("processed counter = %d, want 41", got)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatalf("unmet expectations: %v", err)
+	}
+}
+
+func TestRehashAllRefusesOtherAlgorithmCheckpoint(t *testing.T) {
+	database, mock, err := sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherRegexp))
+	if err != nil {
+		t.Fatalf("sqlmock: %v", err)
+	}
+	defer database.Close()
+
+	if err := RehashAll(context.Background(), database, RehashAllOptions{Server: "backup1.local", Algo: "md5"}); err == nil || !strings.Contains(err.Error(), "unsupported hash algorithm") {
+		t.Fatalf("expected an unsupported algorithm error, got %v", err)
+	}
+
+	mock.ExpectQuery(`SELECT id, name, hostname, ip, root_path, settings, created_at FROM hosts WHERE LOWER\(hostname\) = LOWER\(\$1\)`).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "name", "hostname", "ip", "root_path", "settings", "created_at"}).
+			AddRow(1, "Backup1", "backup1.local", "", "", []byte(`{}`), time.Now()))
+	mock.ExpectQuery(`FROM rehash_checkpoints`).
+		WillReturnRows(sqlmock.NewRows([]string{"algo", "started_at", "cursor_hashed_at", "cursor_id", "processed", "changed", "failed", "completed_at"}).
+			AddRow("blake3", at(0, 0), nil, 0, int64(0), int64(0), int64(0), nil))
+	err = RehashAll(context.Background(), database, RehashAllOptions{Server: "backup1.local", Algo: "sha256"})
+	if err == nil || !strings.Contains(err.Error(), "--restart") {
+		t.Fatalf("expected a checkpoint conflict pointing at --restart, got %v", err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatalf("unmet expectations: %v", err)
+	}
+}
@@ -0,0 +1,227 @@
+package files
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"deduplicator/db"
+)
+
+// moveDestination is where list-dupes --dest and move-dupes put the copies
+// they move: a local directory, or a directory on another host given as
+// host:/path.
+type moveDestination struct {
+	Dir        string         // directory the copies go under
+	Remote     string         // ssh host of a remote destination; "" for a local one
+	Hostname   string         // hostname of the remote host when it is registered
+	SSH        db.SSHSettings // ssh settings of the remote host when it is registered
+	Root       string         // root folder of the friendly path holding Dir; "" when untracked
+	Friendly   string         // name of that friendly path
+	JournalDir string         // where the group journal is kept
+}
+
+// parseRemoteDest splits a host:/path destination. Anything else, including
+// local paths containing a colon, is a local directory.
+func parseRemoteDest(dest string) (host, dir string, ok bool) {
+	i := strings.Index(dest, ":")
+	if i <= 0 || strings.Contains(dest[:i], "/") || !strings.HasPrefix(dest[i+1:], "/") {
+		return "", "", false
+	}
+	return dest[:i], filepath.Clean(dest[i+1:]), true
+}
+
+// newMoveDestination resolves dest. For a remote destination on a registered
+// host, the friendly path whose root folder holds the directory, if any,
+// makes the moved copies tracked: their rows follow them to that host. The
+// journal of a remote destination stays on this machine.
+func newMoveDestination(database *sql.DB, dest string) (moveDestination, error) {
+	host, dir, ok := parseRemoteDest(dest)
+	if !ok {
+		return moveDestination{Dir: dest, JournalDir: dest}, nil
+	}
+	cacheDir, err := os.UserCacheDir()
+	if err != nil {
+		return moveDestination{}, fmt.Errorf("error finding a local directory for the journal: %v", err)
+	}
+	d := moveDestination{
+		Dir:        dir,
+		Remote:     host,
+		JournalDir: filepath.Join(cacheDir, "deduplicator", "journals", fmt.Sprintf("%x", sha256.Sum256([]byte(dest)))[:16]),
+	}
+
+	registered, err := db.ResolveHost(database, host)
+	if err != nil {
+		return d, nil
+	}
+	d.Hostname = normalizeHostname(registered.Hostname)
+	if d.SSH, err = hostSSH(registered); err != nil {
+		return moveDestination{}, err
+	}
+	paths, err := registered.GetPaths()
+	if err != nil {
+		return moveDestination{}, fmt.Errorf("error decoding paths for host '%s': %v", registered.Name, err)
+	}
+	for name, root := range paths {
+		root = filepath.Clean(root)
+		if (dir == root || strings.HasPrefix(dir, root+string(filepath.Separator))) && len(root) > len(d.Root) {
+			d.Root, d.Friendly = root, name
+		}
+	}
+	return d, nil
+}
+
+// announce tells where a remote destination's copies go and whether their
+// rows follow them.
+func (d moveDestination) announce() {
+	if d.Remote == "" {
+		return
+	}
+	if d.Root != "" {
+		fmt.Printf("Moving copies to %s:%s, tracked under friendly path %s of %s\n", d.Remote, d.Dir, d.Friendly, d.Hostname)
+		return
+	}
+	fmt.Printf("Warning: %s:%s is not under a registered friendly path; moved copies will be untracked and their rows deleted\n", d.Remote, d.Dir)
+}
+
+// label names target for output: host:/path for a remote destination.
+func (d moveDestination) label(target string) string {
+	if d.Remote == "" {
+		return target
+	}
+	return d.Remote + ":" + target
+}
+
+// track fills in where a's target lives for the journal: the ssh host of a
+// remote destination and its ssh settings, and, when it is tracked, the row
+// the copy becomes.
+func (d moveDestination) track(a journalAction) journalAction {
+	a.Remote = d.Remote
+	if !d.SSH.IsZero() {
+		settings := d.SSH
+		a.SSH = &settings
+	}
+	if d.Remote == "" || d.Root == "" {
+		return a
+	}
+	rel, err := filepath.Rel(d.Root, a.Target)
+	if err != nil {
+		return a
+	}
+	a.NewHost, a.NewRoot, a.NewPath = d.Hostname, d.Root, rel
+	return a
+}
+
+// targetExists reports whether target is already taken at a remote
+// destination. Local targets are not checked here.
+func (d moveDestination) targetExists(ctx context.Context, target string) (bool, error) {
+	if d.Remote == "" {
+		return false, nil
+	}
+	return remoteFileExists(ctx, d.Remote, d.SSH, target)
+}
+
+// remoteFileExists runs test -e for path on host over ssh.
+func remoteFileExists(ctx context.Context, host string, settings db.SSHSettings, path string) (bool, error) {
+	cmd, err := sshCommand(ctx, host, settings, "test -e "+shellEscape(path))
+	if err != nil {
+		return false, err
+	}
+	err = cmd.Run()
+	if err == nil {
+		return true, nil
+	}
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) && exitErr.ExitCode() == 1 {
+		return false, nil
+	}
+	return false, fmt.Errorf("ssh check of %s:%s failed: %v", host, path, err)
+}
+
+// moveToRemote moves the local file src to dst on host with rsync
+// --remove-source-files, retrying network failures like import does. It is a
+// no-op if src is gone and dst is already in place.
+func moveToRemote(ctx context.Context, host string, settings db.SSHSettings, src, dst string) error {
+	if _, err := os.Stat(src); os.IsNotExist(err) {
+		if exists, err := remoteFileExists(ctx, host, settings, dst); err == nil && exists {
+			return nil
+		}
+		return fmt.Errorf("neither %s nor %s:%s exists", src, host, dst)
+	}
+
+	dir := filepath.Dir(dst)
+	err := retryTransfer(ctx, DefaultTransferRetries, "mkdir on "+host, func() error {
+		cmd, err := sshCommand(ctx, host, settings, "mkdir -p "+shellEscape(dir))
+		if err != nil {
+			return err
+		}
+		return cmd.Run()
+	})
+	if err != nil {
+		return fmt.Errorf("error creating directory %s:%s: %v", host, dir, err)
+	}
+
+	var output []byte
+	err = retryTransfer(ctx, DefaultTransferRetries, "rsync of "+src, func() error {
+		var runErr error
+		args := append([]string{"-a", "--remove-source-files"}, rsyncShell(settings)...)
+		output, runErr = exec.CommandContext(ctx, "rsync", append(args, src, host+":"+dst)...).CombinedOutput()
+		return runErr
+	})
+	if err != nil {
+		return fmt.Errorf("error moving file %s to %s with rsync: %v\nOutput: %s", src, host, err, output)
+	}
+	return nil
+}
+
+// moveFromRemote brings dst on host back to the local src, for --recover
+// back. It is a no-op if dst is gone and src is already in place.
+func moveFromRemote(ctx context.Context, host string, settings db.SSHSettings, dst, src string) error {
+	exists, err := remoteFileExists(ctx, host, settings, dst)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		if _, err := os.Stat(src); err == nil {
+			return nil
+		}
+		return fmt.Errorf("neither %s:%s nor %s exists", host, dst, src)
+	}
+
+	dir := filepath.Dir(src)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return fmt.Errorf("error creating directory %s: %v", dir, err)
+	}
+	var output []byte
+	err = retryTransfer(ctx, DefaultTransferRetries, "rsync of "+host+":"+dst, func() error {
+		var runErr error
+		args := append([]string{"-a", "--remove-source-files"}, rsyncShell(settings)...)
+		output, runErr = exec.CommandContext(ctx, "rsync", append(args, host+":"+dst, src)...).CombinedOutput()
+		return runErr
+	})
+	if err != nil {
+		return fmt.Errorf("error moving file %s:%s back with rsync: %v\nOutput: %s", host, dst, err, output)
+	}
+	return nil
+}
+
+// restoreRewrittenRow points the row a rewrote to a tracked remote
+// destination back at its source. It reports false when there is no such
+// row, as when the rewrite failed and the row was soft-deleted instead.
+func restoreRewrittenRow(database *sql.DB, a journalAction) (bool, error) {
+	res, err := database.Exec(`
+		UPDATE files SET hostname = $2, root_folder = NULLIF($3, ''), path = $1
+		WHERE deleted_at IS NULL AND path = $6 AND hostname = $4 AND root_folder = $5
+	`, a.Path, a.Host, a.RootFolder, a.NewHost, a.NewRoot, a.NewPath)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
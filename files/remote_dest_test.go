@@ -0,0 +1,225 @@
+package files
+
+import (
+	"context"
+	"database/sql"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"deduplicator/logging"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+// stubRemoteHost puts ssh and rsync stubs on PATH that act on a temporary
+// directory standing in for the remote host's disk, and returns it. The
+// journal of a remote destination goes to a temporary cache directory.
+func stubRemoteHost(t *testing.T) string {
+	t.Helper()
+	remote := t.TempDir()
+	t.Setenv("REMOTE_ROOT", remote)
+	t.Setenv("XDG_CACHE_HOME", t.TempDir())
+	logging.InfoLogger = log.New(io.Discard, "", 0)
+	logging.ErrorLogger = log.New(io.Discard, "", 0)
+
+	stubDir := t.TempDir()
+	writeStub(t, stubDir, "ssh", `#!/bin/sh
+shift
+eval "set -- $*"
+case "$1" in
+  test) [ -e "$REMOTE_ROOT$3" ]; exit $?;;
+  mkdir) mkdir -p "$REMOTE_ROOT$3"; exit $?;;
+esac
+exit 1
+`)
+	writeStub(t, stubDir, "rsync", `#!/bin/sh
+count=$#
+src=$(eval echo \${$((count-1))})
+dst=$(eval echo \${$count})
+dst="$REMOTE_ROOT${dst#*:}"
+mkdir -p "$(dirname "$dst")"
+cp "$src" "$dst" && rm -f "$src"
+`)
+	t.Setenv("PATH", stubDir+string(os.PathListSeparator)+os.Getenv("PATH"))
+	return remote
+}
+
+func TestParseRemoteDest(t *testing.T) {
+	cases := []struct {
+		dest, host, dir string
+		ok              bool
+	}{
+		{"nas:/srv/dupes", "nas", "/srv/dupes", true},
+		{"user@nas:/srv/dupes/", "user@nas", "/srv/dupes", true},
+		{"/mnt/dupes", "", "", false},
+		{"/mnt/a:/b", "", "", false},
+		{"nas:dupes", "", "", false},
+		{":/srv", "", "", false},
+	}
+	for _, c := range cases {
+		host, dir, ok := parseRemoteDest(c.dest)
+		if host != c.host || dir != c.dir || ok != c.ok {
+			t.Errorf("parseRemoteDest(%q) = %q, %q, %v", c.dest, host, dir, ok)
+		}
+	}
+}
+
+// expectRemoteDestHost has the destination host resolve to NAS, whose
+// "archive" friendly path is /srv/archive.
+func expectRemoteDestHost(mock sqlmock.Sqlmock) {
+	mock.ExpectQuery(`FROM hosts WHERE LOWER\(hostname\) = LOWER\(\$1\)`).
+		WithArgs("nas").
+		WillReturnRows(sqlmock.NewRows([]string{"id", "name", "hostname", "ip", "root_path", "settings", "created_at"}).
+			AddRow(2, "NAS", "nas", "", "", []byte(`{"paths":{"archive":"/srv/archive"}}`), time.Now()))
+}
+
+func TestMoveDuplicatesToTrackedRemoteDestRewritesRows(t *testing.T) {
+	remote := stubRemoteHost(t)
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("sqlmock: %v", err)
+	}
+	defer db.Close()
+
+	f := newJournalFixture(t)
+	expectRemoteDestHost(mock)
+	expectMoveLookup(mock, f, true)
+	expectPathNameHosts(mock)
+	for _, name := range []string{"a.mkv", "b.mkv"} {
+		mock.ExpectExec(`UPDATE files SET hostname = \$4, root_folder = \$5, path = \$6`).
+			WithArgs(name, "zz-local", f.local, "nas", "/srv/archive", "dupes/zz-local/"+name).
+			WillReturnResult(sqlmock.NewResult(0, 1))
+	}
+
+	out := captureStdout(t, func() {
+		err = MoveDuplicates(context.Background(), db, DuplicateListOptions{}, MoveOptions{TargetDir: "nas:/srv/archive/dupes"})
+	})
+	if err != nil {
+		t.Fatalf("MoveDuplicates error: %v", err)
+	}
+	if !strings.Contains(out, "tracked under friendly path archive of nas") {
+		t.Fatalf("expected the destination to be reported as tracked:\n%s", out)
+	}
+	for i, src := range f.sources {
+		if _, err := os.Stat(src); !os.IsNotExist(err) {
+			t.Fatalf("expected %s to be moved, stat err: %v", src, err)
+		}
+		if _, err := os.Stat(filepath.Join(remote, "/srv/archive/dupes/zz-local", filepath.Base(f.targets[i]))); err != nil {
+			t.Fatalf("expected the copy on the remote host: %v", err)
+		}
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatalf("unmet expectations: %v", err)
+	}
+}
+
+func TestMoveDuplicatesDryRunPrintsRemoteTargetsAndSkipsTakenOnes(t *testing.T) {
+	remote := stubRemoteHost(t)
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("sqlmock: %v", err)
+	}
+	defer db.Close()
+
+	taken := filepath.Join(remote, "/srv/archive/dupes/zz-local/a.mkv")
+	if err := os.MkdirAll(filepath.Dir(taken), 0755); err != nil {
+		t.Fatalf("mkdir: %v", err)
+	}
+	if err := os.WriteFile(taken, []byte("other"), 0644); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+
+	f := newJournalFixture(t)
+	expectRemoteDestHost(mock)
+	expectMoveLookup(mock, f, true)
+	expectPathNameHosts(mock)
+
+	out := captureStdout(t, func() {
+		err = MoveDuplicates(context.Background(), db, DuplicateListOptions{}, MoveOptions{TargetDir: "nas:/srv/archive/dupes", DryRun: true})
+	})
+	if err != nil {
+		t.Fatalf("MoveDuplicates dry-run error: %v", err)
+	}
+	if !strings.Contains(out, "-> nas:/srv/archive/dupes/zz-local/b.mkv") || strings.Contains(out, "zz-local/a.mkv\n") {
+		t.Fatalf("expected only b.mkv planned, to its remote target:\n%s", out)
+	}
+	for _, src := range f.sources {
+		if _, err := os.Stat(src); err != nil {
+			t.Fatalf("dry run moved %s: %v", src, err)
+		}
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatalf("unmet expectations: %v", err)
+	}
+}
+
+func TestDedupFilesToUntrackedRemoteDestDeletesRows(t *testing.T) {
+	remote := stubRemoteHost(t)
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("sqlmock: %v", err)
+	}
+	defer db.Close()
+
+	root := t.TempDir()
+	keepFile := filepath.Join(root, "keepdir", "dup.txt")
+	moveFile := filepath.Join(root, "movedir", "dup.txt")
+	for _, path := range []string{keepFile, moveFile, filepath.Join(root, "keepdir", "other.txt")} {
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatalf("mkdir: %v", err)
+		}
+		if err := os.WriteFile(path, []byte("same"), 0644); err != nil {
+			t.Fatalf("write %s: %v", path, err)
+		}
+	}
+
+	hostname, _ := os.Hostname()
+	lower := strings.ToLower(hostname)
+
+	// backup2 is not a registered host, so the moved copy is untracked.
+	expectLocalHost(mock, root, "")
+	mock.ExpectQuery(`FROM hosts WHERE LOWER\(hostname\) = LOWER\(\$1\)`).
+		WithArgs("backup2").
+		WillReturnError(sql.ErrNoRows)
+	mock.ExpectQuery(`FROM hosts WHERE name = \$1`).
+		WithArgs("backup2").
+		WillReturnError(sql.ErrNoRows)
+	mock.ExpectQuery("SELECT hostname FROM hosts WHERE LOWER\\(hostname\\) = LOWER\\(\\$1\\)").
+		WithArgs(lower).
+		WillReturnRows(sqlmock.NewRows([]string{"hostname"}).AddRow("host-a"))
+	mock.ExpectQuery("WITH duplicates AS").
+		WillReturnRows(sqlmock.NewRows([]string{"hash", "path", "hostname", "size", "root_folder"}).
+			AddRow("hash1", "movedir/dup.txt", "host-a", int64(4), "").
+			AddRow("hash1", "keepdir/dup.txt", "host-a", int64(4), ""))
+	expectPathNameHosts(mock)
+	mock.ExpectExec("UPDATE files SET deleted_at = NOW\\(\\)").
+		WithArgs("movedir/dup.txt", "host-a").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+
+	out := captureStdout(t, func() {
+		err = DedupFiles(context.Background(), db, DedupeOptions{DestDir: "backup2:/mnt/spill"})
+	})
+	if err != nil {
+		t.Fatalf("DedupFiles error: %v", err)
+	}
+	if !strings.Contains(out, "moved copies will be untracked") {
+		t.Fatalf("expected the untracked warning:\n%s", out)
+	}
+	if _, err := os.Stat(moveFile); !os.IsNotExist(err) {
+		t.Fatalf("expected moved file to be removed from source, got stat err: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(remote, "/mnt/spill/movedir/dup.txt")); err != nil {
+		t.Fatalf("expected the copy on the remote host: %v", err)
+	}
+	if _, err := os.Stat(keepFile); err != nil {
+		t.Fatalf("expected keep file to remain: %v", err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatalf("unmet expectations: %v", err)
+	}
+}
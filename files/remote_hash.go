@@ -0,0 +1,77 @@
+package files
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os/exec"
+	"strings"
+	"time"
+
+	"deduplicator/db"
+)
+
+// sshUnreachableExitCode is the exit status ssh reports for its own
+// failures, such as a refused connection, as opposed to the remote
+// command's.
+const sshUnreachableExitCode = 255
+
+// errRemoteUnreachable is returned by remote hashing when ssh itself fails,
+// so a run stops instead of recording every file as problematic.
+var errRemoteUnreachable = errors.New("ssh connection failed")
+
+// remoteHashTimeout is how long hashing a file of size bytes over ssh may
+// take. The remote command prints nothing until it is done, so stall
+// detection is not possible; the file gets the stall timeout for every
+// started GiB instead.
+func remoteHashTimeout(stall time.Duration, size int64) time.Duration {
+	const gib = 1 << 30
+	if size <= gib {
+		return stall
+	}
+	return stall * time.Duration((size+gib-1)/gib)
+}
+
+// asRemoteUnreachable wraps err in errRemoteUnreachable when it is ssh's
+// own failure to reach host.
+func asRemoteUnreachable(host string, err error) error {
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) && exitErr.ExitCode() == sshUnreachableExitCode {
+		return fmt.Errorf("%w to %s: %v", errRemoteUnreachable, host, err)
+	}
+	return err
+}
+
+// checkRemoteHashing makes sure host answers over ssh before a remote hash
+// run starts.
+func checkRemoteHashing(ctx context.Context, host *db.Host) error {
+	settings, err := hostSSH(host)
+	if err != nil {
+		return err
+	}
+	cmd, err := sshCommand(ctx, host.Hostname, settings, "true")
+	if err != nil {
+		return err
+	}
+	if output, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("%w to %s: %v %s", errRemoteUnreachable, host.Hostname, err, strings.TrimSpace(string(output)))
+	}
+	return nil
+}
+
+// remoteFileHasher returns a hasher running the hash command of host on it
+// over ssh, giving up on a file after timeout like a local hash that stalls.
+func remoteFileHasher(ctx context.Context, host *db.Host, timeout time.Duration) func(filePath string) (string, error) {
+	return func(filePath string) (string, error) {
+		hashCtx, cancel := context.WithTimeout(ctx, timeout)
+		defer cancel()
+		hash, err := hashRemoteFile(hashCtx, host, filePath)
+		if err != nil && errors.Is(hashCtx.Err(), context.DeadlineExceeded) {
+			return "", fmt.Errorf("hashing timed out after %s for remote file: %s", describeStall(timeout), filePath)
+		}
+		if err != nil {
+			return "", asRemoteUnreachable(host.Hostname, err)
+		}
+		return hash, nil
+	}
+}
@@ -0,0 +1,137 @@
+package files
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"deduplicator/logging"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+// stubRemoteHashing puts an ssh stub on PATH that answers the reachability
+// probe with probeExit and runs the hash command against a temporary
+// directory standing in for the remote disk, which it returns. With
+// hashExit set, the hash command exits with it instead.
+func stubRemoteHashing(t *testing.T, probeExit, hashExit string) string {
+	t.Helper()
+	remote := t.TempDir()
+	t.Setenv("REMOTE_ROOT", remote)
+	logging.InfoLogger = log.New(io.Discard, "", 0)
+
+	stubDir := t.TempDir()
+	writeStub(t, stubDir, "ssh", `#!/bin/sh
+shift
+eval "set -- $*"
+case "$1" in
+  true) exit `+probeExit+`;;
+esac
+`+hashExit+`
+"$1" "$REMOTE_ROOT$3"
+`)
+	t.Setenv("PATH", stubDir+string(os.PathListSeparator)+os.Getenv("PATH"))
+	return remote
+}
+
+func TestRemoteHashTimeoutGrowsPerGiB(t *testing.T) {
+	for size, want := range map[int64]time.Duration{
+		0:           time.Minute,
+		1 << 30:     time.Minute,
+		1<<30 + 1:   2 * time.Minute,
+		500 << 30:   500 * time.Minute,
+		-1:          time.Minute,
+		3 << 30 / 2: 2 * time.Minute,
+	} {
+		if got := remoteHashTimeout(time.Minute, size); got != want {
+			t.Errorf("remoteHashTimeout(1m, %d) = %v, want %v", size, got, want)
+		}
+	}
+}
+
+func TestHashFilesRemoteHashesOverSSH(t *testing.T) {
+	remote := stubRemoteHashing(t, "0", "")
+	writeFiles(t, remote+"/data", "on the nas", "a.bin")
+	sum := sha256.Sum256([]byte("on the nas"))
+
+	db, mock, err := sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherRegexp))
+	if err != nil {
+		t.Fatalf("Failed to create mock database: %v", err)
+	}
+	defer db.Close()
+	mock.MatchExpectationsInOrder(false)
+
+	mock.ExpectQuery(`SELECT COUNT\(\*\) FROM files`).
+		WithArgs("backup1.local").
+		WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(1))
+	updateRe := `(?s)UPDATE files\s+SET hash = \$1`
+	mock.ExpectPrepare(updateRe)
+	mock.ExpectPrepare(`INSERT INTO file_errors`)
+	mock.ExpectQuery(`(?s)SELECT id, path, root_folder`).
+		WithArgs("backup1.local", 0).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "path", "root_folder", "effective_size", "mod_time", "hashed"}).
+			AddRow(1, "a.bin", "/data", int64(10), nil, false))
+	mock.ExpectPrepare(updateRe).ExpectExec().
+		WithArgs(hex.EncodeToString(sum[:]), 1, HashAlgoSHA256, sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+
+	out := captureStdout(t, func() {
+		err = HashFiles(context.Background(), db, HashOptions{Host: backup1Host("/data", `{}`), FullHash: true, Remote: true})
+	})
+	if err != nil {
+		t.Fatalf("HashFiles: %v", err)
+	}
+	if !strings.Contains(out, "Hashing the files of backup1.local on it over ssh") {
+		t.Fatalf("expected the remote notice:\n%s", out)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatalf("unmet expectations: %v", err)
+	}
+}
+
+func TestHashFilesRemoteStopsWhenSSHFails(t *testing.T) {
+	for name, stub := range map[string][2]string{
+		"unreachable before the run": {"255", ""},
+		"connection lost mid-run":    {"0", "exit 255"},
+	} {
+		t.Run(name, func(t *testing.T) {
+			stubRemoteHashing(t, stub[0], stub[1])
+
+			db, mock, err := sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherRegexp))
+			if err != nil {
+				t.Fatalf("Failed to create mock database: %v", err)
+			}
+			defer db.Close()
+			mock.MatchExpectationsInOrder(false)
+
+			mock.ExpectQuery(`SELECT COUNT\(\*\) FROM files`).
+				WithArgs("backup1.local").
+				WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(1))
+			if stub[0] == "0" {
+				// No file_errors row is written for a lost connection.
+				mock.ExpectPrepare(`(?s)UPDATE files\s+SET hash = \$1`)
+				mock.ExpectPrepare(`INSERT INTO file_errors`)
+				mock.ExpectQuery(`(?s)SELECT id, path, root_folder`).
+					WithArgs("backup1.local", 0).
+					WillReturnRows(sqlmock.NewRows([]string{"id", "path", "root_folder", "effective_size", "mod_time", "hashed"}).
+						AddRow(1, "a.bin", "/data", int64(10), nil, false))
+			}
+
+			captureStdout(t, func() {
+				err = HashFiles(context.Background(), db, HashOptions{Host: backup1Host("/data", `{}`), FullHash: true, Remote: true})
+			})
+			if err == nil || !strings.Contains(err.Error(), "ssh connection failed to backup1.local") {
+				t.Fatalf("expected the run to stop on the ssh failure, got %v", err)
+			}
+			if err := mock.ExpectationsWereMet(); err != nil {
+				t.Fatalf("unmet expectations: %v", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,94 @@
+package files
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"os/exec"
+	"time"
+
+	"deduplicator/logging"
+)
+
+// DefaultTransferRetries is how many times import and mirror attempt each
+// rsync (and ssh mkdir) before giving up on a file.
+const DefaultTransferRetries = 3
+
+// Delay before the second attempt of a transfer. It doubles for every
+// further attempt up to transferMaxBackoff, plus up to half again as jitter
+// so that parallel runs do not retry in lockstep.
+var (
+	transferBackoff    = 2 * time.Second
+	transferMaxBackoff = 30 * time.Second
+)
+
+// transferSleep waits for d or until ctx is done. Tests replace it.
+var transferSleep = func(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+// retryableTransferCodes are the exit codes of a network blip rather than of
+// a transfer that can never succeed: rsync's socket I/O (10), data stream
+// (12) and timeout (30) errors, and 255, the exit code ssh reports when it
+// cannot reach the host. Everything else, such as 1 (syntax) or 23 (partial
+// transfer, e.g. a missing source), fails at once.
+var retryableTransferCodes = map[int]bool{10: true, 12: true, 30: true, 255: true}
+
+// isRetryableTransfer reports whether err is a command exiting with one of
+// retryableTransferCodes.
+func isRetryableTransfer(err error) bool {
+	var exitErr *exec.ExitError
+	if !errors.As(err, &exitErr) {
+		return false
+	}
+	return retryableTransferCodes[exitErr.ExitCode()]
+}
+
+// transferDelay returns the backoff before the attempt after attempt.
+func transferDelay(attempt int) time.Duration {
+	delay := transferBackoff
+	for i := 1; i < attempt && delay < transferMaxBackoff; i++ {
+		delay *= 2
+	}
+	if delay > transferMaxBackoff {
+		delay = transferMaxBackoff
+	}
+	if delay > 1 {
+		delay += time.Duration(rand.Int63n(int64(delay / 2)))
+	}
+	return delay
+}
+
+// retryTransfer calls run, which starts a fresh command each time, up to
+// attempts times while it fails with a retryable exit code, backing off
+// between attempts. label names the transfer in the log. It returns the last
+// error, also when ctx is cancelled during a backoff.
+func retryTransfer(ctx context.Context, attempts int, label string, run func() error) error {
+	if attempts < 1 {
+		attempts = 1
+	}
+	for attempt := 1; ; attempt++ {
+		err := run()
+		if err == nil {
+			if attempt > 1 {
+				logging.InfoLogger.Printf("%s succeeded on attempt %d/%d", label, attempt, attempts)
+			}
+			return nil
+		}
+		if attempt >= attempts || !isRetryableTransfer(err) || ctx.Err() != nil {
+			return err
+		}
+		delay := transferDelay(attempt)
+		logging.InfoLogger.Printf("%s failed on attempt %d/%d: %v; retrying in %s", label, attempt, attempts, err, delay.Round(time.Millisecond))
+		if sleepErr := transferSleep(ctx, delay); sleepErr != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,117 @@
+package files
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os/exec"
+	"testing"
+	"time"
+)
+
+// exitWith runs a shell that exits with code, for a real *exec.ExitError.
+func exitWith(code int) error {
+	return exec.Command("sh", "-c", fmt.Sprintf("exit %d", code)).Run()
+}
+
+// recordSleeps replaces transferSleep for the test and returns the delays it
+// was asked to wait.
+func recordSleeps(t *testing.T) *[]time.Duration {
+	t.Helper()
+	var sleeps []time.Duration
+	orig := transferSleep
+	transferSleep = func(ctx context.Context, d time.Duration) error {
+		sleeps = append(sleeps, d)
+		return ctx.Err()
+	}
+	t.Cleanup(func() { transferSleep = orig })
+	return &sleeps
+}
+
+func TestRetryTransferRetriesTransientFailures(t *testing.T) {
+	for _, code := range []int{10, 12, 30, 255} {
+		sleeps := recordSleeps(t)
+		calls := 0
+		err := retryTransfer(context.Background(), 3, "rsync a b", func() error {
+			calls++
+			if calls < 3 {
+				return exitWith(code)
+			}
+			return nil
+		})
+		if err != nil || calls != 3 {
+			t.Fatalf("exit %d: err=%v after %d calls, want success on the third", code, err, calls)
+		}
+		if len(*sleeps) != 2 {
+			t.Fatalf("exit %d: slept %d times, want 2", code, len(*sleeps))
+		}
+		first, second := (*sleeps)[0], (*sleeps)[1]
+		if first < transferBackoff || first >= transferBackoff*3/2 || second < 2*transferBackoff || second >= 3*transferBackoff {
+			t.Fatalf("exit %d: unexpected backoff %v, %v", code, first, second)
+		}
+	}
+}
+
+func TestRetryTransferGivesUpAfterAttempts(t *testing.T) {
+	recordSleeps(t)
+	calls := 0
+	err := retryTransfer(context.Background(), 3, "rsync a b", func() error {
+		calls++
+		return exitWith(12)
+	})
+	var exitErr *exec.ExitError
+	if !errors.As(err, &exitErr) || exitErr.ExitCode() != 12 || calls != 3 {
+		t.Fatalf("err=%v after %d calls, want exit 12 after 3", err, calls)
+	}
+}
+
+func TestRetryTransferFailsPermanentErrorsAtOnce(t *testing.T) {
+	sleeps := recordSleeps(t)
+	for _, code := range []int{1, 23} {
+		calls := 0
+		err := retryTransfer(context.Background(), 5, "rsync a b", func() error {
+			calls++
+			return exitWith(code)
+		})
+		if err == nil || calls != 1 {
+			t.Fatalf("exit %d: err=%v after %d calls, want one failed call", code, err, calls)
+		}
+	}
+	calls := 0
+	if err := retryTransfer(context.Background(), 5, "rsync a b", func() error {
+		calls++
+		return exec.ErrNotFound
+	}); err == nil || calls != 1 {
+		t.Fatalf("missing binary: err=%v after %d calls", err, calls)
+	}
+	if len(*sleeps) != 0 {
+		t.Fatalf("slept %v for permanent errors", *sleeps)
+	}
+}
+
+func TestRetryTransferStopsWhenCancelledDuringBackoff(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	orig := transferSleep
+	t.Cleanup(func() { transferSleep = orig })
+	transferSleep = func(ctx context.Context, d time.Duration) error {
+		cancel()
+		return orig(ctx, time.Hour)
+	}
+
+	calls := 0
+	err := retryTransfer(ctx, 3, "rsync a b", func() error {
+		calls++
+		return exitWith(255)
+	})
+	if err == nil || calls != 1 {
+		t.Fatalf("err=%v after %d calls, want the first failure once cancelled", err, calls)
+	}
+}
+
+func TestTransferDelayIsCapped(t *testing.T) {
+	for attempt := 1; attempt <= 10; attempt++ {
+		if d := transferDelay(attempt); d > transferMaxBackoff*3/2 {
+			t.Fatalf("attempt %d: delay %v exceeds the cap", attempt, d)
+		}
+	}
+}
@@ -0,0 +1,135 @@
+package files
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"path"
+	"strings"
+
+	"deduplicator/logging"
+)
+
+// dirListing is what the files table knows about one directory: the first
+// names in it and how many rows it holds in all.
+type dirListing struct {
+	Names []string
+	Total int
+}
+
+type dirKey struct {
+	hostname, rootFolder, dir string
+}
+
+// SiblingCache looks up the indexed neighbours of duplicate copies so a
+// dedupe plan can be judged in context. It reads the files table rather than
+// the disk, so remote copies cost the same as local ones, and each directory
+// is queried once per run.
+type SiblingCache struct {
+	ctx   context.Context
+	db    *sql.DB
+	limit int
+	dirs  map[dirKey]dirListing
+}
+
+// NewSiblingCache returns a cache that shows up to limit sibling names per
+// copy.
+func NewSiblingCache(ctx context.Context, database *sql.DB, limit int) *SiblingCache {
+	return &SiblingCache{ctx: ctx, db: database, limit: limit, dirs: make(map[dirKey]dirListing)}
+}
+
+// Siblings returns up to the cache's limit of names sharing filePath's
+// directory, excluding filePath itself, and how many such rows there are.
+func (c *SiblingCache) Siblings(hostname, rootFolder, filePath string) ([]string, int, error) {
+	dir := path.Dir(filePath)
+	key := dirKey{normalizeHostname(hostname), rootFolder, dir}
+	listing, ok := c.dirs[key]
+	if !ok {
+		var err error
+		// One extra name, so the limit still holds once filePath is left out.
+		if listing, err = c.listDir(key, c.limit+1); err != nil {
+			return nil, 0, err
+		}
+		c.dirs[key] = listing
+	}
+
+	self := path.Base(filePath)
+	names := make([]string, 0, c.limit)
+	total := listing.Total
+	for _, name := range listing.Names {
+		if name == self {
+			total--
+			continue
+		}
+		if len(names) < c.limit {
+			names = append(names, name)
+		}
+	}
+	return names, total, nil
+}
+
+// listDir reads the first limit rows directly inside key.dir, and the count
+// of all of them.
+func (c *SiblingCache) listDir(key dirKey, limit int) (dirListing, error) {
+	var direct, nested string
+	if key.dir == "." {
+		// Relative paths at the top of their root folder.
+		direct, nested = "%", "%/%"
+	} else {
+		prefix := escapeLike(strings.TrimSuffix(key.dir, "/"))
+		direct, nested = prefix+"/%", prefix+"/%/%"
+	}
+
+	rows, err := c.db.QueryContext(c.ctx, `
+		SELECT path, COUNT(*) OVER ()
+		FROM files
+		WHERE hostname = $1
+		AND COALESCE(root_folder, '') = $2
+		AND path LIKE $3 ESCAPE '\'
+		AND path NOT LIKE $4 ESCAPE '\'
+		AND `+NotDeleted+`
+		ORDER BY path
+		LIMIT $5
+	`, key.hostname, key.rootFolder, direct, nested, limit)
+	if err != nil {
+		return dirListing{}, fmt.Errorf("error listing %s on %s: %v", key.dir, key.hostname, err)
+	}
+	defer rows.Close()
+
+	var listing dirListing
+	for rows.Next() {
+		var p string
+		if err := rows.Scan(&p, &listing.Total); err != nil {
+			return dirListing{}, fmt.Errorf("error scanning sibling: %v", err)
+		}
+		listing.Names = append(listing.Names, path.Base(p))
+	}
+	if err := rows.Err(); err != nil {
+		return dirListing{}, fmt.Errorf("error listing %s on %s: %v", key.dir, key.hostname, err)
+	}
+	return listing, nil
+}
+
+// describe renders the siblings of one copy for list-dupes --context. A
+// failed lookup is logged and shown as unavailable rather than ending the
+// listing.
+func (c *SiblingCache) describe(hostname, rootFolder, filePath string) string {
+	names, total, err := c.Siblings(hostname, rootFolder, filePath)
+	if err != nil {
+		logging.ErrorLogger.Printf("Warning: %v", err)
+		return "context unavailable"
+	}
+	if total == 0 {
+		return "no other indexed files in this directory"
+	}
+	line := fmt.Sprintf("%d other files here: %s", total, strings.Join(names, ", "))
+	if more := total - len(names); more > 0 {
+		line += fmt.Sprintf(", ... (+%d more)", more)
+	}
+	return line
+}
+
+// escapeLike escapes the LIKE wildcards in s, for use with ESCAPE '\'.
+func escapeLike(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(s)
+}
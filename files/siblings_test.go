@@ -0,0 +1,94 @@
+package files
+
+import (
+	"context"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+func TestSiblingCacheListsDirectoryOncePerRun(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("sqlmock: %v", err)
+	}
+	defer db.Close()
+
+	// Two groups have a copy in photos/2021/album; the directory is read
+	// once, with one name more than the limit so the copy itself can be
+	// left out.
+	mock.ExpectQuery(`SELECT path, COUNT\(\*\) OVER \(\)`).
+		WithArgs("pinky", "/data", `photos/2021/album/%`, `photos/2021/album/%/%`, 3).
+		WillReturnRows(sqlmock.NewRows([]string{"path", "count"}).
+			AddRow("photos/2021/album/a.jpg", 40).
+			AddRow("photos/2021/album/b.jpg", 40).
+			AddRow("photos/2021/album/c.jpg", 40))
+	mock.ExpectQuery(`SELECT path, COUNT\(\*\) OVER \(\)`).
+		WithArgs("rpi4", "/backup", `Down\_loads/%`, `Down\_loads/%/%`, 3).
+		WillReturnRows(sqlmock.NewRows([]string{"path", "count"}).
+			AddRow("Down_loads/a.jpg", 1))
+
+	groups := []DuplicateGroup{
+		{
+			Hash:        "h1",
+			Size:        10,
+			Files:       []string{"photos/2021/album/a.jpg", "Down_loads/a.jpg"},
+			Hosts:       []string{"pinky", "rpi4"},
+			RootFolders: []string{"/data", "/backup"},
+		},
+		{
+			Hash:        "h2",
+			Size:        10,
+			Files:       []string{"photos/2021/album/c.jpg", "photos/2021/album/c-copy.jpg"},
+			Hosts:       []string{"pinky", "pinky"},
+			RootFolders: []string{"/data", "/data"},
+		},
+	}
+	siblings := NewSiblingCache(context.Background(), db, 2)
+	out := captureStdout(t, func() { PrintDuplicateGroups(groups, nil, siblings) })
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatalf("unmet expectations: %v", err)
+	}
+	for _, want := range []string{
+		"39 other files here: b.jpg, c.jpg, ... (+37 more)",
+		"no other indexed files in this directory",
+		"39 other files here: a.jpg, b.jpg, ... (+37 more)",
+		// c-copy.jpg is not among the first names read, so none is left out.
+		"40 other files here: a.jpg, b.jpg, ... (+38 more)",
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("output missing %q:\n%s", want, out)
+		}
+	}
+	if strings.Contains(out, "context unavailable") {
+		t.Errorf("a directory was looked up twice:\n%s", out)
+	}
+}
+
+func TestSiblingCacheTopLevelDirectory(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("sqlmock: %v", err)
+	}
+	defer db.Close()
+
+	mock.ExpectQuery(`SELECT path, COUNT\(\*\) OVER \(\)`).
+		WithArgs("pinky", "/data", "%", "%/%", 6).
+		WillReturnRows(sqlmock.NewRows([]string{"path", "count"}).
+			AddRow("a.txt", 2).
+			AddRow("b.txt", 2))
+
+	names, total, err := NewSiblingCache(context.Background(), db, 5).Siblings("Pinky", "/data", "a.txt")
+	if err != nil {
+		t.Fatalf("Siblings: %v", err)
+	}
+	if !reflect.DeepEqual(names, []string{"b.txt"}) || total != 1 {
+		t.Fatalf("Siblings = %v, %d; want [b.txt], 1", names, total)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatalf("unmet expectations: %v", err)
+	}
+}
@@ -0,0 +1,132 @@
+package files
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"time"
+
+	"deduplicator/db"
+	"deduplicator/logging"
+)
+
+// defaultVacuumBatchSize is how many soft-deleted rows are purged per DELETE.
+const defaultVacuumBatchSize = 1000
+
+// UndeleteFiles clears deleted_at on the rows of a host that were
+// soft-deleted within opts.Since, optionally limited to one friendly path.
+// Only catalog rows come back; files removed from disk stay removed. A row is
+// skipped when its path has since been indexed again, and only the most
+// recently deleted row of a path is restored. It returns the number of rows
+// restored and skipped.
+func UndeleteFiles(ctx context.Context, database *sql.DB, opts UndeleteOptions) (int64, int64, error) {
+	if opts.Since <= 0 {
+		return 0, 0, fmt.Errorf("--since must be positive")
+	}
+	host, err := db.GetHost(database, opts.Server)
+	if err != nil {
+		return 0, 0, fmt.Errorf("server not found: %s", opts.Server)
+	}
+
+	args := []interface{}{normalizeHostname(host.Hostname), int64(opts.Since / time.Second)}
+	where := `WHERE f.hostname = $1 AND f.deleted_at >= NOW() - $2 * INTERVAL '1 second'`
+	if opts.Path != "" {
+		paths, err := host.GetPaths()
+		if err != nil {
+			return 0, 0, fmt.Errorf("error decoding host paths: %v", err)
+		}
+		root, ok := paths[opts.Path]
+		if !ok {
+			return 0, 0, fmt.Errorf("friendly path %q not found for server %s", opts.Path, host.Name)
+		}
+		args = append(args, root)
+		where += ` AND f.root_folder = $3`
+	}
+
+	var candidates int64
+	if err := database.QueryRowContext(ctx, `SELECT COUNT(*) FROM files f `+where, args...).Scan(&candidates); err != nil {
+		return 0, 0, fmt.Errorf("error counting deleted files: %v", err)
+	}
+	if candidates == 0 {
+		return 0, 0, nil
+	}
+
+	result, err := database.ExecContext(ctx, `
+		UPDATE files f SET deleted_at = NULL
+		`+where+`
+		AND NOT EXISTS (
+			SELECT 1 FROM files live
+			WHERE live.path = f.path AND live.hostname = f.hostname AND live.`+NotDeleted+`
+		)
+		AND f.id = (
+			SELECT d.id FROM files d
+			WHERE d.path = f.path AND d.hostname = f.hostname AND d.deleted_at IS NOT NULL
+			ORDER BY d.deleted_at DESC, d.id DESC
+			LIMIT 1
+		)
+	`, args...)
+	if err != nil {
+		return 0, 0, fmt.Errorf("error restoring deleted files: %v", err)
+	}
+	restored, err := result.RowsAffected()
+	if err != nil {
+		return 0, 0, fmt.Errorf("error checking restored rows: %v", err)
+	}
+
+	logging.InfoLogger.Printf("Undeleted %d rows for host %s (%d skipped)", restored, host.Name, candidates-restored)
+	return restored, candidates - restored, nil
+}
+
+// CountVacuumable returns how many rows VacuumFiles would remove for
+// olderThan, without removing them.
+func CountVacuumable(ctx context.Context, database *sql.DB, olderThan time.Duration) (int64, error) {
+	var count int64
+	err := database.QueryRowContext(ctx, `
+		SELECT COUNT(*) FROM files
+		WHERE deleted_at < NOW() - $1 * INTERVAL '1 second'
+	`, int64(olderThan/time.Second)).Scan(&count)
+	if err != nil {
+		return 0, fmt.Errorf("error counting deleted files: %v", err)
+	}
+	return count, nil
+}
+
+// VacuumFiles permanently removes rows that were soft-deleted more than
+// opts.OlderThan ago, across all hosts, in batches so no single statement
+// holds locks on a large part of the table. It returns the number of rows
+// removed.
+func VacuumFiles(ctx context.Context, database *sql.DB, opts VacuumOptions) (int64, error) {
+	if opts.OlderThan <= 0 {
+		return 0, fmt.Errorf("--older-than must be positive")
+	}
+	batchSize := opts.BatchSize
+	if batchSize <= 0 {
+		batchSize = defaultVacuumBatchSize
+	}
+	olderThan := int64(opts.OlderThan / time.Second)
+
+	var removed int64
+	for {
+		result, err := database.ExecContext(ctx, `
+			DELETE FROM files WHERE id IN (
+				SELECT id FROM files
+				WHERE deleted_at < NOW() - $1 * INTERVAL '1 second'
+				LIMIT $2
+			)
+		`, olderThan, batchSize)
+		if err != nil {
+			return removed, fmt.Errorf("error purging deleted files: %v", err)
+		}
+		n, err := result.RowsAffected()
+		if err != nil {
+			return removed, fmt.Errorf("error checking purged rows: %v", err)
+		}
+		removed += n
+		if n < int64(batchSize) {
+			return removed, nil
+		}
+		if err := ctx.Err(); err != nil {
+			return removed, err
+		}
+	}
+}
@@ -0,0 +1,91 @@
+package files
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+func TestUndeleteFilesRestoresNewestLiveFreeRows(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("sqlmock: %v", err)
+	}
+	defer db.Close()
+
+	expectExportHost(mock)
+	where := `WHERE f.hostname = \$1 AND f.deleted_at >= NOW\(\) - \$2 \* INTERVAL '1 second' AND f.root_folder = \$3`
+	mock.ExpectQuery(`SELECT COUNT\(\*\) FROM files f `+where).
+		WithArgs("backup1.local", int64(7200), "/data/photos").
+		WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(5))
+	mock.ExpectExec(`(?s)UPDATE files f SET deleted_at = NULL\s+`+where+`\s+AND NOT EXISTS \(.*live.deleted_at IS NULL\s+\)\s+AND f.id = \(.*ORDER BY d.deleted_at DESC, d.id DESC`).
+		WithArgs("backup1.local", int64(7200), "/data/photos").
+		WillReturnResult(sqlmock.NewResult(0, 3))
+
+	restored, skipped, err := UndeleteFiles(context.Background(), db, UndeleteOptions{Server: "Backup1", Path: "photos", Since: 2 * time.Hour})
+	if err != nil {
+		t.Fatalf("UndeleteFiles: %v", err)
+	}
+	if restored != 3 || skipped != 2 {
+		t.Fatalf("expected 3 restored and 2 skipped, got %d and %d", restored, skipped)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatalf("unmet expectations: %v", err)
+	}
+}
+
+func TestVacuumFilesDeletesInBatchesUntilShort(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("sqlmock: %v", err)
+	}
+	defer db.Close()
+
+	purge := `(?s)DELETE FROM files WHERE id IN \(\s+SELECT id FROM files\s+WHERE deleted_at < NOW\(\) - \$1 \* INTERVAL '1 second'\s+LIMIT \$2\s+\)`
+	thirtyDays := int64(30 * 24 * 3600)
+	mock.ExpectExec(purge).WithArgs(thirtyDays, 2).WillReturnResult(sqlmock.NewResult(0, 2))
+	mock.ExpectExec(purge).WithArgs(thirtyDays, 2).WillReturnResult(sqlmock.NewResult(0, 2))
+	mock.ExpectExec(purge).WithArgs(thirtyDays, 2).WillReturnResult(sqlmock.NewResult(0, 1))
+
+	removed, err := VacuumFiles(context.Background(), db, VacuumOptions{OlderThan: 30 * 24 * time.Hour, BatchSize: 2})
+	if err != nil {
+		t.Fatalf("VacuumFiles: %v", err)
+	}
+	if removed != 5 {
+		t.Fatalf("expected 5 rows purged, got %d", removed)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatalf("unmet expectations: %v", err)
+	}
+
+	if _, err := VacuumFiles(context.Background(), db, VacuumOptions{}); err == nil {
+		t.Fatal("expected an error without --older-than")
+	}
+}
+
+func TestReadQueriesHideSoftDeletedRows(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("sqlmock: %v", err)
+	}
+	defer db.Close()
+
+	mock.ExpectQuery(`(?s)WITH duplicates AS \(.*WHERE hash IS NOT NULL\s+AND hash ~ '\^\[0-9a-f\]\{64\}\$'\s+AND size IS NOT NULL\s+AND deleted_at IS NULL.*JOIN files f ON f.hash = d.hash AND f.size = d.size AND f.deleted_at IS NULL`).
+		WillReturnRows(sqlmock.NewRows([]string{"hash", "path", "hostname", "size", "root_folder"}))
+	if _, err := FindDuplicateGroups(context.Background(), db, "", "", DuplicateSizeRules{}, "", 0, nil); err != nil {
+		t.Fatalf("FindDuplicateGroups: %v", err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatalf("unmet expectations: %v", err)
+	}
+
+	for _, opts := range []HashOptions{{}, {FullHash: true}, {Refresh: true}, {RetryProblematic: true, Renew: true}} {
+		where := buildHashWhereClause(opts)
+		if !strings.Contains(where, "WHERE hostname = $1 AND "+NotDeleted) {
+			t.Fatalf("hash where clause %+v does not hide deleted rows: %s", opts, where)
+		}
+	}
+}
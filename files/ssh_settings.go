@@ -0,0 +1,51 @@
+package files
+
+import (
+	"fmt"
+	"strconv"
+
+	"deduplicator/db"
+)
+
+// sshOptions returns the ssh arguments that go before the host for s: -p,
+// -i and -l, then one -o per extra option. Zero settings add none, so ssh
+// goes by ~/.ssh/config as it always did.
+func sshOptions(s db.SSHSettings) []string {
+	var args []string
+	if s.Port != 0 {
+		args = append(args, "-p", strconv.Itoa(s.Port))
+	}
+	if s.IdentityFile != "" {
+		args = append(args, "-i", s.IdentityFile)
+	}
+	if s.User != "" {
+		args = append(args, "-l", s.User)
+	}
+	for _, option := range s.Options {
+		args = append(args, "-o", option)
+	}
+	return args
+}
+
+// rsyncShell returns the -e option that makes rsync connect with s, or
+// nothing for zero settings. rsync splits the command itself, honoring the
+// quotes shellJoin adds.
+func rsyncShell(s db.SSHSettings) []string {
+	if s.IsZero() {
+		return nil
+	}
+	return []string{"-e", shellJoin(append([]string{"ssh"}, sshOptions(s)...))}
+}
+
+// hostSSH returns the ssh settings of host; a nil host, such as one that is
+// not registered, has none.
+func hostSSH(host *db.Host) (db.SSHSettings, error) {
+	if host == nil {
+		return db.SSHSettings{}, nil
+	}
+	s, err := host.GetSSHSettings()
+	if err != nil {
+		return db.SSHSettings{}, fmt.Errorf("error reading ssh settings for host '%s': %v", host.Name, err)
+	}
+	return s, nil
+}
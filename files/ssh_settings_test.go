@@ -0,0 +1,37 @@
+package files
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	"deduplicator/db"
+)
+
+func TestSSHCommandUsesHostSettings(t *testing.T) {
+	settings := db.SSHSettings{User: "backup", Port: 2222, IdentityFile: "/keys/nas key", Options: []string{"BatchMode=yes"}}
+
+	cmd, err := sshCommand(context.Background(), "nas.invalid", settings, "mkdir", "-p", "/data/photos")
+	if err != nil {
+		t.Fatalf("sshCommand: %v", err)
+	}
+	want := []string{"ssh", "-p", "2222", "-i", "/keys/nas key", "-l", "backup", "-o", "BatchMode=yes", "nas.invalid", "mkdir", "-p", "/data/photos"}
+	if !reflect.DeepEqual(cmd.Args, want) {
+		t.Fatalf("unexpected ssh argv:\n got %q\nwant %q", cmd.Args, want)
+	}
+	if got, want := rsyncShell(settings), []string{"-e", "ssh -p 2222 -i '/keys/nas key' -l backup -o BatchMode=yes"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("unexpected rsync shell %q, want %q", got, want)
+	}
+
+	// A host without settings is reached exactly as before.
+	cmd, err = sshCommand(context.Background(), "nas.invalid", db.SSHSettings{}, "true")
+	if err != nil {
+		t.Fatalf("sshCommand: %v", err)
+	}
+	if want := []string{"ssh", "nas.invalid", "true"}; !reflect.DeepEqual(cmd.Args, want) {
+		t.Fatalf("unexpected ssh argv without settings: %q", cmd.Args)
+	}
+	if got := rsyncShell(db.SSHSettings{}); got != nil {
+		t.Fatalf("expected no rsync -e without settings, got %q", got)
+	}
+}
@@ -0,0 +1,224 @@
+package files
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// statusInterval is how often a StatusWriter rewrites its file while
+// counters change; significant events are written at once.
+const statusInterval = 5 * time.Second
+
+// statusStaleAfter is how long a running status may go without an update
+// before it is reported as stale.
+const statusStaleAfter = time.Minute
+
+// RunStatus is the JSON document a StatusWriter keeps current, so a long run
+// can be watched from another terminal with files import-status or jq.
+type RunStatus struct {
+	Command     string           `json:"command"`
+	PID         int              `json:"pid"`
+	State       string           `json:"state"` // running, finished, cancelled or failed
+	StartedAt   time.Time        `json:"started_at"`
+	UpdatedAt   time.Time        `json:"updated_at"`
+	CurrentFile string           `json:"current_file,omitempty"`
+	Counters    map[string]int64 `json:"counters"`
+	Error       string           `json:"error,omitempty"`
+}
+
+// StatusWriter periodically and atomically rewrites a RunStatus file, and
+// notices a sibling ".cancel" file asking the run to stop. A nil
+// *StatusWriter does nothing, so callers need not check whether one was
+// requested.
+type StatusWriter struct {
+	path  string
+	clock clock
+
+	mu        sync.Mutex
+	status    RunStatus
+	lastWrite time.Time
+}
+
+// NewStatusWriter returns a writer for path, or nil when path is empty. The
+// file is written immediately so watchers see the run start.
+func NewStatusWriter(path, command string) (*StatusWriter, error) {
+	return newStatusWriter(path, command, realClock{})
+}
+
+func newStatusWriter(path, command string, c clock) (*StatusWriter, error) {
+	if path == "" {
+		return nil, nil
+	}
+	now := c.Now()
+	w := &StatusWriter{
+		path:  path,
+		clock: c,
+		status: RunStatus{
+			Command:   command,
+			PID:       os.Getpid(),
+			State:     "running",
+			StartedAt: now,
+			Counters:  map[string]int64{},
+		},
+	}
+	// A cancel file left over from an earlier run must not stop this one.
+	if err := os.Remove(w.CancelPath()); err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("error removing stale cancel file %s: %v", w.CancelPath(), err)
+	}
+	if err := w.write(); err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
+// CancelPath is the file whose appearance asks the run to stop.
+func (w *StatusWriter) CancelPath() string {
+	return w.path + ".cancel"
+}
+
+// Update records the current file and counters, rewriting the status file
+// once statusInterval has passed since the last write.
+func (w *StatusWriter) Update(currentFile string, counters map[string]int64) {
+	if w == nil {
+		return
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.record(currentFile, counters)
+	if w.clock.Now().Sub(w.lastWrite) >= statusInterval {
+		w.writeLocked()
+	}
+}
+
+// Event records like Update but rewrites the status file at once, for
+// significant events such as a transfer starting or failing.
+func (w *StatusWriter) Event(currentFile string, counters map[string]int64) {
+	if w == nil {
+		return
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.record(currentFile, counters)
+	w.writeLocked()
+}
+
+// Finish writes the final counters and state: finished, cancelled when err
+// is a cancellation, or failed.
+func (w *StatusWriter) Finish(counters map[string]int64, err error) {
+	if w == nil {
+		return
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.record("", counters)
+	switch {
+	case err == nil:
+		w.status.State = "finished"
+	case errors.Is(err, context.Canceled):
+		w.status.State = "cancelled"
+		w.status.Error = err.Error()
+	default:
+		w.status.State = "failed"
+		w.status.Error = err.Error()
+	}
+	w.writeLocked()
+}
+
+// CheckCancel returns a context.Canceled error if the cancel file exists.
+// Runs call it at each item boundary, so work in flight is finished first.
+func (w *StatusWriter) CheckCancel() error {
+	if w == nil {
+		return nil
+	}
+	if _, err := os.Stat(w.CancelPath()); err == nil {
+		return fmt.Errorf("%w: %s found", context.Canceled, w.CancelPath())
+	}
+	return nil
+}
+
+func (w *StatusWriter) record(currentFile string, counters map[string]int64) {
+	w.status.CurrentFile = currentFile
+	for name, value := range counters {
+		w.status.Counters[name] = value
+	}
+}
+
+func (w *StatusWriter) writeLocked() {
+	// A status file that cannot be written must not stop the run.
+	if err := w.write(); err != nil {
+		fmt.Fprintf(os.Stderr, "Warning: %v\n", err)
+	}
+}
+
+// write replaces the status file through a temporary file and rename, so a
+// reader never sees a partial document.
+func (w *StatusWriter) write() error {
+	now := w.clock.Now()
+	w.status.UpdatedAt = now
+	data, err := json.MarshalIndent(w.status, "", "  ")
+	if err != nil {
+		return fmt.Errorf("error encoding status: %v", err)
+	}
+	tmp := w.path + ".tmp"
+	if err := os.WriteFile(tmp, append(data, '\n'), 0644); err != nil {
+		return fmt.Errorf("error writing status file %s: %v", tmp, err)
+	}
+	if err := os.Rename(tmp, w.path); err != nil {
+		return fmt.Errorf("error writing status file %s: %v", w.path, err)
+	}
+	w.lastWrite = now
+	return nil
+}
+
+// ReadRunStatus reads a status file written by a StatusWriter.
+func ReadRunStatus(path string) (*RunStatus, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("error reading status file: %v", err)
+	}
+	var status RunStatus
+	if err := json.Unmarshal(data, &status); err != nil {
+		return nil, fmt.Errorf("error parsing status file %s: %v", path, err)
+	}
+	return &status, nil
+}
+
+// PrintRunStatus prints a status file's contents for a person watching the
+// run; now is used for elapsed times and to flag a status gone stale.
+func PrintRunStatus(status *RunStatus, now time.Time) {
+	fmt.Printf("%s (pid %d): %s\n", status.Command, status.PID, status.State)
+	fmt.Printf("  Started: %s (%s ago)\n", status.StartedAt.Format("2006-01-02 15:04:05"), now.Sub(status.StartedAt).Round(time.Second))
+	updated := now.Sub(status.UpdatedAt).Round(time.Second)
+	if status.State == "running" && updated >= statusStaleAfter {
+		fmt.Printf("  Updated: %s ago (stale: the run may have died)\n", updated)
+	} else {
+		fmt.Printf("  Updated: %s ago\n", updated)
+	}
+	if status.CurrentFile != "" {
+		fmt.Printf("  Current file: %s\n", status.CurrentFile)
+	}
+
+	names := make([]string, 0, len(status.Counters))
+	for name := range status.Counters {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		value := status.Counters[name]
+		if strings.HasSuffix(name, "bytes") {
+			fmt.Printf("  %s: %s\n", name, formatBytes(value))
+		} else {
+			fmt.Printf("  %s: %d\n", name, value)
+		}
+	}
+	if status.Error != "" {
+		fmt.Printf("  Error: %s\n", status.Error)
+	}
+}
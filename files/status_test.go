@@ -0,0 +1,126 @@
+package files
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func readStatus(t *testing.T, path string) *RunStatus {
+	t.Helper()
+	status, err := ReadRunStatus(path)
+	if err != nil {
+		t.Fatalf("ReadRunStatus: %v", err)
+	}
+	return status
+}
+
+func TestStatusWriterThrottlesUpdatesButNotEvents(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "status.json")
+	clk := &fakeClock{now: at(9, 0)}
+	w, err := newStatusWriter(path, "files import", clk)
+	if err != nil {
+		t.Fatalf("newStatusWriter: %v", err)
+	}
+	if got := readStatus(t, path); got.State != "running" || got.PID != os.Getpid() || !got.StartedAt.Equal(at(9, 0)) {
+		t.Fatalf("unexpected initial status %+v", got)
+	}
+
+	w.Update("a.jpg", map[string]int64{"processed": 1})
+	if got := readStatus(t, path); got.Counters["processed"] != 0 {
+		t.Fatalf("update within the interval should not be written, got %+v", got)
+	}
+
+	clk.now = clk.now.Add(statusInterval)
+	w.Update("b.jpg", map[string]int64{"processed": 2})
+	if got := readStatus(t, path); got.Counters["processed"] != 2 || got.CurrentFile != "b.jpg" {
+		t.Fatalf("update after the interval should be written, got %+v", got)
+	}
+
+	w.Event("c.jpg", map[string]int64{"processed": 3, "errors": 1})
+	if got := readStatus(t, path); got.Counters["errors"] != 1 || got.CurrentFile != "c.jpg" {
+		t.Fatalf("events should be written at once, got %+v", got)
+	}
+
+	w.Finish(map[string]int64{"processed": 4}, nil)
+	got := readStatus(t, path)
+	if got.State != "finished" || got.Counters["processed"] != 4 || got.CurrentFile != "" {
+		t.Fatalf("unexpected final status %+v", got)
+	}
+	if _, err := os.Stat(path + ".tmp"); !os.IsNotExist(err) {
+		t.Fatalf("temporary file left behind: %v", err)
+	}
+}
+
+func TestStatusWriterCancelFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "status.json")
+	if err := os.WriteFile(path+".cancel", nil, 0644); err != nil {
+		t.Fatalf("write stale cancel file: %v", err)
+	}
+	w, err := newStatusWriter(path, "files import", &fakeClock{now: at(9, 0)})
+	if err != nil {
+		t.Fatalf("newStatusWriter: %v", err)
+	}
+	if err := w.CheckCancel(); err != nil {
+		t.Fatalf("a cancel file from an earlier run should be cleared, got %v", err)
+	}
+
+	if err := os.WriteFile(w.CancelPath(), nil, 0644); err != nil {
+		t.Fatalf("write cancel file: %v", err)
+	}
+	err = w.CheckCancel()
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected a cancellation, got %v", err)
+	}
+	w.Finish(nil, err)
+	if got := readStatus(t, path); got.State != "cancelled" || !strings.Contains(got.Error, ".cancel found") {
+		t.Fatalf("unexpected final status %+v", got)
+	}
+}
+
+func TestNilStatusWriterDoesNothing(t *testing.T) {
+	w, err := NewStatusWriter("", "files import")
+	if err != nil || w != nil {
+		t.Fatalf("expected no writer without a path, got %v (%v)", w, err)
+	}
+	w.Update("a", nil)
+	w.Event("a", nil)
+	w.Finish(nil, errors.New("boom"))
+	if err := w.CheckCancel(); err != nil {
+		t.Fatalf("CheckCancel on nil writer: %v", err)
+	}
+}
+
+func TestPrintRunStatusFlagsStaleRuns(t *testing.T) {
+	status := &RunStatus{
+		Command:     "files import",
+		PID:         4242,
+		State:       "running",
+		StartedAt:   at(9, 0),
+		UpdatedAt:   at(9, 58),
+		CurrentFile: "/staging/a.jpg",
+		Counters:    map[string]int64{"processed": 12, "bytes": 1234567},
+	}
+	out := captureStdout(t, func() { PrintRunStatus(status, at(10, 0)) })
+	for _, want := range []string{
+		"files import (pid 4242): running",
+		"Started: 2026-03-14 09:00:00 (1h0m0s ago)",
+		"Updated: 2m0s ago (stale",
+		"Current file: /staging/a.jpg",
+		"bytes: 1,234,567",
+		"processed: 12",
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("expected %q in output:\n%s", want, out)
+		}
+	}
+
+	status.UpdatedAt = at(10, 0).Add(-2 * time.Second)
+	if out := captureStdout(t, func() { PrintRunStatus(status, at(10, 0)) }); strings.Contains(out, "stale") {
+		t.Errorf("a fresh status should not be stale:\n%s", out)
+	}
+}
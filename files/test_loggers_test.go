@@ -1,8 +1,11 @@
 package files
 
 import (
+	"bytes"
 	"io"
 	"log"
+	"os"
+	"testing"
 
 	"deduplicator/logging"
 )
@@ -11,3 +14,21 @@ func init() {
 	logging.InfoLogger = log.New(io.Discard, "", 0)
 	logging.ErrorLogger = log.New(io.Discard, "", 0)
 }
+
+func captureStdout(t *testing.T, fn func()) string {
+	t.Helper()
+	orig := os.Stdout
+	r, w, _ := os.Pipe()
+	os.Stdout = w
+	// Drain the pipe while fn runs so long output cannot fill it and block.
+	done := make(chan string)
+	go func() {
+		var buf bytes.Buffer
+		_, _ = io.Copy(&buf, r)
+		done <- buf.String()
+	}()
+	fn()
+	_ = w.Close()
+	os.Stdout = orig
+	return <-done
+}
@@ -1,5 +1,13 @@
 package files
 
+import (
+	"io"
+	"sync"
+	"time"
+
+	"deduplicator/db"
+)
+
 // ColorOptions represents color settings for output
 type ColorOptions struct {
 	HeaderColor string
@@ -9,50 +17,203 @@ type ColorOptions struct {
 
 // DuplicateListOptions represents options for listing duplicate files
 type DuplicateListOptions struct {
-	Count   int   // Limit the number of duplicate groups to show (0 = no limit)
-	MinSize int64 // Minimum file size to consider
+	Count        int           // Limit the number of duplicate groups to show (0 = no limit)
+	MinSize      int64         // Minimum file size to consider
+	IgnoreEmpty  bool          // Leave out empty files even without MinSize
+	Sort         DuplicateSort // Order of the groups ("" = SortBySize)
+	ShowExternal bool          // Annotate groups whose content is known to an external backup
+	Context      int           // Show up to this many other files from each copy's directory (0 = off)
+	Format       string        // "text" (default), "brief", one line per group, or "json", the summary
+	Summary      bool          // Report totals instead of the groups; with the brief format, end with a totals line
+	Print0Paths  bool          // Print only the non-keeper paths of this host, NUL-terminated
+	CSV          string        // Write one row per duplicate file to this file instead ("-" = stdout)
+	Exclude      PathExcludes  // Leave out files matching these globs
+	Path         string        // Only consider this host's files under this friendly path ("" = all)
 }
 
 // DedupeOptions represents options for the dedupe command
 type DedupeOptions struct {
-	DryRun        bool   // If true, only show what would be done without making changes
-	DestDir       string // Directory to move duplicate files to
-	StripPrefix   string // Remove this prefix from paths when moving files
-	Count         int    // Limit the number of duplicate groups to process (0 = no limit)
-	IgnoreDestDir bool   // If true, ignore files that are already in the destination directory
-	MinSize       int64  // Minimum file size to consider
+	DryRun        bool          // If true, only show what would be done without making changes
+	DestDir       string        // Directory to move duplicate files to
+	StripPrefix   string        // Remove this prefix from paths when moving files
+	Count         int           // Limit the number of duplicate groups to process (0 = no limit)
+	IgnoreDestDir bool          // If true, ignore files that are already in the destination directory
+	MinSize       int64         // Minimum file size to consider
+	IgnoreEmpty   bool          // Leave out empty files even without MinSize
+	Recover       string        // How to resolve a group left half done: "forward", "back", or "" to refuse
+	MergeXattrs   bool          // Copy whitelisted xattrs missing on the keeper from each moved copy
+	Symlink       bool          // Leave a relative symlink to the keeper where each moved copy was
+	Exclude       PathExcludes  // Leave out files matching these globs
+	Path          string        // Only consider files under this friendly path of the host ("" = all)
+	Keep          KeepPolicy    // Which copy of each group to keep (zero = most-populated)
+	Interactive   bool          // Ask on the terminal before moving each group
+	Stats         *RunStats     // Receives the interactive decisions and verification counts (optional)
+	Delete        bool          // Delete surplus copies instead of moving them; DestDir must be empty
+	MinCopies     int           // How many copies of each group to keep, moving or deleting the rest (0 = 1)
+	Verify        bool          // Re-hash each copy right before moving or deleting it (and with Delete, each kept copy)
+	DeleteReport  string        // With Delete, file recording every deletion ("" = DefaultDeleteReportPath)
+	MinAge        time.Duration // Skip copies modified less than this long ago (0 = no minimum)
+	MaxBytes      int64         // Without Delete, start no new group once the moved copies add up to this many bytes (0 = no limit)
+
+	terminal io.ReadWriter // answers the interactive prompt instead of /dev/tty (tests)
 }
 
 // ImportOptions represents options for the import command
 type ImportOptions struct {
-	SourcePath   string // Source directory to import files from
-	HostName     string // Target hostname to import files to
-	FriendlyPath string // Target friendly path on the server to import files to
-	RemoveSource bool   // If true, remove source files after successful import
-	DryRun       bool   // If true, only show what would be done without making changes
-	Count        int    // Limit the number of files to process (0 = no limit)
-	DuplicateDir string // If non-empty, move duplicate files to this directory instead of skipping
-	Age          int    // Only import files older than this many minutes
+	SourcePath   string        // Source directory to import files from
+	HostName     string        // Target hostname to import files to
+	FriendlyPath string        // Target friendly path on the server to import files to
+	RemoveSource bool          // If true, remove source files after successful import
+	DryRun       bool          // If true, only show what would be done without making changes
+	Count        int           // Limit the number of files to process (0 = no limit)
+	DuplicateDir string        // If non-empty, move duplicate files to this directory instead of skipping
+	Age          time.Duration // Only import files older than this
+	MaxAge       time.Duration // Only import files newer than this (0 = no limit)
+	Stats        *RunStats     // Receives the final counters of the run (optional)
+	// Routes sends each top-level source subdirectory to its own friendly
+	// path; other files go to FriendlyPath.
+	Routes        map[string]string
+	StrictRoutes  bool // Skip files outside routed subdirectories instead of using FriendlyPath
+	CaptureXattrs bool // Store the target host's whitelisted xattrs of each source file
+	// TransferRetries is how many times each rsync and ssh mkdir is attempted
+	// while it fails with a transient exit code (0 or 1 = no retries).
+	TransferRetries int
+	// MaxPathLen skips files whose source, target or duplicate path is
+	// longer, in bytes (0 = DefaultMaxPathLen).
+	MaxPathLen int
+	// Status, when set, is kept current with the run's progress and stops
+	// the run at the next file once its cancel file appears.
+	Status *StatusWriter
+	// MinFree stops the run, after the file being transferred, before a
+	// destination's free space drops under it (zero = no headroom check).
+	MinFree FreeSpaceFloor
+	// FreeCheckEvery is how many transferred files go by between free
+	// space checks (0 = DefaultFreeCheckEvery).
+	FreeCheckEvery int
+	// Exclude skips files and whole directories whose path relative to
+	// SourcePath matches one of its globs.
+	Exclude PathExcludes
+	// Include, when set, only imports files whose path relative to
+	// SourcePath matches one of its globs. Directories are always walked.
+	Include PathExcludes
+	// Workers is how many files are hashed and transferred at once
+	// (0 or 1 = one at a time).
+	Workers int
+	// Verify re-hashes each transferred copy at the destination before its
+	// row is inserted or its source removed; a copy that does not match
+	// is deleted and counted as an error.
+	Verify bool
+	// BatchSize is how many transferred files are recorded per
+	// transaction (0 = DefaultImportBatchSize).
+	BatchSize int
+	// OnConflict settles a source file whose target path already holds a
+	// file with other content ("" = ImportConflictSkip).
+	OnConflict ImportConflict
+	// SummaryJSON, when set, is the file the run's counters and failures
+	// are written to as JSON when it ends; "-" writes them to stdout and
+	// sends the human output to stderr.
+	SummaryJSON string
+	// BwLimit is passed to every rsync as --bwlimit (empty = no limit).
+	BwLimit string
+	// RsyncOptions are added to every rsync's arguments, each as one argv
+	// entry.
+	RsyncOptions []string
 }
 
 // MoveOptions represents options for moving duplicate files
 type MoveOptions struct {
-	TargetDir string // Directory to move duplicates to
-	DryRun    bool   // If true, only show what would be done
-	Count     int    // Limit the number of duplicate groups to process (0 = no limit)
+	TargetDir   string        // Directory to move duplicates to
+	DryRun      bool          // If true, only show what would be done
+	Count       int           // Limit the number of duplicate groups to process (0 = no limit)
+	Recover     string        // How to resolve a group left half done: "forward", "back", or "" to refuse
+	MergeXattrs bool          // Copy whitelisted xattrs missing on a local keeper from each moved copy
+	Symlink     bool          // Leave a relative symlink to the local keeper where each moved copy was
+	Keep        KeepPolicy    // Which copy of each group to keep (zero = first by host and path)
+	Verify      bool          // Re-hash each copy right before moving it; skip those that differ
+	MinAge      time.Duration // Skip copies modified less than this long ago (0 = no minimum)
+	MaxBytes    int64         // Start no new group once the moved copies add up to this many bytes (0 = no limit)
+	Stats       *RunStats     // Receives the verification counts (optional)
 }
 
 // PruneOptions represents options for the prune command
 
 // HashOptions represents options for the hash command
 type HashOptions struct {
-	Server           string
-	Refresh          bool     // hash selected files regardless of existing hash
-	Renew            bool     // hash files with hashes older than 1 week
-	RetryProblematic bool     // retry files that previously timed out
-	FullHash         bool     // hash all eligible files instead of only duplicate-size candidates
-	LargeFirst       bool     // process larger files before smaller files
-	Paths            []string // friendly path names or absolute root folders to process first
+	Host             *db.Host  // host to hash, resolved by the caller with db.ResolveHost
+	Refresh          bool      // hash selected files regardless of existing hash
+	Renew            bool      // hash files with hashes older than 1 week
+	RetryProblematic bool      // retry files that previously timed out
+	MaxAttempts      int       // timeouts after which a file is marked permanent (0 = never)
+	FullHash         bool      // hash all eligible files instead of only duplicate-size candidates
+	LargeFirst       bool      // process larger files before smaller files
+	NewestFirst      bool      // process the most recently added files (highest id) first
+	Paths            []string  // friendly path names or absolute root folders to process first
+	OnlyPath         string    // only hash files under this friendly path ("" = every root folder)
+	MinSize          int64     // only hash files at least this large (0 = no minimum)
+	MaxSize          int64     // only hash files at most this large (0 = no maximum)
+	AuditSample      int       // files hashed this run to re-hash at the end and compare (0 disables)
+	Algo             string    // hash algorithm to hash with and record in hash_algo ("" = sha256)
+	Prescreen        bool      // quick-hash candidates first and fully hash only colliding ones
+	Remote           bool      // hash the files of another machine on it over ssh
+	Count            int       // stop after hashing this many files (0 = unlimited)
+	Checkpoint       bool      // save progress in hash_checkpoints after every batch
+	Resume           bool      // with Checkpoint, start after the saved checkpoint of these options
+	Stats            *RunStats // receives the final counters of the run (optional)
+
+	hasher     func(path string) (string, error) // the Algo hasher when nil; tests inject their own
+	rootFolder string                            // OnlyPath resolved by HashFiles
+}
+
+// HashStatsOptions represents options for the files stats report
+type HashStatsOptions struct {
+	Server  string // Host name to report on
+	Slowest int    // Number of slowest-hashing files to list
+}
+
+// UnhashedOptions represents options for the unhashed backlog report
+type UnhashedOptions struct {
+	Server string // Host name to report on
+	By     string // Bucket by "path" (friendly path) or "age" (row created_at)
+	Output string // "text" (default) or "json"
+}
+
+// ExportHashesOptions represents options for the export-hashes command
+type ExportHashesOptions struct {
+	Server       string
+	Path         string    // Optional friendly path to restrict the export to
+	Format       string    // "csv" (default) or "binary"
+	ChangedSince time.Time // Only export rows hashed at or after this time (zero = all)
+}
+
+// ImportHashesOptions represents options for the import-hashes command
+type ImportHashesOptions struct {
+	Format    string // "csv" (default) or "binary"
+	BatchSize int    // Hashes marked per UPDATE (default: 1000)
+}
+
+// DoctorOptions represents options for the catalog health checks
+type DoctorOptions struct {
+	Fix bool // Repair the problems found where a check knows how
+}
+
+// UndeleteOptions represents options for the undelete command
+type UndeleteOptions struct {
+	Server string
+	Path   string        // Optional friendly path to restrict the restore to
+	Since  time.Duration // Restore rows soft-deleted within this window
+}
+
+// UndoMovesOptions represents options for the undo-moves command
+type UndoMovesOptions struct {
+	Manifest string    // Move manifest written by list-dupes --dest or move-dupes
+	DryRun   bool      // If true, only show what would be moved back
+	Stats    *RunStats // Counters for the run summary (optional)
+}
+
+// VacuumOptions represents options for the vacuum command
+type VacuumOptions struct {
+	OlderThan time.Duration // Purge rows soft-deleted longer ago than this
+	BatchSize int           // Rows removed per DELETE (default: 1000)
 }
 
 // HashUpgradeOptions represents options for upgrading stored hashes to full-file hashes.
@@ -60,10 +221,97 @@ type HashUpgradeOptions struct {
 	Server string
 }
 
+// RehashAllOptions represents options for the rehash-all command
+type RehashAllOptions struct {
+	Server  string
+	Algo    string    // Hash algorithm to recompute with (default: sha256)
+	Rate    float64   // Files rehashed per second at most (0 = unlimited)
+	Window  string    // Daily time-of-day window as HH:MM-HH:MM ("" = any time)
+	Restart bool      // Discard the saved checkpoint and start over
+	Stats   *RunStats // Receives the final counters of the run (optional)
+}
+
+// VerifyOptions represents options for the verify command
+type VerifyOptions struct {
+	Server          string
+	All             bool      // Verify every hashed file instead of a sample
+	SamplePercent   float64   // Percentage of hashed files to verify without All
+	MinSize         int64     // Only verify files at least this large
+	FailFast        bool      // Stop at the first mismatch
+	ResetMismatched bool      // Clear the hash of mismatched rows so files hash repairs them
+	Stats           *RunStats // Receives the final counters of the run (optional)
+}
+
 // FindOptions represents options for the find command
 type FindOptions struct {
-	Server      string
-	Path        string // Optional friendly path to filter on
-	MinimumSize int64  // Minimum file size to consider
-	NumWorkers  int    // Number of worker goroutines to use
+	Server              string
+	Path                string    // Optional friendly path to filter on
+	MinimumSize         int64     // Minimum file size to consider
+	NumWorkers          int       // Number of worker goroutines to use
+	FollowSymlinks      bool      // Descend into symlinked directories, skipping cycles
+	IndexSymlinkTargets bool      // Index file symlinks under the link path using the target's content
+	MaxDepth            int       // Directory depth limit when following symlinks (0 = DefaultMaxWalkDepth)
+	CaptureXattrs       bool      // Store the host's whitelisted xattrs in files.xattrs
+	Register            bool      // Create the hosts row for this machine if it is missing
+	Stats               *RunStats // Receives the final counters of the run (optional)
+	ReportNew           io.Writer // Receives "<friendly>/<path>" of each inserted row, per committed batch (optional)
+	MaxPathLen          int       // Skip files whose absolute path is longer, in bytes (0 = DefaultMaxPathLen)
+}
+
+// UpdateOptions represents options for the update command
+type UpdateOptions struct {
+	Register bool // Create the hosts row for this machine if it is missing
+}
+
+// RunStats collects the final counters of a long-running command so the
+// caller can report them once it finishes. A nil *RunStats records nothing,
+// so commands can update it unconditionally.
+type RunStats struct {
+	mu       sync.Mutex
+	counters map[string]int64
+}
+
+// Set records the value of a counter.
+func (s *RunStats) Set(name string, value int64) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.counters == nil {
+		s.counters = make(map[string]int64)
+	}
+	s.counters[name] = value
+}
+
+// Counters returns a copy of the recorded counters.
+func (s *RunStats) Counters() map[string]int64 {
+	if s == nil {
+		return nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	counters := make(map[string]int64, len(s.counters))
+	for name, value := range s.counters {
+		counters[name] = value
+	}
+	return counters
+}
+
+// UniqueOptions represents options for the unique command
+type UniqueOptions struct {
+	Server  string   // Host whose unique content is reported
+	Against []string // Host names to compare with; empty compares with every other host
+	MinSize int64    // Minimum file size to consider
+	Output  string   // "text" (default) or "json"
+	List    bool     // Also list each unique file
+	CopyTo  string   // Copy the unique files to this host, under the same friendly paths
+	DryRun  bool     // With CopyTo, only show what would be copied
+}
+
+// DupeReportOptions represents options for the dupe-report command
+type DupeReportOptions struct {
+	Depth   int    // Directory levels below each root folder to group by (0 = the root folder itself)
+	MinSize int64  // Minimum file size to consider
+	CSV     string // Also write the table to this file as CSV ("-" = stdout instead of the table)
 }
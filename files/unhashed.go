@@ -0,0 +1,217 @@
+package files
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"deduplicator/db"
+)
+
+// unhashedAgeLabels names the created_at buckets used by --by age, youngest first.
+var unhashedAgeLabels = []string{"<1d", "1-7d", "7-30d", ">30d"}
+
+// unhashedLargestLimit is how many of the biggest unhashed files are reported.
+const unhashedLargestLimit = 10
+
+// UnhashedBucket is the number and total size of unhashed files in one bucket.
+type UnhashedBucket struct {
+	Label string `json:"label"`
+	Files int64  `json:"files"`
+	Bytes int64  `json:"bytes"`
+}
+
+// UnhashedFile is one of the largest files still waiting for a hash.
+type UnhashedFile struct {
+	Path         string     `json:"path"`
+	RootFolder   string     `json:"root_folder"`
+	FriendlyPath string     `json:"friendly_path"`
+	Size         int64      `json:"size"`
+	CreatedAt    *time.Time `json:"created_at,omitempty"`
+}
+
+// UnhashedReport summarizes the hashing backlog of a host.
+type UnhashedReport struct {
+	Host       string           `json:"host"`
+	By         string           `json:"by"`
+	TotalFiles int64            `json:"total_files"`
+	TotalBytes int64            `json:"total_bytes"`
+	Buckets    []UnhashedBucket `json:"buckets"`
+	Largest    []UnhashedFile   `json:"largest"`
+}
+
+// unhashedAgeBucket maps the age of a row in whole days to an index into
+// unhashedAgeLabels. Rows without a created_at are counted as the oldest.
+func unhashedAgeBucket(ageDays sql.NullInt64) int {
+	switch {
+	case !ageDays.Valid:
+		return 3
+	case ageDays.Int64 < 1:
+		return 0
+	case ageDays.Int64 < 7:
+		return 1
+	case ageDays.Int64 < 30:
+		return 2
+	default:
+		return 3
+	}
+}
+
+// UnhashedBacklog reports files that have never been hashed (hash IS NULL and
+// no recorded hashing error) bucketed by friendly path or by row age, along
+// with the largest of them.
+func UnhashedBacklog(ctx context.Context, database *sql.DB, opts UnhashedOptions) (*UnhashedReport, error) {
+	by := opts.By
+	if by == "" {
+		by = "path"
+	}
+	if by != "path" && by != "age" {
+		return nil, fmt.Errorf("invalid value for --by: %q (use path or age)", opts.By)
+	}
+
+	host, err := db.GetHost(database, opts.Server)
+	if err != nil {
+		return nil, fmt.Errorf("server not found: %s", opts.Server)
+	}
+	hostname := normalizeHostname(host.Hostname)
+	names, err := NewPathNames(host)
+	if err != nil {
+		return nil, err
+	}
+
+	report := &UnhashedReport{Host: host.Name, By: by, Buckets: []UnhashedBucket{}, Largest: []UnhashedFile{}}
+	where := `WHERE hostname = $1 AND hash IS NULL AND ` + NotDeleted + ` AND ` + noFileErrorsPredicate
+
+	if by == "path" {
+		rows, err := database.QueryContext(ctx, `
+			SELECT COALESCE(root_folder, ''), COUNT(*), COALESCE(SUM(size), 0)
+			FROM files `+where+`
+			GROUP BY COALESCE(root_folder, '')
+			ORDER BY COUNT(*) DESC, COALESCE(root_folder, '')
+		`, hostname)
+		if err != nil {
+			return nil, fmt.Errorf("error counting unhashed files: %v", err)
+		}
+		defer rows.Close()
+		for rows.Next() {
+			var root string
+			var b UnhashedBucket
+			if err := rows.Scan(&root, &b.Files, &b.Bytes); err != nil {
+				return nil, fmt.Errorf("error scanning unhashed counts: %v", err)
+			}
+			if root == "" {
+				b.Label = "(no root folder)"
+			} else {
+				b.Label = names.Display(root, "")
+			}
+			report.Buckets = append(report.Buckets, b)
+		}
+		if err := rows.Err(); err != nil {
+			return nil, fmt.Errorf("error reading unhashed counts: %v", err)
+		}
+	} else {
+		buckets := make([]UnhashedBucket, len(unhashedAgeLabels))
+		for i, label := range unhashedAgeLabels {
+			buckets[i].Label = label
+		}
+
+		rows, err := database.QueryContext(ctx, `
+			SELECT FLOOR(EXTRACT(EPOCH FROM NOW() - created_at) / 86400)::bigint AS age_days,
+				COUNT(*), COALESCE(SUM(size), 0)
+			FROM files `+where+`
+			GROUP BY age_days
+		`, hostname)
+		if err != nil {
+			return nil, fmt.Errorf("error counting unhashed files: %v", err)
+		}
+		defer rows.Close()
+		for rows.Next() {
+			var ageDays sql.NullInt64
+			var files, bytes int64
+			if err := rows.Scan(&ageDays, &files, &bytes); err != nil {
+				return nil, fmt.Errorf("error scanning unhashed counts: %v", err)
+			}
+			i := unhashedAgeBucket(ageDays)
+			buckets[i].Files += files
+			buckets[i].Bytes += bytes
+		}
+		if err := rows.Err(); err != nil {
+			return nil, fmt.Errorf("error reading unhashed counts: %v", err)
+		}
+		report.Buckets = buckets
+	}
+
+	for _, b := range report.Buckets {
+		report.TotalFiles += b.Files
+		report.TotalBytes += b.Bytes
+	}
+
+	rows, err := database.QueryContext(ctx, `
+		SELECT path, COALESCE(root_folder, ''), size, created_at
+		FROM files `+where+`
+		AND size IS NOT NULL
+		ORDER BY size DESC, id
+		LIMIT $2
+	`, hostname, unhashedLargestLimit)
+	if err != nil {
+		return nil, fmt.Errorf("error listing largest unhashed files: %v", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var f UnhashedFile
+		var createdAt sql.NullTime
+		if err := rows.Scan(&f.Path, &f.RootFolder, &f.Size, &createdAt); err != nil {
+			return nil, fmt.Errorf("error scanning unhashed file: %v", err)
+		}
+		f.FriendlyPath = names.Display(f.RootFolder, f.Path)
+		if createdAt.Valid {
+			t := createdAt.Time
+			f.CreatedAt = &t
+		}
+		report.Largest = append(report.Largest, f)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error reading unhashed files: %v", err)
+	}
+
+	return report, nil
+}
+
+// ListUnhashed prints the hashing backlog report as a table or as JSON.
+func ListUnhashed(ctx context.Context, database *sql.DB, opts UnhashedOptions) error {
+	if opts.Output != "" && opts.Output != "text" && opts.Output != "json" {
+		return fmt.Errorf("invalid value for --output: %q (use text or json)", opts.Output)
+	}
+	report, err := UnhashedBacklog(ctx, database, opts)
+	if err != nil {
+		return err
+	}
+
+	if opts.Output == "json" {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(report)
+	}
+
+	header := "Friendly path"
+	if report.By == "age" {
+		header = "Age"
+	}
+	fmt.Printf("Unhashed files for host '%s': %d (%s)\n\n", report.Host, report.TotalFiles, formatBytes(report.TotalBytes))
+	fmt.Printf("%-30s %12s %12s\n", header, "Files", "Size")
+	for _, b := range report.Buckets {
+		fmt.Printf("%-30s %12d %12s\n", b.Label, b.Files, formatBytes(b.Bytes))
+	}
+
+	if len(report.Largest) > 0 {
+		fmt.Printf("\nLargest unhashed files:\n")
+		for _, f := range report.Largest {
+			fmt.Printf("%12s  %s (%s)\n", formatBytes(f.Size), f.FriendlyPath, filepath.Join(f.RootFolder, f.Path))
+		}
+	}
+	return nil
+}
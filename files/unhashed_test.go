@@ -0,0 +1,163 @@
+package files
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+func TestUnhashedAgeBucket(t *testing.T) {
+	cases := []struct {
+		age  sql.NullInt64
+		want string
+	}{
+		{sql.NullInt64{Int64: 0, Valid: true}, "<1d"},
+		{sql.NullInt64{Int64: 1, Valid: true}, "1-7d"},
+		{sql.NullInt64{Int64: 6, Valid: true}, "1-7d"},
+		{sql.NullInt64{Int64: 7, Valid: true}, "7-30d"},
+		{sql.NullInt64{Int64: 29, Valid: true}, "7-30d"},
+		{sql.NullInt64{Int64: 30, Valid: true}, ">30d"},
+		{sql.NullInt64{Int64: 400, Valid: true}, ">30d"},
+		{sql.NullInt64{}, ">30d"},
+	}
+	for _, c := range cases {
+		if got := unhashedAgeLabels[unhashedAgeBucket(c.age)]; got != c.want {
+			t.Errorf("unhashedAgeBucket(%+v) = %s, want %s", c.age, got, c.want)
+		}
+	}
+}
+
+func expectUnhashedHost(mock sqlmock.Sqlmock) {
+	mock.ExpectQuery("SELECT id, name, hostname, ip, root_path, settings, created_at FROM hosts WHERE name = \\$1").
+		WithArgs("Backup1").
+		WillReturnRows(sqlmock.NewRows([]string{"id", "name", "hostname", "ip", "root_path", "settings", "created_at"}).
+			AddRow(1, "Backup1", "Backup1.Local", "1.1.1.1", "/old", []byte(`{"paths":{"photos":"/data/photos"}}`), time.Now()))
+}
+
+func expectUnhashedLargest(mock sqlmock.Sqlmock) {
+	created := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	mock.ExpectQuery("SELECT path, COALESCE\\(root_folder, ''\\), size, created_at\\s+FROM files WHERE hostname = \\$1 AND hash IS NULL AND deleted_at IS NULL AND NOT EXISTS \\(SELECT 1 FROM file_errors.*AND size IS NOT NULL\\s+ORDER BY size DESC, id\\s+LIMIT \\$2").
+		WithArgs("backup1.local", unhashedLargestLimit).
+		WillReturnRows(sqlmock.NewRows([]string{"path", "root_folder", "size", "created_at"}).
+			AddRow("big.iso", "/data/photos", int64(4096), created).
+			AddRow("small.jpg", "", int64(10), nil))
+}
+
+func TestUnhashedBacklogByPath(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("sqlmock: %v", err)
+	}
+	defer db.Close()
+
+	expectUnhashedHost(mock)
+	mock.ExpectQuery("SELECT COALESCE\\(root_folder, ''\\), COUNT\\(\\*\\), COALESCE\\(SUM\\(size\\), 0\\)\\s+FROM files WHERE hostname = \\$1 AND hash IS NULL AND deleted_at IS NULL AND NOT EXISTS \\(SELECT 1 FROM file_errors fe WHERE fe.file_id = files.id\\)\\s+GROUP BY COALESCE\\(root_folder, ''\\)").
+		WithArgs("backup1.local").
+		WillReturnRows(sqlmock.NewRows([]string{"root_folder", "count", "sum"}).
+			AddRow("/data/photos", int64(5), int64(5000)).
+			AddRow("/data/other", int64(2), int64(200)).
+			AddRow("", int64(1), int64(0)))
+	expectUnhashedLargest(mock)
+
+	report, err := UnhashedBacklog(context.Background(), db, UnhashedOptions{Server: "Backup1"})
+	if err != nil {
+		t.Fatalf("UnhashedBacklog: %v", err)
+	}
+	if report.By != "path" || report.TotalFiles != 8 || report.TotalBytes != 5200 {
+		t.Fatalf("unexpected totals: %+v", report)
+	}
+	labels := []string{report.Buckets[0].Label, report.Buckets[1].Label, report.Buckets[2].Label}
+	if labels[0] != "photos" || labels[1] != "(unmapped) /data/other" || labels[2] != "(no root folder)" {
+		t.Fatalf("unexpected bucket labels: %v", labels)
+	}
+	if len(report.Largest) != 2 || report.Largest[0].CreatedAt == nil || report.Largest[1].CreatedAt != nil {
+		t.Fatalf("unexpected largest files: %+v", report.Largest)
+	}
+	if report.Largest[0].FriendlyPath != "photos/big.iso" || report.Largest[0].RootFolder != "/data/photos" {
+		t.Fatalf("expected friendly and absolute forms, got %+v", report.Largest[0])
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatalf("unmet expectations: %v", err)
+	}
+}
+
+func TestUnhashedBacklogByAgeFoldsDaysIntoBuckets(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("sqlmock: %v", err)
+	}
+	defer db.Close()
+
+	expectUnhashedHost(mock)
+	mock.ExpectQuery("SELECT FLOOR\\(EXTRACT\\(EPOCH FROM NOW\\(\\) - created_at\\) / 86400\\)::bigint AS age_days.*FROM files WHERE hostname = \\$1 AND hash IS NULL AND deleted_at IS NULL AND NOT EXISTS .*GROUP BY age_days").
+		WithArgs("backup1.local").
+		WillReturnRows(sqlmock.NewRows([]string{"age_days", "count", "sum"}).
+			AddRow(int64(0), int64(3), int64(30)).
+			AddRow(int64(6), int64(1), int64(60)).
+			AddRow(int64(7), int64(2), int64(70)).
+			AddRow(int64(45), int64(4), int64(400)).
+			AddRow(nil, int64(1), int64(1)))
+	expectUnhashedLargest(mock)
+
+	report, err := UnhashedBacklog(context.Background(), db, UnhashedOptions{Server: "Backup1", By: "age"})
+	if err != nil {
+		t.Fatalf("UnhashedBacklog: %v", err)
+	}
+	want := []UnhashedBucket{
+		{Label: "<1d", Files: 3, Bytes: 30},
+		{Label: "1-7d", Files: 1, Bytes: 60},
+		{Label: "7-30d", Files: 2, Bytes: 70},
+		{Label: ">30d", Files: 5, Bytes: 401},
+	}
+	if len(report.Buckets) != len(want) {
+		t.Fatalf("expected %d buckets, got %+v", len(want), report.Buckets)
+	}
+	for i, b := range want {
+		if report.Buckets[i] != b {
+			t.Errorf("bucket %d = %+v, want %+v", i, report.Buckets[i], b)
+		}
+	}
+	if report.TotalFiles != 11 {
+		t.Fatalf("expected 11 files in total, got %d", report.TotalFiles)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatalf("unmet expectations: %v", err)
+	}
+}
+
+func TestListUnhashedPrintsJSON(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("sqlmock: %v", err)
+	}
+	defer db.Close()
+
+	expectUnhashedHost(mock)
+	mock.ExpectQuery("SELECT FLOOR").
+		WithArgs("backup1.local").
+		WillReturnRows(sqlmock.NewRows([]string{"age_days", "count", "sum"}).AddRow(int64(2), int64(1), int64(10)))
+	expectUnhashedLargest(mock)
+
+	out := captureStdout(t, func() {
+		if err := ListUnhashed(context.Background(), db, UnhashedOptions{Server: "Backup1", By: "age", Output: "json"}); err != nil {
+			t.Fatalf("ListUnhashed: %v", err)
+		}
+	})
+	var report UnhashedReport
+	if err := json.Unmarshal([]byte(out), &report); err != nil {
+		t.Fatalf("output is not JSON: %v\n%s", err, out)
+	}
+	if report.Host != "Backup1" || report.By != "age" || report.Buckets[1].Files != 1 || len(report.Largest) != 2 {
+		t.Fatalf("unexpected report: %+v", report)
+	}
+}
+
+func TestUnhashedBacklogRejectsUnknownBucketing(t *testing.T) {
+	if _, err := UnhashedBacklog(context.Background(), nil, UnhashedOptions{Server: "Backup1", By: "size"}); err == nil {
+		t.Fatal("expected an error for --by size")
+	}
+}
@@ -0,0 +1,323 @@
+package files
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"deduplicator/db"
+
+	"github.com/lib/pq"
+)
+
+// UniquePath is the number and total size of a host's unique files under one
+// friendly path.
+type UniquePath struct {
+	FriendlyPath string `json:"friendly_path"`
+	Files        int64  `json:"files"`
+	Bytes        int64  `json:"bytes"`
+}
+
+// UniqueFile is one file whose content no comparison host holds.
+type UniqueFile struct {
+	Path         string `json:"path"`
+	RootFolder   string `json:"root_folder"`
+	FriendlyPath string `json:"friendly_path"`
+	Size         int64  `json:"size"`
+	Hash         string `json:"hash"`
+}
+
+// UniqueReport summarizes the content that exists only on one host.
+type UniqueReport struct {
+	Host       string       `json:"host"`
+	Against    []string     `json:"against"` // comparison hosts; every other host with --all
+	TotalFiles int64        `json:"total_files"`
+	TotalBytes int64        `json:"total_bytes"`
+	Paths      []UniquePath `json:"paths"`
+	Files      []UniqueFile `json:"files,omitempty"` // only with --list
+}
+
+// uniqueFilesQuery selects the hashed files of host $1 of at least $2 bytes
+// whose content is on none of the comparison hosts: every other host when
+// all is set, otherwise the hostnames in $3. Content matches on hash and size,
+// so a partial-hash collision never makes a file look safe to drop.
+func uniqueFilesQuery(all bool) string {
+	comparison := `AND o.hostname = ANY($3)`
+	if all {
+		comparison = `AND o.hostname <> $1`
+	}
+	return `
+		SELECT f.path, COALESCE(f.root_folder, ''), COALESCE(f.size, 0), f.hash
+		FROM files f
+		WHERE f.hostname = $1
+		AND f.hash IS NOT NULL
+		AND ` + NotDeletedAs("f") + `
+		AND COALESCE(f.size, 0) >= $2
+		AND NOT EXISTS (
+			SELECT 1 FROM files o
+			WHERE o.hash = f.hash
+			AND o.size = f.size
+			AND o.hash_algo = f.hash_algo
+			AND ` + NotDeletedAs("o") + `
+			` + comparison + `
+		)
+		ORDER BY COALESCE(f.root_folder, ''), f.path
+	`
+}
+
+// uniqueBucketLabel names the friendly path a root folder belongs to.
+func uniqueBucketLabel(names *PathNames, rootFolder string) string {
+	if rootFolder == "" {
+		return "(no root folder)"
+	}
+	return names.Name(rootFolder)
+}
+
+// addUniqueFile counts f in its friendly path's bucket of report; index maps
+// a label to its position in report.Paths.
+func addUniqueFile(report *UniqueReport, index map[string]int, label string, f UniqueFile) {
+	i, ok := index[label]
+	if !ok {
+		i = len(report.Paths)
+		index[label] = i
+		report.Paths = append(report.Paths, UniquePath{FriendlyPath: label})
+	}
+	report.Paths[i].Files++
+	report.Paths[i].Bytes += f.Size
+	report.TotalFiles++
+	report.TotalBytes += f.Size
+}
+
+// UniqueContent reports the files of opts.Server whose content is on none of
+// the comparison hosts, by friendly path. Each file is also passed to emit,
+// when set, as it is read.
+func UniqueContent(ctx context.Context, database *sql.DB, opts UniqueOptions, emit func(UniqueFile)) (*UniqueReport, error) {
+	host, err := db.GetHost(database, opts.Server)
+	if err != nil {
+		return nil, fmt.Errorf("server not found: %s", opts.Server)
+	}
+	names, err := NewPathNames(host)
+	if err != nil {
+		return nil, err
+	}
+
+	report := &UniqueReport{Host: host.Name, Against: []string{}, Paths: []UniquePath{}}
+	args := []interface{}{normalizeHostname(host.Hostname), opts.MinSize}
+	all := len(opts.Against) == 0
+	if all {
+		hosts, err := db.ListHosts(database)
+		if err != nil {
+			return nil, fmt.Errorf("error listing hosts: %v", err)
+		}
+		for _, h := range hosts {
+			if h.Name != host.Name {
+				report.Against = append(report.Against, h.Name)
+			}
+		}
+	} else {
+		var hostnames []string
+		for _, name := range opts.Against {
+			other, err := db.GetHost(database, name)
+			if err != nil {
+				return nil, fmt.Errorf("server not found: %s", name)
+			}
+			if other.Name == host.Name {
+				return nil, fmt.Errorf("cannot compare %s against itself", host.Name)
+			}
+			report.Against = append(report.Against, other.Name)
+			hostnames = append(hostnames, normalizeHostname(other.Hostname))
+		}
+		args = append(args, pq.Array(hostnames))
+	}
+
+	rows, err := database.QueryContext(ctx, uniqueFilesQuery(all), args...)
+	if err != nil {
+		return nil, fmt.Errorf("error finding unique files: %v", err)
+	}
+	defer rows.Close()
+
+	index := make(map[string]int)
+	for rows.Next() {
+		var f UniqueFile
+		if err := rows.Scan(&f.Path, &f.RootFolder, &f.Size, &f.Hash); err != nil {
+			return nil, fmt.Errorf("error scanning unique file: %v", err)
+		}
+		f.FriendlyPath = names.Display(f.RootFolder, f.Path)
+		addUniqueFile(report, index, uniqueBucketLabel(names, f.RootFolder), f)
+		if emit != nil {
+			emit(f)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error reading unique files: %v", err)
+	}
+	return report, nil
+}
+
+// ListUnique prints the content only opts.Server holds, as a table or as
+// JSON, and with opts.CopyTo copies it to that host with the mirror transfers.
+func ListUnique(ctx context.Context, database *sql.DB, opts UniqueOptions) error {
+	if opts.Output != "" && opts.Output != "text" && opts.Output != "json" {
+		return fmt.Errorf("invalid value for --output: %q (use text or json)", opts.Output)
+	}
+	text := opts.Output != "json"
+	if opts.CopyTo != "" && !text {
+		return fmt.Errorf("--copy-to reports its transfers as text and cannot be combined with --output json")
+	}
+
+	var copier *uniqueCopier
+	if opts.CopyTo != "" {
+		var err error
+		if copier, err = newUniqueCopier(database, opts.Server, opts.CopyTo); err != nil {
+			return err
+		}
+	}
+
+	var listed []UniqueFile
+	report, err := UniqueContent(ctx, database, opts, func(f UniqueFile) {
+		if opts.List {
+			if text {
+				fmt.Printf("%12s  %s (%s)\n", formatBytes(f.Size), f.FriendlyPath, filepath.Join(f.RootFolder, f.Path))
+			} else {
+				listed = append(listed, f)
+			}
+		}
+		copier.plan(f)
+	})
+	if err != nil {
+		return err
+	}
+
+	if !text {
+		report.Files = listed
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(report); err != nil {
+			return err
+		}
+	} else {
+		if opts.List && report.TotalFiles > 0 {
+			fmt.Println()
+		}
+		fmt.Printf("Files only on host '%s' (compared with %s): %d (%s)\n\n",
+			report.Host, strings.Join(report.Against, ", "), report.TotalFiles, formatBytes(report.TotalBytes))
+		fmt.Printf("%-30s %12s %12s\n", "Friendly path", "Files", "Size")
+		for _, p := range report.Paths {
+			fmt.Printf("%-30s %12d %12s\n", p.FriendlyPath, p.Files, formatBytes(p.Bytes))
+		}
+	}
+
+	return copier.run(ctx, opts.DryRun)
+}
+
+// uniqueCopier copies unique files to a host under the same friendly path,
+// one mirror task per file.
+type uniqueCopier struct {
+	src     *db.Host
+	dst     *db.Host
+	names   *PathNames
+	srcRoot map[string]string // friendly path -> root on the source
+	dstRoot map[string]string // friendly path -> root on the destination
+	tasks   []mirrorTask
+	skipped map[string]int // friendly path (or reason) -> files left behind
+}
+
+func newUniqueCopier(database *sql.DB, server, copyTo string) (*uniqueCopier, error) {
+	src, err := db.GetHost(database, server)
+	if err != nil {
+		return nil, fmt.Errorf("server not found: %s", server)
+	}
+	dst, err := db.GetHost(database, copyTo)
+	if err != nil {
+		return nil, fmt.Errorf("server not found: %s", copyTo)
+	}
+	if dst.Name == src.Name {
+		return nil, fmt.Errorf("--copy-to must name another host than %s", src.Name)
+	}
+	names, err := NewPathNames(src)
+	if err != nil {
+		return nil, err
+	}
+	srcRoot, err := src.GetPaths()
+	if err != nil {
+		return nil, fmt.Errorf("error getting path mappings for host %s: %v", src.Name, err)
+	}
+	dstRoot, err := dst.GetPaths()
+	if err != nil {
+		return nil, fmt.Errorf("error getting path mappings for host %s: %v", dst.Name, err)
+	}
+	return &uniqueCopier{src: src, dst: dst, names: names, srcRoot: srcRoot, dstRoot: dstRoot, skipped: make(map[string]int)}, nil
+}
+
+// plan queues f for copying, or counts it as skipped when it is outside
+// every friendly path or the destination lacks its friendly path.
+func (c *uniqueCopier) plan(f UniqueFile) {
+	if c == nil {
+		return
+	}
+	name, rest, ok := c.names.Resolve(f.RootFolder)
+	if !ok {
+		c.skipped[UnmappedPath]++
+		return
+	}
+	dstRoot, ok := c.dstRoot[name]
+	if !ok {
+		c.skipped[name]++
+		return
+	}
+	c.tasks = append(c.tasks, mirrorTask{
+		relPath: filepath.ToSlash(filepath.Join(rest, f.Path)),
+		srcHost: hostPath{Name: c.src.Name, Hostname: c.src.Hostname, RootPath: c.src.RootPath, AbsPath: c.srcRoot[name]},
+		dstHost: hostPath{Name: c.dst.Name, Hostname: c.dst.Hostname, RootPath: c.dst.RootPath, AbsPath: dstRoot},
+		hashVal: f.Hash,
+	})
+}
+
+// run performs (or with dryRun, lists) the queued copies.
+func (c *uniqueCopier) run(ctx context.Context, dryRun bool) error {
+	if c == nil {
+		return nil
+	}
+	fmt.Printf("\nCopying %d files to host '%s'\n", len(c.tasks), c.dst.Name)
+	skipped := make([]string, 0, len(c.skipped))
+	for name := range c.skipped {
+		skipped = append(skipped, name)
+	}
+	sort.Strings(skipped)
+	for _, name := range skipped {
+		if name == UnmappedPath {
+			fmt.Printf("Skipping %d files outside every friendly path\n", c.skipped[name])
+		} else {
+			fmt.Printf("Skipping %d files: host '%s' has no friendly path '%s'\n", c.skipped[name], c.dst.Name, name)
+		}
+	}
+
+	localHost, _ := os.Hostname()
+	copied, failed := 0, 0
+	for _, task := range c.tasks {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if dryRun {
+			fmt.Printf("Would copy %s -> %s: %s\n", task.srcHost.Name, task.dstHost.Name, task.relPath)
+			continue
+		}
+		line, conflict := runMirrorTask(ctx, localHost, task, DefaultTransferRetries)
+		if conflict != nil {
+			failed++
+			fmt.Printf("Not copied %s: %s\n", conflict.RelPath, conflict.Reason)
+			continue
+		}
+		copied++
+		fmt.Printf("Copied %s\n", line)
+	}
+	if !dryRun {
+		fmt.Printf("Copied %d files, %d failed\n", copied, failed)
+	}
+	return nil
+}
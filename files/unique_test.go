@@ -0,0 +1,178 @@
+package files
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+var uniqueHostColumns = []string{"id", "name", "hostname", "ip", "root_path", "settings", "created_at"}
+
+func expectUniqueHost(mock sqlmock.Sqlmock, name, hostname, settings string) {
+	mock.ExpectQuery("SELECT id, name, hostname, ip, root_path, settings, created_at FROM hosts WHERE name = \\$1").
+		WithArgs(name).
+		WillReturnRows(sqlmock.NewRows(uniqueHostColumns).
+			AddRow(1, name, hostname, "10.0.0.1", "/", []byte(settings), time.Now()))
+}
+
+func TestUniqueFilesQueryComparesWithChosenHosts(t *testing.T) {
+	against := uniqueFilesQuery(false)
+	if !strings.Contains(against, "o.hostname = ANY($3)") || strings.Contains(against, "o.hostname <> $1") {
+		t.Fatalf("--against query does not restrict the comparison to $3:\n%s", against)
+	}
+	all := uniqueFilesQuery(true)
+	if !strings.Contains(all, "o.hostname <> $1") || strings.Contains(all, "$3") {
+		t.Fatalf("--all query does not compare with every other host:\n%s", all)
+	}
+	for _, q := range []string{against, all} {
+		for _, want := range []string{"NOT EXISTS", "o.hash = f.hash", "o.size = f.size", "o.deleted_at IS NULL", "f.deleted_at IS NULL", "f.hash IS NOT NULL"} {
+			if !strings.Contains(q, want) {
+				t.Errorf("query is missing %q:\n%s", want, q)
+			}
+		}
+	}
+}
+
+func TestUniqueContentGroupsByFriendlyPath(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("sqlmock: %v", err)
+	}
+	defer db.Close()
+
+	// Three hosts: Backup1 is reported on, Backup2 and nas are compared with.
+	expectUniqueHost(mock, "Backup1", "Backup1.Local", `{"paths":{"photos":"/data/photos","raw":"/data/photos/raw"}}`)
+	expectUniqueHost(mock, "Backup2", "backup2.local", `{}`)
+	expectUniqueHost(mock, "nas", "NAS.local", `{}`)
+	mock.ExpectQuery("SELECT f.path, COALESCE\\(f.root_folder, ''\\), COALESCE\\(f.size, 0\\), f.hash\\s+FROM files f\\s+WHERE f.hostname = \\$1.*AND NOT EXISTS \\(\\s+SELECT 1 FROM files o\\s+WHERE o.hash = f.hash\\s+AND o.size = f.size.*AND o.hostname = ANY\\(\\$3\\)").
+		WithArgs("backup1.local", int64(1024), `{"backup2.local","nas.local"}`).
+		WillReturnRows(sqlmock.NewRows([]string{"path", "root_folder", "size", "hash"}).
+			AddRow("/legacy/e.txt", "", int64(0), "h5").
+			AddRow("a.jpg", "/data/photos/2021", int64(2000), "h1").
+			AddRow("b.jpg", "/data/photos", int64(3000), "h2").
+			AddRow("c.cr2", "/data/photos/raw", int64(9000), "h3").
+			AddRow("d.bin", "/srv/other", int64(4000), "h4"))
+
+	var emitted []UniqueFile
+	report, err := UniqueContent(context.Background(), db, UniqueOptions{Server: "Backup1", Against: []string{"Backup2", "nas"}, MinSize: 1024},
+		func(f UniqueFile) { emitted = append(emitted, f) })
+	if err != nil {
+		t.Fatalf("UniqueContent: %v", err)
+	}
+
+	if report.Host != "Backup1" || strings.Join(report.Against, ",") != "Backup2,nas" {
+		t.Fatalf("unexpected hosts: %+v", report)
+	}
+	want := []UniquePath{
+		{FriendlyPath: "(no root folder)", Files: 1, Bytes: 0},
+		{FriendlyPath: "photos", Files: 2, Bytes: 5000},
+		{FriendlyPath: "raw", Files: 1, Bytes: 9000},
+		{FriendlyPath: UnmappedPath, Files: 1, Bytes: 4000},
+	}
+	if len(report.Paths) != len(want) {
+		t.Fatalf("expected %d paths, got %+v", len(want), report.Paths)
+	}
+	for i, p := range want {
+		if report.Paths[i] != p {
+			t.Errorf("path %d = %+v, want %+v", i, report.Paths[i], p)
+		}
+	}
+	if report.TotalFiles != 5 || report.TotalBytes != 18000 {
+		t.Fatalf("unexpected totals: %d files, %d bytes", report.TotalFiles, report.TotalBytes)
+	}
+	if len(emitted) != 5 || emitted[1].FriendlyPath != "photos/2021/a.jpg" || emitted[3].FriendlyPath != "raw/c.cr2" {
+		t.Fatalf("unexpected emitted files: %+v", emitted)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatalf("unmet expectations: %v", err)
+	}
+}
+
+func TestUniqueContentAllComparesWithEveryOtherHost(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("sqlmock: %v", err)
+	}
+	defer db.Close()
+
+	expectUniqueHost(mock, "Backup1", "backup1.local", `{"paths":{"photos":"/data/photos"}}`)
+	mock.ExpectQuery("SELECT id, name, hostname, ip, root_path, settings, created_at\\s+FROM hosts ORDER BY name").
+		WillReturnRows(sqlmock.NewRows(uniqueHostColumns).
+			AddRow(1, "Backup1", "backup1.local", "", "/", []byte(`{}`), time.Now()).
+			AddRow(2, "Backup2", "backup2.local", "", "/", []byte(`{}`), time.Now()).
+			AddRow(3, "nas", "nas.local", "", "/", []byte(`{}`), time.Now()))
+	mock.ExpectQuery("AND o.hostname <> \\$1").
+		WithArgs("backup1.local", int64(0)).
+		WillReturnRows(sqlmock.NewRows([]string{"path", "root_folder", "size", "hash"}).
+			AddRow("a.jpg", "/data/photos", int64(10), "h1"))
+
+	out := captureStdout(t, func() {
+		if err := ListUnique(context.Background(), db, UniqueOptions{Server: "Backup1", Output: "json", List: true}); err != nil {
+			t.Fatalf("ListUnique: %v", err)
+		}
+	})
+	var report UniqueReport
+	if err := json.Unmarshal([]byte(out), &report); err != nil {
+		t.Fatalf("output is not JSON: %v\n%s", err, out)
+	}
+	if strings.Join(report.Against, ",") != "Backup2,nas" || report.TotalFiles != 1 || len(report.Files) != 1 || report.Files[0].FriendlyPath != "photos/a.jpg" {
+		t.Fatalf("unexpected report: %+v", report)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatalf("unmet expectations: %v", err)
+	}
+}
+
+func TestUniqueCopierPlansByFriendlyPath(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("sqlmock: %v", err)
+	}
+	defer db.Close()
+
+	expectUniqueHost(mock, "Backup1", "backup1.local", `{"paths":{"photos":"/data/photos","raw":"/data/photos/raw"}}`)
+	expectUniqueHost(mock, "nas", "nas.local", `{"paths":{"photos":"/volume1/photos"}}`)
+	copier, err := newUniqueCopier(db, "Backup1", "nas")
+	if err != nil {
+		t.Fatalf("newUniqueCopier: %v", err)
+	}
+
+	copier.plan(UniqueFile{Path: "a.jpg", RootFolder: "/data/photos/2021", Hash: "h1"})
+	copier.plan(UniqueFile{Path: "c.cr2", RootFolder: "/data/photos/raw", Hash: "h3"})
+	copier.plan(UniqueFile{Path: "d.bin", RootFolder: "/srv/other", Hash: "h4"})
+
+	if len(copier.tasks) != 1 {
+		t.Fatalf("expected one task, got %+v", copier.tasks)
+	}
+	task := copier.tasks[0]
+	if task.relPath != "2021/a.jpg" || task.srcHost.AbsPath != "/data/photos" || task.dstHost.AbsPath != "/volume1/photos" || task.hashVal != "h1" {
+		t.Fatalf("unexpected task: %+v", task)
+	}
+	if copier.skipped["raw"] != 1 || copier.skipped[UnmappedPath] != 1 {
+		t.Fatalf("unexpected skipped counts: %v", copier.skipped)
+	}
+
+	out := captureStdout(t, func() {
+		if err := copier.run(context.Background(), true); err != nil {
+			t.Fatalf("run: %v", err)
+		}
+	})
+	for _, want := range []string{"Copying 1 files to host 'nas'", "Skipping 1 files outside every friendly path", "host 'nas' has no friendly path 'raw'", "Would copy Backup1 -> nas: 2021/a.jpg"} {
+		if !strings.Contains(out, want) {
+			t.Errorf("output does not mention %q:\n%s", want, out)
+		}
+	}
+}
+
+func TestListUniqueRejectsCopyWithJSON(t *testing.T) {
+	if err := ListUnique(context.Background(), nil, UniqueOptions{Server: "Backup1", Output: "json", CopyTo: "nas"}); err == nil {
+		t.Fatal("expected --copy-to with --output json to be rejected")
+	}
+	if err := ListUnique(context.Background(), nil, UniqueOptions{Server: "Backup1", Output: "csv"}); err == nil {
+		t.Fatal("expected an error for --output csv")
+	}
+}
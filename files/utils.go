@@ -11,6 +11,8 @@ import (
 	"strconv"
 	"strings"
 	"time"
+
+	"deduplicator/db"
 )
 
 // getRowLimitClause returns a LIMIT clause for SELECT queries if ENVIRONMENT=local
@@ -26,17 +28,222 @@ func getRowLimitClause() string {
 	return ""
 }
 
+// normalizeHostname returns the canonical form of a hostname as stored in
+// files.hostname. Queries compare hostnames with plain equality so the
+// hostname indexes stay usable, which only works if every write and lookup
+// agrees on this form.
+func normalizeHostname(hostname string) string {
+	return db.NormalizeHostname(hostname)
+}
+
+// UnknownHostError is returned when no hosts row matches hostname, and names
+// the command that registers one.
+func UnknownHostError(hostname string) error {
+	return fmt.Errorf("no host found for hostname %s, please add it using 'deduplicator manage server-add %s --hostname %s'", hostname, hostname, hostname)
+}
+
+// NotDeleted is the predicate that hides soft-deleted files rows. Prune,
+// dedupe and move set deleted_at instead of deleting, so every read of the
+// files table must include it (see NotDeletedAs for an aliased table).
+const NotDeleted = "deleted_at IS NULL"
+
+// NotDeletedAs qualifies NotDeleted with a table alias.
+func NotDeletedAs(alias string) string {
+	return alias + "." + NotDeleted
+}
+
+// NotHardLinkedAs leaves out a row of the files table aliased alias that is a
+// hard link of another live row: both name the same (device, inode) on one
+// host, so they hold the space once, and only the link with the first path
+// counts as a copy. Rows without an inode (indexed by files update, or on a
+// platform without inodes) always count.
+func NotHardLinkedAs(alias string) string {
+	return `NOT EXISTS (SELECT 1 FROM files hl WHERE hl.hostname = ` + alias + `.hostname
+		AND hl.device = ` + alias + `.device AND hl.inode = ` + alias + `.inode
+		AND hl.hash = ` + alias + `.hash AND hl.path < ` + alias + `.path AND ` + NotDeletedAs("hl") + `)`
+}
+
+// WellFormedHash matches a complete hash: exactly 64 lowercase hex digits.
+// Duplicate queries require it so truncated legacy hashes are never grouped,
+// and doctor reports the rows that fail it (see WellFormedHashAs).
+const WellFormedHash = "hash ~ '^[0-9a-f]{64}$'"
+
+// WellFormedHashAs returns WellFormedHash for the table alias.
+func WellFormedHashAs(alias string) string {
+	return alias + "." + WellFormedHash
+}
+
 // DuplicateGroup represents a group of duplicate files
 type DuplicateGroup struct {
-	Hash      string
-	Size      int64
-	Files     []string
-	Hosts     []string
-	TotalSize int64
+	Hash  string
+	Size  int64
+	Files []string
+	Hosts []string
+	// RootFolders holds the root_folder of each file ("" for legacy rows).
+	RootFolders []string
+	TotalSize   int64
+	// KnownExternal is set when the content is already held by an external
+	// backup (files import-hashes); only filled in by list-dupes --show-external.
+	KnownExternal bool
+}
+
+// DuplicateSizeRules leave small files out of duplicate detection, so that
+// empty lock files and tiny placeholders, which all share a hash, do not drown
+// out the real duplicates.
+type DuplicateSizeRules struct {
+	MinSize     int64 // leave out files smaller than this (0 = no minimum)
+	IgnoreEmpty bool  // leave out empty files even without a minimum
+}
+
+// active reports whether the rules leave any file out.
+func (r DuplicateSizeRules) active() bool {
+	return r.MinSize > 0 || r.IgnoreEmpty
+}
+
+// predicate returns the condition on column that keeps the files the rules
+// allow, appending its argument to args ("" when no rule applies).
+func (r DuplicateSizeRules) predicate(column string, argCount *int, args *[]interface{}) string {
+	if r.MinSize > 0 {
+		*argCount++
+		*args = append(*args, r.MinSize)
+		return fmt.Sprintf("%s >= $%d", column, *argCount)
+	}
+	if r.IgnoreEmpty {
+		return column + " > 0"
+	}
+	return ""
+}
+
+// DuplicateSort is the order of duplicate groups in a listing (--sort). The
+// zero value is SortBySize.
+type DuplicateSort string
+
+const (
+	SortBySize    DuplicateSort = "size"    // largest total size first
+	SortByCount   DuplicateSort = "count"   // most copies first
+	SortByPath    DuplicateSort = "path"    // alphabetically by first file
+	SortBySavings DuplicateSort = "savings" // most space freed by deduplication first
+)
+
+// ParseDuplicateSort parses the value of --sort ("" is SortBySize).
+func ParseDuplicateSort(value string) (DuplicateSort, error) {
+	switch sort := DuplicateSort(value); sort {
+	case "":
+		return SortBySize, nil
+	case SortBySize, SortByCount, SortByPath, SortBySavings:
+		return sort, nil
+	}
+	return "", fmt.Errorf("invalid value for --sort: %q (use size, count, path or savings)", value)
 }
 
-// FindDuplicateGroups finds groups of duplicate files based on the provided options
-func FindDuplicateGroups(ctx context.Context, db *sql.DB, hostname string, minSize int64, count int) ([]DuplicateGroup, error) {
+// orderBy returns the ORDER BY keys of the duplicate groups, on columns of
+// the duplicates CTE qualified with prefix. Ties are broken by hash and size,
+// which also keeps the rows of each group adjacent.
+func (s DuplicateSort) orderBy(prefix string) string {
+	keys := prefix + "total_size DESC"
+	switch s {
+	case SortByCount:
+		keys = prefix + "count DESC, " + keys
+	case SortByPath:
+		keys = prefix + "first_path"
+	case SortBySavings:
+		keys = prefix + "total_size - " + prefix + "size DESC"
+	}
+	return keys + ", " + prefix + "hash, " + prefix + "size"
+}
+
+// fileOrder returns the order of the files within a group: by path when
+// groups are sorted by path, so the first file shown is the one sorted on.
+func (s DuplicateSort) fileOrder() string {
+	if s == SortByPath {
+		return "f.path, f.hostname"
+	}
+	return "f.hostname, f.path"
+}
+
+// sizeRules returns the size rules of a listing.
+func (o DuplicateListOptions) sizeRules() DuplicateSizeRules {
+	return DuplicateSizeRules{MinSize: o.MinSize, IgnoreEmpty: o.IgnoreEmpty}
+}
+
+// sizeRules returns the size rules of a dedupe run.
+func (o DedupeOptions) sizeRules() DuplicateSizeRules {
+	return DuplicateSizeRules{MinSize: o.MinSize, IgnoreEmpty: o.IgnoreEmpty}
+}
+
+// countSizeFilteredGroups counts the duplicate groups the size rules leave
+// out, within the files of hostname under rootFolder when they are set, so the
+// summary tells how many were not considered. Without rules it is 0.
+func countSizeFilteredGroups(ctx context.Context, db *sql.DB, hostname, rootFolder string, sizes DuplicateSizeRules) (int64, error) {
+	if !sizes.active() {
+		return 0, nil
+	}
+	var args []interface{}
+	argCount := 0
+	query := `
+		SELECT COUNT(*) FROM (
+			SELECT 1
+			FROM files
+			WHERE hash IS NOT NULL
+			AND ` + WellFormedHash + `
+			AND size IS NOT NULL
+			AND ` + NotDeleted + `
+			AND ` + NotHardLinkedAs("files") + `
+	`
+	if strings.TrimSpace(hostname) != "" {
+		argCount++
+		args = append(args, normalizeHostname(hostname))
+		query += fmt.Sprintf(" AND hostname = $%d", argCount)
+	}
+	if rootFolder != "" {
+		argCount++
+		args = append(args, rootFolder)
+		query += fmt.Sprintf(" AND root_folder = $%d", argCount)
+	}
+	query += " AND NOT (" + sizes.predicate("size", &argCount, &args) + `)
+			GROUP BY hash, size, hash_algo
+			HAVING COUNT(*) > 1
+		) filtered
+	`
+	var n int64
+	if err := db.QueryRowContext(ctx, query, args...).Scan(&n); err != nil {
+		return 0, fmt.Errorf("error counting groups left out by the size rules: %v", err)
+	}
+	return n, nil
+}
+
+// printSizeFiltered adds the groups the size rules left out to a summary.
+func printSizeFiltered(n int64) {
+	if n > 0 {
+		fmt.Printf("%d duplicate groups filtered out by the size rules (--min-size/--ignore-empty)\n", n)
+	}
+}
+
+// FindDuplicateGroups finds groups of duplicate files based on the provided
+// options, leaving out the files exclude matches and those sizes rules out,
+// in the order of sort. With rootFolder, only the files of hostname under
+// that root folder are considered.
+func FindDuplicateGroups(ctx context.Context, db *sql.DB, hostname, rootFolder string, sizes DuplicateSizeRules, sort DuplicateSort, count int, exclude PathExcludes) ([]DuplicateGroup, error) {
+	cursor, err := openDuplicateGroups(ctx, db, hostname, rootFolder, sizes, sort, count, exclude)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close()
+
+	var groups []DuplicateGroup
+	for cursor.Next() {
+		groups = append(groups, cursor.Group())
+	}
+	if err := cursor.Err(); err != nil {
+		return nil, err
+	}
+	return groups, nil
+}
+
+// openDuplicateGroups runs the duplicate query of FindDuplicateGroups and
+// returns a cursor over its groups, in the order of sort (largest first by
+// default), so callers can act on each group without loading the rest.
+func openDuplicateGroups(ctx context.Context, db *sql.DB, hostname, rootFolder string, sizes DuplicateSizeRules, sort DuplicateSort, count int, exclude PathExcludes) (*duplicateGroupCursor, error) {
 	scopedToHost := strings.TrimSpace(hostname) != ""
 	var args []interface{}
 	argCount := 0
@@ -52,59 +259,76 @@ func FindDuplicateGroups(ctx context.Context, db *sql.DB, hostname string, minSi
 		`, hostname).Scan(&hostName)
 		if err != nil {
 			if err == sql.ErrNoRows {
-				return nil, fmt.Errorf("no host found for hostname %s, please add it using 'dedupe manage add'", hostname)
+				return nil, UnknownHostError(hostname)
 			}
 			return nil, fmt.Errorf("error finding host: %v", err)
 		}
 		log.Printf("Found host: %s", hostName)
 
 		argCount++
-		args = append(args, hostName)
-		hostFilter = fmt.Sprintf(" AND LOWER(hostname) = LOWER($%d)", argCount)
+		args = append(args, normalizeHostname(hostName))
+		hostFilter = fmt.Sprintf(" AND hostname = $%d", argCount)
 	}
 
 	// Build query based on options
 	query := `
 		WITH duplicates AS (
-			SELECT hash, size, COUNT(*) as count, SUM(size) as total_size
+			SELECT hash, size, hash_algo, COUNT(*) as count, SUM(size) as total_size, MIN(path) as first_path
 			FROM files
 			WHERE hash IS NOT NULL
-			AND hash NOT IN ('TIMEOUT_ERROR', 'HASH_ERROR')
+			AND ` + WellFormedHash + `
 			AND size IS NOT NULL
+			AND ` + NotDeleted + `
+			AND ` + NotHardLinkedAs("files") + `
 	`
 	query += hostFilter
 
-	if minSize > 0 {
+	rootFilter := ""
+	if rootFolder != "" {
 		argCount++
-		query += fmt.Sprintf(" AND size >= $%d", argCount)
-		args = append(args, minSize)
+		args = append(args, rootFolder)
+		rootFilter = fmt.Sprintf("root_folder = $%d", argCount)
+		query += " AND " + rootFilter
+	}
+
+	if sizeFilter := sizes.predicate("size", &argCount, &args); sizeFilter != "" {
+		query += " AND " + sizeFilter
 	}
 
 	query += `
-			GROUP BY hash, size
+			GROUP BY hash, size, hash_algo
 			HAVING COUNT(*) > 1
 	`
 
-	// If count is specified, limit the number of duplicate groups
-	if count > 0 {
+	// If count is specified, limit the number of duplicate groups. Groups
+	// that exclude drops must not count, so then the cursor limits them.
+	if count > 0 && len(exclude) == 0 {
 		argCount++
-		query += fmt.Sprintf(" ORDER BY total_size DESC, hash, size LIMIT $%d", argCount)
+		query += fmt.Sprintf(" ORDER BY %s LIMIT $%d", sort.orderBy(""), argCount)
 		args = append(args, count)
 	} else {
-		query += ` ORDER BY total_size DESC, hash, size`
+		query += " ORDER BY " + sort.orderBy("")
 	}
 
 	query += `
 		)
-		SELECT f.hash, f.path, f.hostname, f.size
+		SELECT f.hash, f.path, f.hostname, f.size, COALESCE(f.root_folder, '') AS root_folder
 		FROM duplicates d
-		JOIN files f ON f.hash = d.hash AND f.size = d.size
+		JOIN files f ON f.hash = d.hash AND f.size = d.size AND ` + NotDeletedAs("f") + ` AND f.hash_algo = d.hash_algo
+			AND ` + NotHardLinkedAs("f") + `
 	`
+	var outerFilters []string
 	if scopedToHost {
-		query += " WHERE LOWER(f.hostname) = LOWER($1)"
+		outerFilters = append(outerFilters, "f.hostname = $1")
+	}
+	if rootFilter != "" {
+		outerFilters = append(outerFilters, "f."+rootFilter)
+	}
+	if len(outerFilters) > 0 {
+		query += " WHERE " + strings.Join(outerFilters, " AND ")
 	}
 	query += `
-		ORDER BY d.total_size DESC, d.hash, d.size, f.hostname, f.path
+		ORDER BY ` + sort.orderBy("d.") + ", " + sort.fileOrder() + `
 	`
 
 	// Query duplicate groups
@@ -112,54 +336,18 @@ func FindDuplicateGroups(ctx context.Context, db *sql.DB, hostname string, minSi
 	if err != nil {
 		return nil, fmt.Errorf("error querying duplicates: %v", err)
 	}
-	defer rows.Close()
-
-	// Process results
-	var currentHash string
-	var currentSize int64
-	var currentGroup DuplicateGroup
-	var groups []DuplicateGroup
-
-	for rows.Next() {
-		var hash, path, hostname string
-		var size int64
-
-		if err := rows.Scan(&hash, &path, &hostname, &size); err != nil {
-			return nil, fmt.Errorf("error scanning row: %v", err)
-		}
-
-		if hash != currentHash || size != currentSize {
-			if currentHash != "" {
-				groups = append(groups, currentGroup)
-			}
-			currentHash = hash
-			currentSize = size
-			currentGroup = DuplicateGroup{
-				Hash:  hash,
-				Size:  size,
-				Files: make([]string, 0),
-				Hosts: make([]string, 0),
-			}
-		}
-		currentGroup.Files = append(currentGroup.Files, path)
-		currentGroup.Hosts = append(currentGroup.Hosts, hostname)
-		currentGroup.TotalSize += size
-	}
-
-	// Add the last group
-	if currentHash != "" {
-		groups = append(groups, currentGroup)
+	cursor := &duplicateGroupCursor{rows: rows}
+	cursor.acc.exclude = exclude
+	if len(exclude) > 0 {
+		cursor.acc.limit = count
 	}
-
-	if err := rows.Err(); err != nil {
-		return nil, fmt.Errorf("error iterating rows: %v", err)
-	}
-
-	return groups, nil
+	return cursor, nil
 }
 
-// PrintDuplicateGroups prints the duplicate groups in a formatted way
-func PrintDuplicateGroups(groups []DuplicateGroup) int64 {
+// PrintDuplicateGroups prints the duplicate groups in a formatted way. Files
+// are shown under their friendly path names when names is set, and with the
+// other files in their directory when siblings is set.
+func PrintDuplicateGroups(groups []DuplicateGroup, names *PathNameCache, siblings *SiblingCache) int64 {
 	if len(groups) == 0 {
 		fmt.Println("No duplicate files found.")
 		return 0
@@ -172,11 +360,15 @@ func PrintDuplicateGroups(groups []DuplicateGroup) int64 {
 		fmt.Printf("\033[33mHash: %s\033[0m\n", group.Hash)
 		fmt.Printf("Size: %s bytes\n", formatBytes(group.Size))
 		fmt.Printf("Duplicates: %d files\n", len(group.Files))
+		if group.KnownExternal {
+			fmt.Println("Backed up externally: yes")
+		}
 		fmt.Println("Files:")
-		for i, file := range group.Files {
-			fmt.Printf("\033[90m  %s (%s)\033[0m\n",
-				file,
-				group.Hosts[i])
+		for i := range group.Files {
+			fmt.Printf("\033[90m  %s\033[0m\n", group.label(i, names))
+			if siblings != nil {
+				fmt.Printf("\033[90m      %s\033[0m\n", siblings.describe(group.Hosts[i], group.rootFolder(i), group.Files[i]))
+			}
 		}
 		savings := group.Size * int64(len(group.Files)-1)
 		fmt.Printf("Potential savings: %s bytes\n", formatBytes(savings))
@@ -188,6 +380,19 @@ func PrintDuplicateGroups(groups []DuplicateGroup) int64 {
 	return totalSavings
 }
 
+// label returns how the i-th file of the group is shown in reports.
+func (g DuplicateGroup) label(i int, names *PathNameCache) string {
+	return names.Label(g.Hosts[i], g.rootFolder(i), g.Files[i])
+}
+
+// rootFolder returns the root_folder of the i-th file of the group.
+func (g DuplicateGroup) rootFolder(i int) string {
+	if i < len(g.RootFolders) {
+		return g.RootFolders[i]
+	}
+	return ""
+}
+
 // formatBytes formats a byte count with thousand separators
 func formatBytes(bytes int64) string {
 	// Convert to string first
@@ -285,3 +490,94 @@ func ParseSize(sizeStr string) (int64, error) {
 
 	return int64(num * multiplier), nil
 }
+
+const (
+	sizeFormatHint     = "use plain bytes or a number with a K, M, G or T suffix (e.g. 1048576, 500M, 1.5G)"
+	durationFormatHint = "use a number with an s, m, h, d or w suffix (e.g. 90s, 30m, 12h, 7d, 2w)"
+)
+
+// ParseDuration parses a duration using Go syntax ("90m", "1h30m") plus day
+// and week suffixes ("7d", "1.5w") that time.ParseDuration does not support.
+func ParseDuration(value string) (time.Duration, error) {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return 0, fmt.Errorf("empty duration")
+	}
+
+	var unit time.Duration
+	switch value[len(value)-1] {
+	case 'd':
+		unit = 24 * time.Hour
+	case 'w':
+		unit = 7 * 24 * time.Hour
+	}
+	if unit != 0 {
+		num, err := strconv.ParseFloat(value[:len(value)-1], 64)
+		if err != nil || num < 0 {
+			return 0, fmt.Errorf("invalid duration: %s", value)
+		}
+		return time.Duration(num * float64(unit)), nil
+	}
+
+	d, err := time.ParseDuration(value)
+	if err != nil || d < 0 {
+		return 0, fmt.Errorf("invalid duration: %s", value)
+	}
+	return d, nil
+}
+
+// SizeFlag is a flag.Value holding a size parsed with ParseSize.
+type SizeFlag struct {
+	Bytes int64
+	raw   string
+}
+
+func (f *SizeFlag) String() string {
+	if f == nil {
+		return ""
+	}
+	return f.raw
+}
+
+func (f *SizeFlag) Set(value string) error {
+	bytes, err := ParseSize(value)
+	if err != nil || bytes < 0 {
+		return fmt.Errorf("invalid size %q: %s", value, sizeFormatHint)
+	}
+	f.Bytes = bytes
+	f.raw = value
+	return nil
+}
+
+// DurationFlag is a flag.Value holding a duration parsed with ParseDuration.
+// When DefaultUnit is set, a bare number is read in that unit so flags that
+// used to take plain integers (like import --age minutes) keep working.
+type DurationFlag struct {
+	Duration    time.Duration
+	DefaultUnit time.Duration
+	raw         string
+}
+
+func (f *DurationFlag) String() string {
+	if f == nil {
+		return ""
+	}
+	return f.raw
+}
+
+func (f *DurationFlag) Set(value string) error {
+	if f.DefaultUnit != 0 {
+		if n, err := strconv.ParseInt(strings.TrimSpace(value), 10, 64); err == nil && n >= 0 {
+			f.Duration = time.Duration(n) * f.DefaultUnit
+			f.raw = value
+			return nil
+		}
+	}
+	d, err := ParseDuration(value)
+	if err != nil {
+		return fmt.Errorf("invalid duration %q: %s", value, durationFormatHint)
+	}
+	f.Duration = d
+	f.raw = value
+	return nil
+}
@@ -0,0 +1,119 @@
+package files
+
+import (
+	"flag"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestNormalizeHostname(t *testing.T) {
+	tests := []struct {
+		in   string
+		want string
+	}{
+		{"backup1.local", "backup1.local"},
+		{"Backup1.Local", "backup1.local"},
+		{"  NAS-01 \n", "nas-01"},
+		{"", ""},
+	}
+	for _, tt := range tests {
+		if got := normalizeHostname(tt.in); got != tt.want {
+			t.Errorf("normalizeHostname(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestSizeFlag(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    int64
+		wantErr bool
+	}{
+		{"1048576", 1048576, false},
+		{"500M", 500 * 1024 * 1024, false},
+		{"1.5G", 1536 * 1024 * 1024, false},
+		{"10KB", 10 * 1024, false},
+		{"2t", 2 * 1024 * 1024 * 1024 * 1024, false},
+		{"1GB5", 0, true},
+		{"1.2.3G", 0, true},
+		{"lots", 0, true},
+		{"-5", 0, true},
+	}
+	for _, tt := range tests {
+		var f SizeFlag
+		err := f.Set(tt.in)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("Set(%q) expected error, got %d", tt.in, f.Bytes)
+			} else if !strings.Contains(err.Error(), "500M, 1.5G") {
+				t.Errorf("Set(%q) error %q does not list accepted formats", tt.in, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Set(%q) unexpected error: %v", tt.in, err)
+			continue
+		}
+		if f.Bytes != tt.want || f.String() != tt.in {
+			t.Errorf("Set(%q) = %d (%q), want %d", tt.in, f.Bytes, f.String(), tt.want)
+		}
+	}
+}
+
+func TestDurationFlag(t *testing.T) {
+	day := 24 * time.Hour
+	tests := []struct {
+		in          string
+		defaultUnit time.Duration
+		want        time.Duration
+		wantErr     bool
+	}{
+		{"90s", 0, 90 * time.Second, false},
+		{"1h30m", 0, 90 * time.Minute, false},
+		{"7d", 0, 7 * day, false},
+		{"1.5d", 0, 36 * time.Hour, false},
+		{"2w", 0, 14 * day, false},
+		{"30", time.Minute, 30 * time.Minute, false},
+		{"2h", time.Minute, 2 * time.Hour, false},
+		{"30", 0, 0, true},
+		{"7days", 0, 0, true},
+		{"xd", 0, 0, true},
+		{"-1h", 0, 0, true},
+		{"", 0, 0, true},
+	}
+	for _, tt := range tests {
+		f := DurationFlag{DefaultUnit: tt.defaultUnit}
+		err := f.Set(tt.in)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("Set(%q) expected error, got %s", tt.in, f.Duration)
+			} else if !strings.Contains(err.Error(), "7d, 2w") {
+				t.Errorf("Set(%q) error %q does not list accepted formats", tt.in, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Set(%q) unexpected error: %v", tt.in, err)
+			continue
+		}
+		if f.Duration != tt.want {
+			t.Errorf("Set(%q) = %s, want %s", tt.in, f.Duration, tt.want)
+		}
+	}
+}
+
+func TestSizeFlagErrorReachesFlagSet(t *testing.T) {
+	var out strings.Builder
+	fs := flag.NewFlagSet("list-dupes", flag.ContinueOnError)
+	fs.SetOutput(&out)
+	var minSize SizeFlag
+	fs.Var(&minSize, "min-size", "Minimum file size")
+
+	if err := fs.Parse([]string{"--min-size", "1GB5"}); err == nil {
+		t.Fatalf("expected parse error")
+	}
+	if !strings.Contains(out.String(), `invalid size "1GB5"`) || !strings.Contains(out.String(), "1.5G") {
+		t.Fatalf("flag output missing friendly size error: %q", out.String())
+	}
+}
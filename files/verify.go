@@ -0,0 +1,186 @@
+package files
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"time"
+
+	"deduplicator/db"
+)
+
+// DefaultVerifySample is the percentage of hashed files files verify
+// re-checks without --all.
+const DefaultVerifySample = 10.0
+
+const verifyBatchSize = 100
+
+// verifyTally counts what a files verify run found.
+type verifyTally struct {
+	verified, matched, mismatched, missing, unreadable int64
+}
+
+func (t verifyTally) record(stats *RunStats) {
+	stats.Set("verified", t.verified)
+	stats.Set("matched", t.matched)
+	stats.Set("mismatched", t.mismatched)
+	stats.Set("missing", t.missing)
+	stats.Set("unreadable", t.unreadable)
+}
+
+// VerifyFiles re-hashes a random sample of the hashed files of a host, or
+// all of them, and reports the rows whose file on disk no longer matches the
+// stored hash. It fails when any does, so scripts see a non-zero exit code.
+func VerifyFiles(ctx context.Context, sqldb *sql.DB, opts VerifyOptions) error {
+	return verifyFiles(ctx, sqldb, opts, rand.New(rand.NewSource(time.Now().UnixNano())))
+}
+
+func verifyFiles(ctx context.Context, sqldb *sql.DB, opts VerifyOptions, rng *rand.Rand) error {
+	sample := opts.SamplePercent
+	if opts.All {
+		sample = 100
+	}
+	if sample <= 0 || sample > 100 {
+		return fmt.Errorf("sample percentage must be greater than 0 and at most 100, got %g", sample)
+	}
+
+	host, err := db.ResolveHost(sqldb, opts.Server)
+	if err != nil {
+		return err
+	}
+	hostname := normalizeHostname(host.Hostname)
+	if opts.All {
+		fmt.Printf("Verifying every hashed file of %s\n", host.Name)
+	} else {
+		fmt.Printf("Verifying a %g%% sample of the hashed files of %s\n", sample, host.Name)
+	}
+
+	query := fmt.Sprintf(`
+		SELECT id, path, COALESCE(root_folder, ''), size, hash, hash_algo
+		FROM files
+		WHERE hostname = $1 AND `+NotDeleted+`
+		AND hash IS NOT NULL
+		AND COALESCE(size, 0) >= $2
+		AND id > $3
+		ORDER BY id ASC
+		LIMIT %d
+	`, verifyBatchSize)
+
+	type verifyRow struct {
+		id               int
+		path, root, hash string
+		algo             string
+		size             sql.NullInt64
+	}
+
+	var tally verifyTally
+	defer func() { tally.record(opts.Stats) }()
+	lastID := 0
+	stopped := false
+	for !stopped {
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("operation cancelled after verifying %d files", tally.verified)
+		default:
+		}
+
+		rows, err := sqldb.QueryContext(ctx, query, hostname, opts.MinSize, lastID)
+		if err != nil {
+			return fmt.Errorf("error querying hashed files: %v", err)
+		}
+		var batch []verifyRow
+		for rows.Next() {
+			var r verifyRow
+			if err := rows.Scan(&r.id, &r.path, &r.root, &r.size, &r.hash, &r.algo); err != nil {
+				rows.Close()
+				return fmt.Errorf("error scanning file row: %v", err)
+			}
+			batch = append(batch, r)
+		}
+		err = rows.Err()
+		rows.Close()
+		if err != nil {
+			return fmt.Errorf("error reading hashed files: %v", err)
+		}
+		if len(batch) == 0 {
+			break
+		}
+
+		for _, r := range batch {
+			lastID = r.id
+			if sample < 100 && rng.Float64()*100 >= sample {
+				continue
+			}
+			tally.verified++
+			fullPath := filepath.Join(r.root, r.path)
+
+			info, err := os.Stat(fullPath)
+			if os.IsNotExist(err) {
+				tally.missing++
+				fmt.Printf("MISSING     %s\n", fullPath)
+				continue
+			}
+			if err != nil {
+				tally.unreadable++
+				fmt.Printf("UNREADABLE  %s: %v\n", fullPath, err)
+				continue
+			}
+
+			var current string
+			if r.size.Valid && info.Size() != r.size.Int64 {
+				current = fmt.Sprintf("%d bytes instead of %d", info.Size(), r.size.Int64)
+			} else {
+				algo, err := ParseHashAlgo(r.algo)
+				if err != nil {
+					return fmt.Errorf("file %d: %v", r.id, err)
+				}
+				hash, err := fileHasher(algo)(hashTargetPath(fullPath))
+				if err != nil {
+					tally.unreadable++
+					fmt.Printf("UNREADABLE  %s: %v\n", fullPath, err)
+					continue
+				}
+				if hash == r.hash {
+					tally.matched++
+					continue
+				}
+				current = "hash " + hash
+			}
+
+			tally.mismatched++
+			fmt.Printf("MISMATCH    %s: stored %s, now %s\n", fullPath, r.hash, current)
+			if opts.ResetMismatched {
+				// The next files hash run picks the row up again
+				if _, err := sqldb.ExecContext(ctx, `UPDATE files SET hash = NULL, last_hashed_at = NULL, quick_hash = NULL WHERE id = $1`, r.id); err != nil {
+					return fmt.Errorf("error resetting the hash of %s: %v", fullPath, err)
+				}
+			}
+			if opts.FailFast {
+				stopped = true
+				break
+			}
+		}
+		if len(batch) < verifyBatchSize {
+			break
+		}
+	}
+
+	fmt.Printf("\nVerified    %d\n", tally.verified)
+	fmt.Printf("Matched     %d\n", tally.matched)
+	fmt.Printf("Mismatched  %d\n", tally.mismatched)
+	fmt.Printf("Missing     %d\n", tally.missing)
+	fmt.Printf("Unreadable  %d\n", tally.unreadable)
+	if stopped {
+		fmt.Println("Stopped at the first mismatch (--fail-fast)")
+	}
+	if tally.mismatched > 0 {
+		if opts.ResetMismatched {
+			fmt.Printf("Reset the hash of %d mismatched files; run files hash to repair them\n", tally.mismatched)
+		}
+		return fmt.Errorf("%d of %d verified files no longer match their stored hash", tally.mismatched, tally.verified)
+	}
+	return nil
+}
@@ -0,0 +1,122 @@
+package files
+
+import (
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"math/rand"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"lukechampine.com/blake3"
+)
+
+const verifyQueryRe = `(?s)SELECT id, path, COALESCE\(root_folder, ''\), size, hash, hash_algo\s+FROM files\s+WHERE hostname = \$1 AND deleted_at IS NULL\s+AND hash IS NOT NULL\s+AND COALESCE\(size, 0\) >= \$2\s+AND id > \$3`
+
+func expectVerifyHost(mock sqlmock.Sqlmock, root string) {
+	mock.ExpectQuery("SELECT id, name, hostname, ip, root_path, settings, created_at FROM hosts WHERE name = \\$1").
+		WithArgs("Backup1").
+		WillReturnRows(sqlmock.NewRows([]string{"id", "name", "hostname", "ip", "root_path", "settings", "created_at"}).
+			AddRow(1, "Backup1", "backup1.local", "1.1.1.1", root, []byte(`{}`), time.Now()))
+}
+
+func verifyRows() *sqlmock.Rows {
+	return sqlmock.NewRows([]string{"id", "path", "root_folder", "size", "hash", "hash_algo"})
+}
+
+func TestVerifyFilesReportsMismatchedAndMissingFiles(t *testing.T) {
+	db, mock, err := sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherRegexp))
+	if err != nil {
+		t.Fatalf("sqlmock: %v", err)
+	}
+	defer db.Close()
+
+	root := t.TempDir()
+	writeFiles(t, root, "intact", "intact.jpg")
+	writeFiles(t, root, "rotted", "rotted.jpg")
+	writeFiles(t, root, "fast", "fast.mkv")
+	intact := fmt.Sprintf("%x", sha256.Sum256([]byte("intact")))
+	fast := fmt.Sprintf("%x", blake3.Sum256([]byte("fast")))
+
+	expectVerifyHost(mock, root)
+	mock.ExpectQuery(verifyQueryRe).
+		WithArgs("backup1.local", int64(0), 0).
+		WillReturnRows(verifyRows().
+			AddRow(1, "intact.jpg", root, int64(6), intact, HashAlgoSHA256).
+			AddRow(2, "rotted.jpg", root, int64(6), intact, HashAlgoSHA256).
+			AddRow(3, "gone.jpg", root, int64(6), intact, HashAlgoSHA256).
+			AddRow(4, "fast.mkv", root, int64(4), fast, HashAlgoBLAKE3))
+	mock.ExpectExec(`UPDATE files SET hash = NULL, last_hashed_at = NULL, quick_hash = NULL WHERE id = \$1`).
+		WithArgs(2).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+
+	stats := &RunStats{}
+	out := captureStdout(t, func() {
+		err = verifyFiles(context.Background(), db, VerifyOptions{
+			Server:          "Backup1",
+			All:             true,
+			ResetMismatched: true,
+			Stats:           stats,
+		}, rand.New(rand.NewSource(1)))
+	})
+	if err == nil || err.Error() != "1 of 4 verified files no longer match their stored hash" {
+		t.Fatalf("expected the mismatch to fail the run, got %v", err)
+	}
+	for _, want := range []string{
+		"MISMATCH    " + filepath.Join(root, "rotted.jpg") + ": stored " + intact,
+		"MISSING     " + filepath.Join(root, "gone.jpg"),
+		"Verified    4\nMatched     2\nMismatched  1\nMissing     1\nUnreadable  0\n",
+		"Reset the hash of 1 mismatched files",
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("output does not contain %q:\n%s", want, out)
+		}
+	}
+	if counters := stats.Counters(); counters["verified"] != 4 || counters["mismatched"] != 1 || counters["missing"] != 1 {
+		t.Fatalf("unexpected counters %v", counters)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatalf("unmet expectations: %v", err)
+	}
+}
+
+func TestVerifyFilesSamplesAndStopsAtFirstMismatch(t *testing.T) {
+	db, mock, err := sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherRegexp))
+	if err != nil {
+		t.Fatalf("sqlmock: %v", err)
+	}
+	defer db.Close()
+
+	root := t.TempDir()
+	rows := verifyRows()
+	for id := 1; id <= 40; id++ {
+		name := fmt.Sprintf("file-%d.bin", id)
+		writeFiles(t, root, "changed", name)
+		rows.AddRow(id, name, root, int64(7), "stale", HashAlgoSHA256)
+	}
+	expectVerifyHost(mock, root)
+	mock.ExpectQuery(verifyQueryRe).
+		WithArgs("backup1.local", int64(1024), 0).
+		WillReturnRows(rows)
+
+	out := captureStdout(t, func() {
+		err = verifyFiles(context.Background(), db, VerifyOptions{
+			Server:        "Backup1",
+			SamplePercent: 50,
+			MinSize:       1024,
+			FailFast:      true,
+		}, rand.New(rand.NewSource(1)))
+	})
+	if err == nil || err.Error() != "1 of 1 verified files no longer match their stored hash" {
+		t.Fatalf("expected a single verified mismatch, got %v", err)
+	}
+	if !strings.Contains(out, "Verifying a 50% sample") || !strings.Contains(out, "Stopped at the first mismatch (--fail-fast)") {
+		t.Fatalf("unexpected output:\n%s", out)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatalf("unmet expectations: %v", err)
+	}
+}
@@ -0,0 +1,144 @@
+package files
+
+import (
+	"context"
+	"log"
+	"os"
+	"path/filepath"
+)
+
+// DefaultMaxWalkDepth bounds how deep the symlink-following walk descends.
+const DefaultMaxWalkDepth = 64
+
+// symlinkWalker walks a directory tree following directory symlinks. Each
+// directory is identified by its (device, inode) pair so a directory reached a
+// second time, whether through a symlink cycle or two links to the same
+// target, is skipped instead of being walked again.
+type symlinkWalker struct {
+	ctx          context.Context
+	followDirs   bool
+	indexTargets bool
+	maxDepth     int
+	visited      map[[2]uint64]bool
+	visitFile    func(path string, info os.FileInfo) error
+}
+
+// walkFollowingSymlinks calls visitFile for every file under root. Paths are
+// reported as reached through links, so a file behind a symlinked directory is
+// reported under the link, even when the link points outside root. File
+// symlinks are skipped unless indexTargets is set, in which case visitFile
+// gets the link path with the target's FileInfo.
+func walkFollowingSymlinks(ctx context.Context, root string, followDirs, indexTargets bool, maxDepth int, visitFile func(path string, info os.FileInfo) error) error {
+	if maxDepth <= 0 {
+		maxDepth = DefaultMaxWalkDepth
+	}
+	w := &symlinkWalker{
+		ctx:          ctx,
+		followDirs:   followDirs,
+		indexTargets: indexTargets,
+		maxDepth:     maxDepth,
+		visited:      make(map[[2]uint64]bool),
+		visitFile:    visitFile,
+	}
+	info, err := os.Stat(root)
+	if err != nil {
+		log.Printf("Warning: Error accessing path %s: %v", root, err)
+		return nil
+	}
+	return w.enterDir(root, info, 0)
+}
+
+func (w *symlinkWalker) enterDir(dir string, info os.FileInfo, depth int) error {
+	if depth > w.maxDepth {
+		log.Printf("Warning: Skipping %s: deeper than --max-depth %d", dir, w.maxDepth)
+		return nil
+	}
+	if device, inode, ok := fileIdentity(info); ok {
+		key := [2]uint64{device, inode}
+		if w.visited[key] {
+			log.Printf("Warning: Skipping %s: directory already visited (symlink cycle or duplicate link)", dir)
+			return nil
+		}
+		w.visited[key] = true
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		log.Printf("Warning: Error reading directory %s: %v", dir, err)
+		return nil
+	}
+	for _, entry := range entries {
+		select {
+		case <-w.ctx.Done():
+			return w.ctx.Err()
+		default:
+		}
+
+		path := filepath.Join(dir, entry.Name())
+		info, err := os.Lstat(path)
+		if err != nil {
+			log.Printf("Warning: Error accessing path %s: %v", path, err)
+			continue
+		}
+
+		if info.Mode()&os.ModeSymlink != 0 {
+			target, err := os.Stat(path)
+			if err != nil {
+				log.Printf("Warning: Skipping broken symlink %s: %v", path, err)
+				continue
+			}
+			if target.IsDir() {
+				if !w.followDirs {
+					continue
+				}
+				if err := w.enterDir(path, target, depth+1); err != nil {
+					return err
+				}
+				continue
+			}
+			if !w.indexTargets || !target.Mode().IsRegular() {
+				continue
+			}
+			if err := w.visitFile(path, target); err != nil {
+				return err
+			}
+			continue
+		}
+
+		if info.IsDir() {
+			if err := w.enterDir(path, info, depth+1); err != nil {
+				return err
+			}
+			continue
+		}
+		if err := w.visitFile(path, info); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// isSymlinkToRegularFile reports whether path is a symlink that resolves to a
+// regular file, the only kind of link find --index-symlink-targets indexes.
+func isSymlinkToRegularFile(path string) bool {
+	info, err := os.Lstat(path)
+	if err != nil || info.Mode()&os.ModeSymlink == 0 {
+		return false
+	}
+	target, err := os.Stat(path)
+	return err == nil && target.Mode().IsRegular()
+}
+
+// hashTargetPath returns the path whose content should be hashed for an
+// indexed file: the resolved target for symlinks to regular files, otherwise
+// path itself (so other symlinks are still rejected by calculateFileHash).
+func hashTargetPath(path string) string {
+	if !isSymlinkToRegularFile(path) {
+		return path
+	}
+	resolved, err := filepath.EvalSymlinks(path)
+	if err != nil {
+		return path
+	}
+	return resolved
+}
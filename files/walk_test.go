@@ -0,0 +1,158 @@
+package files
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func mustWrite(t *testing.T, path, content string) {
+	t.Helper()
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		t.Fatalf("mkdir: %v", err)
+	}
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+}
+
+func mustSymlink(t *testing.T, target, link string) {
+	t.Helper()
+	if err := os.MkdirAll(filepath.Dir(link), 0755); err != nil {
+		t.Fatalf("mkdir: %v", err)
+	}
+	if err := os.Symlink(target, link); err != nil {
+		t.Skipf("symlinks not supported: %v", err)
+	}
+}
+
+// collectWalk runs the symlink-following walk and returns the visited paths
+// relative to root along with their sizes.
+func collectWalk(t *testing.T, root string, followDirs, indexTargets bool, maxDepth int) map[string]int64 {
+	t.Helper()
+	seen := map[string]int64{}
+	err := walkFollowingSymlinks(context.Background(), root, followDirs, indexTargets, maxDepth, func(path string, info os.FileInfo) error {
+		rel, err := filepath.Rel(root, path)
+		if err != nil {
+			t.Fatalf("rel: %v", err)
+		}
+		if _, dup := seen[rel]; dup {
+			t.Fatalf("path visited twice: %s", rel)
+		}
+		seen[rel] = info.Size()
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("walk error: %v", err)
+	}
+	return seen
+}
+
+func sortedKeys(m map[string]int64) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func TestWalkFollowingSymlinksStopsAtCycles(t *testing.T) {
+	root := t.TempDir()
+	mustWrite(t, filepath.Join(root, "a", "file.txt"), "a")
+	// a/loop -> .. points back at root; a/self -> . points at a itself.
+	mustSymlink(t, "..", filepath.Join(root, "a", "loop"))
+	mustSymlink(t, ".", filepath.Join(root, "a", "self"))
+
+	got := sortedKeys(collectWalk(t, root, true, false, 0))
+	want := []string{filepath.Join("a", "file.txt")}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+}
+
+func TestWalkFollowingSymlinksIndexesLinksOutsideRoot(t *testing.T) {
+	store := t.TempDir()
+	root := t.TempDir()
+	mustWrite(t, filepath.Join(store, "albums", "2020", "photo.jpg"), "jpeg-bytes")
+	mustSymlink(t, filepath.Join(store, "albums"), filepath.Join(root, "albums"))
+
+	// Without --follow-symlinks the linked directory is skipped entirely.
+	if got := collectWalk(t, root, false, false, 0); len(got) != 0 {
+		t.Fatalf("expected nothing without following links, got %v", sortedKeys(got))
+	}
+
+	got := collectWalk(t, root, true, false, 0)
+	rel := filepath.Join("albums", "2020", "photo.jpg")
+	if size, ok := got[rel]; !ok || size != int64(len("jpeg-bytes")) {
+		t.Fatalf("expected %s under the link path, got %v", rel, got)
+	}
+	for p := range got {
+		if strings.HasPrefix(p, "..") {
+			t.Fatalf("path escaped root: %s", p)
+		}
+	}
+}
+
+func TestWalkFollowingSymlinksHonoursMaxDepth(t *testing.T) {
+	store := t.TempDir()
+	root := t.TempDir()
+	// Build a chain root/l1 -> store/d1, store/d1/l2 -> store/d2, ... with a
+	// file at every level.
+	const levels = 6
+	prev := root
+	for i := 1; i <= levels; i++ {
+		dir := filepath.Join(store, "d"+string(rune('0'+i)))
+		mustWrite(t, filepath.Join(dir, "f.txt"), "x")
+		mustSymlink(t, dir, filepath.Join(prev, "l"))
+		prev = dir
+	}
+
+	got := collectWalk(t, root, true, false, 3)
+	if len(got) != 3 {
+		t.Fatalf("expected 3 files within depth 3, got %v", sortedKeys(got))
+	}
+	deepest := filepath.Join("l", "l", "l", "f.txt")
+	if _, ok := got[deepest]; !ok {
+		t.Fatalf("expected %s within depth limit, got %v", deepest, sortedKeys(got))
+	}
+	if _, ok := got[filepath.Join("l", "l", "l", "l", "f.txt")]; ok {
+		t.Fatalf("walk went past the depth limit: %v", sortedKeys(got))
+	}
+
+	if all := collectWalk(t, root, true, false, 0); len(all) != levels {
+		t.Fatalf("expected all %d files with the default depth, got %v", levels, sortedKeys(all))
+	}
+}
+
+func TestWalkFollowingSymlinksFileLinks(t *testing.T) {
+	root := t.TempDir()
+	mustWrite(t, filepath.Join(root, "real.txt"), "real")
+	outside := filepath.Join(t.TempDir(), "target.bin")
+	mustWrite(t, outside, "target-content")
+	mustSymlink(t, outside, filepath.Join(root, "link.bin"))
+	mustSymlink(t, filepath.Join(root, "missing"), filepath.Join(root, "broken"))
+
+	got := collectWalk(t, root, true, false, 0)
+	if !reflect.DeepEqual(sortedKeys(got), []string{"real.txt"}) {
+		t.Fatalf("file symlinks should be skipped by default, got %v", sortedKeys(got))
+	}
+
+	got = collectWalk(t, root, true, true, 0)
+	if !reflect.DeepEqual(sortedKeys(got), []string{"link.bin", "real.txt"}) {
+		t.Fatalf("expected link indexed with --index-symlink-targets, got %v", sortedKeys(got))
+	}
+	if got["link.bin"] != int64(len("target-content")) {
+		t.Fatalf("link should carry the target's size, got %d", got["link.bin"])
+	}
+	if hashTargetPath(filepath.Join(root, "link.bin")) != outside {
+		t.Fatalf("hashTargetPath should resolve to the link target")
+	}
+	if hashTargetPath(filepath.Join(root, "real.txt")) != filepath.Join(root, "real.txt") {
+		t.Fatalf("hashTargetPath should leave regular files alone")
+	}
+}
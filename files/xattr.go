@@ -0,0 +1,105 @@
+package files
+
+import (
+	"database/sql"
+	"encoding/json"
+	"sort"
+	"unicode/utf8"
+
+	"deduplicator/db"
+	"deduplicator/logging"
+
+	"golang.org/x/sys/unix"
+)
+
+// xattrMaxSize bounds the value read for one extended attribute; ratings and
+// tags are far smaller.
+const xattrMaxSize = 64 * 1024
+
+// readXattrs returns the whitelisted extended attributes set on path. Names
+// that are missing, unreadable, or not valid UTF-8 are left out, so
+// filesystems without xattr support just yield an empty map.
+func readXattrs(path string, whitelist []string) map[string]string {
+	attrs := make(map[string]string)
+	buf := make([]byte, xattrMaxSize)
+	for _, name := range whitelist {
+		n, err := unix.Getxattr(path, name, buf)
+		if err != nil || !utf8.Valid(buf[:n]) {
+			continue
+		}
+		attrs[name] = string(buf[:n])
+	}
+	return attrs
+}
+
+// captureXattrs returns the whitelisted attributes of path as the JSON stored
+// in files.xattrs, or nil (NULL) when there are none.
+func captureXattrs(path string, whitelist []string) interface{} {
+	if len(whitelist) == 0 {
+		return nil
+	}
+	attrs := readXattrs(path, whitelist)
+	if len(attrs) == 0 {
+		return nil
+	}
+	encoded, err := json.Marshal(attrs)
+	if err != nil {
+		return nil
+	}
+	return string(encoded)
+}
+
+// missingXattrs returns the whitelisted attributes set on doomed but not on
+// keeper, which would be lost if doomed were removed. Attributes the keeper
+// already has are never overwritten.
+func missingXattrs(keeper, doomed map[string]string, whitelist []string) map[string]string {
+	missing := make(map[string]string)
+	for _, name := range whitelist {
+		value, ok := doomed[name]
+		if !ok {
+			continue
+		}
+		if _, kept := keeper[name]; kept {
+			continue
+		}
+		missing[name] = value
+	}
+	return missing
+}
+
+// mergeXattrs copies the whitelisted attributes of doomedPath that
+// keeperPath lacks onto keeperPath, before doomedPath is moved away. Both
+// must be local files. It returns the names copied; attributes the
+// filesystem refuses are skipped.
+func mergeXattrs(keeperPath, doomedPath string, whitelist []string) []string {
+	if len(whitelist) == 0 {
+		return nil
+	}
+	missing := missingXattrs(readXattrs(keeperPath, whitelist), readXattrs(doomedPath, whitelist), whitelist)
+	var merged []string
+	for name, value := range missing {
+		if err := unix.Setxattr(keeperPath, name, []byte(value), 0); err != nil {
+			logging.InfoLogger.Printf("Could not copy xattr %s onto %s: %v", name, keeperPath, err)
+			continue
+		}
+		merged = append(merged, name)
+	}
+	sort.Strings(merged)
+	return merged
+}
+
+// xattrWhitelistFor returns the xattr_whitelist of the host with hostname,
+// or nil when the host is unknown or has none configured.
+func xattrWhitelistFor(sqldb *sql.DB, hostname string) []string {
+	host, err := db.GetHostByHostname(sqldb, hostname)
+	if err != nil {
+		logging.ErrorLogger.Printf("Warning: no xattr whitelist for %s: %v", hostname, err)
+		return nil
+	}
+	whitelist, err := host.GetXattrWhitelist()
+	if err != nil {
+		logging.ErrorLogger.Printf("Warning: invalid xattr_whitelist for %s: %v", hostname, err)
+		return nil
+	}
+	return whitelist
+}
@@ -0,0 +1,81 @@
+package files
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+func TestMissingXattrsOnlyFillsGapsOnTheKeeper(t *testing.T) {
+	whitelist := []string{"user.rating", "user.xdg.tags", "user.comment"}
+	keeper := map[string]string{"user.rating": "5"}
+	doomed := map[string]string{
+		"user.rating":   "2",
+		"user.xdg.tags": "family,beach",
+		"user.private":  "not whitelisted",
+	}
+
+	got := missingXattrs(keeper, doomed, whitelist)
+	want := map[string]string{"user.xdg.tags": "family,beach"}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("missingXattrs = %v, want %v", got, want)
+	}
+	if got := missingXattrs(keeper, doomed, nil); len(got) != 0 {
+		t.Fatalf("expected nothing without a whitelist, got %v", got)
+	}
+}
+
+// xattrFile creates a file in a temporary directory and skips the test when
+// the filesystem does not take user.* attributes.
+func xattrFile(t *testing.T, name string, attrs map[string]string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte(name), 0644); err != nil {
+		t.Fatalf("write fixture: %v", err)
+	}
+	for k, v := range attrs {
+		if err := unix.Setxattr(path, k, []byte(v), 0); err != nil {
+			t.Skipf("user xattrs not supported here: %v", err)
+		}
+	}
+	return path
+}
+
+func TestMergeXattrsCopiesMissingAttributesOntoKeeper(t *testing.T) {
+	whitelist := []string{"user.rating", "user.xdg.tags"}
+	keeper := xattrFile(t, "keeper.jpg", map[string]string{"user.rating": "5"})
+	doomed := xattrFile(t, "doomed.jpg", map[string]string{"user.rating": "1", "user.xdg.tags": "beach", "user.other": "x"})
+
+	merged := mergeXattrs(keeper, doomed, whitelist)
+	if !reflect.DeepEqual(merged, []string{"user.xdg.tags"}) {
+		t.Fatalf("merged %v, want [user.xdg.tags]", merged)
+	}
+	got := readXattrs(keeper, append(whitelist, "user.other"))
+	want := map[string]string{"user.rating": "5", "user.xdg.tags": "beach"}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("keeper xattrs = %v, want %v", got, want)
+	}
+
+	if captured := captureXattrs(keeper, whitelist); captured != `{"user.rating":"5","user.xdg.tags":"beach"}` {
+		t.Fatalf("unexpected captured JSON %v", captured)
+	}
+}
+
+func TestCaptureXattrsDegradesToNull(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "plain.txt")
+	if err := os.WriteFile(path, []byte("plain"), 0644); err != nil {
+		t.Fatalf("write fixture: %v", err)
+	}
+	if got := captureXattrs(path, []string{"user.rating"}); got != nil {
+		t.Fatalf("expected NULL for a file without attributes, got %v", got)
+	}
+	if got := captureXattrs(filepath.Join(t.TempDir(), "missing"), []string{"user.rating"}); got != nil {
+		t.Fatalf("expected NULL for a missing file, got %v", got)
+	}
+	if got := mergeXattrs(path, filepath.Join(t.TempDir(), "missing"), []string{"user.rating"}); got != nil {
+		t.Fatalf("expected nothing merged from a missing file, got %v", got)
+	}
+}
@@ -3,6 +3,7 @@ package main
 import (
 	"bufio"
 	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"net/url"
@@ -21,7 +22,7 @@ import (
 )
 
 // VERSION represents the current version of the deduplicator tool
-const VERSION = "1.4.4"
+const VERSION = "1.4.117"
 
 const (
 	systemConfigPath = "/etc/dedupe/config.ini"
@@ -44,7 +45,10 @@ func main() {
 			cmd.PrintUsage(VERSION)
 			return
 		} else if os.Args[1] == "--version" || os.Args[1] == "-v" {
-			fmt.Printf("Deduplicator %s\n", VERSION)
+			if err := printVersion(os.Stdout, currentBuildInfo(), os.Args[2:]); err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				os.Exit(1)
+			}
 			return
 		}
 	}
@@ -68,6 +72,7 @@ func main() {
 
 	// Create and run application
 	app := cmd.NewApp(VERSION)
+	app.SetCommit(currentBuildInfo().Commit)
 	logging.InfoLogger.Printf("DEBUG: os.Args = %v", os.Args)
 	if err := app.HandleCommand(ctx, os.Args); err != nil {
 		logging.ErrorLogger.Fatal(err)
@@ -187,6 +192,9 @@ func hasConfigEnvironment() bool {
 // - [database]
 // - [rabbitmq]
 // - [logging]
+// - [paths]: friendly=absolute lines seeded on --auto-register
+// - [notify]: webhook_url, command and min_duration for run notifications
+// - [dedupe]: min_size, the default --min-size of list-dupes and move-dupes
 func loadConfigINI(path string) (bool, error) {
 	f, err := os.Open(path)
 	if err != nil {
@@ -223,6 +231,10 @@ func loadConfigINI(path string) (bool, error) {
 	configuredHostname := ""
 	lockDir := ""
 	localMigrateLockDir := ""
+	autoRegister := ""
+	seedPaths := map[string]string{}
+	notifyCfg := map[string]string{}
+	dedupeMinSize := ""
 
 	section := "default" // also covers lines before any [section]
 	sc := bufio.NewScanner(f)
@@ -284,6 +296,8 @@ func loadConfigINI(path string) (bool, error) {
 				lockDir = val
 			case "local_migrate_lock_dir":
 				localMigrateLockDir = val
+			case "auto_register":
+				autoRegister = val
 			}
 		case "rabbitmq":
 			switch key {
@@ -300,6 +314,22 @@ func loadConfigINI(path string) (bool, error) {
 			case "queue":
 				rmq.queue = val
 			}
+		case "paths":
+			// Keys keep their case: they are friendly path names.
+			seedPaths[strings.TrimSpace(parts[0])] = val
+		case "notify":
+			switch key {
+			case "webhook_url":
+				notifyCfg["NOTIFY_WEBHOOK_URL"] = val
+			case "command":
+				notifyCfg["NOTIFY_COMMAND"] = val
+			case "min_duration":
+				notifyCfg["NOTIFY_MIN_DURATION"] = val
+			}
+		case "dedupe":
+			if key == "min_size" {
+				dedupeMinSize = val
+			}
 		case "logging":
 			switch key {
 			case "log_file":
@@ -340,6 +370,27 @@ func loadConfigINI(path string) (bool, error) {
 		os.Setenv("LOCAL_MIGRATE_LOCK_DIR", localMigrateLockDir)
 	}
 
+	if os.Getenv("AUTO_REGISTER") == "" && autoRegister != "" {
+		os.Setenv("AUTO_REGISTER", autoRegister)
+	}
+	if os.Getenv("AUTO_REGISTER_PATHS") == "" && len(seedPaths) > 0 {
+		encoded, err := json.Marshal(seedPaths)
+		if err != nil {
+			return true, fmt.Errorf("error encoding [paths] from %s: %w", path, err)
+		}
+		os.Setenv("AUTO_REGISTER_PATHS", string(encoded))
+	}
+
+	for key, val := range notifyCfg {
+		if os.Getenv(key) == "" && val != "" {
+			os.Setenv(key, val)
+		}
+	}
+
+	if os.Getenv("DEDUPE_MIN_SIZE") == "" && dedupeMinSize != "" {
+		os.Setenv("DEDUPE_MIN_SIZE", dedupeMinSize)
+	}
+
 	if os.Getenv("RABBITMQ_HOST") == "" && rmq.host != "" {
 		os.Setenv("RABBITMQ_HOST", rmq.host)
 	}
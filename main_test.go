@@ -1,8 +1,11 @@
 package main
 
 import (
+	"bytes"
+	"encoding/json"
 	"os"
 	"path/filepath"
+	"reflect"
 	"regexp"
 	"strings"
 	"testing"
@@ -33,6 +36,38 @@ func TestVersionIsSemanticVersion(t *testing.T) {
 	}
 }
 
+func TestPrintVersionJSONIncludesBuildMetadata(t *testing.T) {
+	info := buildInfo{Version: "1.3.6", Commit: "abc1234", Built: "2024-05-01T10:00:00Z", Go: "go1.22.2"}
+	for _, args := range [][]string{{"--output", "json"}, {"--output=json"}} {
+		var out bytes.Buffer
+		if err := printVersion(&out, info, args); err != nil {
+			t.Fatalf("printVersion(%v): %v", args, err)
+		}
+		var got map[string]string
+		if err := json.Unmarshal(out.Bytes(), &got); err != nil {
+			t.Fatalf("output is not JSON: %v\n%s", err, out.String())
+		}
+		want := map[string]string{"version": "1.3.6", "commit": "abc1234", "built": "2024-05-01T10:00:00Z", "go": "go1.22.2"}
+		if !reflect.DeepEqual(got, want) {
+			t.Fatalf("printVersion(%v) = %v, want %v", args, got, want)
+		}
+	}
+}
+
+func TestPrintVersionTextMarksMissingMetadata(t *testing.T) {
+	var out bytes.Buffer
+	if err := printVersion(&out, buildInfo{Version: "1.3.6", Go: "go1.22.2"}, nil); err != nil {
+		t.Fatalf("printVersion: %v", err)
+	}
+	text := out.String()
+	if !strings.HasPrefix(text, "Deduplicator 1.3.6\n") || !strings.Contains(text, "commit: unknown") || !strings.Contains(text, "built:  unknown") {
+		t.Fatalf("unexpected version text:\n%s", text)
+	}
+	if err := printVersion(&out, buildInfo{}, []string{"--output", "yaml"}); err == nil {
+		t.Fatalf("expected an unknown output format to fail")
+	}
+}
+
 func TestLoadConfigINISupportsDefaultSectionAndNoSection(t *testing.T) {
 	tmp := t.TempDir()
 	cfgPath := filepath.Join(tmp, "config.ini")
@@ -241,3 +276,50 @@ func TestMissingConfigRejectionSkipsHelpAndHonorsEnv(t *testing.T) {
 		t.Fatal("configured environment should satisfy startup config")
 	}
 }
+
+func TestLoadConfigINISeedsAutoRegisterPaths(t *testing.T) {
+	tmp := t.TempDir()
+	cfgPath := filepath.Join(tmp, "config.ini")
+	if err := os.WriteFile(cfgPath, []byte(`
+auto_register=true
+
+[paths]
+Photos=/data/photos
+backups = /srv/backups
+`), 0644); err != nil {
+		t.Fatalf("write config: %v", err)
+	}
+
+	preserveEnv(t, "AUTO_REGISTER", "AUTO_REGISTER_PATHS")
+
+	if _, err := loadConfigINI(cfgPath); err != nil {
+		t.Fatalf("loadConfigINI: %v", err)
+	}
+
+	if got := os.Getenv("AUTO_REGISTER"); got != "true" {
+		t.Fatalf("AUTO_REGISTER=%q, want %q", got, "true")
+	}
+	if got := os.Getenv("AUTO_REGISTER_PATHS"); got != `{"Photos":"/data/photos","backups":"/srv/backups"}` {
+		t.Fatalf("AUTO_REGISTER_PATHS=%q", got)
+	}
+}
+
+func TestLoadConfigINIReadsDedupeMinSize(t *testing.T) {
+	tmp := t.TempDir()
+	cfgPath := filepath.Join(tmp, "config.ini")
+	if err := os.WriteFile(cfgPath, []byte(`
+[dedupe]
+min_size=4K
+`), 0644); err != nil {
+		t.Fatalf("write config: %v", err)
+	}
+
+	preserveEnv(t, "DEDUPE_MIN_SIZE")
+
+	if _, err := loadConfigINI(cfgPath); err != nil {
+		t.Fatalf("loadConfigINI: %v", err)
+	}
+	if got := os.Getenv("DEDUPE_MIN_SIZE"); got != "4K" {
+		t.Fatalf("DEDUPE_MIN_SIZE=%q, want %q", got, "4K")
+	}
+}
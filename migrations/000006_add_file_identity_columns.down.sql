@@ -0,0 +1,4 @@
+DROP INDEX IF EXISTS idx_files_hostname_device_inode;
+ALTER TABLE files DROP COLUMN IF EXISTS mod_time;
+ALTER TABLE files DROP COLUMN IF EXISTS inode;
+ALTER TABLE files DROP COLUMN IF EXISTS device;
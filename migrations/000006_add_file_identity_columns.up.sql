@@ -0,0 +1,6 @@
+ALTER TABLE files ADD COLUMN device BIGINT;
+ALTER TABLE files ADD COLUMN inode BIGINT;
+ALTER TABLE files ADD COLUMN mod_time TIMESTAMP;
+
+-- Lets files find look up an existing row by (device, inode) to detect renames.
+CREATE INDEX IF NOT EXISTS idx_files_hostname_device_inode ON files(hostname, device, inode) WHERE inode IS NOT NULL;
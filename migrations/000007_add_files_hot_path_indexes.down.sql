@@ -0,0 +1,4 @@
+DROP INDEX IF EXISTS idx_files_hash;
+DROP INDEX IF EXISTS idx_files_hostname_root_folder;
+DROP INDEX IF EXISTS idx_files_hostname_unhashed;
+DROP INDEX IF EXISTS idx_files_hostname_hash;
@@ -0,0 +1,31 @@
+-- Hostnames are compared with plain equality so the indexes below can be used.
+-- Fold any legacy mixed-case rows first. Hosts whose hostnames differ only by
+-- case would merge into one; they are left alone here and reported by files
+-- doctor until one is renamed.
+
+-- A mixed-case row whose path is already indexed under the lowercased (or an
+-- older mixed-case) hostname keeps its hostname, since it would collide on
+-- UNIQUE(path, hostname); 000016 soft-deletes it once files has deleted_at.
+UPDATE files m SET hostname = LOWER(m.hostname)
+WHERE m.hostname <> LOWER(m.hostname)
+AND NOT EXISTS (
+    SELECT 1 FROM files b
+    WHERE b.path = m.path
+    AND LOWER(b.hostname) = LOWER(m.hostname)
+    AND b.id <> m.id
+    AND (b.hostname = LOWER(b.hostname) OR b.id < m.id)
+)
+AND (SELECT COUNT(*) FROM hosts o WHERE LOWER(o.hostname) = LOWER(m.hostname)) <= 1;
+
+UPDATE hosts m SET hostname = LOWER(m.hostname)
+WHERE m.hostname <> LOWER(m.hostname)
+AND (SELECT COUNT(*) FROM hosts o WHERE LOWER(o.hostname) = LOWER(m.hostname)) <= 1;
+
+-- Duplicate detection CTE (hash grouping scoped to a host).
+CREATE INDEX IF NOT EXISTS idx_files_hostname_hash ON files(hostname, hash) WHERE hash IS NOT NULL;
+-- Hashing candidates (rows still waiting for a hash).
+CREATE INDEX IF NOT EXISTS idx_files_hostname_unhashed ON files(hostname, hash) WHERE hash IS NULL;
+-- Per friendly path operations (mirror, prune, group dedupe).
+CREATE INDEX IF NOT EXISTS idx_files_hostname_root_folder ON files(hostname, root_folder);
+-- Import existence check and cross-host duplicate joins.
+CREATE INDEX IF NOT EXISTS idx_files_hash ON files(hash);
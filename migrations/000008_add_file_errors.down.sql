@@ -0,0 +1,11 @@
+-- Restore sentinels for files that still have no hash, preferring
+-- TIMEOUT_ERROR when a file has both kinds of error recorded.
+UPDATE files f
+SET hash = CASE WHEN EXISTS (
+        SELECT 1 FROM file_errors t WHERE t.file_id = f.id AND t.kind = 'timeout'
+    ) THEN 'TIMEOUT_ERROR' ELSE 'HASH_ERROR' END,
+    last_hashed_at = (SELECT MAX(occurred_at) FROM file_errors m WHERE m.file_id = f.id)
+WHERE f.hash IS NULL
+AND EXISTS (SELECT 1 FROM file_errors e WHERE e.file_id = f.id);
+
+DROP TABLE IF EXISTS file_errors;
@@ -0,0 +1,24 @@
+-- Operational failures (timeouts, unreadable files, ...) live here instead of
+-- being written into files.hash, which is reserved for real content hashes.
+CREATE TABLE file_errors (
+    id SERIAL PRIMARY KEY,
+    file_id INT NOT NULL REFERENCES files(id) ON DELETE CASCADE,
+    kind TEXT NOT NULL,
+    message TEXT,
+    occurred_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    attempts INT NOT NULL DEFAULT 1,
+    UNIQUE(file_id, kind)
+);
+
+-- Move the legacy sentinel values over and clear them from the hash column.
+INSERT INTO file_errors (file_id, kind, message, occurred_at, attempts)
+SELECT id,
+    CASE hash WHEN 'TIMEOUT_ERROR' THEN 'timeout' ELSE 'hash_error' END,
+    'migrated from ' || hash || ' sentinel',
+    COALESCE(last_hashed_at, CURRENT_TIMESTAMP),
+    1
+FROM files
+WHERE hash IN ('TIMEOUT_ERROR', 'HASH_ERROR');
+
+UPDATE files SET hash = NULL, last_hashed_at = NULL
+WHERE hash IN ('TIMEOUT_ERROR', 'HASH_ERROR');
@@ -0,0 +1,2 @@
+DROP INDEX IF EXISTS idx_files_known_external_hash;
+ALTER TABLE files DROP COLUMN IF EXISTS known_external;
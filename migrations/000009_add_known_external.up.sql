@@ -0,0 +1,5 @@
+-- Set by files import-hashes for content an external backup system already
+-- holds, so list-dupes can point out groups that are covered by backups.
+ALTER TABLE files ADD COLUMN known_external BOOLEAN NOT NULL DEFAULT FALSE;
+
+CREATE INDEX IF NOT EXISTS idx_files_known_external_hash ON files(hash) WHERE known_external;
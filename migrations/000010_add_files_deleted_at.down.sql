@@ -0,0 +1,5 @@
+DELETE FROM files WHERE deleted_at IS NOT NULL;
+DROP INDEX IF EXISTS idx_files_deleted_at;
+DROP INDEX IF EXISTS idx_files_path_hostname_live;
+ALTER TABLE files ADD CONSTRAINT files_path_hostname_key UNIQUE (path, hostname);
+ALTER TABLE files DROP COLUMN IF EXISTS deleted_at;
@@ -0,0 +1,10 @@
+-- Prune, dedupe and move mark rows deleted instead of removing them, so a
+-- mistaken run can be undone with files undelete; files vacuum purges them.
+ALTER TABLE files ADD COLUMN deleted_at TIMESTAMP;
+
+-- A path may be re-indexed after its old row was soft-deleted, so uniqueness
+-- only applies to live rows.
+ALTER TABLE files DROP CONSTRAINT IF EXISTS files_path_hostname_key;
+CREATE UNIQUE INDEX IF NOT EXISTS idx_files_path_hostname_live ON files(path, hostname) WHERE deleted_at IS NULL;
+
+CREATE INDEX IF NOT EXISTS idx_files_deleted_at ON files(deleted_at) WHERE deleted_at IS NOT NULL;
@@ -0,0 +1,2 @@
+ALTER TABLE files DROP COLUMN IF EXISTS added_host_user;
+ALTER TABLE files DROP COLUMN IF EXISTS added_by;
@@ -0,0 +1,5 @@
+-- Record how each row entered the catalog: the command that inserted it
+-- (find, import, update, mirror) and the OS user it ran as. Older rows keep
+-- NULL in both.
+ALTER TABLE files ADD COLUMN added_by TEXT;
+ALTER TABLE files ADD COLUMN added_host_user TEXT;
@@ -0,0 +1 @@
+DROP TABLE IF EXISTS rehash_checkpoints;
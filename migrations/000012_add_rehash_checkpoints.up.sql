@@ -0,0 +1,16 @@
+-- files rehash-all records how far each host's full rehash got, so a run
+-- stopped by a restart or a closed time window resumes where it left off.
+-- Rows are walked by (last_hashed_at, id); cursor_hashed_at and cursor_id
+-- hold that key for the last row done.
+CREATE TABLE rehash_checkpoints (
+    hostname TEXT PRIMARY KEY,
+    algo TEXT NOT NULL,
+    started_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    cursor_hashed_at TIMESTAMP,
+    cursor_id INT NOT NULL DEFAULT 0,
+    processed BIGINT NOT NULL DEFAULT 0,
+    changed BIGINT NOT NULL DEFAULT 0,
+    failed BIGINT NOT NULL DEFAULT 0,
+    updated_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    completed_at TIMESTAMP
+);
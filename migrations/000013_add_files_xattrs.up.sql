@@ -0,0 +1,3 @@
+-- Whitelisted extended attributes (ratings, tags, ...) captured by
+-- find/import --capture-xattrs, as a JSON object of name -> value.
+ALTER TABLE files ADD COLUMN xattrs JSONB;
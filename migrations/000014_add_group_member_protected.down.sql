@@ -0,0 +1 @@
+ALTER TABLE path_group_members DROP COLUMN IF EXISTS protected;
@@ -0,0 +1,3 @@
+-- Protected group members are authoritative sources: dedupe-group never
+-- picks their copies for removal, whatever their priority.
+ALTER TABLE path_group_members ADD COLUMN protected BOOLEAN NOT NULL DEFAULT FALSE;
@@ -0,0 +1,13 @@
+-- Destructive runs (mirror, dedupe-group, local dedupe) hold a Postgres
+-- advisory lock per (host, friendly path) they touch. The lock itself says
+-- nothing about its holder, so each run also records itself here; a run that
+-- times out waiting reads this row to report who it was likely waiting for.
+CREATE TABLE path_locks (
+    lock_key BIGINT PRIMARY KEY,
+    host_name TEXT NOT NULL,
+    friendly_path TEXT NOT NULL,
+    command TEXT NOT NULL,
+    holder TEXT NOT NULL,
+    pid INT NOT NULL,
+    acquired_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
@@ -0,0 +1,3 @@
+-- The original case of folded hostnames is not kept, so there is nothing to
+-- restore; rolling back only forgets that this migration ran.
+SELECT 1;
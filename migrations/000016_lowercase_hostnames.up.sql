@@ -0,0 +1,28 @@
+-- Every write now lowercases hostnames and per-host queries compare them with
+-- plain equality, so fold the mixed-case rows written since 000007 again.
+-- Hosts whose hostnames differ only by case would merge into one; they are
+-- left alone here and reported by files doctor until one is renamed.
+
+-- A live mixed-case row is soft-deleted when the same path is already
+-- indexed under the lowercased (or an older mixed-case) hostname, since it
+-- would collide on idx_files_path_hostname_live.
+UPDATE files m SET deleted_at = NOW()
+WHERE m.deleted_at IS NULL
+AND m.hostname <> LOWER(m.hostname)
+AND EXISTS (
+    SELECT 1 FROM files b
+    WHERE b.path = m.path
+    AND LOWER(b.hostname) = LOWER(m.hostname)
+    AND b.id <> m.id
+    AND b.deleted_at IS NULL
+    AND (b.hostname = LOWER(b.hostname) OR b.id < m.id)
+)
+AND (SELECT COUNT(*) FROM hosts o WHERE LOWER(o.hostname) = LOWER(m.hostname)) <= 1;
+
+UPDATE files m SET hostname = LOWER(m.hostname)
+WHERE m.hostname <> LOWER(m.hostname)
+AND (SELECT COUNT(*) FROM hosts o WHERE LOWER(o.hostname) = LOWER(m.hostname)) <= 1;
+
+UPDATE hosts m SET hostname = LOWER(m.hostname)
+WHERE m.hostname <> LOWER(m.hostname)
+AND (SELECT COUNT(*) FROM hosts o WHERE LOWER(o.hostname) = LOWER(m.hostname)) <= 1;
@@ -0,0 +1,3 @@
+-- The algorithm that produced files.hash (sha256 or blake3). Every hash
+-- stored before this column existed is a SHA-256 digest.
+ALTER TABLE files ADD COLUMN hash_algo TEXT NOT NULL DEFAULT 'sha256';
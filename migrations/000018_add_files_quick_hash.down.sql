@@ -0,0 +1,2 @@
+DROP INDEX IF EXISTS idx_files_hostname_size_quick_hash;
+ALTER TABLE files DROP COLUMN IF EXISTS quick_hash;
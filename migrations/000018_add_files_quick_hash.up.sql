@@ -0,0 +1,5 @@
+-- A cheap hash of the size and the first and last 64KB of a file, used by
+-- files hash --prescreen to skip full hashes of files that cannot have a
+-- duplicate. NULL until computed.
+ALTER TABLE files ADD COLUMN quick_hash TEXT;
+CREATE INDEX IF NOT EXISTS idx_files_hostname_size_quick_hash ON files(hostname, size, quick_hash) WHERE deleted_at IS NULL;
@@ -0,0 +1,13 @@
+-- files hash records how far a run got, so an interrupted run over a large
+-- host resumes where it left off. A checkpoint belongs to one host and one
+-- set of hash options; cursor_id, cursor_size and cursor_priority hold the
+-- keyset bookmark of the last file done.
+CREATE TABLE hash_checkpoints (
+    hostname TEXT NOT NULL,
+    options TEXT NOT NULL,
+    cursor_id INT NOT NULL DEFAULT 0,
+    cursor_size BIGINT,
+    cursor_priority INT,
+    updated_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    PRIMARY KEY (hostname, options)
+);
@@ -0,0 +1,5 @@
+-- How long the last full hash of a file took, in milliseconds, recorded by
+-- files hash, rehash-all and process. files stats --slowest uses it to find
+-- slow files and root folders on failing disks. NULL until a file is hashed
+-- again after this migration.
+ALTER TABLE files ADD COLUMN hash_duration_ms BIGINT;
@@ -0,0 +1,3 @@
+-- Read-only group members are archive mounts that must never be modified:
+-- dedupe-group never removes their copies and mirror-group never writes to them.
+ALTER TABLE path_group_members ADD COLUMN read_only BOOLEAN NOT NULL DEFAULT FALSE;
@@ -16,6 +16,31 @@ import (
 type VersionUpdate struct {
 	Version   string    `json:"version"`
 	Timestamp time.Time `json:"timestamp"`
+	// Commit is the build the publisher runs, when it publishes its own
+	// version. Older publishers omit it.
+	Commit string `json:"commit,omitempty"`
+	// Force asks instances running the same version from another commit to
+	// shut down too, so rebuilds can be rolled out while testing.
+	Force bool `json:"force,omitempty"`
+}
+
+// shouldShutdown reports whether an instance running current (built from
+// commit) should exit for update: when update is newer, or when it is the
+// same version forced out by a publisher built from a different commit.
+func shouldShutdown(current *semver.Version, commit string, update VersionUpdate) (bool, error) {
+	newVer, err := semver.NewVersion(update.Version)
+	if err != nil {
+		return false, fmt.Errorf("error parsing new version %s: %v", update.Version, err)
+	}
+	if newVer.GreaterThan(current) {
+		return true, nil
+	}
+	if newVer.Equal(current) && update.Force {
+		// Without both commits there is no telling the builds apart, and a
+		// forced update is what was asked for.
+		return commit == "" || update.Commit == "" || update.Commit != commit, nil
+	}
+	return false, nil
 }
 
 // RabbitMQ holds the connection and channel information
@@ -24,10 +49,11 @@ type RabbitMQ struct {
 	channel *amqp.Channel
 	queue   amqp.Queue
 	version string // Current version of the running instance
+	commit  string // Build commit of the running instance, if known
 }
 
 // NewRabbitMQ creates a new RabbitMQ connection using environment variables
-func NewRabbitMQ(currentVersion string) (*RabbitMQ, error) {
+func NewRabbitMQ(currentVersion, currentCommit string) (*RabbitMQ, error) {
 	host := os.Getenv("RABBITMQ_HOST")
 	port := os.Getenv("RABBITMQ_PORT")
 	user := os.Getenv("RABBITMQ_USER")
@@ -106,6 +132,7 @@ func NewRabbitMQ(currentVersion string) (*RabbitMQ, error) {
 		channel: ch,
 		queue:   q,
 		version: currentVersion,
+		commit:  currentCommit,
 	}, nil
 }
 
@@ -164,18 +191,18 @@ func (r *RabbitMQ) ListenForUpdates(ctx context.Context) chan struct{} {
 					continue
 				}
 
-				newVer, err := semver.NewVersion(update.Version)
+				shutdownNow, err := shouldShutdown(currentVer, r.commit, update)
 				if err != nil {
-					log.Printf("Error parsing new version %s: %v", update.Version, err)
+					log.Printf("%v", err)
 					continue
 				}
 
 				log.Printf("Received version update notification: version %s at %s",
 					update.Version, update.Timestamp)
 
-				if newVer.GreaterThan(currentVer) {
-					log.Printf("New version %s is newer than current version %s, initiating shutdown",
-						update.Version, r.version)
+				if shutdownNow {
+					log.Printf("Version %s (commit %s, force %t) replaces current version %s (commit %s), initiating shutdown",
+						update.Version, update.Commit, update.Force, r.version, r.commit)
 					// Acknowledge the message before shutting down
 					if err := msg.Ack(false); err != nil {
 						log.Printf("Error acknowledging message: %v", err)
@@ -197,8 +224,10 @@ func (r *RabbitMQ) ListenForUpdates(ctx context.Context) chan struct{} {
 	return shutdown
 }
 
-// PublishVersionUpdate sends a version update message to the queue
-func (r *RabbitMQ) PublishVersionUpdate(ctx context.Context, version string) error {
+// PublishVersionUpdate sends a version update message to the queue. commit
+// may be empty; force asks instances on the same version from another
+// commit to shut down as well.
+func (r *RabbitMQ) PublishVersionUpdate(ctx context.Context, version, commit string, force bool) error {
 	// Validate that the version string is a valid semantic version
 	_, err := semver.NewVersion(version)
 	if err != nil {
@@ -208,6 +237,8 @@ func (r *RabbitMQ) PublishVersionUpdate(ctx context.Context, version string) err
 	update := VersionUpdate{
 		Version:   version,
 		Timestamp: time.Now(),
+		Commit:    commit,
+		Force:     force,
 	}
 
 	body, err := json.Marshal(update)
@@ -229,6 +260,6 @@ func (r *RabbitMQ) PublishVersionUpdate(ctx context.Context, version string) err
 		return fmt.Errorf("failed to publish version update: %v", err)
 	}
 
-	log.Printf("Published version update: %s", version)
+	log.Printf("Published version update: %s (commit %s, force %t)", version, commit, force)
 	return nil
 }
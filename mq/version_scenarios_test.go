@@ -3,6 +3,7 @@ package mq
 import (
 	"context"
 	"encoding/json"
+	"strings"
 	"testing"
 	"time"
 
@@ -23,7 +24,7 @@ func (a *ackRecorder) Reject(uint64, bool) error     { return nil }
 
 func TestPublishVersionUpdateRejectsInvalidSemver(t *testing.T) {
 	rabbit := &RabbitMQ{}
-	if err := rabbit.PublishVersionUpdate(context.Background(), "not-a-semver"); err == nil {
+	if err := rabbit.PublishVersionUpdate(context.Background(), "not-a-semver", "", false); err == nil {
 		t.Fatalf("expected invalid semver to fail")
 	}
 }
@@ -73,3 +74,48 @@ func TestListenerLogicAcksAndShutsDownOnNewerVersion(t *testing.T) {
 		t.Fatalf("unexpected ack order: %+v", recorder.acks)
 	}
 }
+
+func TestShouldShutdownOnEqualVersionOnlyWhenForcedFromAnotherCommit(t *testing.T) {
+	current, err := semver.NewVersion("1.3.6")
+	if err != nil {
+		t.Fatalf("parse current version: %v", err)
+	}
+
+	for _, tc := range []struct {
+		name   string
+		commit string
+		update VersionUpdate
+		want   bool
+	}{
+		{name: "newer", commit: "aaa", update: VersionUpdate{Version: "1.3.7"}, want: true},
+		{name: "older forced", commit: "aaa", update: VersionUpdate{Version: "1.3.5", Commit: "bbb", Force: true}, want: false},
+		{name: "equal other commit unforced", commit: "aaa", update: VersionUpdate{Version: "1.3.6", Commit: "bbb"}, want: false},
+		{name: "equal other commit forced", commit: "aaa", update: VersionUpdate{Version: "1.3.6", Commit: "bbb", Force: true}, want: true},
+		{name: "equal same commit forced", commit: "aaa", update: VersionUpdate{Version: "1.3.6", Commit: "aaa", Force: true}, want: false},
+		{name: "equal forced without commit", commit: "aaa", update: VersionUpdate{Version: "1.3.6", Force: true}, want: true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := shouldShutdown(current, tc.commit, tc.update)
+			if err != nil {
+				t.Fatalf("shouldShutdown: %v", err)
+			}
+			if got != tc.want {
+				t.Fatalf("shouldShutdown = %t, want %t", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestVersionUpdateDecodesMessagesWithoutCommit(t *testing.T) {
+	var update VersionUpdate
+	if err := json.Unmarshal([]byte(`{"version":"1.3.6","timestamp":"2024-05-01T10:00:00Z"}`), &update); err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	if update.Commit != "" || update.Force {
+		t.Fatalf("old message decoded as %+v", update)
+	}
+	body, _ := json.Marshal(VersionUpdate{Version: "1.3.6"})
+	if strings.Contains(string(body), "commit") || strings.Contains(string(body), "force") {
+		t.Fatalf("unset optional fields are encoded: %s", body)
+	}
+}
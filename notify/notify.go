@@ -0,0 +1,144 @@
+package notify
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// DefaultMinDuration is how long a successful run must take before it is
+// reported, so short interactive runs stay quiet.
+const DefaultMinDuration = 10 * time.Minute
+
+const (
+	webhookTimeout = 10 * time.Second
+	commandTimeout = time.Minute
+)
+
+// Result is the summary of a finished run, sent as JSON.
+type Result struct {
+	Command         string           `json:"command"`
+	Host            string           `json:"host"`
+	Version         string           `json:"version"`
+	StartedAt       time.Time        `json:"started_at"`
+	DurationSeconds float64          `json:"duration_seconds"`
+	Success         bool             `json:"success"`
+	Error           string           `json:"error,omitempty"`
+	Counters        map[string]int64 `json:"counters,omitempty"`
+}
+
+// NewResult builds the summary of a run that started at started and ended
+// with err.
+func NewResult(command, version string, started time.Time, counters map[string]int64, err error) Result {
+	host, _ := os.Hostname()
+	r := Result{
+		Command:         command,
+		Host:            strings.ToLower(host),
+		Version:         version,
+		StartedAt:       started,
+		DurationSeconds: time.Since(started).Seconds(),
+		Success:         err == nil,
+		Counters:        counters,
+	}
+	if err != nil {
+		r.Error = err.Error()
+	}
+	return r
+}
+
+// Notifier posts run summaries to a webhook and/or pipes them to a command.
+type Notifier struct {
+	WebhookURL  string        // POST the summary as JSON (NOTIFY_WEBHOOK_URL)
+	Command     string        // Run through sh -c with the summary on stdin (NOTIFY_COMMAND)
+	MinDuration time.Duration // Successful runs shorter than this are not reported
+	Client      *http.Client  // Defaults to a client with a short timeout
+}
+
+// FromEnv returns a Notifier configured from NOTIFY_WEBHOOK_URL and
+// NOTIFY_COMMAND, or nil if neither is set.
+func FromEnv(minDuration time.Duration) *Notifier {
+	n := &Notifier{
+		WebhookURL:  strings.TrimSpace(os.Getenv("NOTIFY_WEBHOOK_URL")),
+		Command:     strings.TrimSpace(os.Getenv("NOTIFY_COMMAND")),
+		MinDuration: minDuration,
+	}
+	if n.WebhookURL == "" && n.Command == "" {
+		return nil
+	}
+	return n
+}
+
+// ShouldNotify reports whether r is worth a notification: every failure, and
+// successes that ran for at least MinDuration.
+func (n *Notifier) ShouldNotify(r Result) bool {
+	if n == nil {
+		return false
+	}
+	return !r.Success || r.DurationSeconds >= n.MinDuration.Seconds()
+}
+
+// Notify sends r to every configured target. Each target gets its own
+// timeout; the errors of all targets are joined.
+func (n *Notifier) Notify(ctx context.Context, r Result) error {
+	payload, err := json.Marshal(r)
+	if err != nil {
+		return fmt.Errorf("error encoding notification: %v", err)
+	}
+
+	var errs []error
+	if n.WebhookURL != "" {
+		if err := n.post(ctx, payload); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if n.Command != "" {
+		if err := n.run(ctx, payload); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (n *Notifier) post(ctx context.Context, payload []byte) error {
+	ctx, cancel := context.WithTimeout(ctx, webhookTimeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, n.WebhookURL, bytes.NewReader(payload))
+	if err != nil {
+		return fmt.Errorf("error creating webhook request: %v", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	client := n.Client
+	if client == nil {
+		client = &http.Client{Timeout: webhookTimeout}
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("error posting to webhook: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("webhook returned %s", resp.Status)
+	}
+	return nil
+}
+
+func (n *Notifier) run(ctx context.Context, payload []byte) error {
+	ctx, cancel := context.WithTimeout(ctx, commandTimeout)
+	defer cancel()
+
+	cmd := exec.CommandContext(ctx, "sh", "-c", n.Command)
+	cmd.Stdin = bytes.NewReader(payload)
+	if output, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("error running notify command: %v\nOutput: %s", err, strings.TrimSpace(string(output)))
+	}
+	return nil
+}
@@ -0,0 +1,120 @@
+package notify
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestShouldNotify(t *testing.T) {
+	n := &Notifier{MinDuration: 10 * time.Minute}
+	cases := []struct {
+		name   string
+		result Result
+		want   bool
+	}{
+		{"short success", Result{Success: true, DurationSeconds: 30}, false},
+		{"long success", Result{Success: true, DurationSeconds: 601}, true},
+		{"short failure", Result{Success: false, DurationSeconds: 1}, true},
+	}
+	for _, tc := range cases {
+		if got := n.ShouldNotify(tc.result); got != tc.want {
+			t.Errorf("%s: ShouldNotify = %v, want %v", tc.name, got, tc.want)
+		}
+	}
+	var none *Notifier
+	if none.ShouldNotify(Result{}) {
+		t.Error("a nil notifier should never notify")
+	}
+}
+
+func TestFromEnv(t *testing.T) {
+	t.Setenv("NOTIFY_WEBHOOK_URL", "")
+	t.Setenv("NOTIFY_COMMAND", "")
+	if n := FromEnv(time.Minute); n != nil {
+		t.Fatalf("expected no notifier without configuration, got %+v", n)
+	}
+	t.Setenv("NOTIFY_COMMAND", "cat")
+	n := FromEnv(time.Minute)
+	if n == nil || n.Command != "cat" || n.MinDuration != time.Minute {
+		t.Fatalf("unexpected notifier: %+v", n)
+	}
+}
+
+func TestNotifyPostsJSONToWebhook(t *testing.T) {
+	var got Result
+	var contentType string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		contentType = r.Header.Get("Content-Type")
+		body, _ := io.ReadAll(r.Body)
+		if err := json.Unmarshal(body, &got); err != nil {
+			t.Errorf("decode body: %v", err)
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer srv.Close()
+
+	n := &Notifier{WebhookURL: srv.URL}
+	r := NewResult("files hash", "1.0.0", time.Now().Add(-time.Hour), map[string]int64{"processed": 42}, errors.New("disk full"))
+	if err := n.Notify(context.Background(), r); err != nil {
+		t.Fatalf("Notify: %v", err)
+	}
+	if contentType != "application/json" {
+		t.Errorf("Content-Type = %q", contentType)
+	}
+	if got.Command != "files hash" || got.Success || got.Error != "disk full" || got.Counters["processed"] != 42 {
+		t.Fatalf("unexpected payload: %+v", got)
+	}
+	if got.DurationSeconds < 3600 {
+		t.Fatalf("expected the duration to cover the hour, got %v", got.DurationSeconds)
+	}
+}
+
+func TestNotifyReportsWebhookErrorStatus(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadGateway)
+	}))
+	defer srv.Close()
+
+	n := &Notifier{WebhookURL: srv.URL}
+	err := n.Notify(context.Background(), Result{Command: "files find", Success: true})
+	if err == nil || !strings.Contains(err.Error(), "502") {
+		t.Fatalf("expected the status in the error, got %v", err)
+	}
+}
+
+func TestNotifyPipesJSONToCommand(t *testing.T) {
+	out := filepath.Join(t.TempDir(), "summary.json")
+	n := &Notifier{Command: "cat > " + out}
+	if err := n.Notify(context.Background(), Result{Command: "files prune", Success: true, Counters: map[string]int64{"checked": 7}}); err != nil {
+		t.Fatalf("Notify: %v", err)
+	}
+
+	data, err := os.ReadFile(out)
+	if err != nil {
+		t.Fatalf("read summary: %v", err)
+	}
+	var got Result
+	if err := json.Unmarshal(data, &got); err != nil {
+		t.Fatalf("decode summary: %v", err)
+	}
+	if got.Command != "files prune" || !got.Success || got.Counters["checked"] != 7 {
+		t.Fatalf("unexpected summary: %+v", got)
+	}
+}
+
+func TestNotifyReportsCommandFailure(t *testing.T) {
+	n := &Notifier{Command: "echo boom >&2; exit 3"}
+	err := n.Notify(context.Background(), Result{Command: "files import"})
+	if err == nil || !strings.Contains(err.Error(), "boom") {
+		t.Fatalf("expected the command output in the error, got %v", err)
+	}
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"runtime"
+	"runtime/debug"
+	"strings"
+)
+
+// Build metadata, injected at build time:
+//
+//	go build -ldflags "-X main.commit=$(git rev-parse --short HEAD) -X main.buildDate=$(date -u +%Y-%m-%dT%H:%M:%SZ)"
+//
+// When left empty they fall back to the VCS stamp Go embeds in the binary.
+var (
+	commit    string
+	buildDate string
+)
+
+// buildInfo is what --version reports.
+type buildInfo struct {
+	Version string `json:"version"`
+	Commit  string `json:"commit"`
+	Built   string `json:"built"`
+	Go      string `json:"go"`
+}
+
+// currentBuildInfo returns the metadata of the running binary. Commit and
+// Built are empty when neither ldflags nor the VCS stamp provide them.
+func currentBuildInfo() buildInfo {
+	info := buildInfo{Version: VERSION, Commit: commit, Built: buildDate, Go: runtime.Version()}
+	if bi, ok := debug.ReadBuildInfo(); ok {
+		for _, s := range bi.Settings {
+			switch {
+			case s.Key == "vcs.revision" && info.Commit == "":
+				info.Commit = s.Value
+			case s.Key == "vcs.time" && info.Built == "":
+				info.Built = s.Value
+			}
+		}
+	}
+	return info
+}
+
+// printVersion writes info for --version; args are the arguments after it,
+// where "--output json" selects the machine-readable form.
+func printVersion(w io.Writer, info buildInfo, args []string) error {
+	output := "text"
+	for i := 0; i < len(args); i++ {
+		switch {
+		case args[i] == "--output" && i+1 < len(args):
+			output = args[i+1]
+			i++
+		case strings.HasPrefix(args[i], "--output="):
+			output = strings.TrimPrefix(args[i], "--output=")
+		default:
+			return fmt.Errorf("unknown --version option: %s", args[i])
+		}
+	}
+
+	if info.Commit == "" {
+		info.Commit = "unknown"
+	}
+	if info.Built == "" {
+		info.Built = "unknown"
+	}
+	switch output {
+	case "text":
+		fmt.Fprintf(w, "Deduplicator %s\n", info.Version)
+		fmt.Fprintf(w, "  commit: %s\n", info.Commit)
+		fmt.Fprintf(w, "  built:  %s\n", info.Built)
+		fmt.Fprintf(w, "  go:     %s\n", info.Go)
+		return nil
+	case "json":
+		return json.NewEncoder(w).Encode(info)
+	default:
+		return fmt.Errorf("invalid --output %q (expected text or json)", output)
+	}
+}
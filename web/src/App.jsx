@@ -149,6 +149,9 @@ function App() {
                 <td>
                   <div className="path-cell">{file.path}</div>
                   <div className="full-path">{file.fullPath || file.path}</div>
+                  {file.addedBy ? (
+                    <div className="full-path">added by {file.addedBy}{file.addedHostUser ? ` (${file.addedHostUser})` : ''}</div>
+                  ) : null}
                 </td>
                 <td>{file.rootFolder}</td>
                 <td>{formatBytes(file.size)}</td>